@@ -86,6 +86,7 @@ print_yellow "Cleaning up Kerberos credential caches..."
 
 # Clear FILE-based credential caches
 sudo rm -f /tmp/krb5cc*
+sudo rm -rf /var/lib/krb5-cc
 
 print_yellow "Note: This removes ALL FILE-based credential caches including system ones - they will be recreated on next deploy"
 
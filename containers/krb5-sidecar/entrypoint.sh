@@ -8,14 +8,50 @@ set -eu
 USERNAME=${KERBEROS_USER:-user10002}
 REALM=${KERBEROS_REALM:-EXAMPLE.COM}
 KERBEROS_RENEWAL_TIME=${KERBEROS_RENEWAL_TIME:-86400}
+# Group the credential cache is shared with, from the kerberos-gids annotation
+KERBEROS_CCACHE_GROUP=${KERBEROS_CCACHE_GROUP:-}
 USER_ID=$(id -u)
 export KRB5CCNAME=${KRB5CCNAME:-"FILE:/tmp/krb5cc_${USER_ID}"}
 
+# kinit writes the cache 0600 with our primary group, share it with the group
+# of the kerberos-gids annotation again
+share_ccache() {
+    if [[ -n "${KERBEROS_CCACHE_GROUP}" && "${KRB5CCNAME}" == FILE:* ]]; then
+        chgrp "${KERBEROS_CCACHE_GROUP}" "${KRB5CCNAME#FILE:}"
+        chmod 640 "${KRB5CCNAME#FILE:}"
+    fi
+}
+
+# KERBEROS_RENEWAL_TIME in seconds, or as hours, minutes and seconds like 1h30m,
+# as the NRI plugin takes it
+renewal_seconds() {
+    local value=$1 total=0
+    if [[ "${value}" =~ ^[0-9]+$ ]]; then
+        echo "${value}"
+        return
+    fi
+    while [[ "${value}" =~ ^([0-9]+)([hms])(.*)$ ]]; do
+        case "${BASH_REMATCH[2]}" in
+            h) total=$((total + BASH_REMATCH[1] * 3600)) ;;
+            m) total=$((total + BASH_REMATCH[1] * 60)) ;;
+            s) total=$((total + BASH_REMATCH[1])) ;;
+        esac
+        value=${BASH_REMATCH[3]}
+    done
+    if [[ -n "${value}" || ${total} -eq 0 ]]; then
+        echo "Invalid KERBEROS_RENEWAL_TIME ${1}, must be seconds or a duration like 1h30m" >&2
+        exit 1
+    fi
+    echo "${total}"
+}
+KERBEROS_RENEWAL_TIME=$(renewal_seconds "${KERBEROS_RENEWAL_TIME}")
+
 echo "Starting Kerberos sidecar for ${USERNAME}@${REALM}"
 
 # Use FILE-based credential cache
 echo "Using FILE credential cache: ${KRB5CCNAME}"
 
+share_ccache
 echo "Initial tickets:"
 klist
 
@@ -26,10 +62,12 @@ while true; do
     echo "Renewing Kerberos credentials..."
     if kinit -R; then
         echo "✓ Credentials renewed successfully"
+        share_ccache
     else
         echo "⚠ Renewal failed, getting fresh ticket..."
         if kinit -k -t "/etc/keytabs/${USERNAME}.keytab" "${USERNAME}@${REALM}"; then
             echo "✓ Fresh ticket obtained"
+            share_ccache
         else
             echo "✗ Failed to get fresh ticket"
             exit 1
@@ -69,9 +69,15 @@ print_yellow "Build Kerberos sidecar Docker image..."
 docker build -t krb5-sidecar:latest containers/krb5-sidecar/
 print_green "✓ Kerberos sidecar image built"
 
+# Build image of the cluster components of the NRI plugin
+print_yellow "Build NRI kerberos cluster components Docker image..."
+docker build -t nri-kerberos:latest -f containers/nri-kerberos/Dockerfile .
+print_green "✓ NRI kerberos cluster components image built"
+
 # Import images to containerd for Kubernetes
 docker save nfs-kerberos-client:latest | sudo ctr -n k8s.io images import -
 docker save krb5-sidecar:latest | sudo ctr -n k8s.io images import -
+docker save nri-kerberos:latest | sudo ctr -n k8s.io images import -
 print_green "✓ Images imported to containerd"
 
 # Check if cluster is already running
@@ -206,7 +212,7 @@ sudo mkdir -p /opt/nri-hooks /opt/nri/plugins
 
 print_yellow "Building NRI kerberos plugin..."
 cd "${SCRIPT_DIR}"/nri-plugin
-go build ./kerberos.go
+go build -o kerberos .
 
 # Install the hook-injector plugin
 sudo cp ./kerberos /opt/nri/plugins/10-kerberos
@@ -244,6 +250,26 @@ print_green "✓ Critical daemons restarted"
 kubectl apply -f k8s-manifests/storageclass.yaml
 print_green "✓ Storage class deployed"
 
+kubectl apply -f k8s-manifests/kerberosidentity-crd.yaml
+kubectl apply -f k8s-manifests/kerberosticket-crd.yaml
+kubectl apply -f k8s-manifests/kerberos-controller.yaml
+print_green "✓ KerberosIdentity CRD and controller deployed"
+
+# Self-signed serving certificate for the admission webhook
+WEBHOOK_TLS_DIR=$(mktemp -d)
+openssl req -x509 -newkey rsa:2048 -nodes -days 365 \
+    -keyout "${WEBHOOK_TLS_DIR}/tls.key" -out "${WEBHOOK_TLS_DIR}/tls.crt" \
+    -subj "/CN=kerberos-webhook.nri-kerberos.svc" \
+    -addext "subjectAltName=DNS:kerberos-webhook.nri-kerberos.svc" &> /dev/null
+kubectl -n nri-kerberos create secret tls kerberos-webhook-tls \
+    --cert="${WEBHOOK_TLS_DIR}/tls.crt" --key="${WEBHOOK_TLS_DIR}/tls.key" \
+    --dry-run=client -o yaml | kubectl apply -f -
+CA_BUNDLE=$(base64 -w0 < "${WEBHOOK_TLS_DIR}/tls.crt")
+sed "s|\${CA_BUNDLE}|${CA_BUNDLE}|" k8s-manifests/kerberos-webhook.yaml | kubectl apply -f -
+kubectl -n nri-kerberos rollout restart deployment kerberos-webhook
+rm -rf "${WEBHOOK_TLS_DIR}"
+print_green "✓ Sidecar injection webhook deployed"
+
 # Deploy PVs dynamically with correct NFS hostname
 for user in "${USERS[@]}"; do
     cat <<EOF | kubectl apply -f -
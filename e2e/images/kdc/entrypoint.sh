@@ -0,0 +1,67 @@
+#!/usr/bin/env bash
+
+# KDC of the e2e suite: creates a realm with the NFS service and user
+# principals, serves their keytabs and krb5.conf over HTTP on port 8080 as
+# vm-scripts/install-kdc.sh does, and runs krb5kdc in the foreground
+
+set -euo pipefail
+
+REALM=${REALM:-EXAMPLE.COM}
+KDC_HOSTNAME=${KDC_HOSTNAME:-kdc.e2e.test}
+NFS_HOSTNAME=${NFS_HOSTNAME:-nfs.e2e.test}
+read -r -a USERS <<< "${USERS:-user10002}"
+KDC_PASSWORD=$(head -c 18 /dev/urandom | base64)
+
+cat > /etc/krb5.conf <<CONF
+[libdefaults]
+    default_realm = ${REALM}
+    dns_lookup_realm = false
+    dns_lookup_kdc = false
+    rdns = false
+    ticket_lifetime = 1h
+    renew_lifetime = 2h
+
+[realms]
+    ${REALM} = {
+        kdc = ${KDC_HOSTNAME}
+        admin_server = ${KDC_HOSTNAME}
+    }
+
+[domain_realm]
+    .e2e.test = ${REALM}
+    e2e.test = ${REALM}
+CONF
+
+mkdir -p /etc/krb5kdc /var/lib/krb5kdc
+cat > /etc/krb5kdc/kdc.conf <<CONF
+[kdcdefaults]
+    kdc_ports = 88
+    kdc_tcp_ports = 88
+
+[realms]
+    ${REALM} = {
+        database_name = /var/lib/krb5kdc/principal
+        key_stash_file = /etc/krb5kdc/stash
+        max_life = 1h
+        max_renewable_life = 2h
+        supported_enctypes = aes256-cts:normal aes128-cts:normal
+    }
+
+[logging]
+    kdc = STDERR
+CONF
+
+kdb5_util create -s -r "${REALM}" -P "${KDC_PASSWORD}"
+
+mkdir -p /srv/keytabs
+kadmin.local -q "addprinc -randkey nfs/${NFS_HOSTNAME}@${REALM}"
+kadmin.local -q "ktadd -k /srv/keytabs/nfs.keytab nfs/${NFS_HOSTNAME}@${REALM}"
+for user in "${USERS[@]}"; do
+    kadmin.local -q "addprinc -pw password ${user}@${REALM}"
+    kadmin.local -q "ktadd -k /srv/keytabs/${user}.keytab ${user}@${REALM}"
+done
+chmod 644 /srv/keytabs/*.keytab
+cp /etc/krb5.conf /srv/krb5.conf
+
+python3 -m http.server 8080 --directory /srv &
+exec krb5kdc -n
@@ -0,0 +1,60 @@
+#!/usr/bin/env bash
+
+# Kerberized NFSv4 server of the e2e suite: fetches its keytab and krb5.conf
+# from the KDC, exports the home directories of the users with sec=krb5p as
+# vm-scripts/install-nfs.sh does, and runs knfsd until stopped. Needs a
+# privileged pod and the nfsd module loaded on the host.
+
+set -euo pipefail
+
+KDC_HOSTNAME=${KDC_HOSTNAME:-kdc.e2e.test}
+DOMAIN=${DOMAIN:-example.com}
+read -r -a USERS <<< "${USERS:-user10002}"
+
+until curl -fsS -o /etc/krb5.conf "http://${KDC_HOSTNAME}:8080/krb5.conf"; do
+    echo "Waiting for the KDC at ${KDC_HOSTNAME}..."
+    sleep 2
+done
+curl -fsS -o /etc/krb5.keytab "http://${KDC_HOSTNAME}:8080/keytabs/nfs.keytab"
+chmod 600 /etc/krb5.keytab
+
+mkdir -p /export/home
+echo "/export *(rw,sync,no_subtree_check,fsid=0,sec=krb5p)" > /etc/exports
+for user in "${USERS[@]}"; do
+    uid=${user#user}
+    gid=$((uid - 5000))
+    groupadd -g "${gid}" "group${gid}" || true
+    useradd -u "${uid}" -g "${gid}" -M -d "/export/home/${user}" "${user}" || true
+    mkdir -p "/export/home/${user}"
+    chown "${uid}:${gid}" "/export/home/${user}"
+    chmod 700 "/export/home/${user}"
+    echo "/export/home/${user} *(rw,sync,no_subtree_check,sec=krb5p)" >> /etc/exports
+done
+
+cat > /etc/idmapd.conf <<CONF
+[General]
+Domain = ${DOMAIN}
+
+[Mapping]
+Nobody-User = nobody
+Nobody-Group = nogroup
+CONF
+
+mountpoint -q /proc/fs/nfsd || mount -t nfsd nfsd /proc/fs/nfsd
+mkdir -p /var/lib/nfs/rpc_pipefs
+mountpoint -q /var/lib/nfs/rpc_pipefs || mount -t rpc_pipefs sunrpc /var/lib/nfs/rpc_pipefs
+
+stop() {
+    rpc.nfsd 0 || true
+    exportfs -ua || true
+    exit 0
+}
+trap stop TERM INT
+
+rpcbind -w
+rpc.idmapd
+rpc.svcgssd
+exportfs -ra
+rpc.nfsd -N 2 -N 3 8
+rpc.mountd -N 2 -N 3 -F &
+wait $!
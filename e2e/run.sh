@@ -0,0 +1,207 @@
+#!/usr/bin/env bash
+# End-to-end test of the Kerberos NRI plugin on kind
+#
+# Creates a kind cluster with NRI enabled, runs a KDC and a Kerberized knfsd in
+# it, deploys the plugin as a DaemonSet and checks that a pod of user10002 can
+# write and read its NFS home directory mounted with sec=krb5p, with the
+# credentials the plugin obtained for it.
+#
+# Needs docker, kind and kubectl, and the nfsd and rpcsec_gss_krb5 modules on
+# the host. E2E_KEEP=1 keeps the cluster afterwards, E2E_CLUSTER names it,
+# E2E_NODE_IMAGE sets the kind node image and E2E_IP_FAMILY=ipv6 runs the
+# cluster, the KDC and the NFS server on IPv6 only.
+
+set -euo pipefail
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+BLUE='\033[0;34m'
+NC='\033[0m' # No Color
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_DIR="$(dirname "${SCRIPT_DIR}")"
+
+CLUSTER="${E2E_CLUSTER:-nri-kerberos-e2e}"
+NAMESPACE="kerberos-e2e"
+REALM="EXAMPLE.COM"
+KDC_HOSTNAME="kdc.e2e.test"
+NFS_HOSTNAME="nfs.e2e.test"
+IP_FAMILY="${E2E_IP_FAMILY:-ipv4}"
+case "${IP_FAMILY}" in
+    ipv4)
+        SERVICE_SUBNET="10.96.0.0/16"
+        KDC_IP="10.96.88.88"
+        NFS_IP="10.96.88.20"
+        ;;
+    ipv6)
+        SERVICE_SUBNET="fd00:10:96::/112"
+        KDC_IP="fd00:10:96::5858"
+        NFS_IP="fd00:10:96::5814"
+        ;;
+    *)
+        echo "E2E_IP_FAMILY must be ipv4 or ipv6, not ${IP_FAMILY}" >&2
+        exit 1
+        ;;
+esac
+USER_NAME="user10002"
+USER_ID="10002"
+TIMEOUT="180s"
+
+print_header() {
+    echo -e "\n${BLUE}=== $1 ===${NC}"
+}
+
+print_success() {
+    echo -e "${GREEN}✓ $1${NC}"
+}
+
+print_error() {
+    echo -e "${RED}✗ $1${NC}"
+}
+
+print_warning() {
+    echo -e "${YELLOW}⚠ $1${NC}"
+}
+
+kube() {
+    kubectl --context "kind-${CLUSTER}" "$@"
+}
+
+# Apply a manifest with the addresses of the IP family of the run
+apply_manifest() {
+    sed -e "s/10\.96\.88\.88/${KDC_IP}/g" -e "s/10\.96\.88\.20/${NFS_IP}/g" "${SCRIPT_DIR}/manifests/$1" | kube apply -f -
+}
+
+# Logs and state of the components, to tell why a step failed
+dump_state() {
+    print_header "State on failure"
+    kube get pods -A -o wide || true
+    kube -n "${NAMESPACE}" describe pod "client-${USER_NAME}" || true
+    kube -n nri-kerberos logs ds/nri-kerberos --tail=200 || true
+    kube -n "${NAMESPACE}" logs deploy/kdc --tail=100 || true
+    kube -n "${NAMESPACE}" logs deploy/nfs-server --tail=100 || true
+    for node in $(kind get nodes --name "${CLUSTER}"); do
+        docker exec "${node}" journalctl -u rpc-gssd --no-pager -n 100 || true
+    done
+}
+
+cleanup() {
+    local rc=$?
+    if [[ ${rc} -ne 0 ]]; then
+        dump_state
+        print_error "e2e test failed"
+    fi
+    if [[ "${E2E_KEEP:-}" = "1" ]]; then
+        print_warning "Keeping cluster ${CLUSTER}, delete it with: kind delete cluster --name ${CLUSTER}"
+    else
+        kind delete cluster --name "${CLUSTER}" || true
+    fi
+    exit "${rc}"
+}
+
+for tool in docker kind kubectl; do
+    if ! command -v "${tool}" &> /dev/null; then
+        print_error "${tool} not found"
+        exit 1
+    fi
+done
+for module in nfsd rpcsec_gss_krb5; do
+    if ! grep -q "^${module} " /proc/modules && ! modprobe "${module}" 2> /dev/null; then
+        print_warning "Kernel module ${module} not loaded, run: sudo modprobe ${module}"
+    fi
+done
+
+print_header "Creating kind cluster ${CLUSTER} (${IP_FAMILY})"
+kind_config=$(mktemp)
+sed -e "s|serviceSubnet: .*|ipFamily: ${IP_FAMILY}\n  serviceSubnet: ${SERVICE_SUBNET}|" "${SCRIPT_DIR}/kind-config.yaml" > "${kind_config}"
+kind_args=(--name "${CLUSTER}" --config "${kind_config}" --wait "${TIMEOUT}")
+if [[ -n "${E2E_NODE_IMAGE:-}" ]]; then
+    kind_args+=(--image "${E2E_NODE_IMAGE}")
+fi
+kind create cluster "${kind_args[@]}"
+rm -f "${kind_config}"
+trap cleanup EXIT
+print_success "Cluster created"
+
+print_header "Building images"
+docker build -t nri-kerberos:latest -f "${REPO_DIR}/containers/nri-kerberos/Dockerfile" "${REPO_DIR}"
+docker build -t e2e-kdc:latest "${SCRIPT_DIR}/images/kdc"
+docker build -t e2e-nfs-server:latest "${SCRIPT_DIR}/images/nfs-server"
+kind load docker-image --name "${CLUSTER}" nri-kerberos:latest e2e-kdc:latest e2e-nfs-server:latest
+print_success "Images built and loaded"
+
+print_header "Deploying the KDC"
+apply_manifest kdc.yaml
+kube -n "${NAMESPACE}" rollout status deploy/kdc --timeout "${TIMEOUT}"
+print_success "KDC serving ${REALM} at ${KDC_HOSTNAME}"
+
+# The kubelet mounts the NFS volumes and rpc.gssd runs on the node, outside the
+# cluster DNS: give the node the names of the KDC and the NFS server, the NFS
+# client tools, and the credentials of root for the mount as
+# vm-scripts/install-k8s.sh and deploy-k8s.sh do
+print_header "Preparing the node"
+for node in $(kind get nodes --name "${CLUSTER}"); do
+    docker exec -i "${node}" bash -euo pipefail <<EOF
+echo "${KDC_IP} ${KDC_HOSTNAME}" >> /etc/hosts
+echo "${NFS_IP} ${NFS_HOSTNAME}" >> /etc/hosts
+apt-get update -qq
+DEBIAN_FRONTEND=noninteractive apt-get install -y -qq nfs-common krb5-user > /dev/null
+curl -fsS -o /etc/krb5.conf "http://${KDC_HOSTNAME}:8080/krb5.conf"
+curl -fsS -o /etc/krb5.keytab "http://${KDC_HOSTNAME}:8080/keytabs/nfs.keytab"
+chmod 600 /etc/krb5.keytab
+mkdir -p /etc/nfs.conf.d
+cat > /etc/nfs.conf.d/e2e.conf <<CONF
+[gssd]
+use-machine-creds=0
+preferred-realm=${REALM}
+CONF
+KRB5CCNAME=FILE:/tmp/krb5cc_0 kinit -k -t /etc/krb5.keytab "nfs/${NFS_HOSTNAME}@${REALM}"
+systemctl restart rpc-gssd
+EOF
+done
+print_success "Node prepared"
+
+print_header "Deploying the NFS server"
+apply_manifest nfs-server.yaml
+kube -n "${NAMESPACE}" rollout status deploy/nfs-server --timeout "${TIMEOUT}"
+print_success "NFS server exporting with sec=krb5p at ${NFS_HOSTNAME}"
+
+print_header "Deploying the NRI plugin"
+apply_manifest nri-kerberos.yaml
+kube -n nri-kerberos rollout status ds/nri-kerberos --timeout "${TIMEOUT}"
+print_success "NRI plugin connected"
+
+print_header "Running the workload"
+kube apply -f "${SCRIPT_DIR}/manifests/workload.yaml"
+kube -n "${NAMESPACE}" wait pod "client-${USER_NAME}" --for condition=Ready --timeout "${TIMEOUT}"
+
+mount_opts=$(kube -n "${NAMESPACE}" exec "client-${USER_NAME}" -- grep " /home/${USER_NAME} nfs" /proc/mounts)
+if [[ "${mount_opts}" != *"sec=krb5p"* ]]; then
+    print_error "Home directory not mounted with sec=krb5p: ${mount_opts}"
+    exit 1
+fi
+print_success "Home directory mounted with sec=krb5p"
+
+kube -n "${NAMESPACE}" exec "client-${USER_NAME}" -- sh -c "echo read-write > /home/${USER_NAME}/e2e-rw.txt"
+content=$(kube -n "${NAMESPACE}" exec "client-${USER_NAME}" -- cat "/home/${USER_NAME}/e2e-rw.txt")
+if [[ "${content}" != "read-write" ]]; then
+    print_error "Read back \"${content}\" from the export"
+    exit 1
+fi
+print_success "Pod writes and reads the export"
+
+owner=$(kube -n "${NAMESPACE}" exec deploy/nfs-server -- stat -c %u "/export/home/${USER_NAME}/e2e.txt")
+if [[ "${owner}" != "${USER_ID}" ]]; then
+    print_error "File written by the pod is owned by ${owner} on the server, not ${USER_ID}"
+    exit 1
+fi
+print_success "Files written by the pod are owned by ${USER_NAME} on the server"
+
+for node in $(kind get nodes --name "${CLUSTER}"); do
+    docker exec "${node}" klist -c "FILE:/tmp/krb5cc_${USER_ID}"
+done
+print_success "Credential cache of ${USER_NAME}@${REALM} set up by the plugin"
+
+print_header "e2e test passed"
@@ -2,65 +2,210 @@
 # NRI Pre-Create Hook: Setup Kerberos auth before pod creation
 # This script runs on the host before kubelet creates the pod
 # It must complete successfully for the pod to be created
+#
+# With "stop" as the first argument it tears down what setup created instead.
 
 set -euo pipefail
 
+MODE="setup"
+if [[ "${1:-}" = "stop" ]]; then
+    MODE="stop"
+    shift
+fi
+
 USER_ID="${1:?}"
 GROUP_ID="${2:?}"
 FSID="${3:?}"
 USERNAME="${4:?}"
 REALM="${5:?}"
+# Principal to authenticate as, from the principal template, set by the plugin
+PRINCIPAL="${KERBEROS_PRINCIPAL:-${USERNAME}@${REALM}}"
 KDC_HOSTNAME="${6:?}"
 NFS_HOSTNAME="${7:?}"
+# All NFS servers of the pod, space separated, set by the plugin
+NFS_HOSTNAMES="${NFS_HOSTNAMES:-${NFS_HOSTNAME}}"
 KRB5CCNAME="${8:?}"
+# Optional keytab already fetched by the plugin, e.g. from a Secret
+KEYTAB_SOURCE="${9:-}"
+# Certificate and key to use PKINIT with instead of a keytab, set by the plugin
+PKINIT_CERT="${KERBEROS_PKINIT_CERT:-}"
+PKINIT_KEY="${KERBEROS_PKINIT_KEY:-}"
+PKINIT_ANCHORS="${KERBEROS_PKINIT_ANCHORS:-}"
+# Obtain an anonymous ticket by anonymous PKINIT instead, set by the plugin
+ANONYMOUS="${KERBEROS_ANONYMOUS:-}"
+# Realm of the NFS service principals, if another one trusting REALM, set by the plugin
+NFS_REALM="${KERBEROS_NFS_REALM:-${REALM}}"
+# Ticket and renewable lifetimes to ask for in seconds, those of krb5.conf if
+# empty, set by the plugin
+TICKET_LIFETIME="${KERBEROS_TICKET_LIFETIME:-}"
+RENEW_LIFETIME="${KERBEROS_RENEW_LIFETIME:-}"
+# Ask for a forwardable TGT, for the workload to forward, set by the plugin
+FORWARDABLE="${KERBEROS_FORWARDABLE:-}"
+# start, renew or stop, set by the plugin, or the setup phases prepare, fetching
+# the keytab, and mount, obtaining the tickets, in turn with scriptPhases
+OPERATION="${KERBEROS_OPERATION:-start}"
+# Keep the keytab on stop, still used by another pod of the user, set by the plugin
+KEEP_KEYTAB="${KERBEROS_KEEP_KEYTAB:-}"
 
 log() {
     echo "$(date '+%Y-%m-%d %H:%M:%S') [${USER_ID}] $*" | tee -a /var/log/nri-kerberos.log
 }
 
-log "Setting up Kerberos authentication for ${USERNAME} (UID: ${USER_ID}, GID: ${GROUP_ID})"
+# Host of an address which may have a port, without the brackets of an IPv6
+# literal: kdc.example.com:88, fd00::88 and [fd00::88]:88 all work
+host_of() {
+    local addr="$1"
+    if [[ "${addr}" = \[* ]]; then
+        addr="${addr#[}"
+        echo "${addr%%]*}"
+    elif [[ "${addr}" = *:*:* ]]; then
+        echo "${addr}"
+    else
+        echo "${addr%%:*}"
+    fi
+}
+
+# Host of an address as a URL takes it, IPv6 literals in brackets
+url_host() {
+    local host
+    host="$(host_of "$1")"
+    if [[ "${host}" = *:* ]]; then
+        echo "[${host}]"
+    else
+        echo "${host}"
+    fi
+}
+
+# Percent-encode a URL path segment
+url_escape() {
+    local s="$1" out="" c i
+    for ((i = 0; i < ${#s}; i++)); do
+        c="${s:i:1}"
+        case "${c}" in
+            [A-Za-z0-9._~-]) out+="${c}" ;;
+            *) out+="$(printf '%%%02X' "'${c}")" ;;
+        esac
+    done
+    echo "${out}"
+}
+
+KEYTAB_DIR="/etc/keytabs"
+KEYTAB_FILE="${KEYTAB_DIR}/${USERNAME}.keytab"
+# a FILE cache, or a single cache of a DIR collection
+CC_FILE="${KRB5CCNAME#FILE:}"
+CC_FILE="${CC_FILE#DIR::}"
+
+if [[ "${MODE}" = "stop" ]]; then
+    # The plugin only calls this once no other container uses the cache
+    log "Destroying Kerberos tickets for ${USERNAME} in ${KRB5CCNAME}"
+    KRB5CCNAME="${KRB5CCNAME}" kdestroy -q 2>/dev/null || true
+    rm -f "${CC_FILE}"
+    if [[ -z "${KEEP_KEYTAB}" && -z "${KEYTAB_SOURCE}" && -z "${PKINIT_CERT}" && -z "${ANONYMOUS}" ]]; then
+        log "Removing keytab ${KEYTAB_FILE}"
+        rm -f "${KEYTAB_FILE}"
+    fi
+    exit 0
+fi
+
+if [[ "${OPERATION}" = "prepare" ]]; then
+    log "Preparing Kerberos authentication for ${USERNAME} (UID: ${USER_ID}, GID: ${GROUP_ID})"
+elif [[ "${OPERATION}" = "mount" ]]; then
+    log "Obtaining Kerberos tickets for ${USERNAME} (UID: ${USER_ID}, GID: ${GROUP_ID})"
+elif [[ "${OPERATION}" = "renew" ]]; then
+    log "Renewing Kerberos authentication for ${USERNAME} (UID: ${USER_ID}, GID: ${GROUP_ID})"
+else
+    log "Setting up Kerberos authentication for ${USERNAME} (UID: ${USER_ID}, GID: ${GROUP_ID})"
+fi
 log "Using KDC: ${KDC_HOSTNAME}, Realm: ${REALM}"
 
 # Create keytabs directory if it doesn't exist
-KEYTAB_DIR="/etc/keytabs"
 mkdir -p "${KEYTAB_DIR}"
 
-# Download keytab for the user
-KEYTAB_FILE="${KEYTAB_DIR}/${USERNAME}.keytab"
-KEYTAB_URL="http://${KDC_HOSTNAME}:8080/keytabs/${USERNAME}.keytab"
+if [[ -n "${ANONYMOUS}" ]]; then
+    log "Using anonymous PKINIT"
+elif [[ -n "${PKINIT_CERT}" ]]; then
+    log "Using certificate provided by the plugin: ${PKINIT_CERT}"
+elif [[ -n "${KEYTAB_SOURCE}" ]]; then
+    log "Using keytab provided by the plugin: ${KEYTAB_SOURCE}"
+    KEYTAB_FILE="${KEYTAB_SOURCE}"
+elif [[ "${OPERATION}" = "mount" ]]; then
+    # fetched by the prepare phase
+    log "Using keytab ${KEYTAB_FILE}"
+else
+    # Download keytab for the user
+    KEYTAB_URL="http://$(url_host "${KDC_HOSTNAME}"):8080/keytabs/$(url_escape "${USERNAME}").keytab"
 
-log "Downloading keytab from: ${KEYTAB_URL}"
+    log "Downloading keytab from: ${KEYTAB_URL}"
 
-# Download keytab with retries
-for attempt in {1..3}; do
-    if curl -f -s -o "${KEYTAB_FILE}" "${KEYTAB_URL}"; then
-        log "Successfully downloaded keytab for ${USERNAME}"
-        break
-    else
-        log "Attempt ${attempt}: Failed to download keytab for $USERNAME"
-        if [[ "${attempt}" -eq 3 ]]; then
-            log "ERROR: Failed to download keytab after 3 attempts"
-            exit 1
+    # Download keytab with retries
+    for attempt in {1..3}; do
+        if curl -f -s -o "${KEYTAB_FILE}" "${KEYTAB_URL}"; then
+            log "Successfully downloaded keytab for ${USERNAME}"
+            break
+        else
+            log "Attempt ${attempt}: Failed to download keytab for $USERNAME"
+            if [[ "${attempt}" -eq 3 ]]; then
+                log "ERROR: Failed to download keytab after 3 attempts"
+                exit 1
+            fi
+            sleep 2
         fi
-        sleep 2
-    fi
-done
+    done
 
-# Set proper permissions on keytab
-log "Set keytab permissions"
-chmod 600 "${KEYTAB_FILE}"
-chown "${USER_ID}:${GROUP_ID}" "${KEYTAB_FILE}"
+    # Set proper permissions on keytab
+    log "Set keytab permissions"
+    chmod 600 "${KEYTAB_FILE}"
+    chown "${USER_ID}:${GROUP_ID}" "${KEYTAB_FILE}"
+fi
+
+if [[ "${OPERATION}" = "prepare" ]]; then
+    log "Successfully completed preparation for ${USERNAME}"
+    exit 0
+fi
 
 # Always use FILE-based credential cache
-CC_FILE="/tmp/krb5cc_${USER_ID}"
-export KRB5CCNAME=${KRB5CCNAME:-"FILE:${CC_FILE}"}
+export KRB5CCNAME
 log "Using FILE credential cache: ${KRB5CCNAME}"
 
-# Run kinit as root with the keytab
-log "Performing kinit for ${USERNAME} (${USER_ID}:${GROUP_ID} + ${FSID})"
-if kinit -k -t "${KEYTAB_FILE}" "${USERNAME}@${REALM}"; then
+# Run kinit as root with the keytab, or the certificate
+KINIT_ARGS=(-k -t "${KEYTAB_FILE}")
+if [[ -n "${PKINIT_CERT}" ]]; then
+    KINIT_ARGS=(-X "X509_user_identity=FILE:${PKINIT_CERT},${PKINIT_KEY}")
+    if [[ -n "${PKINIT_ANCHORS}" ]]; then
+        KINIT_ARGS+=(-X "X509_anchors=FILE:${PKINIT_ANCHORS}")
+    fi
+elif [[ -n "${ANONYMOUS}" ]]; then
+    KINIT_ARGS=(-n)
+    if [[ -n "${PKINIT_ANCHORS}" ]]; then
+        KINIT_ARGS+=(-X "X509_anchors=FILE:${PKINIT_ANCHORS}")
+    fi
+fi
+if [[ -n "${TICKET_LIFETIME}" ]]; then
+    KINIT_ARGS+=(-l "${TICKET_LIFETIME}s")
+fi
+if [[ -n "${RENEW_LIFETIME}" ]]; then
+    KINIT_ARGS+=(-r "${RENEW_LIFETIME}s")
+fi
+if [[ -n "${FORWARDABLE}" ]]; then
+    KINIT_ARGS+=(-f)
+fi
+log "Performing kinit for ${PRINCIPAL} (${USER_ID}:${GROUP_ID} + ${FSID})"
+KINIT_PRINCIPAL="${PRINCIPAL}"
+if [[ -n "${ANONYMOUS}" ]]; then
+    KINIT_PRINCIPAL="@${REALM}"
+fi
+if kinit "${KINIT_ARGS[@]}" "${KINIT_PRINCIPAL}"; then
     log "Successfully authenticated ${USERNAME} with Kerberos"
 
+    # Get the NFS service tickets up front; rpc.gssd may yet get those
+    # failing here under the canonical name of the server
+    for NFS_SERVER in ${NFS_HOSTNAMES}; do
+        NFS_HOST="$(host_of "${NFS_SERVER}")"
+        if ! kvno -q "nfs/${NFS_HOST}@${NFS_REALM}" >/dev/null 2>&1; then
+            log "WARNING: cannot obtain service ticket for nfs/${NFS_HOST}"
+        fi
+    done
+
     # Change ownership to the correct UID/GID (even without local users)
     chown "${USER_ID}:${GROUP_ID}" "${CC_FILE}"
     chmod 600 "${CC_FILE}"
@@ -80,11 +225,3 @@ fi
 log "Successfully completed pre-create setup for ${USERNAME}"
 exit 0
 
-# make separate script for this ?
-if [[ "${1:-}" = "stop" ]]; then
-    # This does not really work if multiple pods for same user are created
-    # TBD: drop stop handling?
-    log "Nuking Kerberos tickets for ${USERNAME}"
-    KRB5CCNAME="FILE:${CC_FILE}" kdestroy || true
-    rm -f /tmp/krb5cc_${USER_ID}*
-fi
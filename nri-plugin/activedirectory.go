@@ -0,0 +1,232 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	// LDAP attribute of the enctypes an AD account supports, a bit mask.
+	ldapSupportedETypesAttr = "msDS-SupportedEncryptionTypes"
+	// AES only, for accounts without the attribute.
+	defaultADSupportedETypes = 0x18
+)
+
+// Bits of msDS-SupportedEncryptionTypes by enctype, in order of preference.
+var adETypeBits = []struct {
+	name string
+	bit  uint32
+}{
+	{"aes256-cts-hmac-sha1-96", 0x10},
+	{"aes128-cts-hmac-sha1-96", 0x08},
+	{"arcfour-hmac", 0x04},
+	{"des-cbc-md5", 0x02},
+	{"des-cbc-crc", 0x01},
+}
+
+// Active Directory compatibility: realms given by the NetBIOS name or the
+// DNS name of a domain in any case, the enctypes of accounts and the salts of
+// their keys, and errors telling the usual misconfigurations of accounts.
+type activeDirectoryConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Realms of AD domains, all if empty.
+	Realms []string `json:"realms,omitempty"`
+	// Realms by the NetBIOS names of their domains, as CORP: CORP.EXAMPLE.COM.
+	NetBIOSNames map[string]string `json:"netbiosNames,omitempty"`
+	// msDS-SupportedEncryptionTypes of accounts the LDAP directory has no
+	// value of, 0x18 (AES) by default.
+	SupportedEncryptionTypes uint32 `json:"supportedEncryptionTypes,omitempty"`
+}
+
+func (c *activeDirectoryConfig) validate() error {
+	for name, realm := range c.NetBIOSNames {
+		if realm == "" || realm != strings.ToUpper(realm) {
+			return fmt.Errorf("netbiosNames: realm %q of %s must be upper case", realm, name)
+		}
+	}
+	var all uint32
+	for _, e := range adETypeBits {
+		all |= e.bit
+	}
+	if c.SupportedEncryptionTypes&all == 0 && c.SupportedEncryptionTypes != 0 {
+		return fmt.Errorf("supportedEncryptionTypes: 0x%x has no enctype bits", c.SupportedEncryptionTypes)
+	}
+	return nil
+}
+
+// Realm of the domain named by a pod: the DNS realm of a NetBIOS name, or the
+// DNS name in upper case. Other realms are left as they are.
+func (c *activeDirectoryConfig) realm(name string) string {
+	if !c.Enabled || name == "" {
+		return name
+	}
+	for netbios, realm := range c.NetBIOSNames {
+		if strings.EqualFold(name, netbios) {
+			return realm
+		}
+	}
+	if upper := strings.ToUpper(name); upper != name && c.applies(upper) {
+		return upper
+	}
+	return name
+}
+
+// Check whether the realm is that of an AD domain.
+func (c *activeDirectoryConfig) applies(realm string) bool {
+	return c.Enabled && (len(c.Realms) == 0 || slices.Contains(c.Realms, realm))
+}
+
+// Enctypes of the workload which its account supports: those permitted, or
+// the ones AD has if all are, with a bit in msDS-SupportedEncryptionTypes,
+// the configured default if the directory has no value for the account.
+func (c *activeDirectoryConfig) encTypes(supported uint32, permitted []string, fips bool) ([]string, error) {
+	if supported == 0 {
+		supported = c.SupportedEncryptionTypes
+	}
+	if supported == 0 {
+		supported = defaultADSupportedETypes
+	}
+	var names []string
+	for _, e := range adETypeBits {
+		if supported&e.bit == 0 || (fips && weakEType(etypeID.EtypeSupported(e.name))) {
+			continue
+		}
+		if len(permitted) == 0 || slices.ContainsFunc(permitted, func(name string) bool {
+			return etypeID.EtypeSupported(name) == etypeID.EtypeSupported(e.name)
+		}) {
+			names = append(names, e.name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("none of the permitted enctypes %s is in msDS-SupportedEncryptionTypes 0x%x of the account",
+			strings.Join(permitted, ","), supported)
+	}
+	return names, nil
+}
+
+// Parse msDS-SupportedEncryptionTypes of a directory entry, 0 if it has none.
+func parseSupportedETypes(user, v string) (uint32, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q of %s", ldapSupportedETypesAttr, v, user)
+	}
+	return uint32(n), nil
+}
+
+// Name of the AD account of a workload logging in with a password, in the
+// case its salt gives. AD salts the keys of user accounts with the realm and
+// the sAMAccountName as it was created, which the name of the pod may differ
+// from in case, while gokrb5 derives the key of the reply with the name asked
+// for unless the KDC tells the salt again. The principal name of the workload
+// is kept if the KDC cannot be asked or tells no salt of another case.
+func adAccountName(ctx context.Context, cfg *krb5config.Config, kp *kerberosParams) string {
+	name := kp.principalName()
+	if strings.Contains(name, "/") {
+		return name
+	}
+	req, err := messages.NewASReqForTGT(kp.Realm, cfg, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, name))
+	if err != nil {
+		return name
+	}
+	msg, err := req.Marshal()
+	if err != nil {
+		return name
+	}
+	reply, err := exchangeKDC(ctx, cfg, kp.Realm, msg)
+	if err != nil {
+		return name
+	}
+	var krbErr messages.KRBError
+	if err := krbErr.Unmarshal(reply); err != nil || krbErr.ErrorCode != errorcode.KDC_ERR_PREAUTH_REQUIRED {
+		return name
+	}
+	var methods types.PADataSequence
+	if err := methods.Unmarshal(krbErr.EData); err != nil {
+		return name
+	}
+	for _, pa := range methods {
+		if pa.PADataType != patype.PA_ETYPE_INFO2 {
+			continue
+		}
+		info, err := pa.GetETypeInfo2()
+		if err != nil {
+			return name
+		}
+		for _, e := range info {
+			account, ok := strings.CutPrefix(e.Salt, kp.Realm)
+			if ok && account != name && strings.EqualFold(account, name) {
+				loggerFrom(ctx).Infof("AD account of %s is %s, as its salt tells", kp.Principal(), account)
+				return account
+			}
+		}
+	}
+	return name
+}
+
+// Hints at the usual misconfigurations of AD accounts, by the KDC error
+// names of gokrb5 and the messages of MIT kinit.
+var adErrorHints = []struct {
+	errors []string
+	hint   string
+}{
+	{[]string{"KDC_ERR_C_PRINCIPAL_UNKNOWN", "not found in Kerberos database"},
+		"no account of this sAMAccountName in the domain, or the realm is not the DNS name of the domain"},
+	{[]string{"KDC_ERR_WRONG_REALM", "Wrong realm"},
+		"the realm is not the DNS name of the domain in upper case"},
+	{[]string{"KDC_ERR_ETYPE_NOSUPP", "KDC has no support for encryption type"},
+		"the account has no keys of the enctypes asked for: check its msDS-SupportedEncryptionTypes, and reset its password after enabling AES"},
+	{[]string{"KDC_ERR_PREAUTH_FAILED", "Preauthentication failed", "password/keytab incorrect"},
+		"wrong password, or a keytab generated with another salt or key version than the account has, as after a password reset"},
+	{[]string{"KDC_ERR_CLIENT_REVOKED", "credentials have been revoked"},
+		"the account is disabled, locked out or expired"},
+	{[]string{"KDC_ERR_KEY_EXPIRED", "Password has expired"},
+		"the password of the account expired, set it to never expire for service accounts"},
+	{[]string{"KDC_ERR_POLICY", "KDC policy rejects request"},
+		"logon hours or workstation restrictions of the account, or a Protected Users membership, deny it"},
+}
+
+// Tell the likely AD misconfiguration behind a credential setup failure,
+// keeping its failure class.
+func explainADError(err error) error {
+	if err == nil || errors.Is(err, errKDCUnreachable) {
+		return err
+	}
+	msg := err.Error()
+	for _, h := range adErrorHints {
+		if slices.ContainsFunc(h.errors, func(s string) bool { return strings.Contains(msg, s) }) {
+			return fmt.Errorf("%w (Active Directory: %s)", err, h.hint)
+		}
+	}
+	return err
+}
@@ -0,0 +1,514 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultAdminSocket = "/run/nri-kerberos/admin.sock"
+	// Time a client of the admin API waits for an answer, a setup taking as
+	// long as setupTimeout.
+	adminClientTimeout = 5 * time.Minute
+)
+
+// Admin API of the plugin on a UNIX socket of the node, for recovering from
+// bad state without restarting the plugin.
+type adminConfig struct {
+	// Serve the admin API.
+	Enabled bool `json:"enabled,omitempty"`
+	// UNIX socket to serve it at, /run/nri-kerberos/admin.sock by default.
+	Socket string `json:"socket,omitempty"`
+	// Group given access to the socket, whose members may use the API.
+	// Only root may if unset.
+	GID *int `json:"gid,omitempty"`
+	// Further users who may use the API.
+	UIDs []int `json:"uids,omitempty"`
+}
+
+func (c *adminConfig) socket() string {
+	if c.Socket != "" {
+		return c.Socket
+	}
+	return defaultAdminSocket
+}
+
+func (c *adminConfig) validate() error {
+	if c.Socket != "" && !filepath.IsAbs(c.Socket) {
+		return fmt.Errorf("socket %q is not absolute", c.Socket)
+	}
+	if c.GID != nil && *c.GID < 0 {
+		return fmt.Errorf("invalid gid %d", *c.GID)
+	}
+	return nil
+}
+
+// Whether the peer of a connection may use the API: root, the users listed
+// and the members of the group, by its primary group as the kernel tells.
+func (c *adminConfig) allows(cred *unix.Ucred) bool {
+	return cred.Uid == 0 || slices.Contains(c.UIDs, int(cred.Uid)) || (c.GID != nil && int(cred.Gid) == *c.GID)
+}
+
+type peerCredKey struct{}
+
+// Credentials of the process at the other end of a UNIX socket connection.
+func peerCred(c net.Conn) (*unix.Ucred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a UNIX socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// Serve the admin API until the context is cancelled.
+func (p *plugin) serveAdmin(ctx context.Context, cfg adminConfig) {
+	path := cfg.socket()
+	l, err := listen(unixAddressPrefix + path)
+	if err == nil && cfg.GID != nil {
+		if err = os.Chown(path, 0, *cfg.GID); err == nil {
+			err = os.Chmod(path, 0o660)
+		}
+	}
+	if err != nil {
+		log.Errorf("admin API at %s failed: %v", path, err)
+		return
+	}
+
+	m := http.NewServeMux()
+	m.HandleFunc("GET /v1/tickets", p.adminTickets)
+	m.HandleFunc("POST /v1/renew/{key...}", p.adminRenew)
+	m.HandleFunc("POST /v1/destroy/{key...}", p.adminDestroy)
+	m.HandleFunc("POST /v1/setup/{namespace}/{name}", p.adminSetup)
+	m.HandleFunc("GET /v1/output/{namespace}/{name}", p.adminOutput)
+	m.HandleFunc("GET /v1/stats/{namespace}/{name}", p.adminStats)
+	srv := &http.Server{
+		Handler:           adminAuth(cfg, m),
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			cred, err := peerCred(c)
+			if err != nil {
+				log.Warnf("admin API: no peer credentials: %v", err)
+				return ctx
+			}
+			return context.WithValue(ctx, peerCredKey{}, cred)
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	log.Infof("serving admin API at %s", path)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("admin API at %s failed: %v", path, err)
+	}
+}
+
+// Refuse the requests of peers not allowed, logging those allowed.
+func adminAuth(cfg adminConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, _ := r.Context().Value(peerCredKey{}).(*unix.Ucred)
+		if cred == nil || !cfg.allows(cred) {
+			if cred != nil {
+				log.Warnf("admin API: %s %s of uid %d pid %d refused", r.Method, r.URL.Path, cred.Uid, cred.Pid)
+			}
+			adminError(w, http.StatusForbidden, errors.New("not allowed"))
+			return
+		}
+		if r.Method != http.MethodGet {
+			log.Infof("admin API: %s %s by uid %d pid %d", r.Method, r.URL.Path, cred.Uid, cred.Pid)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Answer of the admin API to a request.
+type adminResult struct {
+	Error  string `json:"error,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminReply(w, status, &adminResult{Error: err.Error()})
+}
+
+func adminReply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("admin API: failed to write reply: %v", err)
+	}
+}
+
+// Managed credentials with their ticket times, as at /debug/state.
+func (p *plugin) adminTickets(w http.ResponseWriter, _ *http.Request) {
+	adminReply(w, http.StatusOK, p.debugState().Managed)
+}
+
+// Renew managed credentials now, obtaining them afresh if they cannot be
+// renewed, as their scheduled renewal would.
+func (p *plugin) adminRenew(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if p.managedParamsOf(key) == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no managed credentials %s", key))
+		return
+	}
+	if !p.config().Renewal.Enabled {
+		adminError(w, http.StatusConflict, errors.New("renewal is disabled"))
+		return
+	}
+	p.renewals.Cancel(key)
+	if err := p.renewPod(key); err != nil {
+		adminError(w, http.StatusBadGateway, err)
+		return
+	}
+	adminReply(w, http.StatusOK, &adminResult{Detail: "renewed " + key})
+}
+
+// Destroy managed credentials, even if other pods use the same cache.
+func (p *plugin) adminDestroy(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if p.managedParamsOf(key) == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no managed credentials %s", key))
+		return
+	}
+	p.release(key, true)
+	adminReply(w, http.StatusOK, &adminResult{Detail: "destroyed " + key})
+}
+
+// Set up the credentials of a pod again, as when it ran, releasing those it
+// has first. Credentials of containers of their own are left alone, they are
+// set up with their containers.
+func (p *plugin) adminSetup(w http.ResponseWriter, r *http.Request) {
+	pod, err := p.runningPod(r.PathValue("namespace"), r.PathValue("name"))
+	if err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	cfg := p.config()
+	l := podLogger(pod)
+	if !cfg.enabled(pod) {
+		adminError(w, http.StatusConflict, errors.New("pod not enabled"))
+		return
+	}
+	kp := p.podSandboxParams(l, cfg, pod)
+	if kp == nil {
+		adminError(w, http.StatusConflict, errors.New("pod has no credentials to set up, see the log of the plugin"))
+		return
+	}
+	if cfg.DryRun {
+		adminError(w, http.StatusConflict, errors.New("dry run"))
+		return
+	}
+
+	p.Lock()
+	var keys []string
+	for key, mc := range p.managed {
+		if mc.pod.GetId() == pod.GetId() && mc.params.Container == "" {
+			keys = append(keys, key)
+		}
+	}
+	p.Unlock()
+	for _, key := range keys {
+		p.releaseCache(key)
+	}
+
+	p.results.forget(pod)
+	err = p.setupPod(withLogger(r.Context(), l), l, cfg, pod, kp, "")
+	p.Lock()
+	if err != nil {
+		p.failed[pod.GetId()] = err
+	} else {
+		delete(p.failed, pod.GetId())
+	}
+	p.Unlock()
+	if err != nil {
+		l.Error(err)
+		adminError(w, http.StatusBadGateway, err)
+		return
+	}
+	adminReply(w, http.StatusOK, &adminResult{Detail: "set up " + kp.Principal()})
+}
+
+// Last lines of output of the hook script for a pod, oldest first.
+func (p *plugin) adminOutput(w http.ResponseWriter, r *http.Request) {
+	namespace, name := r.PathValue("namespace"), r.PathValue("name")
+	lines := scriptOutputs.get(namespace, name)
+	if lines == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no script output of pod %s/%s", namespace, name))
+		return
+	}
+	adminReply(w, http.StatusOK, lines)
+}
+
+// NFS mount statistics and GSS contexts of the managed credentials of a pod,
+// collected now.
+func (p *plugin) adminStats(w http.ResponseWriter, r *http.Request) {
+	namespace, name := r.PathValue("namespace"), r.PathValue("name")
+	stats := p.podStatsOf(namespace, name)
+	if len(stats) == 0 {
+		adminError(w, http.StatusNotFound, fmt.Errorf("no managed credentials of pod %s/%s", namespace, name))
+		return
+	}
+	adminReply(w, http.StatusOK, stats)
+}
+
+// Sandbox of a pod, the one not stopped if there are several.
+func (p *plugin) runningPod(namespace, name string) (*api.PodSandbox, error) {
+	stopped := p.cleaner.Due()
+	p.Lock()
+	defer p.Unlock()
+	var found *api.PodSandbox
+	for id, pod := range p.pods {
+		if pod.GetNamespace() != namespace || pod.GetName() != name {
+			continue
+		}
+		if _, ok := stopped[id]; ok {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("pod %s/%s has several sandboxes", namespace, name)
+		}
+		found = pod
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no running sandbox of pod %s/%s", namespace, name)
+	}
+	return found, nil
+}
+
+// Client of the admin API of the plugin on the node:
+// `kerberos admin tickets`, `kerberos admin renew <key>`,
+// `kerberos admin destroy <key>`, `kerberos admin setup <namespace>/<name>` or
+// `kerberos admin output <namespace>/<name>`.
+func runAdmin(args []string) {
+	var socket, output string
+
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	fs.StringVar(&socket, "socket", defaultAdminSocket, "UNIX socket of the admin API")
+	fs.StringVar(&output, "o", "", "output format, json for the tickets or script output")
+	args = parseInterspersed(fs, args)
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: kerberos admin [-socket path] tickets | renew <key> | destroy <key> | setup <namespace>/<name> | output <namespace>/<name> | stats <namespace>/<name>")
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout: adminClientTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	var err error
+	switch cmd := args[0]; {
+	case cmd == "tickets" && len(args) == 1:
+		err = adminListTickets(client, output)
+	case (cmd == "renew" || cmd == "destroy") && len(args) == 2:
+		err = adminCall(client, "/v1/"+cmd+"/"+url.PathEscape(args[1]))
+	case (cmd == "setup" || cmd == "output" || cmd == "stats") && len(args) == 2:
+		namespace, name, ok := strings.Cut(args[1], "/")
+		if !ok {
+			namespace, name = "default", args[1]
+		}
+		path := "/v1/" + cmd + "/" + url.PathEscape(namespace) + "/" + url.PathEscape(name)
+		switch cmd {
+		case "output":
+			err = adminScriptOutput(client, path, output)
+		case "stats":
+			err = adminPodStats(client, path, output)
+		default:
+			err = adminCall(client, path)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func adminListTickets(client *http.Client, output string) error {
+	resp, err := client.Get("http://admin/v1/tickets")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return adminFailure(resp)
+	}
+	if output == "json" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	var tickets []debugCredential
+	if err := json.NewDecoder(resp.Body).Decode(&tickets); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tPOD\tPRINCIPAL\tEXPIRES\tRENEWAL")
+	for _, t := range tickets {
+		expires, renewal := t.Error, ""
+		if t.Expires != nil {
+			expires = t.Expires.Format(time.RFC3339)
+		}
+		if t.Renewal != nil {
+			renewal = t.Renewal.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s/%s\t%s\t%s\t%s\n", t.Key, t.Namespace, t.Pod, t.Principal, expires, renewal)
+	}
+	return tw.Flush()
+}
+
+func adminScriptOutput(client *http.Client, path, output string) error {
+	resp, err := client.Get("http://admin" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return adminFailure(resp)
+	}
+	if output == "json" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	var lines []scriptLine
+	if err := json.NewDecoder(resp.Body).Decode(&lines); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		fmt.Printf("%s %s %s %s\n", l.Time.Format(time.RFC3339), l.Operation, l.Stream, l.String())
+	}
+	return nil
+}
+
+func adminPodStats(client *http.Client, path, output string) error {
+	resp, err := client.Get("http://admin" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return adminFailure(resp)
+	}
+	if output == "json" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	var stats []podStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tMOUNT\tDEVICE\tSEC\tREAD\tWRITTEN\tRPCS\tRETRANS\tTIMEOUTS\tERRORS")
+	for _, st := range stats {
+		for _, m := range st.Mounts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", st.Key, m.MountPoint, m.Device, m.Sec,
+				m.ReadBytes, m.WriteBytes, m.RPCs, m.Retransmissions, m.Timeouts, m.Errors)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	tw = tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "\nKEY\tSERVICE\tEXPIRES")
+	for _, st := range stats {
+		for _, c := range st.Contexts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", st.Key, c.Service, c.Expires.Format(time.RFC3339))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, st := range stats {
+		if st.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", st.Key, st.Error)
+		}
+	}
+	return nil
+}
+
+func adminCall(client *http.Client, path string) error {
+	resp, err := client.Post("http://admin"+path, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return adminFailure(resp)
+	}
+	var res adminResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	fmt.Println(res.Detail)
+	return nil
+}
+
+func adminFailure(resp *http.Response) error {
+	var res adminResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.Error == "" {
+		return fmt.Errorf("admin API answered %s", resp.Status)
+	}
+	return errors.New(res.Error)
+}
+
+// Parse flags given before, between and after the arguments, as kubectl
+// does, returning the arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var rest []string
+	for {
+		_ = fs.Parse(args)
+		if fs.NArg() == 0 {
+			return rest
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
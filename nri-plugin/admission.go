@@ -0,0 +1,273 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// AdmissionReview of admission.k8s.io/v1, the parts we use.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string          `json:"uid"`
+	Namespace string          `json:"namespace"`
+	Operation string          `json:"operation"`
+	Object    json.RawMessage `json:"object"`
+}
+
+type admissionResponse struct {
+	UID       string           `json:"uid"`
+	Allowed   bool             `json:"allowed"`
+	Result    *admissionStatus `json:"status,omitempty"`
+	Patch     []byte           `json:"patch,omitempty"`
+	PatchType string           `json:"patchType,omitempty"`
+	Warnings  []string         `json:"warnings,omitempty"`
+}
+
+type admissionStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Pod, the parts admission looks at or patches.
+type admissionPod struct {
+	Metadata struct {
+		Name         string            `json:"name"`
+		GenerateName string            `json:"generateName"`
+		Annotations  map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		SecurityContext *podSecurityContext `json:"securityContext"`
+		InitContainers  []podContainer      `json:"initContainers"`
+		Containers      []podContainer      `json:"containers"`
+		Volumes         []podVolume         `json:"volumes"`
+	} `json:"spec"`
+}
+
+type podSecurityContext struct {
+	RunAsUser  *int64 `json:"runAsUser,omitempty"`
+	RunAsGroup *int64 `json:"runAsGroup,omitempty"`
+	// Pod level only.
+	FSGroup            *int64  `json:"fsGroup,omitempty"`
+	SupplementalGroups []int64 `json:"supplementalGroups,omitempty"`
+}
+
+type podContainer struct {
+	Name            string              `json:"name"`
+	Image           string              `json:"image,omitempty"`
+	ImagePullPolicy string              `json:"imagePullPolicy,omitempty"`
+	Env             []podEnvVar         `json:"env,omitempty"`
+	VolumeMounts    []podVolumeMount    `json:"volumeMounts,omitempty"`
+	SecurityContext *podSecurityContext `json:"securityContext,omitempty"`
+	Lifecycle       any                 `json:"lifecycle,omitempty"`
+	// Init containers only, Always for native sidecars.
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+}
+
+type podEnvVar struct {
+	Name      string           `json:"name"`
+	Value     string           `json:"value,omitempty"`
+	ValueFrom *podEnvVarSource `json:"valueFrom,omitempty"`
+}
+
+type podEnvVarSource struct {
+	ConfigMapKeyRef *podConfigMapKeyRef `json:"configMapKeyRef,omitempty"`
+}
+
+type podConfigMapKeyRef struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+type podVolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+type podVolume struct {
+	Name     string       `json:"name"`
+	HostPath *podHostPath `json:"hostPath,omitempty"`
+	EmptyDir *podEmptyDir `json:"emptyDir,omitempty"`
+}
+
+type podEmptyDir struct {
+	Medium string `json:"medium,omitempty"`
+}
+
+type podHostPath struct {
+	Path string `json:"path"`
+	Type string `json:"type,omitempty"`
+}
+
+// Value of an environment variable of the container, by value only.
+func (c *podContainer) env(name string) (string, bool) {
+	for _, e := range c.Env {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+	return "", false
+}
+
+// Whether the init container is a native sidecar, running alongside the
+// containers of the pod.
+func (c *podContainer) nativeSidecar() bool {
+	return c.RestartPolicy == "Always"
+}
+
+// Init containers and containers of the pod, which the plugin sees all.
+func (p *admissionPod) allContainers() []podContainer {
+	return append(slices.Clone(p.Spec.InitContainers), p.Spec.Containers...)
+}
+
+// Containers of the pod running for its lifetime: the native sidecars and the
+// containers.
+func (p *admissionPod) longRunningContainers() []podContainer {
+	var cs []podContainer
+	for _, c := range p.Spec.InitContainers {
+		if c.nativeSidecar() {
+			cs = append(cs, c)
+		}
+	}
+	return append(cs, p.Spec.Containers...)
+}
+
+// Name of the pod for log messages, which may not be set yet at admission.
+func (p *admissionPod) name(namespace string) string {
+	name := p.Metadata.Name
+	if name == "" {
+		name = p.Metadata.GenerateName + "*"
+	}
+	return namespace + "/" + name
+}
+
+// Handler of an admission request for a pod.
+type admissionHandler func(req *admissionRequest, pod *admissionPod) *admissionResponse
+
+// Serve AdmissionReviews of pods with the handler.
+func serveAdmission(handle admissionHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		review := &admissionReview{}
+		if err := json.Unmarshal(data, review); err != nil || review.Request == nil {
+			http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+			return
+		}
+
+		req := review.Request
+		pod := &admissionPod{}
+		var rsp *admissionResponse
+		if err := json.Unmarshal(req.Object, pod); err != nil {
+			rsp = &admissionResponse{Allowed: false, Result: &admissionStatus{
+				Code:    http.StatusBadRequest,
+				Message: "failed to decode pod: " + err.Error(),
+			}}
+		} else {
+			rsp = handle(req, pod)
+		}
+		rsp.UID = req.UID
+
+		review.Request, review.Response = nil, rsp
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(review)
+	}
+}
+
+// Run the admission webhook server, which serves the mutating webhook at
+// /mutate and the validating one at /validate over TLS.
+func runWebhook(args []string) {
+	var (
+		listen, certFile, keyFile string
+		inj                       injector
+		val                       validator
+		logOpts                   logOptions
+	)
+
+	fs := flag.NewFlagSet("webhook", flag.ExitOnError)
+	fs.StringVar(&listen, "listen", ":8443", "address to serve the webhooks at")
+	fs.StringVar(&certFile, "tlsCert", "/etc/webhook/tls.crt", "TLS certificate")
+	fs.StringVar(&keyFile, "tlsKey", "/etc/webhook/tls.key", "TLS key")
+	fs.StringVar(&inj.annotationPrefix, "annotationPrefix", defaultAnnotationPrefix, "prefix of the pod annotations")
+	fs.BoolVar(&val.strict, "strict", true, "require uid/gid/fsid annotations and KERBEROS_REALM on enabled pods")
+	fs.BoolVar(&val.securityContextIDs, "securityContextIDs", false, "accept runAsUser, runAsGroup and fsGroup for the uid/gid/fsid annotations in strict mode")
+	fs.StringVar(&inj.image, "sidecarImage", defaultSidecarImage, "image of the injected renewal sidecar")
+	fs.StringVar(&inj.configMap, "hostnamesConfigMap", defaultHostnamesConfigMap, "ConfigMap with KERBEROS_REALM, KDC_HOSTNAME and NFS_HOSTNAME")
+	fs.StringVar(&inj.renewalTime, "renewalTime", defaultRenewalTime, "renewal interval of the sidecar in seconds or as 1h30m, unless annotated")
+	fs.StringVar(&inj.sidecarMode, "sidecarMode", sidecarModeContainer, "inject the sidecar as a container, as a native sidecar init container (native) or not at all (none)")
+	logOpts.register(fs)
+	_ = fs.Parse(args)
+	if err := logOpts.apply(); err != nil {
+		log.Errorf("invalid logging options: %v", err)
+		os.Exit(1)
+	}
+	if _, err := parseRenewalTime(inj.renewalTime); err != nil {
+		log.Errorf("invalid -renewalTime: %v", err)
+		os.Exit(1)
+	}
+	if err := validSidecarMode(inj.sidecarMode); err != nil {
+		log.Errorf("invalid -sidecarMode: %v", err)
+		os.Exit(1)
+	}
+	val.annotationPrefix = inj.annotationPrefix
+
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", serveAdmission(inj.mutate))
+	mux.Handle("/validate", serveAdmission(val.validate))
+
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdown)
+	}()
+
+	log.Infof("serving admission webhooks at %s", listen)
+	if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("webhook server failed: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	backendAgent = "agent"
+
+	defaultAgentSocket = "/run/nri-kerberos/agent.sock"
+
+	// gRPC service of the ticket agent. Messages are JSON, there is no .proto.
+	agentService = "nri.kerberos.v1alpha1.TicketAgent"
+)
+
+// Ticket agent configuration.
+type agentConfig struct {
+	// UNIX socket the agent serves at, /run/nri-kerberos/agent.sock by default.
+	Socket string `json:"socket,omitempty"`
+	// Backend the agent uses, native (default) or script.
+	Backend string `json:"backend,omitempty"`
+	// Keytabs distributed by the controller.
+	Distribution agentDistributionConfig `json:"distribution,omitempty"`
+}
+
+func (c *agentConfig) socket() string {
+	if c.Socket != "" {
+		return c.Socket
+	}
+	return defaultAgentSocket
+}
+
+// Request of the ticket agent, for the credentials of one workload.
+type ticketRequest struct {
+	Params *kerberosParams `json:"params"`
+}
+
+// Reply of the ticket agent.
+type ticketReply struct {
+	// Expiry of the TGT, if the credential cache could be read.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Ticket agent API.
+type ticketAgentServer interface {
+	AcquireTicket(context.Context, *ticketRequest) (*ticketReply, error)
+	RenewTicket(context.Context, *ticketRequest) (*ticketReply, error)
+	ReleaseTicket(context.Context, *ticketRequest) (*ticketReply, error)
+}
+
+var ticketAgentDesc = grpc.ServiceDesc{
+	ServiceName: agentService,
+	HandlerType: (*ticketAgentServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "AcquireTicket", Handler: agentHandler("AcquireTicket", ticketAgentServer.AcquireTicket)},
+		{MethodName: "RenewTicket", Handler: agentHandler("RenewTicket", ticketAgentServer.RenewTicket)},
+		{MethodName: "ReleaseTicket", Handler: agentHandler("ReleaseTicket", ticketAgentServer.ReleaseTicket)},
+	},
+}
+
+type agentMethod func(ticketAgentServer, context.Context, *ticketRequest) (*ticketReply, error)
+
+func agentHandler(name string, method agentMethod) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := &ticketRequest{}
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if req.Params == nil {
+			return nil, status.Error(codes.InvalidArgument, "no parameters")
+		}
+		call := func(ctx context.Context, req any) (any, error) {
+			return method(srv.(ticketAgentServer), ctx, req.(*ticketRequest))
+		}
+		if interceptor == nil {
+			return call(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + agentService + "/" + name}
+		return interceptor(ctx, req, info, call)
+	}
+}
+
+// Failure classes and the status codes carrying them over the agent API.
+var agentErrorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{errKeytabUnavailable, codes.FailedPrecondition},
+	{errKDCUnreachable, codes.Unavailable},
+	{errPrincipalUnknown, codes.NotFound},
+	{errPreauthFailed, codes.PermissionDenied},
+	{errKDCRejected, codes.Aborted},
+	{errCCacheFailed, codes.DataLoss},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+}
+
+// Convert a backend error to a status error of its failure class.
+func agentStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, c := range agentErrorCodes {
+		if errors.Is(err, c.err) {
+			return status.Error(c.code, err.Error())
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// Node-local daemon obtaining, renewing and destroying credentials on behalf of
+// the NRI plugin, so that backend state outlives plugin restarts.
+type ticketAgent struct {
+	backend KerberosBackend
+}
+
+func (a *ticketAgent) reply(kp *kerberosParams) *ticketReply {
+	rsp := &ticketReply{}
+	if t, err := ccacheTimes(kp.CCName, kp.Realm); err == nil {
+		rsp.Expires = t.end
+	}
+	return rsp
+}
+
+func (a *ticketAgent) AcquireTicket(ctx context.Context, req *ticketRequest) (*ticketReply, error) {
+	if err := a.backend.Setup(ctx, req.Params); err != nil {
+		log.Errorf("failed to acquire credentials for %s: %v", req.Params.Principal(), err)
+		return nil, agentStatus(err)
+	}
+	log.Infof("acquired credentials for %s into %s", req.Params.Principal(), req.Params.CCName)
+	return a.reply(req.Params), nil
+}
+
+func (a *ticketAgent) RenewTicket(ctx context.Context, req *ticketRequest) (*ticketReply, error) {
+	if err := a.backend.Renew(ctx, req.Params); err != nil {
+		log.Errorf("failed to renew credentials for %s: %v", req.Params.Principal(), err)
+		return nil, agentStatus(err)
+	}
+	log.Infof("renewed credentials for %s in %s", req.Params.Principal(), req.Params.CCName)
+	return a.reply(req.Params), nil
+}
+
+func (a *ticketAgent) ReleaseTicket(ctx context.Context, req *ticketRequest) (*ticketReply, error) {
+	if err := a.backend.Destroy(ctx, req.Params); err != nil {
+		log.Errorf("failed to release credentials for %s: %v", req.Params.Principal(), err)
+		return nil, agentStatus(err)
+	}
+	log.Infof("released credentials for %s in %s", req.Params.Principal(), req.Params.CCName)
+	return &ticketReply{}, nil
+}
+
+// Run the ticket agent, serving the agent API at a UNIX socket only root can connect to.
+func runAgent(args []string) {
+	var (
+		configFile string
+		logOpts    logOptions
+	)
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", defaultConfigFile, "path to the plugin configuration file")
+	logOpts.register(fs)
+	_ = fs.Parse(args)
+	if err := logOpts.apply(); err != nil {
+		log.Errorf("invalid logging options: %v", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(configFile, configFile == defaultConfigFile)
+	if err != nil {
+		log.Errorf("failed to load plugin configuration: %v", err)
+		os.Exit(1)
+	}
+	if cfg.Backend = cfg.Agent.Backend; cfg.Backend == backendAgent {
+		log.Errorf("the agent cannot use the %s backend", backendAgent)
+		os.Exit(1)
+	}
+	if err := setupHelpers(cfg.Helpers); err != nil {
+		log.Errorf("failed to set up helper limits: %v", err)
+		os.Exit(1)
+	}
+	setupResolvers(cfg.DNS)
+	backend, err := newBackend(cfg, nodeExec{}, systemClock{})
+	if err != nil {
+		log.Errorf("failed to set up Kerberos backend: %v", err)
+		os.Exit(1)
+	}
+	agent := &ticketAgent{
+		backend: newSharedBackend(&instrumentedBackend{backend}, cfg.MaxParallelSetups),
+	}
+
+	socket := cfg.Agent.socket()
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		log.Errorf("failed to create socket directory: %v", err)
+		os.Exit(1)
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("failed to remove stale socket: %v", err)
+		os.Exit(1)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Errorf("failed to listen at %s: %v", socket, err)
+		os.Exit(1)
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		log.Errorf("failed to set socket permissions: %v", err)
+		os.Exit(1)
+	}
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}))
+	srv.RegisterService(&ticketAgentDesc, agent)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	if cfg.Agent.Distribution.Listen != "" {
+		if err := serveKeytabDistribution(ctx, cfg); err != nil {
+			log.Errorf("failed to set up keytab distribution: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	log.Infof("ticket agent serving at %s", socket)
+	if err := srv.Serve(l); err != nil {
+		log.Errorf("ticket agent failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+// Backend handing credential operations to the ticket agent.
+type agentBackend struct {
+	conn *grpc.ClientConn
+}
+
+func newAgentBackend(socket string) (*agentBackend, error) {
+	conn, err := grpc.NewClient("unix://"+socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ticket agent at %s: %w", socket, err)
+	}
+	return &agentBackend{conn: conn}, nil
+}
+
+func (b *agentBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	return b.call(ctx, "AcquireTicket", kp)
+}
+
+func (b *agentBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	return b.call(ctx, "RenewTicket", kp)
+}
+
+func (b *agentBackend) Destroy(ctx context.Context, kp *kerberosParams) error {
+	return b.call(ctx, "ReleaseTicket", kp)
+}
+
+// Call the agent, mapping status errors back to their failure classes.
+func (b *agentBackend) call(ctx context.Context, method string, kp *kerberosParams) error {
+	rsp := &ticketReply{}
+	err := b.conn.Invoke(ctx, "/"+agentService+"/"+method, &ticketRequest{Params: kp}, rsp)
+	if err == nil {
+		return nil
+	}
+	st := status.Convert(err)
+	for _, c := range agentErrorCodes {
+		if st.Code() == c.code {
+			return fmt.Errorf("%w: ticket agent: %s", c.err, st.Message())
+		}
+	}
+	return fmt.Errorf("ticket agent: %s", st.Message())
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"sigs.k8s.io/yaml"
+)
+
+// Prefix of the versioned pod annotations, v1alpha2.kerberos.nri.io/user for
+// nri.io/kerberos-user. The version is part of the domain as an annotation
+// key takes a single slash, so a later schema can live next to this one.
+const annotationSchemaPrefix = "v1alpha2.kerberos.nri.io/"
+
+// Annotations of pods the plugin reads settings from, which have versioned
+// keys. Others under the prefix, like those the plugin writes or the
+// kerberos-scenario notes of the example pods, stay as they are.
+var settingAnnotations = []string{"kerberos-auth", "kerberos-user", "kerberos-uid", "kerberos-gid", gidsAnnotation,
+	"kerberos-fsid", "kerberos-realm", "kerberos-kdc", "kerberos-nfs", "kerberos-nfs-version", "kerberos-sec",
+	"kerberos-ccache-type", "kerberos-renewal-time", "kerberos-principal", automountAnnotation,
+	keytabSecretAnnotation, passwordSecretAnnotation, pkinitSecretAnnotation, anonymousAnnotation,
+	ephemeralAnnotation, forwardableAnnotation, hostAliasesAnnotation, ticketLifetimeAnnotation,
+	renewLifetimeAnnotation, principalsAnnotation, ccachePrincipalAnnotation, sharedCCacheAnnotation}
+
+// Whether an annotation name is of a setting, also as overridden for a
+// container or set for a volume, kerberos-user.app.
+func settingAnnotation(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	return slices.Contains(settingAnnotations, base)
+}
+
+// Versioned key of a prefixed annotation name, kerberos-user to
+// v1alpha2.kerberos.nri.io/user.
+func versionedAnnotation(name string) string {
+	return annotationSchemaPrefix + strings.TrimPrefix(name, "kerberos-")
+}
+
+// Copy the versioned annotations to the prefixed keys the plugin reads,
+// overriding those, and return the prefixed keys of settings the pod sets
+// without a versioned one, which are deprecated.
+func normalizeAnnotations(ann map[string]string, annotation func(string) string) []string {
+	prefix := annotation("kerberos-")
+	var legacy []string
+	for _, k := range slices.Sorted(maps.Keys(ann)) {
+		name, ok := strings.CutPrefix(k, prefix)
+		if ok && settingAnnotation("kerberos-"+name) {
+			if _, versioned := ann[annotationSchemaPrefix+name]; !versioned {
+				legacy = append(legacy, k)
+			}
+		}
+	}
+	copies := map[string]string{}
+	for k, v := range ann {
+		if name, ok := strings.CutPrefix(k, annotationSchemaPrefix); ok && name != "" {
+			copies[annotation("kerberos-"+name)] = v
+		}
+	}
+	maps.Copy(ann, copies)
+	return legacy
+}
+
+// Normalize the annotations of a pod, see normalizeAnnotations.
+func (c *config) normalizePod(pod *api.PodSandbox) []string {
+	return normalizeAnnotations(pod.GetAnnotations(), c.annotation)
+}
+
+// Normalize the annotations of a pod as it is run, posting a Warning Event
+// if it sets deprecated ones.
+func (p *plugin) normalizeRunPod(cfg *config, pod *api.PodSandbox) {
+	legacy := cfg.normalizePod(pod)
+	if len(legacy) == 0 {
+		return
+	}
+	podLogger(pod).Debugf("deprecated annotations: %s", strings.Join(legacy, ", "))
+	p.events.warn(pod, "KerberosDeprecatedAnnotations", "%s are deprecated, use %s instead, see kerberos-auth migrate-annotations",
+		strings.Join(legacy, ", "), strings.Join(versionedKeys(legacy, cfg.annotation), ", "))
+}
+
+// Versioned keys of prefixed annotation keys.
+func versionedKeys(keys []string, annotation func(string) string) []string {
+	versioned := make([]string, len(keys))
+	for i, k := range keys {
+		versioned[i] = versionedAnnotation(strings.TrimPrefix(k, annotation("")))
+	}
+	return versioned
+}
+
+// Annotations with the prefixed keys the pod sets renamed to versioned ones.
+// A versioned key set already keeps its value, as it overrides the prefixed
+// one. Annotations not of settings are kept.
+func migrateAnnotations(ann map[string]string, annotation func(string) string) map[string]string {
+	migrated := maps.Clone(ann)
+	legacy := normalizeAnnotations(maps.Clone(ann), annotation)
+	for i, k := range versionedKeys(legacy, annotation) {
+		migrated[k] = ann[legacy[i]]
+		delete(migrated, legacy[i])
+	}
+	prefix := annotation("kerberos-")
+	for k := range migrated {
+		name, ok := strings.CutPrefix(k, prefix)
+		if _, versioned := migrated[annotationSchemaPrefix+name]; ok && versioned && settingAnnotation("kerberos-"+name) {
+			delete(migrated, k)
+		}
+	}
+	return migrated
+}
+
+// Conversion of manifests to the versioned annotations:
+// `kerberos-auth migrate-annotations [-annotationPrefix nri.io/] [file...]`
+// writes the YAML or JSON manifests of the files, or of stdin, to stdout as
+// YAML, with the annotations of every object in them migrated, pod templates
+// included. Comments and the order of keys are not kept.
+func runMigrateAnnotations(args []string) {
+	prefix := defaultAnnotationPrefix
+	fs := flag.NewFlagSet("migrate-annotations", flag.ExitOnError)
+	fs.StringVar(&prefix, "annotationPrefix", defaultAnnotationPrefix, "prefix of the pod annotations")
+	_ = fs.Parse(args)
+	annotation := func(name string) string { return prefix + name }
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var docs [][]byte
+	for _, file := range files {
+		var (
+			data []byte
+			err  error
+		)
+		if file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, doc := range splitYAML(data) {
+			out, err := migrateManifest(doc, annotation)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s: %v\n", file, err)
+				os.Exit(1)
+			}
+			if out != nil {
+				docs = append(docs, out)
+			}
+		}
+	}
+	if _, err := os.Stdout.Write(bytes.Join(docs, []byte("---\n"))); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Documents of a YAML stream, split at the "---" lines, without empty ones.
+func splitYAML(data []byte) [][]byte {
+	var (
+		docs [][]byte
+		doc  []byte
+	)
+	for line := range bytes.Lines(data) {
+		if sep := bytes.TrimRight(line, "\r\n"); bytes.Equal(sep, []byte("---")) || bytes.HasPrefix(sep, []byte("--- ")) {
+			docs, doc = append(docs, doc), nil
+			continue
+		}
+		doc = append(doc, line...)
+	}
+	docs = append(docs, doc)
+	return slices.DeleteFunc(docs, func(doc []byte) bool { return len(bytes.TrimSpace(doc)) == 0 })
+}
+
+// Manifest with the annotations of its objects migrated, as YAML.
+func migrateManifest(doc []byte, annotation func(string) string) ([]byte, error) {
+	var obj any
+	if err := yaml.Unmarshal(doc, &obj); err != nil || obj == nil {
+		return nil, err
+	}
+	migrateObject(obj, annotation)
+	return yaml.Marshal(obj)
+}
+
+// Migrate the annotations in the metadata of an object and of the objects
+// nested in it, like the pod template of a Deployment or the items of a List.
+func migrateObject(obj any, annotation func(string) string) {
+	switch v := obj.(type) {
+	case map[string]any:
+		if md, ok := v["metadata"].(map[string]any); ok {
+			if ann, ok := md["annotations"].(map[string]any); ok {
+				strs := map[string]string{}
+				for k, value := range ann {
+					if s, ok := value.(string); ok {
+						strs[k] = s
+					}
+				}
+				migrated := migrateAnnotations(strs, annotation)
+				for k := range strs {
+					delete(ann, k)
+				}
+				for k, value := range migrated {
+					ann[k] = value
+				}
+			}
+		}
+		for _, value := range v {
+			migrateObject(value, annotation)
+		}
+	case []any:
+		for _, value := range v {
+			migrateObject(value, annotation)
+		}
+	}
+}
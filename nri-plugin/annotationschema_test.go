@@ -0,0 +1,298 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func testAnnotation(name string) string {
+	return defaultAnnotationPrefix + name
+}
+
+func TestNormalizeAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+		wantLegacy  []string
+	}{{
+		name: "versioned",
+		annotations: map[string]string{
+			"v1alpha2.kerberos.nri.io/auth": "enabled",
+			"v1alpha2.kerberos.nri.io/user": "alice",
+		},
+		want: map[string]string{
+			"v1alpha2.kerberos.nri.io/auth": "enabled",
+			"v1alpha2.kerberos.nri.io/user": "alice",
+			"nri.io/kerberos-auth":          "enabled",
+			"nri.io/kerberos-user":          "alice",
+		},
+	}, {
+		name: "prefixed",
+		annotations: map[string]string{
+			"nri.io/kerberos-auth":     "enabled",
+			"nri.io/kerberos-user.app": "bob",
+		},
+		want: map[string]string{
+			"nri.io/kerberos-auth":     "enabled",
+			"nri.io/kerberos-user.app": "bob",
+		},
+		wantLegacy: []string{"nri.io/kerberos-auth", "nri.io/kerberos-user.app"},
+	}, {
+		name: "versioned overriding prefixed",
+		annotations: map[string]string{
+			"nri.io/kerberos-user":          "bob",
+			"v1alpha2.kerberos.nri.io/user": "alice",
+		},
+		want: map[string]string{
+			"nri.io/kerberos-user":          "alice",
+			"v1alpha2.kerberos.nri.io/user": "alice",
+		},
+	}, {
+		name: "not settings",
+		annotations: map[string]string{
+			"nri.io/kerberos-scenario":          "no sidecar",
+			"nri.io/kerberos-status":            "ready",
+			"nri.io/kerberos-credentials-lost":  "true",
+			"nri.io/kerberos-principal.scratch": "svc",
+			"example.com/kerberos-user":         "carol",
+		},
+		want: map[string]string{
+			"nri.io/kerberos-scenario":          "no sidecar",
+			"nri.io/kerberos-status":            "ready",
+			"nri.io/kerberos-credentials-lost":  "true",
+			"nri.io/kerberos-principal.scratch": "svc",
+			"example.com/kerberos-user":         "carol",
+		},
+		wantLegacy: []string{"nri.io/kerberos-principal.scratch"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			legacy := normalizeAnnotations(tc.annotations, testAnnotation)
+			if !slices.Equal(legacy, tc.wantLegacy) {
+				t.Errorf("deprecated = %q, want %q", legacy, tc.wantLegacy)
+			}
+			if !reflect.DeepEqual(tc.annotations, tc.want) {
+				t.Errorf("annotations = %v, want %v", tc.annotations, tc.want)
+			}
+		})
+	}
+}
+
+func TestMigrateAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		prefix      string
+		annotations map[string]string
+		want        map[string]string
+	}{{
+		name: "settings",
+		annotations: map[string]string{
+			"nri.io/kerberos-auth":             "enabled",
+			"nri.io/kerberos-uid":              "10002",
+			"nri.io/kerberos-auth.metrics":     "disabled",
+			"nri.io/kerberos-nfs-version.home": "4.2",
+		},
+		want: map[string]string{
+			"v1alpha2.kerberos.nri.io/auth":             "enabled",
+			"v1alpha2.kerberos.nri.io/uid":              "10002",
+			"v1alpha2.kerberos.nri.io/auth.metrics":     "disabled",
+			"v1alpha2.kerberos.nri.io/nfs-version.home": "4.2",
+		},
+	}, {
+		name: "versioned kept over prefixed",
+		annotations: map[string]string{
+			"nri.io/kerberos-user":          "bob",
+			"v1alpha2.kerberos.nri.io/user": "alice",
+		},
+		want: map[string]string{
+			"v1alpha2.kerberos.nri.io/user": "alice",
+		},
+	}, {
+		name: "not settings kept",
+		annotations: map[string]string{
+			"nri.io/kerberos-auth":     "enabled",
+			"nri.io/kerberos-scenario": "no sidecar",
+			"nri.io/kerberos-status":   "ready",
+			"app.kubernetes.io/name":   "client",
+		},
+		want: map[string]string{
+			"v1alpha2.kerberos.nri.io/auth": "enabled",
+			"nri.io/kerberos-scenario":      "no sidecar",
+			"nri.io/kerberos-status":        "ready",
+			"app.kubernetes.io/name":        "client",
+		},
+	}, {
+		name:   "other prefix",
+		prefix: "example.com/",
+		annotations: map[string]string{
+			"example.com/kerberos-auth": "enabled",
+			"nri.io/kerberos-auth":      "enabled",
+		},
+		want: map[string]string{
+			"v1alpha2.kerberos.nri.io/auth": "enabled",
+			"nri.io/kerberos-auth":          "enabled",
+		},
+	}, {
+		name: "none",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix := tc.prefix
+			if prefix == "" {
+				prefix = defaultAnnotationPrefix
+			}
+			orig := maps.Clone(tc.annotations)
+			got := migrateAnnotations(tc.annotations, func(name string) string { return prefix + name })
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("migrateAnnotations() = %v, want %v", got, tc.want)
+			}
+			if !maps.Equal(tc.annotations, orig) {
+				t.Errorf("annotations changed to %v", tc.annotations)
+			}
+		})
+	}
+}
+
+func TestSplitYAML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want []string
+	}{{
+		name: "single",
+		data: "kind: Pod\n",
+		want: []string{"kind: Pod\n"},
+	}, {
+		name: "separated",
+		data: "kind: Pod\n---\nkind: Service\n",
+		want: []string{"kind: Pod\n", "kind: Service\n"},
+	}, {
+		name: "leading and trailing separators",
+		data: "---\nkind: Pod\n---\n",
+		want: []string{"kind: Pod\n"},
+	}, {
+		name: "empty documents dropped",
+		data: "kind: Pod\n---\n\n  \n---\nkind: Service\n",
+		want: []string{"kind: Pod\n", "kind: Service\n"},
+	}, {
+		name: "separator with a comment and CRLF",
+		data: "kind: Pod\r\n--- # next\r\nkind: Service\r\n",
+		want: []string{"kind: Pod\r\n", "kind: Service\r\n"},
+	}, {
+		name: "dashes in a value",
+		data: "data:\n  sep: ---\n  text: |\n    ----\n",
+		want: []string{"data:\n  sep: ---\n  text: |\n    ----\n"},
+	}, {
+		name: "no final newline",
+		data: "kind: Pod\n---\nkind: Service",
+		want: []string{"kind: Pod\n", "kind: Service"},
+	}, {
+		name: "empty",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, doc := range splitYAML([]byte(tc.data)) {
+				got = append(got, string(doc))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("splitYAML() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMigrateManifest(t *testing.T) {
+	doc := []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: client
+  annotations:
+    nri.io/kerberos-scenario: example
+spec:
+  template:
+    metadata:
+      annotations:
+        nri.io/kerberos-auth: "enabled"
+        nri.io/kerberos-uid: "10002"
+`)
+	out, err := migrateManifest(doc, testAnnotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := yaml.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"nri.io/kerberos-scenario": "example"}; !maps.Equal(got.Metadata.Annotations, want) {
+		t.Errorf("annotations = %v, want %v", got.Metadata.Annotations, want)
+	}
+	want := map[string]string{"v1alpha2.kerberos.nri.io/auth": "enabled", "v1alpha2.kerberos.nri.io/uid": "10002"}
+	if !maps.Equal(got.Spec.Template.Metadata.Annotations, want) {
+		t.Errorf("pod template annotations = %v, want %v", got.Spec.Template.Metadata.Annotations, want)
+	}
+}
+
+// The example and e2e pods use the versioned annotations, so that they get no
+// deprecation Events.
+func TestManifestsMigrated(t *testing.T) {
+	files, err := filepath.Glob("../k8s-manifests/client-user*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, "../e2e/manifests/workload.yaml")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, doc := range splitYAML(data) {
+			var orig any
+			if err := yaml.Unmarshal(doc, &orig); err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			want, err := yaml.Marshal(orig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := migrateManifest(doc, testAnnotation)
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("%s has deprecated annotations, migrated:\n%s", file, got)
+			}
+		}
+	}
+}
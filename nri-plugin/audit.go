@@ -0,0 +1,277 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	auditToStderr   = "stderr"
+	auditToFile     = "file"
+	auditToSyslog   = "syslog"
+	auditToJournald = "journald"
+
+	defaultAuditFile = "/var/log/nri-kerberos-audit.log"
+
+	// Native protocol socket of systemd-journald.
+	journaldSocket = "/run/systemd/journal/socket"
+
+	// How long to wait for the service account of a pod for its records.
+	auditLookupTimeout = 2 * time.Second
+
+	// FS_APPEND_FL of linux/fs.h, the append-only inode attribute.
+	fsAppendFL = 0x20
+)
+
+// Audit log configuration.
+type auditConfig struct {
+	// Destination is one of stderr, file, syslog or journald. Empty disables
+	// auditing.
+	Destination string `json:"destination,omitempty"`
+	// Path of the audit log when Destination is file.
+	Path string `json:"path,omitempty"`
+	// Mark the audit log file append-only, so that records cannot be altered
+	// or removed, not even by root without CAP_LINUX_IMMUTABLE. It cannot be
+	// rotated then either.
+	AppendOnly bool `json:"appendOnly,omitempty"`
+}
+
+// A single audit record. It deliberately has no room for secrets.
+type auditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	Node      string    `json:"node"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	// Service account of the pod, if the Kubernetes API is accessible.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	Principal      string `json:"principal"`
+	Realm          string `json:"realm"`
+	// KDC asked first, the others of the realm may have answered.
+	KDC string `json:"kdc,omitempty"`
+	NFS string `json:"nfs"`
+	// NFS exports the volumes of the pod mount, as server:path.
+	Exports []string `json:"exports,omitempty"`
+	// success or failure, with the error of a failure.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Writer for audit records, independent of the main logger and its level.
+type auditLogger struct {
+	sync.Mutex
+	w    io.Writer
+	node string
+	now  func() time.Time
+	// Service accounts of pods, by pod UID.
+	accounts map[string]string
+}
+
+// Create an audit logger for the configured destination. Returns nil if auditing is disabled.
+func newAuditLogger(cfg auditConfig, node string) (*auditLogger, error) {
+	var w io.Writer
+
+	switch cfg.Destination {
+	case "":
+		return nil, nil
+	case auditToStderr:
+		w = os.Stderr
+	case auditToFile:
+		path := cfg.Path
+		if path == "" {
+			path = defaultAuditFile
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log %q: %w", path, err)
+		}
+		if cfg.AppendOnly {
+			if err := setAppendOnly(f); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to make audit log %q append-only: %w", path, err)
+			}
+		}
+		w = f
+	case auditToSyslog:
+		sw, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "nri-kerberos")
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		w = sw
+	case auditToJournald:
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to journald: %w", err)
+		}
+		w = &journaldWriter{conn: conn}
+	default:
+		return nil, fmt.Errorf("invalid audit destination %q", cfg.Destination)
+	}
+
+	return &auditLogger{
+		w:        w,
+		node:     node,
+		now:      time.Now,
+		accounts: map[string]string{},
+	}, nil
+}
+
+// Write an audit record. Safe to call on a nil (disabled) logger.
+func (a *auditLogger) Log(rec auditRecord) {
+	if a == nil {
+		return
+	}
+
+	rec.Timestamp = a.now().UTC()
+	rec.Node = a.node
+
+	msg, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("failed to marshal audit record: %v", err)
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.w.Write(append(msg, '\n')); err != nil {
+		log.Errorf("failed to write audit record: %v", err)
+	}
+}
+
+// Audit an operation on the credentials of a pod, or of a container of it,
+// with its outcome. Safe to call with auditing disabled.
+func (p *plugin) auditOp(event string, pod *api.PodSandbox, container string, kp *kerberosParams, err error) {
+	if p.audit == nil {
+		return
+	}
+	rec := auditRecord{
+		Event:          event,
+		Namespace:      pod.GetNamespace(),
+		Pod:            pod.GetName(),
+		Container:      container,
+		ServiceAccount: p.audit.serviceAccount(p.kube, pod),
+		Principal:      kp.Principal(),
+		Realm:          kp.Realm,
+		KDC:            kp.KDC,
+		NFS:            strings.Join(kp.nfsServers(), ","),
+		Exports:        p.podExports(pod),
+		Outcome:        result(err),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	p.audit.Log(rec)
+}
+
+// NFS exports mounted by the volumes of a pod, sorted.
+func (p *plugin) podExports(pod *api.PodSandbox) []string {
+	if pod.GetUid() == "" {
+		return nil
+	}
+	mounts, err := podVolumeMounts(p.mounter, p.config().MountCheck.kubeletDir(), pod.GetUid())
+	if err != nil {
+		return nil
+	}
+	exports := map[string]bool{}
+	for _, m := range mounts {
+		exports[m.source] = true
+	}
+	return slices.Sorted(maps.Keys(exports))
+}
+
+// Service account of a pod, looked up once, empty without API access.
+func (a *auditLogger) serviceAccount(kube *kubeClient, pod *api.PodSandbox) string {
+	if kube == nil || pod.GetUid() == "" {
+		return ""
+	}
+	a.Lock()
+	sa, ok := a.accounts[pod.GetUid()]
+	a.Unlock()
+	if ok {
+		return sa
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditLookupTimeout)
+	defer cancel()
+	sa, err := podServiceAccount(ctx, kube, pod)
+	if err != nil {
+		log.Debugf("no service account of %s/%s for the audit log: %v", pod.GetNamespace(), pod.GetName(), err)
+		return ""
+	}
+	a.Lock()
+	a.accounts[pod.GetUid()] = sa
+	a.Unlock()
+	return sa
+}
+
+// Forget the service account of a removed pod. Safe to call on a nil logger.
+func (a *auditLogger) forget(pod *api.PodSandbox) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	delete(a.accounts, pod.GetUid())
+	a.Unlock()
+}
+
+// Writer of records to journald by its native protocol, one entry each, with
+// the record as the message.
+type journaldWriter struct {
+	conn net.Conn
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	entry := "SYSLOG_IDENTIFIER=nri-kerberos\nSYSLOG_FACILITY=10\nPRIORITY=6\nMESSAGE=" +
+		strings.TrimSuffix(string(p), "\n") + "\n"
+	if _, err := w.conn.Write([]byte(entry)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Set the append-only attribute of a file, as chattr +a does.
+func setAppendOnly(f *os.File) error {
+	attrs, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, attrs|fsAppendFL)
+}
+
+// Name of the node we run on, as given by the downward API or the hostname.
+func nodeName() string {
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
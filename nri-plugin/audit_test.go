@@ -0,0 +1,228 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+
+	"github.com/tuminoid/nri-plugins/kerberos-auth/kubeapi"
+)
+
+// Fields every audit record has, as documented, but for error.
+var auditFields = []string{"timestamp", "event", "node", "namespace", "pod", "container",
+	"principal", "realm", "nfs", "outcome"}
+
+// Fields audit records have when known.
+var auditOptionalFields = []string{"serviceAccount", "kdc", "exports"}
+
+// Audit log of a test plugin, in a buffer, with the service accounts of pods
+// served by a fake API server, counting its lookups.
+func newTestAudit(t *testing.T, p *plugin) (*bytes.Buffer, *atomic.Int32) {
+	t.Helper()
+	lookups := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		fmt.Fprint(w, `{"spec":{"serviceAccountName":"app"}}`)
+	}))
+	t.Cleanup(srv.Close)
+	p.kube = &kubeClient{&kubeapi.Client{Server: srv.URL, HTTP: srv.Client()}}
+
+	buf := &bytes.Buffer{}
+	p.audit = &auditLogger{
+		w:        buf,
+		node:     "worker-1",
+		now:      func() time.Time { return time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC) },
+		accounts: map[string]string{},
+	}
+	return buf, lookups
+}
+
+// Audit records of a log, checked to have all documented fields and the
+// optional ones given.
+func auditRecords(t *testing.T, buf *bytes.Buffer, optional ...string) []auditRecord {
+	t.Helper()
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		fields := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("invalid audit record %q: %v", line, err)
+		}
+		for _, f := range slices.Concat(auditFields, optional) {
+			if _, ok := fields[f]; !ok {
+				t.Errorf("audit record %q has no %s", line, f)
+			}
+		}
+		_, hasErr := fields["error"]
+		if failed := fields["outcome"] == "failure"; hasErr != failed {
+			t.Errorf("audit record %q has error %v, failed %v", line, hasErr, failed)
+		}
+		rec := auditRecord{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditRecord(t *testing.T) {
+	keytab := []byte("\x05\x02audit-test-keytab-key")
+	keytabPath := filepath.Join(t.TempDir(), "alice.keytab")
+	if err := os.WriteFile(keytabPath, keytab, 0600); err != nil {
+		t.Fatal(err)
+	}
+	const password = "audit-test-password"
+
+	for _, tc := range []struct {
+		name      string
+		event     string
+		container string
+		kp        *kerberosParams
+		err       error
+		want      auditRecord
+	}{{
+		name:  "setup with a password",
+		event: "setup",
+		kp:    &kerberosParams{User: "alice", Realm: "EXAMPLE.COM", KDC: "kdc.example.com", NFS: "nfs.example.com", Password: password},
+		want: auditRecord{Event: "setup", Principal: "alice@EXAMPLE.COM", Realm: "EXAMPLE.COM",
+			KDC: "kdc.example.com", NFS: "nfs.example.com", Outcome: "success"},
+	}, {
+		name:  "failed renewal with a keytab",
+		event: "renew",
+		kp:    &kerberosParams{User: "alice", Realm: "EXAMPLE.COM", KDC: "kdc.example.com", NFS: "nfs.example.com", Keytab: keytabPath},
+		err:   fmt.Errorf("%w: KDC unreachable", errCCacheFailed),
+		want: auditRecord{Event: "renew", Principal: "alice@EXAMPLE.COM", Realm: "EXAMPLE.COM",
+			KDC: "kdc.example.com", NFS: "nfs.example.com", Outcome: "failure",
+			Error: errCCacheFailed.Error() + ": KDC unreachable"},
+	}, {
+		name:      "rekey of a container with credentials of its own",
+		event:     "rekey",
+		container: "sidecar",
+		kp: &kerberosParams{User: "svc", Realm: "EXAMPLE.COM", KDC: "kdc.example.com", NFS: "nfs.example.com",
+			NFSServers: []string{"nfs.example.com", "nfs2.example.com"}, Keytab: keytabPath, Container: "sidecar"},
+		want: auditRecord{Event: "rekey", Container: "sidecar", Principal: "svc@EXAMPLE.COM", Realm: "EXAMPLE.COM",
+			KDC: "kdc.example.com", NFS: "nfs.example.com,nfs2.example.com", Outcome: "success"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, rt := newTestPlugin(t, testConfigYAML, newFakeBackend())
+			buf, _ := newTestAudit(t, p)
+			pod := rt.Pod("team-a", "app-0", nil)
+			addPodVolumes(p, pod)
+
+			p.auditOp(tc.event, pod, tc.container, tc.kp, tc.err)
+
+			want := tc.want
+			want.Timestamp = time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+			want.Node = "worker-1"
+			want.Namespace = "team-a"
+			want.Pod = "app-0"
+			want.ServiceAccount = "app"
+			want.Exports = []string{"nfs.example.com:/home/alice", "nfs.example.com:/scratch"}
+			if got := auditRecords(t, buf, auditOptionalFields...); len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+				t.Errorf("audit records = %+v, want %+v", got, want)
+			}
+			for _, secret := range []string{password, string(keytab), base64.StdEncoding.EncodeToString(keytab)} {
+				if strings.Contains(buf.String(), secret) {
+					t.Errorf("audit log %q contains secret %q", buf.String(), secret)
+				}
+			}
+		})
+	}
+}
+
+// NFS mounts of volumes of a pod, of nfs.example.com:/home/alice twice and
+// nfs.example.com:/scratch, and others not of its NFS volumes.
+func addPodVolumes(p *plugin, pod *api.PodSandbox) {
+	volumes := filepath.Join(defaultKubeletDir, "pods", pod.GetUid(), "volumes")
+	m := p.mounter.(*fakeMounter)
+	m.Lock()
+	defer m.Unlock()
+	m.mounts = append(m.mounts,
+		&hostMount{mountPoint: filepath.Join(volumes, "kubernetes.io~nfs", "scratch"), fsType: "nfs4", source: "nfs.example.com:/scratch"},
+		&hostMount{mountPoint: filepath.Join(volumes, "kubernetes.io~nfs", "home"), fsType: "nfs4", source: "nfs.example.com:/home/alice"},
+		&hostMount{mountPoint: filepath.Join(volumes, "kubernetes.io~csi", "home", "mount"), fsType: "nfs", source: "nfs.example.com:/home/alice"},
+		&hostMount{mountPoint: filepath.Join(volumes, "kubernetes.io~empty-dir", "tmp"), fsType: "tmpfs", source: "tmpfs"},
+		&hostMount{mountPoint: filepath.Join(defaultKubeletDir, "pods", "other", "volumes", "kubernetes.io~nfs", "home"), fsType: "nfs4", source: "nfs.example.com:/home/bob"},
+	)
+}
+
+func TestAuditPodLifecycle(t *testing.T) {
+	ctx := context.Background()
+	b := &fakeBackend{lifetime: time.Hour, renewable: 24 * time.Hour}
+	p, rt := newTestPlugin(t, testConfigYAML, b)
+	buf, lookups := newTestAudit(t, p)
+	pod := rt.Pod("team-a", "app-0", testAnnotations("alice", 61101))
+	addPodVolumes(p, pod)
+	if err := rt.RunPod(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.CreateContainer(ctx, pod, rt.Container(pod, "app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.RemovePod(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, rec := range auditRecords(t, buf, auditOptionalFields...) {
+		if rec.Namespace != "team-a" || rec.Pod != "app-0" || rec.ServiceAccount != "app" || rec.Principal != "alice@EXAMPLE.COM" {
+			t.Errorf("audit record %+v not of the pod", rec)
+		}
+		got = append(got, rec.Event+" "+rec.Outcome)
+	}
+	want := []string{"setup success", "destroy success"}
+	if !slices.Equal(got, want) {
+		t.Errorf("audit events = %q, want %q", got, want)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("service account looked up %d times, want once", n)
+	}
+	if _, ok := p.audit.accounts[pod.GetUid()]; ok {
+		t.Error("service account of the removed pod not forgotten")
+	}
+}
+
+// Pods without a uid are audited without exports and service account.
+func TestAuditPodWithoutUID(t *testing.T) {
+	p, _ := newTestPlugin(t, testConfigYAML, newFakeBackend())
+	buf, lookups := newTestAudit(t, p)
+	pod := &api.PodSandbox{Namespace: "team-a", Name: "app-0"}
+	p.auditOp("setup", pod, "", &kerberosParams{User: "alice", Realm: "EXAMPLE.COM", NFS: "nfs.example.com"}, nil)
+	recs := auditRecords(t, buf)
+	if len(recs) != 1 || recs[0].ServiceAccount != "" || recs[0].Exports != nil {
+		t.Errorf("audit records = %+v, want one without service account and exports", recs)
+	}
+	if n := lookups.Load(); n != 0 {
+		t.Errorf("service account looked up %d times, want never", n)
+	}
+}
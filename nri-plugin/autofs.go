@@ -0,0 +1,276 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// Annotation of the exports a pod has automounted, as
+	// /data=nfs.example.com:/export/data.
+	automountAnnotation = "kerberos-automount"
+
+	defaultAutofsMapFile    = "/etc/auto.nri-kerberos"
+	defaultAutofsMasterFile = "/etc/auto.master.d/nri-kerberos.autofs"
+	defaultAutofsMountDir   = "/run/nri-kerberos/autofs"
+	defaultAutofsTimeout    = 5 * time.Minute
+)
+
+// Exports of NFS servers mounted by automount(8) for the pods asking for them
+// rather than by the kubelet: the plugin writes an indirect autofs map with
+// an entry per pod, keyed by its UID, mounting its exports with the security
+// flavor and NFS version of the pod, and bind mounts them into its
+// containers. Exports are mounted when first accessed and unmounted when
+// idle, so that nodes with many pods of sparsely used shares neither mount
+// all of them at pod start nor keep them mounted.
+type autofsConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Map of the entries of the pods, /etc/auto.nri-kerberos by default.
+	MapFile string `json:"mapFile,omitempty"`
+	// Master map drop-in mounting the map, written at start,
+	// /etc/auto.master.d/nri-kerberos.autofs by default.
+	MasterFile string `json:"masterFile,omitempty"`
+	// Directory the map is mounted at, /run/nri-kerberos/autofs by default.
+	MountDir string `json:"mountDir,omitempty"`
+	// Time exports are unmounted after when idle, 5m by default.
+	Timeout duration `json:"timeout,omitempty"`
+	// Command making automount reread its maps,
+	// systemctl reload autofs.service by default.
+	ReloadCommand []string `json:"reloadCommand,omitempty"`
+}
+
+func (c *autofsConfig) mapFile() string {
+	if c.MapFile != "" {
+		return c.MapFile
+	}
+	return defaultAutofsMapFile
+}
+
+func (c *autofsConfig) masterFile() string {
+	if c.MasterFile != "" {
+		return c.MasterFile
+	}
+	return defaultAutofsMasterFile
+}
+
+func (c *autofsConfig) mountDir() string {
+	if c.MountDir != "" {
+		return c.MountDir
+	}
+	return defaultAutofsMountDir
+}
+
+func (c *autofsConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultAutofsTimeout
+}
+
+func (c *autofsConfig) reloadCommand() []string {
+	if len(c.ReloadCommand) > 0 {
+		return c.ReloadCommand
+	}
+	return []string{"systemctl", "reload", "autofs.service"}
+}
+
+// An export automounted for a pod, at a path of its containers.
+type automount struct {
+	Path   string
+	Source string
+}
+
+// Parse the automounts of a pod, path=server:/export pairs separated by
+// commas or whitespace, checking the exports are of the NFS servers of the
+// pod unless servers is nil.
+func parseAutomounts(value string, servers []string) ([]automount, error) {
+	var mounts []automount
+	for _, pair := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		dest, source, ok := strings.Cut(pair, "=")
+		server, export := splitNFSSource(source)
+		switch {
+		case !ok || !path.IsAbs(dest) || server == "" || !path.IsAbs(export):
+			return nil, fmt.Errorf("%q must be a path and an export, as /data=nfs.example.com:/export/data", pair)
+		case path.Clean(dest) == "/":
+			return nil, fmt.Errorf("%q cannot be mounted at /", source)
+		case servers != nil && !sameServer(servers, server):
+			return nil, fmt.Errorf("%s is not an NFS server of the pod, %s", server, strings.Join(servers, ", "))
+		case slices.ContainsFunc(mounts, func(m automount) bool { return m.Path == path.Clean(dest) }):
+			return nil, fmt.Errorf("%s given twice", dest)
+		case strings.ContainsAny(export, " \t\\\"&"):
+			return nil, fmt.Errorf("%q is not an export autofs maps can hold", export)
+		}
+		mounts = append(mounts, automount{Path: path.Clean(dest), Source: nfsSource(server, path.Clean(export))})
+	}
+	if len(mounts) == 0 {
+		return nil, fmt.Errorf("no automounts in %q", value)
+	}
+	return mounts, nil
+}
+
+// Autofs map of the pods of the node.
+type autofsMaps struct {
+	cfg  autofsConfig
+	exec Exec
+
+	sync.Mutex
+	// Map entries by pod UID.
+	entries map[string]string
+}
+
+// Install the master map drop-in of the autofs map, keeping the entries the
+// map has from before a restart, or nil if not enabled.
+func newAutofsMaps(ctx context.Context, cfg autofsConfig, exec Exec) (*autofsMaps, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	a := &autofsMaps{cfg: cfg, exec: exec, entries: map[string]string{}}
+	if data, err := os.ReadFile(cfg.mapFile()); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if key, _, ok := strings.Cut(scanner.Text(), "\t"); ok && !strings.HasPrefix(key, "#") {
+				a.entries[key] = scanner.Text()
+			}
+		}
+	}
+	if err := os.MkdirAll(cfg.mountDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", cfg.mountDir(), err)
+	}
+	if _, err := a.write(); err != nil {
+		return nil, err
+	}
+	master := fmt.Sprintf("%s %s --timeout=%d\n", cfg.mountDir(), cfg.mapFile(), int(cfg.timeout().Seconds()))
+	// #nosec G306:gosec -- autofs maps are world-readable
+	changed, err := installFile(cfg.masterFile(), []byte(master), 0644)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		a.reload(ctx)
+	}
+	return a, nil
+}
+
+// Add the entry of a pod, mounting its exports with the security flavor,
+// krb5 if it requires none, and NFS version it requires.
+func (a *autofsMaps) add(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) error {
+	if a == nil || len(kp.Automounts) == 0 || pod.GetUid() == "" {
+		return nil
+	}
+	sec := kp.Sec
+	if sec == "" {
+		sec = "krb5"
+	}
+	options := "-fstype=nfs,sec=" + sec
+	if kp.NFSVersion != "" {
+		options += ",vers=" + kp.NFSVersion
+	}
+	entry := pod.GetUid() + "\t" + options
+	for i, m := range kp.Automounts {
+		entry += fmt.Sprintf(" /%d %s", i, m.Source)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if a.entries[pod.GetUid()] == entry {
+		return nil
+	}
+	a.entries[pod.GetUid()] = entry
+	changed, err := a.write()
+	if err != nil {
+		return err
+	}
+	if changed {
+		loggerFrom(ctx).Infof("automounting %d exports for %s", len(kp.Automounts), kp.Principal())
+		a.reload(ctx)
+	}
+	return nil
+}
+
+// Remove the entry of a pod.
+func (a *autofsMaps) remove(ctx context.Context, pod *api.PodSandbox) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.entries[pod.GetUid()]; !ok {
+		return
+	}
+	delete(a.entries, pod.GetUid())
+	if _, err := a.write(); err != nil {
+		loggerFrom(ctx).Error(err)
+		return
+	}
+	a.reload(ctx)
+}
+
+// Bind mounts of the automounted exports of a pod into its containers,
+// slave to the mounts automount makes on the node.
+func (a *autofsMaps) mounts(pod *api.PodSandbox, kp *kerberosParams) []*api.Mount {
+	if a == nil || pod.GetUid() == "" {
+		return nil
+	}
+	var mounts []*api.Mount
+	for i, m := range kp.Automounts {
+		mounts = append(mounts, &api.Mount{
+			Destination: m.Path,
+			Type:        "bind",
+			Source:      filepath.Join(a.cfg.mountDir(), pod.GetUid(), strconv.Itoa(i)),
+			Options:     []string{"rbind", "rslave", "nosuid", "nodev"},
+		})
+	}
+	return mounts
+}
+
+// Write the map, returning whether it changed. Called with the lock held.
+func (a *autofsMaps) write() (bool, error) {
+	keys := make([]string, 0, len(a.entries))
+	for key := range a.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString("# Managed by nri-kerberos, entries by pod UID\n")
+	for _, key := range keys {
+		buf.WriteString(a.entries[key] + "\n")
+	}
+	// #nosec G306:gosec -- autofs maps are world-readable
+	return installFile(a.cfg.mapFile(), buf.Bytes(), 0644)
+}
+
+// Make automount reread the maps, for removed and changed entries.
+func (a *autofsMaps) reload(ctx context.Context) {
+	if err := runNodeCommand(ctx, a.exec, a.cfg.reloadCommand()); err != nil {
+		loggerFrom(ctx).Errorf("failed to reload autofs maps: %v", err)
+	}
+}
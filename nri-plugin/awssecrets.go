@@ -0,0 +1,321 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsSecretsService = "secretsmanager"
+	awsSTSService     = "sts"
+	awsSigningAlgo    = "AWS4-HMAC-SHA256"
+	awsTimeFormat     = "20060102T150405Z"
+
+	// Credentials expiring sooner are refreshed before use.
+	awsCredentialsMinLifetime = 5 * time.Minute
+)
+
+// AWS Secrets Manager credential source configuration. The plugin
+// authenticates with the workload identity of its pod: EKS Pod Identity, IAM
+// roles for service accounts, or else the AWS_ACCESS_KEY_ID of its env.
+type awsSecretsConfig struct {
+	// Region of the secrets, AWS_REGION by default.
+	Region string `json:"region,omitempty"`
+	// Endpoint of Secrets Manager, as a VPC endpoint, the regional one by default.
+	Endpoint string `json:"endpoint,omitempty"`
+	cloudSecretPaths
+}
+
+// Session credentials of the plugin for AWS.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// Secrets Manager client signing its requests with the workload identity of
+// the plugin.
+type awsSecrets struct {
+	cfg  awsSecretsConfig
+	http *http.Client
+
+	sync.Mutex
+	creds *awsCredentials
+}
+
+// Create the AWS Secrets Manager credential source, nil if it is not configured.
+func newAWSSecretsSource(cfg awsSecretsConfig) (*cloudSecretSource, error) {
+	if cfg.DefaultPath == "" && len(cfg.NamespacePaths) == 0 {
+		return nil, nil
+	}
+	if cfg.Region == "" {
+		cfg.Region = firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("AWS Secrets Manager needs a region")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", awsSecretsService, cfg.Region)
+	}
+	a := &awsSecrets{cfg: cfg, http: &http.Client{Timeout: 10 * time.Second}}
+	return newCloudSecretSource("AWS Secrets Manager "+cfg.Region, cfg.cloudSecretPaths, a.read), nil
+}
+
+// Value of the first of the environment variables set.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Read the SecretString, or else the SecretBinary, of a secret by name or ARN.
+func (a *awsSecrets) read(ctx context.Context, secret string) ([]byte, error) {
+	creds, err := a.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": secret})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(a.cfg.Endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, a.cfg.Region, awsSecretsService, time.Now())
+
+	rsp, err := a.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GetSecretValue %s failed: %w", secret, err)
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("GetSecretValue %s failed: %w", secret, err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &e)
+		if e.Type == "ResourceNotFoundException" {
+			return nil, fmt.Errorf("GetSecretValue %s: %w", secret, errNotFound)
+		}
+		if e.Type == "ExpiredTokenException" {
+			a.Lock()
+			a.creds = nil
+			a.Unlock()
+		}
+		return nil, fmt.Errorf("GetSecretValue %s failed: %s %s %s", secret, rsp.Status, e.Type, e.Message)
+	}
+
+	var value struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary []byte `json:"SecretBinary"`
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("GetSecretValue %s: %w", secret, err)
+	}
+	if value.SecretString != "" {
+		return []byte(value.SecretString), nil
+	}
+	return value.SecretBinary, nil
+}
+
+// Session credentials of the workload identity of the plugin, refreshed
+// shortly before they expire.
+func (a *awsSecrets) credentials(ctx context.Context) (*awsCredentials, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.creds != nil && (a.creds.Expires.IsZero() || time.Until(a.creds.Expires) > awsCredentialsMinLifetime) {
+		return a.creds, nil
+	}
+
+	var creds *awsCredentials
+	var err error
+	switch {
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		creds, err = a.podIdentityCredentials(ctx)
+	case os.Getenv("AWS_ROLE_ARN") != "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		creds, err = a.webIdentityCredentials(ctx)
+	case os.Getenv("AWS_ACCESS_KEY_ID") != "":
+		creds = &awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	default:
+		err = errors.New("no AWS workload identity: neither EKS Pod Identity nor IAM roles for service accounts set up")
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.creds = creds
+	return creds, nil
+}
+
+// Credentials of EKS Pod Identity, from the agent on the node.
+func (a *awsSecrets) podIdentityCredentials(ctx context.Context) (*awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EKS Pod Identity token: %w", err)
+		}
+		req.Header.Set("Authorization", strings.TrimSpace(string(token)))
+	}
+	rsp, err := a.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("EKS Pod Identity credentials: %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("EKS Pod Identity credentials: %s", rsp.Status)
+	}
+	var c struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&c); err != nil {
+		return nil, fmt.Errorf("EKS Pod Identity credentials: %w", err)
+	}
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.Token, Expires: c.Expiration}, nil
+}
+
+// Credentials of IAM roles for service accounts, assuming the role with the
+// projected service account token.
+func (a *awsSecrets) webIdentityCredentials(ctx context.Context) (*awsCredentials, error) {
+	token, err := os.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web identity token: %w", err)
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "nri-kerberos-" + nodeName()
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	endpoint := fmt.Sprintf("https://%s.%s.amazonaws.com/", awsSTSService, a.cfg.Region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rsp, err := a.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity failed: %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity failed: %s", rsp.Status)
+	}
+	var r struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&r); err != nil {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity: %w", err)
+	}
+	c := r.Credentials
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// Sign a request with AWS Signature Version 4.
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsTimeFormat)
+	date := amzDate[:8]
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	names := []string{"content-type", "host", "x-amz-date"}
+	if creds.SessionToken != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	if req.Header.Get("X-Amz-Target") != "" {
+		names = append(names, "x-amz-target")
+	}
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path, req.URL.RawQuery, headers.String(), signed, hex.EncodeToString(payload[:])}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{awsSigningAlgo, amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", awsSigningAlgo, creds.AccessKeyID, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
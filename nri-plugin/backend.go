@@ -0,0 +1,244 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	backendScript = "script"
+	backendNative = "native"
+
+	defaultScriptPath    = "/opt/nri-hooks/kerberos.sh"
+	defaultScriptTimeout = 30 * time.Second
+	defaultKeytabDir     = "/etc/keytabs"
+)
+
+// Parameters for setting up Kerberos credentials for a workload. The ids are
+// those of the host, see containerIDs for those the containers see.
+type kerberosParams struct {
+	UID  uint64
+	GID  uint64
+	FSID uint64
+	// Supplementary gids of the workload, the first owning the pod
+	// credential cache, see ccacheGID.
+	GIDs  []uint64 `json:",omitempty"`
+	User  string
+	Realm string
+	KDC   string
+	// NFS server of the pod, the first of NFSServers if it has several.
+	NFS      string
+	CCName   string
+	Password string
+	// Keytab already fetched for the workload, if any.
+	Keytab string
+	// Certificate to obtain the TGT with by PKINIT instead, if any.
+	PKINIT *pkinitIdentity
+	// Whether the credential cache was installed with a TGT issued by the
+	// token broker, leaving the backend nothing to obtain.
+	Issued bool `json:",omitempty"`
+	// CA to verify the KDC with when obtaining an anonymous TGT by anonymous
+	// PKINIT instead, for anonymous workloads, nil for others.
+	Anonymous *pkinitIdentity
+	// Further KDCs of the realm, tried in order after KDC.
+	KDCs []string
+	// DNS domains of the realm.
+	Domains []string
+	// MS-KKDCP proxy the KDCs are reached through, if any.
+	KDCProxy *kdcProxyConfig
+	// Type of the credential cache published to the pod, FILE if empty.
+	CCacheType string
+	// Hand the pod the gss-proxy socket instead of a credential cache.
+	GSSProxy bool
+	// Weakest NFS security flavor the volumes of the pod may be mounted with, if any.
+	Sec string
+	// NFS version the volumes of the pod are to be mounted with, if any.
+	NFSVersion string
+	// NFS versions of single volumes, by kubelet volume directory name.
+	NFSVolumeVersions map[string]string
+	// Container with credentials of its own these are for, empty for the pod.
+	Container string
+	// All NFS servers of the pod, for pods with several.
+	NFSServers []string
+	// Principals volumes of the pod are accessed as instead, by volume
+	// directory name, without realm.
+	VolumePrincipals map[string]string
+	// Volumes these are for, for credentials of a principal volumes of the pod
+	// are mapped to.
+	Volumes []string
+	// Further principals of the pod, without realm, with credentials of
+	// their own next to those of the pod.
+	Principals []string `json:",omitempty"`
+	// Credentials of one of the further principals of the pod.
+	Secondary bool `json:",omitempty"`
+	// EmptyDir volume of the pod its DIR credential cache collection is
+	// shared in by all its containers, if any.
+	SharedVolume string `json:",omitempty"`
+	// Principal name of the workload without realm, from the principal
+	// template, User if empty.
+	Name string
+	// User namespace of the pod, nil if it runs in that of the host.
+	UserNS *userNamespace
+	// Realm of the NFS service principals, Realm if empty.
+	NFSRealm string
+	// Realms between Realm and NFSRealm on the cross-realm trust path.
+	TrustPath []string
+	// Realms of the trust path after Realm, for krb5.conf.
+	TrustRealms []trustedRealm
+	// Settings of the generated krb5.conf files, the defaults if nil.
+	Krb5Conf *krb5ConfConfig
+	// Enctypes permitted, those of the Kerberos libraries if empty.
+	ETypes []string
+	// Refuse the RC4 and DES enctypes.
+	FIPS bool
+	// Realm is that of an Active Directory domain.
+	ActiveDirectory bool
+	// Addresses the KDC and NFS host names of the workload resolve to, by
+	// lower case host name, instead of those of the node resolver.
+	HostAliases map[string]string
+	// Ticket and renewable lifetimes the pod asked for, those of the node
+	// if 0.
+	TicketLifetime time.Duration
+	RenewLifetime  time.Duration
+	// Interval the credentials are renewed at in the plugin, from
+	// KERBEROS_RENEWAL_TIME, instead of the renewal fraction if not 0.
+	RenewalInterval time.Duration
+	// Class of the namespace of the pod, see qosConfig.
+	QoS string `json:",omitempty"`
+	// Forwardable tickets asked for, to be forwarded by the workload.
+	Forwardable bool
+	// Credentials of the node principal instead of the user, see
+	// hostFallbackConfig.
+	HostFallback bool
+	// Exports automounted for the pod, see autofsConfig.
+	Automounts []automount `json:",omitempty"`
+	// Keytab of the user still in use by another pod, left in place when
+	// the credentials are destroyed.
+	KeytabInUse bool `json:",omitempty"`
+}
+
+// Principal name of the workload.
+func (kp *kerberosParams) Principal() string {
+	if kp.Anonymous != nil {
+		return anonymousPrincipal
+	}
+	return kp.principalName() + "@" + kp.Realm
+}
+
+// Principal name of the workload without realm.
+func (kp *kerberosParams) principalName() string {
+	if kp.Name != "" {
+		return kp.Name
+	}
+	return kp.User
+}
+
+// All NFS servers of the pod, the first one being NFS.
+func (kp *kerberosParams) nfsServers() []string {
+	if len(kp.NFSServers) > 0 {
+		return kp.NFSServers
+	}
+	return []string{kp.NFS}
+}
+
+// NFS service principal names of the servers of the pod, without realm.
+func (kp *kerberosParams) nfsServices() []string {
+	var services []string
+	for _, server := range kp.nfsServers() {
+		services = append(services, "nfs/"+hostOf(server))
+	}
+	return services
+}
+
+// KerberosBackend acquires, renews and destroys credentials for a workload.
+// The backend configured is one of the script, native and agent backends.
+// Mounting is left to the kubelet, and the plugin publishes the credential
+// cache to the pod itself, whichever the backend.
+type KerberosBackend interface {
+	// Setup obtains initial credentials into the credential cache.
+	Setup(ctx context.Context, params *kerberosParams) error
+	// Renew refreshes the credentials in the credential cache.
+	Renew(ctx context.Context, params *kerberosParams) error
+	// Destroy removes the credential cache and any other host state Setup created.
+	Destroy(ctx context.Context, params *kerberosParams) error
+}
+
+// SetupBackend sets credentials up in phases, for a backend run as a
+// KerberosBackend by phasedBackend. Only the script backend is one, its
+// phases being those of the script; the native and agent backends obtain
+// the keytab and the tickets in a single Setup.
+type SetupBackend interface {
+	// Prepare fetches what the TGT is obtained with, such as the keytab.
+	Prepare(ctx context.Context, params *kerberosParams) error
+	// Mount obtains the TGT and the NFS service tickets the volumes of the
+	// pod are mounted with into the credential cache.
+	Mount(ctx context.Context, params *kerberosParams) error
+	// Renew refreshes the credentials in the credential cache.
+	Renew(ctx context.Context, params *kerberosParams) error
+	// Teardown removes the credential cache and any other host state
+	// Prepare and Mount created.
+	Teardown(ctx context.Context, params *kerberosParams) error
+}
+
+// KerberosBackend of a SetupBackend, preparing and mounting on setup.
+type phasedBackend struct {
+	SetupBackend
+}
+
+func (b phasedBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	if err := b.Prepare(ctx, kp); err != nil {
+		return err
+	}
+	return b.Mount(ctx, kp)
+}
+
+func (b phasedBackend) Destroy(ctx context.Context, kp *kerberosParams) error {
+	return b.Teardown(ctx, kp)
+}
+
+// Create the backend selected in the configuration.
+func newBackend(cfg *config, exec Exec, clock Clock) (KerberosBackend, error) {
+	switch cfg.Backend {
+	case backendScript:
+		path := cfg.ScriptPath
+		if path == "" {
+			path = defaultScriptPath
+		}
+		timeout := cfg.ScriptTimeout.Duration
+		if timeout <= 0 {
+			timeout = defaultScriptTimeout
+		}
+		return phasedBackend{&ScriptBackend{path: path, timeout: timeout, phases: cfg.ScriptPhases, output: cfg.ScriptOutput, exec: exec}}, nil
+	case "", backendNative:
+		dir := cfg.KeytabDir
+		if dir == "" {
+			dir = defaultKeytabDir
+		}
+		url := cfg.KeytabURL
+		if url == "" {
+			url = defaultKeytabURL
+		}
+		return newNativeBackend(dir, url, cfg.FAST, cfg.Delegation, cfg.ClockSkew, exec, clock), nil
+	case backendAgent:
+		return newAgentBackend(cfg.Agent.socket())
+	default:
+		return nil, fmt.Errorf("invalid backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,474 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	defaultKeytabURL = "http://{kdc}:8080/keytabs/{user}.keytab"
+
+	keytabFetchAttempts = 3
+	keytabFetchDelay    = 2 * time.Second
+)
+
+// NativeBackend talks to the KDC directly using gokrb5, needing no host Kerberos tooling.
+// Like kerberos.sh it downloads the user keytab from the KDC host before kinit.
+type NativeBackend struct {
+	keytabDir string
+	keytabURL string
+	http      *http.Client
+	// Armor of AS exchanges, nil if FAST is off.
+	armor *fastArmor
+	// Constrained delegation, nil if off.
+	delegation *delegationConfig
+	skew       clockSkewConfig
+	exec       Exec
+	clock      Clock
+
+	sync.Mutex
+	downloaded map[string]bool
+	proxies    map[kdcProxyConfig]*kdcProxy
+}
+
+func newNativeBackend(keytabDir, keytabURL string, fast fastConfig, delegation delegationConfig, skew clockSkewConfig, exec Exec, clock Clock) *NativeBackend {
+	var armor *fastArmor
+	if fast.Enabled {
+		armor = newFASTArmor(fast, exec, clock)
+	}
+	var delegated *delegationConfig
+	if delegation.Enabled {
+		delegated = &delegation
+	}
+	return &NativeBackend{
+		keytabDir:  keytabDir,
+		keytabURL:  keytabURL,
+		http:       &http.Client{Timeout: 10 * time.Second},
+		armor:      armor,
+		delegation: delegated,
+		skew:       skew,
+		exec:       exec,
+		clock:      clock,
+		downloaded: make(map[string]bool),
+		proxies:    make(map[kdcProxyConfig]*kdcProxy),
+	}
+}
+
+// Setup performs an AS exchange using the password, if given, or the user
+// keytab. PKINIT and FAST armored exchanges are left to MIT kinit, and with
+// constrained delegation the NFS service tickets are obtained for workloads
+// without either by the service principal of the plugin. Failures
+// due to clock skew tell the offset of the KDC clock and, with
+// clockSkew.retry, exchanges of gokrb5 are retried with MIT kinit, which
+// corrects its timestamps by the time of the KDC. Failures in Active
+// Directory domains tell the likely misconfiguration of the account.
+func (b *NativeBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	err := b.setup(ctx, kp)
+	if kp.ActiveDirectory {
+		err = explainADError(err)
+	}
+	if !errors.Is(err, errClockSkew) {
+		return err
+	}
+	err = b.clockSkew(ctx, kp, err)
+	if !b.skew.Retry || kp.PKINIT != nil || kp.Anonymous != nil || b.armor.applies(kp.Realm) || b.delegation.applies(kp) {
+		return err
+	}
+	loggerFrom(ctx).Warnf("%v, retrying with MIT kinit", err)
+	if rerr := b.kinitSetup(ctx, kp, ""); rerr != nil {
+		return fmt.Errorf("%w, retry with MIT kinit failed: %v", err, rerr)
+	}
+	return nil
+}
+
+func (b *NativeBackend) setup(ctx context.Context, kp *kerberosParams) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var armor string
+	if b.armor.applies(kp.Realm) {
+		path, err := b.armor.ccache(ctx, kp)
+		if err != nil {
+			return err
+		}
+		armor = "FILE:" + path
+	}
+	if kp.PKINIT != nil || kp.Anonymous != nil {
+		if err := pkinit(ctx, b.exec, kp, armor); err != nil {
+			return err
+		}
+		return kvnoServiceTickets(ctx, b.exec, kp)
+	}
+	if b.delegation.applies(kp) {
+		return b.delegate(ctx, kp)
+	}
+	if armor != "" {
+		return b.kinitSetup(ctx, kp, armor)
+	}
+
+	cfg, stop, err := b.krb5Config(ctx, kp)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	var cl *client.Client
+	if kp.Password != "" {
+		name := kp.principalName()
+		if kp.ActiveDirectory {
+			name = adAccountName(ctx, cfg, kp)
+		}
+		cl = client.NewWithPassword(name, kp.Realm, kp.Password, cfg, client.DisablePAFXFAST(true))
+	} else {
+		path := kp.Keytab
+		if path == "" {
+			if path, err = b.fetchKeytab(ctx, kp); err != nil {
+				return err
+			}
+		}
+		kt, err := loadPermittedKeytab(kp, path)
+		if err != nil {
+			return err
+		}
+		if err := preflightKeytab(ctx, cfg, kp, kt); err != nil {
+			return fmt.Errorf("kinit for %s failed: %w", kp.Principal(), err)
+		}
+		cl = client.NewWithKeytab(kp.principalName(), kp.Realm, kt, cfg, client.DisablePAFXFAST(true))
+	}
+	defer cl.Destroy()
+
+	req, err := messages.NewASReqForTGT(kp.Realm, cfg, cl.Credentials.CName())
+	if err != nil {
+		return fmt.Errorf("failed to create AS-REQ for %s: %w", kp.Principal(), err)
+	}
+	rep, err := cl.ASExchange(kp.Realm, req, 0)
+	if err != nil {
+		return fmt.Errorf("kinit for %s failed: %w", kp.Principal(), classifyKrbError(err))
+	}
+
+	tgt, key, trusts, err := crossRealmTGTs(cl, kp, rep.Ticket, rep.DecryptedEncPart.Key)
+	if err != nil {
+		return fmt.Errorf("credentials for %s: %w", kp.Principal(), err)
+	}
+	services := serviceTickets(ctx, cl, kp, tgt, key)
+	return storeCredentials(kp, rep.CRealm, rep.CName, rep.Ticket, rep.DecryptedEncPart, append(trusts, services...)...)
+}
+
+// Obtain credentials with the password or keytab using kinit, armored with
+// the FAST armor cache if given.
+func (b *NativeBackend) kinitSetup(ctx context.Context, kp *kerberosParams, armor string) error {
+	path := kp.Keytab
+	if path == "" && kp.Password == "" {
+		var err error
+		if path, err = b.fetchKeytab(ctx, kp); err != nil {
+			return err
+		}
+	}
+	if err := kinitCredentials(ctx, b.exec, kp, path, armor); err != nil {
+		return err
+	}
+	return kvnoServiceTickets(ctx, b.exec, kp)
+}
+
+// Obtain the NFS service tickets of the workload with its TGT of the realm of
+// the NFS service principals, logging those which cannot be had: rpc.gssd may
+// yet get them under the canonical name of the server.
+func serviceTickets(ctx context.Context, cl *client.Client, kp *kerberosParams, tgt messages.Ticket, key types.EncryptionKey) []*ccacheEntry {
+	var entries []*ccacheEntry
+	obtainServiceTickets(ctx, kp, func(service string) error {
+		spn := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service)
+		_, rep, err := cl.TGSREQGenerateAndExchange(spn, kp.serviceRealm(), tgt, key, false)
+		if err != nil {
+			return classifyKrbError(err)
+		}
+		entry, err := newCCacheEntry(rep.CRealm, rep.CName, rep.Ticket, rep.DecryptedEncPart)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries
+}
+
+// Write the credentials from a KDC reply into the credential cache of the
+// workload, followed by any service tickets.
+func storeCredentials(kp *kerberosParams, crealm string, cname types.PrincipalName, tkt messages.Ticket, part messages.EncKDCRepPart, services ...*ccacheEntry) error {
+	entry, err := newCCacheEntry(crealm, cname, tkt, part)
+	if err == nil {
+		err = writeCCache(kp.CCName, int(kp.UID), int(kp.GID), append([]*ccacheEntry{entry}, services...)...)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	return nil
+}
+
+// Download the user keytab, retrying a few times. An already present keytab is
+// used if the download fails.
+func (b *NativeBackend) fetchKeytab(ctx context.Context, kp *kerberosParams) (string, error) {
+	path := filepath.Join(b.keytabDir, kp.User+".keytab")
+	url := expandKeytabURL(b.keytabURL, kp.hostAddress(kp.KDC), kp.User)
+
+	var err error
+	for attempt := 1; attempt <= keytabFetchAttempts; attempt++ {
+		if err = b.download(ctx, url, path, kp); err == nil {
+			b.Lock()
+			b.downloaded[path] = true
+			b.Unlock()
+			return path, nil
+		}
+		if attempt < keytabFetchAttempts {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(keytabFetchDelay):
+			}
+		}
+	}
+
+	if _, statErr := os.Stat(path); statErr == nil {
+		log.Warnf("failed to download keytab for %s, using existing %q: %v", kp.User, path, err)
+		return path, nil
+	}
+
+	return "", fmt.Errorf("%w: failed to download keytab from %s: %w", errKeytabUnavailable, url, err)
+}
+
+// Keytab URL of a user for a KDC: {kdc} is replaced by the host of the KDC,
+// without its port and with an IPv6 literal in brackets, so that the port of
+// the template applies, and {user} by the user, escaped.
+func expandKeytabURL(template, kdc, user string) string {
+	return strings.NewReplacer("{kdc}", urlHost(kdc), "{user}", url.PathEscape(user)).Replace(template)
+}
+
+func (b *NativeBackend) download(ctx context.Context, url, path string, kp *kerberosParams) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", rsp.Status)
+	}
+
+	if err := os.MkdirAll(b.keytabDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(b.keytabDir, kp.User+".keytab.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, rsp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chown(int(kp.UID), int(kp.GID)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Renew renews the TGT in the credential cache, falling back to Setup if that is not possible.
+// Delegated credentials hold no TGT of the workload and are delegated afresh.
+func (b *NativeBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	if b.delegation.applies(kp) {
+		return b.Setup(ctx, kp)
+	}
+	if err := b.renew(ctx, kp); err != nil {
+		log.Infof("renewal for %s failed, getting a fresh ticket: %v", kp.Principal(), err)
+		return b.Setup(ctx, kp)
+	}
+	return nil
+}
+
+func (b *NativeBackend) renew(ctx context.Context, kp *kerberosParams) error {
+	cfg, stop, err := b.krb5Config(ctx, kp)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	path, err := ccachePath(kp.CCName)
+	if err != nil {
+		return err
+	}
+	cc, err := loadCCache(path)
+	if err != nil {
+		return fmt.Errorf("%w: failed to load credential cache %q: %w", errCCacheFailed, path, err)
+	}
+
+	spn := types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", kp.Realm},
+	}
+	cred, ok := cc.GetEntry(spn)
+	if !ok {
+		return fmt.Errorf("%w: no TGT in credential cache %q", errCCacheFailed, path)
+	}
+	var tgt messages.Ticket
+	if err := tgt.Unmarshal(cred.Ticket); err != nil {
+		return fmt.Errorf("%w: invalid TGT in credential cache %q: %w", errCCacheFailed, path, err)
+	}
+
+	cl, err := client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true))
+	if err != nil {
+		return fmt.Errorf("%w: failed to use credential cache %q: %w", errCCacheFailed, path, err)
+	}
+	defer cl.Destroy()
+
+	_, rep, err := cl.TGSREQGenerateAndExchange(spn, kp.Realm, tgt, cred.Key, true)
+	if err != nil {
+		return fmt.Errorf("TGT renewal failed: %w", classifyKrbError(err))
+	}
+
+	tgt, key, trusts, err := crossRealmTGTs(cl, kp, rep.Ticket, rep.DecryptedEncPart.Key)
+	if err != nil {
+		return fmt.Errorf("TGT renewal failed: %w", err)
+	}
+	services := serviceTickets(ctx, cl, kp, tgt, key)
+	return storeCredentials(kp, rep.CRealm, rep.CName, rep.Ticket, rep.DecryptedEncPart, append(trusts, services...)...)
+}
+
+// Destroy removes the credential cache and the keytab, if we downloaded it and
+// no other pod still uses it.
+func (b *NativeBackend) Destroy(_ context.Context, kp *kerberosParams) error {
+	if err := destroyCCache(kp.CCName); err != nil {
+		return err
+	}
+	if kp.KeytabInUse {
+		return nil
+	}
+
+	path := filepath.Join(b.keytabDir, kp.User+".keytab")
+	b.Lock()
+	downloaded := b.downloaded[path]
+	delete(b.downloaded, path)
+	b.Unlock()
+
+	if downloaded {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove keytab %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Kerberos configuration for talking to the KDC of the workload, through a
+// relay to its KDC proxy if it has one. The returned function stops the relay.
+func (b *NativeBackend) krb5Config(ctx context.Context, kp *kerberosParams) (*krb5config.Config, func(), error) {
+	if kp.KDCProxy == nil {
+		dual := *kp.withHostAliases()
+		if kdcs := dualStackKDCs(ctx, append([]string{kp.KDC}, kp.KDCs...)); len(kdcs) > 0 {
+			dual.KDC, dual.KDCs = kdcs[0], kdcs[1:]
+		}
+		cfg, err := nativeKrb5Config(&dual)
+		return cfg, func() {}, err
+	}
+
+	b.Lock()
+	proxy, ok := b.proxies[*kp.KDCProxy]
+	if !ok {
+		var err error
+		if proxy, err = newKDCProxy(*kp.KDCProxy); err != nil {
+			b.Unlock()
+			return nil, nil, err
+		}
+		b.proxies[*kp.KDCProxy] = proxy
+	}
+	b.Unlock()
+
+	addr, stop, err := proxy.relay(ctx, kp.Realm)
+	if err != nil {
+		return nil, nil, err
+	}
+	direct := *kp
+	direct.KDC, direct.KDCs, direct.KDCProxy = addr, nil, nil
+	cfg, err := nativeKrb5Config(&direct)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	// the relay only speaks TCP
+	cfg.LibDefaults.UDPPreferenceLimit = 1
+	return cfg, stop, nil
+}
+
+// Minimal krb5.conf for talking to the KDC of the workload. gokrb5 takes
+// dns_canonicalize_hostname for a boolean and does not use it, the plugin
+// canonicalizes the names of the NFS servers itself: fallback is passed as true.
+func nativeKrb5Config(kp *kerberosParams) (*krb5config.Config, error) {
+	native := *kp
+	// gokrb5 takes a KDC with a colon for one with a port, so IPv6 literals
+	// get theirs here
+	if kp.KDC != "" {
+		native.KDC = kdcAddress(kp.KDC)
+	}
+	native.KDCs = kdcAddresses(kp.KDCs)
+	native.TrustRealms = nil
+	for _, r := range kp.TrustRealms {
+		r.KDCs = kdcAddresses(r.KDCs)
+		native.TrustRealms = append(native.TrustRealms, r)
+	}
+	if kp.Krb5Conf.canonicalize() == canonicalizeFallback {
+		settings := *kp.Krb5Conf
+		settings.DNSCanonicalizeHostname = canonicalizeTrue
+		native.Krb5Conf = &settings
+	}
+	conf, err := renderKrb5Conf(&native, "")
+	if err == nil {
+		var cfg *krb5config.Config
+		if cfg, err = krb5config.NewFromString(conf); err == nil {
+			return cfg, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to create Kerberos configuration: %w", err)
+}
@@ -0,0 +1,292 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+
+	"github.com/tuminoid/nri-plugins/kerberos-auth/testkdc"
+)
+
+// KDC of the test with alice and the NFS service of nfs.example.com, stopped
+// after the test.
+func startTestKDC(t *testing.T, cfg testkdc.Config) *testkdc.KDC {
+	t.Helper()
+	kdc, err := testkdc.Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kdc.Close() })
+	if err := kdc.AddPrincipal("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kdc.AddService("nfs/nfs.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	return kdc
+}
+
+// Native backend with its keytabs in a directory of the test, downloading
+// them from keytabURL.
+func newTestNativeBackend(t *testing.T, keytabURL string) *NativeBackend {
+	return newNativeBackend(t.TempDir(), keytabURL, fastConfig{}, delegationConfig{}, clockSkewConfig{}, &fakeExec{}, systemClock{})
+}
+
+// Parameters of alice of the KDC, with the NFS server nfs.example.com.
+func nativeParams(t *testing.T, kdc *testkdc.KDC) *kerberosParams {
+	kp := testParams(t, kdc.Addr())
+	kp.Realm = kdc.Realm()
+	kp.Krb5Conf = &krb5ConfConfig{}
+	return kp
+}
+
+// Check that the credential cache holds a TGT of alice valid in a while, and
+// the NFS service ticket.
+func checkNativeCCache(t *testing.T, kp *kerberosParams) {
+	t.Helper()
+	if err := checkCCachePrincipal(kp.CCName, kp.Principal()); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCCache(kp.CCName, kp.Realm, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readCCache(kp.CCName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.server.PrincipalNameString() == "nfs/nfs.example.com" {
+			return
+		}
+	}
+	t.Errorf("no service ticket of nfs/nfs.example.com in %d credentials", len(entries))
+}
+
+func TestNativeBackendSetup(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Set up the credentials of kp, a keytab written by the KDC being at path.
+		prepare func(t *testing.T, kdc *testkdc.KDC, kp *kerberosParams, path string)
+		wantErr error
+	}{{
+		name: "password",
+		prepare: func(_ *testing.T, _ *testkdc.KDC, kp *kerberosParams, _ string) {
+			kp.Password = "secret"
+		},
+	}, {
+		name: "wrong password",
+		prepare: func(_ *testing.T, _ *testkdc.KDC, kp *kerberosParams, _ string) {
+			kp.Password = "guessed"
+		},
+		wantErr: errPreauthFailed,
+	}, {
+		name: "unknown principal",
+		prepare: func(_ *testing.T, kdc *testkdc.KDC, kp *kerberosParams, _ string) {
+			kdc.DeletePrincipal("alice")
+			kp.Password = "secret"
+		},
+		wantErr: errPrincipalUnknown,
+	}, {
+		name: "keytab",
+		prepare: func(_ *testing.T, _ *testkdc.KDC, kp *kerberosParams, path string) {
+			kp.Keytab = path
+		},
+	}, {
+		name: "keytab of an older key version",
+		prepare: func(t *testing.T, kdc *testkdc.KDC, kp *kerberosParams, path string) {
+			if err := kdc.ChangePassword("alice", "rotated"); err != nil {
+				t.Fatal(err)
+			}
+			kp.Keytab = path
+		},
+		wantErr: errKeytabMismatch,
+	}, {
+		name: "keytab of another principal",
+		prepare: func(t *testing.T, kdc *testkdc.KDC, kp *kerberosParams, path string) {
+			if err := kdc.AddPrincipal("bob", "secret"); err != nil {
+				t.Fatal(err)
+			}
+			if err := kdc.WriteKeytab(path, "bob"); err != nil {
+				t.Fatal(err)
+			}
+			kp.Keytab = path
+		},
+		wantErr: errKeytabMismatch,
+	}, {
+		name: "keytab missing",
+		prepare: func(_ *testing.T, _ *testkdc.KDC, kp *kerberosParams, path string) {
+			kp.Keytab = path + ".missing"
+		},
+		wantErr: errKeytabUnavailable,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			kdc := startTestKDC(t, testkdc.Config{})
+			path := filepath.Join(t.TempDir(), "alice.keytab")
+			if err := kdc.WriteKeytab(path, "alice"); err != nil {
+				t.Fatal(err)
+			}
+			kp := nativeParams(t, kdc)
+			tc.prepare(t, kdc, kp, path)
+			err := newTestNativeBackend(t, "").Setup(context.Background(), kp)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Setup() error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil {
+				checkNativeCCache(t, kp)
+			} else if _, err := os.Stat(strings.TrimPrefix(kp.CCName, "FILE:")); err == nil {
+				t.Error("credential cache written on failure")
+			}
+		})
+	}
+}
+
+func TestNativeBackendRenew(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  testkdc.Config
+		// Wait before renewing, for the tickets to expire.
+		wait time.Duration
+		// Delete the principal before renewing.
+		revoked bool
+		// Whether the credentials are obtained afresh rather than renewed.
+		wantSetup bool
+		wantErr   error
+	}{{
+		name: "renewable",
+	}, {
+		name:      "not renewable",
+		cfg:       testkdc.Config{RenewLifetime: -1},
+		wantSetup: true,
+	}, {
+		name:      "renewable lifetime expired",
+		cfg:       testkdc.Config{TicketLifetime: time.Second, RenewLifetime: time.Second},
+		wait:      2100 * time.Millisecond,
+		wantSetup: true,
+	}, {
+		name:      "principal deleted",
+		revoked:   true,
+		wantSetup: true,
+		wantErr:   errPrincipalUnknown,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			kdc := startTestKDC(t, tc.cfg)
+			b := newTestNativeBackend(t, "")
+			kp := nativeParams(t, kdc)
+			kp.Password = "secret"
+			ctx := context.Background()
+			if err := b.Setup(ctx, kp); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tc.wait)
+			if tc.revoked {
+				kdc.DeletePrincipal("alice")
+			}
+
+			as := kdc.Requests(msgtype.KRB_AS_REQ)
+			err := b.Renew(ctx, kp)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Renew() error = %v, want %v", err, tc.wantErr)
+			}
+			if setup := kdc.Requests(msgtype.KRB_AS_REQ) > as; setup != tc.wantSetup {
+				t.Errorf("credentials obtained afresh = %v, want %v", setup, tc.wantSetup)
+			}
+			if tc.wantErr == nil && tc.cfg.TicketLifetime == 0 {
+				checkNativeCCache(t, kp)
+			}
+		})
+	}
+}
+
+func TestNativeBackendDestroy(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Keytab given rather than downloaded.
+		given       bool
+		keytabInUse bool
+		wantKeytab  bool
+	}{{
+		name: "downloaded keytab",
+	}, {
+		name:        "downloaded keytab in use",
+		keytabInUse: true,
+		wantKeytab:  true,
+	}, {
+		name:       "keytab given",
+		given:      true,
+		wantKeytab: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			kdc := startTestKDC(t, testkdc.Config{})
+			kt, err := kdc.Keytab("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := kt.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/keytabs/alice.keytab" {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = w.Write(data)
+			}))
+			defer srv.Close()
+
+			b := newTestNativeBackend(t, srv.URL+"/keytabs/{user}.keytab")
+			kp := nativeParams(t, kdc)
+			path := filepath.Join(b.keytabDir, "alice.keytab")
+			if tc.given {
+				if err := kdc.WriteKeytab(path, "alice"); err != nil {
+					t.Fatal(err)
+				}
+				kp.Keytab = path
+			}
+			ctx := context.Background()
+			if err := b.Setup(ctx, kp); err != nil {
+				t.Fatal(err)
+			}
+			checkNativeCCache(t, kp)
+
+			kp.KeytabInUse = tc.keytabInUse
+			if err := b.Destroy(ctx, kp); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ccacheTimes(kp.CCName, kp.Realm); err == nil {
+				t.Error("credential cache not destroyed")
+			}
+			if _, err := os.Stat(path); (err == nil) != tc.wantKeytab {
+				t.Errorf("keytab kept = %v, want %v", err == nil, tc.wantKeytab)
+			}
+			// destroying again is fine, as after a restart
+			if err := b.Destroy(ctx, kp); err != nil {
+				t.Errorf("Destroy() again: %v", err)
+			}
+		})
+	}
+}
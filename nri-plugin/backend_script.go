@@ -0,0 +1,368 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ScriptBackend runs the kerberos.sh hook script, relying on host kinit and
+// klist. Sites keep a script of their own by pointing scriptPath at it: it
+// gets the parameters as arguments, with a leading "stop" to tear down, and the
+// operation, start, renew or stop, in KERBEROS_OPERATION. With phases the
+// script is run once for each setup phase instead of once for start, for
+// prepare and then mount.
+type ScriptBackend struct {
+	path    string
+	timeout time.Duration
+	phases  bool
+	output  scriptOutputConfig
+	exec    Exec
+}
+
+// Capture of the output of the script.
+type scriptOutputConfig struct {
+	// Bytes of output captured of a run, the rest discarded, 64KiB by default.
+	MaxBytes int `json:"maxBytes,omitempty"`
+	// Lines of output kept per pod for the admin API, 100 by default.
+	Lines int `json:"lines,omitempty"`
+}
+
+func (c *scriptOutputConfig) validate() error {
+	if c.MaxBytes < 0 || c.Lines < 0 {
+		return errors.New("maxBytes and lines must not be negative")
+	}
+	return nil
+}
+
+func (c *scriptOutputConfig) maxBytes() int {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return defaultScriptOutputBytes
+}
+
+func (c *scriptOutputConfig) lines() int {
+	if c.Lines > 0 {
+		return c.Lines
+	}
+	return defaultScriptOutputLines
+}
+
+// Prepare runs the script to fetch the keytab, with phases, and refuses
+// passwords, which the script cannot obtain a TGT with.
+func (b *ScriptBackend) Prepare(ctx context.Context, kp *kerberosParams) error {
+	if kp.Password != "" {
+		return fmt.Errorf("%w: %s supports keytabs only", errKeytabUnavailable, b.path)
+	}
+	if !b.phases {
+		return nil
+	}
+	return b.runExplained(ctx, kp, scriptPrepare)
+}
+
+// Mount runs the script to obtain the TGT and the NFS service tickets, the
+// whole setup without phases.
+func (b *ScriptBackend) Mount(ctx context.Context, kp *kerberosParams) error {
+	if !b.phases {
+		return b.runExplained(ctx, kp, scriptStart)
+	}
+	return b.runExplained(ctx, kp, scriptMount)
+}
+
+// Renew re-runs the script, which obtains a fresh ticket from the keytab.
+func (b *ScriptBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	return b.run(ctx, kp, scriptRenew)
+}
+
+// Teardown runs the script in stop mode, destroying the tickets and removing the
+// downloaded keytab, unless KERBEROS_KEEP_KEYTAB tells it another pod still uses it.
+func (b *ScriptBackend) Teardown(ctx context.Context, kp *kerberosParams) error {
+	return b.run(ctx, kp, scriptStop)
+}
+
+// Operations the script is run for.
+const (
+	scriptStart   = "start"
+	scriptPrepare = "prepare"
+	scriptMount   = "mount"
+	scriptRenew   = "renew"
+	scriptStop    = "stop"
+)
+
+// Run the script, explaining failures with Active Directory realms.
+func (b *ScriptBackend) runExplained(ctx context.Context, kp *kerberosParams, mode string) error {
+	err := b.run(ctx, kp, mode)
+	if kp.ActiveDirectory {
+		return explainADError(err)
+	}
+	return err
+}
+
+// Time the script has to close its output after being killed, in case it left
+// children behind holding it open.
+const scriptWaitDelay = 2 * time.Second
+
+// Lines of script output kept for the error message.
+const scriptTailLines = 5
+
+// Output of the script captured of a run and kept per pod, by default.
+const (
+	defaultScriptOutputBytes = 64 << 10
+	defaultScriptOutputLines = 100
+)
+
+func (b *ScriptBackend) run(ctx context.Context, kp *kerberosParams, mode string) (err error) {
+	var args []string
+	if mode == scriptStop {
+		args = append(args, scriptStop)
+	}
+	start := time.Now()
+	defer func() {
+		scriptDuration.WithLabelValues(mode, result(err)).Observe(time.Since(start).Seconds())
+	}()
+
+	args = append(args,
+		fmt.Sprintf("%d", kp.UID), fmt.Sprintf("%d", kp.GID), fmt.Sprintf("%d", kp.FSID),
+		kp.User, kp.Realm, kp.hostAddress(kp.KDC), kp.NFS, kp.CCName, kp.Keytab)
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	// #nosec G204:gosec
+	cmd := exec.CommandContext(ctx, b.path, args...)
+	// run in a process group of its own, killed as a whole on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = scriptWaitDelay
+	cmd.Env = append(os.Environ(), "NFS_HOSTNAMES="+strings.Join(kp.nfsServers(), " "), "KERBEROS_PRINCIPAL="+kp.Principal(), "KERBEROS_OPERATION="+mode,
+		"KERBEROS_NFS_REALM="+kp.serviceRealm())
+	if kp.PKINIT != nil {
+		cmd.Env = append(cmd.Env,
+			"KERBEROS_PKINIT_CERT="+kp.PKINIT.Cert,
+			"KERBEROS_PKINIT_KEY="+kp.PKINIT.Key,
+			"KERBEROS_PKINIT_ANCHORS="+kp.PKINIT.Anchors)
+	}
+	if kp.Anonymous != nil {
+		cmd.Env = append(cmd.Env, "KERBEROS_ANONYMOUS=true", "KERBEROS_PKINIT_ANCHORS="+kp.Anonymous.Anchors)
+	}
+	if len(kp.GIDs) > 0 {
+		gids := make([]string, len(kp.GIDs))
+		for i, gid := range kp.GIDs {
+			gids[i] = strconv.FormatUint(gid, 10)
+		}
+		cmd.Env = append(cmd.Env, "KERBEROS_GIDS="+strings.Join(gids, ","))
+	}
+	if ticket, renew := kp.lifetimes(); ticket > 0 || renew > 0 {
+		cmd.Env = append(cmd.Env, "KERBEROS_TICKET_LIFETIME="+krb5Lifetime(duration{ticket}), "KERBEROS_RENEW_LIFETIME="+krb5Lifetime(duration{renew}))
+	}
+	if kp.Forwardable {
+		cmd.Env = append(cmd.Env, "KERBEROS_FORWARDABLE=true")
+	}
+	if kp.KeytabInUse {
+		cmd.Env = append(cmd.Env, "KERBEROS_KEEP_KEYTAB=true")
+	}
+
+	out := newScriptOutput(ctx, mode, b.output.maxBytes())
+	cmd.Stdout = out.stream("stdout")
+	cmd.Stderr = out.stream("stderr")
+
+	err = b.exec.RunCmd(ctx, cmd)
+	out.flush(err)
+	scriptOutputs.add(ctx, out, b.output.lines())
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s killed after %s: %w", b.path, b.timeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", b.path, err, out.tail())
+	}
+
+	return nil
+}
+
+// Script output, captured line by line as it comes up to a byte limit, and
+// logged once the script exited, at debug level if it succeeded and as
+// warnings if not. Lines are prefixed with the container the credentials are
+// for, if any, and the last ones kept for error messages and the admin API.
+type scriptOutput struct {
+	sync.Mutex
+	log       *logrus.Entry
+	operation string
+	container string
+	max       int
+	size      int
+	truncated bool
+	streams   []*scriptStream
+	lines     []scriptLine
+}
+
+// Line of script output.
+type scriptLine struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Container string    `json:"container,omitempty"`
+	Stream    string    `json:"stream"`
+	Line      string    `json:"line"`
+}
+
+// Line as logged, prefixed with the container.
+func (l *scriptLine) String() string {
+	if l.Container != "" {
+		return l.Container + ": " + l.Line
+	}
+	return l.Line
+}
+
+type scriptStream struct {
+	out  *scriptOutput
+	name string
+	buf  []byte
+}
+
+// Output of a run of the script for the operation, of the pod and container
+// of the logger of the context.
+func newScriptOutput(ctx context.Context, operation string, limit int) *scriptOutput {
+	l := loggerFrom(ctx)
+	container, _ := l.Data["container"].(string)
+	return &scriptOutput{log: l.WithField("script", operation), operation: operation, container: container, max: limit}
+}
+
+func (o *scriptOutput) stream(name string) io.Writer {
+	s := &scriptStream{out: o, name: name}
+	o.streams = append(o.streams, s)
+	return s
+}
+
+// Take in output up to the byte limit of the run, discarding the rest.
+func (s *scriptStream) Write(b []byte) (int, error) {
+	s.out.Lock()
+	defer s.out.Unlock()
+	n := len(b)
+	if room := s.out.max - s.out.size; len(b) > room {
+		b, s.out.truncated = b[:max(room, 0)], true
+	}
+	s.out.size += len(b)
+	s.buf = append(s.buf, b...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		s.out.line(s.name, string(s.buf[:i]))
+		s.buf = s.buf[i+1:]
+	}
+	return n, nil
+}
+
+// Keep a line of output, with the lock held.
+func (o *scriptOutput) line(stream, line string) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	o.lines = append(o.lines, scriptLine{Time: time.Now(), Operation: o.operation, Container: o.container, Stream: stream, Line: line})
+}
+
+// Keep any incomplete last lines, once the script has exited, and log the
+// output at the level the exit status calls for.
+func (o *scriptOutput) flush(err error) {
+	o.Lock()
+	defer o.Unlock()
+	for _, s := range o.streams {
+		if len(s.buf) > 0 {
+			o.line(s.name, string(s.buf))
+			s.buf = nil
+		}
+	}
+	level := logrus.DebugLevel
+	if err != nil {
+		level = logrus.WarnLevel
+	}
+	for i := range o.lines {
+		o.log.WithField("stream", o.lines[i].Stream).Log(level, o.lines[i].String())
+	}
+	if o.truncated {
+		o.log.Logf(level, "output truncated after %d bytes", o.max)
+	}
+}
+
+// Last lines of the output, for error messages.
+func (o *scriptOutput) tail() string {
+	o.Lock()
+	defer o.Unlock()
+	var last []string
+	for _, l := range o.lines[max(len(o.lines)-scriptTailLines, 0):] {
+		last = append(last, l.String())
+	}
+	return strings.Join(last, "; ")
+}
+
+// Last lines of script output, by namespace/name of the pod, for the admin
+// API. Runs for no pod are not kept.
+type scriptOutputLog struct {
+	sync.Mutex
+	byPod map[string][]scriptLine
+}
+
+var scriptOutputs = &scriptOutputLog{byPod: map[string][]scriptLine{}}
+
+// Keep the output of a run for the pod of the logger of the context, up to
+// keep lines of the pod.
+func (s *scriptOutputLog) add(ctx context.Context, o *scriptOutput, keep int) {
+	l := loggerFrom(ctx)
+	namespace, _ := l.Data["namespace"].(string)
+	pod, _ := l.Data["pod"].(string)
+	if pod == "" || keep <= 0 {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	lines := append(s.byPod[namespace+"/"+pod], o.lines...)
+	s.byPod[namespace+"/"+pod] = slices.Clone(lines[max(len(lines)-keep, 0):])
+}
+
+// Output kept for a pod.
+func (s *scriptOutputLog) get(namespace, name string) []scriptLine {
+	s.Lock()
+	defer s.Unlock()
+	return slices.Clone(s.byPod[namespace+"/"+name])
+}
+
+// Forget the output of a removed pod.
+func (s *scriptOutputLog) forget(namespace, name string) {
+	s.Lock()
+	delete(s.byPod, namespace+"/"+name)
+	s.Unlock()
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultMaxParallelSetups = 4
+
+// Backend wrapper letting concurrent setups and renewals of the same
+// credentials share a single run, and bounding how many run at once, those
+// waiting served by their QoS class. When a deployment scales up, the pods of
+// the same user then cause one kinit and one credential cache write instead of
+// one each.
+type sharedBackend struct {
+	KerberosBackend
+	group singleflight.Group
+	slots *prioritySlots
+}
+
+func newSharedBackend(b KerberosBackend, parallel int) *sharedBackend {
+	if parallel <= 0 {
+		parallel = defaultMaxParallelSetups
+	}
+	return &sharedBackend{
+		KerberosBackend: b,
+		slots:           newPrioritySlots(parallel),
+	}
+}
+
+func (b *sharedBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	return b.share(ctx, "setup", kp, b.KerberosBackend.Setup)
+}
+
+func (b *sharedBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	return b.share(ctx, "renew", kp, b.KerberosBackend.Renew)
+}
+
+// Run the operation, or wait for the one already running for the same principal
+// and credential cache. The run is done with the context of the first caller.
+func (b *sharedBackend) share(ctx context.Context, op string, kp *kerberosParams, fn func(context.Context, *kerberosParams) error) error {
+	key := op + " " + kp.Principal() + " " + kp.CCName
+	ch := b.group.DoChan(key, func() (any, error) {
+		if err := b.slots.acquire(ctx, kp.qosClass()); err != nil {
+			return nil, err
+		}
+		defer b.slots.release()
+		return nil, fn(ctx, kp)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Shared {
+			loggerFrom(ctx).Debugf("shared %s of %s with concurrent requests", op, kp.Principal())
+		}
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
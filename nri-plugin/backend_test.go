@@ -0,0 +1,473 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Parameters of alice with an NFS server, a credential cache of the test, owned
+// by us, and the KDCs given, the first one preferred.
+func testParams(t *testing.T, kdcs ...string) *kerberosParams {
+	kp := &kerberosParams{
+		User:   "alice",
+		Realm:  "EXAMPLE.COM",
+		NFS:    "nfs.example.com",
+		CCName: "FILE:" + filepath.Join(t.TempDir(), "krb5cc"),
+		UID:    uint64(os.Getuid()),
+		GID:    uint64(os.Getgid()),
+	}
+	if len(kdcs) > 0 {
+		kp.KDC, kp.KDCs = kdcs[0], kdcs[1:]
+	}
+	return kp
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		clock:     &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		lifetime:  time.Hour,
+		renewable: 24 * time.Hour,
+	}
+}
+
+// Retry policy without jitter or noticeable delays.
+func testRetryConfig(attempts int) *retryConfig {
+	jitter := 0.0
+	return &retryConfig{MaxAttempts: attempts, BaseDelay: duration{time.Millisecond}, Jitter: &jitter}
+}
+
+func TestRetryBackend(t *testing.T) {
+	unreachable := fmt.Errorf("%w: kdc.example.com", errKDCUnreachable)
+	preauth := fmt.Errorf("%w: wrong password", errPreauthFailed)
+	for _, tc := range []struct {
+		name     string
+		attempts int
+		errs     []error
+		// Deadline of the setup, none if zero.
+		timeout   time.Duration
+		wantCalls int
+		wantErr   error
+	}{{
+		name:      "success",
+		wantCalls: 1,
+	}, {
+		name:      "transient failure",
+		errs:      []error{unreachable, unreachable},
+		wantCalls: 3,
+	}, {
+		name:      "attempts exhausted",
+		errs:      []error{unreachable, unreachable, unreachable},
+		wantCalls: 3,
+		wantErr:   errKDCUnreachable,
+	}, {
+		name:      "more attempts",
+		attempts:  5,
+		errs:      []error{unreachable, unreachable, unreachable, unreachable},
+		wantCalls: 5,
+	}, {
+		name:      "no retries",
+		attempts:  1,
+		errs:      []error{unreachable},
+		wantCalls: 1,
+		wantErr:   errKDCUnreachable,
+	}, {
+		name:      "permanent failure",
+		errs:      []error{preauth},
+		wantCalls: 1,
+		wantErr:   errPreauthFailed,
+	}, {
+		name:      "deadline before the retry",
+		errs:      []error{unreachable},
+		timeout:   time.Microsecond,
+		wantCalls: 1,
+		wantErr:   errKDCUnreachable,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			fb := newFakeBackend()
+			fb.errs = map[string][]error{"setup": tc.errs, "renew": tc.errs}
+			b := &retryBackend{fb, func(*kerberosParams) *retryConfig { return testRetryConfig(tc.attempts) }}
+			for _, op := range []func(context.Context, *kerberosParams) error{b.Setup, b.Renew} {
+				fb.reset(fb.errs)
+				kp := testParams(t)
+				if err := fb.issue(kp, fb.clock.Now(), fb.clock.Now().Add(fb.renewable)); err != nil {
+					t.Fatal(err)
+				}
+				if err := op(ctx, kp); !errors.Is(err, tc.wantErr) {
+					t.Errorf("error = %v, want %v", err, tc.wantErr)
+				}
+				if got := len(fb.operations()); got != tc.wantCalls {
+					t.Errorf("%d attempts, want %d: %q", got, tc.wantCalls, fb.operations())
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBackendDestroy(t *testing.T) {
+	fb := newFakeBackend()
+	fb.errs = map[string][]error{"destroy": {fmt.Errorf("%w: kdc.example.com", errKDCUnreachable)}}
+	b := &retryBackend{fb, func(*kerberosParams) *retryConfig { return testRetryConfig(3) }}
+	if err := b.Destroy(context.Background(), testParams(t)); !errors.Is(err, errKDCUnreachable) {
+		t.Errorf("Destroy() error = %v, want %v", err, errKDCUnreachable)
+	}
+	if got := len(fb.operations()); got != 1 {
+		t.Errorf("Destroy() tried %d times, want once", got)
+	}
+}
+
+func TestFailoverBackend(t *testing.T) {
+	unreachable := fmt.Errorf("%w: connection refused", errKDCUnreachable)
+	for _, tc := range []struct {
+		name    string
+		kdcs    []string
+		proxied bool
+		errs    []error
+		// KDCs of two setups in a row.
+		wantKDCs []string
+		wantErr  error
+	}{{
+		name:     "first KDC reachable",
+		kdcs:     []string{"kdc1", "kdc2", "kdc3"},
+		wantKDCs: []string{"kdc1", "kdc1"},
+	}, {
+		name:     "first KDC unreachable",
+		kdcs:     []string{"kdc1", "kdc2", "kdc3"},
+		errs:     []error{unreachable},
+		wantKDCs: []string{"kdc1", "kdc2", "kdc2"},
+	}, {
+		name:     "two KDCs unreachable",
+		kdcs:     []string{"kdc1", "kdc2", "kdc3"},
+		errs:     []error{unreachable, unreachable},
+		wantKDCs: []string{"kdc1", "kdc2", "kdc3", "kdc3"},
+	}, {
+		name:     "all KDCs unreachable",
+		kdcs:     []string{"kdc1", "kdc2"},
+		errs:     []error{unreachable, unreachable, unreachable, unreachable},
+		wantKDCs: []string{"kdc1", "kdc2", "kdc1", "kdc2"},
+		wantErr:  errKDCUnreachable,
+	}, {
+		name:     "other failures not failed over",
+		kdcs:     []string{"kdc1", "kdc2"},
+		errs:     []error{errPreauthFailed, errPreauthFailed},
+		wantKDCs: []string{"kdc1", "kdc1"},
+		wantErr:  errPreauthFailed,
+	}, {
+		name:     "single KDC",
+		kdcs:     []string{"kdc1"},
+		errs:     []error{unreachable, unreachable},
+		wantKDCs: []string{"kdc1", "kdc1"},
+		wantErr:  errKDCUnreachable,
+	}, {
+		name:     "KDC proxy",
+		kdcs:     []string{"kdc1", "kdc2"},
+		proxied:  true,
+		errs:     []error{unreachable, unreachable},
+		wantKDCs: []string{"kdc1", "kdc1"},
+		wantErr:  errKDCUnreachable,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fb := newFakeBackend()
+			fb.errs = map[string][]error{"setup": tc.errs}
+			b := &failoverBackend{fb, newKDCTracker(fb.clock)}
+			kp := testParams(t, tc.kdcs...)
+			if tc.proxied {
+				kp.KDCProxy = &kdcProxyConfig{}
+			}
+			var err error
+			for range 2 {
+				err = b.Setup(context.Background(), kp)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Setup() error = %v, want %v", err, tc.wantErr)
+			}
+			if got := fb.kdcsUsed(); !slices.Equal(got, tc.wantKDCs) {
+				t.Errorf("KDCs tried = %q, want %q", got, tc.wantKDCs)
+			}
+			if kp.KDC != tc.kdcs[0] || len(kp.KDCs) != len(tc.kdcs)-1 {
+				t.Errorf("parameters changed to KDC %s and KDCs %q", kp.KDC, kp.KDCs)
+			}
+		})
+	}
+}
+
+func TestFailoverBackendBackoff(t *testing.T) {
+	fb := newFakeBackend()
+	clock := fb.clock.(*fakeClock)
+	fb.errs = map[string][]error{"setup": {fmt.Errorf("%w: timed out", errKDCUnreachable)}}
+	b := &failoverBackend{fb, newKDCTracker(clock)}
+	kp := testParams(t, "kdc1", "kdc2")
+	for _, after := range []time.Duration{0, time.Second, kdcBackoffMin} {
+		clock.advance(after)
+		if err := b.Setup(context.Background(), kp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// kdc1 is backed off from until kdcBackoffMin has passed
+	want := []string{"kdc1", "kdc2", "kdc2", "kdc1"}
+	if got := fb.kdcsUsed(); !slices.Equal(got, want) {
+		t.Errorf("KDCs tried = %q, want %q", got, want)
+	}
+}
+
+func TestRateLimitedBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		limit rateLimitConfig
+		share float64
+		// Setups at once, of two requests each, and how long the last waits.
+		setups   int
+		wantWait time.Duration
+	}{{
+		name:   "no limit",
+		setups: 20,
+	}, {
+		name:   "within the burst",
+		limit:  rateLimitConfig{RequestsPerSecond: 10, Burst: 10},
+		setups: 5,
+	}, {
+		name:     "over the burst",
+		limit:    rateLimitConfig{RequestsPerSecond: 20, Burst: 4},
+		setups:   4,
+		wantWait: 200 * time.Millisecond,
+	}, {
+		name:     "share of the class",
+		limit:    rateLimitConfig{RequestsPerSecond: 40, Burst: 8},
+		share:    0.5,
+		setups:   4,
+		wantWait: 200 * time.Millisecond,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fb := newFakeBackend()
+			share := tc.share
+			if share == 0 {
+				share = 1
+			}
+			clock := fb.clock.(*fakeClock)
+			b := newRateLimitedBackend(fb, func(string) rateLimitConfig { return tc.limit }, func(string) float64 { return share }, clock)
+			start := clock.Now()
+			var wg sync.WaitGroup
+			for range tc.setups {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := b.Setup(context.Background(), testParams(t)); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			// all setups through or waiting
+			eventually(t, func() bool { return len(fb.operations())+len(clock.pending()) == tc.setups })
+			var wait time.Duration
+			for _, due := range clock.pending() {
+				wait = max(wait, due.Sub(start))
+			}
+			if wait != tc.wantWait {
+				t.Errorf("%d setups wait %s, want %s", tc.setups, wait, tc.wantWait)
+			}
+			clock.advance(wait)
+			wg.Wait()
+			if got := len(fb.operations()); got != tc.setups {
+				t.Errorf("%d setups reached the backend, want %d", got, tc.setups)
+			}
+		})
+	}
+}
+
+func TestRateLimitedBackendCanceled(t *testing.T) {
+	fb := newFakeBackend()
+	clock := fb.clock.(*fakeClock)
+	b := newRateLimitedBackend(fb, func(string) rateLimitConfig {
+		return rateLimitConfig{RequestsPerSecond: 0.1, Burst: 1}
+	}, func(string) float64 { return 1 }, clock)
+	if err := b.Setup(context.Background(), testParams(t)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Renew(ctx, testParams(t)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Renew() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := fb.operations(); len(got) != 1 {
+		t.Errorf("backend operations = %q, want the setup only", got)
+	}
+	if due := clock.pending(); len(due) != 0 {
+		t.Errorf("timers left pending at %v", due)
+	}
+}
+
+func TestSharedBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		parallel int
+		// Credential caches of the concurrent setups of alice, by index.
+		ccaches   []int
+		wantCalls int
+		// Most setups expected to run at once.
+		wantRunning int
+	}{{
+		name:        "same credentials",
+		ccaches:     []int{0, 0, 0, 0},
+		wantCalls:   1,
+		wantRunning: 1,
+	}, {
+		name:        "other credential caches",
+		ccaches:     []int{0, 1, 2, 0, 1},
+		wantCalls:   3,
+		wantRunning: 3,
+	}, {
+		name:        "bounded",
+		parallel:    2,
+		ccaches:     []int{0, 1, 2, 3},
+		wantCalls:   4,
+		wantRunning: 2,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fb := newFakeBackend()
+			fb.hold = make(chan struct{})
+			b := newSharedBackend(fb, tc.parallel)
+			var params []*kerberosParams
+			for range slices.Max(tc.ccaches) + 1 {
+				params = append(params, testParams(t))
+			}
+			var wg sync.WaitGroup
+			for _, i := range tc.ccaches {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := b.Setup(context.Background(), params[i]); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			// let the setups join those running before these finish
+			time.Sleep(50 * time.Millisecond)
+			close(fb.hold)
+			wg.Wait()
+			if got := len(fb.operations()); got != tc.wantCalls {
+				t.Errorf("%d setups run, want %d", got, tc.wantCalls)
+			}
+			if fb.maxRunning != tc.wantRunning {
+				t.Errorf("%d setups ran at once, want %d", fb.maxRunning, tc.wantRunning)
+			}
+		})
+	}
+}
+
+func TestSharedBackendFailure(t *testing.T) {
+	fb := newFakeBackend()
+	fb.hold = make(chan struct{})
+	fb.errs = map[string][]error{"setup": {errPreauthFailed}}
+	b := newSharedBackend(fb, 0)
+	kp := testParams(t)
+	errs := make(chan error, 3)
+	for range cap(errs) {
+		go func() { errs <- b.Setup(context.Background(), kp) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(fb.hold)
+	for range cap(errs) {
+		if err := <-errs; !errors.Is(err, errPreauthFailed) {
+			t.Errorf("Setup() error = %v, want %v", err, errPreauthFailed)
+		}
+	}
+	// failures are not kept for later setups
+	if err := b.Setup(context.Background(), kp); err != nil {
+		t.Errorf("Setup() after the failure: %v", err)
+	}
+}
+
+func TestSharedBackendCanceled(t *testing.T) {
+	fb := newFakeBackend()
+	fb.hold = make(chan struct{})
+	defer close(fb.hold)
+	b := newSharedBackend(fb, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Setup(ctx, testParams(t)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Setup() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// The backend wrappers as the plugin chains them, see main.
+func TestBackendChain(t *testing.T) {
+	unreachable := fmt.Errorf("%w: connection refused", errKDCUnreachable)
+	for _, tc := range []struct {
+		name     string
+		issued   bool
+		errs     []error
+		wantKDCs []string
+		wantErr  error
+	}{{
+		name:     "success",
+		wantKDCs: []string{"kdc1"},
+	}, {
+		name:     "failed over",
+		errs:     []error{unreachable},
+		wantKDCs: []string{"kdc1", "kdc2"},
+	}, {
+		name:     "retried after all KDCs failed",
+		errs:     []error{unreachable, unreachable},
+		wantKDCs: []string{"kdc1", "kdc2", "kdc1"},
+	}, {
+		name:     "given up",
+		errs:     []error{unreachable, unreachable, unreachable, unreachable, unreachable, unreachable},
+		wantKDCs: []string{"kdc1", "kdc2", "kdc1", "kdc2", "kdc1", "kdc2"},
+		wantErr:  errKDCUnreachable,
+	}, {
+		name:     "permanent failure",
+		errs:     []error{errPreauthFailed},
+		wantKDCs: []string{"kdc1"},
+		wantErr:  errPreauthFailed,
+	}, {
+		name:   "issued credentials",
+		issued: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fb := newFakeBackend()
+			fb.errs = map[string][]error{"setup": tc.errs}
+			cfg := &config{KDCRateLimit: rateLimitConfig{RequestsPerSecond: 1000}}
+			b := newSharedBackend(&issuedBackend{&retryBackend{
+				&instrumentedBackend{&failoverBackend{&preflightBackend{newRateLimitedBackend(fb, cfg.rateLimit, cfg.QoS.rateShare, systemClock{}),
+					func() *preflightConfig { return &cfg.Preflight }}, newKDCTracker(fb.clock)}},
+				func(*kerberosParams) *retryConfig { return testRetryConfig(3) },
+			}}, 0)
+			kp := testParams(t, "kdc1", "kdc2")
+			kp.Issued = tc.issued
+			if err := b.Setup(context.Background(), kp); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Setup() error = %v, want %v", err, tc.wantErr)
+			}
+			if got := fb.kdcsUsed(); !slices.Equal(got, tc.wantKDCs) {
+				t.Errorf("KDCs tried = %q, want %q", got, tc.wantKDCs)
+			}
+		})
+	}
+}
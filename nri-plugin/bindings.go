@@ -0,0 +1,295 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultStateFile = "/var/lib/nri-kerberos/state.json"
+
+// Managed credentials and the containers bound to them, by pod sandbox ID and
+// container name, kept in a state file across restarts of the plugin. Pods
+// whose parameters came from the env of a renewal sidecar can then be taken
+// over again while their sidecar is not running, and containers created again
+// in the same sandbox are known as such.
+type bindingState struct {
+	path string
+
+	sync.Mutex
+	// Managed credentials by their key.
+	Credentials map[string]*boundCredentials `json:"credentials"`
+	// Containers by sandbox ID and container name, joined by a slash.
+	Containers map[string]*containerBinding `json:"containers"`
+	// Cleanups of stopped pods pending at shutdown, by sandbox ID.
+	Cleanups map[string]time.Time `json:"cleanups,omitempty"`
+}
+
+type boundCredentials struct {
+	SandboxID string `json:"sandboxID"`
+	PodUID    string `json:"podUID"`
+	// Parameters without the keytab, password and certificate, which are
+	// fetched again when needed, and without the user namespace, which is read
+	// again from the pod.
+	Params *kerberosParams `json:"params"`
+	// Last use and next renewal of the credentials at shutdown.
+	Used    time.Time `json:"used,omitzero"`
+	Renewal time.Time `json:"renewal,omitzero"`
+}
+
+type containerBinding struct {
+	// Key of the managed credentials the container is bound to.
+	Key string `json:"key"`
+	// Times the container was created in the sandbox.
+	Created int `json:"created"`
+}
+
+// Load the state file, starting afresh if there is none or it cannot be read.
+func loadBindings(path string) *bindingState {
+	s := &bindingState{
+		path:        path,
+		Credentials: map[string]*boundCredentials{},
+		Containers:  map[string]*containerBinding{},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warnf("ignoring state file %s: %v", path, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		log.Warnf("ignoring state file %s: %v", path, err)
+		s.Credentials, s.Containers = map[string]*boundCredentials{}, map[string]*containerBinding{}
+	}
+	return s
+}
+
+// Write the state file, with the lock held.
+func (s *bindingState) save() {
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	}
+	if err == nil {
+		err = writePodFile(s.path, data, os.Getuid(), os.Getgid())
+	}
+	if err != nil {
+		log.Errorf("failed to write state file %s: %v", s.path, err)
+	}
+}
+
+// Record managed credentials.
+func (s *bindingState) track(key string, pod *api.PodSandbox, kp *kerberosParams) {
+	if s == nil {
+		return
+	}
+	params := *kp
+	params.Password, params.Keytab, params.PKINIT, params.UserNS = "", "", nil, nil
+	s.Lock()
+	defer s.Unlock()
+	s.Credentials[key] = &boundCredentials{SandboxID: pod.GetId(), PodUID: pod.GetUid(), Params: &params}
+	s.save()
+}
+
+// Forget managed credentials and the containers bound to them.
+func (s *bindingState) release(key string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.Credentials[key]; !ok {
+		return
+	}
+	delete(s.Credentials, key)
+	for name, b := range s.Containers {
+		if b.Key == key {
+			delete(s.Containers, name)
+		}
+	}
+	s.save()
+}
+
+// Bind a container to managed credentials, returning whether it was bound to
+// them before, being created again in the same sandbox.
+func (s *bindingState) bind(pod *api.PodSandbox, container, key string) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	name := pod.GetId() + "/" + container
+	b, ok := s.Containers[name]
+	if !ok || b.Key != key {
+		b = &containerBinding{Key: key}
+		s.Containers[name] = b
+	}
+	b.Created++
+	s.save()
+	return b.Created > 1
+}
+
+// Parameters the credentials of a pod were last set up with, or nil.
+func (s *bindingState) podParams(pod *api.PodSandbox) (*kerberosParams, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.Lock()
+	bc, ok := s.Credentials[pod.GetId()]
+	s.Unlock()
+	if !ok || bc.PodUID != pod.GetUid() || bc.Params == nil {
+		return nil, nil
+	}
+	kp := *bc.Params
+	userns, err := podUserNamespace(pod)
+	if err != nil {
+		return nil, err
+	}
+	kp.UserNS = userns
+	return &kp, nil
+}
+
+// Save the last use and the next renewal of managed credentials and the
+// pending cleanups of pods at shutdown, returning whether they were.
+func (s *bindingState) saveSchedule(used, renewals, cleanups map[string]time.Time) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	for key, bc := range s.Credentials {
+		bc.Used, bc.Renewal = used[key], renewals[key]
+	}
+	s.Cleanups = cleanups
+	s.save()
+	return true
+}
+
+// Last use and next renewal of managed credentials saved at shutdown, zero if
+// not saved. They are taken only once, by the next instance.
+func (s *bindingState) resume(key string) (used, renewal time.Time) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if bc, ok := s.Credentials[key]; ok {
+		used, renewal = bc.Used, bc.Renewal
+		bc.Used, bc.Renewal = time.Time{}, time.Time{}
+	}
+	return
+}
+
+// Cleanups of pods pending at shutdown, taken only once.
+func (s *bindingState) takeCleanups() map[string]time.Time {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	cleanups := s.Cleanups
+	s.Cleanups = nil
+	return cleanups
+}
+
+// Forget the credentials and containers of sandboxes not present.
+func (s *bindingState) prune(present map[string]bool) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for key, bc := range s.Credentials {
+		if !present[bc.SandboxID] {
+			delete(s.Credentials, key)
+		}
+	}
+	for name := range s.Containers {
+		if id, _, _ := strings.Cut(name, "/"); !present[id] {
+			delete(s.Containers, name)
+		}
+	}
+	s.save()
+}
+
+// Check the credentials of a container created again in the same sandbox, as
+// after a crash, before binding it to them again, and set them up again in
+// place if they would not do.
+func (p *plugin) rebind(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams) error {
+	if p.reusable(pod, kp) {
+		l.Infof("container created again, rebinding it to the credentials for %s", kp.Principal())
+		containerRebinds.WithLabelValues("reused").Inc()
+		return nil
+	}
+	l.Infof("container created again, setting up the credentials for %s again", kp.Principal())
+	if err := p.setupPod(ctx, podLogger(pod), cfg, pod, kp, kp.Container); err != nil {
+		containerRebinds.WithLabelValues("failed").Inc()
+		return err
+	}
+	containerRebinds.WithLabelValues("refreshed").Inc()
+	return nil
+}
+
+// Check that the credential cache published to the pod is owned by the uid and
+// gid of the pod, as another setup or a workload may have changed that.
+func (p *plugin) checkPublished(pod *api.PodSandbox, kp *kerberosParams) error {
+	if pod.GetUid() == "" || kp.secondary() || kp.GSSProxy {
+		return nil
+	}
+	dir := p.ccacheDirOf(pod, kp)
+	paths := []string{dir}
+	switch kp.CCacheType {
+	case ccacheTypeDir:
+		paths = append(paths, filepath.Join(dir, dirCCacheName))
+	case ccacheTypeKeyring, ccacheTypeKCM:
+		// only krb5.conf is in the directory
+	default:
+		src, err := ccachePath(kp.CCName)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.Join(dir, filepath.Base(src)))
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		if uint64(st.Uid) != kp.UID || int(st.Gid) != kp.ccacheGID() {
+			return fmt.Errorf("%s is owned by %d:%d, not %d:%d", path, st.Uid, st.Gid, kp.UID, kp.ccacheGID())
+		}
+	}
+	return nil
+}
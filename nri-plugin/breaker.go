@@ -0,0 +1,160 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Defaults of the circuit breaker of failing principals.
+const (
+	defaultBreakerThreshold = 2
+	defaultBreakerTTL       = 5 * time.Minute
+)
+
+// Setups not attempted as the principal keeps failing, see principalBreaker.
+var errPrincipalFailing = errors.New("principal keeps failing")
+
+// Circuit breaker of the principals whose credentials cannot be had until
+// somebody acts, as they are unknown to the KDC or revoked, their password
+// expired or their keytab does not match, see credentialsLost. Once setups
+// of a principal for the pods of a namespace failed so threshold times in a
+// row, its setups fail at once for ttl, without asking the KDC, and the next
+// one after that is tried: the circuit closes when it succeeds and opens again
+// when it fails. Failures some pod fixes, like a missing keytab Secret, only
+// last for the ttl either way; transient ones, like an unreachable KDC, are
+// left to the retries.
+type breakerConfig struct {
+	// Try every setup.
+	Disabled bool `json:"disabled,omitempty"`
+	// Consecutive failures opening the circuit, 2 by default.
+	Threshold int `json:"threshold,omitempty"`
+	// How long setups fail at once, 5m by default.
+	TTL duration `json:"ttl,omitempty"`
+}
+
+func (c *breakerConfig) validate() error {
+	if c.Threshold < 0 {
+		return fmt.Errorf("threshold %d is negative", c.Threshold)
+	}
+	if c.TTL.Duration < 0 {
+		return fmt.Errorf("ttl %s is negative", c.TTL.Duration)
+	}
+	return nil
+}
+
+func (c *breakerConfig) threshold() int {
+	if c.Threshold > 0 {
+		return c.Threshold
+	}
+	return defaultBreakerThreshold
+}
+
+func (c *breakerConfig) ttl() time.Duration {
+	if c.TTL.Duration > 0 {
+		return c.TTL.Duration
+	}
+	return defaultBreakerTTL
+}
+
+// Principal of the pods of a namespace.
+type breakerKey struct {
+	namespace string
+	principal string
+}
+
+// Consecutive failures of a principal, the last one and when the circuit
+// opened, zero while closed.
+type breakerState struct {
+	cfg      *config
+	failures int
+	err      error
+	opened   time.Time
+}
+
+// Failing principals, by namespace. Safe to use on nil.
+type principalBreaker struct {
+	sync.Mutex
+	states map[breakerKey]*breakerState
+}
+
+func newPrincipalBreaker() *principalBreaker {
+	return &principalBreaker{states: map[breakerKey]*breakerState{}}
+}
+
+// Error to fail a setup of the principal with at once while its circuit is
+// open, nil to try it. A reloaded configuration closes all circuits.
+func (b *principalBreaker) check(cfg *config, pod *api.PodSandbox, kp *kerberosParams, now time.Time) error {
+	if b == nil || cfg.Breaker.Disabled {
+		return nil
+	}
+	key := breakerKey{pod.GetNamespace(), kp.Principal()}
+	b.Lock()
+	defer b.Unlock()
+	st := b.states[key]
+	if st == nil || st.opened.IsZero() {
+		return nil
+	}
+	if st.cfg != cfg {
+		delete(b.states, key)
+		return nil
+	}
+	ago := now.Sub(st.opened)
+	if ago >= cfg.Breaker.ttl() {
+		return nil
+	}
+	breakerShortCircuits.WithLabelValues(kp.Realm).Inc()
+	return fmt.Errorf("%w: failed %d times in a row, last %s ago, tried again in %s: %w", errPrincipalFailing,
+		st.failures, ago.Round(time.Second), (cfg.Breaker.ttl() - ago).Round(time.Second), st.err)
+}
+
+// Count the outcome of a setup of the principal, opening its circuit when it
+// failed for threshold times in a row, and telling whether it did. Failures of
+// other classes neither count nor close the circuit.
+func (b *principalBreaker) record(cfg *config, pod *api.PodSandbox, kp *kerberosParams, err error, now time.Time) (opened bool) {
+	if b == nil || cfg.Breaker.Disabled || errors.Is(err, errPrincipalFailing) {
+		return false
+	}
+	key := breakerKey{pod.GetNamespace(), kp.Principal()}
+	b.Lock()
+	defer b.Unlock()
+	if err == nil {
+		delete(b.states, key)
+		return false
+	}
+	if !credentialsLost(err) {
+		return false
+	}
+	st := b.states[key]
+	if st == nil || st.cfg != cfg {
+		st = &breakerState{cfg: cfg}
+		b.states[key] = st
+	}
+	st.failures++
+	st.err = err
+	if st.failures < cfg.Breaker.threshold() {
+		return false
+	}
+	st.opened = now
+	breakerTrips.WithLabelValues(kp.Realm, failureReason(err)).Inc()
+	return true
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Values of krb5Conf.dnsCanonicalizeHostname.
+const (
+	canonicalizeFalse    = "false"
+	canonicalizeTrue     = "true"
+	canonicalizeFallback = "fallback"
+)
+
+func validCanonicalize(mode string) error {
+	switch mode {
+	case "", canonicalizeFalse, canonicalizeTrue, canonicalizeFallback:
+		return nil
+	}
+	return fmt.Errorf("must be true, false or fallback, not %q", mode)
+}
+
+// dns_canonicalize_hostname of the workload, false unless configured.
+func (c *krb5ConfConfig) canonicalize() string {
+	if c == nil || c.DNSCanonicalizeHostname == "" {
+		return canonicalizeFalse
+	}
+	return c.DNSCanonicalizeHostname
+}
+
+// Host names an NFS server may have in its service principal, in the order
+// tried, as the Kerberos libraries of the workload construct them with the
+// dns_canonicalize_hostname and rdns of its krb5.conf: the name as given, in
+// lower case, without canonicalization; its canonical name by DNS, or the name
+// of its address by reverse DNS with rdns, with canonicalization, falling back
+// to the name as given if the lookups fail; both with fallback, the name as
+// given first. Addresses are not canonicalized.
+func canonicalHosts(ctx context.Context, settings *krb5ConfConfig, host string) []string {
+	given := strings.ToLower(host)
+	mode := settings.canonicalize()
+	if mode == canonicalizeFalse || net.ParseIP(host) != nil {
+		return []string{given}
+	}
+	canonical := given
+	if cname, err := resolverFor(host).LookupCNAME(ctx, host); err == nil && cname != "" {
+		canonical = strings.ToLower(strings.TrimSuffix(cname, "."))
+	}
+	if settings.RDNS {
+		if addrs, err := resolverFor(canonical).LookupHost(ctx, canonical); err == nil && len(addrs) > 0 {
+			if names, err := resolverFor(canonical).LookupAddr(ctx, addrs[0]); err == nil && len(names) > 0 {
+				canonical = strings.ToLower(strings.TrimSuffix(names[0], "."))
+			}
+		}
+	}
+	if mode == canonicalizeFallback {
+		return slices.Compact([]string{given, canonical})
+	}
+	return []string{canonical}
+}
+
+// NFS service principal names of each server of the workload, without realm,
+// each with the names to try in order.
+func (kp *kerberosParams) canonicalServices(ctx context.Context) [][]string {
+	var services [][]string
+	for _, server := range kp.nfsServers() {
+		if kp.aliased(server) {
+			// the name of the alias is what the server is known as
+			services = append(services, []string{"nfs/" + strings.ToLower(hostOf(server))})
+			continue
+		}
+		var names []string
+		for _, host := range canonicalHosts(ctx, kp.Krb5Conf, hostOf(server)) {
+			names = append(names, "nfs/"+host)
+		}
+		services = append(services, names)
+	}
+	return services
+}
+
+// Obtain a service ticket of each NFS server of the workload, trying the names
+// of its service principal in order, logging the servers none can be had of.
+func obtainServiceTickets(ctx context.Context, kp *kerberosParams, obtain func(service string) error) {
+	for _, names := range kp.canonicalServices(ctx) {
+		var err error
+		for _, service := range names {
+			if err = obtain(service); err == nil {
+				break
+			}
+			if len(names) > 1 {
+				loggerFrom(ctx).Debugf("cannot obtain service ticket for %s: %v", service, err)
+			}
+		}
+		if err != nil {
+			loggerFrom(ctx).Warnf("cannot obtain service ticket for %s: %v", names[len(names)-1], err)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// File format version written by writeCCache, see
+// https://web.mit.edu/kerberos/krb5-latest/doc/formats/ccache_file_format.html
+const ccacheVersion = 0x0504
+
+// A credential to store in a credential cache.
+type ccacheEntry struct {
+	clientRealm string
+	client      types.PrincipalName
+	serverRealm string
+	server      types.PrincipalName
+	key         types.EncryptionKey
+	authTime    time.Time
+	startTime   time.Time
+	endTime     time.Time
+	renewTill   time.Time
+	flags       asn1.BitString
+	ticket      []byte
+}
+
+// Create a credential cache entry from a decrypted AS or TGS reply.
+func newCCacheEntry(crealm string, cname types.PrincipalName, tkt messages.Ticket, part messages.EncKDCRepPart) (*ccacheEntry, error) {
+	raw, err := tkt.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ticket: %w", err)
+	}
+
+	return &ccacheEntry{
+		clientRealm: crealm,
+		client:      cname,
+		serverRealm: part.SRealm,
+		server:      part.SName,
+		key:         part.Key,
+		authTime:    part.AuthTime,
+		startTime:   part.StartTime,
+		endTime:     part.EndTime,
+		renewTill:   part.RenewTill,
+		flags:       part.Flags,
+		ticket:      raw,
+	}, nil
+}
+
+// Get the file path of a FILE: (or type-less) credential cache name, or of a
+// DIR:: one naming a single cache of a collection, which is a FILE cache.
+func ccachePath(ccname string) (string, error) {
+	path, ok := strings.CutPrefix(ccname, "FILE:")
+	if !ok {
+		path, ok = strings.CutPrefix(ccname, "DIR::")
+	}
+	if !ok && strings.Contains(ccname, ":") {
+		return "", fmt.Errorf("unsupported credential cache type in %q", ccname)
+	}
+	if !ok {
+		path = ccname
+	}
+	return path, nil
+}
+
+// Default credential cache of a uid, the one rpc.gssd looks at.
+func hostCCName(uid uint64) string {
+	return fmt.Sprintf("FILE:/tmp/krb5cc_%d", uid)
+}
+
+// A cache of the DIR collection of a uid at the path of its default credential
+// cache, which rpc.gssd looks at for the uid instead when it is a directory.
+func hostCollectionCCName(uid uint64, name string) string {
+	path, _ := ccachePath(hostCCName(uid))
+	return "DIR::" + filepath.Join(path, name)
+}
+
+// Create the collection directory of a DIR:: credential cache, owned by
+// uid/gid, with the default cache of the collection as its primary one.
+func prepareCollection(ccname string, uid, gid int) error {
+	if !strings.HasPrefix(ccname, "DIR::") {
+		return nil
+	}
+	path, _ := ccachePath(ccname)
+	dir := filepath.Dir(path)
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("failed to create credential cache collection: %w", err)
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return fmt.Errorf("failed to set credential cache collection ownership: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "primary")); err == nil {
+		return nil
+	}
+	return writePodFile(filepath.Join(dir, "primary"), []byte(dirCCacheName+"\n"), uid, gid)
+}
+
+// Atomically write a FILE credential cache with the given entries, owned by uid/gid.
+// The first entry defines the default principal of the cache.
+func writeCCache(ccname string, uid, gid int, entries ...*ccacheEntry) error {
+	if len(entries) == 0 {
+		return errors.New("no credentials to write")
+	}
+
+	path, err := ccachePath(ccname)
+	if err != nil {
+		return err
+	}
+
+	buf := &ccacheEncoder{}
+	buf.put(uint16(ccacheVersion))
+	buf.put(uint16(0)) // no header fields
+	buf.putPrincipal(entries[0].clientRealm, entries[0].client)
+	for _, e := range entries {
+		buf.putCredential(e)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create credential cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write credential cache: %w", err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set credential cache permissions: %w", err)
+	}
+	if err := tmp.Chown(uid, gid); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set credential cache ownership: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write credential cache: %w", err)
+	}
+	if err := replaceCCache(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to install credential cache: %w", err)
+	}
+
+	return nil
+}
+
+// Encoder of principals and credentials in the version 4 ccache format, used
+// by FILE caches as well as for the keys of KEYRING caches.
+type ccacheEncoder struct {
+	bytes.Buffer
+}
+
+func (b *ccacheEncoder) put(v any) {
+	// bytes.Buffer writes never fail
+	_ = binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *ccacheEncoder) putData(data []byte) {
+	b.put(uint32(len(data)))
+	b.Write(data)
+}
+
+func (b *ccacheEncoder) putPrincipal(realm string, pn types.PrincipalName) {
+	b.put(uint32(pn.NameType))
+	b.put(uint32(len(pn.NameString)))
+	b.putData([]byte(realm))
+	for _, c := range pn.NameString {
+		b.putData([]byte(c))
+	}
+}
+
+func (b *ccacheEncoder) putTime(t time.Time) {
+	if t.IsZero() {
+		b.put(uint32(0))
+		return
+	}
+	b.put(uint32(t.Unix()))
+}
+
+func (b *ccacheEncoder) putCredential(e *ccacheEntry) {
+	b.putPrincipal(e.clientRealm, e.client)
+	b.putPrincipal(e.serverRealm, e.server)
+	b.put(uint16(e.key.KeyType))
+	b.putData(e.key.KeyValue)
+	b.putTime(e.authTime)
+	b.putTime(e.startTime)
+	b.putTime(e.endTime)
+	b.putTime(e.renewTill)
+	b.put(uint8(0)) // is_skey
+	b.put(ticketFlags(e.flags))
+	b.put(uint32(0)) // addresses
+	b.put(uint32(0)) // authdata
+	b.putData(e.ticket)
+	b.putData(nil) // second ticket
+}
+
+// Read the credentials of a FILE credential cache, whoever wrote it. As with
+// writeCCache, the client of the first entry is the default principal.
+func readCCache(ccname string) ([]*ccacheEntry, error) {
+	path, err := ccachePath(ccname)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := loadCCache(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load credential cache %q: %w", errCCacheFailed, path, err)
+	}
+	entries := []*ccacheEntry{}
+	for _, c := range cc.Credentials {
+		entries = append(entries, &ccacheEntry{
+			clientRealm: c.Client.Realm,
+			client:      c.Client.PrincipalName,
+			serverRealm: c.Server.Realm,
+			server:      c.Server.PrincipalName,
+			key:         c.Key,
+			authTime:    c.AuthTime,
+			startTime:   c.StartTime,
+			endTime:     c.EndTime,
+			renewTill:   c.RenewTill,
+			flags:       c.TicketFlags,
+			ticket:      c.Ticket,
+		})
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no credentials in credential cache %q", errCCacheFailed, path)
+	}
+
+	return entries, nil
+}
+
+// Convert ASN.1 ticket flags to the 32-bit representation used in ccache files.
+func ticketFlags(flags asn1.BitString) uint32 {
+	var b [4]byte
+	copy(b[:], flags.Bytes)
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// Destroy a credential cache. Only FILE caches are handled, others are left alone.
+func destroyCCache(ccname string) error {
+	path, err := ccachePath(ccname)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove credential cache %q: %w", path, err)
+	}
+	if strings.HasPrefix(ccname, "DIR::") {
+		// the collection goes with its last cache
+		dir := filepath.Dir(path)
+		if caches, _ := filepath.Glob(filepath.Join(dir, dirCCacheName+"*")); len(caches) == 0 {
+			_ = os.Remove(filepath.Join(dir, "primary"))
+			_ = os.Remove(dir)
+		}
+	}
+
+	return nil
+}
+
+// Validity of a TGT in a credential cache.
+type ticketTimes struct {
+	auth      time.Time
+	start     time.Time
+	end       time.Time
+	renewTill time.Time
+}
+
+// Get the validity of the TGT of the realm in a FILE credential cache. Caches
+// of delegated credentials hold service tickets alone, the validity of the
+// first of them to expire is that of the cache.
+func ccacheTimes(ccname, realm string) (*ticketTimes, error) {
+	path, err := ccachePath(ccname)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := loadCCache(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load credential cache %q: %w", errCCacheFailed, path, err)
+	}
+	cred, ok := cc.GetEntry(types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", realm},
+	})
+	if !ok {
+		for _, c := range cc.GetEntries() {
+			if c.Client.PrincipalName.Equal(cc.GetClientPrincipalName()) && (!ok || c.EndTime.Before(cred.EndTime)) {
+				cred, ok = c, true
+			}
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: no TGT in credential cache %q", errCCacheFailed, path)
+	}
+
+	return &ticketTimes{auth: cred.AuthTime, start: cred.StartTime, end: cred.EndTime, renewTill: cred.RenewTill}, nil
+}
+
+// Check that a FILE credential cache is that of the principal.
+func checkCCachePrincipal(ccname, principal string) error {
+	path, err := ccachePath(ccname)
+	if err != nil {
+		return err
+	}
+
+	cc, err := loadCCache(path)
+	if err != nil {
+		return fmt.Errorf("%w: failed to load credential cache %q: %w", errCCacheFailed, path, err)
+	}
+	if owner := cc.GetClientPrincipalName().PrincipalNameString() + "@" + cc.GetClientRealm(); owner != principal {
+		return fmt.Errorf("%w: credential cache %q is of %s", errCCacheFailed, ccname, owner)
+	}
+
+	return nil
+}
+
+// Check that a FILE credential cache holds a TGT of the realm valid until at least the given time.
+func checkCCache(ccname, realm string, until time.Time) error {
+	t, err := ccacheTimes(ccname, realm)
+	if err != nil {
+		return err
+	}
+	if t.end.Before(until) {
+		return fmt.Errorf("%w: TGT in credential cache %q expires at %s", errCCacheFailed, ccname, t.end.Format(time.RFC3339))
+	}
+
+	return nil
+}
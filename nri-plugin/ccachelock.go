@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"golang.org/x/sys/unix"
+)
+
+// Credential cache files are shared with rpc.gssd, which reads the host
+// caches, with kinit run by the script backend, and with the workloads, whose
+// libkrb5 adds service tickets to the pod caches. libkrb5 takes fcntl record
+// locks on a whole cache while reading or writing it in place, so the plugin
+// takes them too: shared while reading a cache, exclusive before replacing
+// one. Caches are still replaced by renaming, so that a reader of the old
+// file never sees a partly written one.
+
+// How long to wait for a lock held by another process before giving up.
+const ccacheLockTimeout = 5 * time.Second
+
+// Interval between attempts to take a lock held by another process.
+const ccacheLockRetry = 10 * time.Millisecond
+
+// Lock a whole credential cache file as libkrb5 does, shared or exclusive,
+// waiting up to ccacheLockTimeout. The lock goes with the last file of the
+// plugin open on the cache, as fcntl locks belong to the process.
+func lockCCacheFile(f *os.File, exclusive bool) error {
+	lock := unix.Flock_t{Type: unix.F_RDLCK, Whence: io.SeekStart}
+	if exclusive {
+		lock.Type = unix.F_WRLCK
+	}
+	deadline := time.Now().Add(ccacheLockTimeout)
+	for {
+		err := unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lock)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, unix.EAGAIN) && !errors.Is(err, unix.EACCES) {
+			return fmt.Errorf("failed to lock credential cache %q: %w", f.Name(), err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: credential cache %q locked by another process for %s", errCCacheFailed, f.Name(), ccacheLockTimeout)
+		}
+		time.Sleep(ccacheLockRetry)
+	}
+}
+
+// Open a credential cache file for reading, holding a shared lock on it.
+func openCCacheLocked(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockCCacheFile(f, false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load a FILE credential cache under a shared lock, so that it is not read
+// while another process writes it in place.
+func loadCCache(path string) (*credentials.CCache, error) {
+	f, err := openCCacheLocked(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty credential cache")
+	}
+	cc := &credentials.CCache{}
+	if err := cc.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Replace the credential cache file at path with the file at tmp once no other
+// process is reading or writing it.
+func replaceCCache(tmp, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.Rename(tmp, path)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockCCacheFile(f, true); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
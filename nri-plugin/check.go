@@ -0,0 +1,241 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/containers/common/pkg/hooks"
+	current "github.com/containers/common/pkg/hooks/1.0.0"
+)
+
+// Check of the configuration of the plugin without connecting to NRI:
+// `kerberos-auth check`, or `kerberos-auth -validate-config` with the flags of
+// the plugin. Exits 1 if a check fails, to gate the plugin in an
+// initContainer.
+func runCheck(args []string) {
+	var (
+		configFile, output string
+		logOpts            logOptions
+	)
+
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", defaultConfigFile, "path to the plugin configuration file")
+	fs.StringVar(&output, "o", "", "output format, json for the report")
+	logOpts.register(fs)
+	_ = fs.Parse(args)
+
+	if err := logOpts.apply(); err != nil {
+		log.Errorf("invalid logging options: %v", err)
+		os.Exit(1)
+	}
+	if output != "" && output != "json" {
+		log.Errorf("unknown output format %q, must be json", output)
+		os.Exit(1)
+	}
+	validateConfig(configFile, output)
+}
+
+// Report on the configuration file, the resources and hooks it takes in and
+// the realms it names, and exit with 1 if a check failed, else 0.
+func validateConfig(configFile, output string) {
+	ctx := context.Background()
+	report := checkConfig(ctx, configFile)
+
+	var err error
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.print(os.Stdout)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if report.failed() {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func checkConfig(ctx context.Context, configFile string) *doctorReport {
+	r := &doctorReport{}
+	cfg, err := loadConfig(configFile, configFile == defaultConfigFile)
+	if err != nil {
+		r.add("config", configFile, doctorFail, "%v", err)
+		return r
+	}
+	r.add("config", configFile, doctorPass, "valid")
+	setupResolvers(cfg.DNS)
+
+	rt, err := detectRuntime(cfg)
+	if err != nil {
+		r.add("runtime", cfg.Runtime, doctorFail, "%v", err)
+	} else {
+		r.add("runtime", rt.name, doctorPass, "socket %s", rt.socket)
+	}
+	r.checkSetup(cfg)
+
+	realms := slices.Collect(maps.Keys(cfg.Realms))
+	kube, err := newKubeClient(cfg.Kubeconfig)
+	switch {
+	case err != nil:
+		r.add("kubernetes", cfg.Kubeconfig, doctorFail, "%v", err)
+	case kube == nil:
+		status := doctorSkip
+		if cfg.needsKube() {
+			status = doctorFail
+		}
+		r.add("kubernetes", "", status, "no in-cluster configuration or kubeconfig")
+	default:
+		r.add("kubernetes", cfg.Kubeconfig, doctorPass, "API client set up")
+		if _, err := newTokenBroker(cfg.TokenBroker, kube); err != nil {
+			r.add("source", "tokenBroker", doctorFail, "%v", err)
+		}
+		if cfg.KerberosIdentities {
+			realms = append(realms, r.checkIdentities(ctx, kube)...)
+		}
+	}
+
+	r.checkHooks(cfg, rt)
+
+	if cfg.DefaultRealm != "" {
+		realms = append(realms, cfg.DefaultRealm)
+	}
+	slices.Sort(realms)
+	for _, realm := range slices.Compact(realms) {
+		r.checkRealm(ctx, cfg, realm)
+	}
+	return r
+}
+
+// Set up the backend and the credential sources as the plugin does, without
+// using them.
+func (r *doctorReport) checkSetup(cfg *config) {
+	name := cfg.Backend
+	if name == "" {
+		name = backendNative
+	}
+	if _, err := newBackend(cfg, nodeExec{}, systemClock{}); err != nil {
+		r.add("backend", name, doctorFail, "%v", err)
+	} else {
+		r.add("backend", name, doctorPass, "set up")
+	}
+
+	for _, source := range []struct {
+		name string
+		new  func() error
+	}{
+		{"directory", func() error { _, err := newDirectory(cfg.Directory, nodeExec{}, systemClock{}); return err }},
+		{"vault", func() error { _, err := newVaultSource(cfg.Vault); return err }},
+		{"awsSecrets", func() error { _, err := newAWSSecretsSource(cfg.AWSSecrets); return err }},
+		{"gcpSecrets", func() error { _, err := newGCPSecretsSource(cfg.GCPSecrets); return err }},
+	} {
+		if err := source.new(); err != nil {
+			r.add("source", source.name, doctorFail, "%v", err)
+		}
+	}
+}
+
+// Settings of the plugin that fail it at startup without Kubernetes API
+// access.
+func (c *config) needsKube() bool {
+	return c.IDsFromSecurityContext || c.KerberosIdentities || c.NamespaceRealmLabel != "" || c.NamespaceDefaults || c.Events ||
+		c.TicketStatus || c.PodStatus.enabled() || c.Remediation.needsKube() || c.Prestage.Enabled ||
+		c.TokenBroker.URL != "" || c.NodeCondition.Enabled
+}
+
+// KerberosIdentity resources, each is checked for errors and for namespaces
+// claimed by an older one. Returns the realms of the valid ones.
+func (r *doctorReport) checkIdentities(ctx context.Context, kube *kubeClient) []string {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	list := struct {
+		Items []*kerberosIdentity `json:"items"`
+	}{}
+	if err := kube.do(ctx, http.MethodGet, identitiesPath, "", nil, &list); err != nil {
+		r.add("identity", identitiesPath, doctorFail, "%v", err)
+		return nil
+	}
+	if len(list.Items) == 0 {
+		r.add("identity", identitiesPath, doctorWarn, "no KerberosIdentities")
+		return nil
+	}
+
+	res := resolveIdentities(list.Items)
+	var realms []string
+	for _, id := range list.Items {
+		name := id.Metadata.Name
+		switch {
+		case res.invalid[name] != nil:
+			r.add("identity", name, doctorFail, "%v", res.invalid[name])
+			continue
+		case len(res.conflicts[name]) > 0:
+			r.add("identity", name, doctorWarn, "namespaces %s claimed by an older identity", strings.Join(res.conflicts[name], ", "))
+		default:
+			r.add("identity", name, doctorPass, "realm %s", id.Spec.Realm)
+		}
+		realms = append(realms, id.Spec.Realm)
+	}
+	return realms
+}
+
+// OCI hook definitions of the hook directories, as the plugin loads them.
+func (r *doctorReport) checkHooks(cfg *config, rt *containerRuntime) {
+	dirs := cfg.HookDirs
+	if len(dirs) == 0 && rt != nil {
+		dirs = rt.hookDirs
+	}
+	for _, dir := range dirs {
+		defs := map[string]*current.Hook{}
+		err := hooks.ReadDir(dir, nil, defs)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			r.add("hooks", dir, doctorSkip, "no such directory")
+		case err != nil:
+			r.add("hooks", dir, doctorFail, "%v", err)
+		default:
+			r.add("hooks", dir, doctorPass, "%d hooks", len(defs))
+		}
+	}
+}
+
+// KDCs of the realm, configured or discovered, and the addresses of its KDCs
+// and NFS servers.
+func (r *doctorReport) checkRealm(ctx context.Context, cfg *config, realm string) {
+	kp := nodeParams(ctx, cfg, "", realm)
+	switch {
+	case kp.KDCProxy != nil:
+		r.add("realm", realm, doctorPass, "KDC proxy %s", kp.KDCProxy.URL)
+	case len(kp.kdcList()) == 0:
+		r.add("realm", realm, doctorFail, "no KDCs configured or discovered")
+	default:
+		r.add("realm", realm, doctorPass, "KDCs %s", strings.Join(kp.kdcList(), ", "))
+	}
+	r.checkDNS(ctx, kp)
+}
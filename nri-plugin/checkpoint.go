@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checkpointRefresh = "refresh"
+	checkpointDiscard = "discard"
+)
+
+// Handling of containers restored from a checkpoint.
+type checkpointConfig struct {
+	// Renew the credentials of containers restored from a checkpoint, whose
+	// tickets are as old as the checkpoint, instead of binding them to the
+	// credentials of the pod as they are.
+	Enabled bool `json:"enabled,omitempty"`
+	// Container annotations marking restored containers, besides those of the runtime.
+	Annotations []string `json:"annotations,omitempty"`
+	// refresh (default) renews the credentials in place, obtaining them
+	// afresh if they cannot be renewed; discard destroys them and obtains new
+	// ones.
+	Action string `json:"action,omitempty"`
+}
+
+func (c *checkpointConfig) validate() error {
+	switch c.Action {
+	case "", checkpointRefresh, checkpointDiscard:
+		return nil
+	}
+	return fmt.Errorf("action %q must be refresh or discard", c.Action)
+}
+
+func (c *checkpointConfig) action() string {
+	if c.Action != "" {
+		return c.Action
+	}
+	return checkpointRefresh
+}
+
+// Annotation marking a container restored from a checkpoint, if it is one.
+func (c *checkpointConfig) restored(rt *containerRuntime, container *api.Container) (string, bool) {
+	if !c.Enabled {
+		return "", false
+	}
+	for _, key := range slices.Concat(c.Annotations, rt.checkpointAnnotations) {
+		if _, ok := container.GetAnnotations()[key]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Replace the credentials a container restored from a checkpoint is bound to
+// and publish them to the pod again, scheduling their renewal by the end time
+// of the new ticket.
+func (p *plugin) refreshRestored(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams, annotation string) (err error) {
+	action := cfg.Checkpoint.action()
+	l.Infof("restored from a checkpoint (%s), credentials for %s: %s", annotation, kp.Principal(), action)
+	defer func() {
+		checkpointRestores.WithLabelValues(action, result(err)).Inc()
+		if err != nil && !p.warnClockSkew(pod, kp, err) {
+			p.events.warn(pod, reasonSetupFailed, "credentials for %s of a container restored from a checkpoint cannot be had (%s): %v",
+				kp.Principal(), failureReason(err), err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(withLogger(ctx, l), cfg.setupTimeout())
+	defer cancel()
+	if err := p.fetchCredentials(ctx, pod, kp); err != nil {
+		return err
+	}
+	renew, op := p.backend.Renew, "renew"
+	if t, err := ccacheTimes(kp.CCName, kp.Realm); action == checkpointDiscard || err != nil || !t.renewTill.After(p.clock.Now().Add(minRenewalDelay)) {
+		renew, op = p.backend.Setup, "setup"
+	}
+	if action == checkpointDiscard {
+		if err := p.backend.Destroy(ctx, kp); err != nil {
+			return err
+		}
+		if err := prepareCollection(kp.CCName, int(kp.UID), int(kp.GID)); err != nil {
+			return err
+		}
+	}
+	err = renew(ctx, kp)
+	p.auditOp(op, pod, kp.Container, kp, err)
+	if err != nil {
+		return err
+	}
+
+	if pod.GetUid() != "" && len(kp.Volumes) == 0 {
+		if _, err := p.publishCCache(pod, kp); err != nil {
+			return fmt.Errorf("failed to publish credential cache: %w", err)
+		}
+	}
+	p.scheduleRenewal(managedKey(pod, kp))
+	if !kp.secondary() {
+		p.tickets.report(pod, kp, nil)
+	}
+	return nil
+}
+
+// Bind a container to managed credentials, renewing them first if it was
+// restored from a checkpoint, or checking them if it was created again in the
+// same sandbox.
+func (p *plugin) bindContainer(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, container *api.Container, kp *kerberosParams) error {
+	recreated := p.bindings.bind(pod, container.GetName(), managedKey(pod, kp))
+	if annotation, ok := cfg.Checkpoint.restored(p.runtime(), container); ok {
+		return p.refreshRestored(ctx, l, cfg, pod, kp, annotation)
+	}
+	if recreated {
+		return p.rebind(ctx, l, cfg, pod, kp)
+	}
+	return nil
+}
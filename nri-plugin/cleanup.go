@@ -0,0 +1,138 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Scheduler for delayed credential cleanup, also used for renewals. Every
+// pending cleanup runs in a tracked goroutine which is canceled when the
+// scheduler is stopped.
+type cleaner struct {
+	sync.Mutex
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending map[string]*pendingCleanup
+	clock   Clock
+}
+
+type pendingCleanup struct {
+	cancel context.CancelFunc
+	fn     func()
+	// When fn is due to run.
+	due time.Time
+}
+
+func newCleaner(clock Clock) *cleaner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &cleaner{
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: make(map[string]*pendingCleanup),
+		clock:   clock,
+	}
+}
+
+// Schedule fn to run for id after delay. A zero delay runs fn immediately.
+// Scheduling an id which already has a pending cleanup replaces it.
+func (c *cleaner) Schedule(id string, delay time.Duration, fn func()) {
+	if delay <= 0 {
+		c.Cancel(id)
+		fn()
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.ctx.Err() != nil {
+		return
+	}
+	if old, ok := c.pending[id]; ok {
+		old.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	pc := &pendingCleanup{cancel: cancel, fn: fn, due: c.clock.Now().Add(delay)}
+	c.pending[id] = pc
+	// started here, so that the delay counts from now however late the
+	// goroutine runs
+	timer := c.clock.NewTimer(delay)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+		}
+
+		c.Lock()
+		if c.pending[id] != pc {
+			c.Unlock()
+			return
+		}
+		delete(c.pending, id)
+		c.Unlock()
+
+		fn()
+	}()
+}
+
+// Cancel the pending cleanup for id, returning true if there was one.
+func (c *cleaner) Cancel(id string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	pc, ok := c.pending[id]
+	if !ok {
+		return false
+	}
+	delete(c.pending, id)
+	pc.cancel()
+
+	return true
+}
+
+// Times the pending cleanups are due at, by id.
+func (c *cleaner) Due() map[string]time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	due := make(map[string]time.Time, len(c.pending))
+	for id, pc := range c.pending {
+		due[id] = pc.due
+	}
+	return due
+}
+
+// Stop cancels all pending cleanups and waits for their goroutines to exit.
+func (c *cleaner) Stop() {
+	c.Lock()
+	c.cancel()
+	c.pending = make(map[string]*pendingCleanup)
+	c.Unlock()
+
+	c.wg.Wait()
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Handling of failures due to the clock of the node.
+type clockSkewConfig struct {
+	// Retry AS exchanges of the native backend failing with clock skew with
+	// MIT kinit, which corrects its timestamps by the time of the KDC.
+	Retry bool `json:"retry,omitempty"`
+}
+
+// Failure due to clock skew, with the offset of the KDC clock measured.
+type clockSkewError struct {
+	err error
+	// Offset of the KDC clock from the node clock.
+	offset time.Duration
+}
+
+func (e *clockSkewError) Error() string {
+	return fmt.Sprintf("%v (%s)", e.err, describeOffset(e.offset))
+}
+
+func (e *clockSkewError) Unwrap() error {
+	return e.err
+}
+
+func describeOffset(offset time.Duration) string {
+	offset = offset.Round(time.Second)
+	if offset < 0 {
+		return fmt.Sprintf("node clock %s ahead of the KDC", -offset)
+	}
+	return fmt.Sprintf("node clock %s behind the KDC", offset)
+}
+
+// Measure the offset of the KDC clock after a clock skew failure, recording it
+// and adding it to the error.
+func (b *NativeBackend) clockSkew(ctx context.Context, kp *kerberosParams, err error) error {
+	cfg, stop, cerr := b.krb5Config(ctx, kp)
+	if cerr != nil {
+		return err
+	}
+	defer stop()
+	offset, merr := measureClockOffset(ctx, cfg, kp)
+	if merr != nil {
+		loggerFrom(ctx).Debugf("cannot measure the clock offset of the KDC of %s: %v", kp.Realm, merr)
+		return err
+	}
+	kdcClockOffset.WithLabelValues(kp.Realm).Set(offset.Seconds())
+	return &clockSkewError{err: err, offset: offset}
+}
+
+// Offset of the KDC clock from the node clock, from the time of the error the
+// KDC answers an AS-REQ without pre-authentication with, taken as that half way
+// through the exchange.
+func measureClockOffset(ctx context.Context, cfg *krb5config.Config, kp *kerberosParams) (time.Duration, error) {
+	req, err := messages.NewASReqForTGT(kp.Realm, cfg, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, kp.principalName()))
+	if err != nil {
+		return 0, err
+	}
+	msg, err := req.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	sent := time.Now()
+	reply, err := exchangeKDC(ctx, cfg, kp.Realm, msg)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	var krbErr messages.KRBError
+	if err := krbErr.Unmarshal(reply); err != nil {
+		return 0, errors.New("the KDC answered without an error telling its time")
+	}
+	kdcTime := krbErr.STime.Add(time.Duration(krbErr.Susec) * time.Microsecond)
+	return kdcTime.Sub(sent.Add(received.Sub(sent) / 2)), nil
+}
+
+// Post a KerberosClockSkew Event for a failure due to clock skew whose offset
+// was measured, returning whether it was one.
+func (p *plugin) warnClockSkew(pod *api.PodSandbox, kp *kerberosParams, err error) bool {
+	var skew *clockSkewError
+	if !errors.As(err, &skew) {
+		return false
+	}
+	p.events.warn(pod, reasonClockSkew, "credentials for %s cannot be had, the clock of node %s is off from the KDC of realm %s: %v",
+		kp.Principal(), nodeName(), kp.Realm, err)
+	return true
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Fetched credentials are used this long before being fetched again.
+const defaultCloudSecretTTL = 5 * time.Minute
+
+// Secrets of a cloud secret manager keytabs and passwords are read from, by
+// namespace.
+type cloudSecretPaths struct {
+	// Secret used for namespaces without an entry in NamespacePaths.
+	// {namespace}, {pod} and {user} are substituted. Empty limits the source
+	// to NamespacePaths.
+	DefaultPath string `json:"defaultPath,omitempty"`
+	// Secrets per namespace, with the same substitutions as DefaultPath.
+	NamespacePaths map[string]string `json:"namespacePaths,omitempty"`
+	// How long fetched credentials are used before they are fetched again,
+	// 5m by default.
+	CacheTTL duration `json:"cacheTTL,omitempty"`
+}
+
+// Secret path of a workload, with {namespace}, {pod} and {user} substituted.
+func secretPath(path string, pod *api.PodSandbox, kp *kerberosParams) string {
+	return strings.NewReplacer(
+		"{namespace}", pod.GetNamespace(),
+		"{pod}", pod.GetName(),
+		"{user}", kp.User,
+	).Replace(strings.Trim(path, "/"))
+}
+
+// Keytabs and passwords from a cloud secret manager, kept for the cache TTL
+// so that pods of the same user and keytab rotation checks do not read the
+// secret each time.
+type cloudSecretSource struct {
+	name  string
+	paths cloudSecretPaths
+	// Read the value of a secret.
+	read func(ctx context.Context, secret string) ([]byte, error)
+
+	sync.Mutex
+	cache map[string]cachedCredential
+}
+
+type cachedCredential struct {
+	cred    *credential
+	expires time.Time
+}
+
+func newCloudSecretSource(name string, paths cloudSecretPaths, read func(context.Context, string) ([]byte, error)) *cloudSecretSource {
+	if paths.CacheTTL.Duration <= 0 {
+		paths.CacheTTL.Duration = defaultCloudSecretTTL
+	}
+	return &cloudSecretSource{name: name, paths: paths, read: read, cache: make(map[string]cachedCredential)}
+}
+
+func (s *cloudSecretSource) Name() string {
+	return s.name
+}
+
+// Check whether the source holds credentials for workloads in the namespace.
+// Safe to call on a nil source.
+func (s *cloudSecretSource) handles(namespace string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.paths.NamespacePaths[namespace]
+	return ok || s.paths.DefaultPath != ""
+}
+
+func (s *cloudSecretSource) Fetch(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) (*credential, error) {
+	path, ok := s.paths.NamespacePaths[pod.GetNamespace()]
+	if !ok {
+		path = s.paths.DefaultPath
+	}
+	secret := secretPath(path, pod, kp)
+
+	now := time.Now()
+	s.Lock()
+	for k, c := range s.cache {
+		if !now.Before(c.expires) {
+			delete(s.cache, k)
+		}
+	}
+	c, ok := s.cache[secret]
+	s.Unlock()
+	if ok {
+		return c.cred, nil
+	}
+
+	data, err := s.read(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := secretCredential(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", secret, err)
+	}
+
+	s.Lock()
+	s.cache[secret] = cachedCredential{cred: cred, expires: now.Add(s.paths.CacheTTL.Duration)}
+	s.Unlock()
+	return cred, nil
+}
+
+// Credential of a secret value: a JSON object with a base64 "keytab" or a
+// "password" field, as in Vault, or a keytab as it is.
+func secretCredential(data []byte) (*credential, error) {
+	var fields struct {
+		Keytab   string `json:"keytab"`
+		Password string `json:"password"`
+	}
+	if bytes.HasPrefix(data, []byte{0x05, 0x02}) {
+		return &credential{Keytab: data}, nil
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("neither a keytab nor a JSON object: %w", err)
+	}
+	if fields.Keytab != "" {
+		keytab, err := base64.StdEncoding.DecodeString(fields.Keytab)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keytab: %w", err)
+		}
+		return &credential{Keytab: keytab}, nil
+	}
+	if fields.Password != "" {
+		return &credential{Password: fields.Password}, nil
+	}
+	return nil, errors.New("no keytab or password")
+}
@@ -0,0 +1,326 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// kubectl-kerberos is the kubectl plugin showing the KerberosTicket objects
+// the Kerberos plugins of the nodes publish with ticketStatus:
+// `kubectl kerberos [list] [-n namespace | -A]` and
+// `kubectl kerberos describe <pod> [-n namespace]`.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tuminoid/nri-plugins/kerberos-auth/kubeapi"
+)
+
+const (
+	ticketsPath       = "/apis/kerberos.nri.io/v1alpha1/kerberostickets"
+	ticketsPathFormat = "/apis/kerberos.nri.io/v1alpha1/namespaces/%s/kerberostickets"
+
+	conditionReady = "Ready"
+)
+
+// KerberosTicket, the ticket state of a pod as published by the node plugin.
+type kerberosTicket struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		Labels          map[string]string `json:"labels,omitempty"`
+		OwnerReferences []ownerReference  `json:"ownerReferences,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Pod       string `json:"pod"`
+		Node      string `json:"node"`
+		Principal string `json:"principal"`
+	} `json:"spec"`
+	Status struct {
+		Expires        *time.Time  `json:"expires,omitempty"`
+		RenewTill      *time.Time  `json:"renewTill,omitempty"`
+		LastRenewal    *time.Time  `json:"lastRenewal,omitempty"`
+		TicketLifetime string      `json:"ticketLifetime,omitempty"`
+		RenewLifetime  string      `json:"renewLifetime,omitempty"`
+		Conditions     []condition `json:"conditions,omitempty"`
+	} `json:"status,omitzero"`
+}
+
+type ownerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+}
+
+type condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// List of KerberosTicket objects.
+type kerberosTicketList struct {
+	Items []kerberosTicket `json:"items"`
+}
+
+func main() {
+	var (
+		kubeconfig, namespace, output string
+		allNamespaces                 bool
+	)
+
+	args := os.Args[1:]
+	cmd := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	fs.StringVar(&kubeconfig, "kubeconfig", defaultKubeconfig(), "kubeconfig")
+	fs.StringVar(&namespace, "n", "", "namespace, that of the kubeconfig context or default if empty")
+	fs.StringVar(&namespace, "namespace", "", "namespace, that of the kubeconfig context or default if empty")
+	fs.BoolVar(&allNamespaces, "A", false, "list the pods of all namespaces")
+	fs.BoolVar(&allNamespaces, "all-namespaces", false, "list the pods of all namespaces")
+	fs.StringVar(&output, "o", "", "output format, json for the KerberosTicket objects")
+	names := parseInterspersed(fs, args)
+
+	kube, err := kubeapi.New(kubeconfig)
+	if err == nil && kube == nil {
+		err = fmt.Errorf("no kubeconfig at %q", kubeconfig)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if namespace == "" {
+		namespace = kube.Namespace
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	ctx := context.Background()
+	switch cmd {
+	case "list", "ls", "get":
+		if allNamespaces {
+			namespace = ""
+		}
+		err = listTickets(ctx, os.Stdout, kube, namespace, names, output)
+	case "describe":
+		if len(names) == 0 {
+			err = fmt.Errorf("describe needs a pod name")
+			break
+		}
+		err = describeTickets(ctx, os.Stdout, kube, namespace, names)
+	default:
+		err = fmt.Errorf("unknown command %q, must be list or describe", cmd)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Kubeconfig as kubectl takes it by default: the first file of $KUBECONFIG,
+// or ~/.kube/config.
+func defaultKubeconfig() string {
+	if path, _, _ := strings.Cut(os.Getenv("KUBECONFIG"), string(filepath.ListSeparator)); path != "" {
+		return path
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".kube", "config")
+	}
+	return ""
+}
+
+// Parse flags given before, between and after the arguments, as kubectl
+// does, returning the arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var rest []string
+	for {
+		_ = fs.Parse(args)
+		if fs.NArg() == 0 {
+			return rest
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// KerberosTickets of a namespace, or of all if empty, by namespace and name.
+func getTickets(ctx context.Context, kube *kubeapi.Client, namespace string) ([]kerberosTicket, error) {
+	path := ticketsPath
+	if namespace != "" {
+		path = fmt.Sprintf(ticketsPathFormat, namespace)
+	}
+	list := &kerberosTicketList{}
+	if err := kube.Do(ctx, http.MethodGet, path, "", nil, list); err != nil {
+		if errors.Is(err, kubeapi.ErrNotFound) {
+			return nil, fmt.Errorf("%w: is the KerberosTicket CRD installed?", err)
+		}
+		return nil, err
+	}
+	slices.SortFunc(list.Items, func(a, b kerberosTicket) int {
+		return strings.Compare(a.Metadata.Namespace+"/"+a.Metadata.Name, b.Metadata.Namespace+"/"+b.Metadata.Name)
+	})
+	return list.Items, nil
+}
+
+// Print a table of the Kerberos managed pods, or of the named ones.
+func listTickets(ctx context.Context, w io.Writer, kube *kubeapi.Client, namespace string, names []string, output string) error {
+	tickets, err := getTickets(ctx, kube, namespace)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		tickets = slices.DeleteFunc(tickets, func(t kerberosTicket) bool { return !slices.Contains(names, t.Spec.Pod) })
+	}
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&kerberosTicketList{Items: tickets})
+	case "":
+	default:
+		return fmt.Errorf("unknown output format %q, must be json", output)
+	}
+	if len(tickets) == 0 {
+		where := "namespace " + namespace
+		if namespace == "" {
+			where = "any namespace"
+		}
+		fmt.Fprintf(w, "No Kerberos managed pods found in %s.\n", where)
+		return nil
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	header := "POD\tNODE\tPRINCIPAL\tEXPIRES\tLAST RENEWAL\tREADY\tLAST ERROR"
+	if namespace == "" {
+		header = "NAMESPACE\t" + header
+	}
+	fmt.Fprintln(tw, header)
+	for _, t := range tickets {
+		ready, lastErr := ticketReady(&t)
+		row := strings.Join([]string{t.Spec.Pod, t.Spec.Node, t.Spec.Principal,
+			untilTime(t.Status.Expires, now), sinceTime(t.Status.LastRenewal, now), ready, lastErr}, "\t")
+		if namespace == "" {
+			row = t.Metadata.Namespace + "\t" + row
+		}
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
+
+// Print the ticket state of the named pods.
+func describeTickets(ctx context.Context, w io.Writer, kube *kubeapi.Client, namespace string, names []string) error {
+	tickets, err := getTickets(ctx, kube, namespace)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, name := range names {
+		idx := slices.IndexFunc(tickets, func(t kerberosTicket) bool { return t.Spec.Pod == name })
+		if idx < 0 {
+			return fmt.Errorf("pod %s/%s has no KerberosTicket: not Kerberos managed, or its node does not publish ticketStatus", namespace, name)
+		}
+		t := &tickets[idx]
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(tw, "Pod:\t%s/%s\n", t.Metadata.Namespace, t.Spec.Pod)
+		fmt.Fprintf(tw, "Node:\t%s\n", t.Spec.Node)
+		fmt.Fprintf(tw, "Principal:\t%s\n", t.Spec.Principal)
+		fmt.Fprintf(tw, "Expires:\t%s\n", describeTime(t.Status.Expires, untilTime(t.Status.Expires, now)))
+		fmt.Fprintf(tw, "Last renewal:\t%s\n", describeTime(t.Status.LastRenewal, sinceTime(t.Status.LastRenewal, now)))
+		fmt.Fprintln(tw, "Conditions:")
+		for _, c := range t.Status.Conditions {
+			fmt.Fprintf(tw, "  %s:\t%s, %s since %s\n", c.Type, c.Status, c.Reason, c.LastTransitionTime.Local().Format(time.RFC3339))
+			if c.Message != "" {
+				fmt.Fprintf(tw, "  \t%s\n", c.Message)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ready status of a ticket, and the last error if it is not.
+func ticketReady(t *kerberosTicket) (string, string) {
+	for _, c := range t.Status.Conditions {
+		if c.Type != conditionReady {
+			continue
+		}
+		if c.Status == "True" {
+			return "True", "-"
+		}
+		return c.Status, c.Reason + ": " + c.Message
+	}
+	return "Unknown", "-"
+}
+
+func untilTime(t *time.Time, now time.Time) string {
+	switch {
+	case t == nil:
+		return "-"
+	case t.Before(now):
+		return "expired " + shortDuration(now.Sub(*t)) + " ago"
+	}
+	return "in " + shortDuration(t.Sub(now))
+}
+
+func sinceTime(t *time.Time, now time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return shortDuration(now.Sub(*t)) + " ago"
+}
+
+func describeTime(t *time.Time, relative string) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339) + " (" + relative + ")"
+}
+
+// Duration rounded as kubectl shows ages, e.g. 45s, 12m, 5h3m, 2d4h.
+func shortDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+}
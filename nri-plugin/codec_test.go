@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The JSON messages of the ticket agent and keytab distribution APIs, as sent
+// by plugins and controllers of other versions, must keep decoding.
+func TestJSONCodecWireFormat(t *testing.T) {
+	expires := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		msg  any
+		wire string
+	}{
+		{"ticket reply", &ticketReply{Expires: expires}, `{"expires":"2026-01-02T03:04:05Z"}`},
+		{"empty ticket reply", &ticketReply{}, `{}`},
+		{"sealed bundle", &sealedBundle{Node: "node-1", Key: []byte{1}, Nonce: []byte{2}, Ciphertext: []byte{3}, Signature: []byte{4}},
+			`{"node":"node-1","key":"AQ==","nonce":"Ag==","ciphertext":"Aw==","signature":"BA=="}`},
+		{"bundle", &keytabBundle{Node: "node-1", Serial: 42, Keytabs: map[string][]byte{"alice.keytab": {5, 2}}},
+			`{"node":"node-1","serial":42,"keytabs":{"alice.keytab":"BQI="}}`},
+		{"store reply", &storeKeytabsReply{Keytabs: 3}, `{"keytabs":3}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			codec := jsonCodec{}
+			b, err := codec.Marshal(tc.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.wire {
+				t.Errorf("encoded as %s, want %s", b, tc.wire)
+			}
+			decoded := reflect.New(reflect.TypeOf(tc.msg).Elem()).Interface()
+			if err := codec.Unmarshal([]byte(tc.wire), decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tc.msg) {
+				t.Errorf("decoded as %+v, want %+v", decoded, tc.msg)
+			}
+		})
+	}
+}
+
+func TestJSONCodecTicketRequest(t *testing.T) {
+	codec := jsonCodec{}
+	if name := codec.Name(); name != "json" {
+		t.Errorf("codec name %q, want json", name)
+	}
+
+	req := &ticketRequest{Params: &kerberosParams{UID: 1000, GID: 1001, FSID: 1002, User: "alice", Realm: "EXAMPLE.COM",
+		KDC: "kdc.example.com", NFS: "nfs.example.com", CCName: "FILE:/tmp/krb5cc_1000"}}
+	b, err := codec.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := `{"params":{"UID":1000,"GID":1001,"FSID":1002,"User":"alice","Realm":"EXAMPLE.COM","KDC":"kdc.example.com","NFS":"nfs.example.com","CCName":"FILE:/tmp/krb5cc_1000",`
+	if !strings.HasPrefix(string(b), prefix) {
+		t.Errorf("encoded as %s, want it to start with %s", b, prefix)
+	}
+
+	// as sent by a plugin knowing fewer parameters, with unknown ones ignored
+	wire := `{"params":{"UID":1000,"GID":1001,"FSID":1002,"User":"alice","Realm":"EXAMPLE.COM","KDC":"kdc.example.com",` +
+		`"NFS":"nfs.example.com","CCName":"FILE:/tmp/krb5cc_1000","Keytab":"/etc/keytabs/alice.keytab","Unknown":true}}`
+	var decoded ticketRequest
+	if err := codec.Unmarshal([]byte(wire), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want := *req.Params
+	want.Keytab = "/etc/keytabs/alice.keytab"
+	if decoded.Params == nil || !reflect.DeepEqual(*decoded.Params, want) {
+		t.Errorf("decoded as %+v, want %+v", decoded.Params, want)
+	}
+}
@@ -0,0 +1,600 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Configuration file used without -config, typically a mounted ConfigMap.
+	defaultConfigFile = "/etc/nri-kerberos/config.yaml"
+	// Prefix of the pod annotations the plugin acts on.
+	defaultAnnotationPrefix = "nri.io/"
+
+	defaultSetupTimeout   = 60 * time.Second
+	defaultCleanupTimeout = 30 * time.Second
+)
+
+// Node-level plugin configuration.
+type config struct {
+	// Realm used when a container does not set KERBEROS_REALM.
+	DefaultRealm string `json:"defaultRealm,omitempty"`
+	// KDC hostname used when a container does not set KDC_HOSTNAME.
+	DefaultKDC string `json:"defaultKDC,omitempty"`
+	// Further KDCs of the default realm, tried in order after the primary one.
+	KDCs []string `json:"kdcs,omitempty"`
+	// NFS server hostname used when a container does not set NFS_HOSTNAME.
+	DefaultNFS string `json:"defaultNFS,omitempty"`
+	// MS-KKDCP proxy the KDCs of the default realm are reached through.
+	KDCProxy *kdcProxyConfig `json:"kdcProxy,omitempty"`
+	// Look up the KDCs of realms in DNS SRV records, trying them after the configured ones.
+	DiscoverKDCs bool `json:"discoverKDCs,omitempty"`
+	// Look up the realm of pods which name none in the DNS TXT records of
+	// their NFS server, before the node default.
+	DiscoverRealms bool `json:"discoverRealms,omitempty"`
+	// Nameservers of the DNS lookups of the plugin.
+	DNS dnsConfig `json:"dns,omitempty"`
+	// Condition, label and taint of the node while Kerberos workloads cannot be served on it.
+	NodeCondition nodeConditionConfig `json:"nodeCondition,omitempty"`
+	// Realm table, giving the KDCs, NFS server and domains of pods in other realms.
+	Realms map[string]realmConfig `json:"realms,omitempty"`
+	// Namespace label naming the realm of the pods in the namespace, needs Kubernetes API access.
+	NamespaceRealmLabel string `json:"namespaceRealmLabel,omitempty"`
+	// Take the realm, KDC, NFS servers, security flavor, credential cache type
+	// and NFS version pods leave out from the labels and annotations of their
+	// namespace, needs Kubernetes API access.
+	NamespaceDefaults bool `json:"namespaceDefaults,omitempty"`
+	// Prefix of the pod annotations, "nri.io/" by default.
+	AnnotationPrefix string `json:"annotationPrefix,omitempty"`
+	// Address to serve Prometheus metrics at, e.g. ":9464". Disabled if empty.
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+	// Address to serve /healthz and /readyz at, e.g. ":9465". Disabled if empty.
+	HealthAddress string `json:"healthAddress,omitempty"`
+	// Address to serve net/http/pprof and /debug/state at, on localhost, e.g.
+	// "127.0.0.1:6060", or a UNIX socket, e.g. "unix:/run/nri-kerberos/debug.sock".
+	// Disabled if empty.
+	DebugAddress string `json:"debugAddress,omitempty"`
+	// OpenTelemetry tracing, exported over OTLP/HTTP.
+	Tracing tracingConfig `json:"tracing,omitempty"`
+	// Audit log of successful authentications.
+	Audit auditConfig `json:"audit,omitempty"`
+	// Admin API on a UNIX socket of the node.
+	Admin adminConfig `json:"admin,omitempty"`
+	// Backend used for credential setup, native (default), script or agent.
+	Backend string `json:"backend,omitempty"`
+	// Ticket agent, serving the agent backend.
+	Agent agentConfig `json:"agent,omitempty"`
+	// CSI node plugin for Kerberized NFS volumes.
+	CSI csiConfig `json:"csi,omitempty"`
+	// Path of the script run by the script backend.
+	ScriptPath string `json:"scriptPath,omitempty"`
+	// Run the script once for each setup phase, prepare and mount, instead of
+	// once for the whole setup.
+	ScriptPhases bool `json:"scriptPhases,omitempty"`
+	// Time limit for a single run of the script, 30s by default.
+	ScriptTimeout duration `json:"scriptTimeout,omitempty"`
+	// Capture of the output of the script.
+	ScriptOutput scriptOutputConfig `json:"scriptOutput,omitempty"`
+	// Resource limits of the external commands run.
+	Helpers helpersConfig `json:"helpers,omitempty"`
+	// Number of credential setups and renewals run at once, 4 by default.
+	MaxParallelSetups int `json:"maxParallelSetups,omitempty"`
+	// OCI hook directories to watch, those of the runtime if empty.
+	HookDirs []string `json:"hookDirs,omitempty"`
+	// Inject the OCI hooks of the hook directories matching a container into
+	// it, for containerd, which does not run them itself.
+	InjectHooks bool `json:"injectHooks,omitempty"`
+	// Container runtime of the node, containerd or cri-o, detected by its CRI
+	// socket if empty, and by what it reports once connected.
+	Runtime string `json:"runtime,omitempty"`
+	// Reconnection to the runtime after losing the NRI connection.
+	Reconnect reconnectConfig `json:"reconnect,omitempty"`
+	// Outcomes of recent setups kept for containers created again.
+	SetupResults setupResultsConfig `json:"setupResults,omitempty"`
+	// Classes of the ticket operations of namespaces.
+	QoS qosConfig `json:"qos,omitempty"`
+	// Gating of the start of containers on their credentials being ready.
+	StartGate startGateConfig `json:"startGate,omitempty"`
+	// Circuit breaker of principals failing setups.
+	Breaker breakerConfig `json:"breaker,omitempty"`
+	// Directory of user keytabs used by the native backend.
+	KeytabDir string `json:"keytabDir,omitempty"`
+	// URL the native backend downloads user keytabs from, {kdc} and {user} are substituted.
+	KeytabURL string `json:"keytabURL,omitempty"`
+	// Directory for keytabs fetched from Secrets, should be on tmpfs.
+	KeytabRuntimeDir string `json:"keytabRuntimeDir,omitempty"`
+	// Kubeconfig for Kubernetes API access. In-cluster credentials are used if empty and available.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Post Warning Events for pods whose credentials cannot be set up or renewed.
+	Events bool `json:"events,omitempty"`
+	// Publish a KerberosTicket with the ticket state of each managed pod.
+	TicketStatus bool `json:"ticketStatus,omitempty"`
+	// Ticket state written back to the annotations and conditions of pods.
+	PodStatus podStatusConfig `json:"podStatus,omitempty"`
+	// Apply the KerberosIdentity resources of the cluster, needs Kubernetes API access.
+	KerberosIdentities bool `json:"kerberosIdentities,omitempty"`
+	// Vault credential source.
+	Vault vaultConfig `json:"vault,omitempty"`
+	// AWS Secrets Manager and GCP Secret Manager credential sources.
+	AWSSecrets awsSecretsConfig `json:"awsSecretsManager,omitempty"`
+	GCPSecrets gcpSecretsConfig `json:"gcpSecretManager,omitempty"`
+	// Exchange of the ServiceAccount tokens of pods for their credentials.
+	TokenBroker tokenBrokerConfig `json:"tokenBroker,omitempty"`
+	// Keytabs of group managed service accounts of AD, from their managed passwords.
+	GMSA gmsaConfig `json:"gmsa,omitempty"`
+	// Templates of the principal names of workloads, by namespace.
+	PrincipalTemplate principalTemplateConfig `json:"principalTemplate,omitempty"`
+	// Principals from the SPIFFE IDs of the pods.
+	SPIFFE spiffeConfig `json:"spiffe,omitempty"`
+	// NFSv4 ID mapping of the node.
+	IDMap idmapConfig `json:"idmap,omitempty"`
+	// Management of rpc.gssd on the node.
+	GSSD gssdConfig `json:"gssd,omitempty"`
+	// Take uid, gid and fsid from the runAsUser, runAsGroup and fsGroup of
+	// pods where not annotated; annotations present must match them.
+	IDsFromSecurityContext bool `json:"idsFromSecurityContext,omitempty"`
+	// Directory the uids and gids of users are looked up in.
+	Directory directoryConfig `json:"directory,omitempty"`
+	// Verification of the NFS volume mounts of managed pods.
+	MountCheck mountCheckConfig `json:"mountCheck,omitempty"`
+	// Mount NFS exports the plugin mounts itself with mount(8) rather than
+	// mount(2), leaving resolving and negotiating to mount.nfs.
+	MountHelper bool `json:"mountHelper,omitempty"`
+	// Delegation of GSS operations to gss-proxy on the host.
+	GSSProxy gssProxyConfig `json:"gssProxy,omitempty"`
+	// FAST armoring of initial authentication.
+	FAST fastConfig `json:"fast,omitempty"`
+	// Constrained delegation of NFS service tickets by a service principal.
+	Delegation delegationConfig `json:"delegation,omitempty"`
+	// Node certificate for PKINIT.
+	PKINIT pkinitConfig `json:"pkinit,omitempty"`
+	// Namespaces whose pods may give the KDC and NFS host names addresses.
+	HostAliases hostAliasesConfig `json:"hostAliases,omitempty"`
+	// PVs of nfs-subdir-external-provisioner the NFS servers of pods are
+	// taken from.
+	NFSSubdir nfsSubdirConfig `json:"nfsSubdir,omitempty"`
+	// Exports mounted for pods by automount.
+	Autofs autofsConfig `json:"autofs,omitempty"`
+	// Namespaces whose pods fall back to credentials of the node.
+	HostFallback hostFallbackConfig `json:"hostFallback,omitempty"`
+	// Host directory for per-pod credential cache directories, /var/lib/krb5-cc by default.
+	CCacheDir string `json:"ccacheDir,omitempty"`
+	// Container path the pod credential cache directory is mounted at, /var/run/krb5cc by default.
+	CCacheMountPath string `json:"ccacheMountPath,omitempty"`
+	// Where the credential cache directories of pods are on the host: flat in
+	// ccacheDir by default, or kubelet in the pod directories of the kubelet.
+	CCacheDirLayout string `json:"ccacheDirLayout,omitempty"`
+	// Propagation of the mounts of the pod credential cache directories into
+	// containers, rprivate by default, rslave or rshared.
+	CCacheMountPropagation string `json:"ccacheMountPropagation,omitempty"`
+	// Memory file systems of their own for the credential caches and keytabs of each pod.
+	PodTmpfs podTmpfsConfig `json:"podTmpfs,omitempty"`
+	// SELinux labeling of the pod credential cache directories.
+	SELinux selinuxConfig `json:"selinux,omitempty"`
+	// AppArmor rules for the mounts of the containers.
+	AppArmor appArmorConfig `json:"appArmor,omitempty"`
+	// Type of the credential cache of pods not annotated otherwise: FILE (default), DIR, KEYRING or KCM.
+	CCacheType string `json:"ccacheType,omitempty"`
+	// Weakest NFS security flavor the volumes of pods not annotated otherwise
+	// may be mounted with: krb5, krb5i or krb5p. Not enforced if empty.
+	NFSSec string `json:"nfsSec,omitempty"`
+	// NFS version the volumes of pods not annotated otherwise are to be
+	// mounted with: 3, 4 or 4.0 to 4.2. Not enforced if empty.
+	NFSVersion string `json:"nfsVersion,omitempty"`
+	// Replace NFS volume mounts not matching nfsSec, nfsVersion or nfsProto with
+	// NFS mounts of their exports that do, instead of failing the container.
+	RewriteNFSMounts bool `json:"rewriteNFSMounts,omitempty"`
+	// Transport NFS volumes are rewritten to: tcp, tcp6, rdma or rdma6. Any if empty.
+	NFSProto string `json:"nfsProto,omitempty"`
+	// Ask the NFS servers whether they export the exports of the NFS volumes
+	// of containers before creating them, failing those which are not.
+	NFSExportCheck bool `json:"nfsExportCheck,omitempty"`
+	// Node KCM socket mounted into pods with KCM caches, /var/run/.heim_org.h5l.kcm-socket by default.
+	KCMSocket string `json:"kcmSocket,omitempty"`
+	// Delay between StopPodSandbox and destroying the credential cache, 0 for immediate.
+	CCacheGracePeriod duration `json:"ccacheGraceperiod,omitempty"`
+	// Renewal of managed credentials by the plugin itself.
+	Renewal renewalConfig `json:"renewal,omitempty"`
+	// Sharing of credentials by the pods of a principal.
+	CredentialSharing credentialSharingConfig `json:"credentialSharing,omitempty"`
+	// Renewals and state saved on SIGTERM.
+	Shutdown shutdownConfig `json:"shutdown,omitempty"`
+	// Principals created for single pods and deleted with them.
+	Ephemeral ephemeralConfig `json:"ephemeral,omitempty"`
+	// Pre-staging of the credentials of pods scheduled to the node.
+	Prestage prestageConfig `json:"prestage,omitempty"`
+	// Handling of failures due to the clock of the node.
+	ClockSkew clockSkewConfig `json:"clockSkew,omitempty"`
+	// Removal of credential caches and keytabs left behind by pods.
+	Sweep sweepConfig `json:"sweep,omitempty"`
+	// Detection of rotated keytabs of managed credentials.
+	KeytabRotation keytabRotationConfig `json:"keytabRotation,omitempty"`
+	// Alerts on managed tickets close to expiry.
+	ExpiryAlerts expiryAlertConfig `json:"expiryAlerts,omitempty"`
+	// NFS mount statistics and GSS context expiry of managed pods as metrics.
+	MountStats mountStatsConfig `json:"mountStats,omitempty"`
+	// Remediation of pods whose credentials are lost for good.
+	Remediation remediationConfig `json:"remediation,omitempty"`
+	// Decoding of the MS-PAC of NFS service tickets, for diagnostics.
+	PAC pacConfig `json:"pac,omitempty"`
+	// Fail container creation when credential setup failed for the pod,
+	// instead of starting it without credentials.
+	Strict bool `json:"strict,omitempty"`
+	// Namespaces in which setup failures are only logged despite Strict.
+	SoftFailNamespaces []string `json:"softFailNamespaces,omitempty"`
+	// Time limit for fetching credentials and setting up the credential cache.
+	SetupTimeout duration `json:"setupTimeout,omitempty"`
+	// Retries of failed credential setups, renewals and NFS remounts.
+	Retry retryConfig `json:"retry,omitempty"`
+	// Enctypes of the tickets and keys of the workloads.
+	Crypto cryptoConfig `json:"crypto,omitempty"`
+	// Compatibility with Active Directory domains.
+	ActiveDirectory activeDirectoryConfig `json:"activeDirectory,omitempty"`
+	// Settings of the krb5.conf files generated for the workloads.
+	Krb5Conf krb5ConfConfig `json:"krb5Conf,omitempty"`
+	// Reachability probes of the KDC and NFS servers before setups.
+	Preflight preflightConfig `json:"preflight,omitempty"`
+	// Rate of KDC requests of each realm, no limit by default.
+	KDCRateLimit rateLimitConfig `json:"kdcRateLimit,omitempty"`
+	// Limits of the credentials managed on the node.
+	Limits limitsConfig `json:"limits,omitempty"`
+	// Namespaces, service accounts, realms and ids allowed credentials.
+	Policy policyConfig `json:"policy,omitempty"`
+	// Take the Kerberos parameters from the pod annotations only, ignoring
+	// the env of renewal sidecars, as workloads set it unchecked.
+	AnnotationsOnly bool `json:"annotationsOnly,omitempty"`
+	// Digests of the approved renewal sidecar images, as sha256:<hex>. If
+	// set, the KERBEROS_* env of containers of other images is not honored.
+	SidecarImages []string `json:"sidecarImages,omitempty"`
+	// Handling of containers restored from a checkpoint.
+	Checkpoint checkpointConfig `json:"checkpoint,omitempty"`
+	// File the managed credentials and the containers bound to them are kept
+	// in across restarts, /var/lib/nri-kerberos/state.json by default.
+	StateFile string `json:"stateFile,omitempty"`
+	// Only evaluate the annotations and env of pods, logging what would be
+	// done and posting KerberosDryRun Events, without obtaining credentials
+	// or changing containers.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Time limit for destroying credentials.
+	CleanupTimeout duration `json:"cleanupTimeout,omitempty"`
+}
+
+// Prefixed pod annotation key.
+func (c *config) annotation(name string) string {
+	if c.AnnotationPrefix != "" {
+		return c.AnnotationPrefix + name
+	}
+	return defaultAnnotationPrefix + name
+}
+
+// Check whether setup failures fail container creation in the namespace.
+func (c *config) failHard(namespace string) bool {
+	return c.Strict && !slices.Contains(c.SoftFailNamespaces, namespace)
+}
+
+// Check whether Kerberos is enabled for the pod.
+func (c *config) enabled(pod *api.PodSandbox) bool {
+	return pod.GetAnnotations()[c.annotation("kerberos-auth")] == "enabled"
+}
+
+// Annotations a container may override for itself, suffixed with its name.
+var containerAnnotations = []string{"kerberos-user", "kerberos-uid", "kerberos-gid", gidsAnnotation, "kerberos-fsid",
+	"kerberos-realm", "kerberos-ccache-type", "kerberos-sec"}
+
+// Prefixed annotation key of a container override.
+func (c *config) containerAnnotation(name, container string) string {
+	return c.annotation(name) + "." + container
+}
+
+// Check whether Kerberos is enabled for a container of the pod, which the
+// container may override for itself.
+func (c *config) enabledFor(pod *api.PodSandbox, container string) bool {
+	if v, ok := pod.GetAnnotations()[c.containerAnnotation("kerberos-auth", container)]; ok {
+		return v == "enabled"
+	}
+	return c.enabled(pod)
+}
+
+// Check whether a container of the pod gets credentials of its own, for
+// overriding any of the annotations of the pod or being enabled alone. No
+// container of an enabled pod sharing its credential cache does.
+func (c *config) ownCredentials(pod *api.PodSandbox, container string) bool {
+	if !c.enabledFor(pod, container) {
+		return false
+	}
+	if !c.enabled(pod) {
+		return true
+	}
+	if _, ok := pod.GetAnnotations()[c.annotation(sharedCCacheAnnotation)]; ok {
+		return false
+	}
+	for _, name := range containerAnnotations {
+		if _, ok := pod.GetAnnotations()[c.containerAnnotation(name, container)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *config) setupTimeout() time.Duration {
+	if c.SetupTimeout.Duration > 0 {
+		return c.SetupTimeout.Duration
+	}
+	return defaultSetupTimeout
+}
+
+func (c *config) cleanupTimeout() time.Duration {
+	if c.CleanupTimeout.Duration > 0 {
+		return c.CleanupTimeout.Duration
+	}
+	return defaultCleanupTimeout
+}
+
+func (c *config) stateFile() string {
+	if c.StateFile != "" {
+		return c.StateFile
+	}
+	return defaultStateFile
+}
+
+// Carry over settings which only take effect at startup from the running
+// configuration, returning the names of those that differ.
+func (c *config) keepStartupSettings(running *config) []string {
+	var changed []string
+	keep := func(name string, cur, old any, restore func()) {
+		a, _ := json.Marshal(cur)
+		b, _ := json.Marshal(old)
+		if string(a) != string(b) {
+			changed = append(changed, name)
+			restore()
+		}
+	}
+
+	keep("metricsAddress", c.MetricsAddress, running.MetricsAddress, func() { c.MetricsAddress = running.MetricsAddress })
+	keep("healthAddress", c.HealthAddress, running.HealthAddress, func() { c.HealthAddress = running.HealthAddress })
+	keep("debugAddress", c.DebugAddress, running.DebugAddress, func() { c.DebugAddress = running.DebugAddress })
+	keep("tracing", c.Tracing, running.Tracing, func() { c.Tracing = running.Tracing })
+	keep("admin", c.Admin, running.Admin, func() { c.Admin = running.Admin })
+	keep("audit", c.Audit, running.Audit, func() { c.Audit = running.Audit })
+	keep("backend", c.Backend, running.Backend, func() { c.Backend = running.Backend })
+	keep("agent", c.Agent, running.Agent, func() { c.Agent = running.Agent })
+	keep("csi", c.CSI, running.CSI, func() { c.CSI = running.CSI })
+	keep("gssd", c.GSSD, running.GSSD, func() { c.GSSD = running.GSSD })
+	keep("mountCheck", c.MountCheck, running.MountCheck, func() { c.MountCheck = running.MountCheck })
+	keep("mountHelper", c.MountHelper, running.MountHelper, func() { c.MountHelper = running.MountHelper })
+	keep("autofs", c.Autofs, running.Autofs, func() { c.Autofs = running.Autofs })
+	keep("keytabRotation", c.KeytabRotation, running.KeytabRotation, func() { c.KeytabRotation = running.KeytabRotation })
+	keep("expiryAlerts", c.ExpiryAlerts, running.ExpiryAlerts, func() { c.ExpiryAlerts = running.ExpiryAlerts })
+	keep("mountStats", c.MountStats, running.MountStats, func() { c.MountStats = running.MountStats })
+	keep("gssProxy", c.GSSProxy, running.GSSProxy, func() { c.GSSProxy = running.GSSProxy })
+	keep("fast", c.FAST, running.FAST, func() { c.FAST = running.FAST })
+	keep("delegation", c.Delegation, running.Delegation, func() { c.Delegation = running.Delegation })
+	keep("scriptPath", c.ScriptPath, running.ScriptPath, func() { c.ScriptPath = running.ScriptPath })
+	keep("scriptPhases", c.ScriptPhases, running.ScriptPhases, func() { c.ScriptPhases = running.ScriptPhases })
+	keep("scriptTimeout", c.ScriptTimeout, running.ScriptTimeout, func() { c.ScriptTimeout = running.ScriptTimeout })
+	keep("scriptOutput", c.ScriptOutput, running.ScriptOutput, func() { c.ScriptOutput = running.ScriptOutput })
+	keep("helpers", c.Helpers, running.Helpers, func() { c.Helpers = running.Helpers })
+	keep("dns", c.DNS, running.DNS, func() { c.DNS = running.DNS })
+	keep("nodeCondition", c.NodeCondition, running.NodeCondition, func() { c.NodeCondition = running.NodeCondition })
+	keep("maxParallelSetups", c.MaxParallelSetups, running.MaxParallelSetups, func() { c.MaxParallelSetups = running.MaxParallelSetups })
+	keep("hookDirs", c.HookDirs, running.HookDirs, func() { c.HookDirs = running.HookDirs })
+	keep("runtime", c.Runtime, running.Runtime, func() { c.Runtime = running.Runtime })
+	keep("keytabDir", c.KeytabDir, running.KeytabDir, func() { c.KeytabDir = running.KeytabDir })
+	keep("keytabURL", c.KeytabURL, running.KeytabURL, func() { c.KeytabURL = running.KeytabURL })
+	keep("keytabRuntimeDir", c.KeytabRuntimeDir, running.KeytabRuntimeDir, func() { c.KeytabRuntimeDir = running.KeytabRuntimeDir })
+	keep("kubeconfig", c.Kubeconfig, running.Kubeconfig, func() { c.Kubeconfig = running.Kubeconfig })
+	keep("events", c.Events, running.Events, func() { c.Events = running.Events })
+	keep("ticketStatus", c.TicketStatus, running.TicketStatus, func() { c.TicketStatus = running.TicketStatus })
+	keep("podStatus", c.PodStatus, running.PodStatus, func() { c.PodStatus = running.PodStatus })
+	keep("namespaceRealmLabel", c.NamespaceRealmLabel, running.NamespaceRealmLabel, func() { c.NamespaceRealmLabel = running.NamespaceRealmLabel })
+	keep("namespaceDefaults", c.NamespaceDefaults, running.NamespaceDefaults, func() { c.NamespaceDefaults = running.NamespaceDefaults })
+	keep("kerberosIdentities", c.KerberosIdentities, running.KerberosIdentities, func() { c.KerberosIdentities = running.KerberosIdentities })
+	keep("spiffe.socket", c.SPIFFE.Socket, running.SPIFFE.Socket, func() { c.SPIFFE.Socket = running.SPIFFE.Socket })
+	keep("directory", c.Directory, running.Directory, func() { c.Directory = running.Directory })
+	keep("vault", c.Vault, running.Vault, func() { c.Vault = running.Vault })
+	keep("awsSecretsManager", c.AWSSecrets, running.AWSSecrets, func() { c.AWSSecrets = running.AWSSecrets })
+	keep("gcpSecretManager", c.GCPSecrets, running.GCPSecrets, func() { c.GCPSecrets = running.GCPSecrets })
+	keep("tokenBroker", c.TokenBroker, running.TokenBroker, func() { c.TokenBroker = running.TokenBroker })
+	keep("gmsa", c.GMSA, running.GMSA, func() { c.GMSA = running.GMSA })
+	keep("ephemeral", c.Ephemeral, running.Ephemeral, func() { c.Ephemeral = running.Ephemeral })
+	keep("prestage", c.Prestage, running.Prestage, func() { c.Prestage = running.Prestage })
+	keep("clockSkew", c.ClockSkew, running.ClockSkew, func() { c.ClockSkew = running.ClockSkew })
+	keep("sweep", c.Sweep, running.Sweep, func() { c.Sweep = running.Sweep })
+	keep("ccacheDir", c.CCacheDir, running.CCacheDir, func() { c.CCacheDir = running.CCacheDir })
+	keep("ccacheMountPath", c.CCacheMountPath, running.CCacheMountPath, func() { c.CCacheMountPath = running.CCacheMountPath })
+	keep("ccacheDirLayout", c.CCacheDirLayout, running.CCacheDirLayout, func() { c.CCacheDirLayout = running.CCacheDirLayout })
+	keep("ccacheMountPropagation", c.CCacheMountPropagation, running.CCacheMountPropagation, func() { c.CCacheMountPropagation = running.CCacheMountPropagation })
+	keep("podTmpfs", c.PodTmpfs, running.PodTmpfs, func() { c.PodTmpfs = running.PodTmpfs })
+	keep("appArmor", c.AppArmor, running.AppArmor, func() { c.AppArmor = running.AppArmor })
+	keep("stateFile", c.StateFile, running.StateFile, func() { c.StateFile = running.StateFile })
+	keep("dryRun", c.DryRun, running.DryRun, func() { c.DryRun = running.DryRun })
+
+	return changed
+}
+
+// A time.Duration which unmarshals from strings like "30s" or "5m".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: %w", string(data), err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	if v < 0 {
+		return fmt.Errorf("invalid duration %q: must not be negative", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+// Load the plugin configuration from a YAML file. An empty path, or a missing
+// file if optional is set, gives an empty configuration.
+func loadConfig(path string, optional bool) (*config, error) {
+	return loadConfigOver(nil, path, optional)
+}
+
+// Load the plugin configuration from a YAML file over the runtime options,
+// which only apply to settings the file leaves out.
+func loadConfigOver(opts *runtimeOptions, path string, optional bool) (*config, error) {
+	cfg := opts.config()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if optional && errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %q: %w", path, err)
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+	if err := validCCacheType(cfg.CCacheType); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: ccacheType: %w", path, err)
+	}
+	if err := validCCacheDirLayout(cfg.CCacheDirLayout); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: ccacheDirLayout: %w", path, err)
+	}
+	if err := validMountPropagation(cfg.CCacheMountPropagation); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: ccacheMountPropagation: %w", path, err)
+	}
+	if err := validSec(cfg.NFSSec); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: nfsSec: %w", path, err)
+	}
+	if err := validNFSVersion(cfg.NFSVersion); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: nfsVersion: %w", path, err)
+	}
+	if err := validNFSProto(cfg.NFSProto); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: nfsProto: %w", path, err)
+	}
+	if err := cfg.PrincipalTemplate.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: principalTemplate: %w", path, err)
+	}
+	if err := cfg.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: retry: %w", path, err)
+	}
+	if err := cfg.Policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: policy: %w", path, err)
+	}
+	if err := cfg.PodTmpfs.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: podTmpfs: %w", path, err)
+	}
+	if err := cfg.Checkpoint.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: checkpoint: %w", path, err)
+	}
+	if err := validSidecarImages(cfg.SidecarImages); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: sidecarImages: %w", path, err)
+	}
+	if err := cfg.Renewal.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: renewal: %w", path, err)
+	}
+	if err := cfg.QoS.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: qos: %w", path, err)
+	}
+	if err := cfg.StartGate.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: startGate: %w", path, err)
+	}
+	if err := cfg.NodeCondition.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: nodeCondition: %w", path, err)
+	}
+	if err := cfg.DNS.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: dns: %w", path, err)
+	}
+	if err := cfg.GMSA.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: gmsa: %w", path, err)
+	}
+	if err := cfg.Breaker.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: breaker: %w", path, err)
+	}
+	if err := cfg.CredentialSharing.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: credentialSharing: %w", path, err)
+	}
+	if err := cfg.Remediation.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: remediation: %w", path, err)
+	}
+	if err := cfg.Krb5Conf.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: krb5Conf: %w", path, err)
+	}
+	if err := cfg.Crypto.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: crypto: %w", path, err)
+	}
+	if err := cfg.Delegation.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: delegation: %w", path, err)
+	}
+	if err := cfg.CSI.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: csi: %w", path, err)
+	}
+	if err := cfg.Agent.Distribution.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: agent: distribution: %w", path, err)
+	}
+	if err := cfg.ActiveDirectory.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: activeDirectory: %w", path, err)
+	}
+	if err := cfg.KDCRateLimit.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: kdcRateLimit: %w", path, err)
+	}
+	if err := validateTrusts(cfg.Realms); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: realms: %w", path, err)
+	}
+	for name, r := range cfg.Realms {
+		if r.RateLimit == nil {
+			continue
+		}
+		if err := r.RateLimit.validate(); err != nil {
+			return nil, fmt.Errorf("invalid config file %q: realms: %s: rateLimit: %w", path, name, err)
+		}
+	}
+	if err := cfg.ScriptOutput.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: scriptOutput: %w", path, err)
+	}
+	if err := cfg.Helpers.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: helpers: %w", path, err)
+	}
+	if err := cfg.Reconnect.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: reconnect: %w", path, err)
+	}
+	if err := validDebugAddress(cfg.DebugAddress); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: debugAddress: %w", path, err)
+	}
+	if err := cfg.Admin.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: admin: %w", path, err)
+	}
+
+	return cfg, nil
+}
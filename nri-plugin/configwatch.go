@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Wait for writes to settle before reloading, editors and ConfigMap updates
+// produce bursts of events.
+const configReloadDelay = 500 * time.Millisecond
+
+// Watch the configuration file and call reload after it changes. The directory
+// is watched instead of the file since ConfigMap updates replace a symlink.
+func watchConfig(ctx context.Context, path string, reload func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to watch %q: %w", filepath.Dir(path), err)
+	}
+
+	go func() {
+		defer w.Close()
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// ..data is the symlink swapped by ConfigMap updates
+				if name := filepath.Base(ev.Name); name == filepath.Base(path) || name == "..data" {
+					pending = time.After(configReloadDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("config watcher: %v", err)
+			case <-pending:
+				pending = nil
+				reload()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Reload the configuration file, keeping the running configuration if it is invalid.
+func (p *plugin) reloadConfig(path string) {
+	cfg, err := loadConfigOver(p.runtimeOptions.Load(), path, false)
+	if err != nil {
+		log.Errorf("failed to reload configuration, keeping the running one: %v", err)
+		return
+	}
+	if changed := cfg.keepStartupSettings(p.config()); len(changed) > 0 {
+		log.Warnf("changes to %s take effect after restart", strings.Join(changed, ", "))
+	}
+	p.cfg.Store(cfg)
+	log.Infof("reloaded configuration from %q", path)
+	if cfg.IDMap.Manage {
+		if err := configureIDMap(context.Background(), p.exec, cfg); err != nil {
+			log.Errorf("failed to configure NFSv4 ID mapping: %v", err)
+		}
+	}
+}
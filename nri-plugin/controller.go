@@ -0,0 +1,210 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Condition types reported on KerberosIdentity status.
+const (
+	conditionValid    = "Valid"
+	conditionConflict = "Conflict"
+)
+
+// Run the cluster-scoped controller, which reports on each KerberosIdentity
+// whether it is valid and which namespaces it is in effect for. The NRI plugin
+// resolves identities the same way on its own, the status is for users. With
+// -provision it also creates the principals and keytabs of the pods, and with
+// -distribute delivers their keytabs to the agents of their nodes. With
+// -leader-elect only the replica holding the lease does any of it.
+func runController(args []string) {
+	var (
+		kubeconfig     string
+		provisionFile  string
+		distributeFile string
+		leaderElect    bool
+		leaseNamespace string
+		logOpts        logOptions
+	)
+
+	fs := flag.NewFlagSet("controller", flag.ExitOnError)
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig, in-cluster credentials are used if empty")
+	fs.StringVar(&provisionFile, "provision", "", "configuration of the provisioning of principals and keytabs, disabled if empty")
+	fs.StringVar(&distributeFile, "distribute", "", "configuration of the distribution of keytabs to node agents, disabled if empty")
+	fs.BoolVar(&leaderElect, "leader-elect", false, "run only while holding the lease of the controller, for running several replicas")
+	fs.StringVar(&leaseNamespace, "lease-namespace", cmp.Or(os.Getenv("POD_NAMESPACE"), "nri-kerberos"), "namespace of the lease of the controller")
+	logOpts.register(fs)
+	_ = fs.Parse(args)
+	if err := logOpts.apply(); err != nil {
+		log.Errorf("invalid logging options: %v", err)
+		os.Exit(1)
+	}
+
+	kube, err := newKubeClient(kubeconfig)
+	if err != nil {
+		log.Errorf("failed to set up Kubernetes API client: %v", err)
+		os.Exit(1)
+	}
+	if kube == nil {
+		log.Errorf("no Kubernetes API access, give -kubeconfig or run in a pod")
+		os.Exit(1)
+	}
+
+	var (
+		provCfg *provisionConfig
+		admin   kdcAdmin
+		distCfg *distributionConfig
+		signer  ed25519.PrivateKey
+	)
+	if provisionFile != "" {
+		if provCfg, err = loadProvisionConfig(provisionFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if admin, err = newKDCAdmin(provCfg.Backend, provCfg.Kadmin, provCfg.LDAP, nodeExec{}); err != nil {
+			log.Errorf("invalid provisioning config %q: %v", provisionFile, err)
+			os.Exit(1)
+		}
+	}
+	if distributeFile != "" {
+		if distCfg, signer, err = loadDistributionConfig(distributeFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	run := func(ctx context.Context) {
+		cache := newIdentityCache(kube)
+		trigger := make(chan struct{}, 1)
+		go cache.run(ctx, func() {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		})
+		if provCfg != nil {
+			prov := &provisioner{cfg: provCfg, kube: kube, ids: cache, admin: admin}
+			go prov.run(ctx)
+			log.Infof("provisioning principals of realm %s with %s", provCfg.Realm, provCfg.Backend)
+		}
+		if distCfg != nil {
+			dist := &keytabDistributor{cfg: distCfg, kube: kube, ids: cache, signer: signer}
+			go dist.run(ctx)
+			log.Infof("distributing keytabs to node agents at port %d", distCfg.port())
+		}
+
+		log.Infof("KerberosIdentity controller started")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+				reconcileIdentities(ctx, kube, cache.list())
+			}
+		}
+	}
+
+	if !leaderElect {
+		run(ctx)
+		return
+	}
+	elector := &leaderElector{
+		kube:      kube,
+		namespace: leaseNamespace,
+		name:      defaultLeaseName,
+		identity:  cmp.Or(os.Getenv("POD_NAME"), nodeName()),
+	}
+	elector.run(ctx, run)
+}
+
+// Update the status of every identity whose status is out of date.
+func reconcileIdentities(ctx context.Context, kube *kubeClient, ids []*kerberosIdentity) {
+	res := resolveIdentities(ids)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for _, id := range ids {
+		name := id.Metadata.Name
+		status := kerberosIdentityStatus{
+			ObservedGeneration: id.Metadata.Generation,
+			Namespaces:         res.namespacesOf(id),
+		}
+
+		valid := identityCondition{Type: conditionValid, Status: "True", Reason: "Valid"}
+		if err, ok := res.invalid[name]; ok {
+			valid = identityCondition{Type: conditionValid, Status: "False", Reason: "InvalidSpec", Message: err.Error()}
+		}
+		conflict := identityCondition{Type: conditionConflict, Status: "False", Reason: "NoConflict"}
+		if lost, ok := res.conflicts[name]; ok {
+			conflict = identityCondition{
+				Type:    conditionConflict,
+				Status:  "True",
+				Reason:  "NamespaceClaimed",
+				Message: "namespaces claimed by an older KerberosIdentity: " + strings.Join(lost, ", "),
+			}
+		}
+		for _, c := range []identityCondition{valid, conflict} {
+			status.Conditions = append(status.Conditions, mergeCondition(id.Status.Conditions, c, now))
+		}
+
+		if statusEqual(id.Status, status) {
+			continue
+		}
+
+		patch := map[string]any{"status": status}
+		path := identitiesPath + "/" + name + "/status"
+		if err := kube.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil); err != nil {
+			log.Errorf("failed to update status of %s: %v", id, err)
+			continue
+		}
+		log.Infof("%s: valid=%s, namespaces [%s]", id, valid.Status, strings.Join(status.Namespaces, ", "))
+	}
+}
+
+// Keep the transition time of a condition whose status did not change.
+func mergeCondition(old []identityCondition, c identityCondition, now time.Time) identityCondition {
+	c.LastTransitionTime = now
+	for _, o := range old {
+		if o.Type == c.Type && o.Status == c.Status {
+			c.LastTransitionTime = o.LastTransitionTime
+		}
+	}
+	return c
+}
+
+func statusEqual(a, b kerberosIdentityStatus) bool {
+	if a.ObservedGeneration != b.ObservedGeneration || !slices.Equal(a.Namespaces, b.Namespaces) {
+		return false
+	}
+	ja, _ := json.Marshal(a.Conditions)
+	jb, _ := json.Marshal(b.Conditions)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Sharing of the credentials of a principal by the pods of a namespace on the
+// node running as it, as the replicas of a service identity. A pod whose
+// principal already has managed credentials in the same credential cache,
+// obtained with the same lifetimes and options and valid for a while yet, is
+// given those rather than obtaining its own, and renewals are made once for
+// all of them. Pods of other namespaces obtain their own, with the keytab or
+// password of their namespace. The credentials, with the service tickets
+// rpc.gssd adds to them, are destroyed when the last pod using them goes, see
+// release.
+type credentialSharingConfig struct {
+	// Obtain credentials for each pod.
+	Disabled bool `json:"disabled,omitempty"`
+	// TGT lifetime left for credentials to be shared, 10m by default.
+	MinLifetime duration `json:"minLifetime,omitempty"`
+}
+
+func (c *credentialSharingConfig) validate() error {
+	if c.MinLifetime.Duration < 0 {
+		return fmt.Errorf("minLifetime %s is negative", c.MinLifetime.Duration)
+	}
+	return nil
+}
+
+func (c *credentialSharingConfig) minLifetime() time.Duration {
+	if c.MinLifetime.Duration > 0 {
+		return c.MinLifetime.Duration
+	}
+	return syncMinLifetime
+}
+
+// Whether credentials obtained with the parameters would be the same as with
+// those of others.
+func (kp *kerberosParams) sharesCredentials(other *kerberosParams) bool {
+	return kp.Principal() == other.Principal() && kp.CCName == other.CCName &&
+		kp.TicketLifetime == other.TicketLifetime && kp.RenewLifetime == other.RenewLifetime &&
+		kp.Forwardable == other.Forwardable && kp.HostFallback == other.HostFallback &&
+		kp.NFSRealm == other.NFSRealm && !kp.Issued && !other.Issued &&
+		(kp.Anonymous == nil) == (other.Anonymous == nil)
+}
+
+// Managed credentials of another pod of the namespace the parameters can
+// share, or nil. The credential cache must still hold a TGT of the principal
+// valid for the minimum lifetime.
+func (p *plugin) sharedCredentials(cfg *config, pod *api.PodSandbox, kp *kerberosParams) *managedCache {
+	if cfg.CredentialSharing.Disabled || kp.secondary() || kp.GSSProxy {
+		return nil
+	}
+	key := managedKey(pod, kp)
+	p.Lock()
+	var shared *managedCache
+	for k, mc := range p.managed {
+		if k != key && mc.pod.GetNamespace() == pod.GetNamespace() && kp.sharesCredentials(mc.params) {
+			shared = mc
+			break
+		}
+	}
+	p.Unlock()
+	if shared == nil {
+		return nil
+	}
+	if err := checkCCachePrincipal(kp.CCName, kp.Principal()); err != nil {
+		return nil
+	}
+	if checkCCache(kp.CCName, kp.Realm, p.clock.Now().Add(cfg.CredentialSharing.minLifetime())) != nil {
+		return nil
+	}
+	return shared
+}
+
+// Take over the credential sources of shared credentials, for renewals
+// obtaining them afresh to fetch them again as usual.
+func (kp *kerberosParams) shareSources(from *kerberosParams) {
+	kp.Keytab, kp.Password, kp.PKINIT = from.Keytab, from.Password, from.PKINIT
+}
+
+// Pods using the credential cache of the parameters, counting the one they are
+// tracked for.
+func (p *plugin) credentialUsers(kp *kerberosParams) int {
+	p.Lock()
+	defer p.Unlock()
+	n := 0
+	for _, mc := range p.managed {
+		if mc.params.CCName == kp.CCName {
+			n++
+		}
+	}
+	return n
+}
+
+// Whether credentials due for renewal were renewed for another pod sharing
+// them since they were last set up or renewed for this one, which leaves it
+// nothing to do until its next renewal.
+func (p *plugin) renewedByOther(l *logrus.Entry, mc *managedCache) bool {
+	kp := mc.params
+	if p.config().CredentialSharing.Disabled || p.credentialUsers(kp) < 2 {
+		return false
+	}
+	p.Lock()
+	used := mc.used
+	p.Unlock()
+	t, err := ccacheTimes(kp.CCName, kp.Realm)
+	if err != nil || !t.start.After(used) {
+		return false
+	}
+	l.Debugf("credentials for %s renewed for another pod sharing them at %s", kp.Principal(), t.start.Format(time.RFC3339))
+	return true
+}
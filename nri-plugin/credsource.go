@@ -0,0 +1,293 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/nri/pkg/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Pod annotation, without prefix, referencing a Secret holding the user keytab, as namespace/name or name.
+	keytabSecretAnnotation = "kerberos-keytab-secret"
+	// Pod annotation, without prefix, referencing a Secret holding the user password, as namespace/name or name.
+	passwordSecretAnnotation = "kerberos-password-secret"
+	// Node-local directory, normally on tmpfs, for keytabs fetched from credential sources.
+	defaultKeytabRuntimeDir = "/run/nri-kerberos/keytabs"
+
+	tmpfsMagic = 0x01021994
+)
+
+// Long-term credentials of a principal. Exactly one of Keytab, Password,
+// Certificate and CCache is set, Certificate with Key and possibly CA.
+type credential struct {
+	Keytab   []byte
+	Password string
+	// PEM X.509 certificate and key for PKINIT, and the CA of the KDC certificates.
+	Certificate []byte
+	Key         []byte
+	CA          []byte
+	// Credential cache holding a TGT already issued for the principal.
+	CCache []byte
+}
+
+// A source of long-term credentials for workloads, used instead of the keytab
+// the backend would otherwise obtain by itself.
+type credentialSource interface {
+	// Name of the source for log messages.
+	Name() string
+	// Fetch the credentials of the workload.
+	Fetch(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) (*credential, error)
+}
+
+// Pick the credential source for a pod, nil if the backend should obtain the keytab itself.
+func (p *plugin) credentialSource(pod *api.PodSandbox) credentialSource {
+	cfg := p.config()
+	if pod.GetAnnotations()[cfg.annotation(anonymousAnnotation)] == "true" {
+		return nil
+	}
+	if p.ephemeral != nil && pod.GetAnnotations()[cfg.annotation(ephemeralAnnotation)] == "true" {
+		return p.ephemeral
+	}
+	key := cfg.annotation(keytabSecretAnnotation)
+	if ref, ok := pod.GetAnnotations()[key]; ok {
+		return &secretSource{kube: p.kube, annotation: key, ref: ref}
+	}
+	key = cfg.annotation(passwordSecretAnnotation)
+	if ref, ok := pod.GetAnnotations()[key]; ok {
+		return &secretSource{kube: p.kube, annotation: key, ref: ref, password: true}
+	}
+	key = cfg.annotation(pkinitSecretAnnotation)
+	if ref, ok := pod.GetAnnotations()[key]; ok {
+		return &pkinitSecretSource{kube: p.kube, annotation: key, ref: ref}
+	}
+	if p.vault != nil && p.vault.handles(pod.GetNamespace()) {
+		return p.vault
+	}
+	if p.aws.handles(pod.GetNamespace()) {
+		return p.aws
+	}
+	if p.gcp.handles(pod.GetNamespace()) {
+		return p.gcp
+	}
+	if p.broker.handles(pod.GetNamespace()) {
+		return p.broker
+	}
+	if p.gmsa.handles(pod.GetNamespace()) {
+		return p.gmsa
+	}
+	if cfg.PKINIT.handles(pod.GetNamespace()) {
+		return &pkinitNodeSource{cfg: cfg.PKINIT}
+	}
+	return nil
+}
+
+// Fetch credentials from the source of the pod, storing a keytab in the
+// node-local keytab directory, and update the parameters accordingly.
+func (p *plugin) fetchCredentials(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) (err error) {
+	src := p.credentialSource(pod)
+	if src == nil {
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "fetchCredentials", principalAttributes(kp),
+		trace.WithAttributes(attribute.String("kerberos.credential_source", src.Name())))
+	defer func() { endSpan(span, err) }()
+
+	cred, err := src.Fetch(ctx, pod, kp)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", errKeytabUnavailable, src.Name(), err)
+	}
+
+	kp.Issued = len(cred.CCache) > 0
+	if kp.Issued {
+		return installIssuedCCache(kp, cred.CCache)
+	}
+
+	if cred.Password != "" {
+		kp.Password = cred.Password
+		return nil
+	}
+	if len(cred.Certificate) > 0 {
+		kp.PKINIT, err = p.storePodCertificate(pod, kp.User, cred)
+		return err
+	}
+
+	path, err := p.storePodKeytab(pod, kp.User, cred.Keytab)
+	if err != nil {
+		return err
+	}
+	kp.Keytab = path
+
+	return nil
+}
+
+// Store a keytab for a pod in the node-local keytab directory.
+func (p *plugin) storePodKeytab(pod *api.PodSandbox, user string, keytab []byte) (string, error) {
+	return p.storePodFile(pod, user+".keytab", keytab)
+}
+
+// Store a secret file for a pod in the node-local keytab directory.
+func (p *plugin) storePodFile(pod *api.PodSandbox, name string, data []byte) (string, error) {
+	dir := p.podKeytabDir(pod)
+	if err := p.makePodKeytabDir(pod); err != nil {
+		return "", fmt.Errorf("failed to create keytab directory: %w", err)
+	}
+	if !onTmpfs(dir) {
+		log.Warnf("keytab directory %q is not on tmpfs, keytabs will be written to disk", dir)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return path, nil
+}
+
+// Directory of the keytabs fetched for a pod.
+func (p *plugin) podKeytabDir(pod *api.PodSandbox) string {
+	return filepath.Join(p.keytabRuntimeDir(), pod.GetUid())
+}
+
+// Create the keytab directory of a pod, accessible to the plugin only.
+func (p *plugin) makePodKeytabDir(pod *api.PodSandbox) error {
+	tmpfs := p.config().PodTmpfs
+	return tmpfs.makeDir(p.podKeytabDir(pod), 0, 0)
+}
+
+// Directory of the pod keytab directories.
+func (p *plugin) keytabRuntimeDir() string {
+	if dir := p.config().KeytabRuntimeDir; dir != "" {
+		return dir
+	}
+	return defaultKeytabRuntimeDir
+}
+
+// Remove the keytabs fetched for a pod.
+func (p *plugin) removePodKeytabDir(pod *api.PodSandbox) error {
+	if pod.GetUid() == "" {
+		return nil
+	}
+	if err := removePodDir(p.podKeytabDir(pod)); err != nil {
+		return fmt.Errorf("failed to remove pod keytab directory: %w", err)
+	}
+	return nil
+}
+
+// Check whether path is on a tmpfs filesystem.
+func onTmpfs(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Type == tmpfsMagic
+}
+
+// Keytabs or passwords from a Kubernetes Secret referenced by a pod annotation.
+type secretSource struct {
+	kube       *kubeClient
+	annotation string
+	ref        string
+	// Whether the Secret holds a password, which is only kept in memory.
+	password bool
+}
+
+func (s *secretSource) Name() string {
+	if s.password {
+		return "password Secret " + s.ref
+	}
+	return "Secret " + s.ref
+}
+
+func (s *secretSource) Fetch(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) (*credential, error) {
+	if s.kube == nil {
+		return nil, fmt.Errorf("%s set but no Kubernetes API access configured", s.annotation)
+	}
+
+	namespace, name, found := strings.Cut(s.ref, "/")
+	if !found {
+		namespace, name = pod.GetNamespace(), s.ref
+	}
+	if namespace != pod.GetNamespace() {
+		return nil, fmt.Errorf("%s is not in the pod namespace %q", s.Name(), pod.GetNamespace())
+	}
+
+	data, err := s.kube.getSecretData(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if s.password {
+		password, err := secretPassword(data, kp.User)
+		if err != nil {
+			return nil, err
+		}
+		return &credential{Password: password}, nil
+	}
+	keytab, err := secretKeytab(data, kp.User)
+	if err != nil {
+		return nil, err
+	}
+
+	return &credential{Keytab: keytab}, nil
+}
+
+// Pick the keytab out of Secret data: the "keytab" key, "<user>.keytab" or the only key present.
+func secretKeytab(data map[string][]byte, user string) ([]byte, error) {
+	for _, key := range []string{"keytab", user + ".keytab"} {
+		if kt, ok := data[key]; ok {
+			return kt, nil
+		}
+	}
+	if len(data) == 1 {
+		for _, kt := range data {
+			return kt, nil
+		}
+	}
+	return nil, errors.New(`no "keytab" or "<user>.keytab" key`)
+}
+
+// Pick the password out of Secret data: the "password" key, "<user>.password"
+// or the only key present, without the line break files end with.
+func secretPassword(data map[string][]byte, user string) (string, error) {
+	pw, ok := data["password"]
+	if !ok {
+		pw, ok = data[user+".password"]
+	}
+	if !ok && len(data) == 1 {
+		for _, v := range data {
+			pw, ok = v, true
+		}
+	}
+	if !ok {
+		return "", errors.New(`no "password" or "<user>.password" key`)
+	}
+	password := strings.TrimRight(string(pw), "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
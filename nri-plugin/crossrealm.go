@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Another realm on the trust path of a workload, for its krb5.conf.
+type trustedRealm struct {
+	Name    string
+	KDCs    []string
+	Domains []string
+}
+
+// Check the cross-realm trusts of the realm table: the realm of the NFS
+// service principals of a realm and those on the trust path to it must be in
+// the table with their KDCs.
+func validateTrusts(realms map[string]realmConfig) error {
+	for name, r := range realms {
+		if r.NFSRealm == "" || r.NFSRealm == name {
+			if len(r.CAPaths[r.NFSRealm]) > 0 {
+				return fmt.Errorf("%s: capaths: trust path to the realm itself", name)
+			}
+			continue
+		}
+		for _, other := range append(slices.Clone(r.CAPaths[r.NFSRealm]), r.NFSRealm) {
+			if other == name {
+				return fmt.Errorf("%s: capaths: trust path to %s through the realm itself", name, r.NFSRealm)
+			}
+			if len(realms[other].KDCs) == 0 {
+				return fmt.Errorf("%s: realm %s of the trust path to %s has no kdcs", name, other, r.NFSRealm)
+			}
+		}
+	}
+	return nil
+}
+
+// Set the realm of the NFS service principals of the workload, and the trust
+// path to it, from the realm table.
+func (cfg *config) applyTrust(kp *kerberosParams) {
+	r := cfg.Realms[kp.Realm]
+	if r.NFSRealm == "" || r.NFSRealm == kp.Realm {
+		return
+	}
+	kp.NFSRealm, kp.TrustPath = r.NFSRealm, r.CAPaths[r.NFSRealm]
+	for _, name := range append(slices.Clone(kp.TrustPath), kp.NFSRealm) {
+		other := cfg.Realms[name]
+		kp.TrustRealms = append(kp.TrustRealms, trustedRealm{Name: name, KDCs: other.KDCs, Domains: other.Domains})
+	}
+}
+
+// Realm of the NFS service principals of the workload.
+func (kp *kerberosParams) serviceRealm() string {
+	if kp.NFSRealm != "" {
+		return kp.NFSRealm
+	}
+	return kp.Realm
+}
+
+// Realms from that of the workload to that of the NFS service principals,
+// the former alone without cross-realm trust.
+func (kp *kerberosParams) trustPath() []string {
+	path := []string{kp.Realm}
+	if kp.serviceRealm() == kp.Realm {
+		return path
+	}
+	return append(append(path, kp.TrustPath...), kp.NFSRealm)
+}
+
+// [capaths] of the krb5.conf of the workload: the intermediate realms to each
+// realm of its trust path, "." for those it trusts directly.
+func (kp *kerberosParams) capaths() map[string][]string {
+	path := kp.trustPath()
+	if len(path) == 1 {
+		return nil
+	}
+	capaths := map[string][]string{}
+	for i := 1; i < len(path); i++ {
+		capaths[path[i]] = slices.Clone(path[1:i])
+		if i == 1 {
+			capaths[path[i]] = []string{"."}
+		}
+	}
+	return capaths
+}
+
+// Obtain the cross-realm TGTs along the trust path of the workload with its
+// TGT, returning the TGT of the realm of the NFS service principals and the
+// cross-realm TGTs for the credential cache. A hop failing or referred
+// elsewhere fails with errTrustFailed.
+func crossRealmTGTs(cl *client.Client, kp *kerberosParams, tgt messages.Ticket, key types.EncryptionKey) (messages.Ticket, types.EncryptionKey, []*ccacheEntry, error) {
+	path := kp.trustPath()
+	var entries []*ccacheEntry
+	for i := 1; i < len(path); i++ {
+		from, to := path[i-1], path[i]
+		spn := types.PrincipalName{NameType: nametype.KRB_NT_SRV_INST, NameString: []string{"krbtgt", to}}
+		_, rep, err := cl.TGSREQGenerateAndExchange(spn, from, tgt, key, false)
+		if err != nil {
+			return tgt, key, nil, fmt.Errorf("%w: no TGT of %s from %s: %w", errTrustFailed, to, from, classifyKrbError(err))
+		}
+		if rep.Ticket.Realm != from {
+			return tgt, key, nil, fmt.Errorf("%w: TGT of %s from %s referred to %s", errTrustFailed, to, from, rep.Ticket.Realm)
+		}
+		entry, err := newCCacheEntry(rep.CRealm, rep.CName, rep.Ticket, rep.DecryptedEncPart)
+		if err != nil {
+			return tgt, key, nil, fmt.Errorf("%w: %w", errCCacheFailed, err)
+		}
+		entries = append(entries, entry)
+		tgt, key = rep.Ticket, rep.DecryptedEncPart.Key
+	}
+	return tgt, key, entries, nil
+}
+
+// Check the trust path of the workload with the TGT kinit obtained, the
+// cross-realm TGTs going into its credential cache.
+func kvnoTrustPath(ctx context.Context, ex Exec, kp *kerberosParams, path string) error {
+	realms := kp.trustPath()
+	if len(realms) == 1 {
+		return nil
+	}
+	last := realms[len(realms)-2]
+	tool, args := kp.krb5Tools(ex).serviceTicket("FILE:"+path, "krbtgt/"+kp.NFSRealm+"@"+last)
+	if err := runKrb5Tool(ctx, ex, kp, "", tool, args...); err != nil {
+		return fmt.Errorf("%w: no TGT of %s through %v: %w", errTrustFailed, kp.NFSRealm, realms, err)
+	}
+	return nil
+}
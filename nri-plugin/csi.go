@@ -0,0 +1,869 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultCSIDriverName = "nfs.kerberos.nri.io"
+	csiVendorVersion     = "v1alpha1"
+
+	csiIdentityService = "csi.v1.Identity"
+	csiNodeService     = "csi.v1.Node"
+
+	// NodeServiceCapability.RPC.Type of STAGE_UNSTAGE_VOLUME.
+	csiStageUnstageVolume = 1
+)
+
+// CSI node plugin mounting Kerberized NFS volumes, see runCSI.
+type csiConfig struct {
+	// Name of the driver, nfs.kerberos.nri.io by default.
+	DriverName string `json:"driverName,omitempty"`
+	// UNIX socket the kubelet connects to,
+	// /var/lib/kubelet/plugins/<driverName>/csi.sock by default.
+	Socket string `json:"socket,omitempty"`
+	// Directory the staged volumes are recorded in across restarts,
+	// /var/lib/kubelet/plugins/<driverName>/volumes by default.
+	StateDir string `json:"stateDir,omitempty"`
+}
+
+func (c *csiConfig) validate() error {
+	if c.DriverName != "" && (len(c.DriverName) > 63 || strings.Trim(c.DriverName, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "") {
+		return fmt.Errorf("driverName %q must be at most 63 lower case letters, digits, dots and dashes", c.DriverName)
+	}
+	return nil
+}
+
+func (c *csiConfig) driverName() string {
+	if c.DriverName != "" {
+		return c.DriverName
+	}
+	return defaultCSIDriverName
+}
+
+func (c *csiConfig) socket() string {
+	if c.Socket != "" {
+		return c.Socket
+	}
+	return filepath.Join("/var/lib/kubelet/plugins", c.driverName(), "csi.sock")
+}
+
+func (c *csiConfig) stateDir() string {
+	if c.StateDir != "" {
+		return c.StateDir
+	}
+	return filepath.Join("/var/lib/kubelet/plugins", c.driverName(), "volumes")
+}
+
+// Request or response of the CSI API without fields we use.
+type csiEmpty struct{}
+
+// GetPluginInfoResponse.
+type csiPluginInfo struct {
+	name, version string
+}
+
+// ProbeResponse, always ready.
+type csiProbe struct{}
+
+// NodeGetCapabilitiesResponse.
+type csiNodeCapabilities struct {
+	rpcs []uint64
+}
+
+// NodeGetInfoResponse.
+type csiNodeInfo struct {
+	nodeID string
+}
+
+// Mount VolumeCapability, block volumes are not supported.
+type csiVolumeCapability struct {
+	block      bool
+	mount      bool
+	mountFlags []string
+}
+
+// NodeStageVolumeRequest.
+type csiStageRequest struct {
+	volumeID      string
+	stagingPath   string
+	capability    csiVolumeCapability
+	secrets       map[string]string
+	volumeContext map[string]string
+}
+
+// NodeUnstageVolumeRequest.
+type csiUnstageRequest struct {
+	volumeID    string
+	stagingPath string
+}
+
+// NodePublishVolumeRequest.
+type csiPublishRequest struct {
+	volumeID    string
+	stagingPath string
+	targetPath  string
+	capability  csiVolumeCapability
+	readonly    bool
+}
+
+// NodeUnpublishVolumeRequest.
+type csiUnpublishRequest struct {
+	volumeID   string
+	targetPath string
+}
+
+// Codec for the few protobuf messages of the CSI spec we use, encoded by hand
+// as those of the SPIRE API are, see spiffeCodec, and tested against the
+// messages of csi.proto in csi_test.go.
+type csiCodec struct{}
+
+func (csiCodec) Name() string { return "proto" }
+
+func (csiCodec) Marshal(v any) ([]byte, error) {
+	var b []byte
+	switch m := v.(type) {
+	case *csiEmpty:
+	case *csiPluginInfo:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.name)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.version)
+	case *csiProbe:
+		// ready (1) -> google.protobuf.BoolValue value (1)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1))
+	case *csiNodeCapabilities:
+		// capabilities (1) -> rpc (1) -> type (1)
+		for _, rpc := range m.rpcs {
+			t := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), rpc)
+			c := protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), t)
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, c)
+		}
+	case *csiNodeInfo:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.nodeID)
+	default:
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+	return b, nil
+}
+
+func (csiCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *csiEmpty:
+		return nil
+	case *csiStageRequest:
+		m.secrets, m.volumeContext = map[string]string{}, map[string]string{}
+		return protoMessage(data, map[protowire.Number]func([]byte) error{
+			1: protoString(&m.volumeID),
+			3: protoString(&m.stagingPath),
+			4: m.capability.decode,
+			5: protoMapEntry(m.secrets),
+			6: protoMapEntry(m.volumeContext),
+		})
+	case *csiUnstageRequest:
+		return protoMessage(data, map[protowire.Number]func([]byte) error{
+			1: protoString(&m.volumeID),
+			2: protoString(&m.stagingPath),
+		})
+	case *csiPublishRequest:
+		var err error
+		if m.readonly, err = protoBool(data, 6); err != nil {
+			return err
+		}
+		return protoMessage(data, map[protowire.Number]func([]byte) error{
+			1: protoString(&m.volumeID),
+			3: protoString(&m.stagingPath),
+			4: protoString(&m.targetPath),
+			5: m.capability.decode,
+		})
+	case *csiUnpublishRequest:
+		return protoMessage(data, map[protowire.Number]func([]byte) error{
+			1: protoString(&m.volumeID),
+			2: protoString(&m.targetPath),
+		})
+	}
+	return fmt.Errorf("cannot decode %T", v)
+}
+
+// Decode a VolumeCapability: block (1), or mount (2) with its mount_flags (2).
+func (c *csiVolumeCapability) decode(b []byte) error {
+	return protoMessage(b, map[protowire.Number]func([]byte) error{
+		1: func([]byte) error { c.block = true; return nil },
+		2: func(mount []byte) error {
+			c.mount = true
+			return protoFields(mount, 2, func(flag []byte) error {
+				c.mountFlags = append(c.mountFlags, string(flag))
+				return nil
+			})
+		},
+	})
+}
+
+// Call the function of its number with each length-delimited field of a
+// protobuf message, skipping fields without one.
+func protoMessage(b []byte, fields map[protowire.Number]func([]byte) error) error {
+	for num, fn := range fields {
+		if err := protoFields(b, num, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decoder of a string field.
+func protoString(s *string) func([]byte) error {
+	return func(b []byte) error {
+		*s = string(b)
+		return nil
+	}
+}
+
+// Decoder of an entry of a map<string, string> field: key (1), value (2).
+func protoMapEntry(m map[string]string) func([]byte) error {
+	return func(b []byte) error {
+		var key, value string
+		err := protoFields(b, 1, protoString(&key))
+		if err == nil {
+			err = protoFields(b, 2, protoString(&value))
+		}
+		m[key] = value
+		return err
+	}
+}
+
+// Value of a bool field of the number in a protobuf message, false if unset.
+func protoBool(b []byte, num protowire.Number) (bool, error) {
+	var value bool
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return false, protowire.ParseError(l)
+		}
+		b = b[l:]
+		if n == num && typ == protowire.VarintType {
+			v, l := protowire.ConsumeVarint(b)
+			if l < 0 {
+				return false, protowire.ParseError(l)
+			}
+			value = v != 0
+			b = b[l:]
+			continue
+		}
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if l < 0 {
+			return false, protowire.ParseError(l)
+		}
+		b = b[l:]
+	}
+	return value, nil
+}
+
+// Method of a CSI service, decoding its request as a Req.
+func csiMethod[Req any](service, name string, fn func(*csiNode, context.Context, *Req) (any, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			call := func(ctx context.Context, req any) (any, error) {
+				return fn(srv.(*csiNode), ctx, req.(*Req))
+			}
+			if interceptor == nil {
+				return call(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + service + "/" + name}
+			return interceptor(ctx, req, info, call)
+		},
+	}
+}
+
+var csiIdentityDesc = grpc.ServiceDesc{
+	ServiceName: csiIdentityService,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		csiMethod(csiIdentityService, "GetPluginInfo", func(d *csiNode, _ context.Context, _ *csiEmpty) (any, error) {
+			return &csiPluginInfo{name: d.cfg.CSI.driverName(), version: csiVendorVersion}, nil
+		}),
+		csiMethod(csiIdentityService, "GetPluginCapabilities", func(*csiNode, context.Context, *csiEmpty) (any, error) {
+			// Node service only, there is no controller.
+			return &csiEmpty{}, nil
+		}),
+		csiMethod(csiIdentityService, "Probe", func(*csiNode, context.Context, *csiEmpty) (any, error) {
+			return &csiProbe{}, nil
+		}),
+	},
+}
+
+var csiNodeDesc = grpc.ServiceDesc{
+	ServiceName: csiNodeService,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		csiMethod(csiNodeService, "NodeGetCapabilities", func(*csiNode, context.Context, *csiEmpty) (any, error) {
+			return &csiNodeCapabilities{rpcs: []uint64{csiStageUnstageVolume}}, nil
+		}),
+		csiMethod(csiNodeService, "NodeGetInfo", func(d *csiNode, _ context.Context, _ *csiEmpty) (any, error) {
+			return &csiNodeInfo{nodeID: d.nodeID}, nil
+		}),
+		csiMethod(csiNodeService, "NodeStageVolume", (*csiNode).stage),
+		csiMethod(csiNodeService, "NodeUnstageVolume", (*csiNode).unstage),
+		csiMethod(csiNodeService, "NodePublishVolume", (*csiNode).publish),
+		csiMethod(csiNodeService, "NodeUnpublishVolume", (*csiNode).unpublish),
+	},
+}
+
+// A volume staged on the node, as recorded in the state directory.
+type csiVolume struct {
+	ID          string          `json:"id"`
+	StagingPath string          `json:"stagingPath"`
+	Source      string          `json:"source"`
+	Params      *kerberosParams `json:"params"`
+}
+
+// CSI node plugin. Volumes are staged by obtaining the credentials of their
+// principal and a service ticket of their NFS server first, and only then
+// mounting the export at the staging path with its security flavor; pods
+// get bind mounts of the staging path. Unstaging the last volume of a
+// credential cache destroys the credentials.
+type csiNode struct {
+	cfg     *config
+	nodeID  string
+	backend KerberosBackend
+	mounter Mounter
+	clock   Clock
+	// Renewals of the credentials of staged volumes, by volume id.
+	renewals *cleaner
+
+	sync.Mutex
+	volumes map[string]*csiVolume
+	// Volumes with an operation in progress.
+	pending map[string]bool
+}
+
+// Start an operation on a volume, failing if one is in progress already as
+// the CSI spec asks for.
+func (d *csiNode) begin(id string) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.pending[id] {
+		return status.Errorf(codes.Aborted, "operation pending for volume %s", id)
+	}
+	d.pending[id] = true
+	return nil
+}
+
+func (d *csiNode) end(id string) {
+	d.Lock()
+	delete(d.pending, id)
+	d.Unlock()
+}
+
+// Parameters of the principal a volume is accessed as, from its volume
+// attributes and node stage Secret: user and uid, and optionally realm,
+// gid, kdc, sec and nfsVersion, with server and share naming the export.
+func (d *csiNode) volumeParams(ctx context.Context, req *csiStageRequest) (*kerberosParams, string, error) {
+	vc := req.volumeContext
+	if vc["server"] == "" || !strings.HasPrefix(vc["share"], "/") {
+		return nil, "", errors.New("server and share volume attributes are required")
+	}
+	if err := validateUser(vc["user"]); err != nil {
+		return nil, "", fmt.Errorf("user volume attribute: %w", err)
+	}
+	uid, err := strconv.ParseUint(vc["uid"], 10, 32)
+	if err != nil || uid == 0 {
+		return nil, "", fmt.Errorf("uid volume attribute must be a positive number, not %q", vc["uid"])
+	}
+	gid := uid
+	if vc["gid"] != "" {
+		if gid, err = strconv.ParseUint(vc["gid"], 10, 32); err != nil || gid == 0 {
+			return nil, "", fmt.Errorf("gid volume attribute must be a positive number, not %q", vc["gid"])
+		}
+	}
+	realm := cmp.Or(vc["realm"], d.cfg.DefaultRealm)
+	if realm == "" {
+		return nil, "", errors.New("realm volume attribute required without defaultRealm")
+	}
+
+	kp := nodeParams(ctx, d.cfg, vc["user"], realm)
+	kp.UID, kp.GID, kp.FSID = uid, gid, gid
+	kp.CCName = hostCCName(uid)
+	kp.NFS, kp.NFSServers = vc["server"], nil
+	if vc["kdc"] != "" {
+		kp.KDC, kp.KDCs = vc["kdc"], nil
+	}
+	if kp.KDC == "" {
+		return nil, "", fmt.Errorf("no KDC of realm %s, set the kdc volume attribute", realm)
+	}
+	if kp.Sec = cmp.Or(vc["sec"], kp.Sec, "krb5"); validSec(kp.Sec) != nil {
+		return nil, "", fmt.Errorf("sec volume attribute must be krb5, krb5i or krb5p, not %q", kp.Sec)
+	}
+	if kp.NFSVersion = cmp.Or(vc["nfsVersion"], kp.NFSVersion); validNFSVersion(kp.NFSVersion) != nil {
+		return nil, "", validNFSVersion(kp.NFSVersion)
+	}
+	if _, ok := req.secrets["password"]; ok {
+		data := map[string][]byte{}
+		for k, v := range req.secrets {
+			data[k] = []byte(v)
+		}
+		if kp.Password, err = secretPassword(data, kp.User); err != nil {
+			return nil, "", fmt.Errorf("node stage Secret: %w", err)
+		}
+	}
+	return kp, nfsSource(kp.NFS, vc["share"]), nil
+}
+
+func (d *csiNode) stage(ctx context.Context, req *csiStageRequest) (any, error) {
+	switch {
+	case req.volumeID == "" || req.stagingPath == "":
+		return nil, status.Error(codes.InvalidArgument, "volume id and staging path are required")
+	case req.capability.block || !req.capability.mount:
+		return nil, status.Error(codes.InvalidArgument, "only mount volumes are supported")
+	}
+	if err := d.begin(req.volumeID); err != nil {
+		return nil, err
+	}
+	defer d.end(req.volumeID)
+
+	kp, source, err := d.volumeParams(ctx, req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	d.Lock()
+	staged, ok := d.volumes[req.volumeID]
+	var other *csiVolume
+	for _, v := range d.volumes {
+		if v.ID != req.volumeID && v.Params.CCName == kp.CCName && v.Params.Principal() != kp.Principal() {
+			other = v
+		}
+	}
+	d.Unlock()
+	if ok && staged.StagingPath == req.stagingPath && staged.Source == source && d.mounted(staged.StagingPath) {
+		return &csiEmpty{}, nil
+	}
+	if other != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "uid %d has credentials of %s for volume %s, not of %s",
+			kp.UID, other.Params.Principal(), other.ID, kp.Principal())
+	}
+	if keytab, ok := req.secrets["keytab"]; ok {
+		if kp.Keytab, err = d.storeKeytab(req.volumeID, []byte(keytab)); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	l := log.WithField("volume", req.volumeID)
+	ctx = withLogger(ctx, l)
+	v := &csiVolume{ID: req.volumeID, StagingPath: req.stagingPath, Source: source, Params: kp}
+	if err := d.backend.Setup(ctx, kp); err != nil {
+		l.Errorf("failed to set up credentials for %s: %v", kp.Principal(), err)
+		d.release(ctx, v)
+		return nil, agentStatus(err)
+	}
+	if err := d.serviceTicket(kp); err != nil {
+		l.Error(err)
+		d.release(ctx, v)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	options := []string{"sec=" + kp.Sec}
+	if kp.NFSVersion != "" {
+		options = append(options, "vers="+kp.NFSVersion)
+	}
+	for _, flag := range req.capability.mountFlags {
+		if !strings.HasPrefix(flag, "sec=") && !strings.HasPrefix(flag, "vers=") {
+			options = append(options, flag)
+		}
+	}
+	err = os.MkdirAll(req.stagingPath, 0750)
+	if err == nil {
+		err = d.mounter.Mount(ctx, "nfs", source, req.stagingPath, options)
+	}
+	if err == nil {
+		err = d.record(v)
+	}
+	if err != nil {
+		l.Errorf("failed to mount %s at %s: %v", source, req.stagingPath, err)
+		_ = d.mounter.Unmount(req.stagingPath)
+		d.release(ctx, v)
+		return nil, mountStatus(err)
+	}
+	l.Infof("staged %s at %s with credentials of %s", source, req.stagingPath, kp.Principal())
+	d.scheduleRenewal(v)
+	return &csiEmpty{}, nil
+}
+
+// Mount failure classes and the status codes reporting them to the kubelet.
+var mountErrorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{errMountDenied, codes.PermissionDenied},
+	{errMountCredentials, codes.Unauthenticated},
+	{errMountNotPermitted, codes.PermissionDenied},
+	{errMountNotExported, codes.NotFound},
+	{errMountOptions, codes.InvalidArgument},
+	{errMountTimeout, codes.DeadlineExceeded},
+	{errNFSUnreachable, codes.Unavailable},
+	{errNFSVersion, codes.FailedPrecondition},
+}
+
+// Convert an error staging a volume to a status error of its mount failure
+// class.
+func mountStatus(err error) error {
+	for _, c := range mountErrorCodes {
+		if errors.Is(err, c.err) {
+			return status.Error(c.code, err.Error())
+		}
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (d *csiNode) unstage(ctx context.Context, req *csiUnstageRequest) (any, error) {
+	if req.volumeID == "" || req.stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and staging path are required")
+	}
+	if err := d.begin(req.volumeID); err != nil {
+		return nil, err
+	}
+	defer d.end(req.volumeID)
+
+	if err := d.mounter.Unmount(req.stagingPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount %s: %v", req.stagingPath, err)
+	}
+	d.Lock()
+	v, ok := d.volumes[req.volumeID]
+	d.Unlock()
+	if !ok {
+		return &csiEmpty{}, nil
+	}
+	l := log.WithField("volume", req.volumeID)
+	d.renewals.Cancel(req.volumeID)
+	d.release(withLogger(ctx, l), v)
+	l.Infof("unstaged %s from %s", v.Source, req.stagingPath)
+	return &csiEmpty{}, nil
+}
+
+func (d *csiNode) publish(ctx context.Context, req *csiPublishRequest) (any, error) {
+	switch {
+	case req.volumeID == "" || req.targetPath == "":
+		return nil, status.Error(codes.InvalidArgument, "volume id and target path are required")
+	case req.stagingPath == "":
+		return nil, status.Error(codes.FailedPrecondition, "volume is not staged")
+	case req.capability.block || !req.capability.mount:
+		return nil, status.Error(codes.InvalidArgument, "only mount volumes are supported")
+	}
+	if d.mounted(req.targetPath) {
+		return &csiEmpty{}, nil
+	}
+	options := []string{"bind"}
+	if req.readonly {
+		options = append(options, "ro")
+	}
+	err := os.MkdirAll(req.targetPath, 0750)
+	if err == nil {
+		err = d.mounter.Mount(ctx, "none", req.stagingPath, req.targetPath, options)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to bind mount %s at %s: %v", req.stagingPath, req.targetPath, err)
+	}
+	return &csiEmpty{}, nil
+}
+
+func (d *csiNode) unpublish(_ context.Context, req *csiUnpublishRequest) (any, error) {
+	if req.volumeID == "" || req.targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and target path are required")
+	}
+	if err := d.mounter.Unmount(req.targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount %s: %v", req.targetPath, err)
+	}
+	if err := os.Remove(req.targetPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.Internal, "failed to remove %s: %v", req.targetPath, err)
+	}
+	return &csiEmpty{}, nil
+}
+
+// Whether something is mounted at a path.
+func (d *csiNode) mounted(path string) bool {
+	mounts, err := d.mounter.Mounts()
+	if err != nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	return slices.ContainsFunc(mounts, func(m *hostMount) bool { return m.mountPoint == path })
+}
+
+// Check the credential cache of a volume holds a valid service ticket of its
+// NFS server, under any of the names of its service principal.
+func (d *csiNode) serviceTicket(kp *kerberosParams) error {
+	entries, err := readCCache(kp.CCName)
+	if err != nil {
+		return err
+	}
+	names := kp.canonicalServices(context.Background())[0]
+	for _, e := range entries {
+		if slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, e.server.PrincipalNameString()) }) && e.endTime.After(d.clock.Now()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no service ticket of %s for %s in %s", names[len(names)-1], kp.Principal(), kp.CCName)
+}
+
+// File recording a staged volume, by a hash of its id, which may hold any
+// characters.
+func (d *csiNode) stateFile(id string, ext string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(d.cfg.CSI.stateDir(), hex.EncodeToString(sum[:8])+ext)
+}
+
+// Store the keytab of a volume given by its node stage Secret.
+func (d *csiNode) storeKeytab(id string, keytab []byte) (string, error) {
+	path := d.stateFile(id, ".keytab")
+	if err := os.WriteFile(path, keytab, 0600); err != nil {
+		return "", fmt.Errorf("failed to write keytab: %w", err)
+	}
+	return path, nil
+}
+
+// Record a staged volume, without the password of its principal, which is
+// only kept in memory.
+func (d *csiNode) record(v *csiVolume) error {
+	kp := *v.Params
+	kp.Password = ""
+	data, err := json.Marshal(&csiVolume{ID: v.ID, StagingPath: v.StagingPath, Source: v.Source, Params: &kp})
+	if err == nil {
+		err = os.WriteFile(d.stateFile(v.ID, ".json"), data, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record volume: %w", err)
+	}
+	d.Lock()
+	d.volumes[v.ID] = v
+	d.Unlock()
+	return nil
+}
+
+// Forget a volume, destroying its credentials unless another staged volume
+// shares the credential cache.
+func (d *csiNode) release(ctx context.Context, v *csiVolume) {
+	d.Lock()
+	delete(d.volumes, v.ID)
+	shared := false
+	for _, o := range d.volumes {
+		shared = shared || o.Params.CCName == v.Params.CCName
+	}
+	d.Unlock()
+	for _, ext := range []string{".json", ".keytab"} {
+		if err := os.Remove(d.stateFile(v.ID, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			loggerFrom(ctx).Warn(err)
+		}
+	}
+	if shared {
+		return
+	}
+	if err := d.backend.Destroy(ctx, v.Params); err != nil {
+		loggerFrom(ctx).Warnf("failed to destroy credentials of %s: %v", v.Params.Principal(), err)
+	}
+}
+
+// Load the volumes staged before a restart and schedule the renewals of
+// their credentials.
+func (d *csiNode) load() error {
+	paths, err := filepath.Glob(filepath.Join(d.cfg.CSI.stateDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		v := &csiVolume{}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, v)
+		}
+		if err != nil || v.Params == nil {
+			log.Warnf("ignoring staged volume %s: %v", path, err)
+			continue
+		}
+		d.volumes[v.ID] = v
+		d.scheduleRenewal(v)
+	}
+	log.Infof("%d staged volumes", len(d.volumes))
+	return nil
+}
+
+// Schedule the renewal of the credentials of a staged volume at the
+// configured fraction of the lifetime of its ticket.
+func (d *csiNode) scheduleRenewal(v *csiVolume) {
+	delay := defaultRenewalInterval
+	if t, err := ccacheTimes(v.Params.CCName, v.Params.Realm); err == nil {
+		lifetime := t.end.Sub(t.start)
+		delay = t.start.Add(time.Duration(float64(lifetime) * d.cfg.Renewal.renewalFraction(v.ID))).Sub(d.clock.Now())
+	}
+	d.renewals.Schedule(v.ID, max(delay, minRenewalDelay), func() { d.renew(v) })
+}
+
+// Renew the credentials of a staged volume, obtaining them afresh when they
+// cannot be renewed any further or were lost.
+func (d *csiNode) renew(v *csiVolume) {
+	l := subsystemLogger(log.WithField("volume", v.ID), subsystemRenew)
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), l), d.cfg.setupTimeout())
+	defer cancel()
+
+	kp := v.Params
+	var err error
+	renewable := d.renewable(kp)
+	if renewable {
+		err = d.backend.Renew(ctx, kp)
+	}
+	if !renewable || credentialsLost(err) {
+		if err != nil {
+			l.Warnf("renewal of credentials for %s failed (%s), obtaining them afresh", kp.Principal(), failureReason(err))
+		}
+		err = d.backend.Setup(ctx, kp)
+	}
+	if err != nil {
+		retry := d.cfg.Renewal.retryInterval()
+		l.Errorf("renewal of credentials for %s failed, retrying in %s: %v", kp.Principal(), retry, err)
+		d.renewals.Schedule(v.ID, retry, func() { d.renew(v) })
+		return
+	}
+	l.Debugf("renewed credentials for %s", kp.Principal())
+	d.scheduleRenewal(v)
+}
+
+// Whether the TGT of the credentials can still be renewed.
+func (d *csiNode) renewable(kp *kerberosParams) bool {
+	t, err := ccacheTimes(kp.CCName, kp.Realm)
+	return err == nil && t.renewTill.After(d.clock.Now().Add(minRenewalDelay))
+}
+
+// Run the CSI node plugin, serving the Identity and Node services at a UNIX
+// socket for the kubelet, registered with it by the node-driver-registrar.
+func runCSI(args []string) {
+	var (
+		configFile, nodeID string
+		logOpts            logOptions
+	)
+
+	fs := flag.NewFlagSet("csi", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", defaultConfigFile, "path to the plugin configuration file")
+	fs.StringVar(&nodeID, "node", os.Getenv("NODE_NAME"), "name of the node, the host name by default")
+	logOpts.register(fs)
+	_ = fs.Parse(args)
+	if err := logOpts.apply(); err != nil {
+		log.Errorf("invalid logging options: %v", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(configFile, configFile == defaultConfigFile)
+	if err != nil {
+		log.Errorf("failed to load plugin configuration: %v", err)
+		os.Exit(1)
+	}
+	if nodeID == "" {
+		if nodeID, err = os.Hostname(); err != nil {
+			log.Errorf("failed to get host name: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := setupHelpers(cfg.Helpers); err != nil {
+		log.Errorf("failed to set up helper limits: %v", err)
+		os.Exit(1)
+	}
+	setupResolvers(cfg.DNS)
+	backend, err := newBackend(cfg, nodeExec{}, systemClock{})
+	if err != nil {
+		log.Errorf("failed to set up Kerberos backend: %v", err)
+		os.Exit(1)
+	}
+	d := &csiNode{
+		cfg:      cfg,
+		nodeID:   nodeID,
+		backend:  newSharedBackend(&instrumentedBackend{backend}, cfg.MaxParallelSetups),
+		mounter:  nodeMounter{exec: nodeExec{}, helper: cfg.MountHelper},
+		clock:    systemClock{},
+		renewals: newCleaner(systemClock{}),
+		volumes:  map[string]*csiVolume{},
+		pending:  map[string]bool{},
+	}
+	if err := os.MkdirAll(cfg.CSI.stateDir(), 0700); err != nil {
+		log.Errorf("failed to create state directory: %v", err)
+		os.Exit(1)
+	}
+	if err := d.load(); err != nil {
+		log.Errorf("failed to load staged volumes: %v", err)
+		os.Exit(1)
+	}
+
+	socket := cfg.CSI.socket()
+	if err := os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		log.Errorf("failed to create socket directory: %v", err)
+		os.Exit(1)
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("failed to remove stale socket: %v", err)
+		os.Exit(1)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Errorf("failed to listen at %s: %v", socket, err)
+		os.Exit(1)
+	}
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(csiCodec{}))
+	srv.RegisterService(&csiIdentityDesc, d)
+	srv.RegisterService(&csiNodeDesc, d)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+		d.renewals.Stop()
+	}()
+
+	log.Infof("CSI driver %s serving at %s on node %s", cfg.CSI.driverName(), socket, nodeID)
+	if err := srv.Serve(l); err != nil {
+		log.Errorf("CSI driver failed: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The messages of csi.proto of the CSI spec v1 csiCodec encodes and decodes,
+// with their field numbers and types, since the generated bindings are not
+// a dependency.
+const csiProto = `
+name: "csi.proto"
+package: "csi.v1"
+dependency: "google/protobuf/wrappers.proto"
+syntax: "proto3"
+message_type: {
+  name: "GetPluginInfoResponse"
+  field: { name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "vendor_version" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "manifest" number: 3 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.GetPluginInfoResponse.ManifestEntry" }
+  nested_type: {
+    name: "ManifestEntry"
+    field: { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options: { map_entry: true }
+  }
+}
+message_type: {
+  name: "ProbeResponse"
+  field: { name: "ready" number: 1 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.BoolValue" }
+}
+message_type: {
+  name: "NodeServiceCapability"
+  field: { name: "rpc" number: 1 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".csi.v1.NodeServiceCapability.RPC" oneof_index: 0 }
+  nested_type: {
+    name: "RPC"
+    field: { name: "type" number: 1 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".csi.v1.NodeServiceCapability.RPC.Type" }
+    enum_type: {
+      name: "Type"
+      value: { name: "UNKNOWN" number: 0 }
+      value: { name: "STAGE_UNSTAGE_VOLUME" number: 1 }
+      value: { name: "GET_VOLUME_STATS" number: 2 }
+      value: { name: "EXPAND_VOLUME" number: 3 }
+    }
+  }
+  oneof_decl: { name: "type" }
+}
+message_type: {
+  name: "NodeGetCapabilitiesResponse"
+  field: { name: "capabilities" number: 1 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.NodeServiceCapability" }
+}
+message_type: {
+  name: "NodeGetInfoResponse"
+  field: { name: "node_id" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "max_volumes_per_node" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64 }
+}
+message_type: {
+  name: "VolumeCapability"
+  field: { name: "block" number: 1 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".csi.v1.VolumeCapability.BlockVolume" oneof_index: 0 }
+  field: { name: "mount" number: 2 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".csi.v1.VolumeCapability.MountVolume" oneof_index: 0 }
+  field: { name: "access_mode" number: 3 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".csi.v1.VolumeCapability.AccessMode" }
+  nested_type: { name: "BlockVolume" }
+  nested_type: {
+    name: "MountVolume"
+    field: { name: "fs_type" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "mount_flags" number: 2 label: LABEL_REPEATED type: TYPE_STRING }
+    field: { name: "volume_mount_group" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  }
+  nested_type: {
+    name: "AccessMode"
+    field: { name: "mode" number: 1 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".csi.v1.VolumeCapability.AccessMode.Mode" }
+    enum_type: {
+      name: "Mode"
+      value: { name: "UNKNOWN" number: 0 }
+      value: { name: "SINGLE_NODE_WRITER" number: 1 }
+      value: { name: "MULTI_NODE_MULTI_WRITER" number: 5 }
+    }
+  }
+  oneof_decl: { name: "access_type" }
+}
+message_type: {
+  name: "NodeStageVolumeRequest"
+  field: { name: "volume_id" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "publish_context" number: 2 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.NodeStageVolumeRequest.PublishContextEntry" }
+  field: { name: "staging_target_path" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "volume_capability" number: 4 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".csi.v1.VolumeCapability" }
+  field: { name: "secrets" number: 5 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.NodeStageVolumeRequest.SecretsEntry" }
+  field: { name: "volume_context" number: 6 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.NodeStageVolumeRequest.VolumeContextEntry" }
+  nested_type: {
+    name: "PublishContextEntry"
+    field: { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options: { map_entry: true }
+  }
+  nested_type: {
+    name: "SecretsEntry"
+    field: { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options: { map_entry: true }
+  }
+  nested_type: {
+    name: "VolumeContextEntry"
+    field: { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options: { map_entry: true }
+  }
+}
+message_type: {
+  name: "NodeUnstageVolumeRequest"
+  field: { name: "volume_id" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "staging_target_path" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+message_type: {
+  name: "NodePublishVolumeRequest"
+  field: { name: "volume_id" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "publish_context" number: 2 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.NodePublishVolumeRequest.PublishContextEntry" }
+  field: { name: "staging_target_path" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "target_path" number: 4 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "volume_capability" number: 5 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".csi.v1.VolumeCapability" }
+  field: { name: "readonly" number: 6 label: LABEL_OPTIONAL type: TYPE_BOOL }
+  field: { name: "secrets" number: 7 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.NodePublishVolumeRequest.SecretsEntry" }
+  field: { name: "volume_context" number: 8 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".csi.v1.NodePublishVolumeRequest.VolumeContextEntry" }
+  nested_type: {
+    name: "PublishContextEntry"
+    field: { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options: { map_entry: true }
+  }
+  nested_type: {
+    name: "SecretsEntry"
+    field: { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options: { map_entry: true }
+  }
+  nested_type: {
+    name: "VolumeContextEntry"
+    field: { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field: { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options: { map_entry: true }
+  }
+}
+message_type: {
+  name: "NodeUnpublishVolumeRequest"
+  field: { name: "volume_id" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field: { name: "target_path" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+`
+
+// Descriptor of csiProto, built once for messages to compare equal.
+var csiFile = sync.OnceValues(func() (protoreflect.FileDescriptor, error) {
+	fdp := &descriptorpb.FileDescriptorProto{}
+	if err := prototext.Unmarshal([]byte(csiProto), fdp); err != nil {
+		return nil, err
+	}
+	return protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+})
+
+// Empty message of csi.proto of the name.
+func csiMessage(t *testing.T, name string) *dynamicpb.Message {
+	t.Helper()
+	fd, err := csiFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := fd.Messages().ByName(protoreflect.Name(name))
+	if md == nil {
+		t.Fatalf("no message %s", name)
+	}
+	return dynamicpb.NewMessage(md)
+}
+
+// Message of csi.proto of the name from its JSON.
+func csiMessageJSON(t *testing.T, name, msg string) *dynamicpb.Message {
+	t.Helper()
+	m := csiMessage(t, name)
+	if err := protojson.Unmarshal([]byte(msg), m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCSICodecMarshal(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		msg     any
+		message string
+		want    string
+	}{
+		{"empty", &csiEmpty{}, "NodeUnstageVolumeRequest", `{}`},
+		{"plugin info", &csiPluginInfo{name: "kerberos.nri.io", version: "v1.2.3"}, "GetPluginInfoResponse",
+			`{"name": "kerberos.nri.io", "vendorVersion": "v1.2.3"}`},
+		{"probe", &csiProbe{}, "ProbeResponse", `{"ready": true}`},
+		{"capabilities", &csiNodeCapabilities{rpcs: []uint64{csiStageUnstageVolume, 2}}, "NodeGetCapabilitiesResponse",
+			`{"capabilities": [{"rpc": {"type": "STAGE_UNSTAGE_VOLUME"}}, {"rpc": {"type": "GET_VOLUME_STATS"}}]}`},
+		{"node info", &csiNodeInfo{nodeID: "node-1"}, "NodeGetInfoResponse", `{"nodeId": "node-1"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := csiCodec{}.Marshal(tc.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := csiMessage(t, tc.message)
+			if err := proto.Unmarshal(b, got); err != nil {
+				t.Fatalf("not a %s: %v", tc.message, err)
+			}
+			if want := csiMessageJSON(t, tc.message, tc.want); !proto.Equal(got, want) {
+				t.Errorf("encoded as %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCSICodecMarshalUnknown(t *testing.T) {
+	if _, err := (csiCodec{}).Marshal(&csiStageRequest{}); err == nil {
+		t.Error("encoded a request")
+	}
+}
+
+func TestCSICodecUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		message string
+		msg     string
+		want    any
+	}{
+		{"stage", "NodeStageVolumeRequest",
+			`{"volumeId": "vol-1", "publishContext": {"a": "b"}, "stagingTargetPath": "/staging/vol-1",
+			  "volumeCapability": {"mount": {"fsType": "nfs", "mountFlags": ["sec=krb5", "vers=4.2"]}, "accessMode": {"mode": "MULTI_NODE_MULTI_WRITER"}},
+			  "secrets": {"password": "secret"}, "volumeContext": {"server": "nfs.example.com", "user": "alice"}}`,
+			&csiStageRequest{volumeID: "vol-1", stagingPath: "/staging/vol-1",
+				capability: csiVolumeCapability{mount: true, mountFlags: []string{"sec=krb5", "vers=4.2"}},
+				secrets:    map[string]string{"password": "secret"}, volumeContext: map[string]string{"server": "nfs.example.com", "user": "alice"}}},
+		{"stage without maps", "NodeStageVolumeRequest", `{"volumeId": "vol-1", "volumeCapability": {"mount": {}}}`,
+			&csiStageRequest{volumeID: "vol-1", capability: csiVolumeCapability{mount: true},
+				secrets: map[string]string{}, volumeContext: map[string]string{}}},
+		{"stage block", "NodeStageVolumeRequest", `{"volumeId": "vol-1", "volumeCapability": {"block": {}}}`,
+			&csiStageRequest{volumeID: "vol-1", capability: csiVolumeCapability{block: true},
+				secrets: map[string]string{}, volumeContext: map[string]string{}}},
+		{"unstage", "NodeUnstageVolumeRequest", `{"volumeId": "vol-1", "stagingTargetPath": "/staging/vol-1"}`,
+			&csiUnstageRequest{volumeID: "vol-1", stagingPath: "/staging/vol-1"}},
+		{"publish", "NodePublishVolumeRequest",
+			`{"volumeId": "vol-1", "stagingTargetPath": "/staging/vol-1", "targetPath": "/pods/vol-1",
+			  "volumeCapability": {"mount": {"mountFlags": ["ro"]}}, "readonly": true, "secrets": {"a": "b"}, "volumeContext": {"c": "d"}}`,
+			&csiPublishRequest{volumeID: "vol-1", stagingPath: "/staging/vol-1", targetPath: "/pods/vol-1",
+				capability: csiVolumeCapability{mount: true, mountFlags: []string{"ro"}}, readonly: true}},
+		{"publish read-write", "NodePublishVolumeRequest", `{"volumeId": "vol-1", "targetPath": "/pods/vol-1"}`,
+			&csiPublishRequest{volumeID: "vol-1", targetPath: "/pods/vol-1"}},
+		{"unpublish", "NodeUnpublishVolumeRequest", `{"volumeId": "vol-1", "targetPath": "/pods/vol-1"}`,
+			&csiUnpublishRequest{volumeID: "vol-1", targetPath: "/pods/vol-1"}},
+		{"empty", "NodeUnpublishVolumeRequest", `{"volumeId": "vol-1"}`, &csiEmpty{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := proto.Marshal(csiMessageJSON(t, tc.message, tc.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := reflect.New(reflect.TypeOf(tc.want).Elem()).Interface()
+			if err := (csiCodec{}).Unmarshal(b, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("decoded as %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCSICodecUnmarshalTruncated(t *testing.T) {
+	b, err := proto.Marshal(csiMessageJSON(t, "NodeUnpublishVolumeRequest", `{"volumeId": "vol-1", "targetPath": "/pods/vol-1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (csiCodec{}).Unmarshal(b[:len(b)-3], &csiUnpublishRequest{}); err == nil {
+		t.Error("decoded a truncated request")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Prefix of addresses naming a UNIX socket to serve at.
+const unixAddressPrefix = "unix:"
+
+// The debug endpoints expose the goroutines and memory of the plugin and the
+// principals of the pods on the node, so they are only served on localhost or
+// on a UNIX socket, for node operators.
+func validDebugAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if path, ok := strings.CutPrefix(addr, unixAddressPrefix); ok {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("UNIX socket path %q is not absolute", path)
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%q is not on localhost or a UNIX socket", addr)
+	}
+	return nil
+}
+
+// Register net/http/pprof and /debug/state.
+func (p *plugin) handleDebug(m *http.ServeMux) {
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.HandleFunc("/debug/state", p.serveDebugState)
+}
+
+// In-memory state of the plugin, as served at /debug/state.
+type debugState struct {
+	Time     time.Time            `json:"time"`
+	Managed  []debugCredential    `json:"managed"`
+	Failed   map[string]string    `json:"failed,omitempty"`
+	DryRuns  map[string]string    `json:"dryRuns,omitempty"`
+	Cleanups map[string]time.Time `json:"cleanups,omitempty"`
+}
+
+// Managed credentials, with their ticket times and next renewal.
+type debugCredential struct {
+	Key       string     `json:"key"`
+	Namespace string     `json:"namespace"`
+	Pod       string     `json:"pod"`
+	Container string     `json:"container,omitempty"`
+	Principal string     `json:"principal"`
+	CCName    string     `json:"ccname"`
+	Volumes   int        `json:"volumes,omitempty"`
+	Used      time.Time  `json:"used"`
+	Renewal   *time.Time `json:"renewal,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	RenewTill *time.Time `json:"renewTill,omitempty"`
+	// Why the ticket times could not be read from the credential cache.
+	Error string `json:"error,omitempty"`
+
+	realm string
+}
+
+func (p *plugin) debugState() *debugState {
+	renewals := p.renewals.Due()
+	cleanups := p.cleaner.Due()
+
+	s := &debugState{Time: p.clock.Now(), Managed: []debugCredential{}}
+	p.Lock()
+	for key, mc := range p.managed {
+		c := debugCredential{
+			Key:       key,
+			Namespace: mc.pod.GetNamespace(),
+			Pod:       mc.pod.GetName(),
+			Container: mc.params.Container,
+			Principal: mc.params.Principal(),
+			CCName:    mc.params.CCName,
+			Volumes:   len(mc.params.Volumes),
+			Used:      mc.used,
+			realm:     mc.params.Realm,
+		}
+		if t, ok := renewals[key]; ok {
+			c.Renewal = &t
+		}
+		s.Managed = append(s.Managed, c)
+	}
+	for id, err := range p.failed {
+		if s.Failed == nil {
+			s.Failed = map[string]string{}
+		}
+		s.Failed[id] = err.Error()
+	}
+	for id, kp := range p.dryRuns {
+		if s.DryRuns == nil {
+			s.DryRuns = map[string]string{}
+		}
+		s.DryRuns[id] = kp.Principal()
+	}
+	p.Unlock()
+
+	if len(cleanups) > 0 {
+		s.Cleanups = cleanups
+	}
+
+	// Read the credential caches without holding the lock, they may be on
+	// slow storage.
+	for i := range s.Managed {
+		c := &s.Managed[i]
+		t, err := ccacheTimes(c.CCName, c.realm)
+		if err != nil {
+			c.Error = err.Error()
+			continue
+		}
+		c.Expires, c.RenewTill = &t.end, &t.renewTill
+	}
+	slices.SortFunc(s.Managed, func(a, b debugCredential) int { return strings.Compare(a.Key, b.Key) })
+	return s
+}
+
+func (p *plugin) serveDebugState(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p.debugState()); err != nil {
+		log.Warnf("failed to write debug state: %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/rfc4757"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	// KDC option asking for a ticket for the client of the additional
+	// ticket, S4U2Proxy (MS-SFU 2.2.3).
+	kdcOptionCNameInAddlTkt = 14
+	// Key usage of the checksum of PA-FOR-USER (MS-SFU 2.2.1).
+	keyUsageForUserChecksum = 17
+	forUserAuthPackage      = "Kerberos"
+
+	// Length of NetBIOS computer names, which machine accounts are named by.
+	netbiosNameLength = 15
+)
+
+// Constrained delegation: a service principal of the plugin obtains the NFS
+// service tickets of workloads on their behalf with S4U2Self and S4U2Proxy,
+// so that no keytabs of users are needed on the nodes. The KDC must allow the
+// service principal protocol transition and delegation to the NFS services.
+type delegationConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Realms of the workloads credentials are delegated for, all if empty.
+	Realms []string `json:"realms,omitempty"`
+	// Keytab of the service principal, /etc/krb5.keytab by default.
+	Keytab string `json:"keytab,omitempty"`
+	// Service principal without realm, host/<hostname> by default.
+	Principal string `json:"principal,omitempty"`
+	// Use the machine account the node joined the domain with through SSSD
+	// or realmd, <HOSTNAME>$ of the host keytab they keep, unless Principal
+	// is set.
+	MachineAccount bool `json:"machineAccount,omitempty"`
+	// Credential cache with the TGT of the service principal to use instead
+	// of the keytab, {realm} replaced by the realm of the workload: the
+	// FILE:/var/lib/sss/db/ccache_{realm} SSSD keeps for the machine account,
+	// or a KCM: cache of SSSD's KCM, read with MIT kvno.
+	CCache string `json:"ccache,omitempty"`
+}
+
+func (c *delegationConfig) validate() error {
+	if c.CCache != "" && !strings.HasPrefix(c.CCache, "FILE:") && !strings.HasPrefix(c.CCache, "KCM:") {
+		return fmt.Errorf("ccache: %q is neither a FILE: nor a KCM: cache", c.CCache)
+	}
+	if c.CCache != "" && c.Keytab != "" {
+		return errors.New("ccache and keytab are exclusive")
+	}
+	return nil
+}
+
+// Check whether credentials are delegated for the workload: those of its
+// realm which have neither a password nor a keytab of their own.
+func (c *delegationConfig) applies(kp *kerberosParams) bool {
+	return c != nil && c.Enabled && (len(c.Realms) == 0 || slices.Contains(c.Realms, kp.Realm)) &&
+		kp.Password == "" && kp.Keytab == "" && kp.PKINIT == nil && kp.Anonymous == nil
+}
+
+// Service principal name of the plugin without realm.
+func (c *delegationConfig) principal() (string, error) {
+	if c.Principal != "" {
+		return c.Principal, nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	if c.MachineAccount {
+		name, _, _ := strings.Cut(strings.ToUpper(host), ".")
+		return name[:min(len(name), netbiosNameLength)] + "$", nil
+	}
+	return "host/" + host, nil
+}
+
+// Credential cache of the service principal for the realm, empty unless
+// configured.
+func (c *delegationConfig) ccache(realm string) string {
+	return strings.ReplaceAll(c.CCache, "{realm}", realm)
+}
+
+// PA-FOR-USER of MS-SFU 2.2.1, naming the user of an S4U2Self request.
+type paForUser struct {
+	UserName    types.PrincipalName `asn1:"explicit,tag:0"`
+	UserRealm   string              `asn1:"generalstring,explicit,tag:1"`
+	Cksum       types.Checksum      `asn1:"explicit,tag:2"`
+	AuthPackage string              `asn1:"generalstring,explicit,tag:3"`
+}
+
+// PA-FOR-USER for the user, its checksum keyed with the session key of the
+// TGT of the service.
+func newPAForUser(user types.PrincipalName, realm string, key types.EncryptionKey) (types.PAData, error) {
+	data := binary.LittleEndian.AppendUint32(nil, uint32(user.NameType))
+	for _, s := range user.NameString {
+		data = append(data, s...)
+	}
+	data = append(data, realm...)
+	data = append(data, forUserAuthPackage...)
+	cksum, err := rfc4757.Checksum(key.KeyValue, keyUsageForUserChecksum, data)
+	if err != nil {
+		return types.PAData{}, err
+	}
+	b, err := asn1.Marshal(paForUser{
+		UserName:    user,
+		UserRealm:   realm,
+		Cksum:       types.Checksum{CksumType: chksumtype.KERB_CHECKSUM_HMAC_MD5, Checksum: cksum},
+		AuthPackage: forUserAuthPackage,
+	})
+	if err != nil {
+		return types.PAData{}, err
+	}
+	return types.PAData{PADataType: patype.PA_FOR_USER, PADataValue: b}, nil
+}
+
+// Authenticate a TGS-REQ with the TGT of the service, the body as it is. The
+// client name of the body is that of the user, for the reply to be checked
+// against, while the authenticator names the service.
+func authenticateTGSReq(req *messages.TGSReq, service types.PrincipalName, tgt messages.Ticket, key types.EncryptionKey, padata ...types.PAData) error {
+	body, err := req.ReqBody.Marshal()
+	if err != nil {
+		return err
+	}
+	etype, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return err
+	}
+	cksum, err := etype.GetChecksumHash(key.KeyValue, body, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM)
+	if err != nil {
+		return err
+	}
+	auth, err := types.NewAuthenticator(tgt.Realm, service)
+	if err != nil {
+		return err
+	}
+	auth.Cksum = types.Checksum{CksumType: etype.GetHashID(), Checksum: cksum}
+	apReq, err := messages.NewAPReq(tgt, key, auth)
+	if err != nil {
+		return err
+	}
+	ap, err := apReq.Marshal()
+	if err != nil {
+		return err
+	}
+	req.PAData = append(types.PADataSequence{{PADataType: patype.PA_TGS_REQ, PADataValue: ap}}, padata...)
+	return nil
+}
+
+// Obtain the NFS service tickets of the workload with the TGT of the service
+// principal: a forwardable ticket of the user to the service by S4U2Self,
+// then the tickets to the NFS services by S4U2Proxy with it as evidence.
+func (b *NativeBackend) delegate(ctx context.Context, kp *kerberosParams) error {
+	if strings.HasPrefix(b.delegation.ccache(kp.Realm), "KCM:") {
+		return delegateKvno(ctx, b.exec, kp, b.delegation.ccache(kp.Realm))
+	}
+	cfg, stop, err := b.krb5Config(ctx, kp)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	cl, tgt, key, err := b.delegationTGT(cfg, kp)
+	if err != nil {
+		return err
+	}
+	defer cl.Destroy()
+	service := cl.Credentials.CName()
+	name := service.PrincipalNameString()
+
+	user := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, kp.principalName())
+	forUser, err := newPAForUser(user, kp.Realm, key)
+	if err != nil {
+		return fmt.Errorf("failed to create S4U2Self request for %s: %w", kp.Principal(), err)
+	}
+	req, err := delegationTGSReq(cfg, user, kp.Realm, service, service, tgt, key, nil, forUser)
+	if err != nil {
+		return fmt.Errorf("failed to create S4U2Self request for %s: %w", kp.Principal(), err)
+	}
+	_, self, err := cl.TGSExchange(req, kp.Realm, tgt, key, 0)
+	if err != nil {
+		return fmt.Errorf("S4U2Self for %s by %s failed: %w", kp.Principal(), name, delegationError(err))
+	}
+	if !types.IsFlagSet(&self.DecryptedEncPart.Flags, flags.Forwardable) {
+		return fmt.Errorf("%w: S4U2Self ticket of %s not forwardable, %s may not use protocol transition", errDelegationRefused, kp.Principal(), name)
+	}
+
+	var entries []*ccacheEntry
+	obtainServiceTickets(ctx, kp, func(nfs string) error {
+		spn := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, nfs)
+		req, err := delegationTGSReq(cfg, user, kp.Realm, spn, service, tgt, key, &self.Ticket)
+		if err != nil {
+			return err
+		}
+		_, rep, err := cl.TGSExchange(req, kp.Realm, tgt, key, 0)
+		if err != nil {
+			return delegationError(err)
+		}
+		entry, err := newCCacheEntry(rep.CRealm, rep.CName, rep.Ticket, rep.DecryptedEncPart)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if len(entries) == 0 {
+		return fmt.Errorf("%w: no NFS service tickets delegated for %s by %s", errDelegationRefused, kp.Principal(), name)
+	}
+	if err := writeCCache(kp.CCName, int(kp.UID), int(kp.GID), entries...); err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	loggerFrom(ctx).Debugf("delegated %d NFS service tickets for %s by %s", len(entries), kp.Principal(), name)
+	return nil
+}
+
+// Client and TGT of the service principal in the realm of the workload:
+// obtained with its keytab, or read from the credential cache kept for it.
+func (b *NativeBackend) delegationTGT(cfg *krb5config.Config, kp *kerberosParams) (*client.Client, messages.Ticket, types.EncryptionKey, error) {
+	var tgt messages.Ticket
+	if ccname := b.delegation.ccache(kp.Realm); ccname != "" {
+		path, err := ccachePath(ccname)
+		if err != nil {
+			return nil, tgt, types.EncryptionKey{}, err
+		}
+		cc, err := loadCCache(path)
+		if err != nil {
+			return nil, tgt, types.EncryptionKey{}, fmt.Errorf("%w: failed to load credential cache %q: %w", errDelegationRefused, path, err)
+		}
+		cl, err := client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true))
+		if err != nil || cc.DefaultPrincipal.Realm != kp.Realm {
+			return nil, tgt, types.EncryptionKey{}, fmt.Errorf("%w: no TGT of %s in credential cache %q", errDelegationRefused, kp.Realm, path)
+		}
+		cred, _ := cc.GetEntry(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+kp.Realm))
+		if cred.EndTime.Before(b.clock.Now()) {
+			cl.Destroy()
+			return nil, tgt, types.EncryptionKey{}, fmt.Errorf("%w: TGT of %s in credential cache %q expired at %s",
+				errDelegationRefused, cc.DefaultPrincipal.PrincipalName.PrincipalNameString(), path, cred.EndTime.Format(time.RFC3339))
+		}
+		if err := tgt.Unmarshal(cred.Ticket); err != nil {
+			cl.Destroy()
+			return nil, tgt, types.EncryptionKey{}, fmt.Errorf("invalid TGT in credential cache %q: %w", path, err)
+		}
+		return cl, tgt, cred.Key, nil
+	}
+
+	name, err := b.delegation.principal()
+	if err != nil {
+		return nil, tgt, types.EncryptionKey{}, err
+	}
+	path := b.delegation.Keytab
+	if path == "" {
+		path = defaultFASTKeytab
+	}
+	kt, err := keytab.Load(path)
+	if err != nil {
+		return nil, tgt, types.EncryptionKey{}, fmt.Errorf("%w: failed to load keytab %q of %s: %w", errKeytabUnavailable, path, name, err)
+	}
+	cl := client.NewWithKeytab(name, kp.Realm, kt, cfg, client.DisablePAFXFAST(true))
+	asReq, err := messages.NewASReqForTGT(kp.Realm, cfg, cl.Credentials.CName())
+	if err != nil {
+		cl.Destroy()
+		return nil, tgt, types.EncryptionKey{}, fmt.Errorf("failed to create AS-REQ for %s@%s: %w", name, kp.Realm, err)
+	}
+	asRep, err := cl.ASExchange(kp.Realm, asReq, 0)
+	if err != nil {
+		cl.Destroy()
+		return nil, tgt, types.EncryptionKey{}, fmt.Errorf("kinit for %s@%s failed: %w", name, kp.Realm, classifyKrbError(err))
+	}
+	return cl, asRep.Ticket, asRep.DecryptedEncPart.Key, nil
+}
+
+// Obtain the NFS service tickets of the workload with MIT kvno, by S4U2Self
+// and S4U2Proxy with the TGT of the service principal in a credential cache
+// gokrb5 cannot read, as those of KCM. The tickets of each service are
+// written into a cache of their own, and those of the NFS services then into
+// that of the workload.
+func delegateKvno(ctx context.Context, ex Exec, kp *kerberosParams, ccname string) error {
+	dir, err := os.MkdirTemp("", "nri-kerberos-s4u-*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	defer os.RemoveAll(dir)
+
+	var entries []*ccacheEntry
+	var n int
+	obtainServiceTickets(ctx, kp, func(nfs string) error {
+		n++
+		out := "FILE:" + filepath.Join(dir, strconv.Itoa(n))
+		tool, args, err := kp.krb5Tools(ex).delegatedTicket(ccname, kp.Principal(), nfs+"@"+kp.serviceRealm(), out)
+		if err != nil {
+			return err
+		}
+		err = runKrb5Tool(ctx, ex, kp, "", tool, args...)
+		if errors.Is(err, errKDCRejected) {
+			return fmt.Errorf("%w: %w", errDelegationRefused, err)
+		} else if err != nil {
+			return err
+		}
+		delegated, err := readCCache(out)
+		if err != nil {
+			return err
+		}
+		for _, e := range delegated {
+			if e.server.PrincipalNameString() == nfs {
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	if len(entries) == 0 {
+		return fmt.Errorf("%w: no NFS service tickets delegated for %s with %s", errDelegationRefused, kp.Principal(), ccname)
+	}
+	if err := writeCCache(kp.CCName, int(kp.UID), int(kp.GID), entries...); err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	loggerFrom(ctx).Debugf("delegated %d NFS service tickets for %s with %s", len(entries), kp.Principal(), ccname)
+	return nil
+}
+
+// TGS-REQ of the service for a ticket of the user to sname: by S4U2Self with
+// PA-FOR-USER, or by S4U2Proxy with the evidence ticket of S4U2Self.
+func delegationTGSReq(cfg *krb5config.Config, user types.PrincipalName, realm string, sname, service types.PrincipalName, tgt messages.Ticket, key types.EncryptionKey, evidence *messages.Ticket, padata ...types.PAData) (messages.TGSReq, error) {
+	req, err := messages.NewTGSReq(user, realm, cfg, tgt, key, sname, false)
+	if err != nil {
+		return req, err
+	}
+	types.SetFlag(&req.ReqBody.KDCOptions, flags.Forwardable)
+	if evidence != nil {
+		types.SetFlag(&req.ReqBody.KDCOptions, kdcOptionCNameInAddlTkt)
+		req.ReqBody.AdditionalTickets = []messages.Ticket{*evidence}
+	}
+	if err := authenticateTGSReq(&req, service, tgt, key, padata...); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// Classify a failed S4U exchange, a KDC refusing it most likely not allowing
+// the service principal to delegate.
+func delegationError(err error) error {
+	err = classifyKrbError(err)
+	if errors.Is(err, errKDCRejected) {
+		return fmt.Errorf("%w: %w", errDelegationRefused, err)
+	}
+	return err
+}
@@ -0,0 +1,561 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	directoryNSS  = "nss"
+	directoryLDAP = "ldap"
+
+	defaultDirectoryTimeout  = 5 * time.Second
+	defaultDirectoryCacheTTL = 5 * time.Minute
+	defaultLDAPUserAttribute = "uid"
+	defaultLDAPObjectClass   = "posixAccount"
+)
+
+// errUnknownUser is returned when the directory has no POSIX account for a user.
+var errUnknownUser = errors.New("no POSIX account in the directory")
+
+// Directory the uids and gids of users are looked up in, so that pods cannot
+// claim any ids they like.
+type directoryConfig struct {
+	// nss for the host name service switch, including SSSD, or ldap. The
+	// annotations give the ids if empty.
+	Source string `json:"source,omitempty"`
+	// Server, ldap://host[:port] or ldaps://host[:port].
+	URL string `json:"url,omitempty"`
+	// PEM CA bundle for verifying an ldaps server.
+	CAFile string `json:"caFile,omitempty"`
+	// Base of the user search, such as ou=people,dc=example,dc=com.
+	BaseDN string `json:"baseDN,omitempty"`
+	// DN to bind as, anonymous if empty, and the file holding its password.
+	BindDN           string `json:"bindDN,omitempty"`
+	BindPasswordFile string `json:"bindPasswordFile,omitempty"`
+	// Attribute holding the user name, uid by default.
+	UserAttribute string `json:"userAttribute,omitempty"`
+	// Object class of users, posixAccount by default.
+	ObjectClass string `json:"objectClass,omitempty"`
+	// Timeout of a lookup, 5s by default.
+	Timeout duration `json:"timeout,omitempty"`
+	// Time lookups are cached for, 5m by default.
+	CacheTTL duration `json:"cacheTTL,omitempty"`
+}
+
+func (c *directoryConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultDirectoryTimeout
+}
+
+func (c *directoryConfig) cacheTTL() time.Duration {
+	if c.CacheTTL.Duration > 0 {
+		return c.CacheTTL.Duration
+	}
+	return defaultDirectoryCacheTTL
+}
+
+// POSIX ids of a user in the directory.
+type posixAccount struct {
+	uid, gid uint64
+	// msDS-SupportedEncryptionTypes of an AD account, 0 if not given.
+	encTypes uint32
+}
+
+// Resolver of the POSIX ids of users, caching the results.
+type directory struct {
+	cfg   directoryConfig
+	tls   *tls.Config
+	exec  Exec
+	clock Clock
+
+	sync.Mutex
+	cache map[string]*directoryEntry
+}
+
+type directoryEntry struct {
+	account posixAccount
+	err     error
+	expires time.Time
+}
+
+// Create the resolver of the configured directory, or nil if not configured.
+func newDirectory(cfg directoryConfig, exec Exec, clock Clock) (*directory, error) {
+	d := &directory{cfg: cfg, exec: exec, clock: clock, cache: map[string]*directoryEntry{}}
+	switch cfg.Source {
+	case "":
+		return nil, nil
+	case directoryNSS:
+		return d, nil
+	case directoryLDAP:
+	default:
+		return nil, fmt.Errorf("invalid directory source %q, must be nss or ldap", cfg.Source)
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q, must be ldap:// or ldaps://", cfg.URL)
+	}
+	if cfg.BaseDN == "" {
+		return nil, errors.New("LDAP directory needs a baseDN")
+	}
+	if d.tls, err = ldapTLSConfig(u, cfg.CAFile); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// TLS configuration for an ldaps server, nil for ldap.
+func ldapTLSConfig(u *url.URL, caFile string) (*tls.Config, error) {
+	if u.Scheme != "ldaps" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LDAP CA: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in LDAP CA %q", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// Look up the POSIX ids of a user, wrapping errUnknownUser if it has none.
+func (d *directory) lookup(ctx context.Context, user string) (posixAccount, error) {
+	d.Lock()
+	e, ok := d.cache[user]
+	d.Unlock()
+	if ok && d.clock.Now().Before(e.expires) {
+		return e.account, e.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.timeout())
+	defer cancel()
+	var account posixAccount
+	var err error
+	if d.cfg.Source == directoryNSS {
+		account, err = lookupNSS(ctx, d.exec, user)
+	} else {
+		account, err = d.lookupLDAP(ctx, user)
+	}
+	// only definite answers are cached, not a directory being unreachable
+	if err == nil || errors.Is(err, errUnknownUser) {
+		d.Lock()
+		d.cache[user] = &directoryEntry{account, err, d.clock.Now().Add(d.cfg.cacheTTL())}
+		d.Unlock()
+	}
+	return account, err
+}
+
+// Look up a user in the host passwd database with getent, which goes through
+// NSS and so SSSD, unlike os/user in a static binary.
+func lookupNSS(ctx context.Context, ex Exec, user string) (posixAccount, error) {
+	out := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "getent", "passwd", user)
+	cmd.Stdout = out
+	err := ex.RunCmd(ctx, cmd)
+	var exit interface{ ExitCode() int }
+	if errors.As(err, &exit) && exit.ExitCode() == 2 {
+		return posixAccount{}, fmt.Errorf("%w: %s", errUnknownUser, user)
+	}
+	if err != nil {
+		return posixAccount{}, fmt.Errorf("getent passwd %s failed: %w", user, err)
+	}
+	// name:password:uid:gid:gecos:home:shell
+	fields := strings.Split(strings.TrimSpace(out.String()), ":")
+	if len(fields) < 4 {
+		return posixAccount{}, fmt.Errorf("invalid passwd entry of %s", user)
+	}
+	return parsePosixAccount(user, fields[2], fields[3])
+}
+
+func parsePosixAccount(user, uid, gid string) (posixAccount, error) {
+	u, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return posixAccount{}, fmt.Errorf("invalid uid %q of %s", uid, user)
+	}
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return posixAccount{}, fmt.Errorf("invalid gid %q of %s", gid, user)
+	}
+	if u == 0 || g == 0 {
+		return posixAccount{}, fmt.Errorf("%s is root in the directory", user)
+	}
+	return posixAccount{uid: u, gid: g}, nil
+}
+
+// LDAP protocol tags.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x30
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapSearchRequest    = 0x63
+	ldapSearchResEntry   = 0x64
+	ldapSearchResDone    = 0x65
+	ldapAuthSimple       = 0x80
+	ldapFilterAnd        = 0xa0
+	ldapFilterEquality   = 0xa3
+	ldapScopeSubtree     = 2
+	ldapResultSuccess    = 0
+	ldapDefaultPort      = "389"
+	ldapDefaultTLSPort   = "636"
+	ldapUIDNumberAttr    = "uidNumber"
+	ldapGIDNumberAttr    = "gidNumber"
+	ldapMaxMessageLength = 1 << 20
+)
+
+// Search the LDAP directory for the account of a user, binding first if
+// configured to.
+func (d *directory) lookupLDAP(ctx context.Context, user string) (posixAccount, error) {
+	conn, err := dialLDAP(ctx, d.cfg.URL, d.tls, d.cfg.BindDN, d.cfg.BindPasswordFile)
+	if err != nil {
+		return posixAccount{}, err
+	}
+	defer conn.Close()
+
+	attr, class := d.cfg.UserAttribute, d.cfg.ObjectClass
+	if attr == "" {
+		attr = defaultLDAPUserAttribute
+	}
+	if class == "" {
+		class = defaultLDAPObjectClass
+	}
+	// size limit 2, to tell ambiguous names
+	entries, err := conn.search(d.cfg.BaseDN, ldapEqualityFilter("objectClass", class, attr, user), 2,
+		d.cfg.timeout(), ldapUIDNumberAttr, ldapGIDNumberAttr, ldapSupportedETypesAttr)
+	if err != nil && len(entries) < 2 {
+		return posixAccount{}, fmt.Errorf("LDAP search for %s failed: %w", user, err)
+	}
+	switch len(entries) {
+	case 0:
+		return posixAccount{}, fmt.Errorf("%w: %s=%s under %s", errUnknownUser, attr, user, d.cfg.BaseDN)
+	case 1:
+		entry := entries[0]
+		account, err := parsePosixAccount(user, entry[strings.ToLower(ldapUIDNumberAttr)], entry[strings.ToLower(ldapGIDNumberAttr)])
+		if err != nil {
+			return posixAccount{}, err
+		}
+		account.encTypes, err = parseSupportedETypes(user, entry[strings.ToLower(ldapSupportedETypesAttr)])
+		return account, err
+	default:
+		return posixAccount{}, fmt.Errorf("several LDAP entries match %s=%s", attr, user)
+	}
+}
+
+// Connection to an LDAP server.
+type ldapConn struct {
+	net.Conn
+	// ID of the last message sent.
+	id int
+}
+
+// Connect to an LDAP server and bind, anonymously if bindDN is empty.
+func dialLDAP(ctx context.Context, rawURL string, tlsCfg *tls.Config, bindDN, bindPasswordFile string) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := ldapDefaultPort
+		if tlsCfg != nil {
+			port = ldapDefaultTLSPort
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if tlsCfg != nil {
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+		}
+		conn = tlsConn
+	}
+	c := &ldapConn{Conn: conn}
+
+	if bindDN != "" {
+		password, err := os.ReadFile(bindPasswordFile)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to read LDAP bind password: %w", err)
+		}
+		bind := ber(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, bindDN),
+			berString(ldapAuthSimple, strings.TrimSpace(string(password))))
+		if err := c.request(bind, ldapBindResponse); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("LDAP bind as %s failed: %w", bindDN, err)
+		}
+	}
+	return c, nil
+}
+
+// Send a request and check the result of the response, which must be of
+// the given protocol op.
+func (c *ldapConn) request(req []byte, rsp byte) error {
+	if err := c.send(req); err != nil {
+		return err
+	}
+	op, body, err := readLDAPMessage(c)
+	if err != nil {
+		return err
+	}
+	if op != rsp {
+		return fmt.Errorf("unexpected LDAP response %#x", op)
+	}
+	return ldapResult(body)
+}
+
+func (c *ldapConn) send(req []byte) error {
+	c.id++
+	_, err := c.Write(ber(berSequence, berInt(berInteger, c.id), req))
+	return err
+}
+
+// Search the subtree of a base DN, returning the first values of the
+// attributes of the entries found, by lowercase name, with the DN of each
+// as "dn". Entries found are returned along with the error of a search
+// which did not complete, as when it hit the size limit.
+func (c *ldapConn) search(baseDN string, filter []byte, sizeLimit int, timeout time.Duration, attrs ...string) ([]map[string]string, error) {
+	var list [][]byte
+	for _, attr := range attrs {
+		list = append(list, berString(berOctetString, attr))
+	}
+	search := ber(ldapSearchRequest,
+		berString(berOctetString, baseDN),
+		berInt(berEnumerated, ldapScopeSubtree),
+		berInt(berEnumerated, 0), // never dereference aliases
+		berInt(berInteger, sizeLimit),
+		berInt(berInteger, int(timeout/time.Second)),
+		ber(berBoolean, []byte{0}),
+		filter,
+		ber(berSequence, list...))
+	if err := c.send(search); err != nil {
+		return nil, err
+	}
+
+	var entries []map[string]string
+	for {
+		op, body, err := readLDAPMessage(c)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case ldapSearchResEntry:
+			entry, err := ldapEntry(body)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchResDone:
+			return entries, ldapResult(body)
+		}
+		// search result references are not followed
+	}
+}
+
+// Filter matching entries with all the attribute values, given as pairs of
+// attribute and value: (&(a1=v1)(a2=v2)...). Values need no escaping in BER.
+func ldapEqualityFilter(pairs ...string) []byte {
+	var filters [][]byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		filters = append(filters, ber(ldapFilterEquality, berString(berOctetString, pairs[i]), berString(berOctetString, pairs[i+1])))
+	}
+	return ber(ldapFilterAnd, filters...)
+}
+
+// Encode a BER element.
+func ber(tag byte, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	out := []byte{tag}
+	switch n := len(body); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, body...)
+}
+
+func berString(tag byte, s string) []byte {
+	return ber(tag, []byte(s))
+}
+
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return ber(tag, b)
+}
+
+// Split the next BER element off data, returning its tag, content and the rest.
+func berNext(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("truncated LDAP message")
+	}
+	tag, n, data := data[0], int(data[1]), data[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(data) < size {
+			return 0, nil, nil, errors.New("invalid length in LDAP message")
+		}
+		n = 0
+		for _, b := range data[:size] {
+			n = n<<8 | int(b)
+		}
+		data = data[size:]
+	}
+	if n > len(data) {
+		return 0, nil, nil, errors.New("truncated LDAP message")
+	}
+	return tag, data[:n], data[n:], nil
+}
+
+// Read an LDAP message, returning the tag and content of its protocol op.
+func readLDAPMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if size := int(header[1]); size&0x80 != 0 {
+		if size&0x7f > 4 {
+			return 0, nil, errors.New("invalid length in LDAP message")
+		}
+		header = header[:2+size&0x7f]
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	n := int(header[1])
+	if n&0x80 != 0 {
+		n = 0
+		for _, b := range header[2:] {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > ldapMaxMessageLength {
+		return 0, nil, errors.New("LDAP message too long")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+	// message ID, then the protocol op
+	_, _, rest, err := berNext(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	op, body, _, err := berNext(rest)
+	return op, body, err
+}
+
+// Error of an LDAPResult, nil on success.
+func ldapResult(body []byte) error {
+	_, code, rest, err := berNext(body)
+	if err != nil {
+		return err
+	}
+	if len(code) == 1 && code[0] == ldapResultSuccess {
+		return nil
+	}
+	var message []byte
+	if _, _, rest, err = berNext(rest); err == nil {
+		_, message, _, _ = berNext(rest)
+	}
+	c := 0
+	for _, b := range code {
+		c = c<<8 | int(b)
+	}
+	return fmt.Errorf("result code %d: %s", c, message)
+}
+
+// First values of the attributes of a SearchResultEntry, by lowercase name,
+// and its DN as "dn".
+func ldapEntry(body []byte) (map[string]string, error) {
+	_, dn, rest, err := berNext(body)
+	if err != nil {
+		return nil, err
+	}
+	_, attrs, _, err := berNext(rest)
+	if err != nil {
+		return nil, err
+	}
+	entry := map[string]string{"dn": string(dn)}
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = berNext(attrs); err != nil {
+			return nil, err
+		}
+		_, name, rest, err := berNext(attr)
+		if err != nil {
+			return nil, err
+		}
+		_, values, _, err := berNext(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 {
+			_, value, _, err := berNext(values)
+			if err != nil {
+				return nil, err
+			}
+			entry[strings.ToLower(string(name))] = string(value)
+		}
+	}
+	return entry, nil
+}
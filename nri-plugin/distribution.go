@@ -0,0 +1,686 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultDistributionPort     = 9467
+	defaultDistributionInterval = time.Minute
+	defaultDistributionTimeout  = 10 * time.Second
+
+	// Node annotation the agent publishes its bundle key in, base64 X25519.
+	agentKeyAnnotation = "kerberos.nri.io/agent-key"
+
+	// gRPC service of the agents taking keytab bundles, JSON like the ticket agent API.
+	distributionService = "nri.kerberos.v1alpha1.KeytabDistribution"
+
+	// Key derivation and signature context of bundles.
+	bundleContext = "nri-kerberos keytab bundle"
+
+	// File in the keytab directory listing the keytabs distributed there and
+	// the serial of the last bundle.
+	distributionStateFile = ".nri-distributed"
+)
+
+// Distribution of the keytabs of the pods to the agents of their nodes by the
+// controller, read from the file given with -distribute.
+type distributionConfig struct {
+	// PEM PKCS#8 Ed25519 key bundles are signed with. Agents are given its public key.
+	SigningKey string `json:"signingKey"`
+	// Namespaces whose pods get their keytabs distributed, all if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Prefix of the pod annotations, "nri.io/" by default.
+	AnnotationPrefix string `json:"annotationPrefix,omitempty"`
+	// Keytab Secret of pods without nri.io/kerberos-keytab-secret, in their
+	// namespace, "kerberos-keytabs" by default.
+	SecretName string `json:"secretName,omitempty"`
+	// Port the agents take bundles at, 9467 by default.
+	Port int `json:"port,omitempty"`
+	// Interval of the distribution, 1m by default.
+	Interval duration `json:"interval,omitempty"`
+	// Time limit for delivering a bundle to one agent, 10s by default.
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+func (c *distributionConfig) port() int {
+	if c.Port > 0 {
+		return c.Port
+	}
+	return defaultDistributionPort
+}
+
+func (c *distributionConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultDistributionInterval
+}
+
+func (c *distributionConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultDistributionTimeout
+}
+
+func (c *distributionConfig) annotation(name string) string {
+	if c.AnnotationPrefix != "" {
+		return c.AnnotationPrefix + name
+	}
+	return defaultAnnotationPrefix + name
+}
+
+func (c *distributionConfig) secretName() string {
+	if c.SecretName != "" {
+		return c.SecretName
+	}
+	return defaultProvisionSecret
+}
+
+func loadDistributionConfig(path string) (*distributionConfig, ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read distribution config %q: %w", path, err)
+	}
+	cfg := &distributionConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse distribution config %q: %w", path, err)
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return nil, nil, fmt.Errorf("invalid distribution config %q: invalid port %d", path, cfg.Port)
+	}
+	key, err := readSigningKey(cfg.SigningKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid distribution config %q: %w", path, err)
+	}
+	return cfg, key, nil
+}
+
+// Read the PEM PKCS#8 Ed25519 private key bundles are signed with.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %q: %w", path, err)
+	}
+	signer, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid signing key %q: not an Ed25519 key", path)
+	}
+	return signer, nil
+}
+
+// Read the PEM PKIX Ed25519 public key of the controller.
+func readControllerKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid controller key %q: %w", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid controller key %q: not an Ed25519 key", path)
+	}
+	return pub, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("no %s PEM block in %q", blockType, path)
+	}
+	return block.Bytes, nil
+}
+
+// Keytabs of one node: those of the users of the pods scheduled to it, by
+// file name in the keytab directory of the agent.
+type keytabBundle struct {
+	Node string `json:"node"`
+	// Time of the bundle in nanoseconds, agents only take newer bundles than
+	// the last one.
+	Serial  int64             `json:"serial"`
+	Keytabs map[string][]byte `json:"keytabs"`
+}
+
+// Bundle as delivered: encrypted to the key the agent of the node published,
+// with a key agreed with an ephemeral X25519 key, and signed by the controller.
+type sealedBundle struct {
+	Node       string `json:"node"`
+	Key        []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+	Signature  []byte `json:"signature"`
+}
+
+type storeKeytabsReply struct {
+	// Number of keytabs the agent holds from the bundle.
+	Keytabs int `json:"keytabs"`
+}
+
+// Bytes of a sealed bundle the signature covers.
+func (s *sealedBundle) signed() []byte {
+	msg := []byte(bundleContext + "\x00" + s.Node + "\x00")
+	msg = append(msg, s.Key...)
+	msg = append(msg, s.Nonce...)
+	return append(msg, s.Ciphertext...)
+}
+
+// AES-256-GCM of a bundle, keyed with the shared secret of the key agreement.
+func bundleCipher(shared, ephemeral, recipient []byte, node string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, shared, append(slices.Clone(ephemeral), recipient...), bundleContext+" "+node, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a bundle to the key of the agent of its node and sign it.
+func sealBundle(b *keytabBundle, recipient *ecdh.PublicKey, signer ed25519.PrivateKey) (*sealedBundle, error) {
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	s := &sealedBundle{Node: b.Node, Key: ephemeral.PublicKey().Bytes()}
+	aead, err := bundleCipher(shared, s.Key, recipient.Bytes(), b.Node)
+	if err != nil {
+		return nil, err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Ciphertext = aead.Seal(nil, s.Nonce, plain, []byte(b.Node))
+	s.Signature = ed25519.Sign(signer, s.signed())
+	return s, nil
+}
+
+// Verify a bundle is signed by the controller and for the node, and decrypt it.
+func openBundle(s *sealedBundle, key *ecdh.PrivateKey, controller ed25519.PublicKey, node string) (*keytabBundle, error) {
+	if s.Node != node {
+		return nil, fmt.Errorf("bundle of node %q, not %q", s.Node, node)
+	}
+	if !ed25519.Verify(controller, s.signed(), s.Signature) {
+		return nil, errors.New("bundle not signed by the controller")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(s.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle key: %w", err)
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := bundleCipher(shared, s.Key, key.PublicKey().Bytes(), node)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid bundle nonce")
+	}
+	plain, err := aead.Open(nil, s.Nonce, s.Ciphertext, []byte(node))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt bundle: %w", err)
+	}
+	b := &keytabBundle{}
+	if err := json.Unmarshal(plain, b); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	if b.Node != node {
+		return nil, fmt.Errorf("bundle of node %q, not %q", b.Node, node)
+	}
+	return b, nil
+}
+
+// Distributor of the keytabs in Secrets to the agents of the nodes their pods
+// run on, so that no keytab needs placing on nodes by hand.
+type keytabDistributor struct {
+	cfg    *distributionConfig
+	kube   *kubeClient
+	ids    *identityCache
+	signer ed25519.PrivateKey
+	// Digest of the agent key and keytabs last delivered, by node.
+	delivered map[string]string
+}
+
+// Node as listed, with the key and address of its agent.
+type distributionNode struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Status struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+// Address of the agent of a node, its internal IP if it has one.
+func (n *distributionNode) address() string {
+	for _, a := range n.Status.Addresses {
+		if a.Type == "InternalIP" {
+			return a.Address
+		}
+	}
+	if len(n.Status.Addresses) > 0 {
+		return n.Status.Addresses[0].Address
+	}
+	return ""
+}
+
+// Distribute the keytabs periodically until the context is cancelled.
+func (d *keytabDistributor) run(ctx context.Context) {
+	d.delivered = map[string]string{}
+	for {
+		d.reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.cfg.interval()):
+		}
+	}
+}
+
+// Deliver a bundle to each node with an agent whose keytabs or agent key
+// changed. Nodes without pods get an empty one, removing the keytabs
+// delivered to them before.
+func (d *keytabDistributor) reconcile(ctx context.Context) {
+	pods := struct {
+		Items []*provisionPod `json:"items"`
+	}{}
+	if err := d.kube.do(ctx, http.MethodGet, "/api/v1/pods", "", nil, &pods); err != nil {
+		log.Errorf("failed to list pods: %v", err)
+		return
+	}
+	nodes := struct {
+		Items []*distributionNode `json:"items"`
+	}{}
+	if err := d.kube.do(ctx, http.MethodGet, "/api/v1/nodes", "", nil, &nodes); err != nil {
+		log.Errorf("failed to list nodes: %v", err)
+		return
+	}
+
+	// users by namespace/Secret, by node
+	wanted := map[string]map[string][]string{}
+	for _, pod := range pods.Items {
+		node := pod.Spec.NodeName
+		if node == "" || len(d.cfg.Namespaces) > 0 && !slices.Contains(d.cfg.Namespaces, pod.Metadata.Namespace) {
+			continue
+		}
+		normalizeAnnotations(pod.Metadata.Annotations, d.cfg.annotation)
+		secret, ok := podKeytabSecret(pod, d.cfg.annotation, d.cfg.secretName())
+		users := d.podUsers(pod)
+		if !ok || len(users) == 0 {
+			continue
+		}
+		if wanted[node] == nil {
+			wanted[node] = map[string][]string{}
+		}
+		ref := pod.Metadata.Namespace + "/" + secret
+		wanted[node][ref] = append(wanted[node][ref], users...)
+	}
+
+	secrets := map[string]map[string][]byte{}
+	for _, node := range nodes.Items {
+		name := node.Metadata.Name
+		pub, err := base64.StdEncoding.DecodeString(node.Metadata.Annotations[agentKeyAnnotation])
+		if err != nil || len(pub) == 0 {
+			continue
+		}
+		key, err := ecdh.X25519().NewPublicKey(pub)
+		if err != nil {
+			log.Warnf("invalid agent key of node %s: %v", name, err)
+			continue
+		}
+		keytabs := d.nodeKeytabs(ctx, name, wanted[name], secrets)
+		digest := bundleDigest(pub, keytabs)
+		if d.delivered[name] == digest {
+			continue
+		}
+		if err := d.deliver(ctx, node, key, keytabs); err != nil {
+			log.Errorf("failed to deliver keytabs to node %s: %v", name, err)
+			continue
+		}
+		log.Infof("delivered %d keytabs to node %s", len(keytabs), name)
+		d.delivered[name] = digest
+	}
+}
+
+// Keytabs of the users of a node from their Secrets, read once per
+// reconciliation. Of users with keytabs in several Secrets, the first Secret
+// in order wins.
+func (d *keytabDistributor) nodeKeytabs(ctx context.Context, node string, refs map[string][]string, secrets map[string]map[string][]byte) map[string][]byte {
+	keytabs := map[string][]byte{}
+	from := map[string]string{}
+	for _, ref := range slices.Sorted(maps.Keys(refs)) {
+		data, ok := secrets[ref]
+		if !ok {
+			namespace, name, _ := strings.Cut(ref, "/")
+			var err error
+			if data, err = d.kube.getSecretData(ctx, namespace, name); err != nil && !errors.Is(err, errNotFound) {
+				log.Errorf("failed to get Secret %s: %v", ref, err)
+			}
+			secrets[ref] = data
+		}
+		for _, user := range refs[ref] {
+			file := user + ".keytab"
+			kt, ok := data[file]
+			switch {
+			case !ok:
+				log.Debugf("no keytab of %s in Secret %s for node %s", user, ref, node)
+			case from[file] != "" && from[file] != ref:
+				log.Warnf("keytab of %s for node %s in both Secret %s and %s, using the former", user, node, from[file], ref)
+			default:
+				keytabs[file], from[file] = kt, ref
+			}
+		}
+	}
+	return keytabs
+}
+
+// Users a pod asks for in its annotations, principal annotations and
+// KERBEROS_USER, which the KerberosIdentity of its namespace allows.
+func (d *keytabDistributor) podUsers(pod *provisionPod) []string {
+	var users []string
+	for k, v := range pod.Metadata.Annotations {
+		switch {
+		case k == d.cfg.annotation("kerberos-user") || strings.HasPrefix(k, d.cfg.annotation("kerberos-user.")):
+			users = append(users, v)
+		case strings.HasPrefix(k, d.cfg.annotation("kerberos-principal.")):
+			user, _, _ := strings.Cut(v, "@")
+			users = append(users, user)
+		case k == d.cfg.annotation(principalsAnnotation):
+			principals, _ := parsePrincipals(v, "")
+			users = append(users, principals...)
+		}
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, env := range c.Env {
+			if env.Name == "KERBEROS_USER" {
+				users = append(users, env.Value)
+			}
+		}
+	}
+	id := d.ids.forNamespace(pod.Metadata.Namespace)
+	return slices.DeleteFunc(users, func(user string) bool {
+		return validateUser(user) != nil || id != nil && !id.allows(user)
+	})
+}
+
+// Digest of what a bundle delivers to a node, to tell when it changed.
+func bundleDigest(key []byte, keytabs map[string][]byte) string {
+	h := sha256.New()
+	h.Write(key)
+	for _, file := range slices.Sorted(maps.Keys(keytabs)) {
+		h.Write([]byte(file + "\x00" + strconv.Itoa(len(keytabs[file])) + "\x00"))
+		h.Write(keytabs[file])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Seal the keytabs of a node and deliver them to its agent.
+func (d *keytabDistributor) deliver(ctx context.Context, node *distributionNode, key *ecdh.PublicKey, keytabs map[string][]byte) error {
+	addr := node.address()
+	if addr == "" {
+		return errors.New("no node address")
+	}
+	sealed, err := sealBundle(&keytabBundle{
+		Node:    node.Metadata.Name,
+		Serial:  time.Now().UnixNano(),
+		Keytabs: keytabs,
+	}, key, d.signer)
+	if err != nil {
+		return fmt.Errorf("failed to seal bundle: %w", err)
+	}
+	// The bundle is encrypted and signed, the channel needs no protection.
+	conn, err := grpc.NewClient(net.JoinHostPort(addr, strconv.Itoa(d.cfg.port())),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.timeout())
+	defer cancel()
+	return conn.Invoke(ctx, "/"+distributionService+"/StoreKeytabs", sealed, &storeKeytabsReply{})
+}
+
+// Keytab distribution configuration of the agent.
+type agentDistributionConfig struct {
+	// Address the agent takes keytab bundles from the controller at, such as
+	// :9467, disabled if empty.
+	Listen string `json:"listen,omitempty"`
+	// PEM PKIX Ed25519 public key of the controller. Bundles it did not sign
+	// are refused.
+	ControllerKey string `json:"controllerKey,omitempty"`
+}
+
+func (c *agentDistributionConfig) validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", c.Listen, err)
+	}
+	if c.ControllerKey == "" {
+		return errors.New("controllerKey is required")
+	}
+	return nil
+}
+
+// Keytab distribution API of the agents.
+type keytabDistributionServer interface {
+	StoreKeytabs(context.Context, *sealedBundle) (*storeKeytabsReply, error)
+}
+
+var keytabDistributionDesc = grpc.ServiceDesc{
+	ServiceName: distributionService,
+	HandlerType: (*keytabDistributionServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "StoreKeytabs", Handler: storeKeytabsHandler},
+	},
+}
+
+func storeKeytabsHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := &sealedBundle{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	call := func(ctx context.Context, req any) (any, error) {
+		return srv.(keytabDistributionServer).StoreKeytabs(ctx, req.(*sealedBundle))
+	}
+	if interceptor == nil {
+		return call(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + distributionService + "/StoreKeytabs"}
+	return interceptor(ctx, req, info, call)
+}
+
+// Taker of the keytab bundles of its node, storing their keytabs in the
+// keytab directory where the backend finds them.
+type keytabReceiver struct {
+	node       string
+	dir        string
+	key        *ecdh.PrivateKey
+	controller ed25519.PublicKey
+
+	sync.Mutex
+	state distributionState
+}
+
+// Keytabs distributed to the keytab directory, and the serial of the bundle.
+type distributionState struct {
+	Serial  int64    `json:"serial"`
+	Keytabs []string `json:"keytabs"`
+}
+
+func (r *keytabReceiver) StoreKeytabs(_ context.Context, s *sealedBundle) (*storeKeytabsReply, error) {
+	b, err := openBundle(s, r.key, r.controller, r.node)
+	if err != nil {
+		log.Warnf("refused keytab bundle: %v", err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	for file := range b.Keytabs {
+		user, ok := strings.CutSuffix(file, ".keytab")
+		if !ok || validateUser(user) != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid keytab name %q", file)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if b.Serial <= r.state.Serial {
+		return nil, status.Errorf(codes.FailedPrecondition, "bundle %d not newer than %d", b.Serial, r.state.Serial)
+	}
+	for _, file := range slices.Sorted(maps.Keys(b.Keytabs)) {
+		if _, err := installFile(filepath.Join(r.dir, file), b.Keytabs[file], 0600); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	for _, file := range r.state.Keytabs {
+		if _, ok := b.Keytabs[file]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(r.dir, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("failed to remove distributed keytab %s: %v", file, err)
+		}
+	}
+	r.state = distributionState{Serial: b.Serial, Keytabs: slices.Sorted(maps.Keys(b.Keytabs))}
+	data, err := json.Marshal(&r.state)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if _, err := installFile(filepath.Join(r.dir, distributionStateFile), data, 0600); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Infof("stored %d distributed keytabs in %s", len(b.Keytabs), r.dir)
+	return &storeKeytabsReply{Keytabs: len(b.Keytabs)}, nil
+}
+
+// Take keytab bundles at the distribution address until the context is
+// cancelled, with a fresh bundle key published in the Node annotation for the
+// controller.
+func serveKeytabDistribution(ctx context.Context, cfg *config) error {
+	controller, err := readControllerKey(cfg.Agent.Distribution.ControllerKey)
+	if err != nil {
+		return err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	r := &keytabReceiver{
+		node:       nodeName(),
+		dir:        cmp.Or(cfg.KeytabDir, defaultKeytabDir),
+		key:        key,
+		controller: controller,
+	}
+	if data, err := os.ReadFile(filepath.Join(r.dir, distributionStateFile)); err == nil {
+		if err := json.Unmarshal(data, &r.state); err != nil {
+			log.Warnf("ignoring invalid keytab distribution state: %v", err)
+		}
+	}
+
+	kube, err := newKubeClient(cfg.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	if kube == nil {
+		return errors.New("no Kubernetes API access to publish the bundle key")
+	}
+	patch := map[string]any{"metadata": map[string]any{"annotations": map[string]string{
+		agentKeyAnnotation: base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()),
+	}}}
+	if err := kube.do(ctx, http.MethodPatch, "/api/v1/nodes/"+r.node, "application/merge-patch+json", patch, nil); err != nil {
+		return fmt.Errorf("failed to publish bundle key: %w", err)
+	}
+
+	l, err := net.Listen("tcp", cfg.Agent.Distribution.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen at %s: %w", cfg.Agent.Distribution.Listen, err)
+	}
+	srv := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}))
+	srv.RegisterService(&keytabDistributionDesc, r)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			log.Errorf("keytab distribution failed: %v", err)
+		}
+	}()
+	log.Infof("taking keytab bundles for node %s at %s", r.node, cfg.Agent.Distribution.Listen)
+	return nil
+}
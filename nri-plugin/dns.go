@@ -0,0 +1,197 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDNSTimeout = 2 * time.Second
+	dnsPort           = "53"
+)
+
+// Nameservers the realms, KDCs and NFS servers of workloads are looked up
+// with, instead of those of the resolv.conf of the node, as where the
+// corporate DNS is reachable through some nameservers only.
+type dnsConfig struct {
+	// Nameservers, ip[:port], of names in none of the zones, those of the
+	// node if empty.
+	Nameservers []string `json:"nameservers,omitempty"`
+	// Nameservers of DNS zones, for a split horizon: names in a zone are
+	// looked up with the nameservers of the longest zone they are in.
+	Zones []dnsZoneConfig `json:"zones,omitempty"`
+	// Timeout of a query to a nameserver, 2s by default.
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+type dnsZoneConfig struct {
+	// Zones, as corp.example.com, the names in or below which are looked up
+	// with the nameservers.
+	Zones       []string `json:"zones"`
+	Nameservers []string `json:"nameservers"`
+}
+
+func (c *dnsConfig) validate() error {
+	if err := validNameservers(c.Nameservers); err != nil {
+		return fmt.Errorf("nameservers: %w", err)
+	}
+	var seen []string
+	for i, z := range c.Zones {
+		if len(z.Zones) == 0 {
+			return fmt.Errorf("zones[%d]: zones are required", i)
+		}
+		for _, zone := range z.Zones {
+			zone = dnsName(zone)
+			if zone == "" || strings.ContainsAny(zone, " /@") {
+				return fmt.Errorf("zones[%d]: invalid zone %q", i, zone)
+			}
+			if slices.Contains(seen, zone) {
+				return fmt.Errorf("zones[%d]: zone %s given twice", i, zone)
+			}
+			seen = append(seen, zone)
+		}
+		if len(z.Nameservers) == 0 {
+			return fmt.Errorf("zones[%d]: nameservers are required", i)
+		}
+		if err := validNameservers(z.Nameservers); err != nil {
+			return fmt.Errorf("zones[%d]: nameservers: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Check that nameservers are addresses, as they cannot be looked up.
+func validNameservers(servers []string) error {
+	for _, server := range servers {
+		if net.ParseIP(hostOf(server)) == nil {
+			return fmt.Errorf("%q is not an IP address", server)
+		}
+	}
+	return nil
+}
+
+func (c *dnsConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultDNSTimeout
+}
+
+// Name in lower case without the trailing dot.
+func dnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Resolvers by zone, the longest zones first, and the one of other names.
+type dnsResolvers struct {
+	zones []dnsZone
+	other *net.Resolver
+}
+
+type dnsZone struct {
+	zone     string
+	resolver *net.Resolver
+}
+
+// Resolvers of the plugin, those of the node until set up.
+var resolvers = &dnsResolvers{other: net.DefaultResolver}
+
+// Set up the resolvers of the plugin with the configured nameservers.
+func setupResolvers(cfg dnsConfig) {
+	resolvers = newDNSResolvers(cfg)
+}
+
+func newDNSResolvers(cfg dnsConfig) *dnsResolvers {
+	r := &dnsResolvers{other: net.DefaultResolver}
+	if len(cfg.Nameservers) > 0 {
+		r.other = nameserverResolver(cfg.Nameservers, cfg.timeout())
+	}
+	for _, z := range cfg.Zones {
+		resolver := nameserverResolver(z.Nameservers, cfg.timeout())
+		for _, zone := range z.Zones {
+			r.zones = append(r.zones, dnsZone{zone: dnsName(zone), resolver: resolver})
+		}
+	}
+	slices.SortFunc(r.zones, func(a, b dnsZone) int {
+		return cmp.Compare(len(b.zone), len(a.zone))
+	})
+	return r
+}
+
+// Resolver querying the nameservers, the next one for each query, so that
+// the retries of the Go resolver go to the others if one does not answer.
+// /etc/hosts is still looked at first.
+func nameserverResolver(servers []string, timeout time.Duration) *net.Resolver {
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		addrs[i] = withPort(server, dnsPort)
+	}
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr := addrs[int(next.Add(1)-1)%len(addrs)]
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// Resolver of a name: that of the longest zone it is in, else that of other
+// names.
+func resolverFor(name string) *net.Resolver {
+	r := resolvers
+	name = dnsName(name)
+	for _, z := range r.zones {
+		if name == z.zone || strings.HasSuffix(name, "."+z.zone) {
+			return z.resolver
+		}
+	}
+	return r.other
+}
+
+// errNoRealmRecord is returned when no _kerberos TXT record names the realm of
+// a host.
+var errNoRealmRecord = errors.New("no _kerberos TXT record")
+
+// Realm of a host from the _kerberos TXT record of the host or else of the
+// closest domain above it which has one, as MIT dns_lookup_realm finds it.
+func lookupRealm(ctx context.Context, host string) (string, error) {
+	host = dnsName(hostOf(host))
+	if host == "" || net.ParseIP(host) != nil {
+		return "", errNoRealmRecord
+	}
+	for name := host; strings.Contains(name, "."); _, name, _ = strings.Cut(name, ".") {
+		txt, err := resolverFor(name).LookupTXT(ctx, "_kerberos."+name)
+		if err == nil && len(txt) > 0 && strings.TrimSpace(txt[0]) != "" {
+			return strings.TrimSpace(txt[0]), nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+	return "", fmt.Errorf("%w for %s or its domains", errNoRealmRecord, host)
+}
@@ -0,0 +1,577 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+
+	// Clock offsets from the KDC warned about, and failed at: KDCs refuse
+	// requests more than 5m off by default.
+	doctorSkewWarn = time.Minute
+	doctorSkewFail = 5 * time.Minute
+	// Time each network check is given.
+	doctorTimeout = 5 * time.Second
+)
+
+// Result of the diagnostics of a principal, or of the check of the
+// configuration.
+type doctorReport struct {
+	Principal string        `json:"principal,omitempty"`
+	Checks    []doctorCheck `json:"checks"`
+}
+
+type doctorCheck struct {
+	Check  string `json:"check"`
+	Target string `json:"target,omitempty"`
+	// pass, warn, fail or skip.
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (r *doctorReport) add(check, target, status, format string, args ...any) {
+	r.Checks = append(r.Checks, doctorCheck{Check: check, Target: target, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (r *doctorReport) failed() bool {
+	for _, c := range r.Checks {
+		if c.Status == doctorFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Node-side diagnostics of the path from a pod or principal to its NFS
+// server: `kerberos doctor -pod <namespace>/<name>` or
+// `kerberos doctor -principal <user>@<REALM>`. Exits 1 if a check fails.
+func runDoctor(args []string) {
+	var (
+		configFile, podName, principal string
+		kdc, nfs, export, keytabPath   string
+		serviceKeytab                  string
+		output                         string
+		mount                          bool
+		logOpts                        logOptions
+	)
+
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", defaultConfigFile, "path to the plugin configuration file")
+	fs.StringVar(&podName, "pod", "", "namespace/name of the pod to diagnose, by its annotations")
+	fs.StringVar(&principal, "principal", "", "user@REALM to diagnose, the realm defaulting to defaultRealm")
+	fs.StringVar(&kdc, "kdc", "", "KDC to check instead of those of the pod or realm")
+	fs.StringVar(&nfs, "nfs", "", "NFS server to check instead of those of the pod or realm")
+	fs.StringVar(&export, "export", "/", "export of the NFS server to test-mount")
+	fs.BoolVar(&mount, "mount", true, "test-mount the export")
+	fs.StringVar(&keytabPath, "keytab", "", "keytab of the principal, that of keytabDir by default")
+	fs.StringVar(&serviceKeytab, "service-keytab", "", "keytab of the NFS service principals to decode the PACs of the NFS service tickets with, pac.keytab by default")
+	fs.StringVar(&output, "o", "", "output format, json for the report")
+	logOpts.register(fs)
+	_ = fs.Parse(args)
+
+	if err := logOpts.apply(); err != nil {
+		log.Errorf("invalid logging options: %v", err)
+		os.Exit(1)
+	}
+	if output != "" && output != "json" {
+		log.Errorf("unknown output format %q, must be json", output)
+		os.Exit(1)
+	}
+	cfg, err := loadConfig(configFile, configFile == defaultConfigFile)
+	if err != nil {
+		log.Errorf("failed to load plugin configuration: %v", err)
+		os.Exit(1)
+	}
+	setupResolvers(cfg.DNS)
+
+	ctx := context.Background()
+	kp, err := doctorParams(ctx, cfg, podName, principal)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if kdc != "" {
+		kp.KDC, kp.KDCs, kp.KDCProxy = kdc, nil, nil
+	}
+	if nfs != "" {
+		kp.NFS, kp.NFSServers = nfs, nil
+	}
+	if keytabPath == "" {
+		dir := cfg.KeytabDir
+		if dir == "" {
+			dir = defaultKeytabDir
+		}
+		keytabPath = filepath.Join(dir, kp.User+".keytab")
+	}
+	if !mount {
+		export = ""
+	}
+	if serviceKeytab == "" {
+		serviceKeytab = cfg.PAC.Keytab
+	}
+
+	report := diagnose(ctx, cfg, kp, keytabPath, export)
+	if serviceKeytab != "" {
+		report.checkPAC(kp, serviceKeytab)
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.print(os.Stdout)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if report.failed() {
+		os.Exit(1)
+	}
+}
+
+// Parameters of the pod, resolved from its annotations as for its sandbox, or
+// of the principal with the defaults of its realm.
+func doctorParams(ctx context.Context, cfg *config, podName, principal string) (*kerberosParams, error) {
+	switch {
+	case podName != "" && principal != "":
+		return nil, errors.New("-pod and -principal cannot be given together")
+	case podName != "":
+		return doctorPodParams(ctx, cfg, podName)
+	case principal != "":
+	default:
+		return nil, errors.New("-pod or -principal is required")
+	}
+
+	user, realm, _ := strings.Cut(principal, "@")
+	if err := validateUser(user); err != nil {
+		return nil, err
+	}
+	if realm == "" {
+		realm = cfg.DefaultRealm
+	}
+	if realm == "" {
+		return nil, fmt.Errorf("principal %s has no realm and there is no defaultRealm", principal)
+	}
+	return nodeParams(ctx, cfg, user, realm), nil
+}
+
+// Parameters of a user of a realm with the KDCs, NFS servers and settings
+// the node configuration has for the realm, for workloads without a pod.
+func nodeParams(ctx context.Context, cfg *config, user, realm string) *kerberosParams {
+	kp := &kerberosParams{
+		User:       user,
+		Realm:      realm,
+		Sec:        cfg.NFSSec,
+		NFSVersion: cfg.NFSVersion,
+		Krb5Conf:   &cfg.Krb5Conf,
+		ETypes:     cfg.Crypto.encTypes(),
+		FIPS:       cfg.Crypto.FIPS,
+	}
+	r := cfg.Realms[realm]
+	kdcs, nfs := r.KDCs, r.NFS
+	kp.Domains, kp.KDCProxy = r.Domains, r.KDCProxy
+	if realm == cfg.DefaultRealm {
+		if len(kdcs) == 0 && cfg.DefaultKDC != "" {
+			kdcs = append([]string{cfg.DefaultKDC}, cfg.KDCs...)
+		}
+		if nfs == "" {
+			nfs = cfg.DefaultNFS
+		}
+		if kp.KDCProxy == nil {
+			kp.KDCProxy = cfg.KDCProxy
+		}
+	}
+	if len(kdcs) == 0 {
+		kdcs = newKDCDiscovery(systemClock{}).lookup(ctx, realm)
+	}
+	if len(kdcs) > 0 {
+		kp.KDC, kp.KDCs = kdcs[0], kdcs[1:]
+	}
+	if servers := nfsServerList(nfs); len(servers) > 0 {
+		kp.NFS, kp.NFSServers = servers[0], servers
+	}
+	cfg.applyTrust(kp)
+	return kp
+}
+
+func doctorPodParams(ctx context.Context, cfg *config, podName string) (*kerberosParams, error) {
+	namespace, name, ok := strings.Cut(podName, "/")
+	if !ok {
+		namespace, name = "default", podName
+	}
+	kube, err := newKubeClient(cfg.Kubeconfig)
+	if err == nil && kube == nil {
+		err = errors.New("looking up a pod needs Kubernetes API access")
+	}
+	if err != nil {
+		return nil, err
+	}
+	pod := &prestagePod{}
+	if err := kube.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), "", nil, pod); err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+	sandbox := pod.sandbox()
+	cfg.normalizePod(sandbox)
+	if !cfg.enabled(sandbox) {
+		return nil, fmt.Errorf("pod %s/%s is not annotated %s: enabled", namespace, name, cfg.annotation("kerberos-auth"))
+	}
+
+	p := &plugin{discovery: newKDCDiscovery(systemClock{}), kube: kube, clock: systemClock{}, exec: nodeExec{}}
+	p.cfg.Store(cfg)
+	if p.directory, err = newDirectory(cfg.Directory, p.exec, p.clock); err != nil {
+		return nil, fmt.Errorf("failed to set up the user directory: %w", err)
+	}
+	if len(cfg.SPIFFE.Principals) > 0 {
+		if p.spiffe, err = newSPIFFEClient(cfg.SPIFFE.socket(), kube); err != nil {
+			return nil, fmt.Errorf("failed to set up SPIFFE: %w", err)
+		}
+	}
+	kp := p.podSandboxParams(podLogger(sandbox), cfg, sandbox)
+	if kp == nil {
+		return nil, fmt.Errorf("pod %s/%s has no complete Kerberos parameters in its annotations, see the warnings above", namespace, name)
+	}
+	return kp, nil
+}
+
+// Run the checks, in the order a setup depends on them.
+func diagnose(ctx context.Context, cfg *config, kp *kerberosParams, keytabPath, export string) *doctorReport {
+	r := &doctorReport{Principal: kp.Principal()}
+	r.checkDNS(ctx, kp)
+	r.checkKDCs(ctx, kp)
+
+	krb5, err := nativeKrb5Config(kp)
+	if err == nil && kp.KDCProxy != nil {
+		var stop func()
+		krb5, stop, err = newNativeBackend("", "", cfg.FAST, cfg.Delegation, cfg.ClockSkew, nodeExec{}, systemClock{}).krb5Config(ctx, kp)
+		if err == nil {
+			defer stop()
+		}
+	}
+	if err != nil {
+		r.add("clock", kp.Realm, doctorSkip, "%v", err)
+		r.add("keytab", keytabPath, doctorSkip, "%v", err)
+	} else {
+		r.checkClock(ctx, krb5, kp)
+		r.checkKeytab(ctx, krb5, kp, keytabPath)
+	}
+
+	gssd := newGSSDManager(cfg.GSSD, kp.GSSProxy, false, nodeExec{})
+	if gssd.running(gssdProcessName) {
+		r.add("gssd", gssdProcessName, doctorPass, "running")
+	} else {
+		r.add("gssd", gssdProcessName, doctorFail, "not running, Kerberos NFS mounts cannot get service tickets")
+	}
+
+	for _, server := range kp.nfsServers() {
+		r.checkNFS(ctx, kp, server, export)
+	}
+	return r
+}
+
+// SRV records of the realm, and addresses of its KDCs and the NFS servers.
+func (r *doctorReport) checkDNS(ctx context.Context, kp *kerberosParams) {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	for _, proto := range []string{"tcp", "udp"} {
+		name := "_kerberos._" + proto + "." + kp.Realm
+		_, addrs, err := resolverFor(kp.Realm).LookupSRV(ctx, "kerberos", proto, kp.Realm)
+		if err != nil {
+			r.add("dns", name, doctorWarn, "no SRV records, KDCs are not discovered: %v", err)
+			continue
+		}
+		targets := make([]string, len(addrs))
+		for i, srv := range addrs {
+			targets[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port))
+		}
+		r.add("dns", name, doctorPass, "%s", strings.Join(targets, ", "))
+	}
+	for _, host := range append(kp.kdcList(), kp.nfsServers()...) {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" || net.ParseIP(host) != nil {
+			continue
+		}
+		if kp.aliased(host) {
+			r.add("dns", host, doctorPass, "host alias %s", kp.hostAddress(host))
+			continue
+		}
+		addrs, err := resolverFor(host).LookupHost(ctx, host)
+		if err != nil {
+			r.add("dns", host, doctorFail, "%v", err)
+			continue
+		}
+		r.add("dns", host, doctorPass, "%s", strings.Join(addrs, ", "))
+	}
+}
+
+// KDCs of the principal, the first one first.
+func (kp *kerberosParams) kdcList() []string {
+	if kp.KDC == "" {
+		return kp.KDCs
+	}
+	return append([]string{kp.KDC}, kp.KDCs...)
+}
+
+// Answer of each KDC on 88/tcp and 88/udp to an AS-REQ for the principal.
+// Any Kerberos message, an error asking for pre-authentication as a rule,
+// counts as an answer.
+func (r *doctorReport) checkKDCs(ctx context.Context, kp *kerberosParams) {
+	if kp.KDCProxy != nil {
+		r.add("kdc", kp.KDCProxy.URL, doctorSkip, "KDCs are reached through the KDC proxy, checked with the clock")
+		return
+	}
+	kdcs := kp.kdcList()
+	if len(kdcs) == 0 {
+		r.add("kdc", kp.Realm, doctorFail, "no KDCs configured or discovered")
+		return
+	}
+	msg, err := doctorASReq(kp)
+	if err != nil {
+		r.add("kdc", kp.Realm, doctorSkip, "%v", err)
+		return
+	}
+	for _, kdc := range kdcs {
+		addr := kdcAddress(kp.hostAddress(kdc))
+		for _, proto := range []string{"tcp", "udp"} {
+			target := proto + "/" + addr
+			exchange := exchangeUDP
+			if proto == "tcp" {
+				exchange = exchangeTCP
+			}
+			ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+			start := time.Now()
+			reply, err := exchange(ctx, addr, msg)
+			cancel()
+			switch {
+			case err != nil:
+				r.add("kdc", target, doctorFail, "%v", err)
+			case !isKerberosReply(reply):
+				r.add("kdc", target, doctorFail, "answered with something else than a Kerberos message")
+			default:
+				r.add("kdc", target, doctorPass, "answered in %s", time.Since(start).Round(time.Millisecond))
+			}
+		}
+	}
+}
+
+func doctorASReq(kp *kerberosParams) ([]byte, error) {
+	cfg, err := nativeKrb5Config(kp)
+	if err != nil {
+		return nil, err
+	}
+	req, err := messages.NewASReqForTGT(kp.Realm, cfg, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, kp.principalName()))
+	if err != nil {
+		return nil, err
+	}
+	return req.Marshal()
+}
+
+func isKerberosReply(reply []byte) bool {
+	var rep messages.ASRep
+	if rep.Unmarshal(reply) == nil {
+		return true
+	}
+	var krbErr messages.KRBError
+	return krbErr.Unmarshal(reply) == nil
+}
+
+func exchangeUDP(ctx context.Context, addr string, msg []byte) ([]byte, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Offset of the node clock from the KDC.
+func (r *doctorReport) checkClock(ctx context.Context, cfg *krb5config.Config, kp *kerberosParams) {
+	offset, err := measureClockOffset(ctx, cfg, kp)
+	if err != nil {
+		r.add("clock", kp.Realm, doctorSkip, "cannot measure the offset from the KDC: %v", err)
+		return
+	}
+	status := doctorPass
+	switch abs := max(offset, -offset); {
+	case abs >= doctorSkewFail:
+		status = doctorFail
+	case abs >= doctorSkewWarn:
+		status = doctorWarn
+	}
+	r.add("clock", kp.Realm, status, "%s", describeOffset(offset))
+}
+
+// Key versions and enctypes of the principal in its keytab, checked with the
+// KDC as before obtaining credentials.
+func (r *doctorReport) checkKeytab(ctx context.Context, cfg *krb5config.Config, kp *kerberosParams, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		r.add("keytab", path, doctorSkip, "%v, it may come from another credential source", err)
+		return
+	}
+	kt := &keytab.Keytab{}
+	if err := kt.Unmarshal(data); err != nil {
+		r.add("keytab", path, doctorFail, "invalid keytab: %v", err)
+		return
+	}
+	keys := principalKeys(kt, kp.Principal())
+	if len(keys) == 0 {
+		r.add("keytab", path, doctorFail, "no keys of %s", kp.Principal())
+		return
+	}
+	etypes := make([]int32, 0, len(keys))
+	for etype := range keys {
+		etypes = append(etypes, etype)
+	}
+	detail := fmt.Sprintf("kvno %s, %s", joinKVNOs(keys.kvnos()), etypeNames(etypes))
+	if err := preflightKeytab(withLogger(ctx, log.WithField("check", "keytab")), cfg, kp, kt); err != nil {
+		r.add("keytab", path, doctorFail, "%s: %v", detail, err)
+		return
+	}
+	r.add("keytab", path, doctorPass, "%s", detail)
+}
+
+// NFS versions of the server, and a test mount of the export with the security
+// flavor of the principal. The mount is made by root, with the credentials
+// rpc.gssd has for it: those of the host keytab as a rule.
+func (r *doctorReport) checkNFS(ctx context.Context, kp *kerberosParams, server, export string) {
+	vers := kp.NFSVersion
+	if vers == "" {
+		vers = "4"
+	}
+	err := probeNFSVersion(ctx, kp.hostAddress(server), vers)
+	switch {
+	case errors.Is(err, errNFSVersion):
+		r.add("nfs", server, doctorFail, "%v: %s", err, vers)
+		return
+	case err != nil:
+		r.add("nfs", server, doctorFail, "cannot ask for NFS version %s: %v", vers, err)
+		return
+	}
+	r.add("nfs", server, doctorPass, "NFS version %s supported", vers)
+
+	if export == "" {
+		return
+	}
+	source := server + ":" + export
+	sec := kp.Sec
+	if sec == "" {
+		sec = "krb5"
+	}
+	dir, err := os.MkdirTemp("", "krb-doctor")
+	if err != nil {
+		r.add("mount", source, doctorSkip, "%v", err)
+		return
+	}
+	defer os.Remove(dir)
+	options := []string{"sec=" + sec, "vers=" + vers, "ro", "soft", "timeo=50", "retrans=1"}
+	mounter := nodeMounter{exec: nodeExec{}}
+	if err := mounter.Mount(ctx, "nfs", source, dir, options); err != nil {
+		r.add("mount", source, doctorFail, "sec=%s: %v", sec, err)
+		return
+	}
+	defer func() { _ = mounter.Unmount(dir) }()
+	if err := mounter.Stat(ctx, dir); err != nil {
+		r.add("mount", source, doctorFail, "mounted with sec=%s, but: %v", sec, err)
+		return
+	}
+	r.add("mount", source, doctorPass, "mounted with sec=%s", sec)
+}
+
+// Groups in the PACs of the NFS service tickets in the credential cache of the
+// principal, which NFS servers mapping PACs give it: the service keytab must be
+// at hand, as on the NFS server.
+func (r *doctorReport) checkPAC(kp *kerberosParams, serviceKeytab string) {
+	kt, err := loadKeytab(serviceKeytab)
+	if err != nil {
+		r.add("pac", serviceKeytab, doctorSkip, "%v", err)
+		return
+	}
+	pacs, err := servicePACs(kp.CCName, kt)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		r.add("pac", kp.CCName, doctorSkip, "no credential cache, the principal has no credentials on the node")
+		return
+	case err != nil:
+		r.add("pac", kp.CCName, doctorFail, "%v", err)
+		return
+	case len(pacs) == 0:
+		r.add("pac", kp.CCName, doctorWarn, "no NFS service tickets in the credential cache yet")
+		return
+	}
+	for _, service := range slices.Sorted(maps.Keys(pacs)) {
+		if groups := pacs[service]; groups != nil {
+			r.add("pac", service, doctorPass, "%s", groups)
+		} else {
+			r.add("pac", service, doctorPass, "no PAC logon information, the NFS server maps the principal itself")
+		}
+	}
+}
+
+// Print the report as a table.
+func (r *doctorReport) print(w io.Writer) error {
+	if r.Principal != "" {
+		fmt.Fprintf(w, "Principal: %s\n\n", r.Principal)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tTARGET\tSTATUS\tDETAIL")
+	for _, c := range r.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Check, c.Target, strings.ToUpper(c.Status), c.Detail)
+	}
+	return tw.Flush()
+}
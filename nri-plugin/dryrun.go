@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Evaluate the credentials a pod would be set up with in dry-run mode,
+// logging them and posting a KerberosDryRun Event, without obtaining them.
+// The parameters of pods allowed them are remembered for their containers.
+func (p *plugin) dryRunSetup(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams) {
+	if err := p.checkPolicy(ctx, cfg, pod, kp); err != nil {
+		dryRunActions.WithLabelValues("deny").Inc()
+		l.Warnf("dry run: credentials for %s would be denied: %v", kp.Principal(), err)
+		p.events.warn(pod, reasonPolicyDenied, "dry run: credentials for %s would be denied: %v", kp.Principal(), err)
+		return
+	}
+	sec := kp.Sec
+	if sec == "" {
+		sec = "any"
+	}
+	dryRunActions.WithLabelValues("setup").Inc()
+	l.Infof("dry run: would obtain credentials for %s from %s into %s, for NFS servers %s with sec=%s",
+		kp.Principal(), kp.KDC, kp.CCName, strings.Join(kp.nfsServers(), ","), sec)
+	p.events.normal(pod, reasonDryRun, "would obtain credentials for %s from %s for NFS servers %s with sec=%s",
+		kp.Principal(), kp.KDC, strings.Join(kp.nfsServers(), ","), sec)
+	if kp.Container == "" {
+		p.Lock()
+		p.dryRuns[pod.GetId()] = kp
+		p.Unlock()
+	}
+}
+
+// Evaluate what creating a container would do in dry-run mode: the
+// credentials set up for a renewal sidecar or a container overriding the
+// annotations of the pod, the injection of the credential cache and the
+// rewriting or failing of its NFS volume mounts. The container is created
+// as it is.
+func (p *plugin) dryRunContainer(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, container *api.Container) {
+	var kp *kerberosParams
+	if cfg.ownCredentials(pod, container.GetName()) {
+		if kp = p.resolveParams(l, cfg, pod, containerSettings(l, cfg, pod, container.GetName())); kp == nil {
+			return
+		}
+		kp.Container = container.GetName()
+		p.dryRunSetup(ctx, l, cfg, pod, kp)
+	} else {
+		p.Lock()
+		kp = p.dryRuns[pod.GetId()]
+		p.Unlock()
+		if kp == nil {
+			var sidecar bool
+			if kp, sidecar = p.containerParams(ctx, l, cfg, pod, container); !sidecar || kp == nil {
+				return
+			}
+			p.dryRunSetup(ctx, l, cfg, pod, kp)
+		}
+	}
+	if pod.GetUid() == "" {
+		return
+	}
+
+	dryRunActions.WithLabelValues("inject").Inc()
+	l.Infof("dry run: would inject the credential cache of %s", kp.Principal())
+	var err error
+	if cfg.RewriteNFSMounts {
+		var rewritten []string
+		rewritten, err = rewriteNFSMounts(p.mounter, &api.ContainerAdjustment{}, container, kp, cfg.NFSProto)
+		for _, dest := range rewritten {
+			dryRunActions.WithLabelValues("rewrite").Inc()
+			l.Infof("dry run: would rewrite NFS volume mount %s to the options the pod requires", dest)
+		}
+	} else {
+		err = checkNFSMounts(p.mounter, container, kp)
+	}
+	if err != nil {
+		dryRunActions.WithLabelValues("fail").Inc()
+		reason := reasonWeakSecurity
+		if errors.Is(err, errNFSVersion) {
+			reason = reasonNFSVersionMismatch
+		}
+		l.Warnf("dry run: container would be failed: %v", err)
+		p.events.warn(pod, reason, "dry run: container %s would be failed: %v", container.GetName(), err)
+	}
+}
@@ -0,0 +1,29 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package e2e is the end-to-end test of the Kerberos NRI plugin on kind, as
+// e2e/run.sh of the repository runs it, built with the e2e tag only:
+//
+//	go test -tags e2e -timeout 30m -v ./e2e
+//
+// It creates a kind cluster with NRI enabled, runs the KDC and the Kerberized
+// knfsd of e2e/images in it, deploys the plugin from e2e/manifests as a
+// DaemonSet and checks that a pod of user10002 writes and reads its NFS home
+// directory mounted with sec=krb5p, with the credentials the plugin obtained
+// for it. It needs docker, kind and kubectl, and the nfsd and rpcsec_gss_krb5
+// modules on the host, and takes the E2E_KEEP, E2E_CLUSTER, E2E_NODE_IMAGE and
+// E2E_IP_FAMILY settings of run.sh from the environment.
+package e2e
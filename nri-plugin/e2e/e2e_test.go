@@ -0,0 +1,289 @@
+//go:build e2e
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	namespace   = "kerberos-e2e"
+	realm       = "EXAMPLE.COM"
+	kdcHostname = "kdc.e2e.test"
+	nfsHostname = "nfs.e2e.test"
+	userName    = "user10002"
+	userID      = "10002"
+	timeout     = "180s"
+
+	// Addresses of the KDC and NFS services in the manifests, of IPv4.
+	manifestKDCIP = "10.96.88.88"
+	manifestNFSIP = "10.96.88.20"
+)
+
+// Service subnet and addresses of the KDC and the NFS server of an IP family.
+type ipFamily struct {
+	serviceSubnet string
+	kdcIP         string
+	nfsIP         string
+}
+
+var ipFamilies = map[string]ipFamily{
+	"ipv4": {serviceSubnet: "10.96.0.0/16", kdcIP: manifestKDCIP, nfsIP: manifestNFSIP},
+	"ipv6": {serviceSubnet: "fd00:10:96::/112", kdcIP: "fd00:10:96::5858", nfsIP: "fd00:10:96::5814"},
+}
+
+// A run of the suite on its kind cluster.
+type suite struct {
+	t       *testing.T
+	ctx     context.Context
+	repoDir string
+	e2eDir  string
+	cluster string
+	family  string
+	ipFamily
+}
+
+func newSuite(t *testing.T) *suite {
+	for _, tool := range []string{"docker", "kind", "kubectl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Fatalf("%s not found", tool)
+		}
+	}
+	for _, module := range []string{"nfsd", "rpcsec_gss_krb5"} {
+		if !moduleLoaded(module) && exec.Command("modprobe", module).Run() != nil {
+			t.Logf("kernel module %s not loaded, run: sudo modprobe %s", module, module)
+		}
+	}
+
+	family := os.Getenv("E2E_IP_FAMILY")
+	if family == "" {
+		family = "ipv4"
+	}
+	ips, ok := ipFamilies[family]
+	if !ok {
+		t.Fatalf("E2E_IP_FAMILY must be ipv4 or ipv6, not %s", family)
+	}
+	cluster := os.Getenv("E2E_CLUSTER")
+	if cluster == "" {
+		cluster = "nri-kerberos-e2e"
+	}
+	repoDir, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &suite{
+		t:        t,
+		ctx:      t.Context(),
+		repoDir:  repoDir,
+		e2eDir:   filepath.Join(repoDir, "e2e"),
+		cluster:  cluster,
+		family:   family,
+		ipFamily: ips,
+	}
+}
+
+func moduleLoaded(module string) bool {
+	data, err := os.ReadFile("/proc/modules")
+	return err == nil && regexp.MustCompile(`(?m)^`+module+` `).Match(data)
+}
+
+// Run a command, with the input given, failing the test if it fails. Returns
+// its output, trimmed.
+func (s *suite) run(stdin string, name string, args ...string) string {
+	s.t.Helper()
+	out, err := s.output(stdin, name, args...)
+	if err != nil {
+		s.t.Fatalf("%s %s failed: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return out
+}
+
+func (s *suite) output(stdin string, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(s.ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return strings.TrimSpace(out.String()), err
+}
+
+func (s *suite) kube(args ...string) string {
+	s.t.Helper()
+	return s.run("", "kubectl", append([]string{"--context", "kind-" + s.cluster}, args...)...)
+}
+
+// Apply a manifest of e2e/manifests with the addresses of the IP family of the run.
+func (s *suite) applyManifest(name string) {
+	s.t.Helper()
+	data, err := os.ReadFile(filepath.Join(s.e2eDir, "manifests", name))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	manifest := strings.NewReplacer(manifestKDCIP, s.kdcIP, manifestNFSIP, s.nfsIP).Replace(string(data))
+	s.run(manifest, "kubectl", "--context", "kind-"+s.cluster, "apply", "-f", "-")
+}
+
+func (s *suite) nodes() []string {
+	s.t.Helper()
+	return strings.Fields(s.run("", "kind", "get", "nodes", "--name", s.cluster))
+}
+
+// Logs and state of the components, to tell why a step failed.
+func (s *suite) dumpState() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	s.ctx = ctx
+	kube := []string{"kubectl", "--context", "kind-" + s.cluster}
+	for _, args := range [][]string{
+		append(kube, "get", "pods", "-A", "-o", "wide"),
+		append(kube, "-n", namespace, "describe", "pod", "client-"+userName),
+		append(kube, "-n", "nri-kerberos", "logs", "ds/nri-kerberos", "--tail=200"),
+		append(kube, "-n", namespace, "logs", "deploy/kdc", "--tail=100"),
+		append(kube, "-n", namespace, "logs", "deploy/nfs-server", "--tail=100"),
+	} {
+		out, _ := s.output("", args[0], args[1:]...)
+		s.t.Logf("%s:\n%s", strings.Join(args, " "), out)
+	}
+	nodes, _ := s.output("", "kind", "get", "nodes", "--name", s.cluster)
+	for _, node := range strings.Fields(nodes) {
+		out, _ := s.output("", "docker", "exec", node, "journalctl", "-u", "rpc-gssd", "--no-pager", "-n", "100")
+		s.t.Logf("rpc-gssd of %s:\n%s", node, out)
+	}
+}
+
+func (s *suite) createCluster() {
+	s.t.Logf("creating kind cluster %s (%s)", s.cluster, s.family)
+	data, err := os.ReadFile(filepath.Join(s.e2eDir, "kind-config.yaml"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	kindConfig := regexp.MustCompile(`serviceSubnet: .*`).ReplaceAllLiteralString(string(data),
+		fmt.Sprintf("ipFamily: %s\n  serviceSubnet: %s", s.family, s.serviceSubnet))
+	path := filepath.Join(s.t.TempDir(), "kind-config.yaml")
+	if err := os.WriteFile(path, []byte(kindConfig), 0644); err != nil {
+		s.t.Fatal(err)
+	}
+	args := []string{"create", "cluster", "--name", s.cluster, "--config", path, "--wait", timeout}
+	if image := os.Getenv("E2E_NODE_IMAGE"); image != "" {
+		args = append(args, "--image", image)
+	}
+	s.run("", "kind", args...)
+	s.t.Cleanup(func() {
+		if s.t.Failed() {
+			s.dumpState()
+		}
+		if os.Getenv("E2E_KEEP") == "1" {
+			s.t.Logf("keeping cluster %s, delete it with: kind delete cluster --name %s", s.cluster, s.cluster)
+			return
+		}
+		if err := exec.Command("kind", "delete", "cluster", "--name", s.cluster).Run(); err != nil {
+			s.t.Logf("failed to delete cluster %s: %v", s.cluster, err)
+		}
+	})
+}
+
+func (s *suite) buildImages() {
+	s.t.Log("building images")
+	s.run("", "docker", "build", "-t", "nri-kerberos:latest",
+		"-f", filepath.Join(s.repoDir, "containers", "nri-kerberos", "Dockerfile"), s.repoDir)
+	s.run("", "docker", "build", "-t", "e2e-kdc:latest", filepath.Join(s.e2eDir, "images", "kdc"))
+	s.run("", "docker", "build", "-t", "e2e-nfs-server:latest", filepath.Join(s.e2eDir, "images", "nfs-server"))
+	s.run("", "kind", "load", "docker-image", "--name", s.cluster, "nri-kerberos:latest", "e2e-kdc:latest", "e2e-nfs-server:latest")
+}
+
+// Give the node the names of the KDC and the NFS server, the NFS client tools,
+// and the credentials of root for the mount, as vm-scripts/install-k8s.sh and
+// deploy-k8s.sh do: the kubelet mounts the NFS volumes and rpc.gssd runs on the
+// node, outside the cluster DNS.
+func (s *suite) prepareNodes() {
+	s.t.Log("preparing the nodes")
+	script := fmt.Sprintf(`echo "%[1]s %[2]s" >> /etc/hosts
+echo "%[3]s %[4]s" >> /etc/hosts
+apt-get update -qq
+DEBIAN_FRONTEND=noninteractive apt-get install -y -qq nfs-common krb5-user > /dev/null
+curl -fsS -o /etc/krb5.conf "http://%[2]s:8080/krb5.conf"
+curl -fsS -o /etc/krb5.keytab "http://%[2]s:8080/keytabs/nfs.keytab"
+chmod 600 /etc/krb5.keytab
+mkdir -p /etc/nfs.conf.d
+cat > /etc/nfs.conf.d/e2e.conf <<CONF
+[gssd]
+use-machine-creds=0
+preferred-realm=%[5]s
+CONF
+KRB5CCNAME=FILE:/tmp/krb5cc_0 kinit -k -t /etc/krb5.keytab "nfs/%[4]s@%[5]s"
+systemctl restart rpc-gssd
+`, s.kdcIP, kdcHostname, s.nfsIP, nfsHostname, realm)
+	for _, node := range s.nodes() {
+		s.run(script, "docker", "exec", "-i", node, "bash", "-euo", "pipefail")
+	}
+}
+
+func TestKerberizedNFS(t *testing.T) {
+	s := newSuite(t)
+	s.createCluster()
+	s.buildImages()
+
+	s.applyManifest("kdc.yaml")
+	s.kube("-n", namespace, "rollout", "status", "deploy/kdc", "--timeout", timeout)
+	t.Logf("KDC serving %s at %s", realm, kdcHostname)
+
+	s.prepareNodes()
+
+	s.applyManifest("nfs-server.yaml")
+	s.kube("-n", namespace, "rollout", "status", "deploy/nfs-server", "--timeout", timeout)
+	t.Logf("NFS server exporting with sec=krb5p at %s", nfsHostname)
+
+	s.applyManifest("nri-kerberos.yaml")
+	s.kube("-n", "nri-kerberos", "rollout", "status", "ds/nri-kerberos", "--timeout", timeout)
+
+	pod := "client-" + userName
+	home := "/home/" + userName
+	s.kube("apply", "-f", filepath.Join(s.e2eDir, "manifests", "workload.yaml"))
+	s.kube("-n", namespace, "wait", "pod", pod, "--for", "condition=Ready", "--timeout", timeout)
+
+	if mount := s.kube("-n", namespace, "exec", pod, "--", "grep", " "+home+" nfs", "/proc/mounts"); !strings.Contains(mount, "sec=krb5p") {
+		t.Fatalf("home directory not mounted with sec=krb5p: %s", mount)
+	}
+
+	s.kube("-n", namespace, "exec", pod, "--", "sh", "-c", "echo read-write > "+home+"/e2e-rw.txt")
+	if content := s.kube("-n", namespace, "exec", pod, "--", "cat", home+"/e2e-rw.txt"); content != "read-write" {
+		t.Fatalf("read back %q from the export", content)
+	}
+
+	// e2e.txt is written by the workload itself on starting
+	if owner := s.kube("-n", namespace, "exec", "deploy/nfs-server", "--", "stat", "-c", "%u", "/export/home/"+userName+"/e2e.txt"); owner != userID {
+		t.Fatalf("file written by the pod is owned by %s on the server, not %s", owner, userID)
+	}
+
+	for _, node := range s.nodes() {
+		t.Log(s.run("", "docker", "exec", node, "klist", "-c", "FILE:/tmp/krb5cc_"+userID))
+	}
+}
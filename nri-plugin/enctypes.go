@@ -0,0 +1,130 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// Enctypes permitted in FIPS mode unless configured: AES only.
+var fipsEncTypes = []string{
+	"aes256-cts-hmac-sha384-192",
+	"aes128-cts-hmac-sha256-128",
+	"aes256-cts-hmac-sha1-96",
+	"aes128-cts-hmac-sha1-96",
+}
+
+// Enctypes of the tickets and keys of the workloads.
+type cryptoConfig struct {
+	// Enctypes permitted, by their MIT names, in order of preference. Passed to
+	// kinit and written into the generated krb5.conf files as the default and
+	// permitted enctypes. Those of the Kerberos libraries if empty, the AES
+	// ones in FIPS mode.
+	EncTypes []string `json:"encTypes,omitempty"`
+	// Refuse the RC4 and DES enctypes, in the config and in keytabs.
+	FIPS bool `json:"fips,omitempty"`
+}
+
+func (c *cryptoConfig) validate() error {
+	for _, name := range c.EncTypes {
+		etype := etypeID.EtypeSupported(name)
+		if etype == 0 {
+			return fmt.Errorf("encTypes: unsupported enctype %q", name)
+		}
+		if c.FIPS && weakEType(etype) {
+			return fmt.Errorf("encTypes: enctype %q not permitted in FIPS mode", name)
+		}
+	}
+	return nil
+}
+
+// Enctypes permitted, nil for the defaults of the Kerberos libraries.
+func (c *cryptoConfig) encTypes() []string {
+	if len(c.EncTypes) == 0 && c.FIPS {
+		return fipsEncTypes
+	}
+	return c.EncTypes
+}
+
+// RC4 and DES enctypes, refused in FIPS mode.
+func weakEType(etype int32) bool {
+	switch etype {
+	case etypeID.DES_CBC_CRC, etypeID.DES_CBC_MD4, etypeID.DES_CBC_MD5, etypeID.DES_CBC_RAW,
+		etypeID.DES3_CBC_MD5, etypeID.DES3_CBC_RAW, etypeID.DES3_CBC_SHA1, etypeID.DES_HMAC_SHA1,
+		etypeID.DES3_CBC_SHA1_KD, etypeID.RC4_HMAC, etypeID.RC4_HMAC_EXP:
+		return true
+	}
+	return false
+}
+
+// Whether an enctype is permitted for the workload.
+func (kp *kerberosParams) permittedEType(etype int32) bool {
+	if kp.FIPS && weakEType(etype) {
+		return false
+	}
+	if len(kp.ETypes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(kp.ETypes, func(name string) bool {
+		return etypeID.ETypesByName[name] == etype
+	})
+}
+
+// Check the keys of the workload in a keytab against the enctypes permitted,
+// returning those which are. In FIPS mode keytabs with RC4 or DES keys of the
+// workload are refused, otherwise keys of other enctypes are left unused.
+func checkKeytabPolicy(kp *kerberosParams, keys keytabKeys) (keytabKeys, error) {
+	permitted := keytabKeys{}
+	var refused []int32
+	for etype, kvnos := range keys {
+		if kp.permittedEType(etype) {
+			permitted[etype] = kvnos
+		} else {
+			refused = append(refused, etype)
+		}
+	}
+	slices.Sort(refused)
+	if kp.FIPS {
+		if weak := slices.DeleteFunc(slices.Clone(refused), func(etype int32) bool { return !weakEType(etype) }); len(weak) > 0 {
+			return nil, fmt.Errorf("%w: keytab has keys of %s of enctypes not permitted in FIPS mode: %s",
+				errKeytabMismatch, kp.Principal(), etypeNames(weak))
+		}
+	}
+	if len(keys) > 0 && len(permitted) == 0 {
+		return nil, fmt.Errorf("%w: keytab has no keys of %s of the permitted enctypes %s, only %s",
+			errKeytabMismatch, kp.Principal(), strings.Join(kp.ETypes, ","), etypeNames(refused))
+	}
+	return permitted, nil
+}
+
+// Load a keytab and check the keys of the workload in it against the enctypes
+// permitted.
+func loadPermittedKeytab(kp *kerberosParams, path string) (*keytab.Keytab, error) {
+	kt, err := keytab.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load keytab %q: %w", errKeytabUnavailable, path, err)
+	}
+	if _, err := checkKeytabPolicy(kp, principalKeys(kt, kp.Principal())); err != nil {
+		return nil, err
+	}
+	return kt, nil
+}
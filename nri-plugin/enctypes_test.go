@@ -0,0 +1,123 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+)
+
+func TestFIPSEncTypes(t *testing.T) {
+	c := &cryptoConfig{FIPS: true}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range c.encTypes() {
+		if weakEType(etypeID.EtypeSupported(name)) {
+			t.Errorf("FIPS enctypes %q have %s", c.encTypes(), name)
+		}
+	}
+	for _, name := range []string{"rc4-hmac", "des-cbc-crc", "des-cbc-md5", "des3-cbc-sha1"} {
+		c := &cryptoConfig{FIPS: true, EncTypes: []string{"aes256-cts-hmac-sha1-96", name}}
+		if err := c.validate(); err == nil {
+			t.Errorf("encTypes with %s validated in FIPS mode", name)
+		}
+	}
+	// gokrb5 has no DES at all
+	if err := (&cryptoConfig{EncTypes: []string{"aes256-cts-hmac-sha1-96", "rc4-hmac"}}).validate(); err != nil {
+		t.Errorf("encTypes with rc4-hmac refused without FIPS mode: %v", err)
+	}
+}
+
+func TestCheckKeytabPolicy(t *testing.T) {
+	const (
+		aes256 = etypeID.AES256_CTS_HMAC_SHA1_96
+		aes128 = etypeID.AES128_CTS_HMAC_SHA1_96
+		rc4    = etypeID.RC4_HMAC
+		des    = etypeID.DES_CBC_MD5
+	)
+	for _, tc := range []struct {
+		name   string
+		fips   bool
+		etypes []string
+		keys   []int32
+		// Enctypes of the permitted keys, nil for an error.
+		want []int32
+	}{{
+		name: "any",
+		keys: []int32{aes256, rc4, des},
+		want: []int32{aes256, rc4, des},
+	}, {
+		name:   "configured enctypes",
+		etypes: []string{"aes256-cts-hmac-sha1-96"},
+		keys:   []int32{aes256, aes128, rc4},
+		want:   []int32{aes256},
+	}, {
+		name: "fips",
+		fips: true,
+		keys: []int32{aes256, aes128},
+		want: []int32{aes256, aes128},
+	}, {
+		name:   "fips with configured enctypes",
+		fips:   true,
+		etypes: []string{"aes128-cts-hmac-sha1-96"},
+		keys:   []int32{aes256, aes128},
+		want:   []int32{aes128},
+	}, {
+		name: "fips refusing rc4",
+		fips: true,
+		keys: []int32{aes256, rc4},
+	}, {
+		name: "fips refusing des",
+		fips: true,
+		keys: []int32{aes256, des},
+	}, {
+		name:   "no permitted keys",
+		etypes: []string{"aes256-cts-hmac-sha1-96"},
+		keys:   []int32{aes128, rc4},
+	}, {
+		name:   "no permitted keys in fips mode",
+		fips:   true,
+		etypes: []string{"aes256-cts-hmac-sha1-96"},
+		keys:   []int32{aes128},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			kp := &kerberosParams{User: "alice", Realm: "EXAMPLE.COM", FIPS: tc.fips, ETypes: tc.etypes}
+			keys := keytabKeys{}
+			for _, etype := range tc.keys {
+				keys[etype] = []uint32{1}
+			}
+			permitted, err := checkKeytabPolicy(kp, keys)
+			if tc.want == nil {
+				if !errors.Is(err, errKeytabMismatch) {
+					t.Errorf("checkKeytabPolicy() = %v, %v, want %v", permitted, err, errKeytabMismatch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := slices.Sorted(maps.Keys(permitted)); !slices.Equal(got, slices.Sorted(slices.Values(tc.want))) {
+				t.Errorf("permitted enctypes %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	// Pod annotation, without prefix, asking for a principal of the pod's own.
+	ephemeralAnnotation = "kerberos-ephemeral"
+
+	defaultEphemeralName     = "{{.user}}/{{.uid}}"
+	defaultEphemeralLifetime = 24 * time.Hour
+	// File in the keytab directory of a pod listing the ephemeral principals
+	// created for it, to be deleted when it is removed.
+	ephemeralPrincipalsFile = "ephemeral-principals"
+)
+
+// Principals created for single pods and deleted with them.
+type ephemeralConfig struct {
+	// Create a principal for each pod annotated nri.io/kerberos-ephemeral: "true"
+	// at setup, and delete it when the pod is removed.
+	Enabled bool `json:"enabled,omitempty"`
+	// Template of the principal names, given the fields of principal
+	// templates, "{{.user}}/{{.uid}}" by default.
+	Name string `json:"name,omitempty"`
+	// Time after which the principals expire even if not deleted, as for pods
+	// removed while the plugin was not running, 24h by default.
+	Lifetime duration `json:"lifetime,omitempty"`
+	// kadmin for an MIT Kerberos admin server, ldap for Active Directory.
+	Backend string `json:"backend,omitempty"`
+	// MIT Kerberos admin server.
+	Kadmin kadminConfig `json:"kadmin,omitempty"`
+	// Active Directory domain controller.
+	LDAP adConfig `json:"ldap,omitempty"`
+}
+
+func (c *ephemeralConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultEphemeralName
+}
+
+func (c *ephemeralConfig) lifetime() time.Duration {
+	if c.Lifetime.Duration > 0 {
+		return c.Lifetime.Duration
+	}
+	return defaultEphemeralLifetime
+}
+
+// Source of the keytabs of ephemeral principals, which it creates.
+type ephemeralPrincipals struct {
+	cfg   ephemeralConfig
+	admin kdcAdmin
+	clock Clock
+	// Keytab directory of a pod, and creation of it.
+	dir   func(*api.PodSandbox) string
+	mkdir func(*api.PodSandbox) error
+
+	sync.Mutex
+}
+
+// Set up ephemeral principals, or nil if not enabled.
+func newEphemeralPrincipals(cfg ephemeralConfig, dir func(*api.PodSandbox) string, mkdir func(*api.PodSandbox) error, exec Exec, clock Clock) (*ephemeralPrincipals, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if _, err := parsePrincipalTemplate(cfg.name()); err != nil {
+		return nil, err
+	}
+	admin, err := newKDCAdmin(cfg.Backend, cfg.Kadmin, cfg.LDAP, exec)
+	if err != nil {
+		return nil, err
+	}
+	return &ephemeralPrincipals{cfg: cfg, admin: admin, clock: clock, dir: dir, mkdir: mkdir}, nil
+}
+
+// Name of the ephemeral principal of a pod, without realm.
+func (e *ephemeralPrincipals) principalName(pod *api.PodSandbox, user, realm string) (string, error) {
+	if pod.GetUid() == "" {
+		return "", errors.New("ephemeral principals need the pod UID")
+	}
+	return renderPrincipal(e.cfg.name(), principalTemplateData(pod, user, realm))
+}
+
+func (e *ephemeralPrincipals) Name() string {
+	return "ephemeral principal"
+}
+
+// Create the principal of the pod, or return the keytab it was created with.
+// The principal is recorded before it is created, so that it is deleted
+// with the pod even if its creation did not complete.
+func (e *ephemeralPrincipals) Fetch(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) (*credential, error) {
+	e.Lock()
+	defer e.Unlock()
+	dir := e.dir(pod)
+	recorded := e.recorded(dir)
+	if slices.Contains(recorded, kp.Principal()) {
+		if kt, err := os.ReadFile(filepath.Join(dir, kp.User+".keytab")); err == nil {
+			return &credential{Keytab: kt}, nil
+		}
+	} else {
+		if err := e.mkdir(pod); err != nil {
+			return nil, fmt.Errorf("failed to create keytab directory: %w", err)
+		}
+		list := strings.Join(append(recorded, kp.Principal()), "\n") + "\n"
+		if err := os.WriteFile(filepath.Join(dir, ephemeralPrincipalsFile), []byte(list), 0600); err != nil {
+			return nil, fmt.Errorf("failed to record ephemeral principal: %w", err)
+		}
+	}
+
+	kt, err := e.admin.provision(ctx, kp.Principal(), e.clock.Now().Add(e.cfg.lifetime()))
+	ephemeralOps.WithLabelValues("create", result(err)).Inc()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", kp.Principal(), err)
+	}
+	loggerFrom(ctx).Infof("created ephemeral principal %s", kp.Principal())
+	return &credential{Keytab: kt}, nil
+}
+
+// Ephemeral principals recorded in a keytab directory.
+func (e *ephemeralPrincipals) recorded(dir string) []string {
+	data, err := os.ReadFile(filepath.Join(dir, ephemeralPrincipalsFile))
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(bytes.TrimSpace(data)))
+}
+
+// Delete the ephemeral principals of a removed pod. Those that cannot be
+// deleted expire at the end of their lifetime.
+func (e *ephemeralPrincipals) release(ctx context.Context, pod *api.PodSandbox) error {
+	if e == nil || pod.GetUid() == "" {
+		return nil
+	}
+	e.Lock()
+	defer e.Unlock()
+	dir := e.dir(pod)
+	var errs []error
+	for _, principal := range e.recorded(dir) {
+		err := e.admin.deprovision(ctx, principal)
+		ephemeralOps.WithLabelValues("delete", result(err)).Inc()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete ephemeral principal %s: %w", principal, err))
+			continue
+		}
+		podLogger(pod).Infof("deleted ephemeral principal %s", principal)
+	}
+	if err := os.Remove(filepath.Join(dir, ephemeralPrincipalsFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/krberror"
+)
+
+// Classes of credential setup failures, usable with errors.Is.
+var (
+	errKeytabUnavailable = errors.New("keytab unavailable")
+	// The keytab holds no keys of the principal, or not of the key version or
+	// an enctype the KDC has.
+	errKeytabMismatch   = errors.New("keytab does not match the KDC")
+	errKDCUnreachable   = errors.New("KDC unreachable")
+	errPrincipalUnknown = errors.New("principal unknown to KDC")
+	errPrincipalRevoked = errors.New("principal revoked by KDC")
+	errPreauthFailed    = errors.New("pre-authentication failed")
+	errPasswordExpired  = errors.New("password of principal expired")
+	errKDCRejected      = errors.New("request rejected by KDC")
+	errCCacheFailed     = errors.New("credential cache unusable")
+	errClockSkew        = errors.New("clock skew with KDC too great")
+	// A cross-realm TGT on the trust path to the realm of the NFS service
+	// principals cannot be had, or the KDC referred elsewhere.
+	errTrustFailed = errors.New("cross-realm trust failed")
+	// The KDC does not let the service principal of the plugin delegate for
+	// the workload, see delegationConfig.
+	errDelegationRefused = errors.New("constrained delegation refused")
+)
+
+// Returned to the runtime when failing a container of a pod whose credential setup failed.
+var errSetupFailed = errors.New("credential setup failed")
+
+// Wrap an error returned by gokrb5 with the matching failure class.
+func classifyKrbError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var class error
+	var kerr krberror.Krberror
+	msg := err.Error()
+
+	switch {
+	case strings.Contains(msg, "KDC_ERR_C_PRINCIPAL_UNKNOWN"):
+		class = errPrincipalUnknown
+	case strings.Contains(msg, "KDC_ERR_CLIENT_REVOKED"):
+		class = errPrincipalRevoked
+	case strings.Contains(msg, "KDC_ERR_KEY_EXPIRED"):
+		class = errPasswordExpired
+	case strings.Contains(msg, "KRB_AP_ERR_SKEW"), strings.Contains(msg, "clock skew with KDC too large"):
+		class = errClockSkew
+	case strings.Contains(msg, "matching key not found in keytab"):
+		// the KDC encrypted the reply with a key version the keytab lacks
+		class = errKeytabMismatch
+	case strings.Contains(msg, "KDC_ERR_PREAUTH_FAILED"), strings.Contains(msg, "password/keytab incorrect"):
+		class = errPreauthFailed
+	case errors.As(err, &kerr) && kerr.RootCause == krberror.NetworkingError:
+		class = errKDCUnreachable
+	default:
+		class = errKDCRejected
+	}
+
+	return fmt.Errorf("%w: %w", class, err)
+}
+
+// Wrap an error of MIT kinit with the failure class its output gives.
+func classifyKinitError(err error, output string) error {
+	output = strings.TrimSpace(output)
+	if errors.Is(err, exec.ErrNotFound) {
+		return err
+	}
+
+	var class error
+	switch {
+	case strings.Contains(output, "Cannot contact any KDC"), strings.Contains(output, "Cannot find KDC"):
+		class = errKDCUnreachable
+	case strings.Contains(output, "not found in Kerberos database"):
+		class = errPrincipalUnknown
+	case strings.Contains(output, "credentials have been revoked"):
+		class = errPrincipalRevoked
+	case strings.Contains(output, "Password has expired"), strings.Contains(output, "Password expired"):
+		class = errPasswordExpired
+	case strings.Contains(output, "Clock skew too great"):
+		class = errClockSkew
+	case strings.Contains(output, "Preauthentication failed"), strings.Contains(output, "Client name mismatch"):
+		class = errPreauthFailed
+	default:
+		class = errKDCRejected
+	}
+
+	return fmt.Errorf("%w: %w: %s", class, err, output)
+}
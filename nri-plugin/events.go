@@ -0,0 +1,161 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Reasons of the Events posted for pods, Warning Events but for reasonDryRun.
+const (
+	reasonSetupFailed        = "KerberosSetupFailed"
+	reasonRenewalFailed      = "KerberosRenewalFailed"
+	reasonConfigIncomplete   = "KerberosConfigIncomplete"
+	reasonPrincipalDenied    = "KerberosPrincipalDenied"
+	reasonIdentityUnverified = "KerberosIdentityUnverified"
+	reasonIDMappingMismatch  = "KerberosIDMappingMismatch"
+	reasonWeakSecurity       = "KerberosWeakSecurity"
+	reasonNFSVersionMismatch = "KerberosNFSVersionMismatch"
+	reasonNFSMountLost       = "KerberosNFSMountLost"
+	reasonClockSkew          = "KerberosClockSkew"
+	reasonLimitExceeded      = "KerberosLimitExceeded"
+	reasonPolicyDenied       = "KerberosPolicyDenied"
+	reasonSidecarUnverified  = "KerberosSidecarUnverified"
+	reasonDryRun             = "KerberosDryRun"
+	reasonTicketExpiring     = "KerberosTicketExpiring"
+	reasonCredentialsLost    = "KerberosCredentialsLost"
+	reasonHostCredentials    = "KerberosHostCredentials"
+	reasonNFSExportMissing   = "KerberosNFSExportMissing"
+	reasonUnreachable        = "KerberosUnreachable"
+	reasonPrincipalFailing   = "KerberosPrincipalFailing"
+	eventComponent           = "nri-kerberos"
+	eventQueueLength         = 64
+	eventRequestTimeout      = 10 * time.Second
+	eventsPathFormat         = "/api/v1/namespaces/%s/events"
+)
+
+// Event of core/v1, the parts we set.
+type kubeEvent struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	InvolvedObject struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Namespace  string `json:"namespace"`
+		Name       string `json:"name"`
+		UID        string `json:"uid,omitempty"`
+	} `json:"involvedObject"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Source  struct {
+		Component string `json:"component"`
+		Host      string `json:"host,omitempty"`
+	} `json:"source"`
+	FirstTimestamp     time.Time `json:"firstTimestamp"`
+	LastTimestamp      time.Time `json:"lastTimestamp"`
+	Count              int       `json:"count"`
+	ReportingComponent string    `json:"reportingComponent"`
+	ReportingInstance  string    `json:"reportingInstance,omitempty"`
+}
+
+// Poster of Events attached to pods, so users see Kerberos problems in
+// kubectl describe pod. Events are posted in the background and dropped when
+// the API server cannot keep up.
+type eventRecorder struct {
+	kube  *kubeClient
+	node  string
+	clock Clock
+	queue chan *kubeEvent
+}
+
+func newEventRecorder(kube *kubeClient, node string, clock Clock) *eventRecorder {
+	return &eventRecorder{
+		kube:  kube,
+		node:  node,
+		clock: clock,
+		queue: make(chan *kubeEvent, eventQueueLength),
+	}
+}
+
+// Post a Warning Event for the pod.
+func (r *eventRecorder) warn(pod *api.PodSandbox, reason, format string, args ...any) {
+	r.post(pod, "Warning", reason, format, args...)
+}
+
+// Post a Normal Event for the pod.
+func (r *eventRecorder) normal(pod *api.PodSandbox, reason, format string, args ...any) {
+	r.post(pod, "Normal", reason, format, args...)
+}
+
+func (r *eventRecorder) post(pod *api.PodSandbox, eventType, reason, format string, args ...any) {
+	if r == nil {
+		return
+	}
+
+	now := r.clock.Now().UTC().Truncate(time.Second)
+	ev := &kubeEvent{
+		Reason:             reason,
+		Message:            fmt.Sprintf(format, args...),
+		Type:               eventType,
+		FirstTimestamp:     now,
+		LastTimestamp:      now,
+		Count:              1,
+		ReportingComponent: eventComponent,
+		ReportingInstance:  r.node,
+	}
+	ev.Metadata.Name = fmt.Sprintf("%s.%x", pod.GetName(), time.Now().UnixNano())
+	ev.Metadata.Namespace = pod.GetNamespace()
+	ev.InvolvedObject.APIVersion = "v1"
+	ev.InvolvedObject.Kind = "Pod"
+	ev.InvolvedObject.Namespace = pod.GetNamespace()
+	ev.InvolvedObject.Name = pod.GetName()
+	ev.InvolvedObject.UID = pod.GetUid()
+	ev.Source.Component = eventComponent
+	ev.Source.Host = r.node
+
+	select {
+	case r.queue <- ev:
+	default:
+		log.Warnf("dropping %s event for %s/%s, queue full", reason, pod.GetNamespace(), pod.GetName())
+	}
+}
+
+// Post queued events until the context is cancelled.
+func (r *eventRecorder) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-r.queue:
+			postCtx, cancel := context.WithTimeout(ctx, eventRequestTimeout)
+			path := fmt.Sprintf(eventsPathFormat, ev.Metadata.Namespace)
+			if err := r.kube.do(postCtx, http.MethodPost, path, "", ev, nil); err != nil {
+				log.Warnf("failed to post %s event for %s/%s: %v", ev.Reason,
+					ev.InvolvedObject.Namespace, ev.InvolvedObject.Name, err)
+			}
+			cancel()
+		}
+	}
+}
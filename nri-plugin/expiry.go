@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExpiryCheckInterval = time.Minute
+	defaultExpiryThreshold     = 30 * time.Minute
+)
+
+// Alerts on managed tickets close to expiry.
+type expiryAlertConfig struct {
+	// Export the time left of each managed ticket and alert on those with
+	// less than the threshold left.
+	Enabled bool `json:"enabled,omitempty"`
+	// Time left below which a ticket is alerted on, 30m by default.
+	Threshold duration `json:"threshold,omitempty"`
+	// Interval of the checks, 1m by default.
+	Interval duration `json:"interval,omitempty"`
+}
+
+func (c *expiryAlertConfig) threshold() time.Duration {
+	if c.Threshold.Duration > 0 {
+		return c.Threshold.Duration
+	}
+	return defaultExpiryThreshold
+}
+
+func (c *expiryAlertConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultExpiryCheckInterval
+}
+
+// Watcher of the time left of managed tickets.
+type expiryWatcher struct {
+	cfg expiryAlertConfig
+
+	sync.Mutex
+	// Labels of the gauge of each ticket, by managed key.
+	labels map[string][]string
+	// Tickets alerted on, until renewed above the threshold.
+	alerted map[string]bool
+}
+
+func newExpiryWatcher(cfg expiryAlertConfig) *expiryWatcher {
+	return &expiryWatcher{cfg: cfg, labels: map[string][]string{}, alerted: map[string]bool{}}
+}
+
+// Stop watching the ticket of credentials, removing its gauge.
+func (w *expiryWatcher) forget(id string) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	if labels, ok := w.labels[id]; ok {
+		ticketExpiry.DeleteLabelValues(labels...)
+	}
+	delete(w.labels, id)
+	delete(w.alerted, id)
+	w.Unlock()
+}
+
+// Check the tickets of managed credentials periodically until the context is
+// cancelled.
+func (p *plugin) runExpiryChecks(ctx context.Context) {
+	for {
+		p.Lock()
+		ids := make([]string, 0, len(p.managed))
+		for id := range p.managed {
+			ids = append(ids, id)
+		}
+		p.Unlock()
+		for _, id := range ids {
+			p.checkExpiry(id)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.expiry.cfg.interval()):
+		}
+	}
+}
+
+// Update the time left of the ticket of managed credentials, and post a
+// Warning Event and count an alert when it drops below the threshold, once
+// until it is renewed above it again. Renewals failing for a while, or a TGT
+// which cannot be renewed any further, show here before NFS I/O fails.
+func (p *plugin) checkExpiry(id string) {
+	p.Lock()
+	mc, ok := p.managed[id]
+	p.Unlock()
+	if !ok {
+		return
+	}
+	kp := mc.params
+	w := p.expiry
+
+	t, err := ccacheTimes(kp.CCName, kp.Realm)
+	if err != nil {
+		mc.log.Debugf("no ticket expiry of %s: %v", kp.Principal(), err)
+		return
+	}
+	left := max(t.end.Sub(p.clock.Now()), 0)
+	labels := []string{mc.pod.GetNamespace(), mc.pod.GetName(), kp.Container, kp.Principal()}
+	w.Lock()
+	w.labels[id] = labels
+	alerted := w.alerted[id]
+	w.alerted[id] = left < w.cfg.threshold()
+	w.Unlock()
+	ticketExpiry.WithLabelValues(labels...).Set(left.Seconds())
+
+	if left >= w.cfg.threshold() || alerted {
+		return
+	}
+	ticketExpiryAlerts.WithLabelValues(kp.Realm).Inc()
+	if left == 0 {
+		mc.log.Warnf("ticket of %s expired", kp.Principal())
+		p.events.warn(mc.pod, reasonTicketExpiring, "ticket of %s expired, NFS access fails until it is obtained again", kp.Principal())
+		return
+	}
+	mc.log.Warnf("ticket of %s expires in %s", kp.Principal(), left.Round(time.Second))
+	p.events.warn(mc.pod, reasonTicketExpiring, "ticket of %s expires in %s, below the alert threshold of %s",
+		kp.Principal(), left.Round(time.Second), w.cfg.threshold())
+}
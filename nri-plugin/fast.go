@@ -0,0 +1,115 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFASTKeytab   = "/etc/krb5.keytab"
+	defaultFASTArmorDir = "/run/nri-kerberos/armor"
+
+	// Armor tickets expiring sooner are replaced before use.
+	fastArmorMinLifetime = 10 * time.Minute
+)
+
+// FAST armoring of initial authentication, hiding the exchange from offline
+// attacks inside a tunnel keyed by an armor TGT of the node.
+type fastConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Realms to armor exchanges with, all if empty.
+	Realms []string `json:"realms,omitempty"`
+	// Keytab of the node principal the armor TGT is obtained with, /etc/krb5.keytab by default.
+	Keytab string `json:"keytab,omitempty"`
+	// Node principal without realm, host/<hostname> by default.
+	Principal string `json:"principal,omitempty"`
+	// Obtain the armor TGT by anonymous PKINIT instead of with the node keytab.
+	Anonymous bool `json:"anonymous,omitempty"`
+	// Directory of the armor credential caches, /run/nri-kerberos/armor by default.
+	ArmorDir string `json:"armorDir,omitempty"`
+}
+
+func (c *fastConfig) applies(realm string) bool {
+	return c.Enabled && (len(c.Realms) == 0 || slices.Contains(c.Realms, realm))
+}
+
+// Armor TGTs of the node, one per realm, obtained on first use and replaced
+// when they are about to expire.
+type fastArmor struct {
+	cfg   fastConfig
+	exec  Exec
+	clock Clock
+
+	sync.Mutex
+}
+
+func newFASTArmor(cfg fastConfig, exec Exec, clock Clock) *fastArmor {
+	if cfg.Keytab == "" {
+		cfg.Keytab = defaultFASTKeytab
+	}
+	if cfg.ArmorDir == "" {
+		cfg.ArmorDir = defaultFASTArmorDir
+	}
+	return &fastArmor{cfg: cfg, exec: exec, clock: clock}
+}
+
+// Check whether exchanges of the realm are armored. Safe to call on a nil armor.
+func (a *fastArmor) applies(realm string) bool {
+	return a != nil && a.cfg.applies(realm)
+}
+
+// Path of a valid armor credential cache for the realm of the workload.
+func (a *fastArmor) ccache(ctx context.Context, kp *kerberosParams) (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	path := filepath.Join(a.cfg.ArmorDir, kp.Realm)
+	if err := checkCCache("FILE:"+path, kp.Realm, a.clock.Now().Add(fastArmorMinLifetime)); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(a.cfg.ArmorDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create armor directory: %w", err)
+	}
+
+	// the armor TGT comes from the KDCs of the workload
+	o := &kinitOptions{CCName: "FILE:" + path, Realm: kp.Realm}
+	if a.cfg.Anonymous {
+		o.Anonymous = true
+	} else {
+		principal := a.cfg.Principal
+		if principal == "" {
+			host, err := os.Hostname()
+			if err != nil {
+				return "", err
+			}
+			principal = "host/" + host
+		}
+		o.Keytab, o.Principal = a.cfg.Keytab, principal+"@"+kp.Realm
+	}
+	if err := runKinit(ctx, a.exec, kp, "", o); err != nil {
+		return "", fmt.Errorf("failed to obtain FAST armor TGT for %s: %w", kp.Realm, err)
+	}
+	loggerFrom(ctx).Infof("obtained FAST armor TGT for %s", kp.Realm)
+	return path, nil
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"maps"
+
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Pod annotation, without prefix, asking for a forwardable TGT, so that the
+// workload can delegate it to further Kerberized services, as HDFS or SQL
+// Server, with the same identity.
+const forwardableAnnotation = "kerberos-forwardable"
+
+// [libdefaults] entries of the workload: those of krb5Conf, with forwardable
+// set for pods asking for forwardable tickets, for kinit and the native
+// backend to ask the KDC for them and for the workload to forward them.
+func (kp *kerberosParams) libDefaults(settings *krb5ConfConfig) map[string]string {
+	if !kp.Forwardable {
+		return settings.LibDefaults
+	}
+	entries := maps.Clone(settings.LibDefaults)
+	if entries == nil {
+		entries = map[string]string{}
+	}
+	entries["forwardable"] = "true"
+	return entries
+}
+
+// Check whether the KDC refused a pod asking for forwardable tickets one: the
+// TGT in its credential cache is not forwardable, as its principal may not be
+// delegated. False if the cache cannot be read.
+func forwardableRefused(kp *kerberosParams) bool {
+	if !kp.Forwardable {
+		return false
+	}
+	path, err := ccachePath(kp.CCName)
+	if err != nil {
+		return false
+	}
+	cc, err := loadCCache(path)
+	if err != nil {
+		return false
+	}
+	cred, ok := cc.GetEntry(types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", kp.Realm},
+	})
+	return ok && !types.IsFlagSet(&cred.TicketFlags, flags.Forwardable)
+}
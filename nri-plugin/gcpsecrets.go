@@ -0,0 +1,179 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGCPSecretsEndpoint = "https://secretmanager.googleapis.com"
+	defaultGCPMetadataHost    = "metadata.google.internal"
+)
+
+// GCP Secret Manager credential source configuration. The plugin
+// authenticates with the workload identity of its pod, the access token of
+// its service account from the GKE metadata server.
+type gcpSecretsConfig struct {
+	// Project of the secrets, for paths not starting with projects/.
+	Project string `json:"project,omitempty"`
+	// Version of the secrets read, latest by default.
+	Version string `json:"version,omitempty"`
+	// Endpoint of Secret Manager, https://secretmanager.googleapis.com by default.
+	Endpoint string `json:"endpoint,omitempty"`
+	cloudSecretPaths
+}
+
+// Secret Manager client with the access token of the workload identity of
+// the plugin.
+type gcpSecrets struct {
+	cfg      gcpSecretsConfig
+	metadata string
+	http     *http.Client
+
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Create the GCP Secret Manager credential source, nil if it is not configured.
+func newGCPSecretsSource(cfg gcpSecretsConfig) (*cloudSecretSource, error) {
+	if cfg.DefaultPath == "" && len(cfg.NamespacePaths) == 0 {
+		return nil, nil
+	}
+	if cfg.Version == "" {
+		cfg.Version = "latest"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultGCPSecretsEndpoint
+	}
+	metadata := os.Getenv("GCE_METADATA_HOST")
+	if metadata == "" {
+		metadata = defaultGCPMetadataHost
+	}
+	g := &gcpSecrets{cfg: cfg, metadata: metadata, http: &http.Client{Timeout: 10 * time.Second}}
+	name := "GCP Secret Manager"
+	if cfg.Project != "" {
+		name += " " + cfg.Project
+	}
+	return newCloudSecretSource(name, cfg.cloudSecretPaths, g.read), nil
+}
+
+// Resource name of the version of a secret: the path as it is if it starts
+// with projects/, else a secret of the project.
+func (g *gcpSecrets) resource(secret string) (string, error) {
+	if !strings.HasPrefix(secret, "projects/") {
+		if g.cfg.Project == "" {
+			return "", fmt.Errorf("secret %s needs a project", secret)
+		}
+		secret = "projects/" + g.cfg.Project + "/secrets/" + secret
+	}
+	if !strings.Contains(secret, "/versions/") {
+		secret += "/versions/" + g.cfg.Version
+	}
+	return secret, nil
+}
+
+// Read the payload of a secret.
+func (g *gcpSecrets) read(ctx context.Context, secret string) ([]byte, error) {
+	name, err := g.resource(secret)
+	if err != nil {
+		return nil, err
+	}
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(g.cfg.Endpoint, "/")+"/v1/"+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	rsp, err := g.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("access %s failed: %w", name, err)
+	}
+	defer rsp.Body.Close()
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("access %s: %w", name, errNotFound)
+	case rsp.StatusCode == http.StatusUnauthorized:
+		// token may have been revoked early, get another one next time
+		g.Lock()
+		g.token = ""
+		g.Unlock()
+		return nil, fmt.Errorf("access %s failed: %s", name, rsp.Status)
+	case rsp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("access %s failed: %s", name, rsp.Status)
+	}
+	var version struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&version); err != nil {
+		return nil, fmt.Errorf("access %s: %w", name, err)
+	}
+	return version.Payload.Data, nil
+}
+
+// Access token of the service account of the plugin from the metadata
+// server, renewed at 80% of its lifetime.
+func (g *gcpSecrets) accessToken(ctx context.Context) (string, error) {
+	g.Lock()
+	defer g.Unlock()
+	if g.token != "" && time.Now().Before(g.expires) {
+		return g.token, nil
+	}
+
+	url := "http://" + g.metadata + "/computeMetadata/v1/instance/service-accounts/default/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	rsp, err := g.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GCP access token: %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GCP access token: %s", rsp.Status)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&t); err != nil {
+		return "", fmt.Errorf("GCP access token: %w", err)
+	}
+	if t.AccessToken == "" {
+		return "", errors.New("GCP access token: none from the metadata server")
+	}
+	g.token = t.AccessToken
+	g.expires = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second * 8 / 10)
+	return g.token, nil
+}
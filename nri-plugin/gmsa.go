@@ -0,0 +1,358 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+const (
+	// Interval of the checks for managed passwords due to be fetched again.
+	defaultGMSACheckInterval = time.Minute
+	// Time limit of the directory lookups of managed passwords unless configured.
+	defaultGMSATimeout = 10 * time.Second
+
+	ldapManagedPasswordAttr = "msDS-ManagedPassword"
+	ldapKeyVersionAttr      = "msDS-KeyVersionNumber"
+)
+
+// errNotManagedAccount is returned for principals which are not the
+// sAMAccountName of a group managed service account.
+var errNotManagedAccount = errors.New("not a group managed service account")
+
+// Group managed service accounts of Active Directory, whose passwords the
+// domain controllers generate and rotate. Their keys are derived from the
+// password fetched from the directory, and the credentials obtained afresh once
+// the next one is out, while the domain still takes the previous one.
+type gmsaConfig struct {
+	// Domain controller, ldaps://host[:port]. Disabled if empty.
+	URL string `json:"url,omitempty"`
+	// PEM CA bundle for verifying the domain controller.
+	CAFile string `json:"caFile,omitempty"`
+	// Base of the account search, such as cn=Managed Service Accounts,dc=corp,dc=example,dc=com.
+	BaseDN string `json:"baseDN,omitempty"`
+	// Account permitted to retrieve the managed passwords, by
+	// msDS-GroupMSAMembership, and the file holding its password.
+	BindDN           string `json:"bindDN,omitempty"`
+	BindPasswordFile string `json:"bindPasswordFile,omitempty"`
+	// DNS name of the domain, which salts the keys, the realm in lower case
+	// by default.
+	Domain string `json:"domain,omitempty"`
+	// Namespaces whose pods run as managed service accounts, all if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Time limit of a lookup, 10s by default.
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+func (c *gmsaConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme != "ldaps" || u.Host == "" {
+		return fmt.Errorf("invalid URL %q, must be ldaps://, as domain controllers hand out managed passwords over TLS only", c.URL)
+	}
+	if c.BaseDN == "" {
+		return errors.New("baseDN is required")
+	}
+	if c.BindDN == "" || c.BindPasswordFile == "" {
+		return errors.New("bindDN and bindPasswordFile are required")
+	}
+	return nil
+}
+
+func (c *gmsaConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultGMSATimeout
+}
+
+// Managed password state of an account, as last fetched.
+type gmsaPassword struct {
+	kvno uint32
+	// Time the next password is out, which the credentials are obtained
+	// afresh with.
+	next time.Time
+}
+
+// Keytabs of group managed service accounts, derived from their passwords in
+// the directory, which are never stored on the node but in the keytab
+// directory of the pods on tmpfs.
+type gmsaSource struct {
+	cfg   gmsaConfig
+	tls   *tls.Config
+	clock Clock
+
+	sync.Mutex
+	// Passwords by principal.
+	passwords map[string]gmsaPassword
+	// Key version managed credentials were last obtained with, by managed key.
+	kvnos map[string]uint32
+}
+
+// Create the managed service account source, nil if not configured.
+func newGMSASource(cfg gmsaConfig, clock Clock) (*gmsaSource, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg, err := ldapTLSConfig(u, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &gmsaSource{cfg: cfg, tls: tlsCfg, clock: clock, passwords: map[string]gmsaPassword{}, kvnos: map[string]uint32{}}, nil
+}
+
+func (s *gmsaSource) Name() string {
+	return "managed service accounts " + s.cfg.URL
+}
+
+// Check whether pods of the namespace run as managed service accounts.
+func (s *gmsaSource) handles(namespace string) bool {
+	return s != nil && (len(s.cfg.Namespaces) == 0 || slices.Contains(s.cfg.Namespaces, namespace))
+}
+
+// Stop refreshing the managed password of credentials.
+func (s *gmsaSource) forget(id string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	delete(s.kvnos, id)
+	s.Unlock()
+}
+
+// Fetch the current managed password of the account of the workload and
+// derive a keytab of its AES keys.
+func (s *gmsaSource) Fetch(ctx context.Context, _ *api.PodSandbox, kp *kerberosParams) (*credential, error) {
+	account := kp.principalName()
+	if !strings.HasSuffix(account, "$") {
+		return nil, fmt.Errorf("%s: %w, whose principal is its sAMAccountName ending in $", kp.Principal(), errNotManagedAccount)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.timeout())
+	defer cancel()
+	conn, err := dialLDAP(ctx, s.cfg.URL, s.tls, s.cfg.BindDN, s.cfg.BindPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entries, err := conn.search(s.cfg.BaseDN, ldapEqualityFilter("objectClass", "msDS-GroupManagedServiceAccount", "sAMAccountName", account),
+		2, s.cfg.timeout(), ldapManagedPasswordAttr, ldapKeyVersionAttr)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("LDAP search for %s failed: %w", account, err)
+	case len(entries) == 0:
+		return nil, fmt.Errorf("%s: %w under %s", account, errNotManagedAccount, s.cfg.BaseDN)
+	case len(entries) > 1:
+		return nil, fmt.Errorf("several accounts %s under %s", account, s.cfg.BaseDN)
+	}
+	blob, ok := entries[0][strings.ToLower(ldapManagedPasswordAttr)]
+	if !ok {
+		return nil, fmt.Errorf("no managed password of %s for %s: check the msDS-GroupMSAMembership of the account", account, s.cfg.BindDN)
+	}
+	kvno, err := strconv.ParseUint(entries[0][strings.ToLower(ldapKeyVersionAttr)], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key version of %s: %w", account, err)
+	}
+	password, next, err := parseManagedPassword([]byte(blob))
+	if err != nil {
+		return nil, fmt.Errorf("invalid managed password of %s: %w", account, err)
+	}
+
+	domain := s.cfg.Domain
+	if domain == "" {
+		domain = kp.Realm
+	}
+	data, err := gmsaKeytab(account, kp.Realm, domain, password, uint32(kvno))
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	s.passwords[kp.Principal()] = gmsaPassword{kvno: uint32(kvno), next: s.clock.Now().Add(next)}
+	s.Unlock()
+	return &credential{Keytab: data}, nil
+}
+
+// Parse an MSDS-MANAGEDPASSWORD_BLOB, returning the current password and the
+// time until the next one may be queried.
+func parseManagedPassword(blob []byte) (string, time.Duration, error) {
+	if len(blob) < 16 {
+		return "", 0, errors.New("truncated")
+	}
+	if v := binary.LittleEndian.Uint16(blob); v != 1 {
+		return "", 0, fmt.Errorf("unknown version %d", v)
+	}
+	if n := binary.LittleEndian.Uint32(blob[4:]); int(n) > len(blob) {
+		return "", 0, errors.New("truncated")
+	}
+	current := int(binary.LittleEndian.Uint16(blob[8:]))
+	query := int(binary.LittleEndian.Uint16(blob[12:]))
+	if current < 16 || query+8 > len(blob) || current >= query {
+		return "", 0, errors.New("invalid offsets")
+	}
+	// UTF-16LE, NUL-terminated
+	var units []uint16
+	for i := current; i+1 < query; i += 2 {
+		u := binary.LittleEndian.Uint16(blob[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	if len(units) == 0 {
+		return "", 0, errors.New("empty password")
+	}
+	// intervals are in 100ns units
+	interval := int64(binary.LittleEndian.Uint64(blob[query:]))
+	if interval < 0 || interval > int64(1<<63-1)/100 {
+		return "", 0, fmt.Errorf("invalid query password interval %d", interval)
+	}
+	// Windows converts the password to UTF-8 for deriving the keys, replacing
+	// unpaired surrogates as utf16.Decode does
+	return string(utf16.Decode(units)), time.Duration(interval * 100), nil
+}
+
+// Keytab of the AES keys of a managed service account. AD salts them as those
+// of computer accounts: the realm, host, and the account name without $ and
+// the DNS name of the domain, in lower case.
+func gmsaKeytab(account, realm, domain, password string, kvno uint32) ([]byte, error) {
+	salt := realm + "host" + strings.ToLower(strings.TrimSuffix(account, "$")) + "." + strings.ToLower(domain)
+	kt := keytab.New()
+	for _, id := range []int32{etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.AES128_CTS_HMAC_SHA1_96} {
+		et, err := crypto.GetEtype(id)
+		if err != nil {
+			return nil, err
+		}
+		key, err := et.StringToKey(password, salt, et.GetDefaultStringToKeyParams())
+		if err != nil {
+			return nil, err
+		}
+		if err := kt.AddEntry(account, realm, password, time.Now(), uint8(kvno), id); err != nil {
+			return nil, err
+		}
+		e := &kt.Entries[len(kt.Entries)-1]
+		e.Key.KeyValue = key
+		// key versions above 255 only fit the 32-bit field
+		e.KVNO = kvno
+	}
+	return kt.Marshal()
+}
+
+// Check the managed passwords of managed credentials periodically until the
+// context is cancelled.
+func (p *plugin) runGMSARefresh(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(defaultGMSACheckInterval):
+		}
+
+		p.Lock()
+		ids := make([]string, 0, len(p.managed))
+		for id := range p.managed {
+			ids = append(ids, id)
+		}
+		p.Unlock()
+		for _, id := range ids {
+			p.refreshGMSA(ctx, id)
+		}
+	}
+}
+
+// Obtain managed credentials afresh once the next password of their account
+// is out, or once another pod of the account found it: the domain takes the
+// previous password only until the one after, and renewals would fail from
+// then on. Credentials whose password was not fetched by this instance of the
+// plugin, as those restored after a restart, are obtained afresh at once.
+func (p *plugin) refreshGMSA(ctx context.Context, id string) {
+	cfg := p.config()
+	p.Lock()
+	mc, ok := p.managed[id]
+	p.Unlock()
+	if !ok || p.credentialSource(mc.pod) != p.gmsa {
+		return
+	}
+	kp := mc.params
+
+	s := p.gmsa
+	s.Lock()
+	pw, known := s.passwords[kp.Principal()]
+	kvno, seen := s.kvnos[id]
+	if known && !seen {
+		kvno, seen = pw.kvno, true
+		s.kvnos[id] = kvno
+	}
+	s.Unlock()
+	if seen && kvno >= pw.kvno && s.clock.Now().Before(pw.next) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withLogger(ctx, mc.log), cfg.setupTimeout())
+	defer cancel()
+	err := p.fetchCredentials(ctx, mc.pod, kp)
+	s.Lock()
+	pw = s.passwords[kp.Principal()]
+	s.Unlock()
+	if err == nil && seen && pw.kvno == kvno {
+		// not rotated yet, checked again by the next query interval
+		return
+	}
+	if err == nil {
+		err = p.backend.Setup(ctx, kp)
+	}
+	if err == nil && mc.pod.GetUid() != "" && len(kp.Volumes) == 0 {
+		_, err = p.publishCCache(mc.pod, kp)
+	}
+	gmsaRefreshes.WithLabelValues(result(err)).Inc()
+	if !kp.secondary() {
+		p.tickets.report(mc.pod, kp, err)
+	}
+	if err != nil {
+		p.auditOp("rekey", mc.pod, kp.Container, kp, err)
+		mc.log.Errorf("obtaining credentials for %s with its managed password failed: %v", kp.Principal(), err)
+		p.events.warn(mc.pod, reasonRenewalFailed, "obtaining credentials for %s with its managed password failed (%s): %v",
+			kp.Principal(), failureReason(err), err)
+		return
+	}
+	mc.log.Infof("obtained credentials for %s afresh with its managed password, key version %d", kp.Principal(), pw.kvno)
+	s.Lock()
+	s.kvnos[id] = pw.kvno
+	s.Unlock()
+	p.auditOp("rekey", mc.pod, kp.Container, kp, nil)
+	p.scheduleRenewal(id)
+}
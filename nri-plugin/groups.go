@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Annotation listing the supplementary groups of the workload, by gid.
+const gidsAnnotation = "kerberos-gids"
+
+// Parse a comma-separated list of gids, dropping duplicates.
+func parseGIDs(value string) ([]uint64, error) {
+	var gids []uint64
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		gid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil || gid == 0 {
+			return nil, fmt.Errorf("gid %q must be a positive number", field)
+		}
+		if !slices.Contains(gids, gid) {
+			gids = append(gids, gid)
+		}
+	}
+	return gids, nil
+}
+
+// Translate supplementary gids as the containers of the pod see them to those
+// of the host.
+func (userns *userNamespace) groupsToHost(gids []uint64) ([]uint64, error) {
+	host := make([]uint64, 0, len(gids))
+	for _, gid := range gids {
+		hostGID, ok := mapToHost(userns.gids, gid)
+		if !ok {
+			return nil, fmt.Errorf("supplementary gid %d is not mapped by the user namespace of the pod", gid)
+		}
+		host = append(host, hostGID)
+	}
+	return host, nil
+}
+
+// Supplementary gids of the parameters as the containers of the pod see them.
+func (kp *kerberosParams) containerGIDs() []uint64 {
+	if kp.UserNS == nil {
+		return kp.GIDs
+	}
+	gids := make([]uint64, 0, len(kp.GIDs))
+	for _, gid := range kp.GIDs {
+		gid, _ = mapToContainer(kp.UserNS.gids, gid)
+		gids = append(gids, gid)
+	}
+	return gids
+}
+
+// Group owning the pod credential cache directory and the caches in it: the
+// first supplementary gid, so that the processes of the pod in that group can
+// use the credentials too, or the gid.
+func (kp *kerberosParams) ccacheGID() int {
+	if len(kp.GIDs) > 0 {
+		return int(kp.GIDs[0])
+	}
+	return int(kp.GID)
+}
+
+// Permissions of the pod credential cache directory and of the caches in it,
+// open to their group with supplementary gids.
+func (kp *kerberosParams) ccacheModes() (dir, file os.FileMode) {
+	if len(kp.GIDs) > 0 {
+		return 0750, 0640
+	}
+	return 0700, 0600
+}
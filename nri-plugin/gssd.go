@@ -0,0 +1,274 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultGSSDConfFile      = "/etc/nfs.conf.d/nri-kerberos.conf"
+	defaultGSSDCCacheDir     = "/tmp"
+	defaultGSSDCheckInterval = time.Minute
+	gssdProcessName          = "rpc.gssd"
+)
+
+var (
+	defaultGSSDRestartCommand = []string{"systemctl", "restart", "rpc-gssd.service"}
+	defaultNFSv3StartCommand  = []string{"systemctl", "start", "rpcbind.service", "rpc-statd.service"}
+	// Daemons NFSv3 needs besides rpc.gssd, for finding the services of the
+	// server and for locking.
+	nfsv3Processes = []string{"rpcbind", "rpc.statd"}
+)
+
+// Management of rpc.gssd on the node, which NFS with krb5 needs.
+type gssdConfig struct {
+	// Verify rpc.gssd runs, configure it and restart it on changes.
+	Manage bool `json:"manage,omitempty"`
+	// nfs.conf drop-in holding the managed [gssd] settings,
+	// /etc/nfs.conf.d/nri-kerberos.conf by default.
+	ConfFile string `json:"confFile,omitempty"`
+	// Directories rpc.gssd looks for credential caches in (-d), /tmp by default.
+	CCacheDirs []string `json:"ccacheDirs,omitempty"`
+	// Canonicalize NFS server names by reverse DNS (-D).
+	ReverseDNS bool `json:"reverseDNS,omitempty"`
+	// Command restarting rpc.gssd, systemctl restart rpc-gssd.service by default.
+	RestartCommand []string `json:"restartCommand,omitempty"`
+	// Interval of checking rpc.gssd runs, 1m by default.
+	CheckInterval duration `json:"checkInterval,omitempty"`
+	// Keep rpcbind and rpc.statd running as well, for NFSv3 volumes. Implied
+	// by nfsVersion 3.
+	NFSv3 bool `json:"nfsv3,omitempty"`
+	// Command starting rpcbind and rpc.statd,
+	// systemctl start rpcbind.service rpc-statd.service by default.
+	NFSv3StartCommand []string `json:"nfsv3StartCommand,omitempty"`
+}
+
+func (c *gssdConfig) confFile() string {
+	if c.ConfFile != "" {
+		return c.ConfFile
+	}
+	return defaultGSSDConfFile
+}
+
+func (c *gssdConfig) ccacheDirs() []string {
+	if len(c.CCacheDirs) > 0 {
+		return c.CCacheDirs
+	}
+	return []string{defaultGSSDCCacheDir}
+}
+
+func (c *gssdConfig) restartCommand() []string {
+	if len(c.RestartCommand) > 0 {
+		return c.RestartCommand
+	}
+	return defaultGSSDRestartCommand
+}
+
+func (c *gssdConfig) nfsv3StartCommand() []string {
+	if len(c.NFSv3StartCommand) > 0 {
+		return c.NFSv3StartCommand
+	}
+	return defaultNFSv3StartCommand
+}
+
+func (c *gssdConfig) checkInterval() time.Duration {
+	if c.CheckInterval.Duration > 0 {
+		return c.CheckInterval.Duration
+	}
+	return defaultGSSDCheckInterval
+}
+
+var gssdConfTemplate = template.Must(template.New("nfs.conf").Parse(`# Managed by nri-kerberos, do not edit.
+[gssd]
+cred-cache-directory = {{ .CCacheDirs }}
+avoid-dns = {{ if .ReverseDNS }}0{{ else }}1{{ end }}
+use-gss-proxy = {{ if .GSSProxy }}1{{ else }}0{{ end }}
+`))
+
+// Data for rendering the nfs.conf drop-in.
+type gssdConfData struct {
+	CCacheDirs string
+	ReverseDNS bool
+	GSSProxy   bool
+}
+
+// Keeper of rpc.gssd on the node.
+type gssdManager struct {
+	cfg gssdConfig
+	// rpc.gssd should go through gss-proxy.
+	gssProxy bool
+	// NFSv3 daemons are needed too.
+	nfsv3 bool
+	// /proc of the host PID namespace, for finding rpc.gssd.
+	proc string
+	exec Exec
+}
+
+func newGSSDManager(cfg gssdConfig, gssProxy, nfsv3 bool, exec Exec) *gssdManager {
+	return &gssdManager{cfg: cfg, gssProxy: gssProxy, nfsv3: nfsv3 || cfg.NFSv3, proc: "/proc", exec: exec}
+}
+
+// Configure rpc.gssd, then check it keeps running until the context is cancelled.
+// rpc.gssd is restarted when the configuration changed or it is not running,
+// and the NFSv3 daemons are started when needed and not running.
+func (m *gssdManager) run(ctx context.Context) {
+	changed, err := m.configure()
+	if err != nil {
+		log.Errorf("failed to configure rpc.gssd: %v", err)
+	}
+	if changed {
+		log.Infof("rpc.gssd configuration %s updated", m.cfg.confFile())
+		m.restart(ctx)
+	}
+
+	for {
+		running := m.running(gssdProcessName)
+		gssdRunning.Set(boolValue(running))
+		if !running {
+			log.Warnf("%s is not running", gssdProcessName)
+			m.restart(ctx)
+		}
+		if m.nfsv3 {
+			for _, name := range nfsv3Processes {
+				if !m.running(name) {
+					log.Warnf("%s is not running, which NFSv3 needs", name)
+					m.startNFSv3(ctx)
+					break
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.cfg.checkInterval()):
+		}
+	}
+}
+
+// Write the managed settings and create the credential cache directories,
+// returning whether the settings changed.
+func (m *gssdManager) configure() (bool, error) {
+	for _, dir := range m.cfg.ccacheDirs() {
+		// #nosec G301:gosec -- rpc.gssd needs to read the caches of all users in there
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return false, fmt.Errorf("failed to create credential cache directory: %w", err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err := gssdConfTemplate.Execute(buf, &gssdConfData{
+		CCacheDirs: strings.Join(m.cfg.ccacheDirs(), ":"),
+		ReverseDNS: m.cfg.ReverseDNS,
+		GSSProxy:   m.gssProxy,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// #nosec G306:gosec -- nfs.conf is world-readable
+	return installFile(m.cfg.confFile(), buf.Bytes(), 0644)
+}
+
+// Atomically replace a node configuration file, unless it has the content
+// already, creating its directory if needed. Returns whether it changed.
+func installFile(path string, data []byte, perm os.FileMode) (bool, error) {
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to set %s permissions: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, fmt.Errorf("failed to install %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// Check whether a process of the name is running.
+func (m *gssdManager) running(name string) bool {
+	comms, _ := filepath.Glob(filepath.Join(m.proc, "[0-9]*", "comm"))
+	for _, path := range comms {
+		if comm, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(comm)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Restart rpc.gssd with the restart command.
+func (m *gssdManager) restart(ctx context.Context) {
+	err := runNodeCommand(ctx, m.exec, m.cfg.restartCommand())
+	gssdRestarts.WithLabelValues(result(err)).Inc()
+	if err != nil {
+		log.Errorf("failed to restart %s: %v", gssdProcessName, err)
+		return
+	}
+	log.Infof("restarted %s", gssdProcessName)
+}
+
+// Start the NFSv3 daemons with the start command.
+func (m *gssdManager) startNFSv3(ctx context.Context) {
+	if err := runNodeCommand(ctx, m.exec, m.cfg.nfsv3StartCommand()); err != nil {
+		log.Errorf("failed to start %s: %v", strings.Join(nfsv3Processes, " and "), err)
+		return
+	}
+	log.Infof("started %s", strings.Join(nfsv3Processes, " and "))
+}
+
+// Run a service management command of the node configuration.
+func runNodeCommand(ctx context.Context, exec Exec, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	out, err := exec.Run(ctx, args[0], args[1:]...)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+)
+
+const (
+	defaultGSSProxyConfDir = "/etc/gssproxy"
+	defaultGSSProxySocket  = "/var/lib/gssproxy/default.sock"
+	defaultGSSProxyPIDFile = "/run/gssproxy.pid"
+)
+
+// Delegation of GSS operations of the pods to gss-proxy on the host.
+type gssProxyConfig struct {
+	// Configure gss-proxy and hand it to the pods instead of the credential cache.
+	Enabled bool `json:"enabled,omitempty"`
+	// Directory gss-proxy reads its service stanzas from, /etc/gssproxy by default.
+	ConfDir string `json:"confDir,omitempty"`
+	// Socket of gss-proxy, mounted into the containers, /var/lib/gssproxy/default.sock by default.
+	Socket string `json:"socket,omitempty"`
+	// PID file of gss-proxy, which is sent SIGHUP to reload, /run/gssproxy.pid by default.
+	PIDFile string `json:"pidFile,omitempty"`
+}
+
+func (c *gssProxyConfig) confDir() string {
+	if c.ConfDir != "" {
+		return c.ConfDir
+	}
+	return defaultGSSProxyConfDir
+}
+
+func (c *gssProxyConfig) socket() string {
+	if c.Socket != "" {
+		return c.Socket
+	}
+	return defaultGSSProxySocket
+}
+
+func (c *gssProxyConfig) pidFile() string {
+	if c.PIDFile != "" {
+		return c.PIDFile
+	}
+	return defaultGSSProxyPIDFile
+}
+
+// Service stanza letting processes of the uid initiate contexts with the
+// credentials the plugin keeps in the host credential cache.
+var gssProxyTemplate = template.Must(template.New("gssproxy.conf").Parse(`# Managed by nri-kerberos, do not edit.
+[service/nri-kerberos-{{ .UID }}]
+    mechs = krb5
+    euid = {{ .UID }}
+    cred_store = ccache:{{ .CCName }}
+    cred_usage = initiate
+    krb5_principal = {{ .Principal }}
+`))
+
+// Data for rendering a service stanza.
+type gssProxyData struct {
+	UID       uint64
+	CCName    string
+	Principal string
+}
+
+// Serializes stanza updates and gss-proxy reloads.
+var gssProxyLock sync.Mutex
+
+// Path of the service stanza of a uid.
+func (c *gssProxyConfig) stanzaPath(uid uint64) string {
+	return filepath.Join(c.confDir(), fmt.Sprintf("90-nri-kerberos-%d.conf", uid))
+}
+
+// Write the service stanza of the workload, reloading gss-proxy if it changed.
+func (c *gssProxyConfig) configure(kp *kerberosParams) error {
+	buf := &bytes.Buffer{}
+	err := gssProxyTemplate.Execute(buf, &gssProxyData{
+		UID:       kp.UID,
+		CCName:    kp.CCName,
+		Principal: kp.Principal(),
+	})
+	if err != nil {
+		return err
+	}
+
+	gssProxyLock.Lock()
+	defer gssProxyLock.Unlock()
+
+	changed, err := installFile(c.stanzaPath(kp.UID), buf.Bytes(), 0600)
+	if err != nil || !changed {
+		return err
+	}
+	return c.reload()
+}
+
+// Remove the service stanza of a uid, reloading gss-proxy if there was one.
+func (c *gssProxyConfig) unconfigure(uid uint64) error {
+	gssProxyLock.Lock()
+	defer gssProxyLock.Unlock()
+
+	err := os.Remove(c.stanzaPath(uid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove gss-proxy configuration: %w", err)
+	}
+	return c.reload()
+}
+
+// Make gss-proxy reread its configuration.
+func (c *gssProxyConfig) reload() error {
+	data, err := os.ReadFile(c.pidFile())
+	if err != nil {
+		return fmt.Errorf("failed to find gss-proxy: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid gss-proxy PID file %q", c.pidFile())
+	}
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to reload gss-proxy: %w", err)
+	}
+	return nil
+}
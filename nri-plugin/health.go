@@ -0,0 +1,169 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kdcProbeInterval = 30 * time.Second
+	kdcProbeTimeout  = 3 * time.Second
+	kdcPort          = "88"
+)
+
+// Health of the plugin: the NRI connection, the hook directory watcher and
+// reachability of the known KDCs.
+type health struct {
+	connected atomic.Bool
+	// Connecting to the runtime again after losing the connection.
+	reconnecting atomic.Bool
+	// Hook directory watcher running, or watching disabled.
+	watching atomic.Bool
+
+	sync.Mutex
+	kdcs map[string]error
+}
+
+func newHealth() *health {
+	return &health{kdcs: map[string]error{}}
+}
+
+// Probe the KDCs returned by list until the context is cancelled, passing the
+// result for each to observe.
+func (h *health) probeKDCs(ctx context.Context, list func() []string, observe func(string, error)) {
+	for {
+		results := map[string]error{}
+		for _, kdc := range list() {
+			addr := kdcAddress(kdc)
+			d := net.Dialer{Timeout: kdcProbeTimeout}
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			results[addr] = err
+			if ctx.Err() == nil {
+				observe(addr, err)
+			}
+		}
+
+		h.Lock()
+		h.kdcs = results
+		h.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kdcProbeInterval):
+		}
+	}
+}
+
+// Liveness: connected to NRI, or reconnecting, and watching hook directories.
+func (h *health) healthz(w http.ResponseWriter, _ *http.Request) {
+	var sb strings.Builder
+	ok := h.writeLiveness(&sb)
+	writeHealth(w, ok, sb.String())
+}
+
+// Readiness: live and connected, and at least one known KDC reachable.
+func (h *health) readyz(w http.ResponseWriter, _ *http.Request) {
+	var sb strings.Builder
+	ok := h.writeLiveness(&sb) && h.connected.Load()
+
+	h.Lock()
+	addrs := make([]string, 0, len(h.kdcs))
+	for addr := range h.kdcs {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+	reachable := len(addrs) == 0
+	for _, addr := range addrs {
+		if err := h.kdcs[addr]; err != nil {
+			fmt.Fprintf(&sb, "kdc %s: %v\n", addr, err)
+		} else {
+			fmt.Fprintf(&sb, "kdc %s: ok\n", addr)
+			reachable = true
+		}
+	}
+	h.Unlock()
+
+	writeHealth(w, ok && reachable, sb.String())
+}
+
+func (h *health) writeLiveness(sb *strings.Builder) bool {
+	ok := true
+	switch {
+	case h.connected.Load():
+		sb.WriteString("nri: ok\n")
+	case h.reconnecting.Load():
+		sb.WriteString("nri: reconnecting\n")
+	default:
+		sb.WriteString("nri: not connected\n")
+		ok = false
+	}
+	if h.watching.Load() {
+		sb.WriteString("hook watcher: ok\n")
+	} else {
+		sb.WriteString("hook watcher: not running\n")
+		ok = false
+	}
+	return ok
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write([]byte(body))
+}
+
+// KDCs of the node configuration, the KerberosIdentities and DNS, for probing.
+func (p *plugin) knownKDCs() []string {
+	cfg := p.config()
+	var kdcs []string
+	if cfg.DefaultKDC != "" {
+		kdcs = append(kdcs, cfg.DefaultKDC)
+	}
+	kdcs = append(kdcs, cfg.KDCs...)
+	if cfg.KDCProxy != nil && cfg.KDCProxy.address() != "" {
+		kdcs = append(kdcs, cfg.KDCProxy.address())
+	}
+	for _, r := range cfg.Realms {
+		kdcs = append(kdcs, r.KDCs...)
+		if r.KDCProxy != nil && r.KDCProxy.address() != "" {
+			kdcs = append(kdcs, r.KDCProxy.address())
+		}
+	}
+	kdcs = append(kdcs, p.discovery.list()...)
+	if p.identities != nil {
+		for _, id := range p.identities.list() {
+			kdcs = append(kdcs, id.Spec.KDCs...)
+		}
+	}
+	slices.Sort(kdcs)
+	return slices.Compact(kdcs)
+}
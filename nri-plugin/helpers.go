@@ -0,0 +1,213 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mount point of the cgroup v2 hierarchy helper cgroups are created in.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Period of the CPU bandwidth limit of helpers.
+const helperCPUPeriod = 100000
+
+// Limits of the external commands the plugin runs: the hook script, kinit and
+// kadmin, mount(8), nfsidmap and those of managing rpc.gssd. These run in a
+// cgroup v2 of their own, so that a misbehaving one cannot starve the kubelet
+// and the node, and no more than maxParallel at a time.
+type helpersConfig struct {
+	// Cgroup of the helpers below /sys/fs/cgroup, created if missing. Its
+	// parent must delegate the cpu, memory and pids controllers. Without it
+	// helpers run in the cgroup of the plugin.
+	Cgroup string `json:"cgroup,omitempty"`
+	// CPU of the node the helpers may use together, in cores.
+	CPU float64 `json:"cpu,omitempty"`
+	// Memory the helpers may use together, in bytes with an optional K, M
+	// or G suffix, as for memory.max.
+	Memory string `json:"memory,omitempty"`
+	// Processes the helpers may have together, counting their children.
+	Pids int `json:"pids,omitempty"`
+	// Helpers run at a time, others waiting for one to finish. Unlimited
+	// by default.
+	MaxParallel int `json:"maxParallel,omitempty"`
+}
+
+var memoryLimit = regexp.MustCompile(`^[0-9]+[KMG]?$`)
+
+func (c *helpersConfig) validate() error {
+	switch {
+	case c.CPU < 0 || c.Pids < 0 || c.MaxParallel < 0:
+		return errors.New("cpu, pids and maxParallel must not be negative")
+	case c.Memory != "" && !memoryLimit.MatchString(c.Memory):
+		return fmt.Errorf("invalid memory %q, must be bytes with an optional K, M or G suffix", c.Memory)
+	case c.Cgroup == "" && (c.CPU > 0 || c.Memory != "" || c.Pids > 0):
+		return errors.New("cpu, memory and pids need a cgroup")
+	case c.Cgroup != "" && (filepath.IsAbs(c.Cgroup) || !filepath.IsLocal(c.Cgroup)):
+		return fmt.Errorf("invalid cgroup %q, must be a relative path below %s", c.Cgroup, cgroupRoot)
+	}
+	return nil
+}
+
+// Runner of the helpers with the limits configured, see helpersConfig.
+type helperPool struct {
+	slots  chan struct{}
+	cgroup string
+	fd     int
+
+	sync.Mutex
+	oomKills uint64
+}
+
+// Helpers of the process, without limits until setupHelpers.
+var helpers = &helperPool{fd: -1}
+
+// Create the cgroup of the helpers with the limits configured, failing if
+// the hierarchy does not allow it rather than running helpers unconfined.
+func setupHelpers(cfg helpersConfig) error {
+	h := &helperPool{fd: -1}
+	if cfg.MaxParallel > 0 {
+		h.slots = make(chan struct{}, cfg.MaxParallel)
+	}
+	if cfg.Cgroup != "" {
+		var fs unix.Statfs_t
+		if err := unix.Statfs(cgroupRoot, &fs); err != nil || fs.Type != unix.CGROUP2_SUPER_MAGIC {
+			return fmt.Errorf("no cgroup v2 hierarchy mounted at %s", cgroupRoot)
+		}
+		h.cgroup = filepath.Join(cgroupRoot, cfg.Cgroup)
+		if err := os.MkdirAll(h.cgroup, 0755); err != nil {
+			return fmt.Errorf("failed to create helper cgroup: %w", err)
+		}
+		// The controllers may well be enabled already, and cannot be
+		// where the parent has processes of its own, which the limits tell.
+		_ = os.WriteFile(filepath.Join(filepath.Dir(h.cgroup), "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0)
+		limits := map[string]string{}
+		if cfg.CPU > 0 {
+			limits["cpu.max"] = fmt.Sprintf("%d %d", max(int(cfg.CPU*helperCPUPeriod), 1000), helperCPUPeriod)
+		}
+		if cfg.Memory != "" {
+			limits["memory.max"] = cfg.Memory
+		}
+		if cfg.Pids > 0 {
+			limits["pids.max"] = strconv.Itoa(cfg.Pids)
+		}
+		for file, value := range limits {
+			if err := os.WriteFile(filepath.Join(h.cgroup, file), []byte(value), 0); err != nil {
+				return fmt.Errorf("failed to set %s of helper cgroup %s: %w", file, h.cgroup, err)
+			}
+		}
+		fd, err := syscall.Open(h.cgroup, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open helper cgroup: %w", err)
+		}
+		h.fd = fd
+		h.oomKills = h.readOOMKills()
+		log.Infof("running helpers in cgroup %s", h.cgroup)
+	}
+	helpers = h
+	return nil
+}
+
+// Run the command of a helper through run, once a slot is free and in the
+// cgroup of the helpers, recording the resources it used.
+func (h *helperPool) run(ctx context.Context, cmd *exec.Cmd, run func() error) error {
+	helper := filepath.Base(cmd.Path)
+	if h.slots != nil {
+		start := time.Now()
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting to run %s: %w", helper, ctx.Err())
+		}
+		defer func() { <-h.slots }()
+		helperWaits.Observe(time.Since(start).Seconds())
+	}
+	if h.fd >= 0 {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = h.fd
+	}
+
+	helpersRunning.Inc()
+	err := run()
+	helpersRunning.Dec()
+	helperRuns.WithLabelValues(helper, result(err)).Inc()
+	if ps := cmd.ProcessState; ps != nil {
+		helperCPUSeconds.WithLabelValues(helper).Add((ps.UserTime() + ps.SystemTime()).Seconds())
+		if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+			helperMemory.WithLabelValues(helper).Observe(float64(ru.Maxrss) * 1024)
+		}
+	}
+	if h.fd >= 0 {
+		h.countOOMKills(helper)
+	}
+	return err
+}
+
+// Run the command of a helper as run does, returning its combined output.
+func (h *helperPool) combinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var out []byte
+	err := h.run(ctx, cmd, func() (err error) {
+		out, err = cmd.CombinedOutput()
+		return err
+	})
+	return out, err
+}
+
+// Count the helpers the kernel killed for running out of the memory of the
+// cgroup since the last run, logging them against the helper just finished.
+func (h *helperPool) countOOMKills(helper string) {
+	kills := h.readOOMKills()
+	h.Lock()
+	n := kills - min(h.oomKills, kills)
+	h.oomKills = kills
+	h.Unlock()
+	if n > 0 {
+		helperOOMKills.Add(float64(n))
+		log.Warnf("%d helper processes killed out of memory of cgroup %s, last run %s", n, h.cgroup, helper)
+	}
+}
+
+func (h *helperPool) readOOMKills() uint64 {
+	data, err := os.ReadFile(filepath.Join(h.cgroup, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for line := range bytes.Lines(data) {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(string(line)), "oom_kill "); ok {
+			n, _ := strconv.ParseUint(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Annotation mapping the KDC and NFS host names of a pod to addresses, as
+// kdc.lab.example=10.0.0.5,nfs.lab.example=fd00::20, for labs without DNS for
+// them.
+const hostAliasesAnnotation = "kerberos-host-aliases"
+
+const (
+	// Name of the hosts file of a pod with host aliases in the pod credential
+	// cache directory.
+	podHostsName = "hosts"
+	// Container path the hosts file is mounted at.
+	hostsMountPath = "/etc/hosts"
+	// Name of the hosts file the kubelet writes for a pod in its directory.
+	kubeletHostsName = "etc-hosts"
+)
+
+// Host aliases, taken by the plugin for the KDC and NFS host names of the pods
+// annotated with them and put in the /etc/hosts of their containers.
+type hostAliasesConfig struct {
+	// Namespaces whose pods may set host aliases.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Check whether the pods of the namespace may set host aliases.
+func (cfg *hostAliasesConfig) allows(namespace string) bool {
+	return slices.Contains(cfg.Namespaces, namespace)
+}
+
+// Parse host aliases, name=address pairs separated by commas or whitespace,
+// into addresses by lower case host name.
+func parseHostAliases(value string) (map[string]string, error) {
+	aliases := map[string]string{}
+	for _, pair := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		name, addr, ok := strings.Cut(pair, "=")
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		ip := net.ParseIP(hostOf(addr))
+		switch {
+		case !ok || name == "" || ip == nil:
+			return nil, fmt.Errorf("%q must be a host name and an IP address, as kdc.example.com=10.0.0.5", pair)
+		case net.ParseIP(name) != nil || strings.ContainsAny(name, "/:@[]"):
+			return nil, fmt.Errorf("%q is not a host name", name)
+		case aliases[name] != "" && aliases[name] != ip.String():
+			return nil, fmt.Errorf("%s given both %s and %s", name, aliases[name], ip)
+		}
+		aliases[name] = ip.String()
+	}
+	if len(aliases) == 0 {
+		return nil, fmt.Errorf("no host aliases in %q", value)
+	}
+	return aliases, nil
+}
+
+// Address of a host, with its port if it has one, the alias of the workload
+// in place of the host name where it has one.
+func (kp *kerberosParams) hostAddress(addr string) string {
+	ip, ok := kp.HostAliases[strings.ToLower(hostOf(addr))]
+	if !ok {
+		return addr
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(ip, port)
+	}
+	return ip
+}
+
+func (kp *kerberosParams) hostAddresses(addrs []string) []string {
+	var out []string
+	for _, addr := range addrs {
+		out = append(out, kp.hostAddress(addr))
+	}
+	return out
+}
+
+// Whether the workload has an alias for the host.
+func (kp *kerberosParams) aliased(host string) bool {
+	_, ok := kp.HostAliases[strings.ToLower(hostOf(host))]
+	return ok
+}
+
+// The parameters with the KDCs at their aliases, for reaching them from the
+// node: a copy if the workload has host aliases, kp otherwise.
+func (kp *kerberosParams) withHostAliases() *kerberosParams {
+	if len(kp.HostAliases) == 0 {
+		return kp
+	}
+	aliased := *kp
+	aliased.KDC, aliased.KDCs = kp.hostAddress(kp.KDC), kp.hostAddresses(kp.KDCs)
+	aliased.TrustRealms = nil
+	for _, r := range kp.TrustRealms {
+		r.KDCs = kp.hostAddresses(r.KDCs)
+		aliased.TrustRealms = append(aliased.TrustRealms, r)
+	}
+	return &aliased
+}
+
+// Write the hosts file of a pod with host aliases into its credential cache
+// directory: the one the kubelet wrote for the pod, or that of the node for
+// pods without, followed by the aliases.
+func (p *plugin) writePodHosts(pod *api.PodSandbox, kp *kerberosParams, dir string) error {
+	base, err := os.ReadFile(filepath.Join(p.config().MountCheck.kubeletDir(), "pods", pod.GetUid(), kubeletHostsName))
+	if os.IsNotExist(err) {
+		base, err = os.ReadFile(hostsMountPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the hosts file of the pod: %w", err)
+	}
+	var b strings.Builder
+	b.Write(base)
+	if len(base) > 0 && base[len(base)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	b.WriteString("\n# Kerberos host aliases.\n")
+	for _, name := range slices.Sorted(maps.Keys(kp.HostAliases)) {
+		fmt.Fprintf(&b, "%s\t%s\n", kp.HostAliases[name], name)
+	}
+	// readable by the workload, the kubelet writes it 0644 as well
+	if err := writePodFile(filepath.Join(dir, podHostsName), []byte(b.String()), int(kp.UID), kp.ccacheGID()); err != nil {
+		return err
+	}
+	return os.Chmod(filepath.Join(dir, podHostsName), 0644)
+}
+
+// Whether the container has the hosts file the kubelet writes, or none, so
+// that the one with the host aliases of the pod may be mounted instead.
+func kubeletHosts(container *api.Container) bool {
+	for _, m := range container.GetMounts() {
+		if filepath.Clean(m.GetDestination()) == hostsMountPath {
+			return filepath.Base(m.GetSource()) == kubeletHostsName
+		}
+	}
+	return true
+}
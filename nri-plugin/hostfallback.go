@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Credentials of the node for pods whose user has none yet: with no keytab or
+// password of the user, or no principal of it in the KDC, the pods of the
+// namespaces allowed mount their NFS volumes with the TGT of a principal of
+// the node. The credential cache is owned by the uid and gid of the pod all
+// the same, so that rpc.gssd uses it for the processes of the pod, while the
+// NFS server sees the node principal. Meant for bringing a cluster up before
+// every user keytab is in place.
+type hostFallbackConfig struct {
+	// Namespaces whose pods fall back to the node credentials, none by
+	// default.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Keytab of the node principal, /etc/krb5.keytab by default.
+	Keytab string `json:"keytab,omitempty"`
+	// Node principal without realm, nfs-client/<hostname> by default.
+	Principal string `json:"principal,omitempty"`
+}
+
+// Check whether a failed setup of the credentials of a pod in the namespace
+// falls back to the node credentials: those of users without credentials,
+// rather than with ones the KDC refused.
+func (c *hostFallbackConfig) applies(namespace string, kp *kerberosParams, err error) bool {
+	return slices.Contains(c.Namespaces, namespace) && kp.PKINIT == nil && kp.Anonymous == nil &&
+		(errors.Is(err, errKeytabUnavailable) || errors.Is(err, errPrincipalUnknown))
+}
+
+// Parameters of the workload with the node principal and its keytab.
+func (c *hostFallbackConfig) params(kp *kerberosParams) (*kerberosParams, error) {
+	name := c.Principal
+	if name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		name = "nfs-client/" + host
+	}
+	keytab := c.Keytab
+	if keytab == "" {
+		keytab = defaultFASTKeytab
+	}
+	fallback := *kp
+	fallback.Name, fallback.Keytab, fallback.Password = name, keytab, ""
+	fallback.HostFallback = true
+	return &fallback, nil
+}
+
+// Set up the node credentials for a pod whose own failed with err, replacing
+// its parameters with those of the node principal on success.
+func (p *plugin) setupHostFallback(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams, err error) error {
+	fallback, ferr := cfg.HostFallback.params(kp)
+	if ferr != nil {
+		return fmt.Errorf("%w, no node credentials: %v", err, ferr)
+	}
+	if ferr := p.backend.Setup(ctx, fallback); ferr != nil {
+		return fmt.Errorf("%w, node credentials of %s failed: %v", err, fallback.Principal(), ferr)
+	}
+	l.Warnf("%v, mounting with the node credentials of %s", err, fallback.Principal())
+	p.events.warn(pod, reasonHostCredentials, "no credentials for %s (%s), NFS volumes accessed as %s",
+		kp.Principal(), failureReason(err), fallback.Principal())
+	*kp = *fallback
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Host of an address which may have a port, without the brackets of an IPv6
+// literal: kdc.example.com, kdc.example.com:88, fd00::88, [fd00::88] and
+// [fd00::88]:88 all work.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// Address with the port given, unless it has one, bracketing IPv6 literals.
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(hostOf(addr), port)
+}
+
+// Host of an address as a URL takes it, without its port, IPv6 literals in
+// brackets: kdc.example.com:88 gives kdc.example.com, fd00::88 [fd00::88].
+func urlHost(addr string) string {
+	if host := hostOf(addr); strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return hostOf(addr)
+}
+
+// Address as krb5.conf takes it, with IPv6 literals in brackets.
+func krb5Address(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	if host := hostOf(addr); strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return addr
+}
+
+func krb5Addresses(addrs []string) []string {
+	var out []string
+	for _, addr := range addrs {
+		out = append(out, krb5Address(addr))
+	}
+	return out
+}
+
+// Server and export of an NFS mount source, server:/export, the server an
+// IPv6 literal in brackets as in [fd00::20]:/export. The server is returned
+// without brackets.
+func splitNFSSource(source string) (server, export string) {
+	if rest, ok := strings.CutPrefix(source, "["); ok {
+		if host, export, ok := strings.Cut(rest, "]:"); ok {
+			return host, export
+		}
+	}
+	server, export, _ = strings.Cut(source, ":")
+	return server, export
+}
+
+// NFS mount source of an export of a server, bracketing IPv6 literals.
+func nfsSource(server, export string) string {
+	if strings.Contains(server, ":") {
+		server = "[" + server + "]"
+	}
+	return server + ":" + export
+}
+
+// Whether the server is one of the servers, however either are written.
+func sameServer(servers []string, server string) bool {
+	for _, s := range servers {
+		if strings.EqualFold(hostOf(s), hostOf(server)) {
+			return true
+		}
+	}
+	return false
+}
+
+// The IPv6 variant of a transport for servers given by IPv6 literal, as
+// mount.nfs wants tcp6 and rdma6 for them.
+func protoFor(server, proto string) string {
+	if ip := net.ParseIP(hostOf(server)); ip == nil || ip.To4() != nil {
+		return proto
+	}
+	switch proto {
+	case "tcp", "rdma", "udp":
+		return proto + "6"
+	}
+	return proto
+}
+
+// Addresses of the KDCs for gokrb5, which resolves a host name to a single
+// address: host names with addresses of both families are replaced by these,
+// alternating between the families starting with IPv6, so that gokrb5, trying
+// the KDCs one after the other, falls back to the other family when one cannot
+// reach the KDC. Host names which do not resolve or have one family only are
+// kept.
+func dualStackKDCs(ctx context.Context, kdcs []string) []string {
+	var out []string
+	for _, kdc := range kdcs {
+		addr := withPort(kdc, kdcPort)
+		host, port, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) != nil {
+			out = append(out, addr)
+			continue
+		}
+		ips, err := resolverFor(host).LookupIPAddr(ctx, host)
+		var v4, v6 []string
+		for _, ip := range ips {
+			if ip.IP.To4() != nil {
+				v4 = append(v4, net.JoinHostPort(ip.IP.String(), port))
+			} else {
+				v6 = append(v6, net.JoinHostPort(ip.IP.String(), port))
+			}
+		}
+		if err != nil || len(v4) == 0 || len(v6) == 0 {
+			out = append(out, addr)
+			continue
+		}
+		for i := 0; i < max(len(v4), len(v6)); i++ {
+			if i < len(v6) {
+				out = append(out, v6[i])
+			}
+			if i < len(v4) {
+				out = append(out, v4[i])
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestHostOf(t *testing.T) {
+	for _, tc := range []struct {
+		addr     string
+		wantHost string
+		// withPort with port 88 and krb5Address
+		wantWithPort string
+		wantKrb5     string
+	}{
+		{"kdc.example.com", "kdc.example.com", "kdc.example.com:88", "kdc.example.com"},
+		{"kdc.example.com:750", "kdc.example.com", "kdc.example.com:750", "kdc.example.com:750"},
+		{"192.0.2.88", "192.0.2.88", "192.0.2.88:88", "192.0.2.88"},
+		{"192.0.2.88:750", "192.0.2.88", "192.0.2.88:750", "192.0.2.88:750"},
+		{"fd00::88", "fd00::88", "[fd00::88]:88", "[fd00::88]"},
+		{"[fd00::88]", "fd00::88", "[fd00::88]:88", "[fd00::88]"},
+		{"[fd00::88]:750", "fd00::88", "[fd00::88]:750", "[fd00::88]:750"},
+	} {
+		t.Run(tc.addr, func(t *testing.T) {
+			if got := hostOf(tc.addr); got != tc.wantHost {
+				t.Errorf("hostOf() = %q, want %q", got, tc.wantHost)
+			}
+			if got := withPort(tc.addr, "88"); got != tc.wantWithPort {
+				t.Errorf("withPort() = %q, want %q", got, tc.wantWithPort)
+			}
+			if got := krb5Address(tc.addr); got != tc.wantKrb5 {
+				t.Errorf("krb5Address() = %q, want %q", got, tc.wantKrb5)
+			}
+		})
+	}
+}
+
+func TestNFSSource(t *testing.T) {
+	for _, tc := range []struct {
+		source     string
+		wantServer string
+		wantExport string
+	}{
+		{"nfs.example.com:/home/alice", "nfs.example.com", "/home/alice"},
+		{"192.0.2.20:/home/alice", "192.0.2.20", "/home/alice"},
+		{"[fd00::20]:/home/alice", "fd00::20", "/home/alice"},
+		{"[fd00::20]:/home/a:b", "fd00::20", "/home/a:b"},
+	} {
+		t.Run(tc.source, func(t *testing.T) {
+			server, export := splitNFSSource(tc.source)
+			if server != tc.wantServer || export != tc.wantExport {
+				t.Errorf("splitNFSSource() = %q, %q, want %q, %q", server, export, tc.wantServer, tc.wantExport)
+			}
+			if got := nfsSource(server, export); got != tc.source {
+				t.Errorf("nfsSource() = %q, want %q", got, tc.source)
+			}
+		})
+	}
+}
+
+func TestSameServer(t *testing.T) {
+	servers := []string{"NFS.example.com", "[fd00::20]:2049"}
+	for _, tc := range []struct {
+		server string
+		want   bool
+	}{
+		{"nfs.example.com", true},
+		{"nfs.example.com:2049", true},
+		{"fd00::20", true},
+		{"[fd00::20]", true},
+		{"fd00::21", false},
+		{"nfs2.example.com", false},
+	} {
+		if got := sameServer(servers, tc.server); got != tc.want {
+			t.Errorf("sameServer(%q) = %v, want %v", tc.server, got, tc.want)
+		}
+	}
+}
+
+func TestProtoFor(t *testing.T) {
+	for _, tc := range []struct {
+		server, proto, want string
+	}{
+		{"nfs.example.com", "tcp", "tcp"},
+		{"192.0.2.20", "tcp", "tcp"},
+		{"fd00::20", "tcp", "tcp6"},
+		{"[fd00::20]:2049", "rdma", "rdma6"},
+		{"fd00::20", "tcp6", "tcp6"},
+		{"::ffff:192.0.2.20", "tcp", "tcp"},
+	} {
+		if got := protoFor(tc.server, tc.proto); got != tc.want {
+			t.Errorf("protoFor(%q, %q) = %q, want %q", tc.server, tc.proto, got, tc.want)
+		}
+	}
+}
+
+func TestExpandKeytabURL(t *testing.T) {
+	for _, tc := range []struct {
+		kdc  string
+		user string
+		want string
+	}{
+		{"kdc.example.com", "alice", "http://kdc.example.com:8080/keytabs/alice.keytab"},
+		{"kdc.example.com:88", "alice", "http://kdc.example.com:8080/keytabs/alice.keytab"},
+		{"192.0.2.88:750", "alice", "http://192.0.2.88:8080/keytabs/alice.keytab"},
+		{"fd00::1", "alice", "http://[fd00::1]:8080/keytabs/alice.keytab"},
+		{"[fd00::1]", "alice", "http://[fd00::1]:8080/keytabs/alice.keytab"},
+		{"[fd00::1]:88", "alice", "http://[fd00::1]:8080/keytabs/alice.keytab"},
+		{"kdc.example.com", "a b?c", "http://kdc.example.com:8080/keytabs/a%20b%3Fc.keytab"},
+	} {
+		t.Run(tc.kdc+"/"+tc.user, func(t *testing.T) {
+			got := expandKeytabURL(defaultKeytabURL, tc.kdc, tc.user)
+			if got != tc.want {
+				t.Errorf("expandKeytabURL() = %q, want %q", got, tc.want)
+			}
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := net.JoinHostPort(hostOf(tc.kdc), "8080"); u.Host != want {
+				t.Errorf("host = %q, want %q", u.Host, want)
+			}
+			if want := "/keytabs/" + tc.user + ".keytab"; u.Path != want {
+				t.Errorf("path = %q, want %q", u.Path, want)
+			}
+		})
+	}
+}
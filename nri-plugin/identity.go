@@ -0,0 +1,361 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Collection path of the cluster-scoped KerberosIdentity resources.
+const identitiesPath = "/apis/kerberos.nri.io/v1alpha1/kerberosidentities"
+
+// Kerberos policy for a set of namespaces.
+type kerberosIdentity struct {
+	Metadata struct {
+		Name              string    `json:"name"`
+		ResourceVersion   string    `json:"resourceVersion,omitempty"`
+		Generation        int64     `json:"generation,omitempty"`
+		CreationTimestamp time.Time `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Spec   kerberosIdentitySpec   `json:"spec"`
+	Status kerberosIdentityStatus `json:"status,omitempty"`
+}
+
+type kerberosIdentitySpec struct {
+	// Namespaces the policy applies to.
+	Namespaces []string `json:"namespaces"`
+	// Kerberos realm of the workloads.
+	Realm string `json:"realm"`
+	// KDCs of the realm, in order of preference.
+	KDCs []string `json:"kdcs"`
+	// NFS server hostname.
+	NFSServer string `json:"nfsServer,omitempty"`
+	// DNS domains of the realm.
+	Domains []string `json:"domains,omitempty"`
+	// NFS security flavor of the workloads, krb5, krb5i or krb5p.
+	Sec string `json:"sec,omitempty"`
+	// Credential cache type of the workloads, FILE, DIR, KEYRING or KCM.
+	CCacheType string `json:"ccacheType,omitempty"`
+	// Glob patterns of the user names workloads may authenticate as, any if empty.
+	AllowedPrincipals []string `json:"allowedPrincipals,omitempty"`
+	// Template of the principal names of the workloads, overriding that of the node.
+	PrincipalTemplate string `json:"principalTemplate,omitempty"`
+	// Rules resolving uid, gid and fsid of a user, the first matching one applies.
+	IDRules []identityIDRule `json:"idRules,omitempty"`
+}
+
+// Resolution of the ids of users matching a pattern. Ids given by a rule
+// fill in missing pod annotations and must match the ones present.
+type identityIDRule struct {
+	// Glob pattern of the user name.
+	Principal string `json:"principal"`
+	// Take the uid from the trailing digits of the user name, e.g. 10002 for user10002.
+	UIDFromPrincipal bool    `json:"uidFromPrincipal,omitempty"`
+	UID              *uint64 `json:"uid,omitempty"`
+	GID              *uint64 `json:"gid,omitempty"`
+	FSID             *uint64 `json:"fsid,omitempty"`
+}
+
+type kerberosIdentityStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Namespaces the policy is in effect for.
+	Namespaces []string            `json:"namespaces,omitempty"`
+	Conditions []identityCondition `json:"conditions,omitempty"`
+}
+
+type identityCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+var (
+	realmRegexp    = regexp.MustCompile(`^[A-Z0-9][A-Z0-9.-]*$`)
+	trailingDigits = regexp.MustCompile(`[0-9]+$`)
+)
+
+// Check the spec for errors.
+func (s *kerberosIdentitySpec) validate() error {
+	if len(s.Namespaces) == 0 {
+		return errors.New("no namespaces")
+	}
+	if !realmRegexp.MatchString(s.Realm) {
+		return fmt.Errorf("invalid realm %q, must be upper case", s.Realm)
+	}
+	if len(s.KDCs) == 0 {
+		return errors.New("no KDCs")
+	}
+	if err := validSec(s.Sec); err != nil {
+		return err
+	}
+	if err := validCCacheType(s.CCacheType); err != nil {
+		return err
+	}
+	for _, pattern := range s.AllowedPrincipals {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid principal pattern %q", pattern)
+		}
+	}
+	if _, err := parsePrincipalTemplate(s.PrincipalTemplate); err != nil {
+		return err
+	}
+	for _, r := range s.IDRules {
+		if _, err := path.Match(r.Principal, ""); err != nil {
+			return fmt.Errorf("invalid principal pattern %q", r.Principal)
+		}
+		if r.UIDFromPrincipal && r.UID != nil {
+			return fmt.Errorf("rule %q sets both uid and uidFromPrincipal", r.Principal)
+		}
+	}
+	return nil
+}
+
+// Check whether workloads may authenticate as the user.
+func (id *kerberosIdentity) allows(user string) bool {
+	if len(id.Spec.AllowedPrincipals) == 0 {
+		return true
+	}
+	for _, pattern := range id.Spec.AllowedPrincipals {
+		if ok, _ := path.Match(pattern, user); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve the ids of the user by the first matching rule. Ids the rule does
+// not give are returned as 0.
+func (id *kerberosIdentity) resolveIDs(user string) (uid, gid, fsid uint64, ok bool) {
+	for _, r := range id.Spec.IDRules {
+		if match, _ := path.Match(r.Principal, user); !match {
+			continue
+		}
+		if r.UIDFromPrincipal {
+			uid, _ = strconv.ParseUint(trailingDigits.FindString(user), 10, 32)
+		}
+		if r.UID != nil {
+			uid = *r.UID
+		}
+		if r.GID != nil {
+			gid = *r.GID
+		}
+		if r.FSID != nil {
+			fsid = *r.FSID
+		}
+		return uid, gid, fsid, true
+	}
+	return 0, 0, 0, false
+}
+
+// Outcome of resolving the namespaces of a set of identities.
+type identityResolution struct {
+	// Identity in effect for each namespace.
+	byNamespace map[string]*kerberosIdentity
+	// Validation errors by identity name.
+	invalid map[string]error
+	// Namespaces claimed by an older identity, by identity name.
+	conflicts map[string][]string
+}
+
+// Assign namespaces to valid identities. A namespace claimed by several goes
+// to the oldest one, by name if created at the same time.
+func resolveIdentities(ids []*kerberosIdentity) *identityResolution {
+	sorted := append([]*kerberosIdentity{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Metadata, sorted[j].Metadata
+		if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(b.CreationTimestamp)
+		}
+		return a.Name < b.Name
+	})
+
+	res := &identityResolution{
+		byNamespace: map[string]*kerberosIdentity{},
+		invalid:     map[string]error{},
+		conflicts:   map[string][]string{},
+	}
+	for _, id := range sorted {
+		if err := id.Spec.validate(); err != nil {
+			res.invalid[id.Metadata.Name] = err
+			continue
+		}
+		for _, ns := range id.Spec.Namespaces {
+			if _, taken := res.byNamespace[ns]; taken {
+				res.conflicts[id.Metadata.Name] = append(res.conflicts[id.Metadata.Name], ns)
+				continue
+			}
+			res.byNamespace[ns] = id
+		}
+	}
+
+	return res
+}
+
+// Cache of the KerberosIdentity resources, kept up to date with a watch.
+type identityCache struct {
+	kube *kubeClient
+
+	sync.RWMutex
+	items       map[string]*kerberosIdentity
+	byNamespace map[string]*kerberosIdentity
+}
+
+func newIdentityCache(kube *kubeClient) *identityCache {
+	return &identityCache{
+		kube:        kube,
+		items:       map[string]*kerberosIdentity{},
+		byNamespace: map[string]*kerberosIdentity{},
+	}
+}
+
+// Identity in effect for a namespace, or nil. Safe to call on a nil cache.
+func (c *identityCache) forNamespace(namespace string) *kerberosIdentity {
+	if c == nil {
+		return nil
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.byNamespace[namespace]
+}
+
+// All cached identities.
+func (c *identityCache) list() []*kerberosIdentity {
+	c.RLock()
+	defer c.RUnlock()
+	ids := make([]*kerberosIdentity, 0, len(c.items))
+	for _, id := range c.items {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Keep the cache in sync until the context is cancelled, calling changed, if
+// given, after every update.
+func (c *identityCache) run(ctx context.Context, changed func()) {
+	const maxBackoff = 2 * time.Minute
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		err := c.sync(ctx, func() {
+			backoff = time.Second
+			if changed != nil {
+				changed()
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, errGone) {
+			log.Warnf("KerberosIdentity watch failed, retrying in %s: %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+}
+
+// List the identities and watch for changes until the watch ends.
+func (c *identityCache) sync(ctx context.Context, changed func()) error {
+	list := struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*kerberosIdentity `json:"items"`
+	}{}
+	if err := c.kube.do(ctx, http.MethodGet, identitiesPath, "", nil, &list); err != nil {
+		return err
+	}
+
+	items := map[string]*kerberosIdentity{}
+	for _, id := range list.Items {
+		items[id.Metadata.Name] = id
+	}
+	c.update(items)
+	changed()
+
+	rv := list.Metadata.ResourceVersion
+	return c.kube.watch(ctx, identitiesPath, rv, func(ev *watchEvent) error {
+		id := &kerberosIdentity{}
+		if err := json.Unmarshal(ev.Object, id); err != nil {
+			return fmt.Errorf("failed to decode KerberosIdentity: %w", err)
+		}
+		if ev.Type == "BOOKMARK" {
+			return nil
+		}
+
+		c.RLock()
+		items := make(map[string]*kerberosIdentity, len(c.items))
+		for name, old := range c.items {
+			items[name] = old
+		}
+		c.RUnlock()
+
+		if ev.Type == "DELETED" {
+			delete(items, id.Metadata.Name)
+		} else {
+			items[id.Metadata.Name] = id
+		}
+		c.update(items)
+		changed()
+		return nil
+	})
+}
+
+// Replace the cached identities.
+func (c *identityCache) update(items map[string]*kerberosIdentity) {
+	ids := make([]*kerberosIdentity, 0, len(items))
+	for _, id := range items {
+		ids = append(ids, id)
+	}
+	res := resolveIdentities(ids)
+
+	c.Lock()
+	c.items, c.byNamespace = items, res.byNamespace
+	c.Unlock()
+}
+
+// Describe the identity for log messages.
+func (id *kerberosIdentity) String() string {
+	return "KerberosIdentity " + id.Metadata.Name
+}
+
+// Sorted namespaces claimed by the identity in a resolution.
+func (res *identityResolution) namespacesOf(id *kerberosIdentity) []string {
+	var namespaces []string
+	for ns, owner := range res.byNamespace {
+		if owner == id {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
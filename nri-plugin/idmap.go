@@ -0,0 +1,200 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultIDMapConfFile = "/etc/idmapd.conf"
+	// DNS TXT record announcing the NFSv4 ID mapping domain of a DNS domain.
+	idmapDomainRecord  = "_nfsv4idmapdomain"
+	idmapLookupTimeout = 5 * time.Second
+)
+
+// NFSv4 ID mapping of the node, which decides how the owners the NFS server
+// reports map to uids and gids.
+type idmapConfig struct {
+	// Write idmapd.conf and check it against the NFS servers.
+	Manage bool `json:"manage,omitempty"`
+	// ID mapping domain, the DNS domain of the default NFS server if empty.
+	Domain string `json:"domain,omitempty"`
+	// Path of idmapd.conf, /etc/idmapd.conf by default.
+	ConfFile string `json:"confFile,omitempty"`
+	// Static mappings of principals to local user names.
+	Static map[string]string `json:"static,omitempty"`
+}
+
+func (c *idmapConfig) confFile() string {
+	if c.ConfFile != "" {
+		return c.ConfFile
+	}
+	return defaultIDMapConfFile
+}
+
+var idmapConfTemplate = template.Must(template.New("idmapd.conf").Parse(`# Managed by nri-kerberos, do not edit.
+[General]
+Domain = {{ .Domain }}
+{{- if .Realms }}
+Local-Realms = {{ .Realms }}
+{{- end }}
+
+[Translation]
+Method = {{ if .Static }}static,{{ end }}nsswitch
+{{- if .Static }}
+
+[Static]
+{{- range .Static }}
+{{ .Principal }} = {{ .User }}
+{{- end }}
+{{- end }}
+`))
+
+// Data for rendering idmapd.conf.
+type idmapConfData struct {
+	Domain string
+	Realms string
+	Static []idmapStatic
+}
+
+type idmapStatic struct {
+	Principal string
+	User      string
+}
+
+// Domain the ID mapping is configured with.
+func (c *idmapConfig) domain(cfg *config) string {
+	if c.Domain != "" {
+		return c.Domain
+	}
+	return dnsDomain(cfg.DefaultNFS)
+}
+
+// Write idmapd.conf for the node configuration and check that the NFS servers
+// use the same domain. The kernel ID mapping cache is flushed when the file
+// changed.
+func configureIDMap(ctx context.Context, ex Exec, cfg *config) error {
+	c := cfg.IDMap
+	domain := c.domain(cfg)
+	if domain == "" {
+		return errors.New("no idmap domain configured and none to derive from defaultNFS")
+	}
+
+	data := &idmapConfData{Domain: domain}
+	realms := []string{}
+	if cfg.DefaultRealm != "" {
+		realms = append(realms, cfg.DefaultRealm)
+	}
+	for _, realm := range slices.Sorted(maps.Keys(cfg.Realms)) {
+		if realm != cfg.DefaultRealm {
+			realms = append(realms, realm)
+		}
+	}
+	data.Realms = strings.Join(realms, " ")
+	for _, principal := range slices.Sorted(maps.Keys(c.Static)) {
+		data.Static = append(data.Static, idmapStatic{principal, c.Static[principal]})
+	}
+
+	buf := &bytes.Buffer{}
+	if err := idmapConfTemplate.Execute(buf, data); err != nil {
+		return err
+	}
+	// #nosec G306:gosec -- idmapd.conf is world-readable
+	changed, err := installFile(c.confFile(), buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Infof("NFSv4 ID mapping domain %s written to %s", domain, c.confFile())
+		if out, err := ex.Run(ctx, "nfsidmap", "-c"); err != nil {
+			log.Warnf("failed to flush the ID mapping cache: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	servers := nfsServerList(cfg.DefaultNFS)
+	for _, r := range cfg.Realms {
+		servers = append(servers, nfsServerList(r.NFS)...)
+	}
+	slices.Sort(servers)
+	for _, server := range slices.Compact(servers) {
+		if server == "" {
+			continue
+		}
+		if theirs := serverIDMapDomain(ctx, server); theirs != "" && !strings.EqualFold(theirs, domain) {
+			log.Warnf("NFS server %s uses ID mapping domain %s, not %s: owners will show as nobody", server, theirs, domain)
+		}
+	}
+	return nil
+}
+
+// ID mapping domain of an NFS server, as announced in DNS or else the DNS
+// domain of the server, as nfsidmap would default it.
+func serverIDMapDomain(ctx context.Context, server string) string {
+	domain := dnsDomain(server)
+	if domain == "" {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, idmapLookupTimeout)
+	defer cancel()
+	if txt, err := resolverFor(domain).LookupTXT(ctx, idmapDomainRecord+"."+domain); err == nil && len(txt) > 0 {
+		return strings.TrimSpace(txt[0])
+	}
+	return domain
+}
+
+// DNS domain of a host name, without the host label, or empty for bare names
+// and addresses.
+func dnsDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	_, domain, _ := strings.Cut(strings.TrimSuffix(host, "."), ".")
+	return domain
+}
+
+// Check that the user of the workload maps to its uid and gid on the node,
+// returning why not. Users unknown on the node map to nobody, which is
+// reported as well.
+func checkIDMapping(cfg *config, kp *kerberosParams) error {
+	name := kp.User
+	if mapped, ok := cfg.IDMap.Static[kp.Principal()]; ok {
+		name = mapped
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("user %s is unknown on the node, NFS owners will show as nobody", name)
+	}
+	if u.Uid != strconv.FormatUint(kp.UID, 10) || u.Gid != strconv.FormatUint(kp.GID, 10) {
+		return fmt.Errorf("user %s maps to uid %s and gid %s on the node, not %d and %d", name, u.Uid, u.Gid, kp.UID, kp.GID)
+	}
+	return nil
+}
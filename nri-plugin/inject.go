@@ -0,0 +1,311 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSidecarImage       = "krb5-sidecar:latest"
+	defaultHostnamesConfigMap = "service-hostnames"
+	defaultRenewalTime        = "3600"
+
+	sidecarName       = "krb5-sidecar"
+	keytabsVolumeName = "keytabs"
+	ccacheVolumeName  = "ccache"
+	ccacheVolumePath  = "/tmp"
+)
+
+// How the renewal sidecar is injected.
+const (
+	// As the first container of the pod.
+	sidecarModeContainer = "container"
+	// As the first init container with restartPolicy Always, a native
+	// sidecar, started before and stopped after the other containers.
+	sidecarModeNative = "native"
+	// Not at all, for nodes where the plugin renews the credentials.
+	sidecarModeNone = "none"
+)
+
+func validSidecarMode(mode string) error {
+	switch mode {
+	case sidecarModeContainer, sidecarModeNative, sidecarModeNone:
+		return nil
+	}
+	return fmt.Errorf("%q must be container, native or none", mode)
+}
+
+// Mutating webhook injecting the renewal sidecar into pods with Kerberos enabled.
+type injector struct {
+	annotationPrefix string
+	image            string
+	configMap        string
+	renewalTime      string
+	sidecarMode      string
+}
+
+// JSON patch operation.
+type patchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+func (inj *injector) annotation(name string) string {
+	return inj.annotationPrefix + name
+}
+
+// Inject the sidecar, env vars and volumes, unless the pod already has a sidecar.
+// Pods which cannot be handled are admitted unchanged with a warning.
+func (inj *injector) mutate(req *admissionRequest, pod *admissionPod) *admissionResponse {
+	rsp := &admissionResponse{Allowed: true}
+	normalizeAnnotations(pod.Metadata.Annotations, inj.annotation)
+	ann := pod.Metadata.Annotations
+	name := pod.name(req.Namespace)
+
+	if ann[inj.annotation("kerberos-auth")] != "enabled" {
+		return rsp
+	}
+	for _, c := range pod.allContainers() {
+		if _, ok := c.env("KERBEROS_RENEWAL_TIME"); ok {
+			log.Infof("%s: has a renewal sidecar already", name)
+			return rsp
+		}
+	}
+
+	user := ann[inj.annotation("kerberos-user")]
+	uid, uidErr := strconv.ParseInt(ann[inj.annotation("kerberos-uid")], 10, 32)
+	gid, gidErr := strconv.ParseInt(ann[inj.annotation("kerberos-gid")], 10, 32)
+	if user == "" || uidErr != nil || gidErr != nil || uid <= 0 || gid <= 0 {
+		msg := fmt.Sprintf("Kerberos sidecar not injected: %s, %s and %s annotations are required",
+			inj.annotation("kerberos-user"), inj.annotation("kerberos-uid"), inj.annotation("kerberos-gid"))
+		log.Warnf("%s: %s", name, msg)
+		rsp.Warnings = append(rsp.Warnings, msg)
+		return rsp
+	}
+	renewal := inj.renewalTime
+	if v, ok := ann[inj.annotation("kerberos-renewal-time")]; ok {
+		if _, err := parseRenewalTime(v); err != nil {
+			msg := fmt.Sprintf("Kerberos sidecar not injected: invalid %s %q", inj.annotation("kerberos-renewal-time"), v)
+			log.Warnf("%s: %s", name, msg)
+			rsp.Warnings = append(rsp.Warnings, msg)
+			return rsp
+		}
+		renewal = v
+	}
+
+	var gids []uint64
+	if v, ok := ann[inj.annotation(gidsAnnotation)]; ok {
+		var err error
+		if gids, err = parseGIDs(v); err != nil {
+			msg := fmt.Sprintf("Kerberos sidecar not injected: %s: %v", inj.annotation(gidsAnnotation), err)
+			log.Warnf("%s: %s", name, msg)
+			rsp.Warnings = append(rsp.Warnings, msg)
+			return rsp
+		}
+	}
+
+	ccname := fmt.Sprintf("FILE:%s/krb5cc_%d", ccacheVolumePath, uid)
+	env := append([]podEnvVar{
+		{Name: "KRB5CCNAME", Value: ccname},
+		{Name: "KERBEROS_USER", Value: user},
+	}, inj.hostnameEnv()...)
+
+	var ops []patchOp
+
+	// supplementary groups of all containers, the sidecar renewing the
+	// credentials as well, which are shared with the first of them
+	if len(gids) > 0 {
+		ops = appendSupplementalGroups(ops, pod.Spec.SecurityContext, gids)
+	}
+
+	// env and credential cache for the workload containers and init containers
+	for _, l := range []struct {
+		path       string
+		containers []podContainer
+	}{
+		{"/spec/initContainers", pod.Spec.InitContainers},
+		{"/spec/containers", pod.Spec.Containers},
+	} {
+		for i, c := range l.containers {
+			base := fmt.Sprintf("%s/%d", l.path, i)
+			missing := []podEnvVar{}
+			for _, e := range env {
+				if _, ok := c.env(e.Name); !ok {
+					missing = append(missing, e)
+				}
+			}
+			ops = appendList(ops, base+"/env", len(c.Env) == 0, missing)
+
+			if !hasVolumeMount(&c, ccacheVolumePath) {
+				ops = appendList(ops, base+"/volumeMounts", len(c.VolumeMounts) == 0,
+					[]podVolumeMount{{Name: ccacheVolumeName, MountPath: ccacheVolumePath}})
+			}
+		}
+	}
+
+	// shared volumes
+	volumes := []podVolume{}
+	for _, v := range []struct{ name, path string }{
+		{keytabsVolumeName, defaultKeytabDir},
+		{ccacheVolumeName, ccacheVolumePath},
+	} {
+		if hasVolume(pod, v.name) || (v.name == keytabsVolumeName && inj.sidecarMode == sidecarModeNone) {
+			continue
+		}
+		volumes = append(volumes, podVolume{
+			Name:     v.name,
+			HostPath: &podHostPath{Path: v.path, Type: "Directory"},
+		})
+	}
+	ops = appendList(ops, "/spec/volumes", len(pod.Spec.Volumes) == 0, volumes)
+
+	// the sidecar goes first, since the plugin sets up credentials when it is created
+	sidecar := &podContainer{
+		Name:            sidecarName,
+		Image:           inj.image,
+		ImagePullPolicy: "IfNotPresent",
+		Env:             append(env, sidecarEnv(renewal, gids)...),
+		VolumeMounts: []podVolumeMount{
+			{Name: keytabsVolumeName, MountPath: defaultKeytabDir, ReadOnly: true},
+			{Name: ccacheVolumeName, MountPath: ccacheVolumePath},
+		},
+		SecurityContext: &podSecurityContext{RunAsUser: &uid, RunAsGroup: &gid},
+		Lifecycle: map[string]any{
+			"preStop": map[string]any{
+				"exec": map[string]any{"command": []string{"/usr/bin/kdestroy"}},
+			},
+		},
+	}
+	what := "sidecar"
+	switch inj.sidecarMode {
+	case sidecarModeNative:
+		sidecar.RestartPolicy = "Always"
+		if len(pod.Spec.InitContainers) == 0 {
+			ops = append(ops, patchOp{Op: "add", Path: "/spec/initContainers", Value: []*podContainer{sidecar}})
+		} else {
+			ops = append(ops, patchOp{Op: "add", Path: "/spec/initContainers/0", Value: sidecar})
+		}
+		what = "native sidecar"
+	case sidecarModeNone:
+		// the plugin renews the credentials
+		what = "env"
+	default:
+		ops = append(ops, patchOp{Op: "add", Path: "/spec/containers/0", Value: sidecar})
+		// kubectl logs and exec still default to the workload
+		if _, ok := ann[defaultContainerAnnotation]; !ok && len(pod.Spec.Containers) > 0 {
+			ops = append(ops, patchOp{Op: "add", Path: "/metadata/annotations/" + jsonPointerEscape(defaultContainerAnnotation),
+				Value: pod.Spec.Containers[0].Name})
+		}
+	}
+
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		rsp.Warnings = append(rsp.Warnings, "Kerberos sidecar not injected: "+err.Error())
+		return rsp
+	}
+	rsp.Patch, rsp.PatchType = patch, "JSONPatch"
+	log.Infof("%s: injecting Kerberos %s for %s", name, what, user)
+
+	return rsp
+}
+
+// Annotation naming the container kubectl logs, exec and attach default to.
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// A JSON Patch path segment, RFC 6901.
+func jsonPointerEscape(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// Env vars taking the realm and hostnames from the hostnames ConfigMap, if any.
+func (inj *injector) hostnameEnv() []podEnvVar {
+	if inj.configMap == "" {
+		return nil
+	}
+	var env []podEnvVar
+	for _, key := range []string{"KERBEROS_REALM", "KDC_HOSTNAME", "NFS_HOSTNAME"} {
+		env = append(env, podEnvVar{Name: key, ValueFrom: &podEnvVarSource{
+			ConfigMapKeyRef: &podConfigMapKeyRef{Name: inj.configMap, Key: key, Optional: true},
+		}})
+	}
+	return env
+}
+
+// Environment of the renewal sidecar, with the group to share the credential
+// cache with, if any.
+func sidecarEnv(renewal string, gids []uint64) []podEnvVar {
+	env := []podEnvVar{{Name: "KERBEROS_RENEWAL_TIME", Value: renewal}}
+	if len(gids) > 0 {
+		env = append(env, podEnvVar{Name: "KERBEROS_CCACHE_GROUP", Value: strconv.FormatUint(gids[0], 10)})
+	}
+	return env
+}
+
+// Add the gids missing from the supplementary groups of the pod.
+func appendSupplementalGroups(ops []patchOp, sc *podSecurityContext, gids []uint64) []patchOp {
+	var missing []int64
+	for _, gid := range gids {
+		if sc == nil || !slices.Contains(sc.SupplementalGroups, int64(gid)) {
+			missing = append(missing, int64(gid))
+		}
+	}
+	if sc == nil {
+		return append(ops, patchOp{Op: "add", Path: "/spec/securityContext", Value: &podSecurityContext{SupplementalGroups: missing}})
+	}
+	return appendList(ops, "/spec/securityContext/supplementalGroups", len(sc.SupplementalGroups) == 0, missing)
+}
+
+// Append patch operations adding items to a list, creating the list if it is empty.
+func appendList[T any](ops []patchOp, path string, empty bool, items []T) []patchOp {
+	if len(items) == 0 {
+		return ops
+	}
+	if empty {
+		return append(ops, patchOp{Op: "add", Path: path, Value: items})
+	}
+	for _, item := range items {
+		ops = append(ops, patchOp{Op: "add", Path: path + "/-", Value: item})
+	}
+	return ops
+}
+
+// Check whether the container mounts a volume at the path.
+func hasVolumeMount(c *podContainer, path string) bool {
+	for _, m := range c.VolumeMounts {
+		if filepath.Clean(m.MountPath) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the pod has a volume of the name.
+func hasVolume(pod *admissionPod, name string) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Lock held by the instance of the plugin managing the pods of the node,
+	// next to the state file to be shared by the pods of the DaemonSet.
+	defaultInstanceLock = "/var/lib/nri-kerberos/instance.lock"
+	// Directory of the NRI plugins the runtime starts itself, named by their
+	// index and name as 10-device-injector.
+	defaultNRIPluginPath = "/opt/nri/plugins"
+	// Interval of the attempts to take the instance lock from another
+	// instance.
+	instanceLockInterval = time.Second
+)
+
+// Instance of the plugin recorded in the instance lock, telling which one is
+// in the way of another.
+type instanceRecord struct {
+	Idx     string    `json:"idx,omitempty"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// Take the instance lock, so that two instances of the plugin, as at
+// different NRI indexes during a botched upgrade, never manage the pods of the
+// node at once: both would set up, renew and clean up the same credentials and
+// mounts. Another instance holding it is waited for until it exits or the
+// context is done. The lock is held as long as the file returned is open, and
+// released by the kernel when the process exits.
+func acquireInstance(ctx context.Context, path, idx string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create instance lock directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open instance lock: %w", err)
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		var other instanceRecord
+		if data, rerr := os.ReadFile(path); rerr == nil {
+			_ = json.Unmarshal(data, &other)
+		}
+		instanceCollisions.Inc()
+		at := "at NRI index " + other.Idx
+		if other.Idx == idx {
+			at = "at the same NRI index " + idx
+		}
+		log.Errorf("another instance of the plugin, pid %d, registered %s since %s, manages the pods of the node: waiting for it to exit",
+			other.PID, at, other.Started.Format(time.RFC3339))
+		ticker := time.NewTicker(instanceLockInterval)
+		defer ticker.Stop()
+		for errors.Is(err, unix.EWOULDBLOCK) {
+			select {
+			case <-ctx.Done():
+				f.Close()
+				return nil, ctx.Err()
+			case <-ticker.C:
+			}
+			err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		}
+		if err == nil {
+			log.Infof("instance pid %d exited, taking over the pods of the node", other.PID)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	data, _ := json.Marshal(instanceRecord{Idx: idx, PID: os.Getpid(), Started: time.Now()})
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt(data, 0)
+	}
+	return f, nil
+}
+
+// Index of the plugin among the NRI plugins of the runtime, which get the
+// events of pods and containers in the order of their indexes. The plugins
+// given with -after, like mount or device plugins adjusting the same
+// containers, must come first: as idx-name with their index, or by name for
+// those found in the NRI plugin directory. Without an index of its own the
+// plugin takes the one after the last of them; one given is checked against
+// them.
+func pluginIndex(idx, plugins, pluginPath string) (string, error) {
+	if idx != "" {
+		if err := api.CheckPluginIndex(idx); err != nil {
+			return "", err
+		}
+	}
+	var after []string
+	for _, plugin := range strings.Split(plugins, ",") {
+		if plugin = strings.TrimSpace(plugin); plugin != "" {
+			after = append(after, plugin)
+		}
+	}
+	if len(after) == 0 {
+		return idx, nil
+	}
+
+	installed := map[string]string{}
+	entries, err := os.ReadDir(pluginPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read NRI plugin directory: %w", err)
+	}
+	for _, e := range entries {
+		if i, name, err := api.ParsePluginName(e.Name()); err == nil {
+			installed[name] = i
+		}
+	}
+
+	last := -1
+	for _, plugin := range after {
+		i, _, err := api.ParsePluginName(plugin)
+		if err != nil {
+			var ok bool
+			if i, ok = installed[plugin]; !ok {
+				log.Warnf("NRI plugin %s not found in %s, cannot tell its index: give it as idx-%s", plugin, pluginPath, plugin)
+				continue
+			}
+		}
+		n, _ := strconv.Atoi(i)
+		if idx != "" && idx <= i {
+			return "", fmt.Errorf("plugin index %s must come after %s of NRI plugin %s", idx, i, strings.TrimPrefix(plugin, i+"-"))
+		}
+		last = max(last, n)
+	}
+	if idx != "" || last < 0 {
+		return idx, nil
+	}
+	if last >= 99 {
+		return "", fmt.Errorf("no plugin index left after %s", strings.Join(after, ", "))
+	}
+	idx = fmt.Sprintf("%02d", last+1)
+	log.Infof("registering at NRI index %s, after %s", idx, strings.Join(after, ", "))
+	return idx, nil
+}
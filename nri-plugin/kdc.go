@@ -0,0 +1,295 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kdcBackoffMin = 30 * time.Second
+	kdcBackoffMax = 10 * time.Minute
+
+	kdcDiscoveryTTL     = 5 * time.Minute
+	kdcDiscoveryTimeout = 2 * time.Second
+)
+
+// Address of a KDC, with the Kerberos port unless it has one.
+func kdcAddress(kdc string) string {
+	return withPort(kdc, kdcPort)
+}
+
+func kdcAddresses(kdcs []string) []string {
+	var out []string
+	for _, kdc := range kdcs {
+		out = append(out, kdcAddress(kdc))
+	}
+	return out
+}
+
+// Health of the KDCs, backing off from each one that could not be reached.
+type kdcTracker struct {
+	clock Clock
+
+	sync.Mutex
+	state map[string]*kdcState
+}
+
+type kdcState struct {
+	failures int
+	until    time.Time
+	// First failure since the KDC was last reached.
+	since time.Time
+}
+
+func newKDCTracker(clock Clock) *kdcTracker {
+	return &kdcTracker{clock: clock, state: map[string]*kdcState{}}
+}
+
+// Record whether the KDC could be reached.
+func (t *kdcTracker) observe(kdc string, err error) {
+	addr := kdcAddress(kdc)
+	t.Lock()
+	defer t.Unlock()
+
+	if err == nil {
+		if s, ok := t.state[addr]; ok {
+			log.Infof("KDC %s reachable again after %d failures", addr, s.failures)
+			delete(t.state, addr)
+		}
+		return
+	}
+	s, ok := t.state[addr]
+	if !ok {
+		s = &kdcState{since: t.clock.Now()}
+		t.state[addr] = s
+	}
+	s.failures++
+	backoff := min(kdcBackoffMin<<min(s.failures-1, 10), kdcBackoffMax)
+	s.until = t.clock.Now().Add(backoff)
+	if s.failures == 1 {
+		log.Warnf("KDC %s unreachable, backing off for %s: %v", addr, backoff, err)
+	} else {
+		log.Debugf("KDC %s still unreachable, backing off for %s: %v", addr, backoff, err)
+	}
+}
+
+// The KDCs in order of preference, with those backed off from moved to the
+// end. A total outage thus still tries all of them.
+func (t *kdcTracker) order(kdcs []string) []string {
+	now := t.clock.Now()
+	t.Lock()
+	defer t.Unlock()
+
+	ordered := slices.Clone(kdcs)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		return compareBool(t.backedOff(a, now), t.backedOff(b, now))
+	})
+	return ordered
+}
+
+// Time since which all the KDCs have been unreachable, zero if any of them
+// was not, or there are none.
+func (t *kdcTracker) downSince(kdcs []string) time.Time {
+	t.Lock()
+	defer t.Unlock()
+	var since time.Time
+	for _, kdc := range kdcs {
+		s, ok := t.state[kdcAddress(kdc)]
+		if !ok {
+			return time.Time{}
+		}
+		if s.since.After(since) {
+			since = s.since
+		}
+	}
+	return since
+}
+
+func (t *kdcTracker) backedOff(kdc string, now time.Time) bool {
+	s, ok := t.state[kdcAddress(kdc)]
+	return ok && now.Before(s.until)
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+// Backend wrapper trying the KDCs of a workload one at a time, healthy ones
+// first, and moving on to the next one when a KDC cannot be reached.
+type failoverBackend struct {
+	KerberosBackend
+	kdcs *kdcTracker
+}
+
+func (b *failoverBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	return b.failover(ctx, kp, b.KerberosBackend.Setup)
+}
+
+func (b *failoverBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	return b.failover(ctx, kp, b.KerberosBackend.Renew)
+}
+
+func (b *failoverBackend) failover(ctx context.Context, kp *kerberosParams, fn func(context.Context, *kerberosParams) error) error {
+	if len(kp.KDCs) == 0 || kp.KDCProxy != nil {
+		return fn(ctx, kp)
+	}
+
+	var err error
+	for _, kdc := range b.kdcs.order(append([]string{kp.KDC}, kp.KDCs...)) {
+		single := *kp
+		single.KDC, single.KDCs = kdc, nil
+		err = fn(ctx, &single)
+		if !errors.Is(err, errKDCUnreachable) {
+			b.kdcs.observe(kdc, nil)
+			return err
+		}
+		b.kdcs.observe(kdc, err)
+		if ctx.Err() != nil {
+			break
+		}
+		loggerFrom(ctx).Infof("KDC %s unreachable for %s, trying the next one", kdc, kp.Principal())
+	}
+	return err
+}
+
+// KDCs of realms found in DNS SRV records, cached for a while.
+type kdcDiscovery struct {
+	clock Clock
+
+	sync.Mutex
+	realms map[string]*discoveredKDCs
+	// Realms of hosts found in DNS TXT records.
+	hosts map[string]*discoveredRealm
+}
+
+type discoveredKDCs struct {
+	kdcs    []string
+	expires time.Time
+}
+
+type discoveredRealm struct {
+	realm   string
+	expires time.Time
+}
+
+func newKDCDiscovery(clock Clock) *kdcDiscovery {
+	return &kdcDiscovery{
+		clock:  clock,
+		realms: map[string]*discoveredKDCs{},
+		hosts:  map[string]*discoveredRealm{},
+	}
+}
+
+// KDCs of the realm from its _kerberos._tcp and _kerberos._udp SRV records, in
+// order of priority. Failed lookups are cached as well, so that a realm
+// without records does not delay every pod start. Safe to call on a nil discovery.
+func (d *kdcDiscovery) lookup(ctx context.Context, realm string) []string {
+	if d == nil || realm == "" {
+		return nil
+	}
+	d.Lock()
+	cached, ok := d.realms[realm]
+	d.Unlock()
+	if ok && d.clock.Now().Before(cached.expires) {
+		return cached.kdcs
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kdcDiscoveryTimeout)
+	defer cancel()
+	var kdcs []string
+	for _, proto := range []string{"tcp", "udp"} {
+		_, addrs, err := resolverFor(realm).LookupSRV(ctx, "kerberos", proto, realm)
+		if err != nil {
+			log.Debugf("no _kerberos._%s SRV records for %s: %v", proto, realm, err)
+			continue
+		}
+		for _, srv := range addrs {
+			kdc := strings.TrimSuffix(srv.Target, ".")
+			if srv.Port != 88 {
+				kdc = net.JoinHostPort(kdc, strconv.Itoa(int(srv.Port)))
+			}
+			if kdc != "" && !slices.Contains(kdcs, kdc) {
+				kdcs = append(kdcs, kdc)
+			}
+		}
+	}
+	if len(kdcs) > 0 {
+		log.Debugf("discovered KDCs of %s: %s", realm, strings.Join(kdcs, ", "))
+	}
+
+	d.Lock()
+	d.realms[realm] = &discoveredKDCs{kdcs: kdcs, expires: d.clock.Now().Add(kdcDiscoveryTTL)}
+	d.Unlock()
+	return kdcs
+}
+
+// Realm of a host from the _kerberos TXT records of it or its domains, empty
+// if none has one. Failed lookups are cached as well. Safe to call on a nil
+// discovery.
+func (d *kdcDiscovery) realm(ctx context.Context, host string) string {
+	if d == nil || host == "" {
+		return ""
+	}
+	d.Lock()
+	cached, ok := d.hosts[host]
+	d.Unlock()
+	if ok && d.clock.Now().Before(cached.expires) {
+		return cached.realm
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kdcDiscoveryTimeout)
+	defer cancel()
+	realm, err := lookupRealm(ctx, host)
+	if err != nil {
+		log.Debugf("no realm of %s in DNS: %v", host, err)
+	} else {
+		log.Debugf("discovered realm %s of %s", realm, host)
+	}
+
+	d.Lock()
+	d.hosts[host] = &discoveredRealm{realm: realm, expires: d.clock.Now().Add(kdcDiscoveryTTL)}
+	d.Unlock()
+	return realm
+}
+
+// All KDCs discovered so far, for probing.
+func (d *kdcDiscovery) list() []string {
+	if d == nil {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	var kdcs []string
+	for _, r := range d.realms {
+		kdcs = append(kdcs, r.kdcs...)
+	}
+	return kdcs
+}
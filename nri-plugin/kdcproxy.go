@@ -0,0 +1,206 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+)
+
+const (
+	kdcProxyContentType = "application/kerberos"
+	kdcProxyTimeout     = 10 * time.Second
+	// Largest Kerberos message relayed, as for MIT krb5 over TCP.
+	kdcProxyMaxMessage = 1 << 20
+)
+
+// Settings of an MS-KKDCP proxy, carrying Kerberos messages over HTTPS for
+// nodes which cannot reach the KDCs directly.
+type kdcProxyConfig struct {
+	// URL of the proxy, e.g. https://proxy.example.com/KdcProxy.
+	URL string `json:"url"`
+	// PEM CA bundle the proxy certificate is verified against, the system roots if empty.
+	CAFile string `json:"caFile,omitempty"`
+	// Skip verification of the proxy certificate, for testing only.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// Address the proxy is reached at, for probing.
+func (c *kdcProxyConfig) address() string {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), "443")
+}
+
+// KDC-PROXY-MESSAGE of MS-KKDCP. The message carries the 4 byte length prefix
+// of a Kerberos message sent over TCP.
+type kdcProxyMessage struct {
+	Message []byte `asn1:"explicit,tag:0"`
+	Domain  string `asn1:"optional,explicit,generalstring,tag:1"`
+}
+
+// Client of an MS-KKDCP proxy.
+type kdcProxy struct {
+	url  string
+	http *http.Client
+}
+
+func newKDCProxy(cfg kdcProxyConfig) (*kdcProxy, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid KDC proxy URL %q, must be https", cfg.URL)
+	}
+
+	// #nosec G402:gosec -- skipping verification is opt-in, for testing
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KDC proxy CA: %w", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in KDC proxy CA %q", cfg.CAFile)
+		}
+	}
+
+	return &kdcProxy{
+		url: cfg.URL,
+		http: &http.Client{
+			Timeout:   kdcProxyTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// Send a length-prefixed Kerberos message for the realm through the proxy,
+// returning the length-prefixed reply.
+func (p *kdcProxy) exchange(ctx context.Context, realm string, msg []byte) ([]byte, error) {
+	body, err := asn1.Marshal(kdcProxyMessage{Message: msg, Domain: realm})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode KDC proxy message: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", kdcProxyContentType)
+
+	rsp, err := p.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("KDC proxy %s: %w", p.url, err)
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, kdcProxyMaxMessage))
+	if err != nil {
+		return nil, fmt.Errorf("KDC proxy %s: %w", p.url, err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KDC proxy %s: %s", p.url, rsp.Status)
+	}
+
+	reply := kdcProxyMessage{}
+	if _, err := asn1.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("KDC proxy %s: invalid reply: %w", p.url, err)
+	}
+	if len(reply.Message) < 4 || int(binary.BigEndian.Uint32(reply.Message)) != len(reply.Message)-4 {
+		return nil, fmt.Errorf("KDC proxy %s: invalid reply length", p.url)
+	}
+	return reply.Message, nil
+}
+
+// Relay Kerberos over TCP from a loopback port to the proxy until stopped,
+// for clients which only talk to KDCs directly. Returns the address to use as
+// the KDC of the realm.
+func (p *kdcProxy) relay(ctx context.Context, realm string) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start KDC proxy relay: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(ctx, conn, realm)
+		}
+	}()
+	stop := func() {
+		cancel()
+		ln.Close()
+	}
+	return ln.Addr().String(), stop, nil
+}
+
+// Relay the messages of a connection, closing it on the first failure.
+func (p *kdcProxy) serve(ctx context.Context, conn net.Conn, realm string) {
+	defer conn.Close()
+	l := loggerFrom(ctx)
+	for {
+		var prefix [4]byte
+		if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+			if !errors.Is(err, io.EOF) {
+				l.Debugf("KDC proxy relay read failed: %v", err)
+			}
+			return
+		}
+		n := binary.BigEndian.Uint32(prefix[:])
+		if n > kdcProxyMaxMessage {
+			l.Warnf("KDC proxy relay: message of %d bytes too large", n)
+			return
+		}
+		msg := make([]byte, 4+n)
+		copy(msg, prefix[:])
+		if _, err := io.ReadFull(conn, msg[4:]); err != nil {
+			l.Debugf("KDC proxy relay read failed: %v", err)
+			return
+		}
+
+		reply, err := p.exchange(ctx, realm, msg)
+		if err != nil {
+			l.Warnf("KDC proxy relay for %s failed: %v", realm, err)
+			return
+		}
+		if _, err := conn.Write(reply); err != nil {
+			l.Debugf("KDC proxy relay write failed: %v", err)
+			return
+		}
+	}
+}
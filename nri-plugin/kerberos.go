@@ -18,12 +18,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/containers/common/pkg/hooks"
 	"github.com/sirupsen/logrus"
@@ -40,39 +49,644 @@ var (
 type plugin struct {
 	stub stub.Stub
 	mgr  *hooks.Manager
+	cfg  atomic.Pointer[config]
+	// Configuration file, and the options of the NRI configuration it is
+	// loaded over.
+	configFile     string
+	runtimeOptions atomic.Pointer[runtimeOptions]
+	// Runtime the plugin is connected to, and whether it connected before.
+	containerRuntime atomic.Pointer[containerRuntime]
+	runtimeConnected atomic.Bool
+	audit            *auditLogger
+	cleaner          *cleaner
+	// Scheduled renewals of managed credentials, by pod ID.
+	renewals *cleaner
+	backend  KerberosBackend
+	kube     *kubeClient
+	vault    *vaultSource
+	aws, gcp *cloudSecretSource
+	// Exchange of ServiceAccount tokens for credentials, nil if not configured.
+	broker *tokenBroker
+	// Group managed service accounts of AD, nil if not configured.
+	gmsa *gmsaSource
+	// Ephemeral per-pod principals, nil if not enabled.
+	ephemeral *ephemeralPrincipals
+	// KerberosIdentity resources, nil if not enabled.
+	identities *identityCache
+	// Health of the KDCs, for failing over between them.
+	kdcs *kdcTracker
+	// KDCs of realms found in DNS.
+	discovery *kdcDiscovery
+	// NFS versions the NFS servers support.
+	nfsVersions *nfsVersionProbe
+	nfsExports  *nfsExportProbe
+	autofs      *autofsMaps
+	// Directory of the POSIX ids of users, nil if not configured.
+	directory *directory
+	// Checker of the NFS volume mounts of pods, nil if not enabled.
+	mountChecks *mountChecker
+	// Watcher of the keytabs of managed credentials, nil if not enabled.
+	keytabs *keytabWatcher
+	// Watcher of the expiry of managed tickets, nil if not enabled.
+	expiry *expiryWatcher
+	// Exporter of the NFS mount statistics of managed pods, nil if not enabled.
+	mountStats *mountStatsExporter
+	// Processes of containers and losses of credentials being remediated.
+	remediation *remediator
+	// Recent outcomes of setups and NFS export checks, off if nil.
+	results *setupResults
+	// Principals failing setups at once, off if nil.
+	breaker *principalBreaker
+	// Credentials of pods not started yet, nil if not enabled.
+	prestage *prestager
+	// Realms of labelled namespaces, nil if not enabled.
+	namespaceRealms *namespaceRealmCache
+	// Settings namespaces give their pods, nil if not enabled.
+	namespaceDefaults *namespaceDefaultsCache
+	// Delegated Identity API client of the SPIRE agent, nil if not enabled.
+	spiffe *spiffeClient
+	// Publisher of KerberosTicket objects, nil if not enabled.
+	tickets *ticketReporter
+	// Poster of Warning Events for pods, nil if not enabled.
+	events *eventRecorder
+	// Managed credentials and the containers bound to them, kept across restarts.
+	bindings *bindingState
+	health   *health
+
+	// Mount table, clock and commands of the node.
+	mounter Mounter
+	clock   Clock
+	exec    Exec
+
+	sync.Mutex
+	managed map[string]*managedCache
+	// Credential setup failures of pods, for failing their containers in strict mode.
+	failed map[string]error
+	// Parameters pods would have credentials set up with in dry-run mode, by pod ID.
+	dryRuns map[string]*kerberosParams
+	// UIDs of the pod sandboxes of the runtime, nil until synchronized.
+	sandboxes map[string]bool
+	// Pod sandboxes of the runtime by ID, as run or synchronized, for the
+	// admin API to set them up again.
+	pods map[string]*api.PodSandbox
+	// Credentials of released pods which could not be destroyed, by
+	// credential cache name, for the sweeper to retry.
+	leaked map[string]*managedCache
 }
 
-func (p *plugin) CreateContainer(_ context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
-	var uid, gid, fsid uint64
-	var ccname, username, realm, kdc, nfs string
-	enabled := false
-	renewal := false
+// Running configuration, replaced as a whole on reload.
+func (p *plugin) config() *config {
+	return p.cfg.Load()
+}
 
-	// dump the name
-	ctrName := containerName(pod, container)
-	fmt.Printf("%s: CreateContainer\n", ctrName)
+// Credential cache set up for a pod.
+type managedCache struct {
+	pod    *api.PodSandbox
+	params *kerberosParams
+	// Logger of the pod the credentials were set up for.
+	log *logrus.Entry
+	// Last time the credentials were set up, renewed or injected.
+	used time.Time
+}
 
-	// check for annotations for uid/gid/fsid/enabled
-	for k, v := range pod.Annotations {
-		switch k {
-		case "nri.io/kerberos-auth":
-			if v == "enabled" {
-				enabled = true
+// Set up credentials once per pod, before any of its containers are created,
+// if the pod annotations name the user.
+func (p *plugin) RunPodSandbox(ctx context.Context, pod *api.PodSandbox) error {
+	cfg := p.config()
+
+	ctx, span := tracer.Start(ctx, "RunPodSandbox", podAttributes(pod.GetNamespace(), pod.GetName()))
+	defer span.End()
+
+	p.Lock()
+	if p.sandboxes != nil {
+		p.sandboxes[pod.GetUid()] = true
+	}
+	p.pods[pod.GetId()] = pod
+	p.Unlock()
+
+	p.normalizeRunPod(cfg, pod)
+	l := podLogger(pod)
+	if !cfg.enabled(pod) {
+		l.Debug("not enabled")
+		return nil
+	}
+	kp := p.podSandboxParams(l, cfg, pod)
+	if kp == nil {
+		return nil
+	}
+	if cfg.DryRun {
+		p.dryRunSetup(ctx, l, cfg, pod, kp)
+		return nil
+	}
+	if err := p.setupPod(ctx, l, cfg, pod, kp, ""); err != nil {
+		l.Error(err)
+		p.Lock()
+		p.failed[pod.GetId()] = err
+		p.Unlock()
+	}
+	return nil
+}
+
+// Inject the credential cache of the pod into its containers. Pods which do not
+// annotate the user are set up when their renewal sidecar is created instead,
+// from its env. The OCI hooks matching the container are injected as well.
+func (p *plugin) CreateContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	p.config().normalizePod(pod)
+	adjust, updates, err := p.createContainer(ctx, pod, container)
+	if err != nil {
+		p.unmountNFSVolumes(containerLogger(pod, container), container)
+		return nil, nil, err
+	}
+	return p.injectHooks(containerLogger(pod, container), p.config(), pod, container, adjust), updates, nil
+}
+
+func (p *plugin) createContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	cfg := p.config()
+
+	ctx, span := tracer.Start(ctx, "CreateContainer",
+		containerAttributes(pod.GetNamespace(), pod.GetName(), container.GetName()))
+	defer span.End()
+
+	l := containerLogger(pod, container)
+	l.Debug("CreateContainer")
+
+	// bail out if all requirements are not met
+	if !cfg.enabledFor(pod, container.GetName()) {
+		l.Debug("not enabled")
+		return nil, nil, nil
+	}
+	if cfg.DryRun {
+		p.dryRunContainer(ctx, l, cfg, pod, container)
+		return nil, nil, nil
+	}
+	if cfg.ownCredentials(pod, container.GetName()) {
+		return p.createOverridingContainer(ctx, l, cfg, pod, container)
+	}
+	p.Lock()
+	setupErr := p.failed[pod.GetId()]
+	p.Unlock()
+	if setupErr != nil && cfg.failHard(pod.GetNamespace()) {
+		l.Errorf("failing container creation: %v", setupErr)
+		return nil, nil, fmt.Errorf("%w: %w", errSetupFailed, setupErr)
+	}
+	if kp := p.podParams(pod); kp != nil {
+		if err := p.bindContainer(ctx, l, cfg, pod, container, kp); err != nil {
+			l.Error(err)
+			if cfg.failHard(pod.GetNamespace()) {
+				return nil, nil, fmt.Errorf("%w: %w", errSetupFailed, err)
+			}
+		}
+		p.touch(managedKey(pod, kp))
+		l.Info("injecting pod credential cache and krb5.conf")
+		_, mountSpan := tracer.Start(ctx, "injectMounts")
+		defer mountSpan.End()
+		adjust := p.podAdjustment(pod, container, kp)
+		if err := p.adjustNFSMounts(l, cfg, pod, container, kp, adjust); err != nil {
+			return nil, nil, err
+		}
+		p.gateStart(l, cfg, pod, container, kp, adjust)
+		return adjust, nil, nil
+	}
+	kp, sidecar := p.containerParams(ctx, l, cfg, pod, container)
+	if !sidecar {
+		l.Debug("not sidecar")
+		return nil, nil, nil
+	}
+	if kp == nil {
+		return nil, nil, nil
+	}
+
+	if err := p.setupPod(ctx, podLogger(pod), cfg, pod, kp, container.GetName()); err != nil {
+		l.Error(err)
+		if cfg.failHard(pod.GetNamespace()) {
+			return nil, nil, fmt.Errorf("%w: %w", errSetupFailed, err)
+		}
+		return nil, nil, nil
+	}
+	p.bindings.bind(pod, container.GetName(), managedKey(pod, kp))
+	adjust := p.podAdjustment(pod, container, kp)
+	if err := p.adjustNFSMounts(l, cfg, pod, container, kp, adjust); err != nil {
+		return nil, nil, err
+	}
+	if pod.GetUid() == "" {
+		return nil, nil, nil
+	}
+	p.gateStart(l, cfg, pod, container, kp, adjust)
+	return adjust, nil, nil
+}
+
+// Set up credentials of its own for a container overriding the annotations of
+// the pod, and inject them.
+func (p *plugin) createOverridingContainer(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	kp := p.managedParams(pod, container.GetName())
+	if kp != nil {
+		if err := p.bindContainer(ctx, l, cfg, pod, container, kp); err != nil {
+			l.Error(err)
+			if cfg.failHard(pod.GetNamespace()) {
+				return nil, nil, fmt.Errorf("%w: %w", errSetupFailed, err)
+			}
+		}
+	} else {
+		if kp = p.resolveParams(l, cfg, pod, containerSettings(l, cfg, pod, container.GetName())); kp == nil {
+			return nil, nil, nil
+		}
+		kp.Container = container.GetName()
+		if err := p.setupPod(ctx, l, cfg, pod, kp, container.GetName()); err != nil {
+			l.Error(err)
+			if cfg.failHard(pod.GetNamespace()) {
+				return nil, nil, fmt.Errorf("%w: %w", errSetupFailed, err)
+			}
+			return nil, nil, nil
+		}
+		p.bindings.bind(pod, container.GetName(), managedKey(pod, kp))
+	}
+	if pod.GetUid() == "" {
+		return nil, nil, nil
+	}
+	l.Infof("injecting container credential cache of %s", kp.Principal())
+	adjust := p.podAdjustment(pod, container, kp)
+	if err := p.adjustNFSMounts(l, cfg, pod, container, kp, adjust); err != nil {
+		return nil, nil, err
+	}
+	p.gateStart(l, cfg, pod, container, kp, adjust)
+	return adjust, nil, nil
+}
+
+// Rewrite the NFS volume mounts of a container to the options its pod
+// requires, with rewriteNFSMounts, or otherwise fail a container with NFS
+// volumes mounted with a weaker security flavor or another NFS version than
+// required, whether or not in strict mode, rather than have it run on a
+// silently downgraded mount.
+func (p *plugin) adjustNFSMounts(l *logrus.Entry, cfg *config, pod *api.PodSandbox, container *api.Container, kp *kerberosParams, adjust *api.ContainerAdjustment) error {
+	l = subsystemLogger(l, subsystemMount)
+	if cfg.NFSExportCheck {
+		if err := p.checkContainerExports(withLogger(context.Background(), l), cfg, pod, container, kp); err != nil {
+			l.Error(err)
+			p.events.warn(pod, reasonNFSExportMissing, "container %s: %v", container.GetName(), err)
+			return err
+		}
+	}
+	if cfg.RewriteNFSMounts {
+		rewritten, err := rewriteNFSMounts(p.mounter, adjust, container, kp, cfg.NFSProto)
+		if err != nil {
+			l.Error(err)
+			p.events.warn(pod, reasonWeakSecurity, "container %s: %v", container.GetName(), err)
+			return err
+		}
+		for _, dest := range rewritten {
+			l.Infof("rewriting NFS volume mount %s to the options the pod requires", dest)
+		}
+		return nil
+	}
+	if err := checkNFSMounts(p.mounter, container, kp); err != nil {
+		l.Error(err)
+		reason := reasonWeakSecurity
+		if errors.Is(err, errNFSVersion) {
+			reason = reasonNFSVersionMismatch
+		}
+		p.events.warn(pod, reason, "container %s: %v", container.GetName(), err)
+		return err
+	}
+	return nil
+}
+
+// Detach the NFS volumes of a container failed for its credentials, which the
+// kubelet mounted on the host before, so that what the pod was denied is not
+// left mounted. The mounts of the containers of the pod running already are
+// their own and stay; the kubelet mounts the volumes again when it retries
+// the container.
+func (p *plugin) unmountNFSVolumes(l *logrus.Entry, container *api.Container) {
+	l = subsystemLogger(l, subsystemMount)
+	volumes, err := nfsVolumeMounts(p.mounter, container)
+	if err != nil {
+		l.Warnf("NFS volumes of the failed container left mounted: %v", err)
+		return
+	}
+	unmounted := map[string]bool{}
+	for _, v := range volumes {
+		if unmounted[v.host.mountPoint] {
+			continue
+		}
+		if err := p.mounter.Unmount(v.host.mountPoint); err != nil {
+			l.Warnf("failed to unmount NFS volume %s at %s: %v", v.host.source, v.host.mountPoint, err)
+			continue
+		}
+		unmounted[v.host.mountPoint] = true
+		l.Infof("unmounted NFS volume %s at %s of the failed container", v.host.source, v.host.mountPoint)
+	}
+}
+
+// Obtain credentials for a pod and publish them to the pod credential cache
+// directory. The container is the renewal sidecar the parameters came from, if any.
+func (p *plugin) setupPod(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams, container string) (err error) {
+	digest := resultDigest(kp)
+	if err := p.recentSetupFailure(cfg, pod, kp, digest); err != nil {
+		l.Infof("credentials for %s not set up again: %v", kp.Principal(), err)
+		return err
+	}
+	defer func() {
+		p.recordSetup(cfg, pod, kp, digest, err)
+		p.tickets.report(pod, kp, err)
+		if p.breaker.record(cfg, pod, kp, err, p.clock.Now()) {
+			l.Warnf("setup of credentials for %s failed %d times in a row (%s), failing its setups for %s",
+				kp.Principal(), cfg.Breaker.threshold(), failureReason(err), cfg.Breaker.ttl())
+		}
+		if errors.Is(err, errPrincipalFailing) {
+			p.events.warn(pod, reasonPrincipalFailing, "credentials for %s not set up (%s): %v", kp.Principal(), failureReason(err), err)
+		} else if errors.Is(err, errLimitExceeded) {
+			p.events.warn(pod, reasonLimitExceeded, "credentials for %s not set up: %v", kp.Principal(), err)
+		} else if errors.Is(err, errPolicyDenied) {
+			p.events.warn(pod, reasonPolicyDenied, "credentials for %s denied: %v", kp.Principal(), err)
+		} else if preflightFailure(err) {
+			p.events.warn(pod, reasonUnreachable, "credentials for %s not set up (%s): %v",
+				kp.Principal(), failureReason(err), err)
+		} else if err != nil && !p.warnClockSkew(pod, kp, err) {
+			p.events.warn(pod, reasonSetupFailed, "setup of credentials for %s failed (%s): %v",
+				kp.Principal(), failureReason(err), err)
+		}
+	}()
+
+	if container != "" {
+		ctx = withLogger(ctx, l.WithField("container", container))
+	} else {
+		ctx = withLogger(ctx, l)
+	}
+	setupCtx, cancel := context.WithTimeout(ctx, cfg.setupTimeout())
+	defer cancel()
+
+	if err := p.checkPolicy(setupCtx, cfg, pod, kp); err != nil {
+		return err
+	}
+	if p.reusable(pod, kp) {
+		l.Infof("credentials for %s already set up and valid, reusing them", kp.Principal())
+		ccacheHits.WithLabelValues(kp.Realm).Inc()
+		return nil
+	}
+	if err := p.breaker.check(cfg, pod, kp, p.clock.Now()); err != nil {
+		l.Infof("credentials for %s not set up: %v", kp.Principal(), err)
+		return err
+	}
+	if err := p.enforceLimits(l, cfg, kp); err != nil {
+		return err
+	}
+	for _, server := range kp.nfsServers() {
+		for _, vers := range append([]string{kp.NFSVersion}, slices.Collect(maps.Values(kp.NFSVolumeVersions))...) {
+			if err := p.nfsVersions.check(setupCtx, kp.hostAddress(server), vers); err != nil {
+				return err
+			}
+		}
+	}
+	var staged *kerberosParams
+	var shared *managedCache
+	if container == "" {
+		staged = p.prestage.claim(setupCtx, pod, kp)
+	}
+	if staged == nil {
+		shared = p.sharedCredentials(cfg, pod, kp)
+	}
+	if staged != nil {
+		l.Infof("using credentials pre-staged for %s", kp.Principal())
+		kp.Keytab, kp.Password, kp.PKINIT = staged.Keytab, staged.Password, staged.PKINIT
+	} else if shared != nil {
+		l.Infof("sharing credentials of %s set up for pod %s/%s", kp.Principal(), shared.pod.GetNamespace(), shared.pod.GetName())
+		kp.shareSources(shared.params)
+		credentialShares.WithLabelValues(kp.Realm).Inc()
+	} else {
+		if err := prepareCollection(kp.CCName, int(kp.UID), int(kp.GID)); err != nil {
+			return err
+		}
+		err := p.fetchCredentials(setupCtx, pod, kp)
+		if err == nil {
+			l.Infof("setting up Kerberos credentials for %s", kp.Principal())
+			if err = p.backend.Setup(setupCtx, kp); err != nil {
+				err = fmt.Errorf("kerberos setup failed: %w", err)
 			}
-			fmt.Printf("%s: %v\n", k, enabled)
-		case "nri.io/kerberos-uid":
-			uid, _ = strconv.ParseUint(v, 10, 32)
-			fmt.Printf("%s: %d\n", k, uid)
-		case "nri.io/kerberos-gid":
-			gid, _ = strconv.ParseUint(v, 10, 32)
-			fmt.Printf("%s: %d\n", k, gid)
-		case "nri.io/kerberos-fsid":
-			fsid, _ = strconv.ParseUint(v, 10, 32)
-			fmt.Printf("%s: %d\n", k, fsid)
+		}
+		if err != nil && cfg.HostFallback.applies(pod.GetNamespace(), kp, err) {
+			err = p.setupHostFallback(setupCtx, l, cfg, pod, kp, err)
+		}
+		if err != nil {
+			p.auditOp("setup", pod, container, kp, err)
+			return err
+		}
+		if clamped := clampedLifetimes(kp); clamped != "" {
+			l.Infof("KDC granted %s asked for by %s", clamped, kp.Principal())
+		}
+		if forwardableRefused(kp) {
+			l.Warnf("KDC granted %s no forwardable TGT, it may not be delegated", kp.Principal())
+		}
+		if cfg.PAC.Keytab != "" {
+			logServicePACs(l, &cfg.PAC, kp)
+		}
+	}
+
+	p.auditOp("setup", pod, container, kp, nil)
+
+	if cfg.IDMap.Manage && !kp.HostFallback {
+		if err := checkIDMapping(cfg, kp); err != nil {
+			l.Warn(err)
+			p.events.warn(pod, reasonIDMappingMismatch, "%v", err)
+		}
+	}
+
+	p.track(pod, kp, l)
+	if err := p.setupVolumePrincipals(setupCtx, l, cfg, pod, kp); err != nil {
+		return err
+	}
+	if container == "" {
+		if err := p.autofs.add(ctx, pod, kp); err != nil {
+			return fmt.Errorf("failed to automount the exports of %s: %w", kp.Principal(), err)
+		}
+	}
+	p.verifyMounts(ctx, managedKey(pod, kp))
+
+	if pod.GetUid() == "" {
+		return nil
+	}
+	_, mountSpan := tracer.Start(ctx, "publishCCache")
+	path, err := p.publishCCache(pod, kp)
+	endSpan(mountSpan, err)
+	if err != nil {
+		return fmt.Errorf("failed to publish credential cache: %w", err)
+	}
+	if kp.GSSProxy {
+		l.Infof("credential cache %s delegated to gss-proxy by %s", kp.CCName, path)
+	} else {
+		l.Infof("credential cache %s published to the pod as %s", path, p.containerCCName(kp))
+	}
+	if err := p.setupPodPrincipals(setupCtx, l, pod, kp); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Kerberos settings of a pod before applying namespace policy and node defaults.
+type podSettings struct {
+	uid, gid, fsid                uint64
+	user, realm, kdc, nfs, ccname string
+	ccacheType, sec, nfsVersion   string
+	// NFS versions of single volumes, by volume directory name.
+	nfsVolumeVersions map[string]string
+	// Principals of single volumes, by volume directory name.
+	volumePrincipals map[string]string
+	// Further principals, unparsed.
+	principals string
+	// Volume to share the credential cache collection in, if any.
+	sharedVolume string
+	// Anonymous ticket asked for instead of credentials of a user.
+	anonymous bool
+	// Supplementary gids, unparsed.
+	gids string
+	// Host aliases, unparsed.
+	hostAliases string
+	// Automounted exports, unparsed.
+	automounts string
+	// Ticket and renewable lifetimes asked for, unparsed.
+	ticketLifetime, renewLifetime string
+	// Renewal interval of KERBEROS_RENEWAL_TIME, unparsed.
+	renewalTime string
+	// Forwardable tickets asked for.
+	forwardable bool
+}
+
+// Get the Kerberos settings from the pod annotations.
+func annotationSettings(l *logrus.Entry, cfg *config, pod *api.PodSandbox) podSettings {
+	var s podSettings
+	s.apply(l, cfg, pod.GetAnnotations())
+	return s
+}
+
+// Get the Kerberos settings of a container from the pod annotations, with
+// those suffixed with the container name overriding those of the pod.
+func containerSettings(l *logrus.Entry, cfg *config, pod *api.PodSandbox, container string) podSettings {
+	s := annotationSettings(l, cfg, pod)
+	overrides := map[string]string{}
+	for _, name := range containerAnnotations {
+		if v, ok := pod.GetAnnotations()[cfg.containerAnnotation(name, container)]; ok {
+			overrides[cfg.annotation(name)] = v
+		}
+	}
+	s.apply(l, cfg, overrides)
+	return s
+}
+
+// Set the settings given by annotations.
+func (s *podSettings) apply(l *logrus.Entry, cfg *config, annotations map[string]string) {
+	for k, v := range annotations {
+		switch k {
+		case cfg.annotation("kerberos-uid"):
+			s.uid = parseID(v)
+			l.Debugf("%s: %d", k, s.uid)
+		case cfg.annotation("kerberos-gid"):
+			s.gid = parseID(v)
+			l.Debugf("%s: %d", k, s.gid)
+		case cfg.annotation("kerberos-fsid"):
+			s.fsid = parseID(v)
+			l.Debugf("%s: %d", k, s.fsid)
+		case cfg.annotation(gidsAnnotation):
+			s.gids = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation("kerberos-user"):
+			s.user = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation("kerberos-realm"):
+			s.realm = v
+		case cfg.annotation("kerberos-kdc"):
+			s.kdc = v
+		case cfg.annotation("kerberos-nfs"):
+			s.nfs = v
+		case cfg.annotation("kerberos-sec"):
+			s.sec = strings.ToLower(v)
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation("kerberos-ccache-type"):
+			s.ccacheType = strings.ToUpper(v)
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation("kerberos-nfs-version"):
+			s.nfsVersion = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(keytabSecretAnnotation), cfg.annotation(passwordSecretAnnotation), cfg.annotation(pkinitSecretAnnotation):
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(anonymousAnnotation):
+			s.anonymous = v == "true"
+			l.Debugf("%s: %v", k, s.anonymous)
+		case cfg.annotation(hostAliasesAnnotation):
+			s.hostAliases = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(automountAnnotation):
+			s.automounts = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(principalsAnnotation):
+			s.principals = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(sharedCCacheAnnotation):
+			s.sharedVolume = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(ticketLifetimeAnnotation):
+			s.ticketLifetime = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(renewLifetimeAnnotation):
+			s.renewLifetime = v
+			l.Debugf("%s: %s", k, v)
+		case cfg.annotation(forwardableAnnotation):
+			s.forwardable = v == "true"
+			l.Debugf("%s: %v", k, s.forwardable)
 		default:
-			// ignore
+			if volume, ok := strings.CutPrefix(k, cfg.annotation("kerberos-nfs-version.")); ok {
+				if s.nfsVolumeVersions == nil {
+					s.nfsVolumeVersions = map[string]string{}
+				}
+				s.nfsVolumeVersions[volume] = v
+				l.Debugf("%s: %s", k, v)
+			}
+			if volume, ok := strings.CutPrefix(k, cfg.annotation("kerberos-principal.")); ok {
+				if s.volumePrincipals == nil {
+					s.volumePrincipals = map[string]string{}
+				}
+				s.volumePrincipals[volume] = v
+				l.Debugf("%s: %s", k, v)
+			}
+		}
+	}
+}
+
+// Parse a uid, gid or fsid annotation, 0 if it is not one.
+func parseID(v string) uint64 {
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// Get the Kerberos parameters of an enabled pod from its annotations, or nil if
+// they do not name the user, are incomplete or not allowed.
+func (p *plugin) podSandboxParams(l *logrus.Entry, cfg *config, pod *api.PodSandbox) *kerberosParams {
+	s := annotationSettings(l, cfg, pod)
+	if s.user == "" && !s.anonymous && !cfg.SPIFFE.handles(pod.GetNamespace()) {
+		if cfg.AnnotationsOnly {
+			l.Warnf("%s not annotated", cfg.annotation("kerberos-user"))
+			p.events.warn(pod, reasonConfigIncomplete, "%s annotation is required, the env of renewal sidecars is ignored",
+				cfg.annotation("kerberos-user"))
+			return nil
 		}
+		l.Debugf("%s not annotated, waiting for the renewal sidecar", cfg.annotation("kerberos-user"))
+		return nil
 	}
+	return p.resolveParams(l, cfg, pod, s)
+}
+
+// Get the Kerberos parameters of the renewal sidecar of an enabled pod from the
+// pod annotations, overridden by the sidecar env. Returns whether the container
+// is a renewal sidecar and, if so, its parameters, or nil if they are incomplete,
+// not allowed or its image is not an approved one. No container is one in
+// annotation-only mode.
+func (p *plugin) containerParams(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, container *api.Container) (*kerberosParams, bool) {
+	if cfg.AnnotationsOnly {
+		return nil, false
+	}
+	s := annotationSettings(l, cfg, pod)
+	renewal, nfsEnv := false, false
 
 	// check the env vars for krb config
 	for _, envVar := range container.Env {
@@ -84,63 +698,764 @@ func (p *plugin) CreateContainer(_ context.Context, pod *api.PodSandbox, contain
 
 		switch k {
 		case "KRB5CCNAME":
-			ccname = v
-			fmt.Printf("%s: %s\n", k, ccname)
+			s.ccname = v
+			l.Debugf("%s: %s", k, v)
 		case "KERBEROS_USER":
-			username = v
-			fmt.Printf("%s: %s\n", k, username)
+			s.user = v
+			l.Debugf("%s: %s", k, v)
 		case "KERBEROS_REALM":
-			realm = v
-			fmt.Printf("%s: %s\n", k, realm)
+			s.realm = v
 		case "KDC_HOSTNAME":
-			kdc = v
-			fmt.Printf("%s: %s\n", k, kdc)
+			s.kdc = v
 		case "NFS_HOSTNAME":
-			nfs = v
-			fmt.Printf("%s: %s\n", k, nfs)
+			// repeated for several servers, replacing the annotation
+			if nfsEnv {
+				v = s.nfs + "," + v
+			}
+			s.nfs, nfsEnv = v, true
 		case "KERBEROS_RENEWAL_TIME":
-			renewal = true
-			fmt.Printf("%s: %v\n", k, renewal)
+			renewal, s.renewalTime = true, v
+			l.Debugf("%s: %s", k, v)
 		default:
 			// ignore
 		}
 	}
+	if !renewal {
+		return nil, false
+	}
+	if err := p.verifySidecarImage(ctx, cfg, pod, container); err != nil {
+		l.Warnf("ignoring the env of renewal sidecar %s: %v", container.GetName(), err)
+		p.events.warn(pod, reasonSidecarUnverified, "ignoring the env of renewal sidecar %s: %v", container.GetName(), err)
+		return nil, true
+	}
 
-	// bail out if all requirements are not met
-	if !enabled || !renewal {
-		fmt.Printf("%s: not enabled or not sidecar\n", ctrName)
-		return nil, nil, nil
+	return p.resolveParams(l, cfg, pod, s), true
+}
+
+// Fill in namespace policy and node-level defaults for anything the pod did not
+// set, returning nil if the result is incomplete or not allowed. Where SPIFFE
+// is in effect, the user comes from the SPIFFE ID of the pod instead. The realm
+// comes from the pod, the KerberosIdentity or label of the namespace, or the
+// node default, and the KDCs and NFS server of the realm from the identity or
+// the realm table. The credential cache defaults to the one rpc.gssd looks at
+// for the uid. Anonymous pods get the anonymous principal, where allowed. The
+// user must be a plain user name, see validateUser.
+func (p *plugin) resolveParams(l *logrus.Entry, cfg *config, pod *api.PodSandbox, s podSettings) *kerberosParams {
+	if s.anonymous {
+		if !cfg.PKINIT.allowsAnonymous(pod.GetNamespace()) {
+			l.Warnf("anonymous tickets not allowed in namespace %s", pod.GetNamespace())
+			p.events.warn(pod, reasonPrincipalDenied, "anonymous tickets are not allowed in namespace %s", pod.GetNamespace())
+			return nil
+		}
+		if s.user != "" || len(s.volumePrincipals) > 0 {
+			l.Warnf("%s set with a user or volume principals", cfg.annotation(anonymousAnnotation))
+			p.events.warn(pod, reasonConfigIncomplete, "%s excludes a user and volume principals", cfg.annotation(anonymousAnnotation))
+			return nil
+		}
+		s.user = anonymousUser
+	} else if cfg.SPIFFE.handles(pod.GetNamespace()) {
+		user, err := p.spiffePrincipal(cfg, pod)
+		if err != nil {
+			l.Warnf("cannot verify the identity of the pod: %v", err)
+			p.events.warn(pod, reasonIdentityUnverified, "cannot verify the identity of the pod: %v", err)
+			return nil
+		}
+		if s.user != "" && s.user != user {
+			l.Warnf("pod asks for principal %s but its SPIFFE ID maps to %s", s.user, user)
+			p.events.warn(pod, reasonPrincipalDenied, "pod asks for principal %s but its SPIFFE ID maps to %s", s.user, user)
+			return nil
+		}
+		l.Debugf("KERBEROS_USER: %s (from SPIFFE ID)", user)
+		s.user = user
 	}
-	if uid == 0 || gid == 0 || fsid == 0 {
-		fmt.Printf("%s: uid/gid/fsid annotation missing\n", ctrName)
-		return nil, nil, nil
+	// the user names the keytab and other paths of the credentials
+	if !s.anonymous && s.user != "" {
+		if err := validateUser(s.user); err != nil {
+			l.Warnf("user: %v", err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s or KERBEROS_USER: %v", cfg.annotation("kerberos-user"), err)
+			return nil
+		}
 	}
-	if username == "" || realm == "" || kdc == "" || nfs == "" || ccname == "" {
-		fmt.Printf("%s: username, realm, kdc, nfs, or ccname missing\n", ctrName)
-		return nil, nil, nil
+
+	id := p.identities.forNamespace(pod.GetNamespace())
+	var policy, idRealm string
+	if id != nil {
+		policy, idRealm = id.String(), id.Spec.Realm
+	}
+	nsRealm := p.namespaceRealms.forNamespace(pod.GetNamespace())
+	nsd := p.namespaceDefaults.forNamespace(pod.GetNamespace())
+	var dnsRealm string
+	if servers := nfsServerList(s.nfs); cfg.DiscoverRealms && s.realm == "" && idRealm == "" && nsd.realm == "" && nsRealm == "" && len(servers) > 0 {
+		dnsRealm = p.discovery.realm(context.Background(), servers[0])
+	}
+	s.realm = p.withDefault(l, "KERBEROS_REALM", s.realm, fallback{idRealm, policy},
+		fallback{nsd.realm, "namespace"}, fallback{nsRealm, "namespace label"}, fallback{dnsRealm, "DNS TXT"},
+		fallback{cfg.DefaultRealm, "node default"})
+	if realm := cfg.ActiveDirectory.realm(s.realm); realm != s.realm {
+		l.Debugf("realm %s of the AD domain %s", realm, s.realm)
+		s.realm = realm
 	}
 
-	// tbd - how do we pass the above to the script? exec the hook script?
-	fmt.Printf("%s:WILL RUN KERBEROS SETUP SCRIPT HERE\n", ctrName)
-	// TODO: hook script name from hook json?
-	// #nosec G204:gosec
-	cmd := exec.Command("/opt/nri-hooks/kerberos.sh", fmt.Sprintf("%d", uid), fmt.Sprintf("%d", gid), fmt.Sprintf("%d", fsid), username, realm, kdc, nfs, ccname)
+	var idKDC, idNFS, realmKDC, dnsKDC string
+	if id != nil && s.realm == id.Spec.Realm {
+		idKDC, idNFS = id.Spec.KDCs[0], id.Spec.NFSServer
+	}
+	realm := cfg.Realms[s.realm]
+	if len(realm.KDCs) > 0 {
+		realmKDC = realm.KDCs[0]
+	}
+	var discovered []string
+	if cfg.DiscoverKDCs {
+		discovered = p.discovery.lookup(context.Background(), s.realm)
+	}
+	if len(discovered) > 0 {
+		dnsKDC = discovered[0]
+	}
+	nsKDC, nsNFS := nsd.servers(s.realm)
+	s.kdc = p.withDefault(l, "KDC_HOSTNAME", s.kdc, fallback{idKDC, policy}, fallback{nsKDC, "namespace"},
+		fallback{realmKDC, "realm " + s.realm}, fallback{dnsKDC, "DNS SRV"}, fallback{cfg.DefaultKDC, "node default"})
+	subdir, err := p.nfsSubdirVolumes(context.Background(), cfg, pod)
+	if err != nil {
+		l.Warnf("cannot look up PVs of nfs-subdir-external-provisioner: %v", err)
+	}
+	s.nfs = p.withDefault(l, "NFS_HOSTNAME", s.nfs, fallback{idNFS, policy}, fallback{nsNFS, "namespace"},
+		fallback{nfsSubdirServers(subdir), "nfs-subdir-external-provisioner PVs"},
+		fallback{realm.NFS, "realm " + s.realm}, fallback{cfg.DefaultNFS, "node default"})
 
-	// nolint:errcheck
-	cmd.CombinedOutput()
+	if cfg.IDsFromSecurityContext {
+		var sc securityContextIDs
+		err := errors.New("idsFromSecurityContext needs Kubernetes API access")
+		if p.kube != nil {
+			sc, err = podSecurityContextIDs(context.Background(), p.kube, pod)
+		}
+		if err == nil {
+			if s.uid, err = resolveID("uid", s.uid, sc.uid); err == nil {
+				if s.gid, err = resolveID("gid", s.gid, sc.gid); err == nil {
+					s.fsid, err = resolveID("fsid", s.fsid, sc.fsid)
+				}
+			}
+		}
+		if err != nil {
+			l.Warnf("%v, from the securityContext", err)
+			p.events.warn(pod, reasonConfigIncomplete, "%v, from the securityContext", err)
+			return nil
+		}
+	}
+	for volume, principal := range s.volumePrincipals {
+		user, realm, _ := strings.Cut(principal, "@")
+		err := validateUser(user)
+		if err == nil && realm != "" && realm != s.realm {
+			err = fmt.Errorf("%q must be in realm %s of the pod", principal, s.realm)
+		}
+		if err != nil {
+			l.Warnf("%s: %v", cfg.annotation("kerberos-principal."+volume), err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation("kerberos-principal."+volume), err)
+			return nil
+		}
+		if id != nil && !id.allows(user) {
+			l.Warnf("principal %s of volume %s not allowed by %s", user, volume, id)
+			p.events.warn(pod, reasonPrincipalDenied, "principal %s of volume %s not allowed by %s", user, volume, id)
+			return nil
+		}
+		s.volumePrincipals[volume] = user
+	}
+	principals, err := parsePrincipals(s.principals, s.realm)
+	if err != nil {
+		l.Warnf("%s: %v", cfg.annotation(principalsAnnotation), err)
+		p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation(principalsAnnotation), err)
+		return nil
+	}
+	principals = slices.DeleteFunc(principals, func(user string) bool { return user == s.user })
+	for _, user := range principals {
+		if id != nil && !id.allows(user) {
+			l.Warnf("principal %s not allowed by %s", user, id)
+			p.events.warn(pod, reasonPrincipalDenied, "principal %s not allowed by %s", user, id)
+			return nil
+		}
+	}
+	if id != nil {
+		if !s.anonymous && !id.allows(s.user) {
+			l.Warnf("principal %s not allowed by %s", s.user, id)
+			p.events.warn(pod, reasonPrincipalDenied, "principal %s not allowed by %s", s.user, id)
+			return nil
+		}
+		if ruleUID, ruleGID, ruleFSID, ok := id.resolveIDs(s.user); ok {
+			var err error
+			if s.uid, err = resolveID("uid", s.uid, ruleUID); err == nil {
+				if s.gid, err = resolveID("gid", s.gid, ruleGID); err == nil {
+					s.fsid, err = resolveID("fsid", s.fsid, ruleFSID)
+				}
+			}
+			if err != nil {
+				l.Warnf("%v, required by %s", err, id)
+				p.events.warn(pod, reasonConfigIncomplete, "%v, required by %s", err, id)
+				return nil
+			}
+		}
+	}
+	var supportedETypes uint32
+	if p.directory != nil && s.user != "" && !s.anonymous {
+		account, err := p.directory.lookup(context.Background(), s.user)
+		if err != nil {
+			l.Warnf("cannot look up the ids of %s: %v", s.user, err)
+			p.events.warn(pod, reasonIdentityUnverified, "cannot look up the ids of %s: %v", s.user, err)
+			return nil
+		}
+		if s.uid, err = resolveID("uid", s.uid, account.uid); err == nil {
+			s.gid, err = resolveID("gid", s.gid, account.gid)
+		}
+		if err != nil {
+			l.Warnf("%v, %s has it in the directory", err, s.user)
+			p.events.warn(pod, reasonPrincipalDenied, "%v, %s has it in the directory", err, s.user)
+			return nil
+		}
+		l.Debugf("uid %d and gid %d of %s from the directory", s.uid, s.gid, s.user)
+		supportedETypes = account.encTypes
+		if s.fsid == 0 {
+			s.fsid = s.gid
+		}
+	}
+	for _, v := range subdir {
+		if s.fsid == 0 && v.gid != 0 {
+			l.Debugf("fsid %d from the gid of PV %s", v.gid, v.pv)
+			s.fsid = v.gid
+		}
+	}
+	if s.uid == 0 || s.gid == 0 || s.fsid == 0 {
+		l.Warn("uid/gid/fsid annotation missing")
+		p.events.warn(pod, reasonConfigIncomplete, "%s, %s and %s annotations are required",
+			cfg.annotation("kerberos-uid"), cfg.annotation("kerberos-gid"), cfg.annotation("kerberos-fsid"))
+		return nil
+	}
+	var gids []uint64
+	if s.gids != "" {
+		var err error
+		if gids, err = parseGIDs(s.gids); err != nil {
+			l.Warnf("%s: %v", cfg.annotation(gidsAnnotation), err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation(gidsAnnotation), err)
+			return nil
+		}
+	}
+	userns, err := podUserNamespace(pod)
+	if err == nil && userns != nil {
+		s.uid, s.gid, s.fsid, err = userns.toHost(s.uid, s.gid, s.fsid)
+		l.Debugf("uid %d, gid %d and fsid %d on the host, by the user namespace of the pod", s.uid, s.gid, s.fsid)
+		if err == nil && len(gids) > 0 {
+			gids, err = userns.groupsToHost(gids)
+		}
+	}
+	if err != nil {
+		l.Warn(err)
+		p.events.warn(pod, reasonConfigIncomplete, "%v", err)
+		return nil
+	}
+	switch {
+	case s.ccname == "" && (len(s.volumePrincipals) > 0 || len(principals) > 0):
+		s.ccname = hostCollectionCCName(s.uid, dirCCacheName)
+	case s.ccname == "":
+		s.ccname = hostCCName(s.uid)
+	case (len(s.volumePrincipals) > 0 || len(principals) > 0) && !strings.HasPrefix(s.ccname, "DIR::"):
+		l.Warnf("volume and further principals need a DIR credential cache collection, not %s", s.ccname)
+		p.events.warn(pod, reasonConfigIncomplete, "volume and further principals need a DIR credential cache collection, not %s", s.ccname)
+		return nil
+	}
+	if err := validCCacheType(s.ccacheType); err != nil {
+		l.Warn(err)
+		p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation("kerberos-ccache-type"), err)
+		return nil
+	}
+	if s.sharedVolume != "" {
+		err := validVolumeName(s.sharedVolume)
+		switch {
+		case err == nil && s.ccacheType != "" && s.ccacheType != ccacheTypeDir:
+			err = fmt.Errorf("a shared credential cache is a DIR collection, not %s", s.ccacheType)
+		case err == nil && cfg.GSSProxy.Enabled:
+			err = errors.New("pods get no credential cache in gss-proxy mode")
+		}
+		if err != nil {
+			l.Warnf("%s: %v", cfg.annotation(sharedCCacheAnnotation), err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation(sharedCCacheAnnotation), err)
+			return nil
+		}
+		s.ccacheType = ccacheTypeDir
+	}
+	var idCCacheType, idSec string
+	if id != nil {
+		idCCacheType, idSec = id.Spec.CCacheType, id.Spec.Sec
+	}
+	s.ccacheType = p.withDefault(l, cfg.annotation("kerberos-ccache-type"), s.ccacheType, fallback{idCCacheType, policy},
+		fallback{nsd.ccacheType, "namespace"}, fallback{cfg.CCacheType, "node default"})
+	if len(principals) > 0 && (cfg.GSSProxy.Enabled || (s.ccacheType != "" && s.ccacheType != ccacheTypeFile && s.ccacheType != ccacheTypeDir)) {
+		l.Warnf("%s need a FILE or DIR credential cache", cfg.annotation(principalsAnnotation))
+		p.events.warn(pod, reasonConfigIncomplete, "%s need a FILE or DIR credential cache in the pod", cfg.annotation(principalsAnnotation))
+		return nil
+	}
+	if err := validSec(s.sec); err != nil {
+		l.Warn(err)
+		p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation("kerberos-sec"), err)
+		return nil
+	}
+	s.sec = p.withDefault(l, cfg.annotation("kerberos-sec"), s.sec, fallback{idSec, policy}, fallback{nsd.sec, "namespace"},
+		fallback{cfg.NFSSec, "node default"})
+	for _, vers := range append([]string{s.nfsVersion}, slices.Collect(maps.Values(s.nfsVolumeVersions))...) {
+		if err := validNFSVersion(vers); err != nil {
+			l.Warn(err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation("kerberos-nfs-version"), err)
+			return nil
+		}
+	}
+	s.nfsVersion = p.withDefault(l, cfg.annotation("kerberos-nfs-version"), s.nfsVersion, fallback{nsd.nfsVersion, "namespace"},
+		fallback{cfg.NFSVersion, "node default"})
+	servers := nfsServerList(s.nfs)
+	if s.user == "" || s.realm == "" || s.kdc == "" || len(servers) == 0 || s.ccname == "" {
+		l.Warn("username, realm, kdc, nfs, or ccname missing")
+		p.events.warn(pod, reasonConfigIncomplete, "user, realm, KDC or NFS server not set and without default")
+		return nil
+	}
+	var name string
+	tmpl := cfg.PrincipalTemplate.forNamespace(pod.GetNamespace())
+	if id != nil && id.Spec.PrincipalTemplate != "" {
+		tmpl = id.Spec.PrincipalTemplate
+	}
+	if s.anonymous {
+		l.Debugf("anonymous principal %s", anonymousPrincipal)
+	} else if pod.GetAnnotations()[cfg.annotation(ephemeralAnnotation)] == "true" {
+		var err error
+		if p.ephemeral == nil {
+			err = errors.New("ephemeral principals are not enabled on the node")
+		} else {
+			name, err = p.ephemeral.principalName(pod, s.user, s.realm)
+		}
+		if err != nil {
+			l.Warnf("%s: %v", cfg.annotation(ephemeralAnnotation), err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation(ephemeralAnnotation), err)
+			return nil
+		}
+		l.Debugf("ephemeral principal %s@%s", name, s.realm)
+	} else if tmpl != "" {
+		var err error
+		name, err = renderPrincipal(tmpl, principalTemplateData(pod, s.user, s.realm))
+		if err != nil {
+			l.Warn(err)
+			p.events.warn(pod, reasonConfigIncomplete, "%v", err)
+			return nil
+		}
+		l.Debugf("principal %s@%s from template %q", name, s.realm, tmpl)
+	}
+
+	kp := &kerberosParams{
+		UID:               s.uid,
+		GID:               s.gid,
+		GIDs:              gids,
+		FSID:              s.fsid,
+		User:              s.user,
+		Name:              name,
+		Realm:             s.realm,
+		KDC:               s.kdc,
+		NFS:               servers[0],
+		NFSServers:        servers,
+		CCName:            s.ccname,
+		CCacheType:        s.ccacheType,
+		GSSProxy:          cfg.GSSProxy.Enabled,
+		Sec:               s.sec,
+		NFSVersion:        s.nfsVersion,
+		NFSVolumeVersions: s.nfsVolumeVersions,
+		VolumePrincipals:  s.volumePrincipals,
+		Principals:        principals,
+		SharedVolume:      s.sharedVolume,
+		UserNS:            userns,
+		Krb5Conf:          &cfg.Krb5Conf,
+		ETypes:            cfg.Crypto.encTypes(),
+		FIPS:              cfg.Crypto.FIPS,
+	}
+	if s.anonymous {
+		kp.Anonymous = &pkinitIdentity{Anchors: cfg.PKINIT.CAFile}
+	}
+	if cfg.ActiveDirectory.applies(s.realm) && !s.anonymous {
+		kp.ActiveDirectory = true
+		if kp.ETypes, err = cfg.ActiveDirectory.encTypes(supportedETypes, kp.ETypes, kp.FIPS); err != nil {
+			l.Warnf("%s: %v", kp.Principal(), err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", kp.Principal(), err)
+			return nil
+		}
+	}
+	if s.hostAliases != "" {
+		if !cfg.HostAliases.allows(pod.GetNamespace()) {
+			l.Warnf("host aliases not allowed in namespace %s", pod.GetNamespace())
+			p.events.warn(pod, reasonConfigIncomplete, "host aliases are not allowed in namespace %s", pod.GetNamespace())
+			return nil
+		}
+		if kp.HostAliases, err = parseHostAliases(s.hostAliases); err != nil {
+			l.Warnf("%s: %v", cfg.annotation(hostAliasesAnnotation), err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation(hostAliasesAnnotation), err)
+			return nil
+		}
+	}
+	if s.automounts != "" {
+		if p.autofs == nil {
+			l.Warnf("%s given, autofs not enabled", cfg.annotation(automountAnnotation))
+			p.events.warn(pod, reasonConfigIncomplete, "%s given, but autofs is not enabled on the node", cfg.annotation(automountAnnotation))
+			return nil
+		}
+		if kp.Automounts, err = parseAutomounts(s.automounts, kp.nfsServers()); err != nil {
+			l.Warnf("%s: %v", cfg.annotation(automountAnnotation), err)
+			p.events.warn(pod, reasonConfigIncomplete, "%s: %v", cfg.annotation(automountAnnotation), err)
+			return nil
+		}
+	}
+	if kp.TicketLifetime, kp.RenewLifetime, err = cfg.Krb5Conf.requestedLifetimes(s.ticketLifetime, s.renewLifetime); err != nil {
+		l.Warnf("lifetime annotation: %v", err)
+		p.events.warn(pod, reasonConfigIncomplete, "%s or %s: %v", cfg.annotation(ticketLifetimeAnnotation), cfg.annotation(renewLifetimeAnnotation), err)
+		return nil
+	}
+	var clamped bool
+	if kp.RenewalInterval, clamped, err = cfg.Renewal.requestedInterval(pod.GetNamespace(), s.renewalTime); err != nil {
+		l.Warnf("KERBEROS_RENEWAL_TIME: %v", err)
+		p.events.warn(pod, reasonConfigIncomplete, "KERBEROS_RENEWAL_TIME: %v", err)
+		return nil
+	} else if clamped {
+		l.Infof("renewal interval %s asked for clamped to %s", s.renewalTime, kp.RenewalInterval)
+	}
+	kp.Forwardable = s.forwardable
+	kp.QoS = cfg.QoS.class(pod.GetNamespace())
+	cfg.applyTrust(kp)
+	kdcs := cfg.KDCs
+	kp.Domains, kp.KDCProxy = realm.Domains, realm.KDCProxy
+	if kp.KDCProxy == nil && s.realm == cfg.DefaultRealm {
+		kp.KDCProxy = cfg.KDCProxy
+	}
+	switch {
+	case id != nil && s.realm == id.Spec.Realm:
+		kdcs, kp.Domains = id.Spec.KDCs, id.Spec.Domains
+	case len(realm.KDCs) > 0:
+		kdcs = realm.KDCs
+	case s.realm != cfg.DefaultRealm:
+		kdcs = nil
+	}
+	for _, k := range append(kdcs, discovered...) {
+		if k != s.kdc && !slices.Contains(kp.KDCs, k) {
+			kp.KDCs = append(kp.KDCs, k)
+		}
+	}
+
+	return kp
+}
+
+// Key of managed credentials: the pod ID, followed by the container name for
+// containers with credentials of their own.
+func managedKey(pod *api.PodSandbox, kp *kerberosParams) string {
+	key := pod.GetId()
+	if kp.Container != "" {
+		key += "/" + kp.Container
+	}
+	if len(kp.Volumes) > 0 {
+		key += "#" + kp.User
+	}
+	if kp.Secondary {
+		key += "+" + kp.User
+	}
+	return key
+}
+
+// Start tracking the credentials set up for a pod.
+func (p *plugin) track(pod *api.PodSandbox, kp *kerberosParams, l *logrus.Entry) {
+	key := managedKey(pod, kp)
+	used, renewal := p.bindings.resume(key)
+	if used.IsZero() {
+		used = p.clock.Now()
+	}
+	p.Lock()
+	p.managed[key] = &managedCache{
+		pod:    pod,
+		params: kp,
+		log:    l,
+		used:   used,
+	}
+	managedTickets.Set(float64(len(p.managed)))
+	p.Unlock()
+	p.bindings.track(key, pod, kp)
+
+	p.scheduleRenewal(key)
+	if !renewal.IsZero() {
+		p.resumeRenewal(key, renewal)
+	}
+}
 
-	//dump("Pod", pod)
-	//dump("Container", container)
+// Whether the credentials tracked under the key of the parameters are of the
+// same principal and credential cache, which still holds a TGT valid for a
+// while and was published to the pod with its ids, as when the renewal sidecar
+// of a pod is created again.
+func (p *plugin) reusable(pod *api.PodSandbox, kp *kerberosParams) bool {
+	managed := p.managedParamsOf(managedKey(pod, kp))
+	if managed == nil || managed.Principal() != kp.Principal() || managed.CCName != kp.CCName {
+		return false
+	}
+	if err := checkCCachePrincipal(kp.CCName, kp.Principal()); err != nil {
+		return false
+	}
+	if err := p.checkPublished(pod, kp); err != nil {
+		return false
+	}
+	return checkCCache(kp.CCName, kp.Realm, p.clock.Now().Add(syncMinLifetime)) == nil
+}
+
+// Note the use of managed credentials, for evicting the least recently used.
+func (p *plugin) touch(key string) {
+	p.Lock()
+	if mc, ok := p.managed[key]; ok {
+		mc.used = p.clock.Now()
+	}
+	p.Unlock()
+}
+
+// Get the parameters of credentials set up for the pod, or nil.
+func (p *plugin) podParams(pod *api.PodSandbox) *kerberosParams {
+	return p.managedParams(pod, "")
+}
+
+// Get the parameters of credentials set up for a container with credentials
+// of its own, or for the pod if the container is empty, or nil.
+func (p *plugin) managedParams(pod *api.PodSandbox, container string) *kerberosParams {
+	if pod.GetUid() == "" {
+		return nil
+	}
+
+	return p.managedParamsOf(managedKey(pod, &kerberosParams{Container: container}))
+}
+
+// Get the parameters of managed credentials by their key, or nil.
+func (p *plugin) managedParamsOf(key string) *kerberosParams {
+	p.Lock()
+	defer p.Unlock()
+	if mc, ok := p.managed[key]; ok {
+		return mc.params
+	}
+	return nil
+}
+
+// Keys of the managed credentials of a pod and of its containers.
+func (p *plugin) podKeys(id string) []string {
+	p.Lock()
+	defer p.Unlock()
+	var keys []string
+	for key, mc := range p.managed {
+		if mc.pod.GetId() == id {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Release the credentials of a pod and of its containers.
+func (p *plugin) releasePod(id string) {
+	for _, key := range p.podKeys(id) {
+		p.releaseCache(key)
+	}
+}
+
+// Schedule credential cache cleanup for a stopped pod, after the configured
+// grace period: its credentials are destroyed and, unless another sandbox of
+// the pod uses them, its credential cache directories and their file systems
+// removed.
+func (p *plugin) StopPodSandbox(_ context.Context, pod *api.PodSandbox) error {
+	if len(p.podKeys(pod.GetId())) == 0 {
+		return nil
+	}
+
+	grace := p.config().CCacheGracePeriod.Duration
+	if grace > 0 {
+		podLogger(pod).Infof("credential cache cleanup in %s", grace)
+	}
+	id := pod.GetId()
+	p.cleaner.Schedule(id, grace, func() {
+		p.releasePod(id)
+		p.removeStoppedPodDirs(pod)
+	})
+
+	return nil
+}
+
+// Remove the credential cache directories of a stopped pod, once no sandbox of
+// the pod has credentials any more.
+func (p *plugin) removeStoppedPodDirs(pod *api.PodSandbox) {
+	p.Lock()
+	for _, mc := range p.managed {
+		if mc.pod.GetUid() == pod.GetUid() {
+			p.Unlock()
+			return
+		}
+	}
+	p.Unlock()
+	if err := p.removePodCCacheDir(pod); err != nil {
+		podLogger(pod).Error(err)
+	}
+}
+
+// Clean up right away when a pod is removed, whether or not its grace period
+// expired, deleting its ephemeral principals.
+func (p *plugin) RemovePodSandbox(ctx context.Context, pod *api.PodSandbox) error {
+	p.config().normalizePod(pod)
+	l := podLogger(pod)
+	p.Lock()
+	delete(p.failed, pod.GetId())
+	delete(p.dryRuns, pod.GetId())
+	if p.sandboxes != nil {
+		delete(p.sandboxes, pod.GetUid())
+	}
+	delete(p.pods, pod.GetId())
+	p.Unlock()
+	if p.cleaner.Cancel(pod.GetId()) {
+		l.Info("pod removed, cleaning up credential cache early")
+	}
+	p.releasePod(pod.GetId())
+	p.tickets.release(pod)
+	p.audit.forget(pod)
+	p.remediation.forgetPod(pod.GetId())
+	p.results.forget(pod)
+	scriptOutputs.forget(pod.GetNamespace(), pod.GetName())
+	p.autofs.remove(withLogger(ctx, l), pod)
+
+	if err := p.removePodCCacheDir(pod); err != nil {
+		l.Error(err)
+	}
+	cleanupCtx, cancel := context.WithTimeout(ctx, p.config().cleanupTimeout())
+	defer cancel()
+	if err := p.ephemeral.release(cleanupCtx, pod); err != nil {
+		l.Error(err)
+	}
+	if err := p.removePodKeytabDir(pod); err != nil {
+		l.Error(err)
+	}
+	return nil
+}
+
+// Stop tracking the credentials of a pod and destroy them unless another pod
+// still uses the same credential cache or keytab.
+func (p *plugin) releaseCache(id string) {
+	p.release(id, false)
+}
+
+// Stop tracking the credentials of a pod and destroy them, when forced even if
+// another pod still uses the same credential cache or keytab.
+func (p *plugin) release(id string, force bool) {
+	p.renewals.Cancel(id)
+
+	p.Lock()
+	mc, ok := p.managed[id]
+	if !ok {
+		p.Unlock()
+		return
+	}
+	delete(p.managed, id)
+	managedTickets.Set(float64(len(p.managed)))
+	inUse, keytabInUse := p.credentialsInUse(mc.params)
+	p.Unlock()
+	p.bindings.release(id)
+	p.tickets.release(mc.pod)
+	p.mountChecks.forget(id)
+	p.keytabs.forget(id)
+	p.gmsa.forget(id)
+	p.expiry.forget(id)
+	p.mountStats.forget(id)
+	p.remediation.forget(id)
+	if len(mc.params.Volumes) > 0 {
+		p.writeK5Identity(mc.log, mc.params.UID, mc.params.GID)
+	}
+
+	if inUse && !force {
+		mc.log.Infof("credentials for %s still in use, keeping them", mc.params.Principal())
+		return
+	}
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), mc.log), p.config().cleanupTimeout())
+	defer cancel()
+	kp := *mc.params
+	kp.KeytabInUse = keytabInUse && !force
+	err := p.destroyCredentials(ctx, &kp)
+	p.auditOp("destroy", mc.pod, mc.params.Container, mc.params, err)
+	if err != nil {
+		mc.log.Errorf("%v, leaving it to the sweeper", err)
+		p.Lock()
+		p.leaked[mc.params.CCName] = mc
+		p.Unlock()
+		return
+	}
+	mc.log.Infof("destroyed credential cache %s", mc.params.CCName)
+}
+
+// Whether credentials of other pods still use the credential cache of kp, and
+// whether they still use the keytab of its user. Call with the plugin locked.
+func (p *plugin) credentialsInUse(kp *kerberosParams) (ccache, keytab bool) {
+	for _, other := range p.managed {
+		if other.params.CCName == kp.CCName {
+			ccache = true
+		}
+		if other.params.User == kp.User {
+			keytab = true
+		}
+	}
+	return ccache, keytab
+}
+
+// Destroy the host credential cache of credentials and what was made of it
+// outside the pod credential cache directory: the gss-proxy configuration of
+// the uid and the cache keyring in its persistent keyring.
+func (p *plugin) destroyCredentials(ctx context.Context, kp *kerberosParams) error {
+	if err := p.backend.Destroy(ctx, kp); err != nil {
+		return err
+	}
+	if kp.GSSProxy {
+		cfg := p.config().GSSProxy
+		if err := cfg.unconfigure(kp.UID); err != nil {
+			return err
+		}
+	}
+	if kp.CCacheType == ccacheTypeKeyring {
+		if err := destroyKeyringCCache(int(kp.UID)); err != nil {
+			return fmt.Errorf("failed to destroy the cache keyring of uid %d: %w", kp.UID, err)
+		}
+	}
+	return nil
+}
+
+// A default value and where it comes from.
+type fallback struct {
+	value string
+	from  string
+}
+
+// Return the pod-provided value if set, otherwise the first non-empty default, logging where it came from.
+func (p *plugin) withDefault(l *logrus.Entry, key, value string, defaults ...fallback) string {
+	if value != "" {
+		l.Debugf("%s: %s (from pod)", key, value)
+		return value
+	}
+	for _, def := range defaults {
+		if def.value != "" {
+			l.Debugf("%s: %s (from %s)", key, def.value, def.from)
+			return def.value
+		}
+	}
+	return ""
+}
 
-	return nil, nil, nil
+// NFS servers of a comma or space separated list.
+func nfsServerList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
 }
 
-// Construct a container name for log messages.
-func containerName(pod *api.PodSandbox, container *api.Container) string {
-	if pod != nil {
-		return pod.Name + "/" + container.Name
+// Fill in an id from a KerberosIdentity rule, which an annotated id must match.
+func resolveID(name string, annotated, rule uint64) (uint64, error) {
+	switch {
+	case rule == 0:
+		return annotated, nil
+	case annotated == 0:
+		return rule, nil
+	case annotated != rule:
+		return 0, fmt.Errorf("%s %d does not match %d", name, annotated, rule)
 	}
-	return container.Name
+	return annotated, nil
 }
 
 // Dump one or more objects, with an optional global prefix and per-object tags.
@@ -180,35 +1495,330 @@ func dump(args ...interface{}) {
 func main() {
 	var (
 		pluginIdx    string
+		after        string
+		nriPlugins   string
+		instanceLock string
+		configFile   string
 		disableWatch bool
+		validate     bool
+		logOpts      logOptions
 		opts         []stub.Option
 		mgr          *hooks.Manager
 		err          error
 	)
 
 	log = logrus.StandardLogger()
-	log.SetFormatter(&logrus.TextFormatter{
-		PadLevelText: true,
-	})
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "controller":
+			runController(os.Args[2:])
+			return
+		case "webhook":
+			runWebhook(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "csi":
+			runCSI(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "admin":
+			runAdmin(os.Args[2:])
+			return
+		case "migrate-annotations":
+			runMigrateAnnotations(os.Args[2:])
+			return
+		case "start-gate":
+			runStartGate(os.Args[2:])
+			return
+		}
+	}
 
 	flag.StringVar(&pluginIdx, "idx", "", "plugin index to register to NRI")
+	flag.StringVar(&after, "after", "", "comma-separated NRI plugins, as name or idx-name, to register after")
+	flag.StringVar(&nriPlugins, "nriPluginPath", defaultNRIPluginPath, "directory of the NRI plugins the runtime starts, for -after")
+	flag.StringVar(&instanceLock, "instanceLock", defaultInstanceLock, "lock of the instance managing the pods of the node, empty for none")
+	flag.StringVar(&configFile, "config", defaultConfigFile, "path to the plugin configuration file")
 	flag.BoolVar(&disableWatch, "disableWatch", false, "disable watching hook directories for new hooks")
+	flag.BoolVar(&validate, "validate-config", false, "check the configuration and exit, without connecting to NRI")
+	logOpts.register(flag.CommandLine)
 	flag.Parse()
 
+	if err = logOpts.apply(); err != nil {
+		log.Errorf("invalid logging options: %v", err)
+		os.Exit(1)
+	}
+
+	if validate {
+		validateConfig(configFile, "")
+	}
+
+	if pluginIdx, err = pluginIndex(pluginIdx, after, nriPlugins); err != nil {
+		log.Errorf("failed to determine the plugin index: %v", err)
+		os.Exit(1)
+	}
 	if pluginIdx != "" {
 		opts = append(opts, stub.WithPluginIdx(pluginIdx))
 	}
 
-	logrus.SetLevel(logrus.DebugLevel)
-
-	p := &plugin{}
+	var clock Clock = systemClock{}
+	p := &plugin{
+		cleaner:     newCleaner(clock),
+		renewals:    newCleaner(clock),
+		kdcs:        newKDCTracker(clock),
+		discovery:   newKDCDiscovery(clock),
+		nfsVersions: newNFSVersionProbe(clock),
+		nfsExports:  newNFSExportProbe(clock),
+		health:      newHealth(),
+		remediation: newRemediator(),
+		results:     newSetupResults(),
+		breaker:     newPrincipalBreaker(),
+		managed:     make(map[string]*managedCache),
+		failed:      make(map[string]error),
+		dryRuns:     make(map[string]*kerberosParams),
+		leaked:      make(map[string]*managedCache),
+		pods:        make(map[string]*api.PodSandbox),
+		clock:       clock,
+		exec:        nodeExec{},
+	}
+	cfg, err := loadConfig(configFile, configFile == defaultConfigFile)
+	if err != nil {
+		log.Errorf("failed to load plugin configuration: %v", err)
+		os.Exit(1)
+	}
+	p.configFile = configFile
+	p.cfg.Store(cfg)
+	if err := setupHelpers(cfg.Helpers); err != nil {
+		log.Errorf("failed to set up helper limits: %v", err)
+		os.Exit(1)
+	}
+	setupResolvers(cfg.DNS)
+	p.mounter = nodeMounter{exec: nodeExec{}, helper: cfg.MountHelper}
+	rt, err := detectRuntime(cfg)
+	if err != nil {
+		log.Errorf("failed to detect the container runtime: %v", err)
+		os.Exit(1)
+	}
+	p.containerRuntime.Store(rt)
+	p.bindings = loadBindings(cfg.stateFile())
+	backend, err := newBackend(cfg, p.exec, p.clock)
+	if err != nil {
+		log.Errorf("failed to set up Kerberos backend: %v", err)
+		os.Exit(1)
+	}
+	p.backend = newSharedBackend(&issuedBackend{&retryBackend{
+		&instrumentedBackend{&failoverBackend{&preflightBackend{newRateLimitedBackend(backend, func(realm string) rateLimitConfig {
+			return p.config().rateLimit(realm)
+		}, func(class string) float64 {
+			return p.config().QoS.rateShare(class)
+		}, p.clock), func() *preflightConfig { return &p.config().Preflight }}, p.kdcs}},
+		func(kp *kerberosParams) *retryConfig {
+			cfg := p.config()
+			return cfg.QoS.retry(kp.qosClass(), &cfg.Retry)
+		},
+	}}, cfg.MaxParallelSetups)
+	if p.kube, err = newKubeClient(cfg.Kubeconfig); err != nil {
+		log.Errorf("failed to set up Kubernetes API client: %v", err)
+		os.Exit(1)
+	}
+	if cfg.IDsFromSecurityContext && p.kube == nil {
+		log.Errorf("idsFromSecurityContext needs Kubernetes API access")
+		os.Exit(1)
+	}
+	if p.directory, err = newDirectory(cfg.Directory, p.exec, p.clock); err != nil {
+		log.Errorf("failed to set up the user directory: %v", err)
+		os.Exit(1)
+	}
+	if p.vault, err = newVaultSource(cfg.Vault); err != nil {
+		log.Errorf("failed to set up Vault credential source: %v", err)
+		os.Exit(1)
+	}
+	if p.aws, err = newAWSSecretsSource(cfg.AWSSecrets); err != nil {
+		log.Errorf("failed to set up AWS Secrets Manager credential source: %v", err)
+		os.Exit(1)
+	}
+	if p.gcp, err = newGCPSecretsSource(cfg.GCPSecrets); err != nil {
+		log.Errorf("failed to set up GCP Secret Manager credential source: %v", err)
+		os.Exit(1)
+	}
+	if p.broker, err = newTokenBroker(cfg.TokenBroker, p.kube); err != nil {
+		log.Errorf("failed to set up the token broker: %v", err)
+		os.Exit(1)
+	}
+	if p.gmsa, err = newGMSASource(cfg.GMSA, p.clock); err != nil {
+		log.Errorf("failed to set up managed service accounts: %v", err)
+		os.Exit(1)
+	}
+	if p.ephemeral, err = newEphemeralPrincipals(cfg.Ephemeral, p.podKeytabDir, p.makePodKeytabDir, p.exec, p.clock); err != nil {
+		log.Errorf("failed to set up ephemeral principals: %v", err)
+		os.Exit(1)
+	}
+	if p.audit, err = newAuditLogger(cfg.Audit, nodeName()); err != nil {
+		log.Errorf("failed to set up audit log: %v", err)
+		os.Exit(1)
+	}
+	opts = append(opts, stub.WithOnClose(func() { p.health.connected.Store(false) }))
 	if p.stub, err = stub.New(p, opts...); err != nil {
 		log.Errorf("failed to create plugin stub: %v", err)
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
-	dirs := []string{hooks.DefaultDir, hooks.OverrideDir}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if instanceLock != "" {
+		idx := pluginIdx
+		if idx == "" {
+			idx, _, _ = api.ParsePluginName(filepath.Base(os.Args[0]))
+		}
+		lock, err := acquireInstance(ctx, instanceLock, idx)
+		if err != nil {
+			log.Errorf("failed to become the instance managing the pods of the node: %v", err)
+			os.Exit(1)
+		}
+		defer lock.Close()
+	}
+
+	shutdownTracing, err := setupTracing(ctx, cfg.Tracing)
+	if err != nil {
+		log.Errorf("failed to set up tracing: %v", err)
+		os.Exit(1)
+	}
+	defer func() {
+		flush, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdownTracing(flush)
+	}()
+
+	if cfg.KerberosIdentities {
+		if p.kube == nil {
+			log.Errorf("kerberosIdentities needs Kubernetes API access")
+			os.Exit(1)
+		}
+		p.identities = newIdentityCache(p.kube)
+		go p.identities.run(ctx, nil)
+	}
+	if len(cfg.SPIFFE.Principals) > 0 {
+		if p.spiffe, err = newSPIFFEClient(cfg.SPIFFE.socket(), p.kube); err != nil {
+			log.Errorf("failed to set up SPIFFE: %v", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.NamespaceRealmLabel != "" {
+		if p.kube == nil {
+			log.Errorf("namespaceRealmLabel needs Kubernetes API access")
+			os.Exit(1)
+		}
+		p.namespaceRealms = newNamespaceRealmCache(p.kube, cfg.NamespaceRealmLabel)
+		go p.namespaceRealms.run(ctx)
+	}
+	if cfg.NamespaceDefaults {
+		if p.kube == nil {
+			log.Errorf("namespaceDefaults needs Kubernetes API access")
+			os.Exit(1)
+		}
+		p.namespaceDefaults = newNamespaceDefaultsCache(p.kube, cfg.annotation)
+		go p.namespaceDefaults.run(ctx)
+	}
+	if cfg.Events {
+		if p.kube == nil {
+			log.Errorf("events needs Kubernetes API access")
+			os.Exit(1)
+		}
+		p.events = newEventRecorder(p.kube, nodeName(), p.clock)
+		go p.events.run(ctx)
+	}
+	if cfg.TicketStatus || cfg.PodStatus.enabled() {
+		if p.kube == nil {
+			log.Errorf("ticketStatus and podStatus need Kubernetes API access")
+			os.Exit(1)
+		}
+		p.tickets = newTicketReporter(p.kube, nodeName(), cfg, p.clock)
+		go p.tickets.run(ctx)
+	}
+	if cfg.Remediation.needsKube() && p.kube == nil {
+		log.Errorf("remediation actions annotate and condition need Kubernetes API access")
+		os.Exit(1)
+	}
+	if cfg.NodeCondition.Enabled {
+		if p.kube == nil {
+			log.Errorf("nodeCondition needs Kubernetes API access")
+			os.Exit(1)
+		}
+		if cfg.HealthAddress == "" {
+			// the condition tells by the probes of the KDCs how long they are down
+			go p.health.probeKDCs(ctx, p.knownKDCs, p.kdcs.observe)
+		}
+		go p.runNodeChecks(ctx, newNodeConditionReporter(cfg.NodeCondition, p.kube, nodeName()))
+	}
+	if cfg.Prestage.Enabled {
+		if p.kube == nil {
+			log.Errorf("prestage needs Kubernetes API access")
+			os.Exit(1)
+		}
+		p.prestage = newPrestager(cfg.Prestage, p.kube, nodeName(), p.clock)
+		go p.runPrestage(ctx)
+	}
+
+	if cfg.AppArmor.Abstraction != "" {
+		if err := p.writeAppArmorAbstraction(cfg); err != nil {
+			log.Errorf("failed to write AppArmor abstraction: %v", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.IDMap.Manage {
+		if err := configureIDMap(ctx, p.exec, cfg); err != nil {
+			log.Errorf("failed to configure NFSv4 ID mapping: %v", err)
+			os.Exit(1)
+		}
+	}
+	if p.autofs, err = newAutofsMaps(ctx, cfg.Autofs, p.exec); err != nil {
+		log.Errorf("failed to set up autofs maps: %v", err)
+		os.Exit(1)
+	}
+	if cfg.GSSD.Manage {
+		go newGSSDManager(cfg.GSSD, cfg.GSSProxy.Enabled, cfg.NFSVersion == "3", p.exec).run(ctx)
+	}
+	if cfg.MountCheck.Enabled {
+		p.mountChecks = newMountChecker(cfg.MountCheck, p.mounter)
+		go p.runMountChecks(ctx)
+	}
+	if cfg.KeytabRotation.Enabled {
+		p.keytabs = newKeytabWatcher(cfg.KeytabRotation)
+		go p.runKeytabChecks(ctx)
+	}
+	if p.gmsa != nil {
+		go p.runGMSARefresh(ctx)
+	}
+	if cfg.Sweep.Enabled {
+		go p.runSweeps(ctx, cfg.Sweep)
+	}
+	if cfg.ExpiryAlerts.Enabled {
+		p.expiry = newExpiryWatcher(cfg.ExpiryAlerts)
+		go p.runExpiryChecks(ctx)
+	}
+	if cfg.MountStats.Enabled {
+		p.mountStats = newMountStatsExporter(cfg.MountStats)
+		go p.runMountStats(ctx)
+	}
+
+	if configFile != "" {
+		if err := watchConfig(ctx, configFile, func() { p.reloadConfig(configFile) }); err != nil {
+			log.Warnf("configuration will not be reloaded on changes: %v", err)
+		}
+	}
+
+	dirs := cfg.HookDirs
+	if len(dirs) == 0 {
+		dirs = p.runtime().hookDirs
+	}
 	mgr, err = hooks.New(ctx, dirs, []string{})
 	if err != nil {
 		log.Errorf("failed to set up hook manager: %v", err)
@@ -225,7 +1835,10 @@ func main() {
 		}
 
 		sync := make(chan error, 2)
-		go mgr.Monitor(ctx, sync)
+		go func() {
+			mgr.Monitor(ctx, sync)
+			p.health.watching.Store(false)
+		}()
 
 		err = <-sync
 		if err != nil {
@@ -234,8 +1847,17 @@ func main() {
 		}
 		log.Infof("watching directories %q for new changes", strings.Join(dirs, " "))
 	}
+	p.health.watching.Store(true)
+
+	p.startServers(ctx, cfg)
+
+	go func() {
+		<-ctx.Done()
+		p.stub.Stop()
+	}()
 
-	err = p.stub.Run(ctx)
+	err = p.runStub(ctx)
+	p.shutdown()
 	if err != nil {
 		log.Errorf("plugin exited with error %v", err)
 		os.Exit(1)
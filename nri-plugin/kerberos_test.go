@@ -0,0 +1,531 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Node defaults of the plugins of the tests.
+const testConfigYAML = `
+defaultRealm: EXAMPLE.COM
+defaultKDC: kdc.example.com
+defaultNFS: nfs.example.com
+`
+
+// Annotations of an enabled pod of user, with the ids of uid.
+func testAnnotations(user string, uid int, extra ...string) map[string]string {
+	ann := map[string]string{
+		"nri.io/kerberos-auth": "enabled",
+		"nri.io/kerberos-user": user,
+		"nri.io/kerberos-uid":  fmt.Sprint(uid),
+		"nri.io/kerberos-gid":  fmt.Sprint(uid),
+		"nri.io/kerberos-fsid": fmt.Sprint(uid),
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		ann[extra[i]] = extra[i+1]
+	}
+	return ann
+}
+
+func TestAnnotationSettings(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		want        podSettings
+	}{{
+		name: "ids and servers",
+		annotations: map[string]string{
+			"nri.io/kerberos-user":  "alice",
+			"nri.io/kerberos-uid":   "1000",
+			"nri.io/kerberos-gid":   "2000",
+			"nri.io/kerberos-fsid":  "3000",
+			"nri.io/kerberos-realm": "EXAMPLE.COM",
+			"nri.io/kerberos-kdc":   "kdc.example.com",
+			"nri.io/kerberos-nfs":   "nfs1.example.com,nfs2.example.com",
+		},
+		want: podSettings{uid: 1000, gid: 2000, fsid: 3000, user: "alice", realm: "EXAMPLE.COM",
+			kdc: "kdc.example.com", nfs: "nfs1.example.com,nfs2.example.com"},
+	}, {
+		name: "invalid ids left out",
+		annotations: map[string]string{
+			"nri.io/kerberos-uid":  "-1",
+			"nri.io/kerberos-gid":  "4294967296",
+			"nri.io/kerberos-fsid": "staff",
+		},
+	}, {
+		name: "security flavor and credential cache type folded",
+		annotations: map[string]string{
+			"nri.io/kerberos-sec":         "KRB5P",
+			"nri.io/kerberos-ccache-type": "dir",
+			"nri.io/kerberos-nfs-version": "4.2",
+			"nri.io/kerberos-anonymous":   "true",
+			"nri.io/kerberos-forwardable": "yes",
+		},
+		want: podSettings{sec: "krb5p", ccacheType: "DIR", nfsVersion: "4.2", anonymous: true},
+	}, {
+		name: "volumes",
+		annotations: map[string]string{
+			"nri.io/kerberos-nfs-version.data": "3",
+			"nri.io/kerberos-principal.data":   "svc-data",
+			"nri.io/kerberos-principal.logs":   "svc-logs@EXAMPLE.COM",
+		},
+		want: podSettings{
+			nfsVolumeVersions: map[string]string{"data": "3"},
+			volumePrincipals:  map[string]string{"data": "svc-data", "logs": "svc-logs@EXAMPLE.COM"},
+		},
+	}, {
+		name: "versioned annotations override prefixed ones",
+		annotations: map[string]string{
+			"nri.io/kerberos-user":                     "alice",
+			"v1alpha2.kerberos.nri.io/user":            "bob",
+			"v1alpha2.kerberos.nri.io/uid":             "1001",
+			"v1alpha2.kerberos.nri.io/ticket-lifetime": "8h",
+		},
+		want: podSettings{user: "bob", uid: 1001, ticketLifetime: "8h"},
+	}, {
+		name: "unknown annotations ignored",
+		annotations: map[string]string{
+			"nri.io/kerberos-usr": "alice",
+			"nri.io/user":         "alice",
+			"kerberos-user":       "alice",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config{}
+			pod := &api.PodSandbox{Annotations: tc.annotations}
+			cfg.normalizePod(pod)
+			if got := annotationSettings(logrus.NewEntry(log), cfg, pod); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("annotationSettings() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContainerSettings(t *testing.T) {
+	cfg := &config{AnnotationPrefix: "example.com/"}
+	pod := &api.PodSandbox{Annotations: map[string]string{
+		"example.com/kerberos-user":     "alice",
+		"example.com/kerberos-uid":      "1000",
+		"example.com/kerberos-realm":    "EXAMPLE.COM",
+		"example.com/kerberos-user.db":  "dbadmin",
+		"example.com/kerberos-uid.db":   "1002",
+		"example.com/kerberos-kdc.db":   "kdc2.example.com",
+		"example.com/kerberos-user.web": "www",
+	}}
+	for container, want := range map[string]podSettings{
+		"db":  {user: "dbadmin", uid: 1002, realm: "EXAMPLE.COM"},
+		"web": {user: "www", uid: 1000, realm: "EXAMPLE.COM"},
+		"app": {user: "alice", uid: 1000, realm: "EXAMPLE.COM"},
+	} {
+		if got := containerSettings(logrus.NewEntry(log), cfg, pod, container); !reflect.DeepEqual(got, want) {
+			t.Errorf("containerSettings(%s) = %+v, want %+v", container, got, want)
+		}
+	}
+}
+
+func TestPodSandboxParams(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Configuration instead of testConfigYAML.
+		config      string
+		annotations map[string]string
+		// Parameters expected, nil for none.
+		want *kerberosParams
+	}{{
+		name:        "node defaults",
+		annotations: testAnnotations("alice", 1000),
+		want: &kerberosParams{UID: 1000, GID: 1000, FSID: 1000, User: "alice", Realm: "EXAMPLE.COM",
+			KDC: "kdc.example.com", NFS: "nfs.example.com", CCName: "FILE:/tmp/krb5cc_1000"},
+	}, {
+		name: "realm table",
+		config: testConfigYAML + `
+realms:
+  OTHER.EXAMPLE.COM:
+    kdcs: [kdc1.other.example.com, kdc2.other.example.com]
+    nfs: nfs.other.example.com
+`,
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-realm", "OTHER.EXAMPLE.COM"),
+		want: &kerberosParams{UID: 1000, GID: 1000, FSID: 1000, User: "alice", Realm: "OTHER.EXAMPLE.COM",
+			KDC: "kdc1.other.example.com", KDCs: []string{"kdc2.other.example.com"}, NFS: "nfs.other.example.com",
+			CCName: "FILE:/tmp/krb5cc_1000"},
+	}, {
+		name: "annotations over node defaults",
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-kdc", "kdc2.example.com",
+			"nri.io/kerberos-nfs", "nfs1.example.com,nfs2.example.com", "nri.io/kerberos-sec", "krb5i"),
+		want: &kerberosParams{UID: 1000, GID: 1000, FSID: 1000, User: "alice", Realm: "EXAMPLE.COM",
+			KDC: "kdc2.example.com", NFS: "nfs1.example.com", CCName: "FILE:/tmp/krb5cc_1000", Sec: "krb5i"},
+	}, {
+		name:        "volume principals in a collection",
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-principal.data", "svc-data@EXAMPLE.COM"),
+		want: &kerberosParams{UID: 1000, GID: 1000, FSID: 1000, User: "alice", Realm: "EXAMPLE.COM",
+			KDC: "kdc.example.com", NFS: "nfs.example.com", CCName: "DIR::/tmp/krb5cc_1000/tkt",
+			VolumePrincipals: map[string]string{"data": "svc-data"}},
+	}, {
+		name:        "user not annotated",
+		annotations: map[string]string{"nri.io/kerberos-auth": "enabled", "nri.io/kerberos-uid": "1000"},
+	}, {
+		name:        "user not a plain name",
+		annotations: testAnnotations("../alice", 1000),
+	}, {
+		name:        "user with a realm",
+		annotations: testAnnotations("alice@EXAMPLE.COM", 1000),
+	}, {
+		name:        "ids missing",
+		annotations: testAnnotations("alice", 0),
+	}, {
+		name:        "invalid security flavor",
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-sec", "sys"),
+	}, {
+		name:        "invalid NFS version",
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-nfs-version", "5"),
+	}, {
+		name:        "invalid NFS version of a volume",
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-nfs-version.data", "2"),
+	}, {
+		name:        "invalid credential cache type",
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-ccache-type", "MEMORY"),
+	}, {
+		name:        "volume principal of another realm",
+		annotations: testAnnotations("alice", 1000, "nri.io/kerberos-principal.data", "svc-data@OTHER.EXAMPLE.COM"),
+	}, {
+		name:        "anonymous not allowed",
+		annotations: map[string]string{"nri.io/kerberos-auth": "enabled", "nri.io/kerberos-anonymous": "true"},
+	}, {
+		name:        "no KDC without default",
+		config:      "defaultRealm: EXAMPLE.COM\ndefaultNFS: nfs.example.com\n",
+		annotations: testAnnotations("alice", 1000),
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			yaml := tc.config
+			if yaml == "" {
+				yaml = testConfigYAML
+			}
+			p, rt := newTestPlugin(t, yaml, &fakeBackend{})
+			cfg := p.config()
+			pod := rt.Pod("default", "app", tc.annotations)
+			got := p.podSandboxParams(logrus.NewEntry(log), cfg, pod)
+			if tc.want == nil {
+				if got != nil {
+					t.Fatalf("podSandboxParams() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("podSandboxParams() = nil")
+			}
+			want := *tc.want
+			want.NFSServers = nfsServerList(tc.annotations["nri.io/kerberos-nfs"])
+			if len(want.NFSServers) == 0 {
+				want.NFSServers = []string{want.NFS}
+			}
+			want.Krb5Conf, want.ETypes, want.QoS = &cfg.Krb5Conf, cfg.Crypto.encTypes(), cfg.QoS.class("default")
+			cfg.applyTrust(&want)
+			if !reflect.DeepEqual(got, &want) {
+				t.Errorf("podSandboxParams() = %+v, want %+v", got, &want)
+			}
+		})
+	}
+}
+
+func TestSetupDecisions(t *testing.T) {
+	errKDC := fmt.Errorf("%w: KDC unreachable", errCCacheFailed)
+	for _, tc := range []struct {
+		name        string
+		config      string
+		annotations map[string]string
+		// Env of the container, as of a renewal sidecar.
+		env     []string
+		errs    map[string][]error
+		wantOps []string
+		// Whether the container gets the credential cache mounted.
+		wantMount bool
+		wantErr   error
+	}{{
+		name:        "annotated pod",
+		annotations: testAnnotations("alice", 61001),
+		wantOps:     []string{"setup alice@EXAMPLE.COM"},
+		wantMount:   true,
+	}, {
+		name:        "versioned annotations",
+		annotations: map[string]string{"v1alpha2.kerberos.nri.io/auth": "enabled", "v1alpha2.kerberos.nri.io/user": "bob", "v1alpha2.kerberos.nri.io/uid": "61002", "v1alpha2.kerberos.nri.io/gid": "61002", "v1alpha2.kerberos.nri.io/fsid": "61002"},
+		wantOps:     []string{"setup bob@EXAMPLE.COM"},
+		wantMount:   true,
+	}, {
+		name:        "not enabled",
+		annotations: map[string]string{"nri.io/kerberos-user": "alice", "nri.io/kerberos-uid": "61003"},
+	}, {
+		name:        "incomplete",
+		annotations: testAnnotations("alice", 0),
+	}, {
+		name:        "renewal sidecar",
+		annotations: map[string]string{"nri.io/kerberos-auth": "enabled", "nri.io/kerberos-uid": "61004", "nri.io/kerberos-gid": "61004", "nri.io/kerberos-fsid": "61004"},
+		env:         []string{"KERBEROS_USER=carol", "KERBEROS_RENEWAL_TIME=3600"},
+		wantOps:     []string{"setup carol@EXAMPLE.COM"},
+		wantMount:   true,
+	}, {
+		name:        "renewal sidecar in annotation-only mode",
+		config:      "annotationsOnly: true\n",
+		annotations: map[string]string{"nri.io/kerberos-auth": "enabled", "nri.io/kerberos-uid": "61005", "nri.io/kerberos-gid": "61005", "nri.io/kerberos-fsid": "61005"},
+		env:         []string{"KERBEROS_USER=carol", "KERBEROS_RENEWAL_TIME=3600"},
+	}, {
+		name:        "dry run",
+		config:      "dryRun: true\n",
+		annotations: testAnnotations("alice", 61006),
+	}, {
+		name:        "setup failing",
+		annotations: testAnnotations("alice", 61007),
+		errs:        map[string][]error{"setup": {errKDC}},
+		wantOps:     []string{"setup alice@EXAMPLE.COM"},
+	}, {
+		name:        "setup failing in strict mode",
+		config:      "strict: true\n",
+		annotations: testAnnotations("alice", 61008),
+		errs:        map[string][]error{"setup": {errKDC}},
+		wantOps:     []string{"setup alice@EXAMPLE.COM"},
+		wantErr:     errSetupFailed,
+	}, {
+		name:        "setup failing in a soft-fail namespace",
+		config:      "strict: true\nsoftFailNamespaces: [default]\n",
+		annotations: testAnnotations("alice", 61009),
+		errs:        map[string][]error{"setup": {errKDC}},
+		wantOps:     []string{"setup alice@EXAMPLE.COM"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := &fakeBackend{lifetime: time.Hour, renewable: 24 * time.Hour, errs: tc.errs}
+			p, rt := newTestPlugin(t, testConfigYAML+tc.config, b)
+			pod := rt.Pod("default", "app", tc.annotations)
+			if err := rt.RunPod(ctx, pod); err != nil {
+				t.Fatal(err)
+			}
+			ctr := rt.Container(pod, "app")
+			ctr.Env = tc.env
+			adjust, err := rt.CreateContainer(ctx, pod, ctr)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("CreateContainer() error = %v, want %v", err, tc.wantErr)
+			}
+			if got := b.operations(); !slices.Equal(got, tc.wantOps) {
+				t.Errorf("backend operations = %q, want %q", got, tc.wantOps)
+			}
+			mounted := slices.ContainsFunc(adjust.GetMounts(), func(m *api.Mount) bool {
+				return m.GetSource() == p.podCCacheDir(pod)
+			})
+			if mounted != tc.wantMount {
+				t.Errorf("credential cache mounted = %v, want %v, adjustment %v", mounted, tc.wantMount, adjust)
+			}
+		})
+	}
+}
+
+func TestSetupReused(t *testing.T) {
+	ctx := context.Background()
+	b := &fakeBackend{lifetime: time.Hour, renewable: 24 * time.Hour}
+	_, rt := newTestPlugin(t, testConfigYAML, b)
+	pod := rt.Pod("default", "app", testAnnotations("alice", 61010))
+	if err := rt.RunPod(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"init", "app", "sidecar"} {
+		if _, err := rt.CreateContainer(ctx, pod, rt.Container(pod, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.RemovePod(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"setup alice@EXAMPLE.COM", "destroy alice@EXAMPLE.COM"}
+	if got := b.operations(); !slices.Equal(got, want) {
+		t.Errorf("backend operations = %q, want %q", got, want)
+	}
+}
+
+func TestSynchronizeRenewal(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Age of the TGT when the plugin synchronizes, none if negative.
+		age     time.Duration
+		wantOps []string
+	}{{
+		name:    "valid",
+		age:     30 * time.Minute,
+		wantOps: nil,
+	}, {
+		name:    "expiring",
+		age:     55 * time.Minute,
+		wantOps: []string{"renew alice@EXAMPLE.COM"},
+	}, {
+		name:    "expired",
+		age:     2 * time.Hour,
+		wantOps: []string{"renew alice@EXAMPLE.COM"},
+	}, {
+		name:    "gone",
+		age:     -1,
+		wantOps: []string{"renew alice@EXAMPLE.COM"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := &fakeBackend{lifetime: time.Hour, renewable: 24 * time.Hour}
+			p, rt := newTestPlugin(t, testConfigYAML, b)
+			pod := rt.Pod("default", "app", testAnnotations("alice", 61020))
+			if err := rt.RunPod(ctx, pod); err != nil {
+				t.Fatal(err)
+			}
+			kp := p.podParams(pod)
+			if kp == nil {
+				t.Fatal("no credentials set up")
+			}
+
+			// as restarted, with the credentials set up before
+			p.Lock()
+			delete(p.managed, pod.GetId())
+			p.Unlock()
+			if tc.age < 0 {
+				if err := destroyCCache(kp.CCName); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p.clock.(*fakeClock).advance(tc.age)
+			b.reset(nil)
+			if err := rt.Synchronize(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.operations(); !slices.Equal(got, tc.wantOps) {
+				t.Errorf("backend operations = %q, want %q", got, tc.wantOps)
+			}
+			if p.podParams(pod) == nil && tc.age >= 0 {
+				t.Error("credentials not taken over")
+			}
+		})
+	}
+}
+
+func TestRenewPod(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Time since setup the credentials are renewed at.
+		after   time.Duration
+		errs    map[string][]error
+		wantOps []string
+		wantErr error
+	}{{
+		name:    "renewable",
+		after:   45 * time.Minute,
+		wantOps: []string{"renew alice@EXAMPLE.COM"},
+	}, {
+		name:    "past the renewable lifetime",
+		after:   4 * time.Hour,
+		wantOps: []string{"setup alice@EXAMPLE.COM"},
+	}, {
+		name:    "credentials lost",
+		after:   45 * time.Minute,
+		errs:    map[string][]error{"renew": {fmt.Errorf("%w: kvno 3", errKeytabMismatch)}},
+		wantOps: []string{"renew alice@EXAMPLE.COM", "setup alice@EXAMPLE.COM"},
+	}, {
+		name:    "renewal failing",
+		after:   45 * time.Minute,
+		errs:    map[string][]error{"renew": {fmt.Errorf("%w: KDC unreachable", errCCacheFailed)}},
+		wantOps: []string{"renew alice@EXAMPLE.COM"},
+		wantErr: errCCacheFailed,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := &fakeBackend{lifetime: time.Hour, renewable: 4 * time.Hour}
+			p, rt := newTestPlugin(t, testConfigYAML+"renewal:\n  enabled: true\n", b)
+			pod := rt.Pod("default", "app", testAnnotations("alice", 61030))
+			if err := rt.RunPod(ctx, pod); err != nil {
+				t.Fatal(err)
+			}
+
+			// Renewed here rather than by the scheduled renewal
+			for key := range p.renewals.Due() {
+				p.renewals.Cancel(key)
+			}
+			p.clock.(*fakeClock).advance(tc.after)
+			b.reset(tc.errs)
+			if err := p.renewPod(pod.GetId()); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("renewPod() error = %v, want %v", err, tc.wantErr)
+			}
+			if got := b.operations(); !slices.Equal(got, tc.wantOps) {
+				t.Errorf("backend operations = %q, want %q", got, tc.wantOps)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			t2, err := ccacheTimes(p.podParams(pod).CCName, "EXAMPLE.COM")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if now := p.clock.Now(); !t2.start.Equal(now) {
+				t.Errorf("TGT starts at %s, want %s", t2.start, now)
+			}
+			if _, err := os.Stat(p.podCCacheDir(pod)); err != nil {
+				t.Errorf("credential cache not published: %v", err)
+			}
+		})
+	}
+}
+
+func TestScheduleRenewal(t *testing.T) {
+	ctx := context.Background()
+	b := &fakeBackend{lifetime: time.Hour, renewable: 4 * time.Hour}
+	p, rt := newTestPlugin(t, testConfigYAML+"renewal:\n  enabled: true\n", b)
+	clock := p.clock.(*fakeClock)
+	start := clock.Now()
+	pod := rt.Pod("default", "app", testAnnotations("alice", 61031))
+	if err := rt.RunPod(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+
+	due := p.renewals.Due()
+	if len(due) != 1 {
+		t.Fatalf("scheduled renewals = %v, want one", due)
+	}
+	want := start.Add(45 * time.Minute)
+	for key, at := range due {
+		if !at.Equal(want) {
+			t.Errorf("renewal of %s due at %s, want %s", key, at, want)
+		}
+	}
+
+	b.reset(nil)
+	clock.advance(44 * time.Minute)
+	if got := b.operations(); len(got) != 0 {
+		t.Errorf("backend operations before the renewal is due = %q, want none", got)
+	}
+	clock.advance(time.Minute)
+	eventually(t, func() bool { return slices.Contains(b.operations(), "renew alice@EXAMPLE.COM") })
+
+	// The renewed ticket is renewed again at the same fraction of its lifetime
+	want = clock.Now().Add(45 * time.Minute)
+	eventually(t, func() bool {
+		for _, at := range p.renewals.Due() {
+			return at.Equal(want)
+		}
+		return false
+	})
+}
@@ -0,0 +1,190 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jcmturner/gokrb5/v8/types"
+	"golang.org/x/sys/unix"
+)
+
+// Layout of KEYRING credential caches as MIT krb5 keeps them, see
+// https://web.mit.edu/kerberos/krb5-latest/doc/basic/ccache_def.html
+const (
+	// Collection keyring within the persistent keyring of a user.
+	keyringCollection = "_krb"
+	// Key of the collection naming its primary cache.
+	keyringPrimaryKey = "krb_ccache:primary"
+	// Key of a cache keyring holding its default principal.
+	keyringPrincipalKey = "__krb5_princ__"
+	// Cache keyring the plugin publishes to.
+	keyringCCache = "krb_ccache_nri_kerberos"
+	// Possessor and user may do anything, as with the keys libkrb5 creates.
+	keyringPerm = 0x3f3f0000
+)
+
+// Serializes publishing, since cache keyrings are built in the process keyring
+// under the same name.
+var keyringLock sync.Mutex
+
+// KEYRING credential cache name of a uid, as used inside the container.
+func keyringCCName(uid uint64) string {
+	return fmt.Sprintf("KEYRING:persistent:%d:%s", uid, keyringCCache)
+}
+
+// Replace the cache keyring of the plugin in the persistent keyring of uid with
+// the entries, handing all keys over to uid/gid. The cache is made primary if
+// the collection has none yet. The first entry defines the default principal.
+func writeKeyringCCache(uid, gid int, entries []*ccacheEntry) error {
+	if len(entries) == 0 {
+		return errors.New("no credentials to write")
+	}
+
+	keyringLock.Lock()
+	defer keyringLock.Unlock()
+
+	collection, release, err := keyringCollectionOf(uid, gid, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// build the cache in the process keyring and link it into the collection
+	// when complete, replacing the previous one at once
+	cache, err := unix.AddKey("keyring", keyringCCache, nil, unix.KEY_SPEC_PROCESS_KEYRING)
+	if err != nil {
+		return fmt.Errorf("%w: failed to create cache keyring: %w", errCCacheFailed, err)
+	}
+	defer unlinkKey(cache, unix.KEY_SPEC_PROCESS_KEYRING)
+
+	princ := &ccacheEncoder{}
+	princ.putPrincipal(entries[0].clientRealm, entries[0].client)
+	if err := addUserKey(keyringPrincipalKey, princ.Bytes(), cache, uid, gid); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		cred := &ccacheEncoder{}
+		cred.putCredential(e)
+		if err := addUserKey(unparsePrincipal(e.serverRealm, e.server), cred.Bytes(), cache, uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := handOverKey(cache, uid, gid); err != nil {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_LINK, cache, collection, 0, 0); err != nil {
+		return fmt.Errorf("%w: failed to link cache keyring: %w", errCCacheFailed, err)
+	}
+
+	if _, err := unix.KeyctlSearch(collection, "user", keyringPrimaryKey, 0); errors.Is(err, unix.ENOKEY) {
+		primary := &bytes.Buffer{}
+		_ = binary.Write(primary, binary.BigEndian, uint32(1)) // version
+		_ = binary.Write(primary, binary.BigEndian, uint32(len(keyringCCache)))
+		primary.WriteString(keyringCCache)
+		if err := addUserKey(keyringPrimaryKey, primary.Bytes(), collection, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove the cache keyring of the plugin from the persistent keyring of uid.
+func destroyKeyringCCache(uid int) error {
+	keyringLock.Lock()
+	defer keyringLock.Unlock()
+
+	collection, release, err := keyringCollectionOf(uid, -1, false)
+	if errors.Is(err, unix.ENOKEY) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cache, err := unix.KeyctlSearch(collection, "keyring", keyringCCache, 0)
+	if errors.Is(err, unix.ENOKEY) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up cache keyring: %w", err)
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, cache, collection, 0, 0); err != nil {
+		return fmt.Errorf("failed to unlink cache keyring: %w", err)
+	}
+	return nil
+}
+
+// Get the collection keyring in the persistent keyring of uid, creating it if
+// asked to. The persistent keyring is linked into the process keyring until
+// release is called.
+func keyringCollectionOf(uid, gid int, create bool) (int, func(), error) {
+	persistent, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, uid, unix.KEY_SPEC_PROCESS_KEYRING, 0, 0)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: failed to get persistent keyring of uid %d: %w", errCCacheFailed, uid, err)
+	}
+	release := func() { unlinkKey(persistent, unix.KEY_SPEC_PROCESS_KEYRING) }
+
+	collection, err := unix.KeyctlSearch(persistent, "keyring", keyringCollection, 0)
+	if errors.Is(err, unix.ENOKEY) && create {
+		collection, err = unix.AddKey("keyring", keyringCollection, nil, persistent)
+		if err == nil {
+			err = handOverKey(collection, uid, gid)
+		}
+	}
+	if err != nil {
+		release()
+		return 0, nil, fmt.Errorf("%w: failed to get credential cache collection of uid %d: %w", errCCacheFailed, uid, err)
+	}
+	return collection, release, nil
+}
+
+// Add or update a user key in a keyring, owned by uid/gid.
+func addUserKey(desc string, payload []byte, keyring, uid, gid int) error {
+	id, err := unix.AddKey("user", desc, payload, keyring)
+	if err != nil {
+		return fmt.Errorf("%w: failed to add key %q: %w", errCCacheFailed, desc, err)
+	}
+	return handOverKey(id, uid, gid)
+}
+
+// Give a key to uid/gid, with the permissions libkrb5 gives its own keys.
+func handOverKey(id, uid, gid int) error {
+	if _, err := unix.KeyctlInt(unix.KEYCTL_CHOWN, id, uid, gid, 0); err != nil {
+		return fmt.Errorf("%w: failed to set key ownership: %w", errCCacheFailed, err)
+	}
+	if err := unix.KeyctlSetperm(id, keyringPerm); err != nil {
+		return fmt.Errorf("%w: failed to set key permissions: %w", errCCacheFailed, err)
+	}
+	return nil
+}
+
+func unlinkKey(id, keyring int) {
+	_, _ = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, keyring, 0, 0)
+}
+
+// Principal name in the form libkrb5 describes credential keys with.
+func unparsePrincipal(realm string, pn types.PrincipalName) string {
+	return strings.Join(pn.NameString, "/") + "@" + realm
+}
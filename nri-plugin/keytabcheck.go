@@ -0,0 +1,216 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Time the KDC is given to answer the pre-flight AS-REQ.
+const keytabCheckTimeout = 5 * time.Second
+
+// Keys of a principal in a keytab: their key versions by enctype.
+type keytabKeys map[int32][]uint32
+
+func principalKeys(kt *keytab.Keytab, principal string) keytabKeys {
+	keys := keytabKeys{}
+	for _, e := range kt.Entries {
+		if strings.Join(e.Principal.Components, "/")+"@"+e.Principal.Realm == principal {
+			keys[e.Key.KeyType] = append(keys[e.Key.KeyType], e.KVNO)
+		}
+	}
+	return keys
+}
+
+// Key versions of the keys, highest first, without duplicates.
+func (k keytabKeys) kvnos() []uint32 {
+	var kvnos []uint32
+	for _, vs := range k {
+		kvnos = append(kvnos, vs...)
+	}
+	slices.Sort(kvnos)
+	slices.Reverse(kvnos)
+	return slices.Compact(kvnos)
+}
+
+// Names of enctypes, the longest of the aliases of each, sorted.
+func etypeNames(etypes []int32) string {
+	var names []string
+	for _, etype := range etypes {
+		name := ""
+		for n, id := range etypeID.ETypesByName {
+			if id == etype && (len(n) > len(name) || len(n) == len(name) && n < name) {
+				name = n
+			}
+		}
+		if name == "" {
+			name = fmt.Sprintf("etype-%d", etype)
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(slices.Compact(names), ",")
+}
+
+// Check a keytab before obtaining credentials with it, so that what cannot
+// work is told apart from other kinit failures: the keytab has keys of the
+// principal, and the KDC, asked for a TGT without pre-authentication, knows the
+// principal and has keys of an enctype the keytab has. If the KDC answers
+// without requiring pre-authentication, the key version it used has to be in
+// the keytab as well. A KDC which cannot be reached is left to kinit.
+func preflightKeytab(ctx context.Context, cfg *krb5config.Config, kp *kerberosParams, kt *keytab.Keytab) error {
+	keys := principalKeys(kt, kp.Principal())
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: keytab has no keys of %s", errKeytabMismatch, kp.Principal())
+	}
+	keys, err := checkKeytabPolicy(kp, keys)
+	if err != nil {
+		return err
+	}
+	etypes := slices.Sorted(maps.Keys(keys))
+
+	req, err := messages.NewASReqForTGT(kp.Realm, cfg, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, kp.principalName()))
+	if err != nil {
+		return nil
+	}
+	req.ReqBody.EType = etypes
+	msg, err := req.Marshal()
+	if err != nil {
+		return nil
+	}
+	reply, err := exchangeKDC(ctx, cfg, kp.Realm, msg)
+	if err != nil {
+		loggerFrom(ctx).Debugf("cannot check keytab of %s with the KDC: %v", kp.Principal(), err)
+		return nil
+	}
+
+	var rep messages.ASRep
+	if err := rep.Unmarshal(reply); err == nil {
+		kvno := uint32(rep.EncPart.KVNO)
+		if kvno != 0 && !slices.Contains(keys[rep.EncPart.EType], kvno) {
+			return fmt.Errorf("%w: kvno mismatch: keytab=%s kdc=%d", errKeytabMismatch, joinKVNOs(keys.kvnos()), kvno)
+		}
+		return nil
+	}
+	var krbErr messages.KRBError
+	if err := krbErr.Unmarshal(reply); err != nil {
+		return nil
+	}
+	switch krbErr.ErrorCode {
+	case errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN:
+		return fmt.Errorf("%w: %s", errPrincipalUnknown, kp.Principal())
+	case errorcode.KDC_ERR_ETYPE_NOSUPP:
+		return fmt.Errorf("%w: enctype mismatch: keytab=%s, the KDC allows none of them for %s",
+			errKeytabMismatch, etypeNames(etypes), kp.Principal())
+	case errorcode.KDC_ERR_PREAUTH_REQUIRED:
+		var methods types.PADataSequence
+		if err := methods.Unmarshal(krbErr.EData); err != nil {
+			return nil
+		}
+		for _, pa := range methods {
+			if pa.PADataType != patype.PA_ETYPE_INFO2 {
+				continue
+			}
+			info, err := pa.GetETypeInfo2()
+			if err != nil {
+				return nil
+			}
+			var kdc []int32
+			for _, e := range info {
+				if _, ok := keys[e.EType]; ok {
+					return nil
+				}
+				kdc = append(kdc, e.EType)
+			}
+			return fmt.Errorf("%w: enctype mismatch: keytab=%s kdc=%s", errKeytabMismatch, etypeNames(etypes), etypeNames(kdc))
+		}
+	}
+	return nil
+}
+
+func joinKVNOs(kvnos []uint32) string {
+	s := make([]string, len(kvnos))
+	for i, kvno := range kvnos {
+		s[i] = fmt.Sprint(kvno)
+	}
+	return strings.Join(s, ",")
+}
+
+// Send a message to a KDC of the realm over TCP and return its reply, trying
+// the KDCs in order.
+func exchangeKDC(ctx context.Context, cfg *krb5config.Config, realm string, msg []byte) ([]byte, error) {
+	n, kdcs, err := cfg.GetKDCs(realm, true)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, keytabCheckTimeout)
+	defer cancel()
+	for i := 1; i <= n; i++ {
+		var reply []byte
+		if reply, err = exchangeTCP(ctx, kdcs[i], msg); err == nil {
+			return reply, nil
+		}
+	}
+	return nil, err
+}
+
+func exchangeTCP(ctx context.Context, addr string, msg []byte) ([]byte, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(msg))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size uint32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > 1<<20 {
+		return nil, fmt.Errorf("reply of %d bytes from %s too large", size, addr)
+	}
+	reply := make([]byte, size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,201 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+const defaultKeytabCheckInterval = 5 * time.Minute
+
+// Detection of rotated keytabs of managed credentials.
+type keytabRotationConfig struct {
+	// Check the keytab sources of managed credentials for new key versions and
+	// obtain the credentials afresh with them.
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval of the checks, 5m by default.
+	Interval duration `json:"interval,omitempty"`
+}
+
+func (c *keytabRotationConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultKeytabCheckInterval
+}
+
+// Watcher of the key versions of the keytabs of managed credentials.
+type keytabWatcher struct {
+	cfg keytabRotationConfig
+
+	sync.Mutex
+	// Key version credentials were last obtained with, by managed key.
+	kvnos map[string]uint32
+}
+
+func newKeytabWatcher(cfg keytabRotationConfig) *keytabWatcher {
+	return &keytabWatcher{cfg: cfg, kvnos: map[string]uint32{}}
+}
+
+// Stop watching the keytab of credentials.
+func (w *keytabWatcher) forget(id string) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	delete(w.kvnos, id)
+	w.Unlock()
+}
+
+// Highest key version of the principal in a keytab, 0 if it has no key of it.
+func keytabKVNO(data []byte, principal string) (uint32, error) {
+	kt := keytab.New()
+	if err := kt.Unmarshal(data); err != nil {
+		return 0, fmt.Errorf("failed to parse keytab: %w", err)
+	}
+	if kvnos := principalKeys(kt, principal).kvnos(); len(kvnos) > 0 {
+		return kvnos[0], nil
+	}
+	return 0, nil
+}
+
+// Check the keytabs of managed credentials periodically until the context is
+// cancelled.
+func (p *plugin) runKeytabChecks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.keytabs.cfg.interval()):
+		}
+
+		p.Lock()
+		ids := make([]string, 0, len(p.managed))
+		for id := range p.managed {
+			ids = append(ids, id)
+		}
+		p.Unlock()
+		for _, id := range ids {
+			p.checkKeytab(ctx, id)
+		}
+	}
+}
+
+// Keytab the backend obtains credentials with when the pod has no credential
+// source, which whatever provisions it on the node may replace.
+func keytabFile(cfg *config, kp *kerberosParams) string {
+	dir := cfg.KeytabDir
+	if dir == "" {
+		dir = defaultKeytabDir
+	}
+	return filepath.Join(dir, kp.User+".keytab")
+}
+
+// Compare the key version of the keytab in the source of managed credentials
+// with that they were obtained with, and obtain them afresh once it is newer:
+// after a key rollover the KDC keeps the old keys only for a while, and
+// renewals would fail once they are retired. The version first seen is taken
+// from the keytab the credentials were set up with.
+func (p *plugin) checkKeytab(ctx context.Context, id string) {
+	cfg := p.config()
+	p.Lock()
+	mc, ok := p.managed[id]
+	p.Unlock()
+	if !ok || mc.params.Password != "" || mc.params.PKINIT != nil || mc.params.Anonymous != nil {
+		return
+	}
+	kp := mc.params
+
+	ctx, cancel := context.WithTimeout(withLogger(ctx, mc.log), cfg.setupTimeout())
+	defer cancel()
+
+	w := p.keytabs
+	w.Lock()
+	seen, ok := w.kvnos[id]
+	w.Unlock()
+	if !ok {
+		path := kp.Keytab
+		if path == "" {
+			path = keytabFile(cfg, kp)
+		}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			seen, err = keytabKVNO(data, kp.Principal())
+		}
+		if err != nil {
+			mc.log.Debugf("cannot tell the key version of %s: %v", kp.Principal(), err)
+			return
+		}
+		w.Lock()
+		w.kvnos[id] = seen
+		w.Unlock()
+	}
+
+	var data []byte
+	var err error
+	if src := p.credentialSource(mc.pod); src != nil {
+		var cred *credential
+		if cred, err = src.Fetch(ctx, mc.pod, kp); err == nil {
+			data = cred.Keytab
+		}
+	} else {
+		data, err = os.ReadFile(keytabFile(cfg, kp))
+	}
+	if err != nil {
+		mc.log.Debugf("cannot check the keytab of %s: %v", kp.Principal(), err)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	current, err := keytabKVNO(data, kp.Principal())
+	if err != nil || current <= seen {
+		return
+	}
+
+	mc.log.Infof("keytab of %s rotated from key version %d to %d, obtaining credentials afresh", kp.Principal(), seen, current)
+	err = p.fetchCredentials(ctx, mc.pod, kp)
+	if err == nil {
+		err = p.backend.Setup(ctx, kp)
+	}
+	if err == nil && mc.pod.GetUid() != "" && len(kp.Volumes) == 0 {
+		_, err = p.publishCCache(mc.pod, kp)
+	}
+	keytabRotations.WithLabelValues(result(err)).Inc()
+	if !kp.secondary() {
+		p.tickets.report(mc.pod, kp, err)
+	}
+	if err != nil {
+		p.auditOp("rekey", mc.pod, kp.Container, kp, err)
+		mc.log.Errorf("obtaining credentials for %s with key version %d failed: %v", kp.Principal(), current, err)
+		p.events.warn(mc.pod, reasonRenewalFailed, "obtaining credentials for %s with the rotated keytab, key version %d, failed (%s): %v",
+			kp.Principal(), current, failureReason(err), err)
+		return
+	}
+	w.Lock()
+	w.kvnos[id] = current
+	w.Unlock()
+	p.auditOp("rekey", mc.pod, kp.Container, kp, nil)
+	p.scheduleRenewal(id)
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// kinit, used for what gokrb5 lacks: PKINIT and FAST. Heimdal names it
+	// the same.
+	mitKinit = "kinit"
+	// MIT kvno, obtaining service tickets into caches kinit wrote.
+	mitKvno = "kvno"
+)
+
+// Run kinit with a krb5.conf generated for the workload, with the arguments
+// of the implementation of the node for the options, passing stdin to it if
+// not empty.
+func runKinit(ctx context.Context, ex Exec, kp *kerberosParams, stdin string, o *kinitOptions) error {
+	return runKrb5Tool(ctx, ex, kp, stdin, mitKinit, kp.krb5Tools(ex).kinitArgs(o)...)
+}
+
+// Obtain a TGT with the password or keytab, armored with the FAST armor cache
+// if given, and hand the credential cache to the workload.
+func kinitCredentials(ctx context.Context, ex Exec, kp *kerberosParams, keytab, armor string) error {
+	path, err := ccachePath(kp.CCName)
+	if err != nil {
+		return err
+	}
+
+	o := &kinitOptions{CCName: "FILE:" + path, Principal: kp.Principal(), Armor: armor}
+	stdin := ""
+	if kp.Password != "" {
+		stdin, o.Password = kp.Password, true
+	} else {
+		if _, err := loadPermittedKeytab(kp, keytab); err != nil {
+			return err
+		}
+		o.Keytab = keytab
+	}
+	if err := runKinit(ctx, ex, kp, stdin, o); err != nil {
+		return fmt.Errorf("kinit for %s failed: %w", kp.Principal(), err)
+	}
+	return chownCCache(kp, path)
+}
+
+// Obtain the NFS service tickets of the workload into the credential cache
+// kinit wrote, after the cross-realm TGTs of its trust path, logging those
+// which cannot be had: rpc.gssd may yet get them under the canonical name of
+// the server. Fails only if the trust path does.
+func kvnoServiceTickets(ctx context.Context, ex Exec, kp *kerberosParams) error {
+	path, err := ccachePath(kp.CCName)
+	if err != nil {
+		return nil
+	}
+	if err := kvnoTrustPath(ctx, ex, kp, path); err != nil {
+		return fmt.Errorf("credentials for %s: %w", kp.Principal(), err)
+	}
+	obtainServiceTickets(ctx, kp, func(service string) error {
+		tool, args := kp.krb5Tools(ex).serviceTicket("FILE:"+path, service+"@"+kp.serviceRealm())
+		return runKrb5Tool(ctx, ex, kp, "", tool, args...)
+	})
+	return nil
+}
+
+// Run a Kerberos tool with a krb5.conf generated for the workload.
+func runKrb5Tool(ctx context.Context, ex Exec, kp *kerberosParams, stdin, tool string, args ...string) error {
+	conf, err := renderKrb5Conf(kp.withHostAliases(), "")
+	if err != nil {
+		return fmt.Errorf("failed to generate krb5.conf: %w", err)
+	}
+	confFile, err := os.CreateTemp("", "nri-kerberos-krb5-*.conf")
+	if err != nil {
+		return fmt.Errorf("failed to write krb5.conf: %w", err)
+	}
+	defer os.Remove(confFile.Name())
+	_, err = confFile.WriteString(conf)
+	if cerr := confFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write krb5.conf: %w", err)
+	}
+
+	// #nosec G204:gosec -- the arguments are not passed through a shell
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Env = append(os.Environ(), "KRB5_CONFIG="+confFile.Name())
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin + "\n")
+	}
+	out := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := ex.RunCmd(ctx, cmd); err != nil {
+		return classifyKinitError(err, out.String())
+	}
+	return nil
+}
+
+// Hand a credential cache written by kinit over to the workload.
+func chownCCache(kp *kerberosParams, path string) error {
+	if err := os.Chown(path, int(kp.UID), int(kp.GID)); err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// renew_lifetime of the generated krb5.conf files unless configured.
+const defaultRenewLifetime = "7d"
+
+// [libdefaults] entries the generator sets, which libdefaults cannot.
+var krb5ConfLibDefaults = []string{"default_realm", "dns_lookup_kdc", "dns_lookup_realm", "dns_canonicalize_hostname", "rdns", "noaddresses",
+	"renew_lifetime", "ticket_lifetime", "default_ccache_name", "default_cc_name", "default_tkt_enctypes", "default_tgs_enctypes",
+	"permitted_enctypes", "allow_weak_crypto"}
+
+var libDefaultRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Settings of the krb5.conf files generated for the workloads, for kinit and
+// the native backend and mounted into the containers.
+type krb5ConfConfig struct {
+	// ticket_lifetime of the TGTs asked for, the one of the KDC if 0.
+	TicketLifetime duration `json:"ticketLifetime,omitempty"`
+	// renew_lifetime of the TGTs asked for, 7 days if 0.
+	RenewLifetime duration `json:"renewLifetime,omitempty"`
+	// Most a pod may ask for with the ticket lifetime and renewable lifetime
+	// annotations, no limit if 0; longer ones are clamped to these.
+	MaxTicketLifetime duration `json:"maxTicketLifetime,omitempty"`
+	MaxRenewLifetime  duration `json:"maxRenewLifetime,omitempty"`
+	// dns_canonicalize_hostname: true, false or fallback, false by default.
+	// The plugin canonicalizes the names of the NFS servers the same way for
+	// the service tickets it obtains.
+	DNSCanonicalizeHostname string `json:"dnsCanonicalizeHostname,omitempty"`
+	// rdns: canonicalize by reverse DNS lookup of the address too.
+	RDNS bool `json:"rdns,omitempty"`
+	// Further [libdefaults] entries, e.g. udp_preference_limit.
+	LibDefaults map[string]string `json:"libdefaults,omitempty"`
+	// Replay cache of the workloads accepting GSSAPI contexts.
+	ReplayCache replayCacheConfig `json:"replayCache,omitempty"`
+	// mit or heimdal, the Kerberos implementation of the kinit and kvno (or
+	// kgetcred) of the node, detected from kinit by default.
+	Tools string `json:"tools,omitempty"`
+	// Go template file to render instead of the built-in one, given the
+	// fields of krb5ConfData.
+	Template string `json:"template,omitempty"`
+
+	tmpl *template.Template
+}
+
+// Check the libdefaults entries and parse the template, if any.
+func (c *krb5ConfConfig) validate() error {
+	if err := validCanonicalize(c.DNSCanonicalizeHostname); err != nil {
+		return fmt.Errorf("dnsCanonicalizeHostname: %w", err)
+	}
+	for k, v := range c.LibDefaults {
+		if !libDefaultRegexp.MatchString(k) {
+			return fmt.Errorf("libdefaults: invalid name %q", k)
+		}
+		for _, name := range krb5ConfLibDefaults {
+			if k == name {
+				return fmt.Errorf("libdefaults: %s is set by the plugin", k)
+			}
+		}
+		if v == "" || strings.ContainsAny(v, "\n{}") {
+			return fmt.Errorf("libdefaults: invalid value %q of %s", v, k)
+		}
+	}
+	if err := c.ReplayCache.validate(); err != nil {
+		return fmt.Errorf("replayCache: %w", err)
+	}
+	if err := validKrb5Tools(c.Tools); err != nil {
+		return fmt.Errorf("tools: %w", err)
+	}
+	if c.Template == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.Template)
+	if err != nil {
+		return fmt.Errorf("template: %w", err)
+	}
+	if c.tmpl, err = template.New("krb5.conf").Option("missingkey=error").Parse(string(data)); err != nil {
+		return fmt.Errorf("template: %w", err)
+	}
+	return nil
+}
+
+// Lifetime as krb5.conf takes it, in seconds.
+func krb5Lifetime(d duration) string {
+	if d.Duration == 0 {
+		return ""
+	}
+	return fmt.Sprint(int64(d.Seconds()))
+}
+
+var krb5ConfTemplate = template.Must(template.New("krb5.conf").Parse(`[libdefaults]
+    default_realm = {{ .Realm }}
+    dns_lookup_kdc = false
+    dns_lookup_realm = false
+    dns_canonicalize_hostname = {{ .DNSCanonicalizeHostname }}
+    rdns = {{ .RDNS }}
+    noaddresses = true
+    renew_lifetime = {{ .RenewLifetime }}
+{{- if .TicketLifetime }}
+    ticket_lifetime = {{ .TicketLifetime }}
+{{- end }}
+{{- if .CCacheName }}
+    default_ccache_name = {{ .CCacheName }}
+    default_cc_name = {{ .CCacheName }}
+{{- end }}
+{{- if .ETypes }}
+    default_tkt_enctypes = {{ .ETypes }}
+    default_tgs_enctypes = {{ .ETypes }}
+    permitted_enctypes = {{ .ETypes }}
+    allow_weak_crypto = false
+{{- end }}
+{{- range $name, $value := .LibDefaults }}
+    {{ $name }} = {{ $value }}
+{{- end }}
+
+[realms]
+    {{ .Realm }} = {
+{{- if .KDCProxy }}
+        kdc = {{ .KDCProxy }}
+{{- else }}
+        kdc = {{ .KDC }}
+{{- range .KDCs }}
+        kdc = {{ . }}
+{{- end }}
+{{- end }}
+    }
+{{- range .Trusted }}
+    {{ .Name }} = {
+{{- range .KDCs }}
+        kdc = {{ . }}
+{{- end }}
+    }
+{{- end }}
+{{- if or .Domains .TrustedDomains }}
+
+[domain_realm]
+{{- range .Domains }}
+    .{{ . }} = {{ $.Realm }}
+    {{ . }} = {{ $.Realm }}
+{{- end }}
+{{- range .Trusted }}
+{{- $realm := .Name }}
+{{- range .Domains }}
+    .{{ . }} = {{ $realm }}
+    {{ . }} = {{ $realm }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- if .CAPaths }}
+
+[capaths]
+    {{ .Realm }} = {
+{{- range $realm, $via := .CAPaths }}
+{{- range $via }}
+        {{ $realm }} = {{ . }}
+{{- end }}
+{{- end }}
+    }
+{{- end }}
+`))
+
+// Data for rendering krb5.conf, also by the templates of krb5Conf.template.
+type krb5ConfData struct {
+	Realm      string
+	KDC        string
+	KDCs       []string
+	Domains    []string
+	KDCProxy   string
+	CCacheName string
+	// Permitted enctypes, space separated.
+	ETypes string
+	// Other realms of the cross-realm trust path and the paths to them.
+	Trusted []trustedRealm
+	CAPaths map[string][]string
+	// Lifetimes of the TGTs asked for, in seconds or as 7d, and further
+	// [libdefaults] entries.
+	TicketLifetime string
+	RenewLifetime  string
+	LibDefaults    map[string]string
+	// Host name canonicalization: true, false or fallback, and reverse DNS.
+	DNSCanonicalizeHostname string
+	RDNS                    bool
+	// User and UID of the workload.
+	User string
+	UID  uint64
+}
+
+// Whether any realm of the trust path has DNS domains.
+func (d *krb5ConfData) TrustedDomains() bool {
+	for _, r := range d.Trusted {
+		if len(r.Domains) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Realms of the trust path with their KDCs as krb5.conf takes them.
+func trustedKrb5Realms(realms []trustedRealm) []trustedRealm {
+	var out []trustedRealm
+	for _, r := range realms {
+		r.KDCs = krb5Addresses(r.KDCs)
+		out = append(out, r)
+	}
+	return out
+}
+
+// URL of the KDC proxy of the workload, or empty.
+func kdcProxyURL(kp *kerberosParams) string {
+	if kp.KDCProxy == nil {
+		return ""
+	}
+	return kp.KDCProxy.URL
+}
+
+// Render a krb5.conf for the workload, with the template of its settings if
+// they have one. A non-empty ccname becomes the default credential cache.
+func renderKrb5Conf(kp *kerberosParams, ccname string) (string, error) {
+	tmpl, settings := krb5ConfTemplate, kp.Krb5Conf
+	if settings == nil {
+		settings = &krb5ConfConfig{}
+	}
+	if settings.tmpl != nil {
+		tmpl = settings.tmpl
+	}
+	ticketLifetime, renewLifetime := kp.lifetimes()
+	renew := krb5Lifetime(duration{renewLifetime})
+	if renew == "" {
+		renew = defaultRenewLifetime
+	}
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, &krb5ConfData{
+		Realm:      kp.Realm,
+		KDC:        krb5Address(kp.KDC),
+		KDCs:       krb5Addresses(kp.KDCs),
+		Domains:    kp.Domains,
+		KDCProxy:   kdcProxyURL(kp),
+		CCacheName: ccname,
+		ETypes:     strings.Join(kp.ETypes, " "),
+		Trusted:    trustedKrb5Realms(kp.TrustRealms),
+		CAPaths:    kp.capaths(),
+
+		TicketLifetime: krb5Lifetime(duration{ticketLifetime}),
+		RenewLifetime:  renew,
+		LibDefaults:    kp.libDefaults(settings),
+
+		DNSCanonicalizeHostname: settings.canonicalize(),
+		RDNS:                    settings.RDNS,
+
+		User: kp.principalName(),
+		UID:  kp.UID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(buf.String()) == "" {
+		return "", errors.New("template renders nothing")
+	}
+	return buf.String(), nil
+}
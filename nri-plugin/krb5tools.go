@@ -0,0 +1,281 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	krb5MIT     = "mit"
+	krb5Heimdal = "heimdal"
+
+	// Heimdal kgetcred, its counterpart of MIT kvno.
+	heimdalKgetcred = "kgetcred"
+	// Time the version of a tool is given to answer.
+	krb5DetectTimeout = 5 * time.Second
+)
+
+// Kerberos implementation of the kinit, kvno and kadmin of the node, which
+// the plugin runs where gokrb5 falls short. MIT krb5 and Heimdal name the
+// tools and their flags differently; both read the keytabs and FILE:
+// credential caches the plugin writes, and rpc.gssd works with either.
+type krb5Tools interface {
+	// mit or heimdal.
+	name() string
+	// kinit arguments obtaining a TGT as the options tell.
+	kinitArgs(o *kinitOptions) []string
+	// Tool and arguments obtaining a service ticket into a cache holding a
+	// TGT.
+	serviceTicket(ccname, service string) (string, []string)
+	// Tool and arguments obtaining a service ticket for the user by S4U2Self
+	// and S4U2Proxy with the TGT of the service in ccname, into out.
+	delegatedTicket(ccname, user, service, out string) (string, []string, error)
+	// kadmin arguments of a query on realm with the keytab of an admin
+	// principal, and the output telling it failed even if kadmin exited 0.
+	kadminArgs(cfg kadminConfig, realm string, query kadminQuery) []string
+	kadminFailed(out string) bool
+	// Whether a failed query found the principal to exist, or missing.
+	kadminExists(out string) bool
+	kadminMissing(out string) bool
+}
+
+// What kinit is to do: a TGT of the principal into the cache, with the
+// keytab, the password on stdin, a certificate by PKINIT or anonymously.
+type kinitOptions struct {
+	CCName    string
+	Principal string
+	Realm     string
+	Keytab    string
+	Password  bool
+	Anonymous bool
+	// PKINIT certificate and key, and the CA certificates of the KDC.
+	Cert, Key, Anchors string
+	// Credential cache of the FAST armor TGT.
+	Armor string
+}
+
+// kadmin query, implementation independent.
+type kadminQuery struct {
+	// addprinc with a random key, ktadd into Keytab or delprinc.
+	Op        string
+	Principal string
+	Keytab    string
+	Expires   time.Time
+}
+
+const (
+	kadminAdd    = "add"
+	kadminExport = "export"
+	kadminDelete = "delete"
+)
+
+func validKrb5Tools(name string) error {
+	switch name {
+	case "", krb5MIT, krb5Heimdal:
+		return nil
+	}
+	return fmt.Errorf("invalid Kerberos implementation %q, must be %s or %s", name, krb5MIT, krb5Heimdal)
+}
+
+// Implementations detected, by tool.
+var detectedKrb5Tools sync.Map
+
+// Implementation of the tool, as configured, else as detected from the
+// output of its --version, which Heimdal tools have and MIT ones reject.
+// Tools which cannot be run count as MIT ones, the failure showing once they
+// are run for real.
+func krb5ToolsOf(ex Exec, configured, tool string) krb5Tools {
+	switch configured {
+	case krb5MIT:
+		return mitTools{}
+	case krb5Heimdal:
+		return heimdalTools{}
+	}
+	if t, ok := detectedKrb5Tools.Load(tool); ok {
+		return t.(krb5Tools)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), krb5DetectTimeout)
+	defer cancel()
+	out, _ := ex.Run(ctx, tool, "--version")
+	var t krb5Tools = mitTools{}
+	if strings.Contains(string(out), "Heimdal") {
+		t = heimdalTools{}
+	}
+	if ctx.Err() == nil {
+		detectedKrb5Tools.Store(tool, t)
+	}
+	log.Debugf("%s is %s", tool, t.name())
+	return t
+}
+
+// Implementation of the kinit and kvno of the node for the workload.
+func (kp *kerberosParams) krb5Tools(ex Exec) krb5Tools {
+	configured := ""
+	if kp.Krb5Conf != nil {
+		configured = kp.Krb5Conf.Tools
+	}
+	return krb5ToolsOf(ex, configured, mitKinit)
+}
+
+type mitTools struct{}
+
+func (mitTools) name() string {
+	return krb5MIT
+}
+
+func (mitTools) kinitArgs(o *kinitOptions) []string {
+	args := []string{"-c", o.CCName}
+	if o.Armor != "" {
+		args = append(args, "-T", o.Armor)
+	}
+	switch {
+	case o.Anonymous:
+		args = append(args, "-n")
+	case o.Cert != "":
+		args = append(args, "-X", "X509_user_identity=FILE:"+o.Cert+","+o.Key)
+	case o.Keytab != "":
+		args = append(args, "-k", "-t", o.Keytab)
+	}
+	if o.Anchors != "" {
+		args = append(args, "-X", "X509_anchors=FILE:"+o.Anchors)
+	}
+	if o.Anonymous {
+		return append(args, "@"+o.Realm)
+	}
+	return append(args, o.Principal)
+}
+
+func (mitTools) serviceTicket(ccname, service string) (string, []string) {
+	return mitKvno, []string{"-c", ccname, service}
+}
+
+func (mitTools) delegatedTicket(ccname, user, service, out string) (string, []string, error) {
+	return mitKvno, []string{"-c", ccname, "-U", user, "-P", "--out-cache", out, service}, nil
+}
+
+func (mitTools) kadminArgs(cfg kadminConfig, realm string, query kadminQuery) []string {
+	args := []string{"-r", realm, "-p", cfg.Principal, "-k", "-t", cfg.Keytab}
+	if cfg.Server != "" {
+		args = append(args, "-s", cfg.Server)
+	}
+	var q []string
+	switch query.Op {
+	case kadminAdd:
+		q = []string{"addprinc", "-randkey"}
+		if !query.Expires.IsZero() {
+			q = append(q, "-expire", `"`+query.Expires.UTC().Format(time.DateTime)+` UTC"`)
+		}
+	case kadminExport:
+		q = []string{"ktadd", "-k", query.Keytab}
+	case kadminDelete:
+		q = []string{"delprinc", "-force"}
+	}
+	return append(args, "-q", strings.Join(append(q, query.Principal), " "))
+}
+
+// MIT kadmin exits successfully when a query fails, which is told by the
+// error message it prints.
+func (mitTools) kadminFailed(out string) bool {
+	return strings.Contains(out, " while ")
+}
+
+func (mitTools) kadminExists(out string) bool {
+	return strings.Contains(out, "already exists")
+}
+
+func (mitTools) kadminMissing(out string) bool {
+	return strings.Contains(out, "does not exist")
+}
+
+type heimdalTools struct{}
+
+func (heimdalTools) name() string {
+	return krb5Heimdal
+}
+
+func (heimdalTools) kinitArgs(o *kinitOptions) []string {
+	args := []string{"--cache=" + o.CCName}
+	if o.Armor != "" {
+		args = append(args, "--fast-armor-cache="+o.Armor)
+	}
+	switch {
+	case o.Anonymous:
+		args = append(args, "--anonymous")
+	case o.Cert != "":
+		args = append(args, "--pk-user=FILE:"+o.Cert+","+o.Key)
+	case o.Keytab != "":
+		args = append(args, "--use-keytab", "--keytab="+o.Keytab)
+	case o.Password:
+		args = append(args, "--password-file=STDIN")
+	}
+	if o.Anchors != "" {
+		args = append(args, "--x509-anchors=FILE:"+o.Anchors)
+	}
+	// Heimdal kinit takes the realm alone for anonymous tickets
+	if o.Anonymous {
+		return append(args, o.Realm)
+	}
+	return append(args, o.Principal)
+}
+
+func (heimdalTools) serviceTicket(ccname, service string) (string, []string) {
+	return heimdalKgetcred, []string{"--cache=" + ccname, service}
+}
+
+// kgetcred does S4U2Self and S4U2Proxy in separate steps, with the evidence
+// ticket in a cache of its own, unlike kvno -P which the delegation relies on.
+func (heimdalTools) delegatedTicket(_, _, _, _ string) (string, []string, error) {
+	return "", nil, errors.New("delegation with a credential cache of the service needs MIT kvno, Heimdal kgetcred cannot do S4U2Self and S4U2Proxy at once")
+}
+
+func (heimdalTools) kadminArgs(cfg kadminConfig, realm string, query kadminQuery) []string {
+	args := []string{"--realm=" + realm, "--principal=" + cfg.Principal, "--keytab=" + cfg.Keytab}
+	if cfg.Server != "" {
+		args = append(args, "--admin-server="+cfg.Server)
+	}
+	switch query.Op {
+	case kadminAdd:
+		args = append(args, "add", "--random-key", "--use-defaults")
+		if !query.Expires.IsZero() {
+			args = append(args, "--expiration-time="+query.Expires.UTC().Format("2006-01-02"))
+		}
+	case kadminExport:
+		args = append(args, "ext_keytab", "--keytab="+query.Keytab)
+	case kadminDelete:
+		args = append(args, "delete")
+	}
+	return append(args, query.Principal)
+}
+
+// Heimdal kadmin exits with 1 when a query fails.
+func (heimdalTools) kadminFailed(string) bool {
+	return false
+}
+
+func (heimdalTools) kadminExists(out string) bool {
+	return strings.Contains(out, "exists")
+}
+
+func (heimdalTools) kadminMissing(out string) bool {
+	return strings.Contains(out, "No such entry") || strings.Contains(out, "does not exist")
+}
@@ -0,0 +1,267 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	heimdalKinitVersion = "kinit (Heimdal 7.8.0)\nCopyright 1995-2022 Kungliga Tekniska Högskolan\nSend bug-reports to heimdal-bugs@h5l.org\n"
+	heimdalKlistVersion = "klist (Heimdal 7.8.0)\nCopyright 1995-2022 Kungliga Tekniska Högskolan\nSend bug-reports to heimdal-bugs@h5l.org\n"
+	mitKinitVersion     = "kinit: invalid option -- '-'\nUsage: kinit [-V] [-l lifetime] [-s start_time] \n"
+	mitKlistVersion     = "klist: invalid option -- '-'\nUsage: klist [-e] [-V] [[-c] [-l] [-A] [-d] [-f] [-s] [-a [-n]]] [-k [-t] [-K]] [name]\n"
+)
+
+func TestKrb5ToolsOf(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configured string
+		tool       string
+		result     fakeResult
+		want       string
+		// Whether --version is run.
+		wantRun bool
+	}{{
+		name:    "heimdal kinit",
+		tool:    "kinit",
+		result:  fakeResult{out: []byte(heimdalKinitVersion)},
+		want:    krb5Heimdal,
+		wantRun: true,
+	}, {
+		name:    "heimdal klist",
+		tool:    "klist",
+		result:  fakeResult{out: []byte(heimdalKlistVersion)},
+		want:    krb5Heimdal,
+		wantRun: true,
+	}, {
+		name:    "mit kinit",
+		tool:    "kinit",
+		result:  fakeResult{out: []byte(mitKinitVersion), err: errors.New("exit status 1")},
+		want:    krb5MIT,
+		wantRun: true,
+	}, {
+		name:    "mit klist",
+		tool:    "klist",
+		result:  fakeResult{out: []byte(mitKlistVersion), err: errors.New("exit status 1")},
+		want:    krb5MIT,
+		wantRun: true,
+	}, {
+		name:    "tool missing",
+		tool:    "kinit",
+		result:  fakeResult{err: errors.New(`exec: "kinit": executable file not found in $PATH`)},
+		want:    krb5MIT,
+		wantRun: true,
+	}, {
+		name:       "configured mit",
+		configured: krb5MIT,
+		tool:       "kinit",
+		result:     fakeResult{out: []byte(heimdalKinitVersion)},
+		want:       krb5MIT,
+	}, {
+		name:       "configured heimdal",
+		configured: krb5Heimdal,
+		tool:       "kinit",
+		result:     fakeResult{out: []byte(mitKinitVersion), err: errors.New("exit status 1")},
+		want:       krb5Heimdal,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			detectedKrb5Tools.Clear()
+			t.Cleanup(detectedKrb5Tools.Clear)
+			ex := &fakeExec{results: map[string]fakeResult{tc.tool: tc.result}}
+
+			// Detected once, then remembered
+			for range 2 {
+				if got := krb5ToolsOf(ex, tc.configured, tc.tool).name(); got != tc.want {
+					t.Errorf("krb5ToolsOf(%q, %q) = %s, want %s", tc.configured, tc.tool, got, tc.want)
+				}
+			}
+			var want [][]string
+			if tc.wantRun {
+				want = [][]string{{tc.tool, "--version"}}
+			}
+			if !slices.EqualFunc(ex.commands, want, slices.Equal) {
+				t.Errorf("commands = %q, want %q", ex.commands, want)
+			}
+		})
+	}
+}
+
+func TestKinitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		opts        kinitOptions
+		wantMIT     string
+		wantHeimdal string
+	}{{
+		name:        "keytab",
+		opts:        kinitOptions{CCName: "FILE:/cc", Principal: "alice@EXAMPLE.COM", Keytab: "/kt"},
+		wantMIT:     "-c FILE:/cc -k -t /kt alice@EXAMPLE.COM",
+		wantHeimdal: "--cache=FILE:/cc --use-keytab --keytab=/kt alice@EXAMPLE.COM",
+	}, {
+		name:        "password",
+		opts:        kinitOptions{CCName: "FILE:/cc", Principal: "alice@EXAMPLE.COM", Password: true},
+		wantMIT:     "-c FILE:/cc alice@EXAMPLE.COM",
+		wantHeimdal: "--cache=FILE:/cc --password-file=STDIN alice@EXAMPLE.COM",
+	}, {
+		name:        "pkinit",
+		opts:        kinitOptions{CCName: "FILE:/cc", Principal: "alice@EXAMPLE.COM", Cert: "/crt", Key: "/key", Anchors: "/ca"},
+		wantMIT:     "-c FILE:/cc -X X509_user_identity=FILE:/crt,/key -X X509_anchors=FILE:/ca alice@EXAMPLE.COM",
+		wantHeimdal: "--cache=FILE:/cc --pk-user=FILE:/crt,/key --x509-anchors=FILE:/ca alice@EXAMPLE.COM",
+	}, {
+		name:        "anonymous with armor",
+		opts:        kinitOptions{CCName: "FILE:/cc", Realm: "EXAMPLE.COM", Anonymous: true, Armor: "FILE:/armor", Anchors: "/ca"},
+		wantMIT:     "-c FILE:/cc -T FILE:/armor -n -X X509_anchors=FILE:/ca @EXAMPLE.COM",
+		wantHeimdal: "--cache=FILE:/cc --fast-armor-cache=FILE:/armor --anonymous --x509-anchors=FILE:/ca EXAMPLE.COM",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := strings.Join(mitTools{}.kinitArgs(&tc.opts), " "); got != tc.wantMIT {
+				t.Errorf("MIT kinit %s, want %s", got, tc.wantMIT)
+			}
+			if got := strings.Join(heimdalTools{}.kinitArgs(&tc.opts), " "); got != tc.wantHeimdal {
+				t.Errorf("Heimdal kinit %s, want %s", got, tc.wantHeimdal)
+			}
+		})
+	}
+}
+
+func TestServiceTickets(t *testing.T) {
+	for _, tc := range []struct {
+		tools krb5Tools
+		want  string
+		// Delegated ticket, empty if not supported.
+		wantDelegated string
+	}{
+		{mitTools{}, "kvno -c FILE:/cc nfs/server@EXAMPLE.COM", "kvno -c FILE:/cc -U alice -P --out-cache FILE:/out nfs/server@EXAMPLE.COM"},
+		{heimdalTools{}, "kgetcred --cache=FILE:/cc nfs/server@EXAMPLE.COM", ""},
+	} {
+		t.Run(tc.tools.name(), func(t *testing.T) {
+			tool, args := tc.tools.serviceTicket("FILE:/cc", "nfs/server@EXAMPLE.COM")
+			if got := strings.Join(append([]string{tool}, args...), " "); got != tc.want {
+				t.Errorf("service ticket by %s, want %s", got, tc.want)
+			}
+
+			tool, args, err := tc.tools.delegatedTicket("FILE:/cc", "alice", "nfs/server@EXAMPLE.COM", "FILE:/out")
+			if tc.wantDelegated == "" {
+				if err == nil {
+					t.Errorf("delegated ticket by %s %q, want an error", tool, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(append([]string{tool}, args...), " "); got != tc.wantDelegated {
+				t.Errorf("delegated ticket by %s, want %s", got, tc.wantDelegated)
+			}
+		})
+	}
+}
+
+func TestKadminArgs(t *testing.T) {
+	cfg := kadminConfig{Principal: "admin/admin@EXAMPLE.COM", Keytab: "/admin.keytab", Server: "kdc.example.com"}
+	expires := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name        string
+		query       kadminQuery
+		wantMIT     string
+		wantHeimdal string
+	}{{
+		name:        "add",
+		query:       kadminQuery{Op: kadminAdd, Principal: "alice@EXAMPLE.COM"},
+		wantMIT:     "-r EXAMPLE.COM -p admin/admin@EXAMPLE.COM -k -t /admin.keytab -s kdc.example.com -q addprinc -randkey alice@EXAMPLE.COM",
+		wantHeimdal: "--realm=EXAMPLE.COM --principal=admin/admin@EXAMPLE.COM --keytab=/admin.keytab --admin-server=kdc.example.com add --random-key --use-defaults alice@EXAMPLE.COM",
+	}, {
+		name:        "add expiring",
+		query:       kadminQuery{Op: kadminAdd, Principal: "alice@EXAMPLE.COM", Expires: expires},
+		wantMIT:     `-r EXAMPLE.COM -p admin/admin@EXAMPLE.COM -k -t /admin.keytab -s kdc.example.com -q addprinc -randkey -expire "2026-03-01 12:30:00 UTC" alice@EXAMPLE.COM`,
+		wantHeimdal: "--realm=EXAMPLE.COM --principal=admin/admin@EXAMPLE.COM --keytab=/admin.keytab --admin-server=kdc.example.com add --random-key --use-defaults --expiration-time=2026-03-01 alice@EXAMPLE.COM",
+	}, {
+		name:        "export",
+		query:       kadminQuery{Op: kadminExport, Principal: "alice@EXAMPLE.COM", Keytab: "/alice.keytab"},
+		wantMIT:     "-r EXAMPLE.COM -p admin/admin@EXAMPLE.COM -k -t /admin.keytab -s kdc.example.com -q ktadd -k /alice.keytab alice@EXAMPLE.COM",
+		wantHeimdal: "--realm=EXAMPLE.COM --principal=admin/admin@EXAMPLE.COM --keytab=/admin.keytab --admin-server=kdc.example.com ext_keytab --keytab=/alice.keytab alice@EXAMPLE.COM",
+	}, {
+		name:        "delete",
+		query:       kadminQuery{Op: kadminDelete, Principal: "alice@EXAMPLE.COM"},
+		wantMIT:     "-r EXAMPLE.COM -p admin/admin@EXAMPLE.COM -k -t /admin.keytab -s kdc.example.com -q delprinc -force alice@EXAMPLE.COM",
+		wantHeimdal: "--realm=EXAMPLE.COM --principal=admin/admin@EXAMPLE.COM --keytab=/admin.keytab --admin-server=kdc.example.com delete alice@EXAMPLE.COM",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := strings.Join(mitTools{}.kadminArgs(cfg, "EXAMPLE.COM", tc.query), " "); got != tc.wantMIT {
+				t.Errorf("MIT kadmin %s, want %s", got, tc.wantMIT)
+			}
+			if got := strings.Join(heimdalTools{}.kadminArgs(cfg, "EXAMPLE.COM", tc.query), " "); got != tc.wantHeimdal {
+				t.Errorf("Heimdal kadmin %s, want %s", got, tc.wantHeimdal)
+			}
+		})
+	}
+}
+
+func TestKadminOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name                                string
+		tools                               krb5Tools
+		out                                 string
+		wantFailed, wantExists, wantMissing bool
+	}{{
+		name:  "mit success",
+		tools: mitTools{},
+		out:   "Authenticating as principal admin/admin@EXAMPLE.COM with keytab /admin.keytab.\nPrincipal \"alice@EXAMPLE.COM\" created.\n",
+	}, {
+		name:       "mit exists",
+		tools:      mitTools{},
+		out:        "add_principal: Principal or policy already exists while creating \"alice@EXAMPLE.COM\".\n",
+		wantFailed: true,
+		wantExists: true,
+	}, {
+		name:        "mit missing",
+		tools:       mitTools{},
+		out:         "delete_principal: Principal does not exist while deleting principal \"alice@EXAMPLE.COM\"\n",
+		wantFailed:  true,
+		wantMissing: true,
+	}, {
+		name:  "heimdal success",
+		tools: heimdalTools{},
+	}, {
+		name:       "heimdal exists",
+		tools:      heimdalTools{},
+		out:        "kadmin: add: alice@EXAMPLE.COM: Principal or policy already exists\n",
+		wantExists: true,
+	}, {
+		name:        "heimdal missing",
+		tools:       heimdalTools{},
+		out:         "kadmin: delete: alice@EXAMPLE.COM: No such entry in the database\n",
+		wantMissing: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.tools.kadminFailed(tc.out); got != tc.wantFailed {
+				t.Errorf("kadminFailed() = %t, want %t", got, tc.wantFailed)
+			}
+			if got := tc.tools.kadminExists(tc.out); got != tc.wantExists {
+				t.Errorf("kadminExists() = %t, want %t", got, tc.wantExists)
+			}
+			if got := tc.tools.kadminMissing(tc.out); got != tc.wantMissing {
+				t.Errorf("kadminMissing() = %t, want %t", got, tc.wantMissing)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tuminoid/nri-plugins/kerberos-auth/kubeapi"
+)
+
+var (
+	errNotFound = kubeapi.ErrNotFound
+	errGone     = kubeapi.ErrGone
+	errConflict = kubeapi.ErrConflict
+)
+
+// Minimal Kubernetes API client, the one the kubectl plugin shares, with the
+// requests of the plugin.
+type kubeClient struct {
+	*kubeapi.Client
+}
+
+// Create a client from a kubeconfig file, or from the in-cluster service
+// account if path is empty and we run in a pod. Returns nil if neither is available.
+func newKubeClient(path string) (*kubeClient, error) {
+	c, err := kubeapi.New(path)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	return &kubeClient{c}, nil
+}
+
+// Perform a request against the API server, decoding the JSON response into out, if given.
+func (k *kubeClient) do(ctx context.Context, method, path, contentType string, body, out any) error {
+	return k.Do(ctx, method, path, contentType, body, out)
+}
+
+// Get the data of a Secret.
+func (k *kubeClient) getSecretData(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	secret := struct {
+		Data map[string][]byte `json:"data"`
+	}{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, name)
+	if err := k.do(ctx, http.MethodGet, path, "", nil, &secret); err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// Watch event of a collection.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Watch a collection from a resource version, calling fn for each event until
+// the stream ends, the context is cancelled or fn fails.
+func (k *kubeClient) watch(ctx context.Context, path, resourceVersion string, fn func(*watchEvent) error) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	path += sep + "watch=1&allowWatchBookmarks=true&resourceVersion=" + resourceVersion
+	req, err := k.NewRequest(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := k.Stream.Do(req)
+	if err != nil {
+		return fmt.Errorf("watch %s failed: %w", path, err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+		return kubeapi.StatusError(http.MethodGet, path, rsp, data)
+	}
+
+	dec := json.NewDecoder(rsp.Body)
+	for {
+		ev := &watchEvent{}
+		if err := dec.Decode(ev); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("watch %s failed: %w", path, err)
+		}
+		if ev.Type == "ERROR" {
+			status := struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}{}
+			_ = json.Unmarshal(ev.Object, &status)
+			if status.Code == http.StatusGone {
+				return fmt.Errorf("watch %s: %w", path, errGone)
+			}
+			return fmt.Errorf("watch %s failed: %s", path, status.Message)
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
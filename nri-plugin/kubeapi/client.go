@@ -0,0 +1,309 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package kubeapi is the minimal Kubernetes API client of the Kerberos
+// plugin and its kubectl plugin: authenticated JSON requests against the API
+// server of a kubeconfig, or of the in-cluster service account.
+package kubeapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// InClusterTokenFile is the service account token of pods.
+	InClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+var (
+	// ErrNotFound is returned for requests of objects which do not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrGone is returned when a watch must be restarted with a fresh list.
+	ErrGone = errors.New("resource version too old")
+	// ErrConflict is returned for creating objects which exist already.
+	ErrConflict = errors.New("conflict")
+)
+
+// Client of the API server. The plugin runs on the host, outside of any pod,
+// so it normally gets a kubeconfig for a narrowly scoped service account.
+type Client struct {
+	Server    string
+	Token     string
+	TokenFile string
+	HTTP      *http.Client
+	// Same transport without the request timeout, for watches.
+	Stream *http.Client
+	// Namespace of the kubeconfig context, if any.
+	Namespace string
+}
+
+// Subset of the kubeconfig format we need.
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData []byte `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData []byte `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         []byte `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+// New creates a client from a kubeconfig file, or from the in-cluster service
+// account if path is empty and we run in a pod. Returns nil if neither is available.
+func New(path string) (*Client, error) {
+	if path == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, nil
+		}
+		ca, err := os.ReadFile(inClusterCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read in-cluster CA: %w", err)
+		}
+		tlsCfg, err := tlsConfig(ca, false, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		c := &Client{
+			Server:    "https://" + net.JoinHostPort(host, port),
+			TokenFile: InClusterTokenFile,
+			HTTP:      httpClient(tlsCfg),
+		}
+		c.Stream = &http.Client{Transport: c.HTTP.Transport}
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig %q: %w", path, err)
+	}
+	kc := &kubeconfig{}
+	if err := yaml.Unmarshal(data, kc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %q: %w", path, err)
+	}
+
+	var clusterName, userName, namespace string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext || kc.CurrentContext == "" {
+			clusterName, userName, namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			break
+		}
+	}
+
+	c := &Client{Namespace: namespace}
+	var ca, cert, key []byte
+	insecure := false
+	for _, cl := range kc.Clusters {
+		if cl.Name != clusterName {
+			continue
+		}
+		c.Server = strings.TrimSuffix(cl.Cluster.Server, "/")
+		insecure = cl.Cluster.InsecureSkipTLSVerify
+		ca = cl.Cluster.CertificateAuthorityData
+		if len(ca) == 0 && cl.Cluster.CertificateAuthority != "" {
+			if ca, err = os.ReadFile(cl.Cluster.CertificateAuthority); err != nil {
+				return nil, fmt.Errorf("failed to read CA: %w", err)
+			}
+		}
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		c.Token, c.TokenFile = u.User.Token, u.User.TokenFile
+		cert, key = u.User.ClientCertificateData, u.User.ClientKeyData
+		if len(cert) == 0 && u.User.ClientCertificate != "" {
+			if cert, err = os.ReadFile(u.User.ClientCertificate); err != nil {
+				return nil, fmt.Errorf("failed to read client certificate: %w", err)
+			}
+		}
+		if len(key) == 0 && u.User.ClientKey != "" {
+			if key, err = os.ReadFile(u.User.ClientKey); err != nil {
+				return nil, fmt.Errorf("failed to read client key: %w", err)
+			}
+		}
+	}
+	if c.Server == "" {
+		return nil, fmt.Errorf("no cluster for context %q in kubeconfig %q", kc.CurrentContext, path)
+	}
+
+	tlsCfg, err := tlsConfig(ca, insecure, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	c.HTTP = httpClient(tlsCfg)
+	c.Stream = &http.Client{Transport: c.HTTP.Transport}
+
+	return c, nil
+}
+
+func tlsConfig(ca []byte, insecure bool, cert, key []byte) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// #nosec G402:gosec -- only when explicitly requested in the kubeconfig
+		InsecureSkipVerify: insecure,
+	}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("failed to parse Kubernetes API CA")
+		}
+		cfg.RootCAs = pool
+	}
+	if len(cert) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+func httpClient(tlsCfg *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsCfg,
+			Proxy:           http.ProxyFromEnvironment,
+		},
+	}
+}
+
+// NewRequest creates an authenticated request against the API server.
+func (c *Client) NewRequest(ctx context.Context, method, path, contentType string, body any) (*http.Request, error) {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		rd = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	token := c.Token
+	if c.TokenFile != "" {
+		// re-read on each request, projected tokens are rotated
+		data, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req, nil
+}
+
+// Do performs a request against the API server, decoding the JSON response
+// into out, if given.
+func (c *Client) Do(ctx context.Context, method, path, contentType string, body, out any) error {
+	req, err := c.NewRequest(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, 16<<20))
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	if err := StatusError(method, path, rsp, data); err != nil {
+		return err
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to decode response to %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// StatusError turns an unsuccessful API server response into an error.
+func StatusError(method, path string, rsp *http.Response, data []byte) error {
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s %s: %w", method, path, ErrNotFound)
+	case rsp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%s %s: %w", method, path, ErrGone)
+	case rsp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("%s %s: %w", method, path, ErrConflict)
+	case rsp.StatusCode < 200 || rsp.StatusCode > 299:
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(data, &status)
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, rsp.Status, status.Message)
+	}
+	return nil
+}
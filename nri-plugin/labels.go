@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Context of files all containers may use, as for volumes relabeled with :z.
+	defaultSELinuxContext = "system_u:object_r:container_file_t:s0"
+	selinuxEnforceFile    = "/sys/fs/selinux/enforce"
+	selinuxXattr          = "security.selinux"
+)
+
+// SELinux labeling of the pod credential cache directories.
+type selinuxConfig struct {
+	// Context the pod credential cache directories and the files in them are
+	// labeled with on nodes enforcing SELinux, container_file_t by default.
+	Context string `json:"context,omitempty"`
+}
+
+func (c *selinuxConfig) context() string {
+	if c.Context != "" {
+		return c.Context
+	}
+	return defaultSELinuxContext
+}
+
+// AppArmor rules for the mounts of the containers.
+type appArmorConfig struct {
+	// Path to write an AppArmor abstraction to at startup, allowing access to
+	// the credential cache, krb5.conf and sockets mounted into containers, as
+	// /etc/apparmor.d/abstractions/nri-kerberos. None is written if empty.
+	Abstraction string `json:"abstraction,omitempty"`
+}
+
+// Whether the node enforces SELinux.
+var selinuxEnforcing = sync.OnceValue(func() bool {
+	data, err := os.ReadFile(selinuxEnforceFile)
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+})
+
+// Label a pod credential cache directory and the files in it for the
+// containers on nodes enforcing SELinux, which would otherwise be denied
+// access to their tickets by the label inherited from the host directory.
+func (c *selinuxConfig) labelDir(dir string) error {
+	if !selinuxEnforcing() {
+		return nil
+	}
+	label := []byte(c.context())
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(path, selinuxXattr, label, 0); err != nil {
+			return fmt.Errorf("failed to label %s %s: %w", path, c.context(), err)
+		}
+		return nil
+	})
+}
+
+// AppArmor path pattern of a container path, matching both /run and /var/run,
+// which is mostly a link to it.
+func appArmorPath(path string) string {
+	for _, prefix := range []string{"/var/run/", "/run/"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			return "/{,var/}run/" + rest
+		}
+	}
+	return path
+}
+
+// Write the AppArmor abstraction for profiles of containers to include.
+func (p *plugin) writeAppArmorAbstraction(cfg *config) error {
+	mount := appArmorPath(strings.TrimSuffix(p.ccacheMountPath(), "/"))
+	rules := []string{
+		"# Written by the Kerberos auth NRI plugin, for profiles of containers",
+		"# given Kerberos credentials to include.",
+		"",
+		mount + "/ r,",
+		mount + "/** rwkl,",
+		krb5ConfMountPath + " r,",
+		appArmorPath(p.kcmSocket()) + " rw,",
+	}
+	if cfg.GSSProxy.Enabled {
+		rules = append(rules, appArmorPath(cfg.GSSProxy.socket())+" rw,")
+	}
+	path := cfg.AppArmor.Abstraction
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// #nosec G306:gosec -- AppArmor abstractions are read by the parser as any other
+	return os.WriteFile(path, []byte(strings.Join(rules, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,237 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultLeaseName = "nri-kerberos-controller"
+
+	leasePathFormat = "/apis/coordination.k8s.io/v1/namespaces/%s/leases"
+	// Time a lease is held without renewal, the time left to renew it before
+	// giving up leadership, and the interval of the attempts, as client-go
+	// uses by default.
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+	leaseRetryPeriod   = 2 * time.Second
+
+	// Timestamps of leases, metav1.MicroTime.
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Lease of coordination.k8s.io/v1, with the fields leader election uses.
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string     `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int        `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          *microTime `json:"acquireTime,omitempty"`
+		RenewTime            *microTime `json:"renewTime,omitempty"`
+		LeaseTransitions     int        `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+type microTime struct {
+	time.Time
+}
+
+func (t microTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(microTimeFormat))
+}
+
+func (t *microTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q: %w", s, err)
+	}
+	t.Time = v
+	return nil
+}
+
+// Leader election among the controller replicas with a Lease, so that only
+// one of them reconciles at a time and the others stand by.
+type leaderElector struct {
+	kube      *kubeClient
+	namespace string
+	name      string
+	identity  string
+
+	// Holder and renewal last seen on the lease, and when by our clock, so
+	// that expiry does not depend on the clock of the holder.
+	observedHolder string
+	observedRenew  time.Time
+	observedAt     time.Time
+}
+
+// Run fn while holding the lease, until the context is cancelled. Losing the
+// lease cancels the context of fn, which is run again once the lease is held
+// again. The lease is released on return, for a standby to take over at once.
+func (e *leaderElector) run(ctx context.Context, fn func(context.Context)) {
+	for {
+		if !e.acquire(ctx) {
+			return
+		}
+		log.Infof("acquired lease %s/%s as %s, leading", e.namespace, e.name, e.identity)
+		lctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			fn(lctx)
+		}()
+		e.hold(ctx)
+		cancel()
+		<-done
+		if ctx.Err() != nil {
+			e.release()
+			return
+		}
+		log.Warnf("lost lease %s/%s, standing by", e.namespace, e.name)
+	}
+}
+
+// Try to take the lease until it is held, false if the context was cancelled first.
+func (e *leaderElector) acquire(ctx context.Context) bool {
+	for {
+		held, err := e.tryAcquireOrRenew(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("failed to acquire lease %s/%s: %v", e.namespace, e.name, err)
+		}
+		if held {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(leaseRetryPeriod):
+		}
+	}
+}
+
+// Renew the lease until it is lost, by another replica taking it or renewal
+// failing for longer than the renew deadline, or the context is cancelled.
+func (e *leaderElector) hold(ctx context.Context) {
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaseRetryPeriod):
+		}
+		held, err := e.tryAcquireOrRenew(ctx)
+		switch {
+		case held:
+			renewed = time.Now()
+		case err == nil:
+			return
+		case ctx.Err() != nil:
+			return
+		default:
+			log.Errorf("failed to renew lease %s/%s: %v", e.namespace, e.name, err)
+			if time.Since(renewed) > leaseRenewDeadline {
+				return
+			}
+		}
+	}
+}
+
+// Take or renew the lease, unless another replica holds it and has renewed it
+// within its duration. Conflicting updates by others lose it.
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+	path := fmt.Sprintf(leasePathFormat, e.namespace)
+	l := &lease{}
+	err := e.kube.do(ctx, http.MethodGet, path+"/"+e.name, "", nil, l)
+	if errors.Is(err, errNotFound) {
+		l = &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		l.Metadata.Name, l.Metadata.Namespace = e.name, e.namespace
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+		l.Spec.AcquireTime, l.Spec.RenewTime = &microTime{now}, &microTime{now}
+		err = e.kube.do(ctx, http.MethodPost, path, "", l, nil)
+		if errors.Is(err, errConflict) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := l.Spec.HolderIdentity
+	var renew time.Time
+	if l.Spec.RenewTime != nil {
+		renew = l.Spec.RenewTime.Time
+	}
+	if holder != e.observedHolder || !renew.Equal(e.observedRenew) {
+		e.observedHolder, e.observedRenew, e.observedAt = holder, renew, now
+	}
+	validFor := time.Duration(l.Spec.LeaseDurationSeconds) * time.Second
+	if holder != "" && holder != e.identity && now.Before(e.observedAt.Add(validFor)) {
+		return false, nil
+	}
+
+	if holder != e.identity {
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.AcquireTime = &microTime{now}
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+	l.Spec.RenewTime = &microTime{now}
+	err = e.kube.do(ctx, http.MethodPut, path+"/"+e.name, "", l, nil)
+	if errors.Is(err, errConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e.observedHolder, e.observedRenew, e.observedAt = e.identity, now, now
+	return true, nil
+}
+
+// Give up the lease, if still held.
+func (e *leaderElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRetryPeriod)
+	defer cancel()
+	path := fmt.Sprintf(leasePathFormat+"/%s", e.namespace, e.name)
+	l := &lease{}
+	if err := e.kube.do(ctx, http.MethodGet, path, "", nil, l); err != nil || l.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	l.Spec.RenewTime = &microTime{time.Now()}
+	if err := e.kube.do(ctx, http.MethodPut, path, "", l, nil); err != nil {
+		log.Warnf("failed to release lease %s/%s: %v", e.namespace, e.name, err)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotations asking for the ticket lifetime and the renewable lifetime of the
+// TGT of a pod, as 8h or 30d.
+const (
+	ticketLifetimeAnnotation = "kerberos-ticket-lifetime"
+	renewLifetimeAnnotation  = "kerberos-renew-lifetime"
+)
+
+// Lifetimes more than this apart from the ones asked for count as clamped by
+// the KDC, rather than shortened by the time the exchange took.
+const lifetimeSlack = time.Minute
+
+// Parse a lifetime: a Go duration, or a number of days as 30d.
+func parseLifetime(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if days, ok := strings.CutSuffix(v, "d"); ok && err != nil {
+		var n uint64
+		if n, err = strconv.ParseUint(days, 10, 16); err == nil {
+			d = time.Duration(n) * 24 * time.Hour
+		}
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q must be a positive duration, as 8h or 30d", v)
+	}
+	return d, nil
+}
+
+// Lifetimes asked for by the annotations of a pod, clamped to the maximums of
+// the node; 0 for those not annotated.
+func (c *krb5ConfConfig) requestedLifetimes(ticket, renew string) (time.Duration, time.Duration, error) {
+	var lifetimes [2]time.Duration
+	for i, v := range []string{ticket, renew} {
+		if v == "" {
+			continue
+		}
+		d, err := parseLifetime(v)
+		if err != nil {
+			return 0, 0, err
+		}
+		limit := []duration{c.MaxTicketLifetime, c.MaxRenewLifetime}[i]
+		if limit.Duration > 0 && d > limit.Duration {
+			d = limit.Duration
+		}
+		lifetimes[i] = d
+	}
+	return lifetimes[0], lifetimes[1], nil
+}
+
+// Ticket and renewable lifetimes asked for from the KDC for the workload: the
+// ones of the pod, or else those of the node, 0 for the default of the KDC and
+// defaultRenewLifetime respectively.
+func (kp *kerberosParams) lifetimes() (ticket, renew time.Duration) {
+	if kp.Krb5Conf != nil {
+		ticket, renew = kp.Krb5Conf.TicketLifetime.Duration, kp.Krb5Conf.RenewLifetime.Duration
+	}
+	if kp.TicketLifetime > 0 {
+		ticket = kp.TicketLifetime
+	}
+	if kp.RenewLifetime > 0 {
+		renew = kp.RenewLifetime
+	}
+	return ticket, renew
+}
+
+// Ticket and renewable lifetimes the KDC granted a TGT, the latter from the
+// initial authentication, so that renewals do not shorten it, and 0 for TGTs
+// which are not renewable.
+func (t *ticketTimes) lifetimes() (ticket, renew time.Duration) {
+	ticket = t.end.Sub(t.start)
+	if !t.renewTill.IsZero() {
+		renew = t.renewTill.Sub(t.auth)
+	}
+	return ticket, renew
+}
+
+// Describe the lifetimes asked for by the pod the KDC granted less of, empty
+// if it granted them or the pod asked for none.
+func clampedLifetimes(kp *kerberosParams) string {
+	if kp.TicketLifetime == 0 && kp.RenewLifetime == 0 {
+		return ""
+	}
+	t, err := ccacheTimes(kp.CCName, kp.Realm)
+	if err != nil {
+		return ""
+	}
+	ticket, renew := t.lifetimes()
+	var clamped []string
+	if kp.TicketLifetime > 0 && ticket < kp.TicketLifetime-lifetimeSlack {
+		clamped = append(clamped, fmt.Sprintf("ticket lifetime %s of %s", ticket.Round(time.Second), kp.TicketLifetime))
+	}
+	if kp.RenewLifetime > 0 && renew < kp.RenewLifetime-lifetimeSlack {
+		clamped = append(clamped, fmt.Sprintf("renewable lifetime %s of %s", renew.Round(time.Second), kp.RenewLifetime))
+	}
+	return strings.Join(clamped, ", ")
+}
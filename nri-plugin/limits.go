@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Returned when setting up credentials for a pod would take the node over a limit.
+var errLimitExceeded = errors.New("node limit exceeded")
+
+// Limits of the credentials managed on the node.
+type limitsConfig struct {
+	// Distinct principals with managed credentials, unlimited if 0.
+	MaxPrincipals int `json:"maxPrincipals,omitempty"`
+	// Bytes in the pod credential cache directory, unlimited if 0.
+	MaxCCacheBytes int64 `json:"maxCCacheBytes,omitempty"`
+}
+
+// Check that the node has room for the credentials of a pod within the
+// limits, evicting expired managed credentials, least recently used first, to
+// make room.
+func (p *plugin) enforceLimits(l *logrus.Entry, cfg *config, kp *kerberosParams) error {
+	limits := cfg.Limits
+	if limits.MaxPrincipals > 0 {
+		fits := func() bool {
+			n, known := p.managedPrincipals(kp.Principal())
+			return known || n < limits.MaxPrincipals
+		}
+		if !p.makeRoom(l, "principals", fits) {
+			limitRejections.WithLabelValues("principals").Inc()
+			n, _ := p.managedPrincipals(kp.Principal())
+			return fmt.Errorf("%w: %d principals have managed credentials on the node, at most %d allowed",
+				errLimitExceeded, n, limits.MaxPrincipals)
+		}
+	}
+	if limits.MaxCCacheBytes > 0 {
+		fits := func() bool { return p.ccacheBytes() < limits.MaxCCacheBytes }
+		if !p.makeRoom(l, "ccache_bytes", fits) {
+			limitRejections.WithLabelValues("ccache_bytes").Inc()
+			return fmt.Errorf("%w: pod credential caches take %d bytes, at most %d allowed",
+				errLimitExceeded, p.ccacheBytes(), limits.MaxCCacheBytes)
+		}
+	}
+	return nil
+}
+
+// Number of distinct principals with managed credentials, and whether the
+// principal is one of them.
+func (p *plugin) managedPrincipals(principal string) (int, bool) {
+	p.Lock()
+	defer p.Unlock()
+	principals := map[string]bool{}
+	for _, mc := range p.managed {
+		principals[mc.params.Principal()] = true
+	}
+	return len(principals), principals[principal]
+}
+
+// Evict managed credentials whose TGT expired, least recently used first,
+// until the limit fits, returning whether it does.
+func (p *plugin) makeRoom(l *logrus.Entry, limit string, fits func() bool) bool {
+	if fits() {
+		return true
+	}
+
+	type candidate struct {
+		key  string
+		mc   *managedCache
+		used time.Time
+	}
+	var candidates []candidate
+	p.Lock()
+	for key, mc := range p.managed {
+		candidates = append(candidates, candidate{key, mc, mc.used})
+	}
+	p.Unlock()
+	slices.SortFunc(candidates, func(a, b candidate) int { return a.used.Compare(b.used) })
+
+	for _, c := range candidates {
+		if _, err := ccachePath(c.mc.params.CCName); err != nil {
+			// expiry is only known of FILE caches
+			continue
+		}
+		if checkCCache(c.mc.params.CCName, c.mc.params.Realm, p.clock.Now()) == nil {
+			continue
+		}
+		l.Infof("evicting expired credentials for %s of pod %s/%s for the %s limit",
+			c.mc.params.Principal(), c.mc.pod.GetNamespace(), c.mc.pod.GetName(), limit)
+		p.evict(c.key, c.mc)
+		limitEvictions.WithLabelValues(limit).Inc()
+		if fits() {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop managing expired credentials and remove what was published of them to
+// the pod, leaving the directory its containers mount.
+func (p *plugin) evict(key string, mc *managedCache) {
+	p.releaseCache(key)
+	if mc.pod.GetUid() != "" && !mc.params.secondary() {
+		dir := p.ccacheDirOf(mc.pod, mc.params)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				mc.log.Error(err)
+			}
+		}
+	}
+	p.events.warn(mc.pod, reasonLimitExceeded, "expired credentials for %s evicted to make room for another pod within the node limits",
+		mc.params.Principal())
+}
+
+// Bytes in the files under a directory.
+// Bytes in the pod credential cache directories.
+func (p *plugin) ccacheBytes() int64 {
+	if p.config().CCacheDirLayout != ccacheLayoutKubelet {
+		return dirSize(p.ccacheDir())
+	}
+	var size int64
+	for dir := range p.podCCacheDirs() {
+		size += dirSize(dir)
+	}
+	return size
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,202 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	defaultLogMaxSize    = 100
+	defaultLogMaxBackups = 5
+)
+
+// Subsystems entries are tagged with in the subsystem field, each of which
+// may log at a level of its own: the NRI event handlers, obtaining and
+// renewing tickets with the KDC, NFS mounts, and scheduled renewals.
+const (
+	subsystemField = "subsystem"
+	subsystemNRI   = "nri"
+	subsystemKrb   = "krb"
+	subsystemMount = "mount"
+	subsystemRenew = "renew"
+)
+
+var subsystems = []string{subsystemNRI, subsystemKrb, subsystemMount, subsystemRenew}
+
+// Logging options, registered on the flag set of every subcommand.
+type logOptions struct {
+	level  string
+	format string
+	// Levels of subsystems, as nri=debug,krb=info.
+	levels string
+	// File to log to instead of stderr, rotated at maxSize MB.
+	file       string
+	maxSize    int
+	maxBackups int
+	// Keys whose values are masked, see redactor.
+	redact           string
+	redactPrincipals bool
+}
+
+func (o *logOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.level, "log-level", "info", "log level: trace, debug, info, warn or error")
+	fs.StringVar(&o.format, "log-format", logFormatText, "log format: text or json")
+	fs.StringVar(&o.levels, "log-levels", "", "comma separated log levels of subsystems, as nri=debug,krb=info; subsystems are "+strings.Join(subsystems, ", "))
+	fs.StringVar(&o.file, "log-file", "", "file to log to instead of stderr, e.g. /var/log/nri-kerberos/plugin.log")
+	fs.IntVar(&o.maxSize, "log-max-size", defaultLogMaxSize, "size in MB at which the log file is rotated")
+	fs.IntVar(&o.maxBackups, "log-max-backups", defaultLogMaxBackups, "rotated log files kept")
+	fs.StringVar(&o.redact, "log-redact", defaultRedactKeys, "comma separated keys, with * wildcards, whose values are masked in logs, empty to mask none")
+	fs.BoolVar(&o.redactPrincipals, "log-redact-principals", false, "replace principal names in logs with a hash of them")
+}
+
+// Set up the logger with the options.
+func (o *logOptions) apply() error {
+	level, err := logrus.ParseLevel(o.level)
+	if err != nil {
+		return err
+	}
+	levels, err := parseSubsystemLevels(o.levels)
+	if err != nil {
+		return fmt.Errorf("log-levels: %w", err)
+	}
+	var formatter logrus.Formatter
+	switch o.format {
+	case logFormatText:
+		formatter = &logrus.TextFormatter{
+			PadLevelText: true,
+		}
+	case logFormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q", o.format)
+	}
+	if len(levels) > 0 {
+		// log at the most verbose level and leave out the rest when formatting
+		formatter = &subsystemFilter{Formatter: formatter, level: level, levels: levels}
+		for _, l := range levels {
+			level = max(level, l)
+		}
+	}
+	log.SetFormatter(formatter)
+	log.SetLevel(level)
+	if o.file != "" {
+		if o.maxSize <= 0 || o.maxBackups < 0 {
+			return fmt.Errorf("invalid log-max-size %d or log-max-backups %d", o.maxSize, o.maxBackups)
+		}
+		f, err := openRotatingFile(o.file, int64(o.maxSize)<<20, o.maxBackups)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	r, err := newRedactor(o.redact, o.redactPrincipals)
+	if err != nil {
+		return fmt.Errorf("log-redact: %w", err)
+	}
+	log.AddHook(r)
+	return nil
+}
+
+// Levels of subsystems, as nri=debug,krb=info.
+func parseSubsystemLevels(s string) (map[string]logrus.Level, error) {
+	levels := map[string]logrus.Level{}
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(kv, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !slices.Contains(subsystems, name) {
+			return nil, fmt.Errorf("%q is not subsystem=level with subsystem one of %s", kv, strings.Join(subsystems, ", "))
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+// Formatter leaving out the entries above the level of their subsystem, or of
+// the logger for entries of none.
+type subsystemFilter struct {
+	logrus.Formatter
+	level  logrus.Level
+	levels map[string]logrus.Level
+}
+
+func (f *subsystemFilter) Format(e *logrus.Entry) ([]byte, error) {
+	level := f.level
+	if s, ok := e.Data[subsystemField].(string); ok {
+		if l, ok := f.levels[s]; ok {
+			level = l
+		}
+	}
+	if e.Level > level {
+		return nil, nil
+	}
+	return f.Formatter.Format(e)
+}
+
+// Logger tagged with a subsystem.
+func subsystemLogger(l *logrus.Entry, subsystem string) *logrus.Entry {
+	return l.WithField(subsystemField, subsystem)
+}
+
+// Logger for a pod, with fields identifying it for log aggregation.
+func podLogger(pod *api.PodSandbox) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		"namespace":    pod.GetNamespace(),
+		"pod":          pod.GetName(),
+		subsystemField: subsystemNRI,
+	})
+}
+
+// Logger for a container, with fields identifying it for log aggregation.
+func containerLogger(pod *api.PodSandbox, container *api.Container) *logrus.Entry {
+	if pod == nil {
+		return subsystemLogger(log.WithField("container", container.GetName()), subsystemNRI)
+	}
+	return podLogger(pod).WithField("container", container.GetName())
+}
+
+type loggerKey struct{}
+
+// Attach a logger to the context, for code deeper down to log with.
+func withLogger(ctx context.Context, l *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Get the logger attached to the context, or the plain logger.
+func loggerFrom(ctx context.Context) *logrus.Entry {
+	if l, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return l
+	}
+	return logrus.NewEntry(log)
+}
@@ -0,0 +1,350 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	kinitAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "kinit_attempts_total",
+		Help:      "Initial credential acquisitions attempted.",
+	}, []string{"realm"})
+	kinitSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "kinit_successes_total",
+		Help:      "Initial credential acquisitions succeeded.",
+	}, []string{"realm"})
+	kinitFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "kinit_failures_total",
+		Help:      "Initial credential acquisitions failed, by failure class.",
+	}, []string{"realm", "reason"})
+	renewalDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nri_kerberos",
+		Name:      "renewal_duration_seconds",
+		Help:      "Latency of credential renewals.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"realm", "result"})
+	scriptDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nri_kerberos",
+		Name:      "hook_script_duration_seconds",
+		Help:      "Run time of the hook script.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"mode", "result"})
+	managedTickets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "managed_tickets",
+		Help:      "Pods with credentials currently managed on this node.",
+	})
+	gssdRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "gssd_running",
+		Help:      "Whether rpc.gssd was running at the last check, when managed.",
+	})
+	nodeReady = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "node_ready",
+		Help:      "Whether the prerequisites of Kerberos workloads of the node were usable at the last check, when nodeCondition is enabled.",
+	})
+	gssdRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "gssd_restarts_total",
+		Help:      "Restarts of rpc.gssd by the plugin.",
+	}, []string{"result"})
+	nfsRemounts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "nfs_remounts_total",
+		Help:      "Remounts of lost or stale NFS volumes of pods by the plugin.",
+	}, []string{"result"})
+	keytabRotations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "keytab_rotations_total",
+		Help:      "Credentials obtained afresh after their keytab was rotated.",
+	}, []string{"result"})
+	gmsaRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "gmsa_refreshes_total",
+		Help:      "Credentials of managed service accounts obtained afresh with their next password.",
+	}, []string{"result"})
+	ephemeralOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "ephemeral_principals_total",
+		Help:      "Ephemeral principals created and deleted, by operation.",
+	}, []string{"op", "result"})
+	ccacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "ccache_hits_total",
+		Help:      "Setups skipped for credentials already set up and still valid, by realm.",
+	}, []string{"realm"})
+	credentialShares = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "credential_shares_total",
+		Help:      "Setups given the credentials of another pod of the principal, by realm.",
+	}, []string{"realm"})
+	containerRebinds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "container_rebinds_total",
+		Help:      "Containers created again in their sandbox and bound to its credentials again, by outcome: reused, refreshed or failed.",
+	}, []string{"outcome"})
+	setupResultHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "setup_result_hits_total",
+		Help:      "Setups and NFS export checks skipped for containers created again, by kind: setup for failed setups not retried yet, exports for exports found before.",
+	}, []string{"kind"})
+	breakerTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "principal_breaker_trips_total",
+		Help:      "Circuits of failing principals opened, by realm and failure class.",
+	}, []string{"realm", "reason"})
+	breakerShortCircuits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "principal_breaker_short_circuits_total",
+		Help:      "Setups failed at once as their principal keeps failing, by realm.",
+	}, []string{"realm"})
+	checkpointRestores = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "checkpoint_restores_total",
+		Help:      "Credentials replaced for containers restored from a checkpoint, by action and result.",
+	}, []string{"action", "result"})
+	dryRunActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "dry_run_actions_total",
+		Help:      "Actions not taken in dry-run mode, by action: setup, inject, rewrite, deny or fail.",
+	}, []string{"action"})
+	sweptDirs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "swept_dirs_total",
+		Help:      "Orphaned pod credential cache and keytab directories removed, by kind.",
+	}, []string{"kind", "result"})
+	leakedState = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "leaked_state_total",
+		Help:      "State of pods found left behind by sweeps, by kind: credentials of pods gone, or caches not destroyed, and result of cleaning it up.",
+	}, []string{"kind", "result"})
+	limitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "limit_rejections_total",
+		Help:      "Pods not set up for being over a node limit, by limit.",
+	}, []string{"limit"})
+	limitEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "limit_evictions_total",
+		Help:      "Expired credentials evicted to make room within a node limit, by limit.",
+	}, []string{"limit"})
+	policyDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "policy_denials_total",
+		Help:      "Pods denied credentials by the node policy, by namespace.",
+	}, []string{"namespace"})
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "retries_total",
+		Help:      "Retries after transient failures, by operation.",
+	}, []string{"op"})
+	kdcClockOffset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "kdc_clock_offset_seconds",
+		Help:      "Offset of the KDC clock from the node clock, measured after clock skew failures, by realm.",
+	}, []string{"realm"})
+	runtimeInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "runtime_info",
+		Help:      "Container runtime the plugin is connected to, 1 by name and version.",
+	}, []string{"runtime", "version"})
+	kdcQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "kdc_queue_depth",
+		Help:      "Setups and renewals waiting for the KDC rate limit, by realm.",
+	}, []string{"realm"})
+	qosQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "qos_queue_depth",
+		Help:      "Setups and renewals waiting for a slot of maxParallelSetups, by QoS class.",
+	}, []string{"class"})
+	runtimeReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "runtime_reconnects_total",
+		Help:      "Attempts to connect to the runtime again after losing the NRI connection.",
+	})
+	ticketExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "ticket_expiry_seconds",
+		Help:      "Time left of the TGT of managed credentials, 0 once expired, with expiryAlerts.",
+	}, []string{"namespace", "pod", "container", "principal"})
+	ticketExpiryAlerts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "ticket_expiry_alerts_total",
+		Help:      "Managed tickets whose time left dropped below the expiry alert threshold, by realm.",
+	}, []string{"realm"})
+	nfsMountBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "nfs_mount_bytes",
+		Help:      "Bytes read and written by pods on their NFS mounts since mounted, with mountStats.",
+	}, []string{"namespace", "pod", "container", "mount", "direction"})
+	nfsMountRPCs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "nfs_mount_rpcs",
+		Help:      "RPCs of the NFS mounts of pods since mounted, by kind: ops, retransmissions, timeouts or errors, with mountStats.",
+	}, []string{"namespace", "pod", "container", "mount", "kind"})
+	gssContextExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "gss_context_expiry_seconds",
+		Help:      "Time left of the NFS service tickets the GSS contexts of pods are established with, 0 once expired, with mountStats.",
+	}, []string{"namespace", "pod", "container", "service"})
+	remediations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "remediations_total",
+		Help:      "Losses of managed credentials remediated, by realm and failure reason.",
+	}, []string{"realm", "reason"})
+	helperRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "helper_runs_total",
+		Help:      "Runs of external helper commands.",
+	}, []string{"helper", "result"})
+	helperCPUSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "helper_cpu_seconds_total",
+		Help:      "User and system CPU time used by external helper commands.",
+	}, []string{"helper"})
+	helperMemory = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nri_kerberos",
+		Name:      "helper_max_rss_bytes",
+		Help:      "Peak resident memory of external helper commands.",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 2, 10),
+	}, []string{"helper"})
+	helpersRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nri_kerberos",
+		Name:      "helpers_running",
+		Help:      "External helper commands running.",
+	})
+	helperWaits = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "nri_kerberos",
+		Name:      "helper_wait_seconds",
+		Help:      "Time external helper commands waited for one of helpers.maxParallel to finish.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	helperOOMKills = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "helper_oom_kills_total",
+		Help:      "Helper processes killed for exceeding the memory of the helper cgroup.",
+	})
+	instanceCollisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "instance_collisions_total",
+		Help:      "Starts finding another instance of the plugin managing the pods of the node.",
+	})
+	prestagedSetups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nri_kerberos",
+		Name:      "prestaged_setups_total",
+		Help:      "Credentials obtained for pods before their sandbox was created.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(kinitAttempts, kinitSuccesses, kinitFailures,
+		renewalDuration, scriptDuration, managedTickets, gssdRunning, nodeReady, gssdRestarts, nfsRemounts, keytabRotations, gmsaRefreshes,
+		ephemeralOps, prestagedSetups, kdcClockOffset, retries, ccacheHits, credentialShares, qosQueueDepth, breakerTrips, breakerShortCircuits, containerRebinds, setupResultHits, checkpointRestores, dryRunActions, sweptDirs, leakedState,
+		limitRejections, limitEvictions, policyDenials, runtimeInfo, runtimeReconnects, kdcQueueDepth,
+		ticketExpiry, ticketExpiryAlerts, nfsMountBytes, nfsMountRPCs, gssContextExpiry, remediations,
+		helperRuns, helperCPUSeconds, helperMemory, helpersRunning, helperWaits, helperOOMKills, instanceCollisions)
+}
+
+// Backend wrapper recording metrics and trace spans of credential operations.
+type instrumentedBackend struct {
+	KerberosBackend
+}
+
+func (b *instrumentedBackend) Setup(ctx context.Context, kp *kerberosParams) (err error) {
+	ctx, span := tracer.Start(ctx, "kinit", principalAttributes(kp))
+	defer func() { endSpan(span, err) }()
+
+	kinitAttempts.WithLabelValues(kp.Realm).Inc()
+	ctx = withLogger(ctx, subsystemLogger(loggerFrom(ctx), subsystemKrb))
+	err = b.KerberosBackend.Setup(ctx, kp)
+	if err != nil {
+		kinitFailures.WithLabelValues(kp.Realm, failureReason(err)).Inc()
+		return err
+	}
+	kinitSuccesses.WithLabelValues(kp.Realm).Inc()
+	return nil
+}
+
+func (b *instrumentedBackend) Renew(ctx context.Context, kp *kerberosParams) (err error) {
+	ctx, span := tracer.Start(ctx, "renew", principalAttributes(kp))
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	ctx = withLogger(ctx, subsystemLogger(loggerFrom(ctx), subsystemKrb))
+	err = b.KerberosBackend.Renew(ctx, kp)
+	renewalDuration.WithLabelValues(kp.Realm, result(err)).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// Metric label for the failure class of an error.
+func failureReason(err error) string {
+	for _, c := range []struct {
+		err    error
+		reason string
+	}{
+		{errNameResolution, "dns_failed"},
+		{errNetworkBlocked, "network_blocked"},
+		{errPortClosed, "port_closed"},
+		{errProxyInterference, "proxy_interference"},
+		{errTrustFailed, "trust_failed"},
+		{errDelegationRefused, "delegation_refused"},
+		{errKeytabUnavailable, "keytab_unavailable"},
+		{errKeytabMismatch, "keytab_mismatch"},
+		{errKDCUnreachable, "kdc_unreachable"},
+		{errPrincipalUnknown, "principal_unknown"},
+		{errPrincipalRevoked, "principal_revoked"},
+		{errPreauthFailed, "preauth_failed"},
+		{errPasswordExpired, "password_expired"},
+		{errKDCRejected, "kdc_rejected"},
+		{errCCacheFailed, "ccache_failed"},
+		{errClockSkew, "clock_skew"},
+		{errNFSVersion, "nfs_version_unsupported"},
+		{errNFSUnreachable, "nfs_unreachable"},
+		{errMountDenied, "mount_denied"},
+		{errMountCredentials, "mount_credentials_rejected"},
+		{errMountTimeout, "mount_timeout"},
+		{errMountNotPermitted, "mount_not_permitted"},
+		{errMountNotExported, "export_not_found"},
+		{errMountOptions, "mount_options_invalid"},
+		{errLimitExceeded, "limit_exceeded"},
+		{errPolicyDenied, "policy_denied"},
+		{context.DeadlineExceeded, "timeout"},
+	} {
+		if errors.Is(err, c.err) {
+			return c.reason
+		}
+	}
+	return "other"
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,206 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Classes of NFS mount failures, from the errno of mount(2), usable with
+// errors.Is. A server which cannot be reached at all is errNFSUnreachable and
+// one not speaking the NFS version asked for errNFSVersion, as for the
+// preflight and version probes.
+var (
+	// The server refused the credentials or the client host, as with no
+	// ticket for the security flavor or an export not to the node.
+	errMountDenied = errors.New("NFS server denied access")
+	// The credentials of the mount expired or were rejected by the server.
+	errMountCredentials = errors.New("NFS mount credentials rejected")
+	errMountTimeout     = errors.New("NFS mount timed out")
+	// The plugin may not mount, as without CAP_SYS_ADMIN, or the server
+	// refused the operation.
+	errMountNotPermitted = errors.New("NFS mount not permitted")
+	errMountNotExported  = errors.New("NFS export not found")
+	errMountOptions      = errors.New("invalid NFS mount options")
+)
+
+// Wrap an error of mount(2) with the matching failure class.
+func classifyMountError(err error) error {
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	var class error
+	switch errno {
+	case unix.EACCES:
+		class = errMountDenied
+	case unix.EKEYEXPIRED, unix.EKEYREJECTED:
+		class = errMountCredentials
+	case unix.ETIMEDOUT:
+		class = errMountTimeout
+	case unix.EPERM:
+		class = errMountNotPermitted
+	case unix.ENOENT:
+		class = errMountNotExported
+	case unix.ECONNREFUSED, unix.EHOSTUNREACH, unix.ENETUNREACH, unix.EHOSTDOWN:
+		class = errNFSUnreachable
+	case unix.EPROTONOSUPPORT:
+		class = errNFSVersion
+	case unix.EINVAL:
+		class = errMountOptions
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", class, err)
+}
+
+// Mount flags of the generic mount options, the rest being passed to the
+// file system. Those only meaning something to mount(8) or fstab are dropped.
+var mountFlags = map[string]struct {
+	set, clear uintptr
+}{
+	"ro":          {set: unix.MS_RDONLY},
+	"rw":          {clear: unix.MS_RDONLY},
+	"nosuid":      {set: unix.MS_NOSUID},
+	"suid":        {clear: unix.MS_NOSUID},
+	"nodev":       {set: unix.MS_NODEV},
+	"dev":         {clear: unix.MS_NODEV},
+	"noexec":      {set: unix.MS_NOEXEC},
+	"exec":        {clear: unix.MS_NOEXEC},
+	"sync":        {set: unix.MS_SYNCHRONOUS},
+	"async":       {clear: unix.MS_SYNCHRONOUS},
+	"noatime":     {set: unix.MS_NOATIME},
+	"atime":       {clear: unix.MS_NOATIME},
+	"nodiratime":  {set: unix.MS_NODIRATIME},
+	"diratime":    {clear: unix.MS_NODIRATIME},
+	"relatime":    {set: unix.MS_RELATIME},
+	"norelatime":  {clear: unix.MS_RELATIME},
+	"strictatime": {set: unix.MS_STRICTATIME},
+	"remount":     {set: unix.MS_REMOUNT},
+	"bind":        {set: unix.MS_BIND},
+	"rbind":       {set: unix.MS_BIND | unix.MS_REC},
+	"defaults":    {},
+	"auto":        {},
+	"noauto":      {},
+	"nofail":      {},
+	"_netdev":     {},
+	"user":        {},
+	"nouser":      {},
+}
+
+// Split mount options into the flags of mount(2) and the data passed to the
+// file system.
+func mountData(options []string) (uintptr, []string) {
+	var flags uintptr
+	var data []string
+	for _, o := range options {
+		if f, ok := mountFlags[o]; ok {
+			flags = flags&^f.clear | f.set
+			continue
+		}
+		data = append(data, o)
+	}
+	return flags, data
+}
+
+// Value of an option of the data of a mount, and whether it is there.
+func mountOption(data []string, name string) (string, bool) {
+	for _, o := range data {
+		if k, v, _ := strings.Cut(o, "="); k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Add the server address the kernel needs to the data of an NFS mount, and
+// for NFSv4 the address of the node the server calls back, which mount.nfs
+// would otherwise resolve. The address is of the family of the transport; an
+// addr given is kept.
+func nfsMountAddresses(ctx context.Context, host string, data []string) ([]string, error) {
+	if _, ok := mountOption(data, "addr"); ok {
+		return data, nil
+	}
+	addrs, err := resolverFor(host).LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errNFSUnreachable, host, err)
+	}
+	proto, _ := mountOption(data, "proto")
+	var addr net.IP
+	for _, a := range addrs {
+		if (a.IP.To4() == nil) == strings.HasSuffix(proto, "6") || proto == "" {
+			addr = a.IP
+			break
+		}
+	}
+	if addr == nil {
+		return nil, fmt.Errorf("%w: %s has no address for transport %s", errNFSUnreachable, host, proto)
+	}
+	data = append(data, "addr="+addr.String())
+
+	vers, _ := mountOption(data, "vers")
+	if _, ok := mountOption(data, "clientaddr"); !ok && vers != "2" && vers != "3" {
+		// The local address routing to the server, connecting a UDP socket
+		// sending nothing.
+		conn, err := net.Dial("udp", net.JoinHostPort(addr.String(), "2049"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errNFSUnreachable, host, err)
+		}
+		local := conn.LocalAddr().(*net.UDPAddr).IP
+		_ = conn.Close()
+		data = append(data, "clientaddr="+local.String())
+	}
+	return data, nil
+}
+
+// Mount an NFS export with mount(2), with the flags and the data for the
+// kernel built from the options rather than by mount.nfs, so that failures
+// keep the errno telling why. The kernel may block well past the deadline of
+// the context on an unresponsive server; the mount is then left to finish or
+// fail in the background.
+func mountNFS(ctx context.Context, fsType, source, target string, options []string) error {
+	flags, data := mountData(options)
+	if flags&(unix.MS_REMOUNT|unix.MS_BIND) == 0 {
+		host, _ := splitNFSSource(source)
+		if host == "" {
+			return fmt.Errorf("invalid NFS source %q", source)
+		}
+		var err error
+		if data, err = nfsMountAddresses(ctx, host, data); err != nil {
+			return err
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- unix.Mount(source, target, fsType, flags, strings.Join(data, ","))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("mount of %s at %s failed: %w", source, target, classifyMountError(err))
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("mount of %s at %s: %w: %w", source, target, errMountTimeout, ctx.Err())
+	}
+}
@@ -0,0 +1,256 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultKubeletDir         = "/var/lib/kubelet"
+	defaultMountCheckInterval = time.Minute
+	defaultMaxRemounts        = 3
+	// Time a stat of a mount point may take before the server is taken as not
+	// responding. Hard mounts of an unreachable server block indefinitely.
+	mountStatTimeout = 10 * time.Second
+)
+
+// Verification of the NFS volume mounts of managed pods.
+type mountCheckConfig struct {
+	// Check the NFS volumes of pods stay mounted and remount lost or stale ones.
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval of the checks, 1m by default.
+	Interval duration `json:"interval,omitempty"`
+	// Remounts tried for a pod before giving up on it, 3 by default.
+	MaxRemounts int `json:"maxRemounts,omitempty"`
+	// Root directory of the kubelet, /var/lib/kubelet by default.
+	KubeletDir string `json:"kubeletDir,omitempty"`
+}
+
+func (c *mountCheckConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultMountCheckInterval
+}
+
+func (c *mountCheckConfig) maxRemounts() int {
+	if c.MaxRemounts > 0 {
+		return c.MaxRemounts
+	}
+	return defaultMaxRemounts
+}
+
+func (c *mountCheckConfig) kubeletDir() string {
+	if c.KubeletDir != "" {
+		return c.KubeletDir
+	}
+	return defaultKubeletDir
+}
+
+// Checker of the NFS volume mounts of managed pods.
+type mountChecker struct {
+	cfg     mountCheckConfig
+	mounter Mounter
+
+	sync.Mutex
+	// NFS volume mounts seen for each pod, by pod ID.
+	pods map[string]*podMounts
+}
+
+// NFS volume mounts of a pod, as first seen.
+type podMounts struct {
+	// Mounts by mount point.
+	mounts map[string]*hostMount
+	// Remounts tried for the pod.
+	remounts int
+}
+
+func newMountChecker(cfg mountCheckConfig, mounter Mounter) *mountChecker {
+	return &mountChecker{cfg: cfg, mounter: mounter, pods: map[string]*podMounts{}}
+}
+
+// NFS mounts of the volumes of a pod, by mount point.
+func (c *mountChecker) volumeMounts(uid string) (map[string]*hostMount, error) {
+	return podVolumeMounts(c.mounter, c.cfg.kubeletDir(), uid)
+}
+
+// NFS mounts of the volumes of a pod under the kubelet directory, by mount point.
+func podVolumeMounts(mounter Mounter, kubeletDir, uid string) (map[string]*hostMount, error) {
+	mounts, err := mounter.Mounts()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mount table: %w", err)
+	}
+	dir := filepath.Join(kubeletDir, "pods", uid, "volumes") + "/"
+	volumes := map[string]*hostMount{}
+	for _, m := range mounts {
+		if m.nfs() && strings.HasPrefix(m.mountPoint, dir) {
+			volumes[m.mountPoint] = m
+		}
+	}
+	return volumes, nil
+}
+
+// Stop checking the mounts of a pod.
+func (c *mountChecker) forget(id string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	delete(c.pods, id)
+	c.Unlock()
+}
+
+// Check the NFS volume mounts of managed pods periodically until the context
+// is cancelled.
+func (p *plugin) runMountChecks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.mountChecks.cfg.interval()):
+		}
+
+		p.Lock()
+		ids := make([]string, 0, len(p.managed))
+		for id := range p.managed {
+			ids = append(ids, id)
+		}
+		p.Unlock()
+		for _, id := range ids {
+			p.verifyMounts(ctx, id)
+		}
+	}
+}
+
+// Verify the NFS volumes of a managed pod are mounted, with the options it
+// requires. Mounts seen the first time are checked for their options and
+// remembered. Remembered mounts which went missing or stale are mounted again,
+// up to the configured number of remounts for the pod.
+func (p *plugin) verifyMounts(ctx context.Context, id string) {
+	c := p.mountChecks
+	if c == nil {
+		return
+	}
+	p.Lock()
+	mc, ok := p.managed[id]
+	p.Unlock()
+	if !ok || mc.pod.GetUid() == "" || mc.params.secondary() {
+		return
+	}
+	l := subsystemLogger(mc.log, subsystemMount)
+	current, err := c.volumeMounts(mc.pod.GetUid())
+	if err != nil {
+		l.Warn(err)
+		return
+	}
+
+	c.Lock()
+	pm, ok := c.pods[id]
+	if !ok {
+		pm = &podMounts{mounts: map[string]*hostMount{}}
+		c.pods[id] = pm
+	}
+	var seen []*hostMount
+	for path, m := range current {
+		if _, ok := pm.mounts[path]; !ok {
+			pm.mounts[path] = m
+			seen = append(seen, m)
+		}
+	}
+	expected := make([]*hostMount, 0, len(pm.mounts))
+	for _, m := range pm.mounts {
+		expected = append(expected, m)
+	}
+	c.Unlock()
+
+	for _, m := range seen {
+		l.Debugf("NFS volume %s mounted at %s", m.source, m.mountPoint)
+		if server, _ := splitNFSSource(m.source); !sameServer(mc.params.nfsServers(), server) {
+			l.Debugf("NFS volume %s is not on an NFS server of the pod, no service ticket was obtained for it", m.source)
+		}
+		if err := mc.params.checkNFSMount(m.mountPoint, m, m.mountPoint); err != nil {
+			l.Warn(err)
+			reason := reasonWeakSecurity
+			if errors.Is(err, errNFSVersion) {
+				reason = reasonNFSVersionMismatch
+			}
+			p.events.warn(mc.pod, reason, "%v", err)
+		}
+	}
+
+	for _, m := range expected {
+		var problem string
+		if _, ok := current[m.mountPoint]; !ok {
+			problem = "is no longer mounted"
+		} else if err := c.mounter.Stat(ctx, m.mountPoint); errors.Is(err, syscall.ESTALE) {
+			problem = "is stale"
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			l.Warnf("NFS volume %s at %s is not responding", m.source, m.mountPoint)
+			continue
+		} else {
+			continue
+		}
+
+		c.Lock()
+		attempt := pm.remounts + 1
+		if attempt <= c.cfg.maxRemounts() {
+			pm.remounts = attempt
+		}
+		c.Unlock()
+		if attempt > c.cfg.maxRemounts() {
+			l.Debugf("NFS volume %s at %s %s, not remounting again", m.source, m.mountPoint, problem)
+			continue
+		}
+
+		retry := p.config().Retry
+		err := retry.do(withLogger(ctx, l), "remount", "remount of "+m.mountPoint, func() error {
+			return remount(ctx, c.mounter, m)
+		})
+		nfsRemounts.WithLabelValues(result(err)).Inc()
+		if err != nil {
+			l.Errorf("NFS volume %s at %s %s, remount %d/%d failed: %v",
+				m.source, m.mountPoint, problem, attempt, c.cfg.maxRemounts(), err)
+			p.events.warn(mc.pod, reasonNFSMountLost, "NFS volume %s at %s %s, remount %d/%d failed (%s): %v",
+				m.source, m.mountPoint, problem, attempt, c.cfg.maxRemounts(), failureReason(err), err)
+			continue
+		}
+		l.Warnf("NFS volume %s at %s %s, remounted", m.source, m.mountPoint, problem)
+		p.events.warn(mc.pod, reasonNFSMountLost, "NFS volume %s at %s %s, remounted",
+			m.source, m.mountPoint, problem)
+	}
+}
+
+// Mount the export of an NFS mount again at its mount point, with the options
+// it had, detaching what is left of the old mount first.
+func remount(ctx context.Context, mounter Mounter, m *hostMount) error {
+	if err := mounter.Unmount(m.mountPoint); err != nil {
+		return fmt.Errorf("failed to detach %s: %w", m.mountPoint, err)
+	}
+	options := m.nfsOptions(m.sec(), m.options["vers"], m.options["proto"])
+	if _, ro := m.options["ro"]; ro {
+		options = append(options, "ro")
+	}
+	return mounter.Mount(ctx, m.fsType, m.source, m.mountPoint, options)
+}
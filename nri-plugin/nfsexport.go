@@ -0,0 +1,348 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	portmapPort    = "111"
+	portmapProgram = 100000
+	portmapGetPort = 3
+	mountProgram   = 100005
+	mountExport    = 5
+	ipProtoTCP     = 6
+
+	rpcAuthNone = 0
+	rpcAuthSys  = 1
+	// Largest fragment of RPC replies read.
+	rpcMaxFragment = 1 << 20
+
+	nfs4OpGetattr   = 9
+	nfs4OpLookup    = 15
+	nfs4OpPutRootFH = 24
+	nfs4AttrFSID    = 8
+	// Status of the walk of the pseudo file system telling a missing export.
+	nfs4ErrNoEnt    = 2
+	nfs4ErrNotDir   = 20
+	nfs4ErrWrongSec = 10016
+)
+
+// Returned when the export a volume of a pod is mounted from is not exported
+// by its NFS server.
+var errNFSExport = errors.New("NFS export not found")
+
+// Failures of RPC calls: a reply which is not one to the call, and a call
+// the server denied or did not accept.
+var (
+	errRPCProtocol    = errors.New("unexpected RPC reply")
+	errRPCRejected    = errors.New("RPC call denied")
+	errRPCNotAccepted = errors.New("RPC call not accepted")
+)
+
+// Prober of the exports of NFS servers, caching the results like
+// nfsVersionProbe.
+type nfsExportProbe struct {
+	clock Clock
+
+	sync.Mutex
+	results map[string]*nfsProbeResult
+}
+
+func newNFSExportProbe(clock Clock) *nfsExportProbe {
+	return &nfsExportProbe{clock: clock, results: map[string]*nfsProbeResult{}}
+}
+
+// Check that the server exports the export of a volume mounted with the NFS
+// version, wrapping errNFSExport if it does not. A server which cannot be asked
+// is given the benefit of the doubt.
+func (p *nfsExportProbe) check(ctx context.Context, server, export, vers string) error {
+	key := server + " " + export + " " + vers
+	p.Lock()
+	r, ok := p.results[key]
+	p.Unlock()
+	if ok && p.clock.Now().Before(r.expires) {
+		return r.err
+	}
+
+	var err error
+	if vers == "3" {
+		err = probeMountExport(ctx, server, export)
+	} else {
+		err = probeNFS4Export(ctx, server, export)
+	}
+	if err != nil && !errors.Is(err, errNFSExport) {
+		loggerFrom(ctx).Debugf("cannot probe export %s of %s: %v", export, server, err)
+		return nil
+	}
+	p.Lock()
+	p.results[key] = &nfsProbeResult{err: err, expires: p.clock.Now().Add(nfsProbeTTL)}
+	p.Unlock()
+	return err
+}
+
+// Check the export against the export list of the MOUNT service of an NFSv3
+// server, found through its portmapper. Directories below an export are
+// exported with it.
+func probeMountExport(ctx context.Context, server, export string) error {
+	ctx, cancel := context.WithTimeout(ctx, nfsProbeTimeout)
+	defer cancel()
+	var args xdrEncoder
+	args.put(mountProgram, 3, ipProtoTCP, 0)
+	res, err := callRPC(ctx, withPort(server, portmapPort), portmapProgram, 2, portmapGetPort, nil, args.Bytes())
+	if err != nil {
+		return fmt.Errorf("portmapper: %w", err)
+	}
+	port := res.uint32()
+	if res.err != nil || port == 0 {
+		return errors.New("no MOUNT service registered")
+	}
+	res, err = callRPC(ctx, net.JoinHostPort(hostOf(server), strconv.Itoa(int(port))), mountProgram, 3, mountExport, nil, nil)
+	if err != nil {
+		return fmt.Errorf("MOUNT: %w", err)
+	}
+	var exports []string
+	for res.uint32() == 1 {
+		dir := res.string()
+		for res.uint32() == 1 {
+			res.string() // group
+		}
+		if res.err != nil {
+			return fmt.Errorf("MOUNT: %w", res.err)
+		}
+		exports = append(exports, dir)
+		if dir == export || strings.HasPrefix(export, strings.TrimSuffix(dir, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s does not export %s, its exports are %s", errNFSExport, server, export, strings.Join(exports, " "))
+}
+
+// Walk the pseudo file system of an NFSv4 server to the export, looking each
+// component of its path up from the root and getting the fsid of the last.
+// A server refusing the lookup for the security flavor still has the
+// export.
+func probeNFS4Export(ctx context.Context, server, export string) error {
+	ctx, cancel := context.WithTimeout(ctx, nfsProbeTimeout)
+	defer cancel()
+	var components []string
+	for _, c := range strings.Split(path.Clean("/"+export), "/") {
+		if c != "" {
+			components = append(components, c)
+		}
+	}
+	var args xdrEncoder
+	args.putString("")
+	args.put(0, uint32(len(components)+2), nfs4OpPutRootFH)
+	for _, c := range components {
+		args.put(nfs4OpLookup)
+		args.putString(c)
+	}
+	args.put(nfs4OpGetattr, 1, 1<<nfs4AttrFSID)
+
+	var cred xdrEncoder
+	cred.put(uint32(time.Now().Unix()))
+	cred.putString("nri-kerberos")
+	cred.put(0, 0, 0) // root, no supplementary groups
+	res, err := callRPC(ctx, withPort(server, nfsPort), nfsProgram, 4, nfs4Compound, cred.Bytes(), args.Bytes())
+	if err != nil {
+		return err
+	}
+	status := res.uint32()
+	res.string() // tag
+	if res.err != nil {
+		return res.err
+	}
+	// the results of the operations up to the one failing, if any
+	n := res.uint32()
+	looked := 0
+	for i := uint32(0); i < n && res.err == nil; i++ {
+		op, st := res.uint32(), res.uint32()
+		switch {
+		case op == nfs4OpLookup && st == 0:
+			looked++
+		case op == nfs4OpGetattr && st == 0:
+			for words := res.uint32(); words > 0 && res.err == nil; words-- {
+				res.uint32()
+			}
+			res.uint32() // length of the attributes
+			major, minor := res.uint64(), res.uint64()
+			if res.err == nil {
+				loggerFrom(ctx).Debugf("export %s of %s has fsid %d.%d", export, server, major, minor)
+			}
+		}
+	}
+	switch status {
+	case 0:
+		return nil
+	case nfs4ErrNoEnt, nfs4ErrNotDir:
+		found := "/" + strings.Join(components[:min(looked, len(components))], "/")
+		return fmt.Errorf("%w: %s has no %s in its NFSv4 pseudo file system, only %s", errNFSExport, server, export, found)
+	case nfs4ErrWrongSec:
+		return nil
+	default:
+		return fmt.Errorf("COMPOUND failed with NFSv4 status %d", status)
+	}
+}
+
+// Encoder of XDR arguments.
+type xdrEncoder struct {
+	bytes.Buffer
+}
+
+func (e *xdrEncoder) put(v ...uint32) {
+	for _, x := range v {
+		_ = binary.Write(e, binary.BigEndian, x)
+	}
+}
+
+func (e *xdrEncoder) putString(s string) {
+	e.put(uint32(len(s)))
+	e.WriteString(s)
+	e.Write(make([]byte, (4-len(s)%4)%4))
+}
+
+// Decoder of XDR results, the first error kept.
+type xdrDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *xdrDecoder) uint32() uint32 {
+	if len(d.data) < 4 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return v
+}
+
+func (d *xdrDecoder) uint64() uint64 {
+	return uint64(d.uint32())<<32 | uint64(d.uint32())
+}
+
+func (d *xdrDecoder) string() string {
+	n := int(d.uint32())
+	padded := n + (4-n%4)%4
+	if d.err != nil || padded > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[padded:]
+	return s
+}
+
+// Make an RPC call over TCP, with AUTH_SYS credentials if given and AUTH_NONE
+// otherwise, returning the results of an accepted and successful call.
+func callRPC(ctx context.Context, addr string, prog, vers, proc uint32, authSys, args []byte) (*xdrDecoder, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var call xdrEncoder
+	xid := uint32(time.Now().UnixNano())
+	call.put(0, xid, rpcCall, 2, prog, vers, proc)
+	if authSys != nil {
+		call.put(rpcAuthSys, uint32(len(authSys)))
+		call.Write(authSys)
+	} else {
+		call.put(rpcAuthNone, 0)
+	}
+	call.put(rpcAuthNone, 0) // verifier
+	call.Write(args)
+	msg := call.Bytes()
+	binary.BigEndian.PutUint32(msg, 0x80000000|uint32(len(msg)-4))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var reply []byte
+	for last := false; !last; {
+		var header uint32
+		if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+		if header&0x7fffffff > rpcMaxFragment {
+			return nil, errRPCProtocol
+		}
+		fragment := make([]byte, header&0x7fffffff)
+		if _, err := io.ReadFull(conn, fragment); err != nil {
+			return nil, err
+		}
+		reply, last = append(reply, fragment...), header&0x80000000 != 0
+	}
+	res := &xdrDecoder{data: reply}
+	if res.uint32() != xid || res.uint32() != rpcReply {
+		return nil, errRPCProtocol
+	}
+	if res.uint32() != rpcMsgAccepted {
+		return nil, errRPCRejected
+	}
+	res.uint32() // verifier flavor
+	res.string()
+	if stat := res.uint32(); res.err != nil {
+		return nil, errRPCProtocol
+	} else if stat != rpcSuccess {
+		return nil, fmt.Errorf("%w (%d)", errRPCNotAccepted, stat)
+	}
+	return res, nil
+}
+
+// Check the exports of the NFS volumes of a container with their servers,
+// at the address and NFS version of the kubelet mounts.
+func (p *plugin) checkNFSExports(ctx context.Context, container *api.Container) error {
+	volumes, err := nfsVolumeMounts(p.mounter, container)
+	if err != nil {
+		return nil
+	}
+	for _, v := range volumes {
+		server, export := splitNFSSource(v.host.source)
+		if addr := v.host.options["addr"]; addr != "" {
+			server = addr
+		}
+		vers := "4"
+		if strings.HasPrefix(v.host.options["vers"], "3") {
+			vers = "3"
+		}
+		if err := p.nfsExports.check(ctx, server, export, vers); err != nil {
+			return fmt.Errorf("%s (%s): %w", v.GetDestination(), v.host.source, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Mount table the NFS mounts of the volumes are looked up in. The plugin has
+// to see the kubelet volume mounts for this, like in the host mount namespace.
+const mountInfoPath = "/proc/self/mountinfo"
+
+// Returned to the runtime when failing a container with an NFS mount of a
+// weaker security flavor than its pod requires.
+var errWeakSecurity = errors.New("NFS security flavor weaker than required")
+
+// RPC security flavors of NFS, by strength.
+var secFlavors = map[string]int{
+	"sys":   0,
+	"krb5":  1,
+	"krb5i": 2,
+	"krb5p": 3,
+}
+
+// Check a required security flavor, an empty one meaning none.
+func validSec(sec string) error {
+	if _, ok := secFlavors[sec]; sec != "" && (!ok || sec == "sys") {
+		return fmt.Errorf("unknown security flavor %q, must be krb5, krb5i or krb5p", sec)
+	}
+	return nil
+}
+
+// Transports NFS volumes may be rewritten to.
+var nfsProtos = []string{"tcp", "tcp6", "rdma", "rdma6"}
+
+// Options of the host NFS mount carried over to rewritten mounts. The kernel
+// needs addr, which mount.nfs normally resolves, along with the rest.
+var nfsCarriedOptions = []string{"addr", "clientaddr", "port", "hard", "soft", "timeo", "retrans", "rsize", "wsize"}
+
+// Check a transport, an empty one meaning any.
+func validNFSProto(proto string) error {
+	if proto != "" && !slices.Contains(nfsProtos, proto) {
+		return fmt.Errorf("unknown NFS transport %q, must be one of %s", proto, strings.Join(nfsProtos, ", "))
+	}
+	return nil
+}
+
+// A mount of the mount table.
+type hostMount struct {
+	mountPoint string
+	fsType     string
+	source     string
+	options    map[string]string
+}
+
+// Whether the mount is an NFS one.
+func (m *hostMount) nfs() bool {
+	return m.fsType == "nfs" || m.fsType == "nfs4"
+}
+
+// Read a mount table in /proc/<pid>/mountinfo format, with the mount and
+// super block options of each mount merged.
+func readMountInfo(path string) ([]*hostMount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []*hostMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		fields, super := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 6 || len(super) < 3 {
+			continue
+		}
+		m := &hostMount{
+			mountPoint: unescapeMountInfo(fields[4]),
+			fsType:     super[0],
+			source:     unescapeMountInfo(super[1]),
+			options:    map[string]string{},
+		}
+		for _, opt := range strings.Split(fields[5]+","+super[2], ",") {
+			k, v, _ := strings.Cut(opt, "=")
+			m.options[k] = v
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// Undo the octal escapes of whitespace and backslashes in mountinfo fields.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// The mount a path is on: the last one mounted at the longest prefix of it.
+func mountOf(mounts []*hostMount, path string) *hostMount {
+	var found *hostMount
+	path = filepath.Clean(path)
+	for _, m := range mounts {
+		rel, err := filepath.Rel(m.mountPoint, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if found == nil || len(m.mountPoint) >= len(found.mountPoint) {
+			found = m
+		}
+	}
+	return found
+}
+
+// Security flavor of an NFS mount: with a list of flavors, the first one is in use.
+func (m *hostMount) sec() string {
+	sec, _, _ := strings.Cut(m.options["sec"], ":")
+	if sec == "" {
+		return "sys"
+	}
+	return sec
+}
+
+// A container bind mount of an NFS volume, with the host NFS mount it is on.
+type nfsVolumeMount struct {
+	*api.Mount
+	host *hostMount
+}
+
+// NFS volume mounts of a container. Sources of bind mounts are looked up in
+// the mount table of the plugin, so that a flavor or version negotiated down by
+// the server is seen, not only what was asked for.
+func nfsVolumeMounts(mounter Mounter, container *api.Container) ([]nfsVolumeMount, error) {
+	mounts, err := mounter.Mounts()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mount table: %w", err)
+	}
+	var volumes []nfsVolumeMount
+	for _, cm := range container.GetMounts() {
+		if !isBindMount(cm) {
+			continue
+		}
+		if m := mountOf(mounts, cm.GetSource()); m != nil && m.nfs() {
+			volumes = append(volumes, nfsVolumeMount{cm, m})
+		}
+	}
+	return volumes, nil
+}
+
+// Whether the pod requires anything of its NFS volume mounts.
+func (kp *kerberosParams) nfsRequirements() bool {
+	return kp.Sec != "" || kp.NFSVersion != "" || len(kp.NFSVolumeVersions) > 0
+}
+
+// Check that the NFS volumes of a container are mounted with the security
+// flavor the pod requires, or a stronger one, and the NFS version it requires
+// for them.
+func checkNFSMounts(mounter Mounter, container *api.Container, kp *kerberosParams) error {
+	if !kp.nfsRequirements() {
+		return nil
+	}
+	volumes, err := nfsVolumeMounts(mounter, container)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWeakSecurity, err)
+	}
+
+	for _, v := range volumes {
+		if err := kp.checkNFSMount(v.GetDestination(), v.host, v.GetSource()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check an NFS mount of a volume of the pod, seen at path and bind mounted
+// from source, against the security flavor and NFS version it requires.
+func (kp *kerberosParams) checkNFSMount(path string, m *hostMount, source string) error {
+	if sec := m.sec(); secFlavors[sec] < secFlavors[kp.Sec] {
+		return fmt.Errorf("%w: %s (%s) is mounted with sec=%s, %s requires sec=%s",
+			errWeakSecurity, path, m.source, sec, kp.Principal(), kp.Sec)
+	}
+	if vers := kp.nfsVersionFor(source); vers != "" && !nfsVersionMatches(m.options["vers"], vers) {
+		return fmt.Errorf("%w: %s (%s) is mounted with vers=%s, not %s", errNFSVersion,
+			path, m.source, m.options["vers"], vers)
+	}
+	return nil
+}
+
+// Options mounting the export of an NFS mount again with the security flavor,
+// NFS version and transport given.
+func (m *hostMount) nfsOptions(sec, vers, proto string) []string {
+	options := []string{"sec=" + sec}
+	if vers != "" {
+		options = append(options, "vers="+vers)
+	}
+	if proto != "" {
+		options = append(options, "proto="+proto)
+	}
+	for _, k := range nfsCarriedOptions {
+		if value, ok := m.options[k]; ok {
+			options = append(options, strings.TrimSuffix(k+"="+value, "="))
+		}
+	}
+	return options
+}
+
+// Replace the NFS volume mounts of a container not mounted with the security
+// flavor, NFS version and transport the pod requires by NFS mounts of the same
+// exports which are, returning the destinations replaced. The runtime mounts
+// these in the container, so a server refusing the options fails the container
+// rather than it running on the weaker host mount.
+func rewriteNFSMounts(mounter Mounter, adjust *api.ContainerAdjustment, container *api.Container, kp *kerberosParams, proto string) ([]string, error) {
+	if !kp.nfsRequirements() && proto == "" {
+		return nil, nil
+	}
+	volumes, err := nfsVolumeMounts(mounter, container)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errWeakSecurity, err)
+	}
+
+	var rewritten []string
+	for _, v := range volumes {
+		sec, vers, proto := kp.Sec, kp.nfsVersionFor(v.GetSource()), proto
+		if sec == "" || secFlavors[v.host.sec()] >= secFlavors[sec] {
+			sec = v.host.sec()
+		}
+		if vers == "" || nfsVersionMatches(v.host.options["vers"], vers) {
+			vers = v.host.options["vers"]
+		}
+		if proto == "" {
+			proto = v.host.options["proto"]
+		}
+		server, export := splitNFSSource(v.host.source)
+		proto = protoFor(server, proto)
+		if sec == v.host.sec() && vers == v.host.options["vers"] && proto == v.host.options["proto"] {
+			continue
+		}
+
+		// a volume bind mounted from below the host mount, like a subPath
+		source := v.host.source
+		if rel, err := filepath.Rel(v.host.mountPoint, filepath.Clean(v.GetSource())); err == nil && rel != "." {
+			source = nfsSource(server, path.Join(export, rel))
+		}
+		options := v.host.nfsOptions(sec, vers, proto)
+		for _, opt := range v.GetOptions() {
+			switch opt {
+			case "ro", "rw", "nosuid", "nodev", "noexec":
+				options = append(options, opt)
+			}
+		}
+
+		adjust.RemoveMount(v.GetDestination())
+		adjust.AddMount(&api.Mount{
+			Destination: v.GetDestination(),
+			Type:        "nfs",
+			Source:      source,
+			Options:     options,
+		})
+		rewritten = append(rewritten, v.GetDestination())
+	}
+	return rewritten, nil
+}
+
+// Whether a container mount is a bind mount, as volumes are.
+func isBindMount(m *api.Mount) bool {
+	if m.GetType() == "bind" {
+		return true
+	}
+	for _, opt := range m.GetOptions() {
+		if opt == "bind" || opt == "rbind" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	defaultNFSSubdirProvisioner = "k8s-sigs.io/nfs-subdir-external-provisioner"
+
+	// Annotations of PVs naming their provisioner, and the gid the kubelet
+	// adds to the supplementary groups of pods mounting them.
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+	pvGIDAnnotation         = "pv.beta.kubernetes.io/gid"
+)
+
+// Names nfs-subdir-external-provisioner gives PVs, and the directory it
+// creates for each by its default pathPattern,
+// ${.PVC.namespace}-${.PVC.name}-${.PV.name}.
+var (
+	provisionedPVRegexp = regexp.MustCompile(`^pvc-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	nfsVolumeDirRegexp  = regexp.MustCompile(`/volumes/kubernetes\.io~nfs/([^/]+)$`)
+)
+
+// Recognition of the PVs of nfs-subdir-external-provisioner among the NFS
+// volumes of pods, which then need not repeat the NFS server of the
+// StorageClass in NFS_HOSTNAME.
+type nfsSubdirConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Names of the provisioners, as in the pv.kubernetes.io/provisioned-by
+	// annotation of their PVs, k8s-sigs.io/nfs-subdir-external-provisioner
+	// by default.
+	Provisioners []string `json:"provisioners,omitempty"`
+}
+
+func (c *nfsSubdirConfig) provisioners() []string {
+	if len(c.Provisioners) > 0 {
+		return c.Provisioners
+	}
+	return []string{defaultNFSSubdirProvisioner}
+}
+
+// A volume of a pod on a PV of nfs-subdir-external-provisioner.
+type nfsSubdirVolume struct {
+	pv     string
+	server string
+	export string
+	// Gid of the PV, 0 if it has none.
+	gid uint64
+}
+
+// Volumes of a pod which are PVs of nfs-subdir-external-provisioner, from the
+// NFS mounts the kubelet made for them. PVs are read from the Kubernetes API
+// for their provisioner and gid where there is access to it; without, PVs
+// named as the provisioner names them, with an export ending in the PV name
+// as its default pathPattern has it, are taken to be its.
+func (p *plugin) nfsSubdirVolumes(ctx context.Context, cfg *config, pod *api.PodSandbox) ([]nfsSubdirVolume, error) {
+	if !cfg.NFSSubdir.Enabled || pod.GetUid() == "" {
+		return nil, nil
+	}
+	mounts, err := podVolumeMounts(p.mounter, cfg.MountCheck.kubeletDir(), pod.GetUid())
+	if err != nil {
+		return nil, err
+	}
+	var volumes []nfsSubdirVolume
+	for mountPoint, m := range mounts {
+		match := nfsVolumeDirRegexp.FindStringSubmatch(mountPoint)
+		if match == nil {
+			continue
+		}
+		v := nfsSubdirVolume{pv: match[1]}
+		v.server, v.export = splitNFSSource(m.source)
+		if p.kube == nil {
+			if !provisionedPVRegexp.MatchString(v.pv) || !strings.HasSuffix(path.Base(v.export), "-"+v.pv) {
+				continue
+			}
+		} else {
+			provisioner, gid, err := pvProvisioner(ctx, p.kube, v.pv)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(cfg.NFSSubdir.provisioners(), provisioner) {
+				continue
+			}
+			v.gid = gid
+		}
+		volumes = append(volumes, v)
+	}
+	slices.SortFunc(volumes, func(a, b nfsSubdirVolume) int { return strings.Compare(a.pv, b.pv) })
+	return volumes, nil
+}
+
+// Provisioner and gid of a PV.
+func pvProvisioner(ctx context.Context, kube *kubeClient, name string) (string, uint64, error) {
+	obj := struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}{}
+	if err := kube.do(ctx, http.MethodGet, "/api/v1/persistentvolumes/"+name, "", nil, &obj); err != nil {
+		return "", 0, fmt.Errorf("failed to get PV %s: %w", name, err)
+	}
+	var gid uint64
+	if value, ok := obj.Metadata.Annotations[pvGIDAnnotation]; ok {
+		var err error
+		if gid, err = strconv.ParseUint(value, 10, 32); err != nil {
+			return "", 0, fmt.Errorf("PV %s: %s %q is not a gid", name, pvGIDAnnotation, value)
+		}
+	}
+	return obj.Metadata.Annotations[provisionedByAnnotation], gid, nil
+}
+
+// NFS servers of the volumes, in order, as a list for NFS_HOSTNAME.
+func nfsSubdirServers(volumes []nfsSubdirVolume) string {
+	var servers []string
+	for _, v := range volumes {
+		if !sameServer(servers, v.server) {
+			servers = append(servers, v.server)
+		}
+	}
+	return strings.Join(servers, ",")
+}
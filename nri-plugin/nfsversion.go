@@ -0,0 +1,216 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nfsPort         = "2049"
+	nfsProgram      = 100003
+	nfsProbeTimeout = 5 * time.Second
+	// Time probe results are cached for.
+	nfsProbeTTL = 5 * time.Minute
+
+	rpcCall                  = 0
+	rpcReply                 = 1
+	rpcMsgAccepted           = 0
+	rpcSuccess               = 0
+	rpcProgMismatch          = 2
+	nfs4Compound             = 1
+	nfs4ErrMinorVersMismatch = 10021
+)
+
+// Returned when the NFS server does not support the version a pod requires,
+// and to the runtime when failing a container mounted with another one.
+var errNFSVersion = errors.New("NFS version not supported")
+
+// Kubelet directory of a volume, whose name follows the plugin name: the
+// volume name for in-tree NFS volumes, the PV name for CSI ones.
+var kubeletVolumeRegexp = regexp.MustCompile(`/volumes/kubernetes\.io~[^/]+/([^/]+)`)
+
+// Check an NFS version, an empty one meaning any.
+func validNFSVersion(vers string) error {
+	switch vers {
+	case "", "3", "4", "4.0", "4.1", "4.2":
+		return nil
+	}
+	return fmt.Errorf("unknown NFS version %q, must be 3, 4, 4.0, 4.1 or 4.2", vers)
+}
+
+// Whether an NFS mount of the version satisfies the required version. 4 stands
+// for any minor version.
+func nfsVersionMatches(mounted, required string) bool {
+	if mounted == "4" {
+		mounted = "4.0"
+	}
+	if required == "4" {
+		return strings.HasPrefix(mounted, "4.")
+	}
+	return mounted == required
+}
+
+// NFS version required for a volume of the pod, given the source of its bind mount.
+func (kp *kerberosParams) nfsVersionFor(source string) string {
+	if m := kubeletVolumeRegexp.FindStringSubmatch(source); m != nil {
+		if vers, ok := kp.NFSVolumeVersions[m[1]]; ok {
+			return vers
+		}
+	}
+	return kp.NFSVersion
+}
+
+// Prober of the NFS versions servers support, caching the results.
+type nfsVersionProbe struct {
+	clock Clock
+
+	sync.Mutex
+	results map[string]*nfsProbeResult
+}
+
+type nfsProbeResult struct {
+	err     error
+	expires time.Time
+}
+
+func newNFSVersionProbe(clock Clock) *nfsVersionProbe {
+	return &nfsVersionProbe{clock: clock, results: map[string]*nfsProbeResult{}}
+}
+
+// Check that the server supports the NFS version, wrapping errNFSVersion if it
+// does not. A server which cannot be asked, for not accepting AUTH_NONE say, is
+// given the benefit of the doubt.
+func (p *nfsVersionProbe) check(ctx context.Context, server, vers string) error {
+	if vers == "" {
+		return nil
+	}
+	key := server + " " + vers
+	p.Lock()
+	r, ok := p.results[key]
+	p.Unlock()
+	if ok && p.clock.Now().Before(r.expires) {
+		return r.err
+	}
+
+	err := probeNFSVersion(ctx, server, vers)
+	if err != nil && !errors.Is(err, errNFSVersion) {
+		loggerFrom(ctx).Debugf("cannot probe NFS version %s of %s: %v", vers, server, err)
+		return nil
+	}
+	p.Lock()
+	p.results[key] = &nfsProbeResult{err: err, expires: p.clock.Now().Add(nfsProbeTTL)}
+	p.Unlock()
+	return err
+}
+
+// Ask the server whether it supports the NFS version: a NULL call for NFSv3
+// or any NFSv4 and, for an NFSv4 minor version, an empty COMPOUND of it.
+func probeNFSVersion(ctx context.Context, server, vers string) error {
+	addr := withPort(server, nfsPort)
+	major, minor, compound := uint32(3), uint32(0), false
+	if vers != "3" {
+		major = 4
+		if _, m, ok := strings.Cut(vers, "."); ok {
+			minor, compound = uint32(m[0]-'0'), true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, nfsProbeTimeout)
+	defer cancel()
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	call := &bytes.Buffer{}
+	put := func(v ...uint32) {
+		for _, x := range v {
+			_ = binary.Write(call, binary.BigEndian, x)
+		}
+	}
+	xid := uint32(time.Now().UnixNano())
+	put(0, xid, rpcCall, 2, nfsProgram, major)
+	if compound {
+		put(nfs4Compound)
+	} else {
+		put(0) // NULL
+	}
+	put(0, 0, 0, 0) // AUTH_NONE credentials and verifier
+	if compound {
+		put(0, minor, 0) // empty tag, minor version, no operations
+	}
+	msg := call.Bytes()
+	binary.BigEndian.PutUint32(msg, 0x80000000|uint32(len(msg)-4))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var header uint32
+	if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	reply := make([]byte, header&0x7fffffff)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	get := func() uint32 {
+		if len(reply) < 4 {
+			return 0xffffffff
+		}
+		v := binary.BigEndian.Uint32(reply)
+		reply = reply[4:]
+		return v
+	}
+	if get() != xid || get() != rpcReply {
+		return errors.New("unexpected RPC reply")
+	}
+	if get() != rpcMsgAccepted {
+		return errors.New("RPC call denied")
+	}
+	get() // verifier flavor
+	if n := (get() + 3) &^ 3; n <= uint32(len(reply)) {
+		reply = reply[n:]
+	}
+	switch get() {
+	case rpcSuccess:
+	case rpcProgMismatch:
+		low, high := get(), get()
+		return fmt.Errorf("%w: %s supports NFS versions %d to %d, not %s", errNFSVersion, server, low, high, vers)
+	default:
+		return errors.New("RPC call not accepted")
+	}
+	if compound && get() == nfs4ErrMinorVersMismatch {
+		return fmt.Errorf("%w: %s does not support NFS version %s", errNFSVersion, server, vers)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The node as the plugin handlers see it: its mount table, its clock and the
+// commands run on it. Credentials come from the KerberosBackend. Tests
+// replace these with fakes to drive the handlers without a runtime, see the
+// nritest package.
+
+// Mount table of the node, and mounting on it.
+type Mounter interface {
+	// Mounts in the mount namespace of the plugin.
+	Mounts() ([]*hostMount, error)
+	// Mount a file system with the options given.
+	Mount(ctx context.Context, fsType, source, target string, options []string) error
+	// Detach a mount, not failing if nothing is mounted there.
+	Unmount(target string) error
+	// Stat a mount point, giving up after mountStatTimeout as NFS mounts hang.
+	Stat(ctx context.Context, path string) error
+}
+
+// Time of the node, deciding when credentials are renewed, expire or are
+// left over, and the timers scheduling renewals, cleanups and waits for the
+// KDC rate limits. Durations measured for metrics, timeouts and ids derived
+// from the time stay on the system clock.
+type Clock interface {
+	Now() time.Time
+	// Timer firing once d has passed, as time.NewTimer.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop the timer, returning false if it fired or was stopped already.
+	Stop() bool
+}
+
+// Commands run on the node.
+type Exec interface {
+	// Run a command, returning its combined output.
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	// Run a command set up with its environment, input and outputs, as
+	// cmd.Run does.
+	RunCmd(ctx context.Context, cmd *exec.Cmd) error
+}
+
+// Mounter of the mount table in mountInfoPath. NFS exports are mounted with
+// mount(2), so that failures are classified by errno, see classifyMountError;
+// with helper set, and for other file systems, with mount(8), so that
+// mount.nfs resolves and negotiates as for the kubelet.
+type nodeMounter struct {
+	exec   Exec
+	helper bool
+}
+
+func (m nodeMounter) Mounts() ([]*hostMount, error) {
+	return readMountInfo(mountInfoPath)
+}
+
+func (m nodeMounter) Mount(ctx context.Context, fsType, source, target string, options []string) error {
+	if !m.helper && (fsType == "nfs" || fsType == "nfs4") {
+		return mountNFS(ctx, fsType, source, target, options)
+	}
+	return runNodeCommand(ctx, m.exec, []string{"mount", "-t", fsType, "-o", strings.Join(options, ","), source, target})
+}
+
+func (nodeMounter) Unmount(target string) error {
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+func (nodeMounter) Stat(ctx context.Context, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, mountStatTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type nodeExec struct{}
+
+func (nodeExec) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	// #nosec G204:gosec -- the arguments are not passed through a shell
+	return helpers.combinedOutput(ctx, exec.CommandContext(ctx, name, args...))
+}
+
+func (nodeExec) RunCmd(ctx context.Context, cmd *exec.Cmd) error {
+	return helpers.run(ctx, cmd, cmd.Run)
+}
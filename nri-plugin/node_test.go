@@ -0,0 +1,418 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/containerd/nri/pkg/api"
+
+	"github.com/tuminoid/nri-plugins/kerberos-auth/nritest"
+)
+
+func TestMain(m *testing.M) {
+	log = logrus.New()
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Wait for a condition of goroutines of the test, failing after a while.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
+
+// Mount table of a node, of the mounts given and those mounted since.
+type fakeMounter struct {
+	sync.Mutex
+	mounts []*hostMount
+}
+
+func (m *fakeMounter) Mounts() ([]*hostMount, error) {
+	m.Lock()
+	defer m.Unlock()
+	return slices.Clone(m.mounts), nil
+}
+
+func (m *fakeMounter) Mount(_ context.Context, fsType, source, target string, options []string) error {
+	opts := map[string]string{}
+	for _, o := range options {
+		k, v, _ := strings.Cut(o, "=")
+		opts[k] = v
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.mounts = append(m.mounts, &hostMount{mountPoint: target, fsType: fsType, source: source, options: opts})
+	return nil
+}
+
+func (m *fakeMounter) Unmount(target string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.mounts = slices.DeleteFunc(m.mounts, func(hm *hostMount) bool { return hm.mountPoint == target })
+	return nil
+}
+
+func (m *fakeMounter) Stat(_ context.Context, _ string) error {
+	return nil
+}
+
+// Clock standing still until advanced, firing the timers due by then.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	c.timers = slices.DeleteFunc(c.timers, func(t *fakeTimer) bool {
+		if t.at.After(c.now) {
+			return false
+		}
+		t.c <- c.now
+		return true
+	})
+}
+
+// Times the timers not yet fired nor stopped are due at.
+func (c *fakeClock) pending() []time.Time {
+	c.Lock()
+	defer c.Unlock()
+	var due []time.Time
+	for _, t := range c.timers {
+		due = append(due, t.at)
+	}
+	return due
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	n := len(t.clock.timers)
+	t.clock.timers = slices.DeleteFunc(t.clock.timers, func(other *fakeTimer) bool { return other == t })
+	return len(t.clock.timers) < n
+}
+
+// Output and error of a command run by fakeExec.
+type fakeResult struct {
+	out []byte
+	err error
+}
+
+// Commands of a node, succeeding without output but for the results given by
+// command name, and recorded.
+type fakeExec struct {
+	results map[string]fakeResult
+
+	sync.Mutex
+	commands [][]string
+}
+
+func (e *fakeExec) Run(_ context.Context, name string, args ...string) ([]byte, error) {
+	r := e.record(append([]string{name}, args...))
+	return r.out, r.err
+}
+
+func (e *fakeExec) RunCmd(_ context.Context, cmd *exec.Cmd) error {
+	r := e.record(cmd.Args)
+	if cmd.Stdout != nil {
+		if _, err := cmd.Stdout.Write(r.out); err != nil {
+			return err
+		}
+	}
+	return r.err
+}
+
+func (e *fakeExec) record(args []string) fakeResult {
+	e.Lock()
+	e.commands = append(e.commands, args)
+	e.Unlock()
+	return e.results[filepath.Base(args[0])]
+}
+
+// Backend issuing TGTs valid for lifetime and renewable for renewable, starting
+// at the time of its clock, into FILE credential caches. Operations are
+// recorded as "setup user@REALM" and the like, with the KDC they were for, and
+// the nth of an operation fails with the nth of its errs, if any.
+type fakeBackend struct {
+	clock               Clock
+	lifetime, renewable time.Duration
+	errs                map[string][]error
+	// Operations wait for it to be closed, if it is not nil.
+	hold chan struct{}
+
+	sync.Mutex
+	calls []string
+	kdcs  []string
+	// Operations running, and the most that ran at once.
+	running, maxRunning int
+}
+
+var _ KerberosBackend = &fakeBackend{}
+
+func (b *fakeBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	if err := b.record(ctx, "setup", kp); err != nil {
+		return err
+	}
+	now := b.clock.Now()
+	return b.issue(kp, now, now.Add(b.renewable))
+}
+
+func (b *fakeBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	if err := b.record(ctx, "renew", kp); err != nil {
+		return err
+	}
+	t, err := ccacheTimes(kp.CCName, kp.Realm)
+	if err != nil {
+		return err
+	}
+	if !t.renewTill.After(b.clock.Now()) {
+		return fmt.Errorf("%w: ticket expired", errCCacheFailed)
+	}
+	return b.issue(kp, b.clock.Now(), t.renewTill)
+}
+
+func (b *fakeBackend) Destroy(ctx context.Context, kp *kerberosParams) error {
+	if err := b.record(ctx, "destroy", kp); err != nil {
+		return err
+	}
+	return destroyCCache(kp.CCName)
+}
+
+// Operations asked for so far.
+func (b *fakeBackend) operations() []string {
+	b.Lock()
+	defer b.Unlock()
+	return slices.Clone(b.calls)
+}
+
+// KDCs of the operations so far.
+func (b *fakeBackend) kdcsUsed() []string {
+	b.Lock()
+	defer b.Unlock()
+	return slices.Clone(b.kdcs)
+}
+
+// Forget the operations so far, and fail the next ones with errs.
+func (b *fakeBackend) reset(errs map[string][]error) {
+	b.Lock()
+	b.calls, b.kdcs, b.errs = nil, nil, errs
+	b.Unlock()
+}
+
+func (b *fakeBackend) record(ctx context.Context, op string, kp *kerberosParams) error {
+	b.Lock()
+	n := 0
+	for _, call := range b.calls {
+		if strings.HasPrefix(call, op+" ") {
+			n++
+		}
+	}
+	b.calls = append(b.calls, op+" "+kp.Principal())
+	b.kdcs = append(b.kdcs, kp.KDC)
+	var err error
+	if n < len(b.errs[op]) {
+		err = b.errs[op][n]
+	}
+	b.running++
+	b.maxRunning = max(b.maxRunning, b.running)
+	b.Unlock()
+
+	if b.hold != nil {
+		select {
+		case <-b.hold:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	b.Lock()
+	b.running--
+	b.Unlock()
+	return err
+}
+
+func (b *fakeBackend) issue(kp *kerberosParams, start, renewTill time.Time) error {
+	user, realm, _ := strings.Cut(kp.Principal(), "@")
+	end := start.Add(b.lifetime)
+	if end.After(renewTill) {
+		end = renewTill
+	}
+	tgt := &ccacheEntry{
+		clientRealm: realm,
+		client:      types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user),
+		serverRealm: realm,
+		server:      types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm),
+		key:         types.EncryptionKey{KeyType: 18, KeyValue: make([]byte, 32)},
+		authTime:    start,
+		startTime:   start,
+		endTime:     end,
+		renewTill:   renewTill,
+		flags:       asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		ticket:      []byte("ticket"),
+	}
+	return writeCCache(kp.CCName, int(kp.UID), int(kp.GID), tgt)
+}
+
+// Plugin with the configuration given in YAML, validated as when loaded,
+// driven by a runtime and running on a fake node, with its clock at 2026-01-01
+// and the pod credential caches in a temporary directory. The host credential
+// caches of the uids pods set up use are removed after the test.
+func newTestPlugin(t *testing.T, yaml string, backend KerberosBackend) (*plugin, *nritest.Runtime) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CCacheDir == "" {
+		cfg.CCacheDir = t.TempDir()
+	}
+
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if fb, ok := backend.(*fakeBackend); ok && fb.clock == nil {
+		fb.clock = clock
+	}
+	p := &plugin{
+		cleaner:     newCleaner(clock),
+		renewals:    newCleaner(clock),
+		kdcs:        newKDCTracker(clock),
+		discovery:   newKDCDiscovery(clock),
+		nfsVersions: newNFSVersionProbe(clock),
+		nfsExports:  newNFSExportProbe(clock),
+		health:      newHealth(),
+		remediation: newRemediator(),
+		results:     newSetupResults(),
+		breaker:     newPrincipalBreaker(),
+		managed:     make(map[string]*managedCache),
+		failed:      make(map[string]error),
+		dryRuns:     make(map[string]*kerberosParams),
+		leaked:      make(map[string]*managedCache),
+		pods:        make(map[string]*api.PodSandbox),
+		backend:     backend,
+		mounter:     &fakeMounter{},
+		clock:       clock,
+		exec:        &fakeExec{},
+	}
+	p.cfg.Store(cfg)
+	p.containerRuntime.Store(lookupRuntime(runtimeContainerd))
+	rt := nritest.NewRuntime(p)
+	p.stub = rt.Stub()
+	t.Cleanup(func() {
+		p.cleaner.Stop()
+		p.renewals.Stop()
+		p.Lock()
+		defer p.Unlock()
+		for _, mc := range p.managed {
+			if path, err := ccachePath(mc.params.CCName); err == nil {
+				os.Remove(path)
+			}
+		}
+	})
+	return p, rt
+}
+
+func TestCreateContainerFailureUnmounts(t *testing.T) {
+	ctx := context.Background()
+	b := &fakeBackend{lifetime: time.Hour, renewable: 24 * time.Hour, errs: map[string][]error{"setup": {fmt.Errorf("%w: KDC unreachable", errCCacheFailed)}}}
+	p, rt := newTestPlugin(t, testConfigYAML+"strict: true\n", b)
+	pod := rt.Pod("default", "app", testAnnotations("alice", 61040))
+	addPodVolumes(p, pod)
+	before, _ := p.mounter.Mounts()
+	if err := rt.RunPod(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes := filepath.Join(defaultKubeletDir, "pods", pod.GetUid(), "volumes")
+	home := filepath.Join(volumes, "kubernetes.io~nfs", "home")
+	ctr := rt.Container(pod, "app",
+		&api.Mount{Destination: "/home/alice", Type: "bind", Source: home, Options: []string{"rbind", "rw"}},
+		&api.Mount{Destination: "/home/alice/.cache", Type: "bind", Source: filepath.Join(home, ".cache"), Options: []string{"rbind", "rw"}},
+		&api.Mount{Destination: "/tmp", Type: "bind", Source: filepath.Join(volumes, "kubernetes.io~empty-dir", "tmp"), Options: []string{"rbind", "rw"}})
+	if _, err := rt.CreateContainer(ctx, pod, ctr); !errors.Is(err, errSetupFailed) {
+		t.Fatalf("CreateContainer() error = %v, want %v", err, errSetupFailed)
+	}
+
+	// Only the NFS volume of the container is gone
+	after, _ := p.mounter.Mounts()
+	var got []string
+	for _, m := range after {
+		got = append(got, m.mountPoint)
+	}
+	var want []string
+	for _, m := range before {
+		if m.mountPoint != home {
+			want = append(want, m.mountPoint)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("mounts after the failed container %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+const (
+	// Condition of the node telling whether it can serve Kerberos workloads.
+	nodeKerberosCondition = "KerberosReady"
+
+	defaultNodeCheckInterval = 30 * time.Second
+	defaultKDCDownAfter      = 5 * time.Minute
+	defaultTaintEffect       = "NoSchedule"
+	// The condition is patched again after this long unchanged, so that its
+	// heartbeat tells it is current.
+	nodeConditionHeartbeat = 5 * time.Minute
+)
+
+// Node condition, with the heartbeat node conditions have.
+type nodeCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastHeartbeatTime  time.Time `json:"lastHeartbeatTime"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+type nodeTaint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"`
+}
+
+// Condition, label and taint of the node while the prerequisites of Kerberos
+// workloads on it are broken, so that new ones are not scheduled to it.
+type nodeConditionConfig struct {
+	// Publish the KerberosReady condition of the node, needs Kubernetes API
+	// access.
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval of the checks, 30s by default.
+	Interval duration `json:"interval,omitempty"`
+	// Time all known KDCs are unreachable for before the node is degraded,
+	// 5m by default.
+	KDCDownAfter duration `json:"kdcDownAfter,omitempty"`
+	// Host keytab checked to be readable and to have keys, not checked if
+	// empty.
+	HostKeytab string `json:"hostKeytab,omitempty"`
+	// Node label set to "false" while degraded and "true" otherwise, for node
+	// affinities of Kerberos workloads. None if empty.
+	Label string `json:"label,omitempty"`
+	// Taint set while degraded, for nodes of Kerberos workloads only, with
+	// TaintEffect, NoSchedule by default, or PreferNoSchedule. None if empty.
+	Taint       string `json:"taint,omitempty"`
+	TaintEffect string `json:"taintEffect,omitempty"`
+}
+
+func (c *nodeConditionConfig) validate() error {
+	for name, key := range map[string]string{"label": c.Label, "taint": c.Taint} {
+		if strings.ContainsAny(key, " =:,") {
+			return fmt.Errorf("%s: invalid key %q", name, key)
+		}
+	}
+	switch c.TaintEffect {
+	case "", "NoSchedule", "PreferNoSchedule":
+	default:
+		return fmt.Errorf("taintEffect must be NoSchedule or PreferNoSchedule, not %q", c.TaintEffect)
+	}
+	return nil
+}
+
+func (c *nodeConditionConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultNodeCheckInterval
+}
+
+func (c *nodeConditionConfig) kdcDownAfter() time.Duration {
+	if c.KDCDownAfter.Duration > 0 {
+		return c.KDCDownAfter.Duration
+	}
+	return defaultKDCDownAfter
+}
+
+func (c *nodeConditionConfig) taintEffect() string {
+	if c.TaintEffect != "" {
+		return c.TaintEffect
+	}
+	return defaultTaintEffect
+}
+
+// Publisher of the condition, label and taint of the node.
+type nodeConditionReporter struct {
+	cfg  nodeConditionConfig
+	kube *kubeClient
+	node string
+
+	sync.Mutex
+	// Condition last published, nil before the first.
+	published *nodeCondition
+	// Whether the node was last labelled and tainted degraded.
+	labelled *bool
+	tainted  *bool
+}
+
+func newNodeConditionReporter(cfg nodeConditionConfig, kube *kubeClient, node string) *nodeConditionReporter {
+	return &nodeConditionReporter{cfg: cfg, kube: kube, node: node}
+}
+
+// Problem with the prerequisites of Kerberos workloads of the node.
+type nodeProblem struct {
+	reason  string
+	message string
+}
+
+// Check the prerequisites of Kerberos workloads of the node periodically and
+// publish the result until the context is cancelled.
+func (p *plugin) runNodeChecks(ctx context.Context, r *nodeConditionReporter) {
+	for {
+		problems := p.nodeProblems(&r.cfg)
+		nodeReady.Set(boolValue(len(problems) == 0))
+		if err := r.publish(ctx, problems); err != nil && ctx.Err() == nil {
+			log.Warnf("failed to publish the %s condition of node %s: %v", nodeKerberosCondition, r.node, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.cfg.interval()):
+		}
+	}
+}
+
+// Broken prerequisites of Kerberos workloads on the node: rpc.gssd not
+// running, the host keytab unreadable or without keys, or all known KDCs
+// unreachable for longer than kdcDownAfter.
+func (p *plugin) nodeProblems(nc *nodeConditionConfig) []nodeProblem {
+	cfg := p.config()
+	var problems []nodeProblem
+	if !newGSSDManager(cfg.GSSD, cfg.GSSProxy.Enabled, false, p.exec).running(gssdProcessName) {
+		problems = append(problems, nodeProblem{"GSSDNotRunning", gssdProcessName + " is not running"})
+	}
+	if path := nc.HostKeytab; path != "" {
+		kt, err := keytab.Load(path)
+		if err == nil && len(kt.Entries) == 0 {
+			err = errors.New("no keys")
+		}
+		if err != nil {
+			problems = append(problems, nodeProblem{"HostKeytabInvalid", fmt.Sprintf("host keytab %s: %v", path, err)})
+		}
+	}
+	kdcs := p.knownKDCs()
+	if since := p.kdcs.downSince(kdcs); !since.IsZero() && p.clock.Now().Sub(since) > nc.kdcDownAfter() {
+		problems = append(problems, nodeProblem{"KDCUnreachable",
+			fmt.Sprintf("KDCs %s unreachable since %s", strings.Join(kdcAddresses(kdcs), ", "), since.UTC().Format(time.RFC3339))})
+	}
+	return problems
+}
+
+// Publish the condition of the node, and label and taint it, where
+// configured, when the state changed. The condition is patched again at
+// least every nodeConditionHeartbeat.
+func (r *nodeConditionReporter) publish(ctx context.Context, problems []nodeProblem) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	cond := nodeCondition{Type: nodeKerberosCondition, Status: "True", Reason: "KerberosReady",
+		Message: "rpc.gssd, the host keytab and the KDCs are usable", LastHeartbeatTime: now, LastTransitionTime: now}
+	if len(problems) > 0 {
+		var reasons, messages []string
+		for _, pr := range problems {
+			reasons = append(reasons, pr.reason)
+			messages = append(messages, pr.message)
+		}
+		cond.Status, cond.Reason, cond.Message = "False", reasons[0], strings.Join(messages, "; ")
+	}
+	degraded := cond.Status == "False"
+
+	r.Lock()
+	prev := r.published
+	labelled, tainted := r.labelled, r.tainted
+	r.Unlock()
+	path := "/api/v1/nodes/" + r.node
+
+	if prev == nil || prev.Status != cond.Status || prev.Reason != cond.Reason || prev.Message != cond.Message ||
+		now.Sub(prev.LastHeartbeatTime) >= nodeConditionHeartbeat {
+		if prev != nil && prev.Status == cond.Status {
+			cond.LastTransitionTime = prev.LastTransitionTime
+		}
+		if prev == nil || prev.Status != cond.Status {
+			if degraded {
+				log.Warnf("node %s degraded for Kerberos workloads: %s", r.node, cond.Message)
+			} else if prev != nil {
+				log.Infof("node %s ready for Kerberos workloads again", r.node)
+			}
+		}
+		patch := map[string]any{"status": map[string]any{"conditions": []nodeCondition{cond}}}
+		if err := r.kube.do(ctx, http.MethodPatch, path+"/status", "application/strategic-merge-patch+json", patch, nil); err != nil {
+			return err
+		}
+		r.Lock()
+		r.published = &cond
+		r.Unlock()
+	}
+
+	if r.cfg.Label != "" && (labelled == nil || *labelled != degraded) {
+		patch := map[string]any{"metadata": map[string]any{"labels": map[string]string{r.cfg.Label: fmt.Sprint(!degraded)}}}
+		if err := r.kube.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil); err != nil {
+			return err
+		}
+		r.Lock()
+		r.labelled = &degraded
+		r.Unlock()
+	}
+
+	if r.cfg.Taint != "" && (tainted == nil || *tainted != degraded) {
+		if err := r.taint(ctx, degraded); err != nil {
+			return err
+		}
+		r.Lock()
+		r.tainted = &degraded
+		r.Unlock()
+	}
+	return nil
+}
+
+// Add or remove the taint of the node. Taints are replaced as a whole, so
+// the node is read first and its resource version guards the update; a
+// conflict is retried by the next check.
+func (r *nodeConditionReporter) taint(ctx context.Context, degraded bool) error {
+	path := "/api/v1/nodes/" + r.node
+	var node struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Spec struct {
+			Taints []nodeTaint `json:"taints"`
+		} `json:"spec"`
+	}
+	if err := r.kube.do(ctx, http.MethodGet, path, "", nil, &node); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(node.Spec.Taints, func(t nodeTaint) bool { return t.Key == r.cfg.Taint })
+	if degraded == (i >= 0) && (i < 0 || node.Spec.Taints[i].Effect == r.cfg.taintEffect()) {
+		return nil
+	}
+	taints := slices.DeleteFunc(slices.Clone(node.Spec.Taints), func(t nodeTaint) bool { return t.Key == r.cfg.Taint })
+	if degraded {
+		taints = append(taints, nodeTaint{Key: r.cfg.Taint, Value: "true", Effect: r.cfg.taintEffect()})
+	} else if taints == nil {
+		taints = []nodeTaint{}
+	}
+	patch := map[string]any{
+		"metadata": map[string]any{"resourceVersion": node.Metadata.ResourceVersion},
+		"spec":     map[string]any{"taints": taints},
+	}
+	return r.kube.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+}
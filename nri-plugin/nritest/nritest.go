@@ -0,0 +1,348 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package nritest drives NRI plugins in tests as a container runtime would,
+// without one. A Runtime delivers the lifecycle events of pods and containers
+// to the handlers of a plugin, the ones it implements of the stub interfaces,
+// and keeps the state a runtime would synchronize the plugin with. Its Stub
+// stands in for the stub.Stub a plugin is connected through, recording the
+// container updates asked for.
+//
+// Together with fakes of the Mounter, Clock and Exec and of the
+// KerberosBackend of the Kerberos plugin, this lets tests check the decisions
+// of the plugin table-driven, from the annotations of pods to the adjustments
+// of their containers.
+package nritest
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+)
+
+// Name and version the Runtime configures plugins with.
+const (
+	RuntimeName    = "nritest"
+	RuntimeVersion = "v0.0.0"
+)
+
+// Runtime delivering pod and container events to a plugin.
+type Runtime struct {
+	plugin any
+
+	sync.Mutex
+	pods       map[string]*api.PodSandbox
+	containers map[string]*api.Container
+	updates    []*api.ContainerUpdate
+	ids        int
+}
+
+// Create a runtime for the plugin, which implements some of the stub
+// handler interfaces, like stub.RunPodInterface.
+func NewRuntime(plugin any) *Runtime {
+	return &Runtime{
+		plugin:     plugin,
+		pods:       map[string]*api.PodSandbox{},
+		containers: map[string]*api.Container{},
+	}
+}
+
+// Pod of a namespace with the annotations, with generated ids, not yet run.
+func (r *Runtime) Pod(namespace, name string, annotations map[string]string) *api.PodSandbox {
+	r.Lock()
+	defer r.Unlock()
+	r.ids++
+	return &api.PodSandbox{
+		Id:          fmt.Sprintf("pod-%d", r.ids),
+		Name:        name,
+		Uid:         fmt.Sprintf("00000000-0000-0000-0000-%012d", r.ids),
+		Namespace:   namespace,
+		Annotations: annotations,
+		Labels:      map[string]string{},
+	}
+}
+
+// Container of a pod with the mounts, with a generated id, not yet created.
+func (r *Runtime) Container(pod *api.PodSandbox, name string, mounts ...*api.Mount) *api.Container {
+	r.Lock()
+	defer r.Unlock()
+	r.ids++
+	return &api.Container{
+		Id:           fmt.Sprintf("ctr-%d", r.ids),
+		PodSandboxId: pod.GetId(),
+		Name:         name,
+		Annotations:  map[string]string{},
+		Labels:       map[string]string{},
+		Mounts:       mounts,
+		Linux:        &api.LinuxContainer{},
+	}
+}
+
+// Bind mount of a volume of the kubelet, as the runtime passes them.
+func BindMount(source, destination string, options ...string) *api.Mount {
+	return &api.Mount{
+		Source:      source,
+		Destination: destination,
+		Type:        "bind",
+		Options:     append([]string{"rbind"}, options...),
+	}
+}
+
+// Configure the plugin, if it implements stub.ConfigureInterface.
+func (r *Runtime) Configure(ctx context.Context, config string) (api.EventMask, error) {
+	if h, ok := r.plugin.(stub.ConfigureInterface); ok {
+		return h.Configure(ctx, config, RuntimeName, RuntimeVersion)
+	}
+	return 0, nil
+}
+
+// Synchronize the plugin with the pods and containers of the runtime, as when
+// it connects, if it implements stub.SynchronizeInterface.
+func (r *Runtime) Synchronize(ctx context.Context) error {
+	h, ok := r.plugin.(stub.SynchronizeInterface)
+	if !ok {
+		return nil
+	}
+	r.Lock()
+	pods := sortedValues(r.pods)
+	containers := sortedValues(r.containers)
+	r.Unlock()
+	updates, err := h.Synchronize(ctx, pods, containers)
+	r.update(updates)
+	return err
+}
+
+// Run a pod, delivering RunPodSandbox.
+func (r *Runtime) RunPod(ctx context.Context, pod *api.PodSandbox) error {
+	r.Lock()
+	r.pods[pod.GetId()] = pod
+	r.Unlock()
+	if h, ok := r.plugin.(stub.RunPodInterface); ok {
+		return h.RunPodSandbox(ctx, pod)
+	}
+	return nil
+}
+
+// Stop a pod, stopping its containers first.
+func (r *Runtime) StopPod(ctx context.Context, pod *api.PodSandbox) error {
+	for _, c := range r.podContainers(pod) {
+		if c.GetState() != api.ContainerState_CONTAINER_STOPPED {
+			if err := r.StopContainer(ctx, pod, c); err != nil {
+				return err
+			}
+		}
+	}
+	if h, ok := r.plugin.(stub.StopPodInterface); ok {
+		return h.StopPodSandbox(ctx, pod)
+	}
+	return nil
+}
+
+// Remove a pod, stopping it and removing its containers first.
+func (r *Runtime) RemovePod(ctx context.Context, pod *api.PodSandbox) error {
+	if err := r.StopPod(ctx, pod); err != nil {
+		return err
+	}
+	for _, c := range r.podContainers(pod) {
+		if err := r.RemoveContainer(ctx, pod, c); err != nil {
+			return err
+		}
+	}
+	r.Lock()
+	delete(r.pods, pod.GetId())
+	r.Unlock()
+	if h, ok := r.plugin.(stub.RemovePodInterface); ok {
+		return h.RemovePodSandbox(ctx, pod)
+	}
+	return nil
+}
+
+// Create a container, delivering CreateContainer and returning the
+// adjustment asked for. A container failed by the plugin is not created.
+func (r *Runtime) CreateContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) (*api.ContainerAdjustment, error) {
+	h, ok := r.plugin.(stub.CreateContainerInterface)
+	var adjust *api.ContainerAdjustment
+	if ok {
+		var (
+			updates []*api.ContainerUpdate
+			err     error
+		)
+		if adjust, updates, err = h.CreateContainer(ctx, pod, container); err != nil {
+			return nil, err
+		}
+		r.update(updates)
+	}
+	container.State = api.ContainerState_CONTAINER_CREATED
+	r.Lock()
+	r.containers[container.GetId()] = container
+	r.Unlock()
+	return adjust, nil
+}
+
+// Start a created container, delivering StartContainer and then
+// PostStartContainer.
+func (r *Runtime) StartContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) error {
+	container.State = api.ContainerState_CONTAINER_RUNNING
+	if h, ok := r.plugin.(stub.StartContainerInterface); ok {
+		if err := h.StartContainer(ctx, pod, container); err != nil {
+			return err
+		}
+	}
+	if h, ok := r.plugin.(stub.PostStartContainerInterface); ok {
+		return h.PostStartContainer(ctx, pod, container)
+	}
+	return nil
+}
+
+// Update the resources of a container, delivering UpdateContainer and then
+// PostUpdateContainer.
+func (r *Runtime) UpdateContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container, resources *api.LinuxResources) error {
+	if h, ok := r.plugin.(stub.UpdateContainerInterface); ok {
+		updates, err := h.UpdateContainer(ctx, pod, container, resources)
+		r.update(updates)
+		if err != nil {
+			return err
+		}
+	}
+	if h, ok := r.plugin.(stub.PostUpdateContainerInterface); ok {
+		return h.PostUpdateContainer(ctx, pod, container)
+	}
+	return nil
+}
+
+// Stop a container.
+func (r *Runtime) StopContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) error {
+	container.State = api.ContainerState_CONTAINER_STOPPED
+	if h, ok := r.plugin.(stub.StopContainerInterface); ok {
+		updates, err := h.StopContainer(ctx, pod, container)
+		r.update(updates)
+		return err
+	}
+	return nil
+}
+
+// Remove a container.
+func (r *Runtime) RemoveContainer(ctx context.Context, pod *api.PodSandbox, container *api.Container) error {
+	r.Lock()
+	delete(r.containers, container.GetId())
+	r.Unlock()
+	if h, ok := r.plugin.(stub.RemoveContainerInterface); ok {
+		return h.RemoveContainer(ctx, pod, container)
+	}
+	return nil
+}
+
+// Container updates the plugin asked for so far, from its handlers or
+// through the Stub.
+func (r *Runtime) Updates() []*api.ContainerUpdate {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Clone(r.updates)
+}
+
+func (r *Runtime) update(updates []*api.ContainerUpdate) {
+	r.Lock()
+	r.updates = append(r.updates, updates...)
+	r.Unlock()
+}
+
+func (r *Runtime) podContainers(pod *api.PodSandbox) []*api.Container {
+	r.Lock()
+	defer r.Unlock()
+	var containers []*api.Container
+	for _, c := range sortedValues(r.containers) {
+		if c.GetPodSandboxId() == pod.GetId() {
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
+
+type identified interface {
+	GetId() string
+}
+
+// Values of a map by id, in the order the ids were generated.
+func sortedValues[T identified](m map[string]T) []T {
+	values := make([]T, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	slices.SortFunc(values, func(a, b T) int {
+		return cmp.Or(cmp.Compare(len(a.GetId()), len(b.GetId())), strings.Compare(a.GetId(), b.GetId()))
+	})
+	return values
+}
+
+// Stub of the runtime, to set as the stub.Stub of a plugin.
+func (r *Runtime) Stub() *Stub {
+	return &Stub{runtime: r, stopped: make(chan struct{})}
+}
+
+// Stub standing in for the connection of a plugin to the runtime. Run
+// returns once stopped, and container updates are recorded by the Runtime.
+type Stub struct {
+	runtime *Runtime
+	once    sync.Once
+	stopped chan struct{}
+}
+
+var _ stub.Stub = &Stub{}
+
+func (s *Stub) Run(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	case <-s.stopped:
+		return nil
+	}
+}
+
+func (s *Stub) Start(_ context.Context) error {
+	return nil
+}
+
+func (s *Stub) Stop() {
+	s.once.Do(func() { close(s.stopped) })
+}
+
+func (s *Stub) Wait() {
+	<-s.stopped
+}
+
+func (s *Stub) UpdateContainers(updates []*api.ContainerUpdate) ([]*api.ContainerUpdate, error) {
+	s.runtime.update(updates)
+	return nil, nil
+}
+
+func (s *Stub) RegistrationTimeout() time.Duration {
+	return api.DefaultPluginRegistrationTimeout
+}
+
+func (s *Stub) RequestTimeout() time.Duration {
+	return api.DefaultPluginRequestTimeout
+}
@@ -0,0 +1,185 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kerberos settings a namespace gives its pods with namespaceDefaults, from
+// its labels and annotations under the pod annotation keys. Pods override
+// them with their own.
+type namespaceSettings struct {
+	realm, kdc, nfs, sec, ccacheType, nfsVersion string
+}
+
+// Settings of a namespace from its labels, overridden by its annotations.
+func newNamespaceSettings(ns *kubeNamespace, annotation func(string) string) (namespaceSettings, error) {
+	ann := maps.Clone(ns.Metadata.Labels)
+	if ann == nil {
+		ann = map[string]string{}
+	}
+	maps.Copy(ann, ns.Metadata.Annotations)
+	normalizeAnnotations(ann, annotation)
+
+	s := namespaceSettings{
+		realm:      ann[annotation("kerberos-realm")],
+		kdc:        ann[annotation("kerberos-kdc")],
+		nfs:        ann[annotation("kerberos-nfs")],
+		sec:        strings.ToLower(ann[annotation("kerberos-sec")]),
+		ccacheType: strings.ToUpper(ann[annotation("kerberos-ccache-type")]),
+		nfsVersion: ann[annotation("kerberos-nfs-version")],
+	}
+	if s.realm != "" && !realmRegexp.MatchString(s.realm) {
+		return namespaceSettings{}, fmt.Errorf("%s: realm %q must be upper case", annotation("kerberos-realm"), s.realm)
+	}
+	if err := validSec(s.sec); err != nil {
+		return namespaceSettings{}, fmt.Errorf("%s: %w", annotation("kerberos-sec"), err)
+	}
+	if err := validCCacheType(s.ccacheType); err != nil {
+		return namespaceSettings{}, fmt.Errorf("%s: %w", annotation("kerberos-ccache-type"), err)
+	}
+	if err := validNFSVersion(s.nfsVersion); err != nil {
+		return namespaceSettings{}, fmt.Errorf("%s: %w", annotation("kerberos-nfs-version"), err)
+	}
+	return s, nil
+}
+
+// KDC and NFS servers of the namespace for pods of the realm, none if the
+// namespace names another realm.
+func (s namespaceSettings) servers(realm string) (kdc, nfs string) {
+	if s.realm != "" && s.realm != realm {
+		return "", ""
+	}
+	return s.kdc, s.nfs
+}
+
+// Cache of the settings namespaces give their pods, kept up to date with a
+// watch of all namespaces.
+type namespaceDefaultsCache struct {
+	kube       *kubeClient
+	annotation func(string) string
+
+	sync.RWMutex
+	byNamespace map[string]namespaceSettings
+}
+
+func newNamespaceDefaultsCache(kube *kubeClient, annotation func(string) string) *namespaceDefaultsCache {
+	return &namespaceDefaultsCache{
+		kube:        kube,
+		annotation:  annotation,
+		byNamespace: map[string]namespaceSettings{},
+	}
+}
+
+// Settings of a namespace, none if it sets none. Safe to call on a nil cache.
+func (c *namespaceDefaultsCache) forNamespace(namespace string) namespaceSettings {
+	if c == nil {
+		return namespaceSettings{}
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.byNamespace[namespace]
+}
+
+// Keep the cache in sync until the context is cancelled.
+func (c *namespaceDefaultsCache) run(ctx context.Context) {
+	const maxBackoff = 2 * time.Minute
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		err := c.sync(ctx, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, errGone) {
+			log.Warnf("namespace watch failed, retrying in %s: %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+}
+
+// Settings of a namespace, logging invalid ones, which the namespace then
+// gives none of.
+func (c *namespaceDefaultsCache) settings(ns *kubeNamespace) namespaceSettings {
+	s, err := newNamespaceSettings(ns, c.annotation)
+	if err != nil {
+		log.Warnf("namespace %s: ignoring its Kerberos defaults: %v", ns.Metadata.Name, err)
+	}
+	return s
+}
+
+// List the namespaces and watch for changes until the watch ends.
+func (c *namespaceDefaultsCache) sync(ctx context.Context, synced func()) error {
+	list := struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*kubeNamespace `json:"items"`
+	}{}
+	if err := c.kube.do(ctx, http.MethodGet, namespacesPath, "", nil, &list); err != nil {
+		return err
+	}
+
+	defaults := map[string]namespaceSettings{}
+	for _, ns := range list.Items {
+		if s := c.settings(ns); s != (namespaceSettings{}) {
+			defaults[ns.Metadata.Name] = s
+		}
+	}
+	c.Lock()
+	c.byNamespace = defaults
+	c.Unlock()
+	synced()
+
+	rv := list.Metadata.ResourceVersion
+	return c.kube.watch(ctx, namespacesPath, rv, func(ev *watchEvent) error {
+		ns := &kubeNamespace{}
+		if err := json.Unmarshal(ev.Object, ns); err != nil {
+			return fmt.Errorf("failed to decode namespace: %w", err)
+		}
+		if ev.Type == "BOOKMARK" {
+			return nil
+		}
+
+		var s namespaceSettings
+		if ev.Type != "DELETED" {
+			s = c.settings(ns)
+		}
+		c.Lock()
+		if s == (namespaceSettings{}) {
+			delete(c.byNamespace, ns.Metadata.Name)
+		} else {
+			c.byNamespace[ns.Metadata.Name] = s
+		}
+		c.Unlock()
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/containerd/nri/pkg/api"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Add the OCI hooks of the hook directories matching a container to its
+// adjustment, for runtimes which do not run them themselves. Hooks match on
+// the annotations of the pod and the container, those of the container taking
+// precedence, on the command of the container and on it having bind mounts.
+func (p *plugin) injectHooks(l *logrus.Entry, cfg *config, pod *api.PodSandbox, container *api.Container, adjust *api.ContainerAdjustment) *api.ContainerAdjustment {
+	if !cfg.InjectHooks || p.mgr == nil {
+		return adjust
+	}
+	if p.runtime().name == runtimeCRIO {
+		// CRI-O runs the hooks of its hook directories itself
+		return adjust
+	}
+
+	annotations := maps.Clone(pod.GetAnnotations())
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	maps.Copy(annotations, container.GetAnnotations())
+	spec := &rspec.Spec{Process: &rspec.Process{Args: container.GetArgs()}}
+	if _, err := p.mgr.Hooks(spec, annotations, hasBindMounts(container)); err != nil {
+		l.Errorf("not injecting OCI hooks: %v", err)
+		return adjust
+	}
+	if spec.Hooks == nil {
+		return adjust
+	}
+
+	hooks := api.FromOCIHooks(spec.Hooks)
+	l.Infof("injecting %d OCI hooks", len(hooks.GetCreateRuntime())+len(hooks.GetCreateContainer())+
+		len(hooks.GetStartContainer())+len(hooks.GetPoststart())+len(hooks.GetPoststop()))
+	if adjust == nil {
+		adjust = &api.ContainerAdjustment{}
+	}
+	adjust.AddHooks(hooks)
+	return adjust
+}
+
+func hasBindMounts(container *api.Container) bool {
+	return slices.ContainsFunc(container.GetMounts(), isBindMount)
+}
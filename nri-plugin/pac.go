@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	stdlog "log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/sirupsen/logrus"
+)
+
+// Decoding of the MS-PAC of NFS service tickets.
+type pacConfig struct {
+	// Keytab of the NFS service principals to decrypt the NFS service tickets
+	// of managed credentials with, logging the groups in their PAC after each
+	// setup. Empty by default, for no decoding.
+	Keytab string `json:"keytab,omitempty"`
+}
+
+// Groups of the client in a PAC, as an NFS server mapping them sees them.
+type pacGroups struct {
+	// Account name and logon domain.
+	Name, Domain string
+	// SIDs of the client, of its primary group and of all its groups, the
+	// extra and resource group SIDs included.
+	User, PrimaryGroup string
+	Groups             []string
+}
+
+func (g *pacGroups) String() string {
+	return fmt.Sprintf("%s\\%s (%s), primary group %s, groups %s", g.Domain, g.Name, g.User, g.PrimaryGroup, strings.Join(g.Groups, ", "))
+}
+
+// Read a keytab file.
+func loadKeytab(path string) (*keytab.Keytab, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kt := &keytab.Keytab{}
+	if err := kt.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("invalid keytab %s: %w", path, err)
+	}
+	return kt, nil
+}
+
+// Decrypt a service ticket with the keytab of its service and decode the
+// groups in its PAC, nil if it has none or one without logon information, as
+// MIT KDCs issue.
+func ticketPAC(raw []byte, kt *keytab.Keytab) (*pacGroups, error) {
+	var tkt messages.Ticket
+	if err := tkt.Unmarshal(raw); err != nil {
+		return nil, fmt.Errorf("invalid ticket: %w", err)
+	}
+	if err := tkt.DecryptEncPart(kt, nil); err != nil {
+		return nil, fmt.Errorf("cannot decrypt ticket: %w", err)
+	}
+	ok, pac, err := tkt.GetPACType(kt, nil, stdlog.New(io.Discard, "", 0))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PAC: %w", err)
+	}
+	info := pac.KerbValidationInfo
+	if !ok || info == nil {
+		return nil, nil
+	}
+	domain := info.LogonDomainID.String()
+	return &pacGroups{
+		Name:         info.EffectiveName.Value,
+		Domain:       info.LogonDomainName.Value,
+		User:         fmt.Sprintf("%s-%d", domain, info.UserID),
+		PrimaryGroup: fmt.Sprintf("%s-%d", domain, info.PrimaryGroupID),
+		Groups:       info.GetGroupMembershipSIDs(),
+	}, nil
+}
+
+// PACs of the NFS service tickets in a credential cache, by service
+// principal, nil for tickets without one.
+func servicePACs(ccname string, kt *keytab.Keytab) (map[string]*pacGroups, error) {
+	entries, err := readCCache(ccname)
+	if err != nil {
+		return nil, err
+	}
+	pacs := map[string]*pacGroups{}
+	for _, e := range entries {
+		if len(e.server.NameString) < 2 || e.server.NameString[0] != "nfs" {
+			continue
+		}
+		service := e.server.PrincipalNameString() + "@" + e.serverRealm
+		if pacs[service], err = ticketPAC(e.ticket, kt); err != nil {
+			return nil, fmt.Errorf("%s: %w", service, err)
+		}
+	}
+	return pacs, nil
+}
+
+// Log the groups in the PACs of the NFS service tickets of the credentials,
+// those NFS servers mapping PACs give the client.
+func logServicePACs(l *logrus.Entry, cfg *pacConfig, kp *kerberosParams) {
+	kt, err := loadKeytab(cfg.Keytab)
+	if err != nil {
+		l.Warnf("cannot decode PACs: %v", err)
+		return
+	}
+	pacs, err := servicePACs(kp.CCName, kt)
+	if err != nil {
+		l.Warnf("cannot decode PACs of %s: %v", kp.Principal(), err)
+		return
+	}
+	if len(pacs) == 0 {
+		l.Infof("no NFS service tickets of %s to decode PACs of", kp.Principal())
+	}
+	for _, service := range slices.Sorted(maps.Keys(pacs)) {
+		groups := pacs[service]
+		if groups == nil {
+			l.Infof("%s: ticket of %s without PAC logon information, the NFS server maps the principal itself", service, kp.Principal())
+			continue
+		}
+		l.Infof("%s: PAC of %s: %s", service, kp.Principal(), groups)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Pod annotation, without prefix, referencing a kubernetes.io/tls Secret, e.g.
+// of a cert-manager Certificate, to obtain the TGT with by PKINIT.
+const pkinitSecretAnnotation = "kerberos-pkinit-secret"
+
+// Pod annotation, without prefix, asking for an anonymous TGT by anonymous
+// PKINIT instead of credentials of a principal, with "true".
+const anonymousAnnotation = "kerberos-anonymous"
+
+const (
+	// Principal of anonymous tickets, RFC 8062.
+	anonymousPrincipal = "WELLKNOWN/ANONYMOUS@WELLKNOWN:ANONYMOUS"
+	// User anonymous workloads are known as in logs, metrics and file names.
+	anonymousUser = "anonymous"
+)
+
+// Node certificate used for PKINIT by the pods of some namespaces, e.g.
+// issued by cert-manager and mounted into the plugin.
+type pkinitConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// CA of the KDC certificates, the anchors of krb5.conf if empty.
+	CAFile string `json:"caFile,omitempty"`
+	// Namespaces whose pods use the certificate unless they reference other credentials.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Namespaces whose pods may ask for anonymous tickets, verifying the KDC
+	// certificate with CAFile.
+	AnonymousNamespaces []string `json:"anonymousNamespaces,omitempty"`
+}
+
+// Certificate and key files a TGT is obtained with by PKINIT.
+type pkinitIdentity struct {
+	Cert string
+	Key  string
+	// CA of the KDC certificates, if any.
+	Anchors string
+}
+
+// X.509 credentials from a kubernetes.io/tls Secret referenced by a pod annotation.
+type pkinitSecretSource struct {
+	kube       *kubeClient
+	annotation string
+	ref        string
+}
+
+func (s *pkinitSecretSource) Name() string {
+	return "certificate Secret " + s.ref
+}
+
+func (s *pkinitSecretSource) Fetch(ctx context.Context, pod *api.PodSandbox, _ *kerberosParams) (*credential, error) {
+	if s.kube == nil {
+		return nil, fmt.Errorf("%s set but no Kubernetes API access configured", s.annotation)
+	}
+
+	namespace, name, found := strings.Cut(s.ref, "/")
+	if !found {
+		namespace, name = pod.GetNamespace(), s.ref
+	}
+	if namespace != pod.GetNamespace() {
+		return nil, fmt.Errorf("certificate Secret is not in the pod namespace %q", pod.GetNamespace())
+	}
+
+	data, err := s.kube.getSecretData(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data["tls.crt"]) == 0 || len(data["tls.key"]) == 0 {
+		return nil, errors.New(`no "tls.crt" and "tls.key" keys`)
+	}
+
+	return &credential{Certificate: data["tls.crt"], Key: data["tls.key"], CA: data["ca.crt"]}, nil
+}
+
+// X.509 credentials of the node, from files.
+type pkinitNodeSource struct {
+	cfg pkinitConfig
+}
+
+func (s *pkinitNodeSource) Name() string {
+	return "node certificate " + s.cfg.CertFile
+}
+
+// Check whether the pods of the namespace use the node certificate.
+func (cfg *pkinitConfig) handles(namespace string) bool {
+	return cfg.CertFile != "" && slices.Contains(cfg.Namespaces, namespace)
+}
+
+// Check whether the pods of the namespace may ask for anonymous tickets.
+func (cfg *pkinitConfig) allowsAnonymous(namespace string) bool {
+	return slices.Contains(cfg.AnonymousNamespaces, namespace)
+}
+
+func (s *pkinitNodeSource) Fetch(context.Context, *api.PodSandbox, *kerberosParams) (*credential, error) {
+	cred := &credential{}
+	var err error
+	if cred.Certificate, err = os.ReadFile(s.cfg.CertFile); err != nil {
+		return nil, err
+	}
+	if cred.Key, err = os.ReadFile(s.cfg.KeyFile); err != nil {
+		return nil, err
+	}
+	if s.cfg.CAFile != "" {
+		if cred.CA, err = os.ReadFile(s.cfg.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return cred, nil
+}
+
+// Store X.509 credentials for a pod in the node-local keytab directory.
+func (p *plugin) storePodCertificate(pod *api.PodSandbox, user string, cred *credential) (*pkinitIdentity, error) {
+	id := &pkinitIdentity{}
+	var err error
+	if id.Cert, err = p.storePodFile(pod, user+".crt", cred.Certificate); err != nil {
+		return nil, err
+	}
+	if id.Key, err = p.storePodFile(pod, user+".key", cred.Key); err != nil {
+		return nil, err
+	}
+	if len(cred.CA) > 0 {
+		if id.Anchors, err = p.storePodFile(pod, user+"-ca.crt", cred.CA); err != nil {
+			return nil, err
+		}
+	}
+	return id, nil
+}
+
+// Obtain a TGT by PKINIT with kinit, anonymous PKINIT for anonymous
+// workloads, armored with the FAST armor cache if given, and hand the
+// credential cache to the workload.
+func pkinit(ctx context.Context, ex Exec, kp *kerberosParams, armor string) error {
+	path, err := ccachePath(kp.CCName)
+	if err != nil {
+		return err
+	}
+
+	o := &kinitOptions{CCName: "FILE:" + path, Principal: kp.Principal(), Realm: kp.Realm, Armor: armor}
+	id := kp.PKINIT
+	if kp.Anonymous != nil {
+		id, o.Anonymous = kp.Anonymous, true
+	} else {
+		o.Cert, o.Key = id.Cert, id.Key
+	}
+	o.Anchors = id.Anchors
+	if err := runKinit(ctx, ex, kp, "", o); err != nil {
+		return fmt.Errorf("PKINIT for %s failed: %w", kp.Principal(), err)
+	}
+	if err := chownCCache(kp, path); err != nil {
+		return err
+	}
+	loggerFrom(ctx).Debugf("obtained TGT for %s by PKINIT into %s", kp.Principal(), filepath.Base(path))
+	return nil
+}
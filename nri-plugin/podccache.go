@@ -0,0 +1,468 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Host directory holding a credential cache directory per pod.
+	defaultCCacheDir = "/var/lib/krb5-cc"
+	// Container path the pod credential cache directory is mounted at.
+	defaultCCacheMountPath = "/var/run/krb5cc"
+	// Name of the credential cache directory in the kubelet pod directory.
+	kubeletCCacheDirName = "krb5-cc"
+	// Name of the generated krb5.conf in the pod credential cache directory.
+	podKrb5ConfName = "krb5.conf"
+	// Container path the generated krb5.conf is mounted at.
+	krb5ConfMountPath = "/etc/krb5.conf"
+	// KCM socket of the node, mounted at the same path.
+	defaultKCMSocket = "/var/run/.heim_org.h5l.kcm-socket"
+	// Name of the cache in a DIR pod credential cache.
+	dirCCacheName = "tkt"
+)
+
+// Layouts of the pod credential cache directories on the host.
+const (
+	// <ccacheDir>/<pod uid>, the default.
+	ccacheLayoutFlat = "flat"
+	// <kubelet dir>/pods/<pod uid>/krb5-cc, next to the volumes of the pod,
+	// on the file system and with the mount propagation the kubelet
+	// directory has on the distribution.
+	ccacheLayoutKubelet = "kubelet"
+)
+
+func validCCacheDirLayout(layout string) error {
+	switch layout {
+	case "", ccacheLayoutFlat, ccacheLayoutKubelet:
+		return nil
+	}
+	return fmt.Errorf("unknown credential cache directory layout %q, must be flat or kubelet", layout)
+}
+
+// Check a propagation of the mounts into containers, an empty one meaning
+// that of the runtime, rprivate.
+func validMountPropagation(propagation string) error {
+	switch propagation {
+	case "", "rprivate", "rslave", "rshared":
+		return nil
+	}
+	return fmt.Errorf("unknown mount propagation %q, must be rprivate, rslave or rshared", propagation)
+}
+
+// Credential cache types the pod can be given.
+const (
+	ccacheTypeFile    = "FILE"
+	ccacheTypeDir     = "DIR"
+	ccacheTypeKeyring = "KEYRING"
+	ccacheTypeKCM     = "KCM"
+)
+
+// Check a pod credential cache type, an empty one meaning the default.
+func validCCacheType(typ string) error {
+	switch typ {
+	case "", ccacheTypeFile, ccacheTypeDir, ccacheTypeKeyring, ccacheTypeKCM:
+		return nil
+	}
+	return fmt.Errorf("unknown credential cache type %q, must be FILE, DIR, KEYRING or KCM", typ)
+}
+
+// Host directory of the pod credential cache directories.
+func (p *plugin) ccacheDir() string {
+	if dir := p.config().CCacheDir; dir != "" {
+		return dir
+	}
+	return defaultCCacheDir
+}
+
+// Make the flat pod credential cache directory a shared mount of its own
+// where containers get rslave or rshared mounts of the pod directories in
+// it, for mounts made in these afterwards, as by podTmpfs, to propagate into
+// the containers. The kubelet directory of the kubelet layout is shared by
+// the kubelet.
+func (p *plugin) shareCCacheDir(mounter Mounter) error {
+	cfg := p.config()
+	if cfg.CCacheMountPropagation == "" || cfg.CCacheMountPropagation == "rprivate" || cfg.CCacheDirLayout == ccacheLayoutKubelet {
+		return nil
+	}
+	dir := p.ccacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	mounts, err := mounter.Mounts()
+	if err != nil {
+		return err
+	}
+	if m := mountOf(mounts, dir); m == nil || m.mountPoint != filepath.Clean(dir) {
+		if err := unix.Mount(dir, dir, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %w", dir, err)
+		}
+	}
+	if err := unix.Mount("", dir, "", unix.MS_SHARED|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to make %s a shared mount: %w", dir, err)
+	}
+	return nil
+}
+
+// Host directory of the credential caches of a pod.
+func (p *plugin) podCCacheDir(pod *api.PodSandbox) string {
+	if p.config().CCacheDirLayout == ccacheLayoutKubelet {
+		return filepath.Join(p.config().MountCheck.kubeletDir(), "pods", pod.GetUid(), kubeletCCacheDirName)
+	}
+	return filepath.Join(p.ccacheDir(), pod.GetUid())
+}
+
+// Credential cache directories of pods and containers on the host, with the
+// uid of their pod.
+func (p *plugin) podCCacheDirs() map[string]string {
+	dirs := map[string]string{}
+	if p.config().CCacheDirLayout == ccacheLayoutKubelet {
+		paths, _ := filepath.Glob(filepath.Join(p.config().MountCheck.kubeletDir(), "pods", "*", kubeletCCacheDirName+"*"))
+		for _, path := range paths {
+			if uid := filepath.Base(filepath.Dir(path)); podUIDRegexp.MatchString(uid) {
+				dirs[path] = uid
+			}
+		}
+		return dirs
+	}
+	entries, _ := os.ReadDir(p.ccacheDir())
+	for _, e := range entries {
+		if uid, _, _ := strings.Cut(e.Name(), "."); e.IsDir() && podUIDRegexp.MatchString(uid) {
+			dirs[filepath.Join(p.ccacheDir(), e.Name())] = uid
+		}
+	}
+	return dirs
+}
+
+// Host directory of the credential caches of the pod or, for a container with
+// credentials of its own, of the container. Container directories sit next to
+// that of the pod, not in it, where the other containers would see them. Pods
+// sharing their credential cache collection in a volume have it there.
+func (p *plugin) ccacheDirOf(pod *api.PodSandbox, kp *kerberosParams) string {
+	if kp.SharedVolume != "" {
+		return p.emptyDirPath(pod, kp.SharedVolume)
+	}
+	if kp.Container != "" {
+		return p.podCCacheDir(pod) + "." + kp.Container
+	}
+	return p.podCCacheDir(pod)
+}
+
+// Container path of the pod credential cache directory.
+func (p *plugin) ccacheMountPath() string {
+	if p.config().CCacheMountPath != "" {
+		return p.config().CCacheMountPath
+	}
+	return defaultCCacheMountPath
+}
+
+// Copy the host credential cache into the pod credential cache of its type:
+// a file in the pod credential cache directory, a DIR collection there, or
+// the persistent keyring of the uid. With KCM the pod uses the node KCM daemon
+// and nothing is copied. A generated krb5.conf goes into the directory in any
+// case. The host cache stays in place, since that is where rpc.gssd looks for
+// it. In gss-proxy mode the pod gets no cache, gss-proxy is configured to use
+// the host cache instead. Caches of further principals of the pod go next to
+// that of the pod. Returns where the cache was published to.
+func (p *plugin) publishCCache(pod *api.PodSandbox, kp *kerberosParams) (string, error) {
+	if kp.Secondary {
+		return p.publishPrincipalCCache(pod, kp)
+	}
+	src, err := ccachePath(kp.CCName)
+	if err != nil {
+		return "", err
+	}
+
+	dir := p.ccacheDirOf(pod, kp)
+	tmpfs := p.config().PodTmpfs
+	gid, file := kp.ccacheGID(), os.FileMode(0600)
+	if err := tmpfs.makeDir(dir, int(kp.UID), gid); err != nil {
+		return "", fmt.Errorf("failed to create pod credential cache directory: %w", err)
+	}
+	if len(kp.GIDs) > 0 {
+		var mode os.FileMode
+		mode, file = kp.ccacheModes()
+		if err := os.Chmod(dir, mode); err != nil {
+			return "", fmt.Errorf("failed to set pod credential cache directory permissions: %w", err)
+		}
+	}
+
+	var dst string
+	switch {
+	case kp.GSSProxy:
+		cfg := p.config().GSSProxy
+		if err := cfg.configure(kp); err != nil {
+			return "", err
+		}
+		dst = cfg.stanzaPath(kp.UID)
+	case kp.CCacheType == ccacheTypeDir:
+		dst = filepath.Join(dir, dirCCacheName)
+		if err := copyCCache(src, dst, int(kp.UID), gid, file); err != nil {
+			return "", err
+		}
+		if err := writePodFile(filepath.Join(dir, "primary"), []byte(dirCCacheName+"\n"), int(kp.UID), gid); err != nil {
+			return "", err
+		}
+		if err := os.Chmod(filepath.Join(dir, "primary"), file); err != nil {
+			return "", err
+		}
+	case kp.CCacheType == ccacheTypeKeyring:
+		entries, err := readCCache(kp.CCName)
+		if err != nil {
+			return "", err
+		}
+		if err := writeKeyringCCache(int(kp.UID), int(kp.GID), entries); err != nil {
+			return "", err
+		}
+		dst = keyringCCName(kp.UID)
+	case kp.CCacheType == ccacheTypeKCM:
+		dst = p.kcmSocket()
+	default:
+		dst = filepath.Join(dir, filepath.Base(src))
+		if err := copyCCache(src, dst, int(kp.UID), gid, file); err != nil {
+			return "", err
+		}
+	}
+
+	ccname := p.containerCCName(kp)
+	if kp.GSSProxy {
+		ccname = ""
+	}
+	conf, err := renderKrb5Conf(kp, ccname)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate krb5.conf: %w", err)
+	}
+	// #nosec G306:gosec -- krb5.conf holds no secrets and must be readable by the workload
+	if err := os.WriteFile(filepath.Join(dir, podKrb5ConfName), []byte(conf), 0644); err != nil {
+		return "", fmt.Errorf("failed to write krb5.conf: %w", err)
+	}
+	if len(kp.HostAliases) > 0 {
+		if err := p.writePodHosts(pod, kp, dir); err != nil {
+			return "", err
+		}
+	}
+	selinux := p.config().SELinux
+	if err := selinux.labelDir(dir); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+// Credential cache name as seen from inside the container.
+func (p *plugin) containerCCName(kp *kerberosParams) string {
+	switch kp.CCacheType {
+	case ccacheTypeDir:
+		return "DIR:" + p.ccacheMountPath()
+	case ccacheTypeKeyring:
+		uid, _, _ := kp.containerIDs()
+		return keyringCCName(uid)
+	case ccacheTypeKCM:
+		return "KCM:"
+	}
+	src, _ := ccachePath(kp.CCName)
+	return "FILE:" + filepath.Join(p.ccacheMountPath(), filepath.Base(src))
+}
+
+// Path of the node KCM socket.
+func (p *plugin) kcmSocket() string {
+	if p.config().KCMSocket != "" {
+		return p.config().KCMSocket
+	}
+	return defaultKCMSocket
+}
+
+// Atomically write a small file of the pod credential cache directory, owned by uid/gid.
+func writePodFile(path string, data []byte, uid, gid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := tmp.Chown(uid, gid); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set %s ownership: %w", filepath.Base(path), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Atomically copy a credential cache file, owned by uid/gid with the mode,
+// holding the locks of both, see lockCCacheFile.
+func copyCCache(src, dst string, uid, gid int, mode os.FileMode) error {
+	in, err := openCCacheLocked(src)
+	if err != nil {
+		return fmt.Errorf("failed to open credential cache: %w", err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create credential cache copy: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy credential cache: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set credential cache permissions: %w", err)
+	}
+	if err := tmp.Chown(uid, gid); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set credential cache ownership: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to copy credential cache: %w", err)
+	}
+
+	return replaceCCache(tmp.Name(), dst)
+}
+
+// Remove the credential cache directories of a pod and its containers, and
+// clear its shared credential cache volume.
+func (p *plugin) removePodCCacheDir(pod *api.PodSandbox) error {
+	if pod.GetUid() == "" {
+		return nil
+	}
+	if err := p.clearSharedCCache(pod); err != nil {
+		return err
+	}
+	dirs, _ := filepath.Glob(p.podCCacheDir(pod) + ".*")
+	for _, dir := range append(dirs, p.podCCacheDir(pod)) {
+		if err := removePodDir(dir); err != nil {
+			return fmt.Errorf("failed to remove pod credential cache directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// Adjustment mounting the pod credential cache directory and the generated
+// krb5.conf into a container, the hosts file with the host aliases of the pod
+// over the one of the kubelet, and the node KCM socket for KCM caches, setting
+// the replay cache environment and pointing KRB5CCNAME at the cache. In gss-proxy mode the gss-proxy socket is
+// mounted and GSS_USE_PROXY set instead of KRB5CCNAME. Anything the container
+// already sets up itself is left alone.
+func (p *plugin) podAdjustment(pod *api.PodSandbox, container *api.Container, kp *kerberosParams) *api.ContainerAdjustment {
+	adjust := &api.ContainerAdjustment{}
+	dir := p.ccacheDirOf(pod, kp)
+
+	if dest, shared := p.containerCCacheMountPath(container, dir, kp); !shared && !hasMount(container, dest) {
+		options := []string{"rbind", "rw", "nosuid", "nodev", "noexec"}
+		if propagation := p.config().CCacheMountPropagation; propagation != "" {
+			options = append(options, propagation)
+		}
+		adjust.AddMount(&api.Mount{
+			Destination: dest,
+			Type:        "bind",
+			Source:      dir,
+			Options:     options,
+		})
+	}
+	if !hasMount(container, krb5ConfMountPath) {
+		adjust.AddMount(&api.Mount{
+			Destination: krb5ConfMountPath,
+			Type:        "bind",
+			Source:      filepath.Join(dir, podKrb5ConfName),
+			Options:     []string{"bind", "ro", "nosuid", "nodev", "noexec"},
+		})
+	}
+	if len(kp.HostAliases) > 0 && kubeletHosts(container) {
+		adjust.RemoveMount(hostsMountPath)
+		adjust.AddMount(&api.Mount{
+			Destination: hostsMountPath,
+			Type:        "bind",
+			Source:      filepath.Join(dir, podHostsName),
+			Options:     []string{"bind", "ro", "nosuid", "nodev", "noexec"},
+		})
+	}
+	if sock := p.kcmSocket(); kp.CCacheType == ccacheTypeKCM && !hasMount(container, sock) {
+		adjust.AddMount(&api.Mount{
+			Destination: sock,
+			Type:        "bind",
+			Source:      sock,
+			Options:     []string{"bind", "rw", "nosuid", "nodev", "noexec"},
+		})
+	}
+	for _, m := range p.autofs.mounts(pod, kp) {
+		if !hasMount(container, m.Destination) {
+			adjust.AddMount(m)
+		}
+	}
+	rcache := p.config().Krb5Conf.ReplayCache
+	rcache.adjust(container, adjust)
+	if kp.GSSProxy {
+		sock := p.config().GSSProxy.socket()
+		if !hasMount(container, sock) {
+			adjust.AddMount(&api.Mount{
+				Destination: sock,
+				Type:        "bind",
+				Source:      sock,
+				Options:     []string{"bind", "rw", "nosuid", "nodev", "noexec"},
+			})
+		}
+		if !hasEnv(container, "GSS_USE_PROXY") {
+			adjust.AddEnv("GSS_USE_PROXY", "yes")
+		}
+		if !hasEnv(container, "GSSPROXY_SOCKET") {
+			adjust.AddEnv("GSSPROXY_SOCKET", sock)
+		}
+		return adjust
+	}
+	if !hasEnv(container, "KRB5CCNAME") {
+		adjust.AddEnv("KRB5CCNAME", p.containerCCNameOf(pod, container, kp))
+	}
+
+	return adjust
+}
+
+// Check whether the container has a mount at the given path.
+func hasMount(container *api.Container, dest string) bool {
+	for _, m := range container.GetMounts() {
+		if filepath.Clean(m.GetDestination()) == filepath.Clean(dest) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the container sets the given environment variable.
+func hasEnv(container *api.Container, key string) bool {
+	for _, e := range container.GetEnv() {
+		if k, _, _ := strings.Cut(e, "="); k == key {
+			return true
+		}
+	}
+	return false
+}
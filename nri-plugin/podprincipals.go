@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Further principals of the pod, comma separated.
+	principalsAnnotation = "kerberos-principals"
+	// Principal whose credentials a container uses by default, suffixed with
+	// the container name.
+	ccachePrincipalAnnotation = "kerberos-ccache-principal"
+)
+
+// Parse a list of further principals, separated by commas, into their names
+// without realm. Principals must be in the realm of the pod, if given.
+func parsePrincipals(value, realm string) ([]string, error) {
+	var users []string
+	for _, principal := range strings.Split(value, ",") {
+		principal = strings.TrimSpace(principal)
+		if principal == "" {
+			continue
+		}
+		user, r, _ := strings.Cut(principal, "@")
+		if err := validateUser(user); err != nil {
+			return nil, err
+		}
+		if r != "" && realm != "" && r != realm {
+			return nil, fmt.Errorf("%q must be in realm %s of the pod", principal, realm)
+		}
+		if !slices.Contains(users, user) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// Parameters for the credentials of a further principal of the pod, kept in a
+// cache next to that of the pod in its collection.
+func (kp *kerberosParams) forPrincipal(user string) *kerberosParams {
+	sp := *kp
+	path, _ := ccachePath(kp.CCName)
+	sp.User, sp.Name, sp.Password, sp.Keytab, sp.PKINIT = user, "", "", "", nil
+	sp.CCName = "DIR::" + filepath.Join(filepath.Dir(path), dirCCacheName+"."+user)
+	sp.VolumePrincipals, sp.Principals, sp.Automounts = nil, nil, nil
+	sp.Secondary = true
+	sp.GSSProxy = false
+	return &sp
+}
+
+// Credentials for a volume or further principal of a pod rather than its own,
+// which are not published to the pod as its credentials.
+func (kp *kerberosParams) secondary() bool {
+	return len(kp.Volumes) > 0 || kp.Secondary
+}
+
+// Obtain the credentials of the further principals of the pod into its
+// credential cache collection, and publish them next to its own. Credentials
+// still valid in the collection, as after a restart, are kept.
+func (p *plugin) setupPodPrincipals(ctx context.Context, l *logrus.Entry, pod *api.PodSandbox, kp *kerberosParams) error {
+	if len(kp.Principals) == 0 || pod.GetUid() == "" {
+		return nil
+	}
+	for _, user := range kp.Principals {
+		sp := kp.forPrincipal(user)
+		if p.managedParamsOf(managedKey(pod, sp)) != nil {
+			continue
+		}
+		if err := checkCCache(sp.CCName, sp.Realm, p.clock.Now().Add(syncMinLifetime)); err != nil {
+			if err := p.setupPrincipal(ctx, l, pod, sp); err != nil {
+				return fmt.Errorf("setup of credentials for %s failed: %w", sp.Principal(), err)
+			}
+		}
+		path, err := p.publishCCache(pod, sp)
+		if err != nil {
+			return fmt.Errorf("failed to publish credential cache of %s: %w", sp.Principal(), err)
+		}
+		l.Infof("credential cache of %s published to the pod as %s", sp.Principal(), path)
+		p.track(pod, sp, l)
+	}
+	return nil
+}
+
+// Copy the cache of a further principal of the pod into the pod credential
+// cache directory, next to that of the pod and named as in the collection:
+// a cache of the collection for DIR pods, a file of its own for FILE pods.
+func (p *plugin) publishPrincipalCCache(pod *api.PodSandbox, kp *kerberosParams) (string, error) {
+	src, err := ccachePath(kp.CCName)
+	if err != nil {
+		return "", err
+	}
+	dir := p.ccacheDirOf(pod, kp)
+	gid, file := kp.ccacheGID(), os.FileMode(0600)
+	if err := p.config().PodTmpfs.makeDir(dir, int(kp.UID), gid); err != nil {
+		return "", fmt.Errorf("failed to create pod credential cache directory: %w", err)
+	}
+	if len(kp.GIDs) > 0 {
+		_, file = kp.ccacheModes()
+	}
+	dst := filepath.Join(dir, filepath.Base(src))
+	if err := copyCCache(src, dst, int(kp.UID), gid, file); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// Credential cache name of a further principal of the pod as seen from inside
+// a container mounting the pod credential cache directory at dest.
+func (p *plugin) principalCCName(kp *kerberosParams, dest, user string) string {
+	path := filepath.Join(dest, dirCCacheName+"."+user)
+	if kp.CCacheType == ccacheTypeDir {
+		return "DIR::" + path
+	}
+	return "FILE:" + path
+}
+
+// Credential cache name a container of the pod is given: that of the
+// principal its annotation selects, if one of the further principals of the
+// pod, or that of the pod.
+func (p *plugin) containerCCNameOf(pod *api.PodSandbox, container *api.Container, kp *kerberosParams) string {
+	ccname := p.containerCCName(kp)
+	dest, shared := p.containerCCacheMountPath(container, p.ccacheDirOf(pod, kp), kp)
+	if shared {
+		ccname = "DIR:" + dest
+	}
+	user, ok := pod.GetAnnotations()[p.config().containerAnnotation(ccachePrincipalAnnotation, container.GetName())]
+	user, _, _ = strings.Cut(user, "@")
+	if !ok || user == kp.User {
+		return ccname
+	}
+	if !slices.Contains(kp.Principals, user) {
+		l := containerLogger(pod, container)
+		l.Warnf("%s is not a principal of the pod", user)
+		p.events.warn(pod, reasonConfigIncomplete, "%s: %s is not one of the principals of the pod",
+			p.config().containerAnnotation(ccachePrincipalAnnotation, container.GetName()), user)
+		return ccname
+	}
+	return p.principalCCName(kp, dest, user)
+}
@@ -0,0 +1,357 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMountStatsInterval = time.Minute
+
+// Statistics of the NFS mounts of pods, as the NFS client keeps them in the
+// mount namespace of their containers, and the expiry of the GSS contexts
+// they are accessed with, so that I/O errors of a pod can be told apart from
+// the lifecycle of its credentials. The admin API collects them on request,
+// with enabled they are exported as metrics as well.
+type mountStatsConfig struct {
+	// Export the statistics of the managed pods as metrics.
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval of the collection, 1m by default.
+	Interval duration `json:"interval,omitempty"`
+}
+
+func (c *mountStatsConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultMountStatsInterval
+}
+
+// Statistics of an NFS mount, from mountstats. The RPC counts are those of
+// all the operations of the mount.
+type nfsMountStats struct {
+	Device     string `json:"device"`
+	MountPoint string `json:"mountPoint"`
+	Sec        string `json:"sec,omitempty"`
+	Vers       string `json:"vers,omitempty"`
+	AgeSeconds uint64 `json:"ageSeconds"`
+	// Bytes read and written by the applications, cached or direct.
+	ReadBytes  uint64 `json:"readBytes"`
+	WriteBytes uint64 `json:"writeBytes"`
+	// Bytes read from and written to the server.
+	ServerReadBytes  uint64 `json:"serverReadBytes"`
+	ServerWriteBytes uint64 `json:"serverWriteBytes"`
+	RPCs             uint64 `json:"rpcs"`
+	Retransmissions  uint64 `json:"retransmissions"`
+	Timeouts         uint64 `json:"timeouts"`
+	// Operations the server failed, with statvers 1.1 and later.
+	Errors uint64 `json:"errors"`
+}
+
+// GSS context of a pod with an NFS server, which is established with a
+// service ticket of the credential cache and expires with it.
+type gssContext struct {
+	Service string    `json:"service"`
+	Expires time.Time `json:"expires"`
+}
+
+// Statistics of the managed credentials of a pod or of a container with
+// credentials of its own.
+type podStats struct {
+	Key       string          `json:"key"`
+	Namespace string          `json:"namespace"`
+	Pod       string          `json:"pod"`
+	Container string          `json:"container,omitempty"`
+	Principal string          `json:"principal"`
+	Collected time.Time       `json:"collected"`
+	Mounts    []nfsMountStats `json:"mounts"`
+	Contexts  []gssContext    `json:"contexts"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Parse the NFS mounts of a mountstats file.
+func parseMountStats(r io.Reader) ([]nfsMountStats, error) {
+	var (
+		mounts []nfsMountStats
+		cur    *nfsMountStats
+		perOp  bool
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if rest, ok := strings.CutPrefix(line, "device "); ok {
+			cur, perOp = nil, false
+			// device <device> mounted on <mount point> with fstype <type> [statvers=<v>]
+			device, rest, ok1 := strings.Cut(rest, " mounted on ")
+			mountPoint, rest, ok2 := strings.Cut(rest, " with fstype ")
+			fsType, _, _ := strings.Cut(rest, " ")
+			if ok1 && ok2 && (fsType == "nfs" || fsType == "nfs4") {
+				mounts = append(mounts, nfsMountStats{Device: device, MountPoint: unescapeMountInfo(mountPoint)})
+				cur = &mounts[len(mounts)-1]
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if strings.TrimSpace(line) == "per-op statistics" {
+			perOp = true
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		switch {
+		case name == "opts":
+			for _, opt := range strings.Split(strings.TrimSpace(value), ",") {
+				k, v, _ := strings.Cut(opt, "=")
+				switch k {
+				case "sec":
+					cur.Sec = v
+				case "vers":
+					cur.Vers = v
+				}
+			}
+		case name == "age" && len(fields) > 0:
+			cur.AgeSeconds, _ = strconv.ParseUint(fields[0], 10, 64)
+		case name == "bytes" && len(fields) >= 6:
+			n := parseCounters(fields)
+			cur.ReadBytes, cur.WriteBytes = n[0]+n[2], n[1]+n[3]
+			cur.ServerReadBytes, cur.ServerWriteBytes = n[4], n[5]
+		case perOp && len(fields) >= 8:
+			// ops transmissions timeouts bytes_sent bytes_recv queue rtt execute [errors]
+			n := parseCounters(fields)
+			cur.RPCs += n[0]
+			cur.Retransmissions += n[1] - min(n[0], n[1])
+			cur.Timeouts += n[2]
+			if len(n) >= 9 {
+				cur.Errors += n[8]
+			}
+		}
+	}
+	return mounts, s.Err()
+}
+
+func parseCounters(fields []string) []uint64 {
+	n := make([]uint64, len(fields))
+	for i, f := range fields {
+		n[i], _ = strconv.ParseUint(f, 10, 64)
+	}
+	return n
+}
+
+// GSS contexts of the NFS servers of the parameters: the service tickets of
+// the credential cache for them.
+func (kp *kerberosParams) gssContexts() ([]gssContext, error) {
+	entries, err := readCCache(kp.CCName)
+	if err != nil {
+		return nil, err
+	}
+	var contexts []gssContext
+	for _, e := range entries {
+		if len(e.server.NameString) == 2 && e.server.NameString[0] == "nfs" {
+			contexts = append(contexts, gssContext{
+				Service: strings.Join(e.server.NameString, "/") + "@" + e.serverRealm,
+				Expires: e.endTime,
+			})
+		}
+	}
+	return contexts, nil
+}
+
+// Collect the statistics of managed credentials, from the mountstats of the
+// first running container of the pod, or of the container they are for.
+func (p *plugin) collectPodStats(id string) *podStats {
+	p.Lock()
+	mc, ok := p.managed[id]
+	p.Unlock()
+	if !ok {
+		return nil
+	}
+	kp := mc.params
+	st := &podStats{
+		Key:       id,
+		Namespace: mc.pod.GetNamespace(),
+		Pod:       mc.pod.GetName(),
+		Container: kp.Container,
+		Principal: kp.Principal(),
+		Collected: p.clock.Now(),
+		Mounts:    []nfsMountStats{},
+		Contexts:  []gssContext{},
+	}
+	var errs []error
+	if contexts, err := kp.gssContexts(); err != nil {
+		errs = append(errs, err)
+	} else {
+		st.Contexts = contexts
+	}
+	procs := p.remediation.containers(mc.pod.GetId(), kp.Container)
+	if len(procs) == 0 {
+		errs = append(errs, errors.New("no running container"))
+	} else {
+		path := filepath.Join("/proc", strconv.FormatUint(uint64(procs[0].pid), 10), "mountstats")
+		if mounts, err := readMountStats(path); err != nil {
+			errs = append(errs, err)
+		} else {
+			st.Mounts = mounts
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		st.Error = err.Error()
+	}
+	return st
+}
+
+func readMountStats(path string) ([]nfsMountStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mounts, err := parseMountStats(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return mounts, nil
+}
+
+// Statistics of the managed credentials of a pod, collected now.
+func (p *plugin) podStatsOf(namespace, name string) []*podStats {
+	p.Lock()
+	var ids []string
+	for id, mc := range p.managed {
+		if mc.pod.GetNamespace() == namespace && mc.pod.GetName() == name && !mc.params.secondary() {
+			ids = append(ids, id)
+		}
+	}
+	p.Unlock()
+	var stats []*podStats
+	for _, id := range ids {
+		if st := p.collectPodStats(id); st != nil {
+			stats = append(stats, st)
+		}
+	}
+	return stats
+}
+
+// Exporter of the statistics of managed pods as metrics.
+type mountStatsExporter struct {
+	cfg mountStatsConfig
+
+	sync.Mutex
+	// Statistics last exported, by managed key.
+	last map[string]*podStats
+}
+
+func newMountStatsExporter(cfg mountStatsConfig) *mountStatsExporter {
+	return &mountStatsExporter{cfg: cfg, last: map[string]*podStats{}}
+}
+
+// Remove the metrics of managed credentials, once released. Safe to call on
+// nil.
+func (e *mountStatsExporter) forget(id string) {
+	if e == nil {
+		return
+	}
+	e.Lock()
+	if st, ok := e.last[id]; ok {
+		deleteMountStats(st)
+	}
+	delete(e.last, id)
+	e.Unlock()
+}
+
+// Export the statistics of managed pods periodically until the context is
+// cancelled.
+func (p *plugin) runMountStats(ctx context.Context) {
+	e := p.mountStats
+	for {
+		p.Lock()
+		ids := make([]string, 0, len(p.managed))
+		for id, mc := range p.managed {
+			if mc.pod.GetUid() != "" && !mc.params.secondary() {
+				ids = append(ids, id)
+			}
+		}
+		p.Unlock()
+		for _, id := range ids {
+			st := p.collectPodStats(id)
+			if st == nil {
+				continue
+			}
+			if st.Error != "" {
+				loggerFrom(ctx).WithField("key", id).Debugf("statistics incomplete: %s", st.Error)
+			}
+			e.Lock()
+			if old, ok := e.last[id]; ok {
+				deleteMountStats(old)
+			}
+			e.last[id] = st
+			e.Unlock()
+			exportMountStats(st, p.clock.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.cfg.interval()):
+		}
+	}
+}
+
+func exportMountStats(st *podStats, now time.Time) {
+	for _, m := range st.Mounts {
+		labels := []string{st.Namespace, st.Pod, st.Container, m.MountPoint}
+		nfsMountBytes.WithLabelValues(append(labels, "read")...).Set(float64(m.ReadBytes))
+		nfsMountBytes.WithLabelValues(append(labels, "write")...).Set(float64(m.WriteBytes))
+		nfsMountRPCs.WithLabelValues(append(labels, "ops")...).Set(float64(m.RPCs))
+		nfsMountRPCs.WithLabelValues(append(labels, "retransmissions")...).Set(float64(m.Retransmissions))
+		nfsMountRPCs.WithLabelValues(append(labels, "timeouts")...).Set(float64(m.Timeouts))
+		nfsMountRPCs.WithLabelValues(append(labels, "errors")...).Set(float64(m.Errors))
+	}
+	for _, c := range st.Contexts {
+		gssContextExpiry.WithLabelValues(st.Namespace, st.Pod, st.Container, c.Service).Set(max(c.Expires.Sub(now), 0).Seconds())
+	}
+}
+
+func deleteMountStats(st *podStats) {
+	for _, m := range st.Mounts {
+		labels := []string{st.Namespace, st.Pod, st.Container, m.MountPoint}
+		for _, direction := range []string{"read", "write"} {
+			nfsMountBytes.DeleteLabelValues(append(labels, direction)...)
+		}
+		for _, kind := range []string{"ops", "retransmissions", "timeouts", "errors"} {
+			nfsMountRPCs.DeleteLabelValues(append(labels, kind)...)
+		}
+	}
+	for _, c := range st.Contexts {
+		gssContextExpiry.DeleteLabelValues(st.Namespace, st.Pod, st.Container, c.Service)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultPodTmpfsSize = "1m"
+
+var tmpfsSizeRegexp = regexp.MustCompile(`^[1-9][0-9]*[kmg]?$`)
+
+// Memory file systems of their own for the credential caches and keytabs of
+// each pod.
+type podTmpfsConfig struct {
+	// Mount a file system on each pod credential cache and keytab directory,
+	// so that credentials never reach the disks of the node nor survive a reboot.
+	Enabled bool `json:"enabled,omitempty"`
+	// File system type, tmpfs (default), or ramfs, which cannot be swapped
+	// out but has no size limit.
+	Type string `json:"type,omitempty"`
+	// Size of each tmpfs, as of its size option, 1m by default.
+	Size string `json:"size,omitempty"`
+}
+
+func (c *podTmpfsConfig) validate() error {
+	switch c.Type {
+	case "", "tmpfs", "ramfs":
+	default:
+		return fmt.Errorf("unknown type %q, must be tmpfs or ramfs", c.Type)
+	}
+	if c.Size != "" && !tmpfsSizeRegexp.MatchString(c.Size) {
+		return fmt.Errorf("invalid size %q", c.Size)
+	}
+	return nil
+}
+
+func (c *podTmpfsConfig) fsType() string {
+	if c.Type != "" {
+		return c.Type
+	}
+	return "tmpfs"
+}
+
+// Create a pod directory owned by uid/gid with mode 0700 and, if enabled,
+// mount a file system of its own on it. Directories already there are left as
+// they are: containers may have them mounted, and would not see a file system
+// mounted on them now.
+func (c *podTmpfsConfig) makeDir(dir string, uid, gid int) error {
+	_, err := os.Stat(dir)
+	created := errors.Is(err, fs.ErrNotExist)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if c.Enabled && created {
+		data := fmt.Sprintf("mode=0700,uid=%d,gid=%d", uid, gid)
+		if c.fsType() == "tmpfs" {
+			size := c.Size
+			if size == "" {
+				size = defaultPodTmpfsSize
+			}
+			data += ",size=" + size
+		}
+		if err := unix.Mount(c.fsType(), dir, c.fsType(), unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, data); err != nil {
+			os.Remove(dir)
+			return fmt.Errorf("failed to mount %s on %s: %w", c.fsType(), dir, err)
+		}
+	}
+	return os.Chown(dir, uid, gid)
+}
+
+// Remove a pod directory, unmounting the file system mounted on it first. The
+// mount is detached, so it goes away once the last container using it exits.
+func removePodDir(dir string) error {
+	if err := unix.Unmount(dir, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to unmount %s: %w", dir, err)
+	}
+	return os.RemoveAll(dir)
+}
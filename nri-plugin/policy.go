@@ -0,0 +1,209 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Returned when the policy of the node does not allow the credentials a pod asks for.
+var errPolicyDenied = errors.New("not allowed by policy")
+
+// Policy of which pods may have credentials set up, and which.
+type policyConfig struct {
+	// Rules allowing pods credentials, the pods of any namespace may have any
+	// if empty. A pod must be allowed by one rule matching its namespace and
+	// service account.
+	Rules []policyRule `json:"rules,omitempty"`
+}
+
+// Rule allowing the pods of some namespaces and service accounts credentials.
+type policyRule struct {
+	// Namespace patterns, as of path.Match.
+	Namespaces []string `json:"namespaces"`
+	// Service account patterns, any if empty. Needs Kubernetes API access.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+	// Realms the pods may target, any if empty.
+	Realms []string `json:"realms,omitempty"`
+	// Ranges of the uids the pods may ask for, any if empty.
+	UIDs []idRange `json:"uids,omitempty"`
+	// Ranges of the gids and fsids the pods may ask for, any if empty.
+	GIDs []idRange `json:"gids,omitempty"`
+}
+
+// Range of POSIX ids, as "10000-19999" or a single id.
+type idRange struct {
+	min, max uint64
+}
+
+func (r idRange) String() string {
+	if r.min == r.max {
+		return strconv.FormatUint(r.min, 10)
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+func (r idRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *idRange) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid id range %s: %w", string(data), err)
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	var err error
+	if r.min, err = strconv.ParseUint(lo, 10, 32); err == nil {
+		r.max, err = strconv.ParseUint(hi, 10, 32)
+	}
+	if err != nil || r.min > r.max {
+		return fmt.Errorf("invalid id range %q", s)
+	}
+	return nil
+}
+
+func (r idRange) contains(id uint64) bool {
+	return id >= r.min && id <= r.max
+}
+
+// Check the rules for errors.
+func (c *policyConfig) validate() error {
+	for i, r := range c.Rules {
+		if len(r.Namespaces) == 0 {
+			return fmt.Errorf("rule %d: no namespaces", i)
+		}
+		for _, pattern := range append(slices.Clone(r.Namespaces), r.ServiceAccounts...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid pattern %q", i, pattern)
+			}
+		}
+		for _, realm := range r.Realms {
+			if !realmRegexp.MatchString(realm) {
+				return fmt.Errorf("rule %d: invalid realm %q, must be upper case", i, realm)
+			}
+		}
+	}
+	return nil
+}
+
+// Whether some rules restrict the service accounts of the namespace.
+func (c *policyConfig) needsServiceAccount(namespace string) bool {
+	for _, r := range c.Rules {
+		if matchesAny(r.Namespaces, namespace) && len(r.ServiceAccounts) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, s string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, s)
+		return ok
+	})
+}
+
+func inRanges(ranges []idRange, id uint64) bool {
+	return len(ranges) == 0 || slices.ContainsFunc(ranges, func(r idRange) bool { return r.contains(id) })
+}
+
+// Why the rule does not allow the parameters, or empty if it does. The ids
+// are those the pod asks for, as its containers see them.
+func (r *policyRule) deny(kp *kerberosParams) string {
+	uid, gid, fsid := kp.containerIDs()
+	switch {
+	case len(r.Realms) > 0 && !slices.Contains(r.Realms, kp.Realm):
+		return fmt.Sprintf("realm %s is not one of %s", kp.Realm, strings.Join(r.Realms, ", "))
+	case !inRanges(r.UIDs, uid):
+		return fmt.Sprintf("uid %d is not in %s", uid, formatRanges(r.UIDs))
+	case !inRanges(r.GIDs, gid):
+		return fmt.Sprintf("gid %d is not in %s", gid, formatRanges(r.GIDs))
+	case !inRanges(r.GIDs, fsid):
+		return fmt.Sprintf("fsid %d is not in %s", fsid, formatRanges(r.GIDs))
+	}
+	for _, gid := range kp.containerGIDs() {
+		if !inRanges(r.GIDs, gid) {
+			return fmt.Sprintf("supplementary gid %d is not in %s", gid, formatRanges(r.GIDs))
+		}
+	}
+	return ""
+}
+
+func formatRanges(ranges []idRange) string {
+	s := make([]string, len(ranges))
+	for i, r := range ranges {
+		s[i] = r.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Check that the policy allows the pod the credentials, with the realm and ids
+// of the parameters. The first rule matching the pod that does not allow them
+// gives the reason of the denial.
+func (p *plugin) checkPolicy(ctx context.Context, cfg *config, pod *api.PodSandbox, kp *kerberosParams) error {
+	policy := &cfg.Policy
+	if len(policy.Rules) == 0 {
+		return nil
+	}
+	var sa string
+	if policy.needsServiceAccount(pod.GetNamespace()) {
+		if p.kube == nil {
+			return fmt.Errorf("%w: service accounts of namespace %s are restricted, which needs Kubernetes API access",
+				errPolicyDenied, pod.GetNamespace())
+		}
+		var err error
+		if sa, err = podServiceAccount(ctx, p.kube, pod); err != nil {
+			return err
+		}
+	}
+
+	reason := fmt.Sprintf("no rule for namespace %s", pod.GetNamespace())
+	matched := false
+	for _, r := range policy.Rules {
+		if !matchesAny(r.Namespaces, pod.GetNamespace()) {
+			continue
+		}
+		if len(r.ServiceAccounts) > 0 && !matchesAny(r.ServiceAccounts, sa) {
+			if !matched {
+				reason = fmt.Sprintf("no rule for service account %s of namespace %s", sa, pod.GetNamespace())
+			}
+			continue
+		}
+		denied := r.deny(kp)
+		if denied == "" {
+			return nil
+		}
+		if !matched {
+			reason, matched = denied, true
+		}
+	}
+	policyDenials.WithLabelValues(pod.GetNamespace()).Inc()
+	return fmt.Errorf("%w: %s", errPolicyDenied, reason)
+}
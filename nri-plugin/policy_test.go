@@ -0,0 +1,170 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tuminoid/nri-plugins/kerberos-auth/kubeapi"
+)
+
+const testPolicyYAML = `
+rules:
+# Narrow rule first, so its denial is the one told for namespace batch
+- namespaces: [batch]
+  serviceAccounts: [runner]
+  realms: [BATCH.EXAMPLE.COM]
+  uids: ["20000-20999"]
+- namespaces: [batch]
+  uids: ["30000"]
+  gids: ["30000-30999"]
+- namespaces: ["team-*"]
+  realms: [EXAMPLE.COM]
+`
+
+func TestCheckPolicy(t *testing.T) {
+	// Pods named after their service account
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"spec":{"serviceAccountName":%q}}`, path.Base(r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := &config{}
+	if err := yaml.Unmarshal([]byte(testPolicyYAML), &cfg.Policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		// Service account.
+		pod   string
+		realm string
+		uid   uint64
+		gid   uint64
+		// Denial reason, allowed if empty.
+		wantDenied string
+	}{{
+		name:      "first rule",
+		namespace: "batch",
+		pod:       "runner",
+		realm:     "BATCH.EXAMPLE.COM",
+		uid:       20001,
+		gid:       20001,
+	}, {
+		name:      "later rule allowing what the first denies",
+		namespace: "batch",
+		pod:       "runner",
+		realm:     "EXAMPLE.COM",
+		uid:       30000,
+		gid:       30000,
+	}, {
+		name:       "denial of the first matching rule",
+		namespace:  "batch",
+		pod:        "runner",
+		realm:      "EXAMPLE.COM",
+		uid:        20001,
+		gid:        20001,
+		wantDenied: "realm EXAMPLE.COM is not one of BATCH.EXAMPLE.COM",
+	}, {
+		name:       "other service account skips the first rule",
+		namespace:  "batch",
+		pod:        "web",
+		realm:      "BATCH.EXAMPLE.COM",
+		uid:        20001,
+		gid:        20001,
+		wantDenied: "uid 20001 is not in 30000",
+	}, {
+		name:       "gid out of range",
+		namespace:  "batch",
+		pod:        "web",
+		realm:      "EXAMPLE.COM",
+		uid:        30000,
+		gid:        31000,
+		wantDenied: "gid 31000 is not in 30000-30999",
+	}, {
+		name:      "namespace pattern",
+		namespace: "team-a",
+		pod:       "web",
+		realm:     "EXAMPLE.COM",
+		uid:       61001,
+		gid:       61001,
+	}, {
+		name:       "namespace pattern, other realm",
+		namespace:  "team-a",
+		pod:        "web",
+		realm:      "BATCH.EXAMPLE.COM",
+		uid:        61001,
+		gid:        61001,
+		wantDenied: "realm BATCH.EXAMPLE.COM is not one of EXAMPLE.COM",
+	}, {
+		name:       "default deny",
+		namespace:  "default",
+		pod:        "web",
+		realm:      "EXAMPLE.COM",
+		uid:        61001,
+		gid:        61001,
+		wantDenied: "no rule for namespace default",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &plugin{kube: &kubeClient{&kubeapi.Client{Server: srv.URL, HTTP: srv.Client()}}}
+			pod := &api.PodSandbox{Namespace: tc.namespace, Name: tc.pod}
+			kp := &kerberosParams{User: "alice", Realm: tc.realm, UID: tc.uid, GID: tc.gid, FSID: tc.gid}
+			err := p.checkPolicy(context.Background(), cfg, pod, kp)
+			if tc.wantDenied == "" {
+				if err != nil {
+					t.Fatalf("checkPolicy() = %v, want allowed", err)
+				}
+				return
+			}
+			if !errors.Is(err, errPolicyDenied) || err.Error() != errPolicyDenied.Error()+": "+tc.wantDenied {
+				t.Errorf("checkPolicy() = %v, want %v: %s", err, errPolicyDenied, tc.wantDenied)
+			}
+		})
+	}
+}
+
+func TestCheckPolicyWithoutRules(t *testing.T) {
+	p := &plugin{}
+	pod := &api.PodSandbox{Namespace: "default", Name: "app"}
+	if err := p.checkPolicy(context.Background(), &config{}, pod, &kerberosParams{User: "alice", Realm: "EXAMPLE.COM"}); err != nil {
+		t.Errorf("checkPolicy() without rules = %v, want allowed", err)
+	}
+}
+
+func TestCheckPolicyNeedsKubernetes(t *testing.T) {
+	cfg := &config{}
+	if err := yaml.Unmarshal([]byte(testPolicyYAML), &cfg.Policy); err != nil {
+		t.Fatal(err)
+	}
+	p := &plugin{}
+	pod := &api.PodSandbox{Namespace: "batch", Name: "runner"}
+	if err := p.checkPolicy(context.Background(), cfg, pod, &kerberosParams{User: "alice", Realm: "BATCH.EXAMPLE.COM", UID: 20001}); !errors.Is(err, errPolicyDenied) {
+		t.Errorf("checkPolicy() without Kubernetes API access = %v, want %v", err, errPolicyDenied)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Time each reachability probe has, by default.
+const defaultPreflightTimeout = 2 * time.Second
+
+// Classes of reachability failures found by the pre-flight probes, wrapped
+// with errKDCUnreachable or errNFSUnreachable.
+var (
+	errNameResolution = errors.New("name resolution failed")
+	// Connections time out or the host is unreachable, as when a
+	// NetworkPolicy or firewall drops them.
+	errNetworkBlocked = errors.New("network blocked")
+	errPortClosed     = errors.New("port closed")
+	// Something else than the service answers, as a TLS or HTTP proxy
+	// intercepting the connection.
+	errProxyInterference = errors.New("answered by something else than the service")
+	errNFSUnreachable    = errors.New("NFS server unreachable")
+)
+
+// Reachability probes of the KDC and NFS servers of a workload before
+// setting up its credentials, telling why they cannot be reached rather than
+// leaving it to the Kerberos libraries.
+type preflightConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Time each probe has, 2s by default.
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+func (c *preflightConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultPreflightTimeout
+}
+
+// Whether a failure is one of a pre-flight probe.
+func preflightFailure(err error) bool {
+	return errors.Is(err, errNameResolution) || errors.Is(err, errNetworkBlocked) ||
+		errors.Is(err, errPortClosed) || errors.Is(err, errProxyInterference)
+}
+
+// Backend wrapper probing the KDC and NFS servers of a workload before
+// setting up its credentials. Inside failoverBackend, so that a KDC failing
+// the probe is failed over like one the backend cannot reach.
+type preflightBackend struct {
+	KerberosBackend
+	config func() *preflightConfig
+}
+
+func (b *preflightBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	if cfg := b.config(); cfg.Enabled {
+		if err := preflight(ctx, kp, cfg.timeout()); err != nil {
+			return err
+		}
+	}
+	return b.KerberosBackend.Setup(ctx, kp)
+}
+
+// Probe the KDC of the workload on 88/tcp and 88/udp with an AS-REQ, either
+// answering with a Kerberos message being enough, and its NFS servers on
+// 2049/tcp with an RPC NULL call. KDCs behind a KDC proxy are not probed.
+func preflight(ctx context.Context, kp *kerberosParams, timeout time.Duration) error {
+	if kp.KDC != "" && kp.KDCProxy == nil {
+		if err := probeKDC(ctx, kp, timeout); err != nil {
+			return fmt.Errorf("%w: %s: %w", errKDCUnreachable, kp.KDC, err)
+		}
+	}
+	for _, server := range kp.nfsServers() {
+		if err := probeNFS(ctx, kp, server, timeout); err != nil {
+			return fmt.Errorf("%w: %s: %w", errNFSUnreachable, server, err)
+		}
+	}
+	return nil
+}
+
+func probeKDC(ctx context.Context, kp *kerberosParams, timeout time.Duration) error {
+	addr, err := resolveProbe(ctx, kdcAddress(kp.hostAddress(kp.KDC)), timeout)
+	if err != nil {
+		return err
+	}
+	msg, err := doctorASReq(kp)
+	if err != nil {
+		return nil
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	reply, tcpErr := exchangeTCP(tctx, addr, msg)
+	cancel()
+	if tcpErr == nil && isKerberosReply(reply) {
+		return nil
+	}
+	uctx, cancel := context.WithTimeout(ctx, timeout)
+	reply, udpErr := exchangeUDP(uctx, addr, msg)
+	cancel()
+	if udpErr == nil && isKerberosReply(reply) {
+		loggerFrom(ctx).Debugf("KDC %s answers on udp only, tcp: %v", addr, tcpErr)
+		return nil
+	}
+	if tcpErr == nil {
+		return fmt.Errorf("%w: tcp/%s answered with something else than a Kerberos message", errProxyInterference, addr)
+	}
+	return fmt.Errorf("tcp/%s: %w, udp: %v", addr, classifyProbeError(tcpErr), udpErr)
+}
+
+func probeNFS(ctx context.Context, kp *kerberosParams, server string, timeout time.Duration) error {
+	addr, err := resolveProbe(ctx, withPort(kp.hostAddress(server), nfsPort), timeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err = callRPC(ctx, addr, nfsProgram, 4, 0, nil, nil)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errRPCProtocol):
+		return fmt.Errorf("%w: tcp/%s answered with something else than an RPC reply", errProxyInterference, addr)
+	case errors.Is(err, errRPCRejected), errors.Is(err, errRPCNotAccepted):
+		// an RPC server, if not one taking the call
+		return nil
+	}
+	return fmt.Errorf("tcp/%s: %w", addr, classifyProbeError(err))
+}
+
+// Resolve the host of an address, failing with errNameResolution.
+func resolveProbe(ctx context.Context, addr string, timeout time.Duration) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addrs, err := resolverFor(host).LookupHost(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errNameResolution, err)
+	}
+	return net.JoinHostPort(addrs[0], port), nil
+}
+
+// Classify a failed connection or exchange: refused connections, timeouts
+// and unreachable hosts, and connections closed, reset or answered with
+// garbage once established, as proxies do with what they cannot make sense
+// of.
+func classifyProbeError(err error) error {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: %w", errPortClosed, err)
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EACCES),
+		errors.Is(err, syscall.EPERM):
+		return fmt.Errorf("%w: %w", errNetworkBlocked, err)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return fmt.Errorf("%w: connection closed: %w", errProxyInterference, err)
+	case !errors.As(err, &opErr) || opErr.Op != "dial":
+		return fmt.Errorf("%w: %w", errProxyInterference, err)
+	}
+	return err
+}
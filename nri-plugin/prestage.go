@@ -0,0 +1,319 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const defaultPrestageMaxAge = 10 * time.Minute
+
+// Pre-staging of the credentials of pods scheduled to the node.
+type prestageConfig struct {
+	// Watch the Pending pods scheduled to the node and obtain their
+	// credentials before their sandbox is created, so that a slow KDC does
+	// not delay their start. Needs Kubernetes API access.
+	Enabled bool `json:"enabled,omitempty"`
+	// Time credentials are kept for pods whose sandbox is not created, 10m by default.
+	MaxAge duration `json:"maxAge,omitempty"`
+}
+
+func (c *prestageConfig) maxAge() time.Duration {
+	if c.MaxAge.Duration > 0 {
+		return c.MaxAge.Duration
+	}
+	return defaultPrestageMaxAge
+}
+
+// Credentials pre-staged for pods not yet started, by pod UID.
+type prestager struct {
+	cfg   prestageConfig
+	kube  *kubeClient
+	node  string
+	clock Clock
+
+	sync.Mutex
+	pods map[string]*prestagedPod
+}
+
+type prestagedPod struct {
+	pod *api.PodSandbox
+	// Closed once staging is done.
+	done chan struct{}
+	// Parameters the credentials were obtained with, nil if there are none.
+	params  *kerberosParams
+	started time.Time
+	// Whether the sandbox took over the credentials. The pod is remembered
+	// until it leaves the Pending phase so that they are not obtained again.
+	claimed bool
+}
+
+func newPrestager(cfg prestageConfig, kube *kubeClient, node string, clock Clock) *prestager {
+	return &prestager{cfg: cfg, kube: kube, node: node, clock: clock, pods: map[string]*prestagedPod{}}
+}
+
+// Pod as watched.
+type prestagePod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		UID         string            `json:"uid"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		HostUsers *bool `json:"hostUsers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+// Whether the pod runs in the user namespace of the host, which pre-staging
+// needs: the id mappings of others are not known before the sandbox exists.
+func (kp *prestagePod) hostUsers() bool {
+	return kp.Spec.HostUsers == nil || *kp.Spec.HostUsers
+}
+
+// The pod as NRI will describe it, without sandbox ID.
+func (kp *prestagePod) sandbox() *api.PodSandbox {
+	return &api.PodSandbox{
+		Name:        kp.Metadata.Name,
+		Namespace:   kp.Metadata.Namespace,
+		Uid:         kp.Metadata.UID,
+		Labels:      kp.Metadata.Labels,
+		Annotations: kp.Metadata.Annotations,
+	}
+}
+
+// Watch the Pending pods scheduled to the node until the context is cancelled.
+func (p *plugin) runPrestage(ctx context.Context) {
+	const maxBackoff = 2 * time.Minute
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		err := p.syncPrestage(ctx, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, errGone) {
+			log.Warnf("pod watch failed, retrying in %s: %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+}
+
+// List the Pending pods of the node and watch for changes until the watch
+// ends, pre-staging the credentials of new ones. Pods leaving the Pending
+// phase are reported deleted by the watch.
+func (p *plugin) syncPrestage(ctx context.Context, synced func()) error {
+	s := p.prestage
+	path := "/api/v1/pods?fieldSelector=" + url.QueryEscape("spec.nodeName="+s.node+",status.phase=Pending")
+	list := struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*prestagePod `json:"items"`
+	}{}
+	if err := s.kube.do(ctx, http.MethodGet, path, "", nil, &list); err != nil {
+		return err
+	}
+	for _, pod := range list.Items {
+		if pod.hostUsers() {
+			go p.prestagePod(ctx, pod.sandbox())
+		}
+	}
+	synced()
+
+	rv := list.Metadata.ResourceVersion
+	return s.kube.watch(ctx, path, rv, func(ev *watchEvent) error {
+		pod := &prestagePod{}
+		if err := json.Unmarshal(ev.Object, pod); err != nil {
+			return fmt.Errorf("failed to decode pod: %w", err)
+		}
+		p.expirePrestaged()
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			if pod.hostUsers() {
+				go p.prestagePod(ctx, pod.sandbox())
+			}
+		case "DELETED":
+			p.dropPrestaged(pod.Metadata.UID)
+		}
+		return nil
+	})
+}
+
+// Obtain the credentials of a pod into its credential cache, once.
+func (p *plugin) prestagePod(ctx context.Context, pod *api.PodSandbox) {
+	cfg := p.config()
+	cfg.normalizePod(pod)
+	if !cfg.enabled(pod) || pod.GetUid() == "" || cfg.DryRun {
+		return
+	}
+	s := p.prestage
+	s.Lock()
+	if _, ok := s.pods[pod.GetUid()]; ok {
+		s.Unlock()
+		return
+	}
+	sp := &prestagedPod{pod: pod, done: make(chan struct{}), started: p.clock.Now()}
+	s.pods[pod.GetUid()] = sp
+	s.Unlock()
+	defer close(sp.done)
+
+	l := podLogger(pod)
+	kp := p.podSandboxParams(l, cfg, pod)
+	if kp == nil || p.checkPolicy(ctx, cfg, pod, kp) != nil || p.enforceLimits(l, cfg, kp) != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(withLogger(ctx, l), cfg.setupTimeout())
+	defer cancel()
+	err := p.fetchCredentials(ctx, pod, kp)
+	if err == nil {
+		err = prepareCollection(kp.CCName, int(kp.UID), int(kp.GID))
+	}
+	if err == nil {
+		err = p.backend.Setup(ctx, kp)
+	}
+	prestagedSetups.WithLabelValues(result(err)).Inc()
+	if err != nil {
+		// left to the setup of the sandbox, which reports failures
+		l.Debugf("pre-staging credentials for %s failed: %v", kp.Principal(), err)
+		return
+	}
+	l.Infof("pre-staged credentials for %s", kp.Principal())
+	sp.params = kp
+}
+
+// Take the credentials pre-staged for a pod, waiting for staging in progress,
+// if they are for the parameters of its sandbox and still valid.
+func (s *prestager) claim(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) *kerberosParams {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	sp, ok := s.pods[pod.GetUid()]
+	s.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-sp.done:
+	case <-ctx.Done():
+		return nil
+	}
+
+	staged := sp.params
+	if staged == nil || staged.Principal() != kp.Principal() || staged.CCName != kp.CCName {
+		// other credentials are dropped when the pod leaves the Pending phase
+		return nil
+	}
+	s.Lock()
+	sp.claimed = true
+	s.Unlock()
+	if err := checkCCache(kp.CCName, kp.Realm, s.clock.Now().Add(syncMinLifetime)); err != nil {
+		return nil
+	}
+	return staged
+}
+
+// UIDs of the pods with credentials pre-staged or being staged.
+func (s *prestager) uids() []string {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return slices.Collect(maps.Keys(s.pods))
+}
+
+// Forget the credentials pre-staged for a pod which did not start, destroying
+// them unless managed credentials use the same credential cache or keytab.
+func (p *plugin) dropPrestaged(uid string) {
+	s := p.prestage
+	s.Lock()
+	sp, ok := s.pods[uid]
+	if ok {
+		select {
+		case <-sp.done:
+			delete(s.pods, uid)
+			ok = !sp.claimed
+		default:
+			// still staging, left to expire
+			ok = false
+		}
+	}
+	s.Unlock()
+	if !ok || sp.params == nil {
+		return
+	}
+
+	l := podLogger(sp.pod)
+	p.Lock()
+	for _, mc := range p.managed {
+		if mc.params.CCName == sp.params.CCName || mc.params.User == sp.params.User {
+			p.Unlock()
+			return
+		}
+	}
+	p.Unlock()
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), l), p.config().cleanupTimeout())
+	defer cancel()
+	if err := p.backend.Destroy(ctx, sp.params); err != nil {
+		l.Error(err)
+	}
+	if err := p.ephemeral.release(ctx, sp.pod); err != nil {
+		l.Error(err)
+	}
+	if err := p.removePodKeytabDir(sp.pod); err != nil {
+		l.Error(err)
+	}
+	l.Infof("dropped credentials pre-staged for %s", sp.params.Principal())
+}
+
+// Drop credentials pre-staged for longer than the maximum age.
+func (p *plugin) expirePrestaged() {
+	s := p.prestage
+	var expired []string
+	s.Lock()
+	for uid, sp := range s.pods {
+		if p.clock.Now().Sub(sp.started) > s.cfg.maxAge() {
+			expired = append(expired, uid)
+		}
+	}
+	s.Unlock()
+	for _, uid := range expired {
+		p.dropPrestaged(uid)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Templates of the principal names of workloads, executed with the user,
+// namespace, pod, uid of the pod, realm and node, e.g. "{{.user}}/{{.namespace}}"
+// or "nfs-client/{{.node}}". The realm of the pod is assumed if the name
+// has none.
+type principalTemplateConfig struct {
+	// Template for pods in namespaces without one of their own.
+	Default string `json:"default,omitempty"`
+	// Templates by namespace.
+	Namespaces map[string]string `json:"namespaces,omitempty"`
+}
+
+// Template of the principal names of pods in the namespace, empty for plain
+// user names.
+func (c *principalTemplateConfig) forNamespace(namespace string) string {
+	if t, ok := c.Namespaces[namespace]; ok {
+		return t
+	}
+	return c.Default
+}
+
+// Check the templates for errors.
+func (c *principalTemplateConfig) validate() error {
+	if _, err := parsePrincipalTemplate(c.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for _, namespace := range slices.Sorted(maps.Keys(c.Namespaces)) {
+		if _, err := parsePrincipalTemplate(c.Namespaces[namespace]); err != nil {
+			return fmt.Errorf("namespaces: %s: %w", namespace, err)
+		}
+	}
+	return nil
+}
+
+func parsePrincipalTemplate(text string) (*template.Template, error) {
+	t, err := template.New("principal").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid principal template %q: %w", text, err)
+	}
+	return t, nil
+}
+
+// Data principal templates of a pod are executed with.
+func principalTemplateData(pod *api.PodSandbox, user, realm string) map[string]string {
+	return map[string]string{
+		"user":      user,
+		"namespace": pod.GetNamespace(),
+		"pod":       pod.GetName(),
+		"uid":       pod.GetUid(),
+		"realm":     realm,
+		"node":      nodeName(),
+	}
+}
+
+// Principal name from a template, returned without realm. The name must
+// come out in the realm of the pod, if it names one.
+func renderPrincipal(text string, data map[string]string) (string, error) {
+	t, err := parsePrincipalTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	out := &strings.Builder{}
+	if err := t.Execute(out, data); err != nil {
+		return "", fmt.Errorf("principal template %q: %w", text, err)
+	}
+	name, realm, hasRealm := strings.Cut(strings.TrimSpace(out.String()), "@")
+	switch {
+	case name == "":
+		return "", fmt.Errorf("principal template %q gives an empty name", text)
+	case strings.ContainsAny(name, " \t\n@"):
+		return "", fmt.Errorf("principal template %q gives invalid name %q", text, out.String())
+	case slices.Contains(strings.Split(name, "/"), ""):
+		return "", fmt.Errorf("principal template %q gives %q with an empty component", text, name)
+	case hasRealm && realm != data["realm"]:
+		return "", fmt.Errorf("principal template %q gives %s, not in realm %s of the pod", text, out.String(), data["realm"])
+	}
+	return name, nil
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+func TestRenderPrincipal(t *testing.T) {
+	t.Setenv("NODE_NAME", "worker-1")
+	pod := &api.PodSandbox{Name: "app-7f9c", Namespace: "batch", Uid: "5d3c0b7e"}
+	for _, tc := range []struct {
+		name     string
+		template string
+		user     string
+		want     string
+		wantErr  bool
+	}{{
+		name:     "user",
+		template: "{{.user}}",
+		user:     "alice",
+		want:     "alice",
+	}, {
+		name:     "user and namespace",
+		template: "{{.user}}/{{.namespace}}",
+		user:     "alice",
+		want:     "alice/batch",
+	}, {
+		name:     "pod, uid and node",
+		template: "{{.pod}}.{{.uid}}/{{.node}}",
+		want:     "app-7f9c.5d3c0b7e/worker-1",
+	}, {
+		name:     "realm of the pod",
+		template: "nfs-client/{{.node}}@{{.realm}}",
+		want:     "nfs-client/worker-1",
+	}, {
+		name:     "surrounding space trimmed",
+		template: " {{.user}}\n",
+		user:     "alice",
+		want:     "alice",
+	}, {
+		name:     "escaped braces",
+		template: `{{"{{"}}{{.user}}{{"}}"}}`,
+		user:     "alice",
+		want:     "{{alice}}",
+	}, {
+		name:     "literal text",
+		template: "svc_{{.namespace}}-{{.user}}",
+		user:     "alice",
+		want:     "svc_batch-alice",
+	}, {
+		name:     "unknown placeholder",
+		template: "{{.group}}/{{.user}}",
+		user:     "alice",
+		wantErr:  true,
+	}, {
+		name:     "unterminated action",
+		template: "{{.user",
+		user:     "alice",
+		wantErr:  true,
+	}, {
+		name:     "other realm",
+		template: "{{.user}}@OTHER.COM",
+		user:     "alice",
+		wantErr:  true,
+	}, {
+		name:     "empty name",
+		template: "{{.user}}",
+		wantErr:  true,
+	}, {
+		name:     "empty component",
+		template: "{{.user}}/{{.user}}",
+		wantErr:  true,
+	}, {
+		name:     "realm injected by the user",
+		template: "{{.user}}",
+		user:     "alice@OTHER.COM",
+		wantErr:  true,
+	}, {
+		name:     "space injected by the user",
+		template: "{{.user}}/admin",
+		user:     "alice bob",
+		wantErr:  true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := renderPrincipal(tc.template, principalTemplateData(pod, tc.user, "EXAMPLE.COM"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("renderPrincipal(%q) error = %v, want error %v", tc.template, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("renderPrincipal(%q) = %q, want %q", tc.template, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrincipalTemplateConfig(t *testing.T) {
+	c := &principalTemplateConfig{
+		Default:    "{{.user}}",
+		Namespaces: map[string]string{"batch": "{{.user}}/{{.namespace}}", "legacy": ""},
+	}
+	for namespace, want := range map[string]string{"default": "{{.user}}", "batch": "{{.user}}/{{.namespace}}", "legacy": ""} {
+		if got := c.forNamespace(namespace); got != want {
+			t.Errorf("forNamespace(%q) = %q, want %q", namespace, got, want)
+		}
+	}
+	if err := c.validate(); err != nil {
+		t.Errorf("validate() = %v", err)
+	}
+	c.Namespaces["broken"] = "{{.user"
+	if err := c.validate(); err == nil {
+		t.Error("validate() of an unterminated template succeeded")
+	}
+}
@@ -0,0 +1,619 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	provisionKadmin = "kadmin"
+	provisionLDAP   = "ldap"
+
+	defaultProvisionInterval = time.Minute
+	defaultProvisionSecret   = "kerberos-keytabs"
+	defaultProvisionTimeout  = 30 * time.Second
+	defaultKadminPath        = "kadmin"
+
+	// userAccountControl of created AD accounts: NORMAL_ACCOUNT and
+	// DONT_EXPIRE_PASSWORD, as the plugin never changes the password.
+	adUserAccountControl = 0x10200
+	// msDS-SupportedEncryptionTypes of created AD accounts: AES128 and AES256.
+	adEncryptionTypes = 0x18
+
+	ldapModifyRequest  = 0x66
+	ldapModifyResponse = 0x67
+	ldapAddRequest     = 0x68
+	ldapAddResponse    = 0x69
+	ldapDelRequest     = 0x4a
+	ldapDelResponse    = 0x6b
+	ldapModifyReplace  = 2
+	berSet             = 0x31
+)
+
+// Principal names the provisioner creates: components of letters, digits,
+// dots, dashes and underscores, which kadmin queries and DNs take unquoted.
+var provisionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*(/[A-Za-z0-9_][A-Za-z0-9._-]*)*$`)
+
+// Provisioning of the principals and keytabs of the workloads by the
+// controller, read from the file given with -provision.
+type provisionConfig struct {
+	// kadmin for MIT Kerberos or ldap for Active Directory.
+	Backend string `json:"backend"`
+	// Realm principals are created in. Pods of other realms are left alone.
+	Realm string `json:"realm"`
+	// Namespaces whose pods get principals, all if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Prefix of the pod annotations, "nri.io/" by default.
+	AnnotationPrefix string `json:"annotationPrefix,omitempty"`
+	// Secret keytabs are stored in, in the namespace of the pods, for pods
+	// without nri.io/kerberos-keytab-secret, "kerberos-keytabs" by default.
+	SecretName string `json:"secretName,omitempty"`
+	// Interval of the checks for pods of principals without keytab, 1m by default.
+	Interval duration `json:"interval,omitempty"`
+	// Time limit for provisioning one principal, 30s by default.
+	Timeout duration `json:"timeout,omitempty"`
+	// MIT Kerberos admin server.
+	Kadmin kadminConfig `json:"kadmin,omitempty"`
+	// Active Directory domain controller.
+	LDAP adConfig `json:"ldap,omitempty"`
+}
+
+type kadminConfig struct {
+	// kadmin binary, "kadmin" by default.
+	Path string `json:"path,omitempty"`
+	// Principal to administer the realm as, and its keytab.
+	Principal string `json:"principal"`
+	Keytab    string `json:"keytab"`
+	// Admin server, the one of the realm in krb5.conf if empty.
+	Server string `json:"server,omitempty"`
+	// mit or heimdal, the Kerberos implementation of the kadmin binary,
+	// detected from it by default.
+	Implementation string `json:"implementation,omitempty"`
+}
+
+type adConfig struct {
+	// Domain controller, ldaps://host[:port]. Passwords can only be set over TLS.
+	URL string `json:"url"`
+	// PEM CA bundle for verifying the server.
+	CAFile string `json:"caFile,omitempty"`
+	// DN to bind as, and the file holding its password. It needs to create
+	// users in BaseDN and reset their passwords.
+	BindDN           string `json:"bindDN"`
+	BindPasswordFile string `json:"bindPasswordFile"`
+	// Container accounts are looked up and created in, such as
+	// ou=workloads,dc=example,dc=com.
+	BaseDN string `json:"baseDN"`
+}
+
+func (c *provisionConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultProvisionInterval
+}
+
+func (c *provisionConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultProvisionTimeout
+}
+
+func (c *provisionConfig) annotation(name string) string {
+	if c.AnnotationPrefix != "" {
+		return c.AnnotationPrefix + name
+	}
+	return defaultAnnotationPrefix + name
+}
+
+func (c *provisionConfig) secretName() string {
+	if c.SecretName != "" {
+		return c.SecretName
+	}
+	return defaultProvisionSecret
+}
+
+func loadProvisionConfig(path string) (*provisionConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provisioning config %q: %w", path, err)
+	}
+	cfg := &provisionConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse provisioning config %q: %w", path, err)
+	}
+	if !realmRegexp.MatchString(cfg.Realm) {
+		return nil, fmt.Errorf("invalid provisioning config %q: invalid realm %q, must be upper case", path, cfg.Realm)
+	}
+	return cfg, nil
+}
+
+// Administration interface of the KDC.
+type kdcAdmin interface {
+	// Create the principal unless it exists, give it fresh keys and return
+	// a keytab with them. A principal created expires at the given time,
+	// unless zero.
+	provision(ctx context.Context, principal string, expires time.Time) ([]byte, error)
+	// Delete the principal and its keys, if it exists.
+	deprovision(ctx context.Context, principal string) error
+}
+
+func newKDCAdmin(backend string, kadminCfg kadminConfig, adCfg adConfig, exec Exec) (kdcAdmin, error) {
+	switch backend {
+	case provisionKadmin:
+		if kadminCfg.Principal == "" || kadminCfg.Keytab == "" {
+			return nil, errors.New("kadmin needs a principal and keytab")
+		}
+		if err := validKrb5Tools(kadminCfg.Implementation); err != nil {
+			return nil, fmt.Errorf("kadmin: %w", err)
+		}
+		return &kadmin{cfg: kadminCfg, exec: exec}, nil
+	case provisionLDAP:
+		u, err := url.Parse(adCfg.URL)
+		if err != nil || u.Scheme != "ldaps" || u.Host == "" {
+			return nil, fmt.Errorf("invalid LDAP URL %q, must be ldaps://", adCfg.URL)
+		}
+		if adCfg.BindDN == "" || adCfg.BaseDN == "" {
+			return nil, errors.New("ldap needs a bindDN and baseDN")
+		}
+		tlsCfg, err := ldapTLSConfig(u, adCfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		return &adAdmin{cfg: adCfg, tls: tlsCfg}, nil
+	default:
+		return nil, fmt.Errorf("invalid backend %q, must be kadmin or ldap", backend)
+	}
+}
+
+// Creator of the principals of the workloads and of the keytabs the plugin
+// fetches from Secrets, so that onboarding a tenant needs no work on the KDC.
+type provisioner struct {
+	cfg   *provisionConfig
+	kube  *kubeClient
+	ids   *identityCache
+	admin kdcAdmin
+}
+
+// Pod as listed, with what tells its principals.
+type provisionPod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string         `json:"nodeName,omitempty"`
+		Containers []podContainer `json:"containers"`
+	} `json:"spec"`
+}
+
+// Check for pods of principals without keytab periodically until the context
+// is cancelled, the first time once the KerberosIdentities had time to load.
+func (p *provisioner) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.cfg.interval()):
+		}
+		p.reconcile(ctx)
+	}
+}
+
+// Provision the principals of the pods whose keytab Secret lacks their keytab.
+func (p *provisioner) reconcile(ctx context.Context) {
+	list := struct {
+		Items []*provisionPod `json:"items"`
+	}{}
+	if err := p.kube.do(ctx, http.MethodGet, "/api/v1/pods", "", nil, &list); err != nil {
+		log.Errorf("failed to list pods: %v", err)
+		return
+	}
+
+	// principals by user, by namespace/Secret
+	wanted := map[string]map[string]string{}
+	for _, pod := range list.Items {
+		if len(p.cfg.Namespaces) > 0 && !slices.Contains(p.cfg.Namespaces, pod.Metadata.Namespace) {
+			continue
+		}
+		secret, users := p.podPrincipals(pod)
+		if len(users) == 0 {
+			continue
+		}
+		ref := pod.Metadata.Namespace + "/" + secret
+		if wanted[ref] == nil {
+			wanted[ref] = map[string]string{}
+		}
+		maps.Copy(wanted[ref], users)
+	}
+
+	for _, ref := range slices.Sorted(maps.Keys(wanted)) {
+		namespace, name, _ := strings.Cut(ref, "/")
+		data, err := p.kube.getSecretData(ctx, namespace, name)
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Errorf("failed to get Secret %s: %v", ref, err)
+			continue
+		}
+		exists := err == nil
+		added := map[string][]byte{}
+		for _, user := range slices.Sorted(maps.Keys(wanted[ref])) {
+			if _, ok := data[user+".keytab"]; ok {
+				continue
+			}
+			principal := wanted[ref][user]
+			pctx, cancel := context.WithTimeout(ctx, p.cfg.timeout())
+			kt, err := p.admin.provision(pctx, principal, time.Time{})
+			cancel()
+			if err != nil {
+				log.Errorf("failed to provision %s for Secret %s: %v", principal, ref, err)
+				continue
+			}
+			log.Infof("provisioned %s into Secret %s", principal, ref)
+			added[user+".keytab"] = kt
+		}
+		if len(added) == 0 {
+			continue
+		}
+		if err := p.storeKeytabs(ctx, namespace, name, exists, added); err != nil {
+			log.Errorf("failed to store keytabs in Secret %s: %v", ref, err)
+		}
+	}
+}
+
+// Name of the keytab Secret of a pod, and the principals of the pod in the
+// realm provisioned, by user. Pods asking for a Secret in another namespace,
+// for principals the KerberosIdentity of their namespace does not allow, or
+// whose principal names depend on the node they run on get none.
+func (p *provisioner) podPrincipals(pod *provisionPod) (string, map[string]string) {
+	normalizeAnnotations(pod.Metadata.Annotations, p.cfg.annotation)
+	ann := pod.Metadata.Annotations
+	namespace := pod.Metadata.Namespace
+	secret, ok := podKeytabSecret(pod, p.cfg.annotation, p.cfg.secretName())
+	if !ok {
+		return "", nil
+	}
+
+	id := p.ids.forNamespace(namespace)
+	realm := ann[p.cfg.annotation("kerberos-realm")]
+	var users []string
+	for k, v := range ann {
+		switch {
+		case k == p.cfg.annotation("kerberos-user") || strings.HasPrefix(k, p.cfg.annotation("kerberos-user.")):
+			users = append(users, v)
+		case strings.HasPrefix(k, p.cfg.annotation("kerberos-principal.")):
+			user, r, _ := strings.Cut(v, "@")
+			if r == "" || r == p.cfg.Realm {
+				users = append(users, user)
+			}
+		case k == p.cfg.annotation(principalsAnnotation):
+			if principals, err := parsePrincipals(v, p.cfg.Realm); err == nil {
+				users = append(users, principals...)
+			}
+		}
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, env := range c.Env {
+			switch env.Name {
+			case "KERBEROS_USER":
+				users = append(users, env.Value)
+			case "KERBEROS_REALM":
+				if realm == "" {
+					realm = env.Value
+				}
+			}
+		}
+	}
+	if realm == "" && id != nil {
+		realm = id.Spec.Realm
+	}
+	if realm != "" && realm != p.cfg.Realm {
+		return "", nil
+	}
+
+	principals := map[string]string{}
+	for _, user := range users {
+		if validateUser(user) != nil || id != nil && !id.allows(user) {
+			continue
+		}
+		name := user
+		if id != nil && id.Spec.PrincipalTemplate != "" {
+			var err error
+			name, err = renderPrincipal(id.Spec.PrincipalTemplate, map[string]string{
+				"user":      user,
+				"namespace": namespace,
+				"pod":       pod.Metadata.Name,
+				"realm":     p.cfg.Realm,
+			})
+			if err != nil {
+				log.Debugf("not provisioning %s of pod %s/%s: %v", user, namespace, pod.Metadata.Name, err)
+				continue
+			}
+		}
+		if !provisionNameRegexp.MatchString(name) {
+			log.Debugf("not provisioning %s of pod %s/%s, unsupported name", name, namespace, pod.Metadata.Name)
+			continue
+		}
+		principals[user] = name + "@" + p.cfg.Realm
+	}
+	return secret, principals
+}
+
+// Name of the keytab Secret of a pod, the one of nri.io/kerberos-keytab-secret
+// or the default, and false if it names one of another namespace.
+func podKeytabSecret(pod *provisionPod, annotation func(string) string, def string) (string, bool) {
+	ref, ok := pod.Metadata.Annotations[annotation(keytabSecretAnnotation)]
+	if !ok {
+		return def, true
+	}
+	ns, name, found := strings.Cut(ref, "/")
+	if !found {
+		return ref, true
+	}
+	return name, ns == pod.Metadata.Namespace
+}
+
+// Add keytabs to a Secret, creating it if it does not exist.
+func (p *provisioner) storeKeytabs(ctx context.Context, namespace, name string, exists bool, keytabs map[string][]byte) error {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets", namespace)
+	if exists {
+		patch := map[string]any{"data": keytabs}
+		return p.kube.do(ctx, http.MethodPatch, path+"/"+name, "application/merge-patch+json", patch, nil)
+	}
+	secret := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]any{
+			"name":   name,
+			"labels": map[string]string{"app.kubernetes.io/managed-by": "nri-kerberos"},
+		},
+		"type": "Opaque",
+		"data": keytabs,
+	}
+	return p.kube.do(ctx, http.MethodPost, path, "", secret, nil)
+}
+
+// MIT Kerberos or Heimdal admin server, administered with kadmin.
+type kadmin struct {
+	cfg  kadminConfig
+	exec Exec
+}
+
+// Create the principal with a random key unless it exists and export its
+// keys, which ktadd randomizes, into a keytab.
+func (k *kadmin) provision(ctx context.Context, principal string, expires time.Time) ([]byte, error) {
+	out, err := k.run(ctx, kadminQuery{Op: kadminAdd, Principal: principal, Expires: expires})
+	if err != nil && !k.tools().kadminExists(out) {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "kadmin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keytab")
+	if _, err := k.run(ctx, kadminQuery{Op: kadminExport, Principal: principal, Keytab: path}); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (k *kadmin) deprovision(ctx context.Context, principal string) error {
+	out, err := k.run(ctx, kadminQuery{Op: kadminDelete, Principal: principal})
+	if err != nil && k.tools().kadminMissing(out) {
+		return nil
+	}
+	return err
+}
+
+func (k *kadmin) path() string {
+	if k.cfg.Path != "" {
+		return k.cfg.Path
+	}
+	return defaultKadminPath
+}
+
+func (k *kadmin) tools() krb5Tools {
+	return krb5ToolsOf(k.exec, k.cfg.Implementation, k.path())
+}
+
+// Run a kadmin query on the realm of its principal, returning the output of
+// kadmin. MIT kadmin exits successfully when a query fails, which is told by
+// the error message it prints.
+func (k *kadmin) run(ctx context.Context, query kadminQuery) (string, error) {
+	tools := k.tools()
+	_, realm, _ := strings.Cut(query.Principal, "@")
+	// principal names are checked against provisionNameRegexp
+	out, err := k.exec.Run(ctx, k.path(), tools.kadminArgs(k.cfg, realm, query)...)
+	if err == nil && tools.kadminFailed(string(out)) {
+		err = errors.New("query failed")
+	}
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return string(out), fmt.Errorf("kadmin %s failed: %w: %s", query.Op, err, lines[len(lines)-1])
+	}
+	return string(out), nil
+}
+
+// Active Directory domain controller, administered over LDAP. Accounts get
+// random passwords the keys of the keytab are derived from.
+type adAdmin struct {
+	cfg adConfig
+	tls *tls.Config
+}
+
+// Connect to the domain controller and look up the account of a principal,
+// returning the DN of its entry, or an empty one if it has none.
+func (a *adAdmin) account(ctx context.Context, principal string) (*ldapConn, string, error) {
+	name, _, _ := strings.Cut(principal, "@")
+	if strings.Contains(name, "/") {
+		return nil, "", fmt.Errorf("%s has an instance, which AD user accounts cannot have", principal)
+	}
+	conn, err := dialLDAP(ctx, a.cfg.URL, a.tls, a.cfg.BindDN, a.cfg.BindPasswordFile)
+	if err != nil {
+		return nil, "", err
+	}
+	entries, err := conn.search(a.cfg.BaseDN, ldapEqualityFilter("objectClass", "user", "sAMAccountName", name), 2, ldapTimeout(ctx))
+	if err == nil && len(entries) > 1 {
+		err = fmt.Errorf("several accounts %s under %s", name, a.cfg.BaseDN)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("LDAP search for %s failed: %w", name, err)
+	}
+	if len(entries) == 0 {
+		return conn, "", nil
+	}
+	return conn, entries[0]["dn"], nil
+}
+
+// Time limit of LDAP searches, that left to the context.
+func ldapTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return defaultProvisionTimeout
+}
+
+// Create the user account of the principal unless it exists, set a random
+// password and return a keytab with the AES keys of it.
+func (a *adAdmin) provision(ctx context.Context, principal string, expires time.Time) ([]byte, error) {
+	name, realm, _ := strings.Cut(principal, "@")
+	conn, dn, err := a.account(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	pwd := adPassword(password)
+	if dn != "" {
+		change := ber(berSequence, berInt(berEnumerated, ldapModifyReplace),
+			ber(berSequence, berString(berOctetString, "unicodePwd"), ber(berSet, ber(berOctetString, pwd))))
+		modify := ber(ldapModifyRequest, berString(berOctetString, dn), ber(berSequence, change))
+		if err := conn.request(modify, ldapModifyResponse); err != nil {
+			return nil, fmt.Errorf("failed to set the password of %s: %w", dn, err)
+		}
+	} else {
+		dn = "CN=" + name + "," + a.cfg.BaseDN
+		attr := func(name string, values ...[]byte) []byte {
+			var vs [][]byte
+			for _, v := range values {
+				vs = append(vs, ber(berOctetString, v))
+			}
+			return ber(berSequence, berString(berOctetString, name), ber(berSet, vs...))
+		}
+		attrs := [][]byte{
+			attr("objectClass", []byte("top"), []byte("person"), []byte("organizationalPerson"), []byte("user")),
+			attr("sAMAccountName", []byte(name)),
+			attr("userPrincipalName", []byte(principal)),
+			attr("unicodePwd", pwd),
+			attr("userAccountControl", []byte(strconv.Itoa(adUserAccountControl))),
+			attr("msDS-SupportedEncryptionTypes", []byte(strconv.Itoa(adEncryptionTypes))),
+		}
+		if !expires.IsZero() {
+			attrs = append(attrs, attr("accountExpires", []byte(strconv.FormatInt(windowsFileTime(expires), 10))))
+		}
+		add := ber(ldapAddRequest, berString(berOctetString, dn), ber(berSequence, attrs...))
+		if err := conn.request(add, ldapAddResponse); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", dn, err)
+		}
+	}
+
+	entries, err := conn.search(dn, ldapEqualityFilter("objectClass", "user"), 1, ldapTimeout(ctx), "msDS-KeyVersionNumber")
+	if err != nil || len(entries) == 0 {
+		return nil, fmt.Errorf("cannot read the key version of %s: %v", dn, err)
+	}
+	kvno, err := strconv.ParseUint(entries[0]["msds-keyversionnumber"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key version of %s: %w", dn, err)
+	}
+
+	kt := keytab.New()
+	for _, etype := range []int32{etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.AES128_CTS_HMAC_SHA1_96} {
+		if err := kt.AddEntry(name, realm, password, time.Now(), uint8(kvno), etype); err != nil {
+			return nil, err
+		}
+	}
+	// key versions above 255 only fit the 32-bit field
+	for i := range kt.Entries {
+		kt.Entries[i].KVNO = uint32(kvno)
+	}
+	return kt.Marshal()
+}
+
+func (a *adAdmin) deprovision(ctx context.Context, principal string) error {
+	conn, dn, err := a.account(ctx, principal)
+	if err != nil || dn == "" {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.request(berString(ldapDelRequest, dn), ldapDelResponse); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", dn, err)
+	}
+	return nil
+}
+
+// Time as AD takes it: 100ns intervals since 1601-01-01 UTC.
+func windowsFileTime(t time.Time) int64 {
+	const epochDiff = 11644473600 // seconds from 1601 to 1970
+	return (t.Unix()+epochDiff)*10000000 + int64(t.Nanosecond()/100)
+}
+
+// Random password meeting the AD complexity requirements.
+func randomPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "Aa1-" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Password as AD takes it in unicodePwd: quoted, in UTF-16LE.
+func adPassword(password string) []byte {
+	units := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
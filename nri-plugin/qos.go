@@ -0,0 +1,217 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Classes of the ticket operations of the pods of a namespace, in the order
+// they are served.
+const (
+	qosSystem      = "system"
+	qosInteractive = "interactive"
+	qosBatch       = "batch"
+)
+
+var qosClasses = []string{qosSystem, qosInteractive, qosBatch}
+
+// Share of the rate limit of a realm taken by batch operations by default.
+const defaultBatchRateShare = 0.5
+
+// Quality of service of the ticket operations of namespaces, so that the pod
+// churn of a batch tenant does not hold up the setups of latency-sensitive
+// services. Setups and renewals waiting for one of the maxParallelSetups
+// slots are served system first and batch last, each class has a share of
+// the KDC rate limit of a realm of its own, and a budget of attempts of its
+// own on transient failures.
+type qosConfig struct {
+	// Class of the namespaces matching none, interactive by default.
+	Default string `json:"default,omitempty"`
+	// Classes of namespaces, the first matching.
+	Namespaces []namespaceQoSConfig `json:"namespaces,omitempty"`
+	// Settings of the classes, by name.
+	Classes map[string]qosClassConfig `json:"classes,omitempty"`
+}
+
+// Class of the namespaces matching the patterns.
+type namespaceQoSConfig struct {
+	Namespaces []string `json:"namespaces"`
+	Class      string   `json:"class"`
+}
+
+// Settings of a class.
+type qosClassConfig struct {
+	// Fraction of the requests per second of the rate limit of a realm the
+	// operations of the class may take, all of them by default but for batch,
+	// which takes half.
+	RateShare float64 `json:"rateShare,omitempty"`
+	// Attempts in all of an operation of the class, those of retry by default.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+}
+
+func validQoSClass(class string) error {
+	if !slices.Contains(qosClasses, class) {
+		return fmt.Errorf("unknown class %q, must be one of %v", class, qosClasses)
+	}
+	return nil
+}
+
+func (c *qosConfig) validate() error {
+	if c.Default != "" {
+		if err := validQoSClass(c.Default); err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+	}
+	for i, ns := range c.Namespaces {
+		if len(ns.Namespaces) == 0 {
+			return fmt.Errorf("namespaces[%d]: no namespaces", i)
+		}
+		if err := validQoSClass(ns.Class); err != nil {
+			return fmt.Errorf("namespaces[%d]: %w", i, err)
+		}
+	}
+	for name, class := range c.Classes {
+		if err := validQoSClass(name); err != nil {
+			return fmt.Errorf("classes: %w", err)
+		}
+		if class.RateShare < 0 || class.RateShare > 1 {
+			return fmt.Errorf("classes: %s: rateShare %g must be between 0 and 1", name, class.RateShare)
+		}
+		if class.MaxAttempts < 0 {
+			return fmt.Errorf("classes: %s: maxAttempts %d must not be negative", name, class.MaxAttempts)
+		}
+	}
+	return nil
+}
+
+// Class of the pods of a namespace.
+func (c *qosConfig) class(namespace string) string {
+	for _, ns := range c.Namespaces {
+		if matchesAny(ns.Namespaces, namespace) {
+			return ns.Class
+		}
+	}
+	if c.Default != "" {
+		return c.Default
+	}
+	return qosInteractive
+}
+
+// Share of the rate limit of a realm of a class.
+func (c *qosConfig) rateShare(class string) float64 {
+	if share := c.Classes[class].RateShare; share > 0 {
+		return share
+	}
+	if class == qosBatch {
+		return defaultBatchRateShare
+	}
+	return 1
+}
+
+// Retry policy of a class, that of retry with the attempts of the class.
+func (c *qosConfig) retry(class string, retry *retryConfig) *retryConfig {
+	attempts := c.Classes[class].MaxAttempts
+	if attempts <= 0 {
+		return retry
+	}
+	policy := *retry
+	policy.MaxAttempts = attempts
+	return &policy
+}
+
+// Class of the operations of the parameters, interactive for those of no pod.
+func (kp *kerberosParams) qosClass() string {
+	if kp.QoS != "" {
+		return kp.QoS
+	}
+	return qosInteractive
+}
+
+// Semaphore of at most n holders, waiters served by class and then in the
+// order they came.
+type prioritySlots struct {
+	sync.Mutex
+	free    int
+	waiters map[string][]chan struct{}
+}
+
+func newPrioritySlots(n int) *prioritySlots {
+	return &prioritySlots{free: n, waiters: map[string][]chan struct{}{}}
+}
+
+// Take a slot for an operation of the class, waiting until one is free.
+func (s *prioritySlots) acquire(ctx context.Context, class string) error {
+	if !slices.Contains(qosClasses, class) {
+		class = qosInteractive
+	}
+	s.Lock()
+	if s.free > 0 && s.queued() == 0 {
+		s.free--
+		s.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.waiters[class] = append(s.waiters[class], ready)
+	qosQueueDepth.WithLabelValues(class).Inc()
+	s.Unlock()
+	defer qosQueueDepth.WithLabelValues(class).Dec()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.Lock()
+		defer s.Unlock()
+		if i := slices.Index(s.waiters[class], ready); i >= 0 {
+			s.waiters[class] = slices.Delete(s.waiters[class], i, i+1)
+			return ctx.Err()
+		}
+		// handed the slot meanwhile
+		s.releaseLocked()
+		return ctx.Err()
+	}
+}
+
+// Give a slot back, to the first waiter of the first class waiting.
+func (s *prioritySlots) release() {
+	s.Lock()
+	s.releaseLocked()
+	s.Unlock()
+}
+
+func (s *prioritySlots) releaseLocked() {
+	for _, class := range qosClasses {
+		if q := s.waiters[class]; len(q) > 0 {
+			s.waiters[class] = q[1:]
+			close(q[0])
+			return
+		}
+	}
+	s.free++
+}
+
+func (s *prioritySlots) queued() int {
+	n := 0
+	for _, q := range s.waiters {
+		n += len(q)
+	}
+	return n
+}
@@ -0,0 +1,168 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Rate of KDC requests of a realm.
+type rateLimitConfig struct {
+	// AS and TGS requests per second to the KDCs of a realm, no limit if zero.
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	// Requests sent at once before the rate applies, 10 by default.
+	Burst int `json:"burst,omitempty"`
+}
+
+const defaultRateLimitBurst = 10
+
+func (c *rateLimitConfig) validate() error {
+	if c.RequestsPerSecond < 0 || c.Burst < 0 {
+		return fmt.Errorf("requestsPerSecond %g and burst %d must not be negative", c.RequestsPerSecond, c.Burst)
+	}
+	return nil
+}
+
+func (c *rateLimitConfig) burst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return defaultRateLimitBurst
+}
+
+// Rate limit of the KDC requests of a realm: that of the realm table, or the
+// one of all realms.
+func (c *config) rateLimit(realm string) rateLimitConfig {
+	if r, ok := c.Realms[realm]; ok && r.RateLimit != nil {
+		return *r.RateLimit
+	}
+	return c.KDCRateLimit
+}
+
+// Backend wrapper holding setups and renewals back while the realm they are
+// for is over its rate of KDC requests, so that a mass reschedule of pods, as
+// when nodes are drained, does not flood the KDC. Operations over the limit
+// wait in turn, and count in nri_kerberos_kdc_queue_depth. Each QoS class
+// waits for its share of the rate first, so that the operations of one class
+// cannot take all of it.
+type rateLimitedBackend struct {
+	KerberosBackend
+	limit func(realm string) rateLimitConfig
+	share func(class string) float64
+	clock Clock
+
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimitedBackend(b KerberosBackend, limit func(realm string) rateLimitConfig, share func(class string) float64, clock Clock) *rateLimitedBackend {
+	return &rateLimitedBackend{KerberosBackend: b, limit: limit, share: share, clock: clock, buckets: map[string]*tokenBucket{}}
+}
+
+func (b *rateLimitedBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	if err := b.wait(ctx, kp); err != nil {
+		return err
+	}
+	return b.KerberosBackend.Setup(ctx, kp)
+}
+
+func (b *rateLimitedBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	if err := b.wait(ctx, kp); err != nil {
+		return err
+	}
+	return b.KerberosBackend.Renew(ctx, kp)
+}
+
+// Wait for the requests of an operation: one for the TGT and one for the
+// service ticket of each NFS server, within the share of its class and then
+// within the rate of the realm.
+func (b *rateLimitedBackend) wait(ctx context.Context, kp *kerberosParams) error {
+	limit := b.limit(kp.Realm)
+	if limit.RequestsPerSecond <= 0 {
+		return nil
+	}
+	class := kp.qosClass()
+	if share := b.share(class); share < 1 {
+		classLimit := rateLimitConfig{RequestsPerSecond: limit.RequestsPerSecond * share, Burst: max(int(float64(limit.burst())*share), 1)}
+		if err := b.take(ctx, kp, kp.Realm+"/"+class, classLimit); err != nil {
+			return err
+		}
+	}
+	return b.take(ctx, kp, kp.Realm, limit)
+}
+
+// Take the tokens of the requests of an operation from the bucket of the key.
+func (b *rateLimitedBackend) take(ctx context.Context, kp *kerberosParams, key string, limit rateLimitConfig) error {
+	b.Lock()
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.burst()), last: b.clock.Now()}
+		b.buckets[key] = bucket
+	}
+	b.Unlock()
+
+	n := min(1+len(kp.nfsServices()), limit.burst())
+	delay := bucket.reserve(b.clock.Now(), limit.RequestsPerSecond, limit.burst(), n)
+	if delay <= 0 {
+		return nil
+	}
+
+	loggerFrom(ctx).Debugf("KDC requests of %s over the rate limit of %s, waiting %s", kp.Realm, key, delay.Round(time.Millisecond))
+	kdcQueueDepth.WithLabelValues(kp.Realm).Inc()
+	defer kdcQueueDepth.WithLabelValues(kp.Realm).Dec()
+	timer := b.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		bucket.cancel(n)
+		return fmt.Errorf("waiting for the KDC rate limit of %s: %w", kp.Realm, ctx.Err())
+	}
+}
+
+// Token bucket refilled at a rate up to a burst. Tokens are taken ahead of
+// time, the bucket going negative, so that waiters are served in the order
+// they came.
+type tokenBucket struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Take n tokens at now, returning how long to wait until they are there.
+func (t *tokenBucket) reserve(now time.Time, rate float64, burst, n int) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	t.tokens = min(t.tokens+now.Sub(t.last).Seconds()*rate, float64(burst))
+	t.last = now
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / rate * float64(time.Second))
+}
+
+// Give back the tokens of a reservation not used.
+func (t *tokenBucket) cancel(n int) {
+	t.Lock()
+	t.tokens += float64(n)
+	t.Unlock()
+}
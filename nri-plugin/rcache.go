@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Replay cache of the workloads, for those accepting GSSAPI contexts, which
+// libkrb5 keeps in /var/tmp by default, often read-only or shared by all
+// containers of the image. libkrb5 takes its settings from the environment
+// only.
+type replayCacheConfig struct {
+	// KRB5RCACHETYPE: dfl, file2 or none, which turns replay detection off,
+	// that of libkrb5 if empty.
+	Type string `json:"type,omitempty"`
+	// KRB5RCACHEDIR: directory of the replay cache in the containers, such as
+	// the pod credential cache directory, which is writable and private to
+	// the pod, that of libkrb5 if empty.
+	Dir string `json:"dir,omitempty"`
+}
+
+func (c *replayCacheConfig) validate() error {
+	switch c.Type {
+	case "", "dfl", "file2", "none":
+	default:
+		return fmt.Errorf("unknown type %q, must be dfl, file2 or none", c.Type)
+	}
+	if c.Dir != "" && !filepath.IsAbs(c.Dir) {
+		return fmt.Errorf("dir %q must be absolute", c.Dir)
+	}
+	return nil
+}
+
+// Set the replay cache environment of a container, unless it does itself.
+func (c *replayCacheConfig) adjust(container *api.Container, adjust *api.ContainerAdjustment) {
+	if c.Type != "" && !hasEnv(container, "KRB5RCACHETYPE") {
+		adjust.AddEnv("KRB5RCACHETYPE", c.Type)
+	}
+	if c.Dir != "" && c.Type != "none" && !hasEnv(container, "KRB5RCACHEDIR") {
+		adjust.AddEnv("KRB5RCACHEDIR", c.Dir)
+	}
+}
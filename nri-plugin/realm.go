@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Collection path of the namespaces.
+const namespacesPath = "/api/v1/namespaces"
+
+// Settings of a realm of the node realm table.
+type realmConfig struct {
+	// KDCs of the realm, in order of preference.
+	KDCs []string `json:"kdcs,omitempty"`
+	// NFS server hostname used for pods of the realm.
+	NFS string `json:"nfs,omitempty"`
+	// DNS domains of the realm, mapped to it in the krb5.conf of the pods.
+	Domains []string `json:"domains,omitempty"`
+	// MS-KKDCP proxy the KDCs of the realm are reached through.
+	KDCProxy *kdcProxyConfig `json:"kdcProxy,omitempty"`
+	// Rate of KDC requests of the realm, instead of kdcRateLimit.
+	RateLimit *rateLimitConfig `json:"rateLimit,omitempty"`
+	// Realm of the NFS service principals used by pods of the realm, if
+	// another one trusting it.
+	NFSRealm string `json:"nfsRealm,omitempty"`
+	// Trust paths to other realms, by realm: the realms in between, none if
+	// trusted directly. Written into [capaths] of the krb5.conf of the pods.
+	CAPaths map[string][]string `json:"capaths,omitempty"`
+}
+
+// Namespace, the parts we use.
+type kubeNamespace struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+}
+
+// Cache of the realms namespaces are labelled with, kept up to date with a watch.
+type namespaceRealmCache struct {
+	kube  *kubeClient
+	label string
+
+	sync.RWMutex
+	byNamespace map[string]string
+}
+
+func newNamespaceRealmCache(kube *kubeClient, label string) *namespaceRealmCache {
+	return &namespaceRealmCache{
+		kube:        kube,
+		label:       label,
+		byNamespace: map[string]string{},
+	}
+}
+
+// Realm a namespace is labelled with, or empty. Safe to call on a nil cache.
+func (c *namespaceRealmCache) forNamespace(namespace string) string {
+	if c == nil {
+		return ""
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.byNamespace[namespace]
+}
+
+// Keep the cache in sync until the context is cancelled.
+func (c *namespaceRealmCache) run(ctx context.Context) {
+	const maxBackoff = 2 * time.Minute
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		err := c.sync(ctx, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, errGone) {
+			log.Warnf("namespace watch failed, retrying in %s: %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+}
+
+// List the labelled namespaces and watch for changes until the watch ends.
+// Namespaces losing the label are reported deleted by the watch.
+func (c *namespaceRealmCache) sync(ctx context.Context, synced func()) error {
+	path := namespacesPath + "?labelSelector=" + url.QueryEscape(c.label)
+	list := struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*kubeNamespace `json:"items"`
+	}{}
+	if err := c.kube.do(ctx, http.MethodGet, path, "", nil, &list); err != nil {
+		return err
+	}
+
+	realms := map[string]string{}
+	for _, ns := range list.Items {
+		realms[ns.Metadata.Name] = ns.Metadata.Labels[c.label]
+	}
+	c.Lock()
+	c.byNamespace = realms
+	c.Unlock()
+	synced()
+
+	rv := list.Metadata.ResourceVersion
+	return c.kube.watch(ctx, path, rv, func(ev *watchEvent) error {
+		ns := &kubeNamespace{}
+		if err := json.Unmarshal(ev.Object, ns); err != nil {
+			return fmt.Errorf("failed to decode namespace: %w", err)
+		}
+		if ev.Type == "BOOKMARK" {
+			return nil
+		}
+
+		c.Lock()
+		if realm := ns.Metadata.Labels[c.label]; ev.Type == "DELETED" || realm == "" {
+			delete(c.byNamespace, ns.Metadata.Name)
+		} else {
+			c.byNamespace[ns.Metadata.Name] = realm
+		}
+		c.Unlock()
+		return nil
+	})
+}
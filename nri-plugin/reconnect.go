@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Reconnection to the runtime after losing the NRI connection.
+type reconnectConfig struct {
+	// Exit instead, leaving the restart to the kubelet.
+	Disabled bool `json:"disabled,omitempty"`
+	// Attempts before giving up and exiting, 0 for no limit.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// Delay before the first attempt, doubled for each further one, 1s by default.
+	BaseDelay duration `json:"baseDelay,omitempty"`
+	// Longest delay between attempts, 30s by default.
+	MaxDelay duration `json:"maxDelay,omitempty"`
+}
+
+func (c *reconnectConfig) validate() error {
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts %d must not be negative", c.MaxAttempts)
+	}
+	return nil
+}
+
+// Delay after the failed attempt, counting from 1, with the backoff of retries.
+func (c *reconnectConfig) delay(attempt int) time.Duration {
+	return (&retryConfig{BaseDelay: c.BaseDelay, MaxDelay: c.MaxDelay}).delay(attempt)
+}
+
+// Connect to the runtime and serve it until the context is cancelled,
+// connecting again with backoff when the connection is lost or cannot be made,
+// as while containerd restarts. The stub registers and is synchronized anew on
+// each connection, while the managed credentials, their renewals and the
+// pending cleanups carry on.
+func (p *plugin) runStub(ctx context.Context) error {
+	attempt := 0
+	for {
+		err := p.stub.Start(ctx)
+		if err == nil {
+			attempt = 0
+			p.health.reconnecting.Store(false)
+			p.stub.Wait()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		cfg := p.config().Reconnect
+		if cfg.Disabled {
+			return err
+		}
+		attempt++
+		if cfg.MaxAttempts > 0 && attempt > cfg.MaxAttempts {
+			return fmt.Errorf("giving up reconnecting to the runtime after %d attempts: %w", cfg.MaxAttempts, err)
+		}
+		delay := cfg.delay(attempt)
+		if err != nil {
+			log.Warnf("failed to connect to the runtime, attempt %d, retrying in %s: %v", attempt, delay.Round(time.Millisecond), err)
+		} else {
+			log.Warnf("lost the connection to the runtime, reconnecting in %s", delay.Round(time.Millisecond))
+		}
+		p.health.reconnecting.Store(true)
+		runtimeReconnects.Inc()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
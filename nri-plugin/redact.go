@@ -0,0 +1,148 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Keys whose values are masked in logs by default: the KERBEROS_* env of
+// renewal sidecars, passwords, tokens and secrets, HTTP credentials and
+// keytabs.
+const defaultRedactKeys = "KERBEROS_*,*PASSWORD*,*TOKEN*,*SECRET*,Authorization,*KEYTAB_DATA*"
+
+const redacted = "***"
+
+var (
+	// Keytabs encoded in base64, which start with the 0x0502 header.
+	keytabBase64Regexp = regexp.MustCompile(`\bBQ[EI][A-Za-z0-9+/]{37,}={0,2}`)
+	// A double quoted value with its closing quote.
+	quotedRegexp = regexp.MustCompile(`^"(?:[^"\\]|\\.)*"$`)
+	// Principal names with an upper case realm.
+	principalRegexp = regexp.MustCompile(`\b([A-Za-z0-9][A-Za-z0-9._/-]*)@([A-Z0-9][A-Z0-9.-]*[A-Z0-9])\b`)
+)
+
+// Hook masking the values of sensitive keys in the messages and fields of the
+// log entries, as in KEY=value, KEY: value and "KEY":"value", which covers the
+// env of containers, YAML dumps and JSON, and keytabs in base64 wherever they
+// appear. Quoted values are masked up to their closing quote, or the end of
+// the line without one, KEY=value up to the end of the token and KEY: value
+// up to the end of the line, so that values with separators in them do not
+// leak their rest. With principals, the names of principals are replaced by a short
+// hash, which still tells entries of the same principal apart.
+type redactor struct {
+	keys       []*regexp.Regexp
+	values     *regexp.Regexp
+	principals bool
+}
+
+// Redactor of the keys, comma separated glob patterns matched regardless of
+// case.
+func newRedactor(keys string, principals bool) (*redactor, error) {
+	r := &redactor{principals: principals}
+	var alternatives []string
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(key), `\*`, `[A-Za-z0-9_.-]*`)
+		re, err := regexp.Compile(`(?i)^` + pattern + `$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", key, err)
+		}
+		r.keys = append(r.keys, re)
+		alternatives = append(alternatives, pattern)
+	}
+	if len(alternatives) > 0 {
+		r.values = regexp.MustCompile(`(?i)(^|[^A-Za-z0-9_.-])(` + strings.Join(alternatives, "|") + `)(?:` +
+			`("?\s*[=:]\s*)("(?:[^"\\\r\n]|\\.)*"?|'[^'\r\n]*'?)|` +
+			`("?\s*=\s*)((?:(?:Basic|Bearer|Negotiate)\s+)?\S+)|` +
+			`("?\s*:\s*)([^\s"'][^\r\n]*))`)
+	}
+	return r, nil
+}
+
+func (r *redactor) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *redactor) Fire(e *logrus.Entry) error {
+	e.Message = r.redact(e.Message)
+	for key, value := range e.Data {
+		if r.sensitive(key) {
+			e.Data[key] = redacted
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			e.Data[key] = r.redact(v)
+		case error:
+			if s := r.redact(v.Error()); s != v.Error() {
+				e.Data[key] = s
+			}
+		}
+	}
+	return nil
+}
+
+func (r *redactor) sensitive(key string) bool {
+	for _, re := range r.keys {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mask a value, keeping its quotes.
+func maskValue(value string) string {
+	switch {
+	case strings.HasPrefix(value, `"`) && quotedRegexp.MatchString(value):
+		return `"` + redacted + `"`
+	case strings.HasPrefix(value, "'") && len(value) > 1 && strings.HasSuffix(value, "'"):
+		return "'" + redacted + "'"
+	case strings.HasPrefix(value, `"`), strings.HasPrefix(value, "'"):
+		return value[:1] + redacted
+	}
+	return redacted
+}
+
+// Mask the sensitive values in a string.
+func (r *redactor) redact(s string) string {
+	if r.values != nil {
+		s = r.values.ReplaceAllStringFunc(s, func(m string) string {
+			sub := r.values.FindStringSubmatch(m)
+			return sub[1] + sub[2] + sub[3] + sub[5] + sub[7] + maskValue(sub[4]+sub[6]+sub[8])
+		})
+	}
+	s = keytabBase64Regexp.ReplaceAllString(s, "[keytab]")
+	if r.principals {
+		s = principalRegexp.ReplaceAllStringFunc(s, func(m string) string {
+			name, realm, _ := strings.Cut(m, "@")
+			sum := sha256.Sum256([]byte(name))
+			return "principal-" + hex.EncodeToString(sum[:4]) + "@" + realm
+		})
+	}
+	return s
+}
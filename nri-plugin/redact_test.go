@@ -0,0 +1,148 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	const keytab = "BQIAAABHAAIAC0VYQU1QTEUuQ09NAAVhbGljZQAAAAFnAAAAAQASACA"
+	for _, tc := range []struct {
+		name       string
+		in         string
+		want       string
+		principals bool
+	}{{
+		name: "env",
+		in:   "env KERBEROS_PASSWORD=secret PATH=/bin",
+		want: "env KERBEROS_PASSWORD=*** PATH=/bin",
+	}, {
+		name: "env value with separators",
+		in:   "env KERBEROS_PASSWORD=a,b;c}d]e PATH=/bin",
+		want: "env KERBEROS_PASSWORD=*** PATH=/bin",
+	}, {
+		name: "env in a list",
+		in:   "env [KERBEROS_PASSWORD=a,b HOME=/home/alice]",
+		want: "env [KERBEROS_PASSWORD=*** HOME=/home/alice]",
+	}, {
+		name: "YAML value with separators",
+		in:   "password: a, b; c}\nuser: alice",
+		want: "password: ***\nuser: alice",
+	}, {
+		name: "double quoted",
+		in:   `{"password":"a,\"b\" c","user":"alice"}`,
+		want: `{"password":"***","user":"alice"}`,
+	}, {
+		name: "double quoted env",
+		in:   `KERBEROS_PASSWORD="a b,c" USER=alice`,
+		want: `KERBEROS_PASSWORD="***" USER=alice`,
+	}, {
+		name: "single quoted",
+		in:   "client_secret='a b,c' user=alice",
+		want: "client_secret='***' user=alice",
+	}, {
+		name: "unterminated double quote",
+		in:   "KERBEROS_PASSWORD=\"a, b} c\nuser=alice",
+		want: "KERBEROS_PASSWORD=\"***\nuser=alice",
+	}, {
+		name: "unterminated single quote",
+		in:   "token: 'a, b",
+		want: "token: '***",
+	}, {
+		name: "authorization header",
+		in:   "Authorization: Bearer abc.def, retrying",
+		want: "Authorization: ***",
+	}, {
+		name: "authorization env",
+		in:   "Authorization=Basic YWxpY2U6c2VjcmV0 status=401",
+		want: "Authorization=*** status=401",
+	}, {
+		name: "key part of a longer name",
+		in:   "NOT_A_SECRET_X=1 MYPASSWORDFILE=/etc/pw",
+		want: "NOT_A_SECRET_X=*** MYPASSWORDFILE=***",
+	}, {
+		name: "other keys",
+		in:   "user=alice uid: 10002",
+		want: "user=alice uid: 10002",
+	}, {
+		name: "keytab",
+		in:   "downloaded " + keytab + " for alice",
+		want: "downloaded [keytab] for alice",
+	}, {
+		name:       "principals",
+		in:         "TGT of alice@EXAMPLE.COM, nfs/nfs.example.com@EXAMPLE.COM",
+		want:       "TGT of principal-2bd806c9@EXAMPLE.COM, principal-96e7a703@EXAMPLE.COM",
+		principals: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newRedactor(defaultRedactKeys, tc.principals)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.redact(tc.in); got != tc.want {
+				t.Errorf("redact(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedactNoKeys(t *testing.T) {
+	r, err := newRedactor("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := "KERBEROS_PASSWORD=secret BQIAAABHAAIAC0VYQU1QTEUuQ09NAAVhbGljZQAAAAFnAAAAAQASACA"
+	if got, want := r.redact(in), "KERBEROS_PASSWORD=secret [keytab]"; got != want {
+		t.Errorf("redact(%q) = %q, want %q", in, got, want)
+	}
+}
+
+func TestRedactorFire(t *testing.T) {
+	r, err := newRedactor(defaultRedactKeys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := logrus.NewEntry(logrus.New()).WithFields(logrus.Fields{
+		"password": "a,b",
+		"env":      "KERBEROS_PASSWORD=a,b KERBEROS_USER=alice",
+		"error":    errors.New(`"token": "a,b" rejected`),
+		"user":     "alice",
+		"uid":      10002,
+	})
+	e.Message = "setting up with KERBEROS_PASSWORD=a,b"
+	if err := r.Fire(e); err != nil {
+		t.Fatal(err)
+	}
+	if want := "setting up with KERBEROS_PASSWORD=***"; e.Message != want {
+		t.Errorf("message = %q, want %q", e.Message, want)
+	}
+	for key, want := range map[string]any{
+		"password": redacted,
+		"env":      "KERBEROS_PASSWORD=*** KERBEROS_USER=***",
+		"error":    `"token": "***" rejected`,
+		"user":     "alice",
+		"uid":      10002,
+	} {
+		if got := e.Data[key]; got != want {
+			t.Errorf("field %s = %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Remediation actions for pods whose credentials are lost for good.
+const (
+	// Post a KerberosCredentialsLost Warning Event for the pod.
+	remediationEvent = "event"
+	// Annotate the pod with the failure class.
+	remediationAnnotate = "annotate"
+	// Set the credentialsCondition of the pod to False.
+	remediationCondition = "condition"
+	// Signal the processes of the containers of the credentials.
+	remediationSignal = "signal"
+	// Remount the NFS volumes of the credentials read-only.
+	remediationReadOnly = "readOnly"
+
+	// Annotation set on pods whose credentials were lost, to the failure class.
+	credentialsLostAnnotation = "kerberos-credentials-lost"
+	// Condition of pods, False while their credentials are lost.
+	credentialsCondition     = "kerberos.nri.io/CredentialsValid"
+	defaultRemediationSignal = "SIGTERM"
+	podPathFormat            = "/api/v1/namespaces/%s/pods/%s"
+)
+
+// Remediation of pods whose credentials can neither be renewed nor obtained
+// afresh, as when their principal was revoked or their keytab is gone.
+type remediationConfig struct {
+	// Actions taken once per loss: event, annotate, condition, signal and
+	// readOnly. The annotation and condition are removed and set to True again
+	// and the volumes remounted read-write when the credentials come back.
+	Actions []string `json:"actions,omitempty"`
+	// Signal sent by the signal action, SIGTERM by default.
+	Signal string `json:"signal,omitempty"`
+}
+
+func (c *remediationConfig) validate() error {
+	for _, action := range c.Actions {
+		switch action {
+		case remediationEvent, remediationAnnotate, remediationCondition, remediationSignal, remediationReadOnly:
+		default:
+			return fmt.Errorf("unknown action %q", action)
+		}
+	}
+	if c.Signal != "" && c.signal() == 0 {
+		return fmt.Errorf("unknown signal %q", c.Signal)
+	}
+	return nil
+}
+
+func (c *remediationConfig) enabled(action string) bool {
+	return slices.Contains(c.Actions, action)
+}
+
+// Whether any of the actions needs Kubernetes API access.
+func (c *remediationConfig) needsKube() bool {
+	return c.enabled(remediationAnnotate) || c.enabled(remediationCondition)
+}
+
+// Signal of the signal action, 0 if unknown.
+func (c *remediationConfig) signal() unix.Signal {
+	name := c.Signal
+	if name == "" {
+		name = defaultRemediationSignal
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	return unix.SignalNum(name)
+}
+
+// Whether a failure means the credentials are lost until somebody acts: the
+// principal is unknown or revoked, its password expired, or the keytab is gone
+// or does not match.
+func credentialsLost(err error) bool {
+	for _, class := range []error{errPrincipalUnknown, errPrincipalRevoked, errPreauthFailed, errPasswordExpired, errKeytabMismatch, errKeytabUnavailable} {
+		if errors.Is(err, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// Process of a running container.
+type containerProcess struct {
+	id   string
+	name string
+	pid  uint32
+}
+
+// Remediator of lost credentials, with the processes of the containers of the
+// pods to signal and the mounts it made read-only.
+type remediator struct {
+	sync.Mutex
+	// Processes of the running containers, by pod ID.
+	processes map[string][]containerProcess
+	// Managed keys remediated since their credentials were last good, with
+	// the mounts made read-only.
+	lost map[string][]*hostMount
+}
+
+func newRemediator() *remediator {
+	return &remediator{
+		processes: map[string][]containerProcess{},
+		lost:      map[string][]*hostMount{},
+	}
+}
+
+// Note the process of a started container.
+func (r *remediator) started(ctr *api.Container) {
+	if ctr.GetPid() == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	id := ctr.GetPodSandboxId()
+	r.processes[id] = slices.DeleteFunc(r.processes[id], func(cp containerProcess) bool { return cp.id == ctr.GetId() })
+	r.processes[id] = append(r.processes[id], containerProcess{id: ctr.GetId(), name: ctr.GetName(), pid: ctr.GetPid()})
+}
+
+// Forget the process of a removed container.
+func (r *remediator) removed(ctr *api.Container) {
+	r.Lock()
+	defer r.Unlock()
+	id := ctr.GetPodSandboxId()
+	r.processes[id] = slices.DeleteFunc(r.processes[id], func(cp containerProcess) bool { return cp.id == ctr.GetId() })
+	if len(r.processes[id]) == 0 {
+		delete(r.processes, id)
+	}
+}
+
+// Forget the containers of a removed pod.
+func (r *remediator) forgetPod(id string) {
+	r.Lock()
+	delete(r.processes, id)
+	r.Unlock()
+}
+
+// Forget the loss of released credentials.
+func (r *remediator) forget(key string) {
+	r.Lock()
+	delete(r.lost, key)
+	r.Unlock()
+}
+
+// Processes of the containers of a pod, of one container if named.
+func (r *remediator) containers(id, container string) []containerProcess {
+	r.Lock()
+	defer r.Unlock()
+	var procs []containerProcess
+	for _, cp := range r.processes[id] {
+		if container == "" || cp.name == container {
+			procs = append(procs, cp)
+		}
+	}
+	return procs
+}
+
+// Note the loss of credentials, false if already noted.
+func (r *remediator) markLost(key string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.lost[key]; ok {
+		return false
+	}
+	r.lost[key] = nil
+	return true
+}
+
+func (r *remediator) markReadOnly(key string, mounts []*hostMount) {
+	r.Lock()
+	if _, ok := r.lost[key]; ok {
+		r.lost[key] = mounts
+	}
+	r.Unlock()
+}
+
+// Note the credentials are good again, returning whether they were lost and
+// the mounts made read-only.
+func (r *remediator) recovered(key string) (bool, []*hostMount) {
+	r.Lock()
+	defer r.Unlock()
+	mounts, ok := r.lost[key]
+	delete(r.lost, key)
+	return ok, mounts
+}
+
+// Record the process of a started container, for signalling it when its
+// credentials are lost.
+func (p *plugin) PostStartContainer(_ context.Context, _ *api.PodSandbox, ctr *api.Container) error {
+	p.remediation.started(ctr)
+	return nil
+}
+
+func (p *plugin) RemoveContainer(_ context.Context, _ *api.PodSandbox, ctr *api.Container) error {
+	p.remediation.removed(ctr)
+	return nil
+}
+
+// Act on the loss of the managed credentials of a key as configured, once
+// until they are good again.
+func (p *plugin) remediate(ctx context.Context, key string, mc *managedCache, lost error) {
+	cfg := p.config().Remediation
+	if len(cfg.Actions) == 0 || !p.remediation.markLost(key) {
+		return
+	}
+	kp, pod := mc.params, mc.pod
+	l := subsystemLogger(mc.log, subsystemRenew)
+	reason := failureReason(lost)
+	l.Warnf("credentials for %s lost (%s), remediating with %s", kp.Principal(), reason, strings.Join(cfg.Actions, ", "))
+
+	if cfg.enabled(remediationEvent) {
+		p.events.warn(pod, reasonCredentialsLost, "credentials for %s lost (%s), renewal and setup failed: %v", kp.Principal(), reason, lost)
+	}
+	if cfg.enabled(remediationAnnotate) {
+		if err := p.annotateCredentialsLost(ctx, pod, reason); err != nil {
+			l.Errorf("failed to annotate pod: %v", err)
+		}
+	}
+	if cfg.enabled(remediationCondition) {
+		msg := fmt.Sprintf("credentials for %s lost: %v", kp.Principal(), lost)
+		if err := p.setCredentialsCondition(ctx, pod, "False", "CredentialsLost", msg); err != nil {
+			l.Errorf("failed to set pod condition: %v", err)
+		}
+	}
+	if cfg.enabled(remediationReadOnly) {
+		mounts, err := p.remountVolumes(ctx, pod, kp)
+		for _, m := range mounts {
+			l.Warnf("remounted %s read-only", m.mountPoint)
+		}
+		if err != nil {
+			l.Errorf("failed to remount volumes read-only: %v", err)
+		}
+		p.remediation.markReadOnly(key, mounts)
+	}
+	if cfg.enabled(remediationSignal) {
+		p.signalContainers(l, pod, kp, cfg.signal())
+	}
+	remediations.WithLabelValues(kp.Realm, reason).Inc()
+}
+
+// Undo the remediation of the credentials of a key, once good again.
+func (p *plugin) recoverCredentials(ctx context.Context, key string, mc *managedCache) {
+	lost, mounts := p.remediation.recovered(key)
+	if !lost {
+		return
+	}
+	cfg := p.config().Remediation
+	l := subsystemLogger(mc.log, subsystemRenew)
+	l.Infof("credentials for %s good again", mc.params.Principal())
+
+	if cfg.enabled(remediationAnnotate) {
+		if err := p.annotateCredentialsLost(ctx, mc.pod, ""); err != nil {
+			l.Errorf("failed to annotate pod: %v", err)
+		}
+	}
+	if cfg.enabled(remediationCondition) {
+		if err := p.setCredentialsCondition(ctx, mc.pod, "True", "CredentialsValid", ""); err != nil {
+			l.Errorf("failed to set pod condition: %v", err)
+		}
+	}
+	for _, m := range mounts {
+		if err := p.mounter.Mount(ctx, m.fsType, m.source, m.mountPoint, []string{"remount", "bind", "rw"}); err != nil {
+			l.Errorf("failed to remount %s read-write: %v", m.mountPoint, err)
+			continue
+		}
+		l.Infof("remounted %s read-write", m.mountPoint)
+	}
+}
+
+// Set the credentialsLostAnnotation of a pod, or remove it if empty.
+func (p *plugin) annotateCredentialsLost(ctx context.Context, pod *api.PodSandbox, reason string) error {
+	if p.kube == nil {
+		return errors.New("no Kubernetes API access")
+	}
+	var value any
+	if reason != "" {
+		value = reason
+	}
+	patch := map[string]any{"metadata": map[string]any{"annotations": map[string]any{
+		p.config().annotation(credentialsLostAnnotation): value,
+	}}}
+	path := fmt.Sprintf(podPathFormat, pod.GetNamespace(), pod.GetName())
+	return p.kube.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+}
+
+// Set the credentialsCondition of a pod.
+func (p *plugin) setCredentialsCondition(ctx context.Context, pod *api.PodSandbox, status, reason, message string) error {
+	if p.kube == nil {
+		return errors.New("no Kubernetes API access")
+	}
+	patch := map[string]any{"status": map[string]any{"conditions": []identityCondition{{
+		Type:               credentialsCondition,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: p.clock.Now().UTC().Truncate(time.Second),
+	}}}}
+	path := fmt.Sprintf(podPathFormat, pod.GetNamespace(), pod.GetName()) + "/status"
+	return p.kube.do(ctx, http.MethodPatch, path, "application/strategic-merge-patch+json", patch, nil)
+}
+
+// Remount the NFS volumes of the pod the credentials are for read-only, by the
+// mount point of the kubelet, leaving read-only ones alone. Containers started
+// afterwards, as after the signal action, bind mount them read-only, those
+// running keep their mounts. Returns the mounts remounted.
+func (p *plugin) remountVolumes(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) ([]*hostMount, error) {
+	mounts, err := podVolumeMounts(p.mounter, p.config().MountCheck.kubeletDir(), pod.GetUid())
+	if err != nil {
+		return nil, err
+	}
+	var remounted []*hostMount
+	var errs []error
+	for _, m := range mounts {
+		volume := filepath.Base(m.mountPoint)
+		if len(kp.Volumes) > 0 && !slices.Contains(kp.Volumes, volume) {
+			continue
+		}
+		if _, other := kp.VolumePrincipals[volume]; other {
+			continue
+		}
+		if _, ro := m.options["ro"]; ro {
+			continue
+		}
+		if err := p.mounter.Mount(ctx, m.fsType, m.source, m.mountPoint, []string{"remount", "bind", "ro"}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.mountPoint, err))
+			continue
+		}
+		remounted = append(remounted, m)
+	}
+	slices.SortFunc(remounted, func(a, b *hostMount) int { return strings.Compare(a.mountPoint, b.mountPoint) })
+	return remounted, errors.Join(errs...)
+}
+
+// Signal the processes of the containers the credentials are for, which the
+// plugin sees running in the PID namespace of the host. Processes which are
+// no longer of their container are left alone.
+func (p *plugin) signalContainers(l *logrus.Entry, pod *api.PodSandbox, kp *kerberosParams, sig unix.Signal) {
+	for _, cp := range p.remediation.containers(pod.GetId(), kp.Container) {
+		if !processOf(cp) {
+			l.Debugf("container %s no longer runs as process %d, not signalling it", cp.name, cp.pid)
+			continue
+		}
+		if err := unix.Kill(int(cp.pid), sig); err != nil {
+			l.Errorf("failed to signal container %s: %v", cp.name, err)
+			continue
+		}
+		l.Warnf("sent %s to container %s", unix.SignalName(sig), cp.name)
+	}
+}
+
+// Whether a process still is that of its container, by its cgroup.
+func processOf(cp containerProcess) bool {
+	cgroup, err := os.ReadFile(filepath.Join("/proc", strconv.FormatUint(uint64(cp.pid), 10), "cgroup"))
+	return err == nil && strings.Contains(string(cgroup), cp.id)
+}
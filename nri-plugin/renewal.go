@@ -0,0 +1,298 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRenewalFraction      = 0.75
+	defaultRenewalRetryInterval = time.Minute
+	// Renewal interval when the ticket lifetime cannot be read from the cache.
+	defaultRenewalInterval = time.Hour
+	// Shortest delay before a renewal, so expired tickets are not renewed in a loop.
+	minRenewalDelay = 10 * time.Second
+	// Latest fraction of the ticket lifetime renewals are spread up to.
+	maxRenewalFraction = 0.9
+	// Shortest interval pods may ask for with KERBEROS_RENEWAL_TIME.
+	minRenewalInterval = time.Minute
+)
+
+// Renewal intervals as the renewal sidecar takes them, in hours, minutes and
+// seconds.
+var renewalTimeRegexp = regexp.MustCompile(`^([0-9]+h)?([0-9]+m)?([0-9]+s)?$`)
+
+// Parse a renewal interval of KERBEROS_RENEWAL_TIME or the
+// kerberos-renewal-time annotation: a number of seconds, or a duration of
+// hours, minutes and seconds as 1h30m.
+func parseRenewalTime(v string) (time.Duration, error) {
+	var d time.Duration
+	if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+		d = time.Duration(n) * time.Second
+	} else if v != "" && renewalTimeRegexp.MatchString(v) {
+		d, _ = time.ParseDuration(v)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q must be a positive number of seconds or a duration as 1h30m", v)
+	}
+	return d, nil
+}
+
+// In-plugin renewal of managed credentials.
+type renewalConfig struct {
+	// Renew the credentials of managed pods in the plugin, so that pods need no
+	// renewal sidecar.
+	Enabled bool `json:"enabled,omitempty"`
+	// Fraction of the ticket lifetime after which it is renewed, 0.75 by default.
+	Fraction float64 `json:"fraction,omitempty"`
+	// Delay before retrying a failed renewal, 1m by default.
+	RetryInterval duration `json:"retryInterval,omitempty"`
+	// Fraction of the ticket lifetime taken or added at random to the time of
+	// each renewal and of the retry interval, 0 by default.
+	Jitter float64 `json:"jitter,omitempty"`
+	// Spread the renewals of the credentials of a node evenly from fraction to
+	// 0.9 of the ticket lifetime, by a hash of the pod and container.
+	Spread bool `json:"spread,omitempty"`
+	// Longest renewal interval pods may ask for with KERBEROS_RENEWAL_TIME,
+	// longer ones being shortened to it. No limit by default.
+	MaxInterval duration `json:"maxInterval,omitempty"`
+	// Longest renewal intervals of the pods of namespaces, instead of
+	// maxInterval. The first entry matching the namespace applies.
+	Namespaces []namespaceRenewalConfig `json:"namespaces,omitempty"`
+}
+
+// Longest renewal interval of the pods of some namespaces.
+type namespaceRenewalConfig struct {
+	// Namespace patterns, as of path.Match.
+	Namespaces  []string `json:"namespaces"`
+	MaxInterval duration `json:"maxInterval"`
+}
+
+func (c *renewalConfig) validate() error {
+	if c.Jitter < 0 || c.Jitter > 0.5 {
+		return fmt.Errorf("jitter %g must be between 0 and 0.5", c.Jitter)
+	}
+	if c.MaxInterval.Duration < 0 {
+		return fmt.Errorf("maxInterval %s must not be negative", c.MaxInterval.Duration)
+	}
+	for i, n := range c.Namespaces {
+		if len(n.Namespaces) == 0 {
+			return fmt.Errorf("namespaces %d: no namespaces", i)
+		}
+		for _, pattern := range n.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("namespaces %d: invalid pattern %q", i, pattern)
+			}
+		}
+		if n.MaxInterval.Duration < minRenewalInterval {
+			return fmt.Errorf("namespaces %d: maxInterval %s must be at least %s", i, n.MaxInterval.Duration, minRenewalInterval)
+		}
+	}
+	return nil
+}
+
+// Longest renewal interval pods of a namespace may ask for, 0 for no limit.
+func (c *renewalConfig) maxInterval(namespace string) time.Duration {
+	for _, n := range c.Namespaces {
+		if matchesAny(n.Namespaces, namespace) {
+			return n.MaxInterval.Duration
+		}
+	}
+	return c.MaxInterval.Duration
+}
+
+// Renewal interval a pod of a namespace asked for, clamped to
+// minRenewalInterval and the maximum of the namespace, and whether it was;
+// 0 if it asked for none.
+func (c *renewalConfig) requestedInterval(namespace, v string) (time.Duration, bool, error) {
+	if v == "" {
+		return 0, false, nil
+	}
+	d, err := parseRenewalTime(v)
+	if err != nil {
+		return 0, false, err
+	}
+	clamped := max(d, minRenewalInterval)
+	if limit := c.maxInterval(namespace); limit > 0 {
+		clamped = min(clamped, limit)
+	}
+	return clamped, clamped != d, nil
+}
+
+func (c *renewalConfig) fraction() float64 {
+	if c.Fraction > 0 && c.Fraction < 1 {
+		return c.Fraction
+	}
+	return defaultRenewalFraction
+}
+
+func (c *renewalConfig) retryInterval() time.Duration {
+	d := defaultRenewalRetryInterval
+	if c.RetryInterval.Duration > 0 {
+		d = c.RetryInterval.Duration
+	}
+	return time.Duration(float64(d) * (1 + c.jitter()))
+}
+
+// Fraction of the ticket lifetime at which the credentials of a key are
+// renewed, spread and jittered as configured.
+func (c *renewalConfig) renewalFraction(key string) float64 {
+	f := c.fraction()
+	if c.Spread && f < maxRenewalFraction {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		f += (maxRenewalFraction - f) * float64(h.Sum32()) / (1 << 32)
+	}
+	return min(max(f+c.jitter(), 0.05), 0.95)
+}
+
+// Random offset within the jitter.
+func (c *renewalConfig) jitter() float64 {
+	if c.Jitter <= 0 {
+		return 0
+	}
+	return c.Jitter * (2*rand.Float64() - 1)
+}
+
+// Schedule the next renewal of the credentials of a pod, at the configured
+// fraction of the lifetime of its ticket.
+func (p *plugin) scheduleRenewal(id string) {
+	cfg := p.config().Renewal
+	if !cfg.Enabled {
+		return
+	}
+
+	p.Lock()
+	mc, ok := p.managed[id]
+	p.Unlock()
+	if !ok {
+		return
+	}
+	l := subsystemLogger(mc.log, subsystemRenew)
+
+	delay := defaultRenewalInterval
+	if interval := mc.params.RenewalInterval; interval > 0 {
+		delay = interval
+	}
+	if t, err := ccacheTimes(mc.params.CCName, mc.params.Realm); err != nil {
+		l.Warnf("renewing in %s, ticket lifetime unknown: %v", delay, err)
+	} else if interval := mc.params.RenewalInterval; interval > 0 {
+		// The interval the pod asked for, but before the ticket expires,
+		// and telling when renewing will not do past the renewable lifetime
+		lifetime := t.end.Sub(t.start)
+		if latest := time.Duration(float64(lifetime) * maxRenewalFraction); interval > latest {
+			l.Warnf("renewal interval %s is longer than the ticket lifetime %s allows, renewing after %s",
+				interval, lifetime.Round(time.Second), latest.Round(time.Second))
+			interval = latest
+		}
+		if !t.renewTill.IsZero() && t.start.Add(interval).After(t.renewTill) {
+			l.Infof("renewal interval %s reaches past the renewable lifetime, credentials are obtained afresh then", interval)
+		}
+		delay = t.start.Add(interval).Sub(p.clock.Now())
+	} else {
+		lifetime := t.end.Sub(t.start)
+		delay = t.start.Add(time.Duration(float64(lifetime) * cfg.renewalFraction(id))).Sub(p.clock.Now())
+	}
+	delay = max(delay, minRenewalDelay)
+
+	l.Debugf("renewing credentials for %s in %s", mc.params.Principal(), delay.Round(time.Second))
+	p.renewals.Schedule(id, delay, func() { p.renewPod(id) })
+}
+
+// Renew the credentials of a pod and publish them to the pod again. Tickets
+// which cannot be renewed any further, or whose renewal fails as the
+// credentials are lost, are obtained afresh, with the keytab or certificate
+// fetched again in case it was rotated. Credentials lost for good are
+// remediated as configured. Returns why the renewal failed, if it did.
+func (p *plugin) renewPod(id string) error {
+	cfg := p.config()
+	if !cfg.Renewal.Enabled {
+		return nil
+	}
+
+	p.Lock()
+	mc, ok := p.managed[id]
+	p.Unlock()
+	if !ok {
+		return nil
+	}
+	kp := mc.params
+	l := subsystemLogger(mc.log, subsystemRenew)
+	if p.renewedByOther(l, mc) {
+		p.touch(id)
+		p.scheduleRenewal(id)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), l), cfg.setupTimeout())
+	defer cancel()
+
+	renew, op := p.backend.Renew, "renew"
+	if t, err := ccacheTimes(kp.CCName, kp.Realm); err == nil && !t.renewTill.After(p.clock.Now().Add(minRenewalDelay)) {
+		renew, op = p.backend.Setup, "setup"
+	}
+	var err error
+	if op == "setup" {
+		err = p.fetchCredentials(ctx, mc.pod, kp)
+	}
+	if err == nil {
+		err = renew(ctx, kp)
+	}
+	if op == "renew" && credentialsLost(err) {
+		l.Warnf("renewal of credentials for %s failed (%s), obtaining them afresh", kp.Principal(), failureReason(err))
+		op = "setup"
+		if err = p.fetchCredentials(ctx, mc.pod, kp); err == nil {
+			err = p.backend.Setup(ctx, kp)
+		}
+	}
+	if err == nil && mc.pod.GetUid() != "" && len(kp.Volumes) == 0 {
+		_, err = p.publishCCache(mc.pod, kp)
+	}
+	if !kp.secondary() {
+		p.tickets.report(mc.pod, kp, err)
+	}
+	if err != nil {
+		p.auditOp(op, mc.pod, kp.Container, kp, err)
+		retry := cfg.Renewal.retryInterval()
+		l.Errorf("renewal of credentials for %s failed, retrying in %s: %v", kp.Principal(), retry, err)
+		if !p.warnClockSkew(mc.pod, kp, err) {
+			p.events.warn(mc.pod, reasonRenewalFailed, "renewal of credentials for %s failed (%s), retrying in %s: %v",
+				kp.Principal(), failureReason(err), retry, err)
+		}
+		if credentialsLost(err) {
+			p.remediate(ctx, id, mc, err)
+		}
+		p.renewals.Schedule(id, retry, func() { p.renewPod(id) })
+		return err
+	}
+
+	l.Infof("renewed credentials for %s", kp.Principal())
+	p.touch(id)
+	p.recoverCredentials(ctx, id, mc)
+	p.auditOp(op, mc.pod, kp.Container, kp, nil)
+
+	p.scheduleRenewal(id)
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+	defaultRetryJitter    = 0.2
+)
+
+// Retries of failed credential setups, renewals and NFS remounts.
+type retryConfig struct {
+	// Attempts in all, 3 by default, 1 for no retries.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// Delay before the first retry, doubled for each further one, 1s by default.
+	BaseDelay duration `json:"baseDelay,omitempty"`
+	// Longest delay between attempts, 30s by default.
+	MaxDelay duration `json:"maxDelay,omitempty"`
+	// Fraction of each delay taken or added at random, so that the pods of a
+	// node do not retry in lockstep, 0.2 by default, 0 for none.
+	Jitter *float64 `json:"jitter,omitempty"`
+}
+
+func (c *retryConfig) validate() error {
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts %d must not be negative", c.MaxAttempts)
+	}
+	if c.Jitter != nil && (*c.Jitter < 0 || *c.Jitter > 1) {
+		return fmt.Errorf("jitter %g must be between 0 and 1", *c.Jitter)
+	}
+	return nil
+}
+
+func (c *retryConfig) maxAttempts() int {
+	if c.MaxAttempts > 0 {
+		return c.MaxAttempts
+	}
+	return defaultRetryAttempts
+}
+
+// Delay after the failed attempt, counting from 1.
+func (c *retryConfig) delay(attempt int) time.Duration {
+	base, maxDelay := c.BaseDelay.Duration, c.MaxDelay.Duration
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	jitter := defaultRetryJitter
+	if c.Jitter != nil {
+		jitter = *c.Jitter
+	}
+
+	d := base
+	for i := 1; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxDelay)
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// Whether a failure is not worth retrying: the KDC does not know the principal
+// or revoked it, the keytab or password does not match, delegation is refused, the clock of
+// the node is off or the NFS server lacks the NFS version. Others, like a KDC or NFS server which
+// cannot be reached, may go away.
+func permanent(err error) bool {
+	for _, class := range []error{errPrincipalUnknown, errPrincipalRevoked, errPreauthFailed, errPasswordExpired, errKeytabMismatch, errKeytabUnavailable,
+		errDelegationRefused, errClockSkew, errCCacheFailed, errNFSVersion, context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run an operation until it succeeds, fails permanently or has been attempted
+// maxAttempts times, waiting with exponential backoff between attempts. No
+// attempt is made which the context would not leave time to wait for.
+func (c *retryConfig) do(ctx context.Context, op, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.maxAttempts() {
+			return err
+		}
+		if permanent(err) {
+			loggerFrom(ctx).Debugf("%s failed permanently (%s), not retrying", what, failureReason(err))
+			return err
+		}
+		delay := c.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		loggerFrom(ctx).Warnf("%s failed, attempt %d/%d, retrying in %s: %v", what, attempt, c.maxAttempts(), delay.Round(time.Millisecond), err)
+		retries.WithLabelValues(op).Inc()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Backend wrapper retrying setups and renewals after transient failures, with
+// the retry policy of the running configuration for the class of the
+// parameters.
+type retryBackend struct {
+	KerberosBackend
+	policy func(kp *kerberosParams) *retryConfig
+}
+
+func (b *retryBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	return b.policy(kp).do(ctx, "setup", "setup of credentials for "+kp.Principal(), func() error {
+		return b.KerberosBackend.Setup(ctx, kp)
+	})
+}
+
+func (b *retryBackend) Renew(ctx context.Context, kp *kerberosParams) error {
+	return b.policy(kp).do(ctx, "renew", "renewal of credentials for "+kp.Principal(), func() error {
+		return b.KerberosBackend.Renew(ctx, kp)
+	})
+}
@@ -0,0 +1,217 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containers/common/pkg/hooks"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	runtimeContainerd = "containerd"
+	runtimeCRIO       = "cri-o"
+)
+
+// What the plugin needs to know of a container runtime implementing NRI.
+type containerRuntime struct {
+	// Name as the runtime reports it to NRI plugins.
+	name string
+	// CRI socket, by which the runtime is detected before connecting.
+	socket string
+	// Container annotation with the image reference.
+	imageAnnotation string
+	// Directories of the OCI hooks the runtime runs, watched for new hooks.
+	hookDirs []string
+	// Container annotations marking containers restored from a checkpoint.
+	checkpointAnnotations []string
+}
+
+var knownRuntimes = []*containerRuntime{
+	{
+		name:            runtimeContainerd,
+		socket:          "/run/containerd/containerd.sock",
+		imageAnnotation: "io.kubernetes.cri.image-name",
+		hookDirs:        []string{hooks.DefaultDir, hooks.OverrideDir},
+		// from the checkpoint image
+		checkpointAnnotations: []string{"org.criu.checkpoint.container.name"},
+	},
+	{
+		name:            runtimeCRIO,
+		socket:          "/var/run/crio/crio.sock",
+		imageAnnotation: "io.kubernetes.cri-o.ImageName",
+		hookDirs:        []string{hooks.DefaultDir, hooks.OverrideDir},
+		checkpointAnnotations: []string{
+			"io.kubernetes.cri-o.annotations.checkpoint.name",
+			"org.criu.checkpoint.container.name",
+		},
+	},
+}
+
+// Runtime of the given name, nil if unknown.
+func lookupRuntime(name string) *containerRuntime {
+	for _, rt := range knownRuntimes {
+		if rt.name == name {
+			return rt
+		}
+	}
+	return nil
+}
+
+// Runtime of the node: the one configured, or the first whose CRI socket
+// exists, containerd if none does.
+func detectRuntime(cfg *config) (*containerRuntime, error) {
+	if cfg.Runtime != "" {
+		if rt := lookupRuntime(cfg.Runtime); rt != nil {
+			return rt, nil
+		}
+		return nil, fmt.Errorf("unknown runtime %q, must be %s or %s", cfg.Runtime, runtimeContainerd, runtimeCRIO)
+	}
+	for _, rt := range knownRuntimes {
+		if _, err := os.Stat(rt.socket); err == nil {
+			return rt, nil
+		}
+	}
+	return knownRuntimes[0], nil
+}
+
+// Image reference of a container, from the annotation of the runtime or, for
+// containers of a runtime not detected right, of another one.
+func (rt *containerRuntime) imageName(container *api.Container) string {
+	for _, r := range append([]*containerRuntime{rt}, knownRuntimes...) {
+		if image := container.GetAnnotations()[r.imageAnnotation]; image != "" {
+			return image
+		}
+	}
+	return ""
+}
+
+// Options the runtime can set in the NRI configuration of the plugin, the
+// config of its /etc/nri/conf.d file or of the plugin in the containerd
+// configuration, in the syntax of the configuration file. The file takes
+// precedence over them, and they over the defaults.
+type runtimeOptions struct {
+	AnnotationPrefix       string   `json:"annotationPrefix,omitempty"`
+	CCacheDir              string   `json:"ccacheDir,omitempty"`
+	CCacheDirLayout        string   `json:"ccacheDirLayout,omitempty"`
+	CCacheMountPropagation string   `json:"ccacheMountPropagation,omitempty"`
+	Strict                 bool     `json:"strict,omitempty"`
+	SoftFailNamespaces     []string `json:"softFailNamespaces,omitempty"`
+}
+
+func parseRuntimeOptions(data string) (*runtimeOptions, error) {
+	opts := &runtimeOptions{}
+	if err := yaml.UnmarshalStrict([]byte(data), opts); err != nil {
+		return nil, err
+	}
+	if opts.CCacheDir != "" && !filepath.IsAbs(opts.CCacheDir) {
+		return nil, fmt.Errorf("ccacheDir: %q is not an absolute path", opts.CCacheDir)
+	}
+	if err := validCCacheDirLayout(opts.CCacheDirLayout); err != nil {
+		return nil, fmt.Errorf("ccacheDirLayout: %w", err)
+	}
+	if err := validMountPropagation(opts.CCacheMountPropagation); err != nil {
+		return nil, fmt.Errorf("ccacheMountPropagation: %w", err)
+	}
+	return opts, nil
+}
+
+// Configuration holding just the options, for the configuration file to be
+// loaded over.
+func (o *runtimeOptions) config() *config {
+	if o == nil {
+		return &config{}
+	}
+	return &config{
+		AnnotationPrefix:       o.AnnotationPrefix,
+		CCacheDir:              o.CCacheDir,
+		CCacheDirLayout:        o.CCacheDirLayout,
+		CCacheMountPropagation: o.CCacheMountPropagation,
+		Strict:                 o.Strict,
+		SoftFailNamespaces:     slices.Clone(o.SoftFailNamespaces),
+	}
+}
+
+// Apply the options of the NRI configuration, reloading the configuration
+// file over them if they changed. Invalid options are ignored. Only on the
+// first connection, before any pod is handled, do they change settings which
+// otherwise need a restart, such as ccacheDir, which is then shared for
+// ccacheMountPropagation.
+func (p *plugin) configureRuntimeOptions(nriConfig string) {
+	first := !p.runtimeConnected.Swap(true)
+	if first {
+		defer func() {
+			if err := p.shareCCacheDir(p.mounter); err != nil {
+				log.Errorf("mounts in pod credential cache directories will not propagate into containers: %v", err)
+			}
+		}()
+	}
+	opts, err := parseRuntimeOptions(nriConfig)
+	if err != nil {
+		log.Errorf("ignoring invalid NRI configuration of the plugin: %v", err)
+		opts = &runtimeOptions{}
+	}
+	if old := p.runtimeOptions.Load(); reflect.DeepEqual(old.config(), opts.config()) {
+		return
+	}
+	cfg, err := loadConfigOver(opts, p.configFile, p.configFile == defaultConfigFile)
+	if err != nil {
+		log.Errorf("failed to apply the NRI configuration of the plugin, keeping the running one: %v", err)
+		return
+	}
+	if !first {
+		if changed := cfg.keepStartupSettings(p.config()); len(changed) > 0 {
+			log.Warnf("changes to %s take effect after restart", strings.Join(changed, ", "))
+		}
+	}
+	p.runtimeOptions.Store(opts)
+	p.cfg.Store(cfg)
+	log.Infof("applied the NRI configuration of the plugin")
+}
+
+// Runtime of the node, as detected at startup or reported on connecting.
+func (p *plugin) runtime() *containerRuntime {
+	return p.containerRuntime.Load()
+}
+
+// Configure is called when connecting to the runtime, with its name and
+// version, replacing the runtime detected at startup, and the NRI
+// configuration of the plugin, applied as runtime options.
+func (p *plugin) Configure(_ context.Context, nriConfig, runtime, version string) (api.EventMask, error) {
+	log.Infof("connected to %s %s", runtime, version)
+	p.configureRuntimeOptions(nriConfig)
+	runtimeInfo.Reset()
+	runtimeInfo.WithLabelValues(runtime, version).Set(1)
+	rt := lookupRuntime(runtime)
+	if rt == nil {
+		log.Warnf("runtime %s is not known, assuming the conventions of %s", runtime, p.runtime().name)
+		return 0, nil
+	}
+	if rt != p.runtime() {
+		log.Warnf("runtime %s detected at startup, but connected to %s", p.runtime().name, rt.name)
+		p.containerRuntime.Store(rt)
+	}
+	return 0, nil
+}
@@ -0,0 +1,296 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Known runtimes with their CRI sockets in a temporary directory, those of
+// the names given created, for the rest of the test.
+func fakeRuntimeSockets(t *testing.T, names ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	saved := knownRuntimes
+	t.Cleanup(func() { knownRuntimes = saved })
+	knownRuntimes = nil
+	for _, rt := range saved {
+		fake := *rt
+		fake.socket = filepath.Join(dir, rt.name+".sock")
+		if slices.Contains(names, rt.name) {
+			if err := os.WriteFile(fake.socket, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		knownRuntimes = append(knownRuntimes, &fake)
+	}
+}
+
+func TestDetectRuntime(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configured string
+		// Runtimes whose CRI socket exists.
+		sockets []string
+		want    string
+		wantErr bool
+	}{{
+		name: "no socket",
+		want: runtimeContainerd,
+	}, {
+		name:    "containerd socket",
+		sockets: []string{runtimeContainerd},
+		want:    runtimeContainerd,
+	}, {
+		name:    "CRI-O socket",
+		sockets: []string{runtimeCRIO},
+		want:    runtimeCRIO,
+	}, {
+		name:    "both sockets",
+		sockets: []string{runtimeCRIO, runtimeContainerd},
+		want:    runtimeContainerd,
+	}, {
+		name:       "CRI-O configured",
+		configured: runtimeCRIO,
+		sockets:    []string{runtimeContainerd},
+		want:       runtimeCRIO,
+	}, {
+		name:       "containerd configured",
+		configured: runtimeContainerd,
+		sockets:    []string{runtimeCRIO},
+		want:       runtimeContainerd,
+	}, {
+		name:       "unknown configured",
+		configured: "podman",
+		sockets:    []string{runtimeCRIO},
+		wantErr:    true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeRuntimeSockets(t, tc.sockets...)
+			rt, err := detectRuntime(&config{Runtime: tc.configured})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("detectRuntime() error = %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && rt.name != tc.want {
+				t.Errorf("detectRuntime() = %s, want %s", rt.name, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeImageName(t *testing.T) {
+	const (
+		image      = "registry.example.com/renewer@sha256:1234"
+		otherImage = "registry.example.com/renewer:v1"
+	)
+	for _, tc := range []struct {
+		name        string
+		runtime     string
+		annotations map[string]string
+		want        string
+	}{{
+		name:        "containerd",
+		runtime:     runtimeContainerd,
+		annotations: map[string]string{"io.kubernetes.cri.image-name": image},
+		want:        image,
+	}, {
+		name:        "CRI-O",
+		runtime:     runtimeCRIO,
+		annotations: map[string]string{"io.kubernetes.cri-o.ImageName": image},
+		want:        image,
+	}, {
+		name:        "CRI-O container taken for containerd",
+		runtime:     runtimeContainerd,
+		annotations: map[string]string{"io.kubernetes.cri-o.ImageName": image},
+		want:        image,
+	}, {
+		name:        "containerd container taken for CRI-O",
+		runtime:     runtimeCRIO,
+		annotations: map[string]string{"io.kubernetes.cri.image-name": image},
+		want:        image,
+	}, {
+		name:    "annotation of the runtime first",
+		runtime: runtimeCRIO,
+		annotations: map[string]string{
+			"io.kubernetes.cri.image-name":  otherImage,
+			"io.kubernetes.cri-o.ImageName": image,
+		},
+		want: image,
+	}, {
+		name:        "no image annotation",
+		runtime:     runtimeCRIO,
+		annotations: map[string]string{"io.kubernetes.cri-o.ContainerType": "container"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := &api.Container{Annotations: tc.annotations}
+			if got := lookupRuntime(tc.runtime).imageName(ctr); got != tc.want {
+				t.Errorf("imageName() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckpointRestored(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		runtime     string
+		cfg         checkpointConfig
+		annotations map[string]string
+		want        string
+	}{{
+		name:        "disabled",
+		runtime:     runtimeContainerd,
+		annotations: map[string]string{"org.criu.checkpoint.container.name": "app"},
+	}, {
+		name:        "containerd",
+		runtime:     runtimeContainerd,
+		cfg:         checkpointConfig{Enabled: true},
+		annotations: map[string]string{"org.criu.checkpoint.container.name": "app"},
+		want:        "org.criu.checkpoint.container.name",
+	}, {
+		name:        "CRI-O",
+		runtime:     runtimeCRIO,
+		cfg:         checkpointConfig{Enabled: true},
+		annotations: map[string]string{"io.kubernetes.cri-o.annotations.checkpoint.name": "app"},
+		want:        "io.kubernetes.cri-o.annotations.checkpoint.name",
+	}, {
+		name:        "CRI-O of a checkpoint image",
+		runtime:     runtimeCRIO,
+		cfg:         checkpointConfig{Enabled: true},
+		annotations: map[string]string{"org.criu.checkpoint.container.name": "app"},
+		want:        "org.criu.checkpoint.container.name",
+	}, {
+		name:        "CRI-O annotation on containerd",
+		runtime:     runtimeContainerd,
+		cfg:         checkpointConfig{Enabled: true},
+		annotations: map[string]string{"io.kubernetes.cri-o.annotations.checkpoint.name": "app"},
+	}, {
+		name:        "configured annotation",
+		runtime:     runtimeContainerd,
+		cfg:         checkpointConfig{Enabled: true, Annotations: []string{"example.com/restored"}},
+		annotations: map[string]string{"example.com/restored": ""},
+		want:        "example.com/restored",
+	}, {
+		name:        "not restored",
+		runtime:     runtimeCRIO,
+		cfg:         checkpointConfig{Enabled: true},
+		annotations: map[string]string{"io.kubernetes.cri-o.ImageName": "app:v1"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := &api.Container{Annotations: tc.annotations}
+			got, ok := tc.cfg.restored(lookupRuntime(tc.runtime), ctr)
+			if got != tc.want || ok != (tc.want != "") {
+				t.Errorf("restored() = %q, %v, want %q", got, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigureRuntime(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		connected string
+		want      string
+	}{{
+		name:      "same runtime",
+		connected: runtimeContainerd,
+		want:      runtimeContainerd,
+	}, {
+		name:      "other runtime",
+		connected: runtimeCRIO,
+		want:      runtimeCRIO,
+	}, {
+		name:      "unknown runtime",
+		connected: "podman",
+		want:      runtimeContainerd,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, _ := newTestPlugin(t, testConfigYAML, newFakeBackend())
+			if _, err := p.Configure(context.Background(), "", tc.connected, "1.0"); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.runtime().name; got != tc.want {
+				t.Errorf("runtime = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRestoredContainer(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		runtime     string
+		config      string
+		annotations map[string]string
+		wantOps     []string
+	}{{
+		name:        "created",
+		runtime:     runtimeCRIO,
+		config:      "checkpoint:\n  enabled: true\n",
+		annotations: map[string]string{"io.kubernetes.cri-o.ImageName": "app:v1"},
+		wantOps:     []string{"setup alice@EXAMPLE.COM"},
+	}, {
+		name:        "restored by CRI-O",
+		runtime:     runtimeCRIO,
+		config:      "checkpoint:\n  enabled: true\n",
+		annotations: map[string]string{"io.kubernetes.cri-o.annotations.checkpoint.name": "app"},
+		wantOps:     []string{"setup alice@EXAMPLE.COM", "renew alice@EXAMPLE.COM"},
+	}, {
+		name:        "restored by containerd",
+		runtime:     runtimeContainerd,
+		config:      "checkpoint:\n  enabled: true\n",
+		annotations: map[string]string{"org.criu.checkpoint.container.name": "app"},
+		wantOps:     []string{"setup alice@EXAMPLE.COM", "renew alice@EXAMPLE.COM"},
+	}, {
+		name:        "restored, discarding the credentials",
+		runtime:     runtimeCRIO,
+		config:      "checkpoint:\n  enabled: true\n  action: discard\n",
+		annotations: map[string]string{"io.kubernetes.cri-o.annotations.checkpoint.name": "app"},
+		wantOps:     []string{"setup alice@EXAMPLE.COM", "destroy alice@EXAMPLE.COM", "setup alice@EXAMPLE.COM"},
+	}, {
+		name:        "restored with checkpoints not handled",
+		runtime:     runtimeCRIO,
+		annotations: map[string]string{"io.kubernetes.cri-o.annotations.checkpoint.name": "app"},
+		wantOps:     []string{"setup alice@EXAMPLE.COM"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := &fakeBackend{lifetime: time.Hour, renewable: 24 * time.Hour}
+			p, rt := newTestPlugin(t, testConfigYAML+tc.config, b)
+			p.containerRuntime.Store(lookupRuntime(tc.runtime))
+			pod := rt.Pod("default", "app", testAnnotations("alice", 61201))
+			if err := rt.RunPod(ctx, pod); err != nil {
+				t.Fatal(err)
+			}
+			ctr := rt.Container(pod, "app")
+			ctr.Annotations = tc.annotations
+			if _, err := rt.CreateContainer(ctx, pod, ctr); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.operations(); !slices.Equal(got, tc.wantOps) {
+				t.Errorf("backend operations = %q, want %q", got, tc.wantOps)
+			}
+		})
+	}
+}
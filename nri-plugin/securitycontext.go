@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// POSIX ids the containers of a pod run as, 0 where not set.
+type securityContextIDs struct {
+	uid, gid, fsid uint64
+}
+
+// Ids the containers of a pod run as, by their securityContext, with those of
+// the container overriding those of the pod. NRI does not pass them, so they
+// come from the pod in the Kubernetes API. Containers and native sidecars
+// running as different users or groups are an error, as the pod shares one
+// credential cache.
+func podSecurityContextIDs(ctx context.Context, kube *kubeClient, pod *api.PodSandbox) (securityContextIDs, error) {
+	var ids securityContextIDs
+	obj := &admissionPod{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", pod.GetNamespace(), pod.GetName())
+	if err := kube.do(ctx, http.MethodGet, path, "", nil, obj); err != nil {
+		return ids, fmt.Errorf("failed to get securityContext: %w", err)
+	}
+
+	podSC := obj.Spec.SecurityContext
+	if podSC == nil {
+		podSC = &podSecurityContext{}
+	}
+	if podSC.FSGroup != nil {
+		ids.fsid = uint64(*podSC.FSGroup)
+	}
+	var uidFrom, gidFrom string
+	for _, c := range obj.longRunningContainers() {
+		uid, gid := podSC.RunAsUser, podSC.RunAsGroup
+		if sc := c.SecurityContext; sc != nil {
+			if sc.RunAsUser != nil {
+				uid = sc.RunAsUser
+			}
+			if sc.RunAsGroup != nil {
+				gid = sc.RunAsGroup
+			}
+		}
+		if uid != nil {
+			if uidFrom != "" && uint64(*uid) != ids.uid {
+				return ids, fmt.Errorf("containers %s and %s run as different users", uidFrom, c.Name)
+			}
+			ids.uid, uidFrom = uint64(*uid), c.Name
+		}
+		if gid != nil {
+			if gidFrom != "" && uint64(*gid) != ids.gid {
+				return ids, fmt.Errorf("containers %s and %s run as different groups", gidFrom, c.Name)
+			}
+			ids.gid, gidFrom = uint64(*gid), c.Name
+		}
+	}
+	return ids, nil
+}
+
+// Service account of the pod, which NRI does not pass either.
+func podServiceAccount(ctx context.Context, kube *kubeClient, pod *api.PodSandbox) (string, error) {
+	obj := struct {
+		Spec struct {
+			ServiceAccountName string `json:"serviceAccountName"`
+		} `json:"spec"`
+	}{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", pod.GetNamespace(), pod.GetName())
+	if err := kube.do(ctx, http.MethodGet, path, "", nil, &obj); err != nil {
+		return "", fmt.Errorf("failed to get service account: %w", err)
+	}
+	return obj.Spec.ServiceAccountName, nil
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Start the metrics, health and debug endpoints configured, sharing a server
+// when they are on the same address.
+func (p *plugin) startServers(ctx context.Context, cfg *config) {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if cfg.MetricsAddress != "" {
+		mux(cfg.MetricsAddress).Handle("/metrics", promhttp.Handler())
+	}
+	if cfg.HealthAddress != "" {
+		m := mux(cfg.HealthAddress)
+		m.HandleFunc("/healthz", p.health.healthz)
+		m.HandleFunc("/readyz", p.health.readyz)
+		go p.health.probeKDCs(ctx, p.knownKDCs, p.kdcs.observe)
+	}
+	if cfg.DebugAddress != "" {
+		p.handleDebug(mux(cfg.DebugAddress))
+	}
+
+	for addr, m := range muxes {
+		go serveHTTP(ctx, addr, m)
+	}
+	if cfg.Admin.Enabled {
+		go p.serveAdmin(ctx, cfg.Admin)
+	}
+}
+
+// Serve HTTP until the context is cancelled, at a TCP address or at a UNIX
+// socket given as "unix:/path".
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		log.Errorf("HTTP server at %s failed: %v", addr, err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	log.Infof("serving HTTP at %s", addr)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("HTTP server at %s failed: %v", addr, err)
+	}
+}
+
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixAddressPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// Replace the socket left behind by an earlier instance.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
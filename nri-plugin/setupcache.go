@@ -0,0 +1,177 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Failed setups are not retried for this long by default.
+const defaultSetupFailureTTL = time.Minute
+
+// Outcomes of recent setups kept, so that a container crash looping in its
+// sandbox does not run kinit, or probe the NFS servers of its volumes, each
+// time it is created again.
+type setupResultsConfig struct {
+	// Run setups and checks again on every container creation instead.
+	Disabled bool `json:"disabled,omitempty"`
+	// How long a failed setup fails containers created again without being
+	// retried, 1m by default.
+	FailureTTL duration `json:"failureTTL,omitempty"`
+}
+
+func (c *setupResultsConfig) failureTTL() time.Duration {
+	if c.FailureTTL.Duration > 0 {
+		return c.FailureTTL.Duration
+	}
+	return defaultSetupFailureTTL
+}
+
+// What a result is kept for.
+type setupResultKind string
+
+const (
+	resultSetup   setupResultKind = "setup"
+	resultExports setupResultKind = "exports"
+)
+
+// Key of a result: the kind, the pod UID and the container with credentials
+// of its own or created, empty for those of the pod.
+type setupResultKey struct {
+	kind      setupResultKind
+	uid       string
+	container string
+}
+
+// Outcome of a setup or check under a configuration, for parameters of the
+// digest.
+type setupResult struct {
+	cfg    *config
+	digest [sha256.Size]byte
+	err    error
+	at     time.Time
+}
+
+// Recent outcomes of setups and NFS export checks, by pod UID and container.
+// A result only stands for the configuration and parameters it was had with:
+// a reloaded configuration or changed annotations run the setup again.
+type setupResults struct {
+	sync.Mutex
+	results map[setupResultKey]*setupResult
+}
+
+func newSetupResults() *setupResults {
+	return &setupResults{results: map[setupResultKey]*setupResult{}}
+}
+
+// Digest of what a result stands for, of the parameters of the credentials
+// and whatever else goes with them.
+func resultDigest(kp *kerberosParams, extra ...any) [sha256.Size]byte {
+	data, _ := json.Marshal(append([]any{kp}, extra...))
+	return sha256.Sum256(data)
+}
+
+// Result kept for the configuration and digest, or nil. Safe to call on nil.
+func (r *setupResults) lookup(key setupResultKey, cfg *config, digest [sha256.Size]byte) *setupResult {
+	if r == nil || cfg.SetupResults.Disabled {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	res := r.results[key]
+	if res == nil || res.cfg != cfg || res.digest != digest {
+		return nil
+	}
+	return res
+}
+
+// Keep the outcome under the configuration and digest. Safe to call on nil.
+func (r *setupResults) record(key setupResultKey, cfg *config, digest [sha256.Size]byte, err error, now time.Time) {
+	if r == nil || cfg.SetupResults.Disabled {
+		return
+	}
+	r.Lock()
+	r.results[key] = &setupResult{cfg: cfg, digest: digest, err: err, at: now}
+	r.Unlock()
+}
+
+// Forget the results of a pod, once removed. Safe to call on nil.
+func (r *setupResults) forget(pod *api.PodSandbox) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	for key := range r.results {
+		if key.uid == pod.GetUid() {
+			delete(r.results, key)
+		}
+	}
+	r.Unlock()
+}
+
+// Failure of a setup of the credentials of a pod or of a container with
+// credentials of its own failed recently under the same configuration and
+// parameters, if any, so that it is not retried within failureTTL. Setups of
+// pods without UID are not kept.
+func (p *plugin) recentSetupFailure(cfg *config, pod *api.PodSandbox, kp *kerberosParams, digest [sha256.Size]byte) error {
+	if pod.GetUid() == "" {
+		return nil
+	}
+	res := p.results.lookup(setupResultKey{resultSetup, pod.GetUid(), kp.Container}, cfg, digest)
+	if res == nil || res.err == nil {
+		return nil
+	}
+	ago := p.clock.Now().Sub(res.at)
+	if ago >= cfg.SetupResults.failureTTL() {
+		return nil
+	}
+	setupResultHits.WithLabelValues(string(resultSetup)).Inc()
+	return fmt.Errorf("setup failed %s ago, retried in %s: %w", ago.Round(time.Second),
+		(cfg.SetupResults.failureTTL() - ago).Round(time.Second), res.err)
+}
+
+// Keep the outcome of a setup, see recentSetupFailure.
+func (p *plugin) recordSetup(cfg *config, pod *api.PodSandbox, kp *kerberosParams, digest [sha256.Size]byte, err error) {
+	if pod.GetUid() == "" {
+		return
+	}
+	p.results.record(setupResultKey{resultSetup, pod.GetUid(), kp.Container}, cfg, digest, err, p.clock.Now())
+}
+
+// Check the NFS servers of the volumes of a container export them, unless
+// they were found to for the same configuration, parameters and mounts
+// before, as when the container is created again.
+func (p *plugin) checkContainerExports(ctx context.Context, cfg *config, pod *api.PodSandbox, container *api.Container, kp *kerberosParams) error {
+	key := setupResultKey{resultExports, pod.GetUid(), container.GetName()}
+	digest := resultDigest(kp, container.GetMounts())
+	if res := p.results.lookup(key, cfg, digest); res != nil && res.err == nil && pod.GetUid() != "" {
+		setupResultHits.WithLabelValues(string(resultExports)).Inc()
+		return nil
+	}
+	err := p.checkNFSExports(ctx, container)
+	if err == nil && pod.GetUid() != "" {
+		p.results.record(key, cfg, digest, nil, p.clock.Now())
+	}
+	return err
+}
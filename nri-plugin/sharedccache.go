@@ -0,0 +1,75 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Pod emptyDir volume to share the credential cache collection of the pod in.
+const sharedCCacheAnnotation = "kerberos-shared-ccache"
+
+// Volume names, as Kubernetes has them: DNS labels.
+var volumeNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+func validVolumeName(name string) error {
+	if len(name) > 63 || !volumeNameRegexp.MatchString(name) {
+		return fmt.Errorf("%q is not a volume name", name)
+	}
+	return nil
+}
+
+// Host directory of an emptyDir volume of the pod, as the kubelet sets it up
+// before the pod sandbox is run.
+func (p *plugin) emptyDirPath(pod *api.PodSandbox, volume string) string {
+	return filepath.Join(p.config().MountCheck.kubeletDir(), "pods", pod.GetUid(), "volumes", "kubernetes.io~empty-dir", volume)
+}
+
+// Container path of the shared credential cache volume, if the container
+// mounts it, and of the pod credential cache directory otherwise.
+func (p *plugin) containerCCacheMountPath(container *api.Container, dir string, kp *kerberosParams) (string, bool) {
+	if kp.SharedVolume != "" {
+		for _, m := range container.GetMounts() {
+			if filepath.Clean(m.GetSource()) == filepath.Clean(dir) {
+				return m.GetDestination(), true
+			}
+		}
+	}
+	return p.ccacheMountPath(), false
+}
+
+// Remove what was published to the shared credential cache volume of a pod,
+// leaving the volume itself to the kubelet.
+func (p *plugin) clearSharedCCache(pod *api.PodSandbox) error {
+	volume, ok := pod.GetAnnotations()[p.config().annotation(sharedCCacheAnnotation)]
+	if !ok || pod.GetUid() == "" || validVolumeName(volume) != nil {
+		return nil
+	}
+	dir := p.emptyDirPath(pod, volume)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("failed to clear shared credential cache: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+const defaultShutdownTimeout = 20 * time.Second
+
+// Shutdown of the plugin on SIGTERM, as when the DaemonSet is upgraded.
+type shutdownConfig struct {
+	// Renew the credentials whose tickets expire within this period before
+	// exiting, so that they last until the next instance takes them over.
+	// Disabled if zero, needs renewal.
+	RenewWithin duration `json:"renewWithin,omitempty"`
+	// Time to spend renewing at shutdown, 20s by default. Keep it below the
+	// termination grace period of the pod of the plugin.
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+func (c *shutdownConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultShutdownTimeout
+}
+
+// Shut down once disconnected from the runtime: renew the credentials about to
+// expire for the next instance, stop renewals and cleanups, and save when
+// they were due and when the credentials were last used to the state file, for
+// the next instance to carry on with at Synchronize.
+func (p *plugin) shutdown() {
+	cfg := p.config()
+	if cfg.Shutdown.RenewWithin.Duration > 0 && cfg.Renewal.Enabled {
+		p.handOffRenewals(cfg.Shutdown.RenewWithin.Duration, cfg.Shutdown.timeout())
+	}
+
+	renewals := p.renewals.Due()
+	cleanups := p.cleaner.Due()
+	p.renewals.Stop()
+	p.cleaner.Stop()
+
+	used := map[string]time.Time{}
+	p.Lock()
+	for key, mc := range p.managed {
+		used[key] = mc.used
+	}
+	p.Unlock()
+	if p.bindings.saveSchedule(used, renewals, cleanups) {
+		log.Infof("saved the renewals of %d managed credentials and %d pending cleanups", len(used), len(cleanups))
+	}
+}
+
+// Renew the credentials whose tickets expire within a period, one at a time
+// until the timeout.
+func (p *plugin) handOffRenewals(within, timeout time.Duration) {
+	deadline := p.clock.Now().Add(timeout)
+	p.Lock()
+	keys := make(map[string]*kerberosParams, len(p.managed))
+	for key, mc := range p.managed {
+		keys[key] = mc.params
+	}
+	p.Unlock()
+
+	renewed := 0
+	for key, kp := range keys {
+		if t, err := ccacheTimes(kp.CCName, kp.Realm); err == nil && t.end.After(p.clock.Now().Add(within)) {
+			continue
+		}
+		if !p.clock.Now().Before(deadline) {
+			log.Warnf("shutdown timeout reached, not renewing the credentials for %s", kp.Principal())
+			continue
+		}
+		p.renewPod(key)
+		renewed++
+	}
+	if renewed > 0 {
+		log.Infof("renewed %d credentials expiring within %s for the next instance", renewed, within)
+	}
+}
+
+// Bring a renewal forward to the time it was due at when the previous
+// instance shut down, as for a retry of a failed renewal.
+func (p *plugin) resumeRenewal(key string, due time.Time) {
+	scheduled, ok := p.renewals.Due()[key]
+	if !ok || !due.Before(scheduled) {
+		return
+	}
+	p.renewals.Schedule(key, max(due.Sub(p.clock.Now()), minRenewalDelay), func() { p.renewPod(key) })
+}
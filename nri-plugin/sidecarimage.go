@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+var imageDigestRegexp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// Check the digests of approved renewal sidecar images.
+func validSidecarImages(digests []string) error {
+	for _, d := range digests {
+		if !imageDigestRegexp.MatchString(d) {
+			return fmt.Errorf("invalid image digest %q, must be sha256:<hex>", d)
+		}
+	}
+	return nil
+}
+
+// Check that the image of a renewal sidecar is one of the approved ones, if
+// any are configured, by the digest it is pinned to. The image reference comes
+// from the annotations of the runtime, or from the pod in the Kubernetes API.
+func (p *plugin) verifySidecarImage(ctx context.Context, cfg *config, pod *api.PodSandbox, container *api.Container) error {
+	if len(cfg.SidecarImages) == 0 {
+		return nil
+	}
+	image := p.runtime().imageName(container)
+	if image == "" {
+		if p.kube == nil {
+			return errors.New("the image is not known without Kubernetes API access")
+		}
+		var err error
+		if image, err = podContainerImage(ctx, p.kube, pod, container.GetName()); err != nil {
+			return err
+		}
+	}
+	_, digest, ok := strings.Cut(image, "@")
+	if !ok {
+		return fmt.Errorf("image %s is not pinned by digest", image)
+	}
+	if !slices.Contains(cfg.SidecarImages, digest) {
+		return fmt.Errorf("image %s is not an approved renewal sidecar image", image)
+	}
+	return nil
+}
+
+// Image of a container of the pod as in its spec.
+func podContainerImage(ctx context.Context, kube *kubeClient, pod *api.PodSandbox, container string) (string, error) {
+	obj := struct {
+		Spec struct {
+			Containers []struct {
+				Name  string `json:"name"`
+				Image string `json:"image"`
+			} `json:"containers"`
+		} `json:"spec"`
+	}{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", pod.GetNamespace(), pod.GetName())
+	if err := kube.do(ctx, http.MethodGet, path, "", nil, &obj); err != nil {
+		return "", fmt.Errorf("failed to get image: %w", err)
+	}
+	for _, c := range obj.Spec.Containers {
+		if c.Name == container {
+			return c.Image, nil
+		}
+	}
+	return "", fmt.Errorf("pod has no container %s", container)
+}
@@ -0,0 +1,259 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// Admin socket of the SPIRE agent serving the Delegated Identity API.
+	defaultSPIFFESocket = "/run/spire/agent-admin/admin.sock"
+	spiffeTimeout       = 5 * time.Second
+
+	spiffeSubscribeMethod = "/spire.api.agent.delegatedidentity.v1.DelegatedIdentity/SubscribeToX509SVIDs"
+)
+
+// Derivation of the principal of pods from their SPIFFE ID, which the SPIRE
+// agent attests, instead of trusting the user name the pod asks for.
+type spiffeConfig struct {
+	// Admin socket of the SPIRE agent, /run/spire/agent-admin/admin.sock by default.
+	// The plugin must be an authorized delegate of the agent.
+	Socket string `json:"socket,omitempty"`
+	// Namespaces whose pods get their principal from the SPIFFE ID, all if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Rules mapping SPIFFE IDs to user names, the first matching one applies.
+	Principals []spiffePrincipalRule `json:"principals,omitempty"`
+}
+
+// Mapping of the SPIFFE IDs matching a regular expression to a user name,
+// which may refer to the submatches as $1 or ${name}.
+type spiffePrincipalRule struct {
+	ID   string `json:"id"`
+	User string `json:"user"`
+}
+
+func (c *spiffeConfig) socket() string {
+	if c.Socket != "" {
+		return c.Socket
+	}
+	return defaultSPIFFESocket
+}
+
+// Check whether pods of the namespace get their principal from the SPIFFE ID.
+func (c *spiffeConfig) handles(namespace string) bool {
+	return len(c.Principals) > 0 && (len(c.Namespaces) == 0 || slices.Contains(c.Namespaces, namespace))
+}
+
+// User name a SPIFFE ID maps to, or empty.
+func (c *spiffeConfig) principal(id string) (string, error) {
+	for _, r := range c.Principals {
+		re, err := regexp.Compile(r.ID)
+		if err != nil {
+			return "", fmt.Errorf("invalid SPIFFE ID pattern %q: %w", r.ID, err)
+		}
+		if m := re.FindStringSubmatchIndex(id); m != nil {
+			return string(re.ExpandString(nil, r.User, id, m)), nil
+		}
+	}
+	return "", nil
+}
+
+// Workload selector of SPIRE.
+type spiffeSelector struct {
+	kind, value string
+}
+
+// SubscribeToX509SVIDsRequest of the Delegated Identity API.
+type spiffeSVIDRequest struct {
+	selectors []spiffeSelector
+}
+
+// SubscribeToX509SVIDsResponse of the Delegated Identity API, only the SPIFFE IDs.
+type spiffeSVIDResponse struct {
+	ids []string
+}
+
+// Codec for the few protobuf messages of the Delegated Identity API we use,
+// encoded by hand rather than pulling in the SPIRE API module.
+type spiffeCodec struct{}
+
+func (spiffeCodec) Name() string { return "proto" }
+
+func (spiffeCodec) Marshal(v any) ([]byte, error) {
+	req, ok := v.(*spiffeSVIDRequest)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+	var b []byte
+	for _, s := range req.selectors {
+		var sel []byte
+		sel = protowire.AppendTag(sel, 1, protowire.BytesType)
+		sel = protowire.AppendString(sel, s.kind)
+		sel = protowire.AppendTag(sel, 2, protowire.BytesType)
+		sel = protowire.AppendString(sel, s.value)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, sel)
+	}
+	return b, nil
+}
+
+func (spiffeCodec) Unmarshal(data []byte, v any) error {
+	rsp, ok := v.(*spiffeSVIDResponse)
+	if !ok {
+		return fmt.Errorf("cannot decode %T", v)
+	}
+	rsp.ids = nil
+	// x509_svids (1) -> x509_svid (1) -> id (1) -> trust_domain (1), path (2)
+	return protoFields(data, 1, func(svidWithKey []byte) error {
+		return protoFields(svidWithKey, 1, func(svid []byte) error {
+			return protoFields(svid, 1, func(id []byte) error {
+				var td, path string
+				err := protoFields(id, 1, func(b []byte) error { td = string(b); return nil })
+				if err == nil {
+					err = protoFields(id, 2, func(b []byte) error { path = string(b); return nil })
+				}
+				rsp.ids = append(rsp.ids, "spiffe://"+td+path)
+				return err
+			})
+		})
+	})
+}
+
+// Call fn with each length-delimited field of the number in a protobuf message.
+func protoFields(b []byte, num protowire.Number, fn func([]byte) error) error {
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		if n == num && typ == protowire.BytesType {
+			v, l := protowire.ConsumeBytes(b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			if err := fn(v); err != nil {
+				return err
+			}
+			b = b[l:]
+			continue
+		}
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+	}
+	return nil
+}
+
+// Client of the Delegated Identity API of the SPIRE agent.
+type spiffeClient struct {
+	conn *grpc.ClientConn
+	kube *kubeClient
+}
+
+func newSPIFFEClient(socket string, kube *kubeClient) (*spiffeClient, error) {
+	conn, err := grpc.NewClient("unix://"+socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(spiffeCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SPIRE agent at %s: %w", socket, err)
+	}
+	return &spiffeClient{conn: conn, kube: kube}, nil
+}
+
+// SPIFFE IDs the SPIRE agent issues SVIDs for to the pod, matched by the
+// selectors of the Kubernetes workload attestor.
+func (c *spiffeClient) ids(ctx context.Context, pod *api.PodSandbox) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, spiffeTimeout)
+	defer cancel()
+
+	req := &spiffeSVIDRequest{selectors: []spiffeSelector{
+		{"k8s", "ns:" + pod.GetNamespace()},
+		{"k8s", "pod-name:" + pod.GetName()},
+		{"k8s", "pod-uid:" + pod.GetUid()},
+	}}
+	for k, v := range pod.GetLabels() {
+		req.selectors = append(req.selectors, spiffeSelector{"k8s", "pod-label:" + k + ":" + v})
+	}
+	if sa, err := c.serviceAccount(ctx, pod); err != nil {
+		return nil, err
+	} else if sa != "" {
+		req.selectors = append(req.selectors, spiffeSelector{"k8s", "sa:" + sa})
+	}
+
+	stream, err := c.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, spiffeSubscribeMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	rsp := &spiffeSVIDResponse{}
+	if err := stream.RecvMsg(rsp); err != nil {
+		return nil, err
+	}
+	return rsp.ids, nil
+}
+
+// Service account of the pod, which is not passed over NRI, or empty without
+// Kubernetes API access.
+func (c *spiffeClient) serviceAccount(ctx context.Context, pod *api.PodSandbox) (string, error) {
+	if c.kube == nil {
+		return "", nil
+	}
+	return podServiceAccount(ctx, c.kube, pod)
+}
+
+// Principal of the pod from its SPIFFE ID.
+func (p *plugin) spiffePrincipal(cfg *config, pod *api.PodSandbox) (string, error) {
+	if p.spiffe == nil {
+		return "", errors.New("no SPIRE agent connection")
+	}
+	ids, err := p.spiffe.ids(context.Background(), pod)
+	if err != nil {
+		return "", fmt.Errorf("failed to get SPIFFE ID: %w", err)
+	}
+	for _, id := range ids {
+		user, err := cfg.SPIFFE.principal(id)
+		if err != nil {
+			return "", err
+		}
+		if user != "" {
+			return user, nil
+		}
+	}
+	if len(ids) == 0 {
+		return "", errors.New("no SPIFFE ID issued for the pod")
+	}
+	return "", fmt.Errorf("no principal rule matches SPIFFE ID %s", ids[0])
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Containers wait this long for their credentials by default.
+	defaultStartGateTimeout = time.Minute
+	// Interval the gate checks the credentials and mounts at.
+	startGatePoll = time.Second
+	// Time the runtime gives the hook on top of its own timeout.
+	startGateHookSlack = 10 * time.Second
+)
+
+// Gating of the start of the containers given credentials on them being
+// ready. Containers are created with a createRuntime OCI hook running the
+// plugin binary as start-gate, which the runtime runs on the node before the
+// process of the container is started and which returns once the credential
+// caches of the container hold a valid TGT of its principal and its NFS
+// volumes answer, so that the workload does not run into its NFS paths before
+// them. Containers whose credentials are not ready within the timeout fail to
+// be created, and the kubelet creates them again.
+type startGateConfig struct {
+	// Inject the hook.
+	Enabled bool `json:"enabled,omitempty"`
+	// Path of the plugin binary on the node, that of the plugin by default,
+	// required when the plugin runs in a container, whose binary the runtime
+	// cannot run on the node.
+	Path string `json:"path,omitempty"`
+	// How long a container waits for its credentials, 1m by default.
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+func (c *startGateConfig) validate() error {
+	if c.Path != "" && !filepath.IsAbs(c.Path) {
+		return fmt.Errorf("path %q is not absolute", c.Path)
+	}
+	if c.Enabled && c.Path == "" && containerized() {
+		return errors.New("path must be set when the plugin runs in a container")
+	}
+	if c.Timeout.Duration < 0 {
+		return fmt.Errorf("timeout %s is negative", c.Timeout.Duration)
+	}
+	return nil
+}
+
+func (c *startGateConfig) path() (string, error) {
+	if c.Path != "" {
+		return c.Path, nil
+	}
+	if containerized() {
+		return "", errors.New("startGate.path not set, and the plugin runs in a container")
+	}
+	return os.Executable()
+}
+
+// Whether the plugin runs in a container rather than on the node, in a pod or
+// one of Docker or Podman.
+func containerized() bool {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return true
+	}
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *startGateConfig) timeout() time.Duration {
+	if c.Timeout.Duration > 0 {
+		return c.Timeout.Duration
+	}
+	return defaultStartGateTimeout
+}
+
+// Add the start gate hook to the adjustment of a container given the
+// credentials of the parameters, waiting for the host credential cache, the
+// copy published to the pod, and the NFS volumes of the container.
+func (p *plugin) gateStart(l *logrus.Entry, cfg *config, pod *api.PodSandbox, container *api.Container, kp *kerberosParams, adjust *api.ContainerAdjustment) {
+	if !cfg.StartGate.Enabled || adjust == nil {
+		return
+	}
+	path, err := cfg.StartGate.path()
+	if err != nil {
+		l.Errorf("not gating the start of the container: %v", err)
+		return
+	}
+	timeout := cfg.StartGate.timeout()
+	args := []string{path, "start-gate", "-principal", kp.Principal(), "-realm", kp.Realm, "-timeout", timeout.String()}
+	if src, err := ccachePath(kp.CCName); err == nil {
+		args = append(args, "-ccache", kp.CCName)
+		switch {
+		case kp.GSSProxy:
+		case kp.CCacheType == ccacheTypeDir:
+			args = append(args, "-ccache", filepath.Join(p.ccacheDirOf(pod, kp), dirCCacheName))
+		case kp.CCacheType == ccacheTypeKeyring, kp.CCacheType == ccacheTypeKCM:
+		default:
+			args = append(args, "-ccache", filepath.Join(p.ccacheDirOf(pod, kp), filepath.Base(src)))
+		}
+	}
+	volumes, err := nfsVolumeMounts(p.mounter, container)
+	if err != nil {
+		l.Warnf("not waiting for the NFS volumes of the container: %v", err)
+	}
+	for _, v := range volumes {
+		args = append(args, "-mount", v.GetSource())
+	}
+	l.Debugf("gating the start of the container on the credentials of %s", kp.Principal())
+	adjust.AddHooks(&api.Hooks{
+		CreateRuntime: []*api.Hook{{
+			Path:    path,
+			Args:    args,
+			Timeout: &api.OptionalInt{Value: int64((timeout + startGateHookSlack) / time.Second)},
+		}},
+	})
+}
+
+// Run as the start gate hook: wait until the credential caches hold a valid
+// TGT of the principal and the mounts answer, exiting with 1 if they do not
+// within the timeout.
+func runStartGate(args []string) {
+	var (
+		principal, realm string
+		ccaches, mounts  []string
+		timeout          time.Duration
+	)
+
+	fs := flag.NewFlagSet("start-gate", flag.ExitOnError)
+	fs.StringVar(&principal, "principal", "", "principal the credential caches are to hold a TGT of")
+	fs.StringVar(&realm, "realm", "", "realm of the TGT")
+	fs.Func("ccache", "credential cache to wait for, repeatable", func(v string) error {
+		ccaches = append(ccaches, v)
+		return nil
+	})
+	fs.Func("mount", "mount point to wait for, repeatable", func(v string) error {
+		mounts = append(mounts, v)
+		return nil
+	})
+	fs.DurationVar(&timeout, "timeout", defaultStartGateTimeout, "how long to wait")
+	_ = fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := waitReady(ctx, nodeMounter{}, systemClock{}, principal, realm, ccaches, mounts); err != nil {
+		fmt.Fprintf(os.Stderr, "credentials of %s not ready in %s: %v\n", principal, timeout, err)
+		os.Exit(1)
+	}
+}
+
+// Wait until the credential caches hold a valid TGT of the principal and the
+// mount points can be stat'ed, returning why not once the context is done.
+func waitReady(ctx context.Context, mounter Mounter, clock Clock, principal, realm string, ccaches, mounts []string) error {
+	for {
+		err := checkReady(ctx, mounter, clock, principal, realm, ccaches, mounts)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(startGatePoll):
+		}
+	}
+}
+
+func checkReady(ctx context.Context, mounter Mounter, clock Clock, principal, realm string, ccaches, mounts []string) error {
+	var errs []error
+	for _, ccname := range ccaches {
+		if err := checkCCachePrincipal(ccname, principal); err != nil {
+			errs = append(errs, err)
+		} else if err := checkCCache(ccname, realm, clock.Now()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, path := range mounts {
+		if err := mounter.Stat(ctx, path); err != nil {
+			errs = append(errs, fmt.Errorf("NFS volume %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const defaultSweepInterval = 10 * time.Minute
+
+// Pod UIDs: UUIDs, or hex hashes for static pods.
+var podUIDRegexp = regexp.MustCompile(`^[0-9a-f][0-9a-f-]{31,35}$`)
+
+// Removal of credential caches and keytabs left behind by pods.
+type sweepConfig struct {
+	// Remove the pod credential cache and keytab directories of pods the
+	// runtime no longer has, as left by crashes or missed pod removals.
+	Enabled bool `json:"enabled,omitempty"`
+	// Interval of the sweeps, 10m by default. Directories younger than this
+	// are left alone.
+	Interval duration `json:"interval,omitempty"`
+}
+
+func (c *sweepConfig) interval() time.Duration {
+	if c.Interval.Duration > 0 {
+		return c.Interval.Duration
+	}
+	return defaultSweepInterval
+}
+
+// Sweep the pod directories periodically until the context is cancelled.
+func (p *plugin) runSweeps(ctx context.Context, cfg sweepConfig) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.interval()):
+		}
+		p.sweep(ctx, cfg.interval())
+	}
+}
+
+// Remove the credential cache and keytab directories of pods that are neither
+// sandboxes of the runtime, as last synchronized and tracked since, nor have
+// managed or pre-staged credentials, once older than minAge. The ephemeral
+// principals recorded in keytab directories are deleted with them, or left to
+// expire if they cannot be. Leaked credentials go first, see sweepLeaks.
+func (p *plugin) sweep(ctx context.Context, minAge time.Duration) {
+	p.Lock()
+	if p.sandboxes == nil {
+		// not synchronized yet
+		p.Unlock()
+		return
+	}
+	p.Unlock()
+	p.sweepLeaks(ctx)
+	p.Lock()
+	live := maps.Clone(p.sandboxes)
+	for _, mc := range p.managed {
+		live[mc.pod.GetUid()] = true
+	}
+	p.Unlock()
+	for _, uid := range p.prestage.uids() {
+		live[uid] = true
+	}
+
+	now := p.clock.Now()
+	for _, path := range orphanedDirs(p.podCCacheDirs(), live, now.Add(-minAge)) {
+		err := removePodDir(path)
+		sweptDirs.WithLabelValues("ccache", result(err)).Inc()
+		if err != nil {
+			log.Errorf("failed to remove orphaned credential cache directory %s: %v", path, err)
+			continue
+		}
+		log.Infof("removed orphaned credential cache directory %s", path)
+	}
+	for _, path := range orphanedPodDirs(p.keytabRuntimeDir(), live, now.Add(-minAge)) {
+		cleanupCtx, cancel := context.WithTimeout(ctx, p.config().cleanupTimeout())
+		if err := p.ephemeral.release(cleanupCtx, &api.PodSandbox{Uid: filepath.Base(path)}); err != nil {
+			log.Error(err)
+		}
+		cancel()
+		err := removePodDir(path)
+		sweptDirs.WithLabelValues("keytab", result(err)).Inc()
+		if err != nil {
+			log.Errorf("failed to remove orphaned keytab directory %s: %v", path, err)
+			continue
+		}
+		log.Infof("removed orphaned keytab directory %s", path)
+	}
+}
+
+// Release the credentials of pods which are no sandboxes of the runtime any
+// more without a cleanup pending, as when their removal was missed, and retry
+// destroying the caches of released pods that could not be destroyed, unless
+// in use again.
+func (p *plugin) sweepLeaks(ctx context.Context) {
+	due := p.cleaner.Due()
+	var gone []string
+	p.Lock()
+	for key, mc := range p.managed {
+		_, pending := due[mc.pod.GetId()]
+		if uid := mc.pod.GetUid(); uid != "" && !p.sandboxes[uid] && !pending {
+			gone = append(gone, key)
+		}
+	}
+	p.Unlock()
+	for _, key := range gone {
+		log.Warnf("credentials %s are of a pod the runtime no longer has, releasing them", key)
+		p.releaseCache(key)
+		leakedState.WithLabelValues("credentials", "success").Inc()
+	}
+
+	p.Lock()
+	leaked := p.leaked
+	p.leaked = map[string]*managedCache{}
+	keytabInUse := map[string]bool{}
+	for ccname, lc := range leaked {
+		ccInUse, keytab := p.credentialsInUse(lc.params)
+		if ccInUse {
+			delete(leaked, ccname)
+			continue
+		}
+		keytabInUse[ccname] = keytab
+	}
+	p.Unlock()
+	for ccname, lc := range leaked {
+		cleanupCtx, cancel := context.WithTimeout(ctx, p.config().cleanupTimeout())
+		kp := *lc.params
+		kp.KeytabInUse = keytabInUse[ccname]
+		err := p.destroyCredentials(cleanupCtx, &kp)
+		cancel()
+		leakedState.WithLabelValues("ccache", result(err)).Inc()
+		p.auditOp("destroy", lc.pod, lc.params.Container, lc.params, err)
+		if err != nil {
+			log.Errorf("failed to destroy leaked credential cache %s: %v", ccname, err)
+			p.Lock()
+			if _, ok := p.leaked[ccname]; !ok {
+				p.leaked[ccname] = lc
+			}
+			p.Unlock()
+			continue
+		}
+		log.Infof("destroyed leaked credential cache %s", ccname)
+	}
+}
+
+// Directories of the pod uids given not live, last modified before cutoff.
+func orphanedDirs(dirs map[string]string, live map[string]bool, cutoff time.Time) []string {
+	var orphaned []string
+	for path, uid := range dirs {
+		if info, err := os.Stat(path); err == nil && !live[uid] && !info.ModTime().After(cutoff) {
+			orphaned = append(orphaned, path)
+		}
+	}
+	slices.Sort(orphaned)
+	return orphaned
+}
+
+// Directories of a pod directory of the node, named by pod UID optionally
+// followed by a dot and a container name, of pods not live and last modified
+// before cutoff.
+func orphanedPodDirs(dir string, live map[string]bool, cutoff time.Time) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warnf("cannot sweep %s: %v", dir, err)
+		}
+		return nil
+	}
+	var orphaned []string
+	for _, e := range entries {
+		uid, _, _ := strings.Cut(e.Name(), ".")
+		if !e.IsDir() || !podUIDRegexp.MatchString(uid) || live[uid] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		orphaned = append(orphaned, filepath.Join(dir, e.Name()))
+	}
+	return orphaned
+}
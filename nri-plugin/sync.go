@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Credentials found at synchronization expiring sooner than this are renewed right away.
+const syncMinLifetime = 10 * time.Minute
+
+// Synchronize is called once registered with the runtime, with the pods and
+// containers already there. The plugin forgets the credentials it manages when
+// it restarts, so take over those of running pods again, with the parameters
+// of the state file where neither the annotations nor a running renewal
+// sidecar give them and the renewals and cleanups saved in it at shutdown,
+// and forget pods which went away while we were disconnected.
+func (p *plugin) Synchronize(ctx context.Context, pods []*api.PodSandbox, containers []*api.Container) ([]*api.ContainerUpdate, error) {
+	p.health.connected.Store(true)
+
+	cfg := p.config()
+	running := make(map[string][]*api.Container)
+	for _, ctr := range containers {
+		p.remediation.started(ctr)
+		state := ctr.GetState()
+		if state == api.ContainerState_CONTAINER_CREATED || state == api.ContainerState_CONTAINER_RUNNING {
+			running[ctr.GetPodSandboxId()] = append(running[ctr.GetPodSandboxId()], ctr)
+		}
+	}
+
+	present := make(map[string]bool, len(pods))
+	sandboxes := make(map[string]bool, len(pods))
+	byID := make(map[string]*api.PodSandbox, len(pods))
+	restored := 0
+	for _, pod := range pods {
+		cfg.normalizePod(pod)
+		present[pod.GetId()] = true
+		sandboxes[pod.GetUid()] = true
+		byID[pod.GetId()] = pod
+
+		for _, ctr := range running[pod.GetId()] {
+			if cfg.ownCredentials(pod, ctr.GetName()) && !cfg.DryRun && p.restoreContainer(ctx, cfg, pod, ctr) {
+				restored++
+			}
+		}
+		if !cfg.enabled(pod) {
+			continue
+		}
+		p.Lock()
+		_, known := p.managed[pod.GetId()]
+		p.Unlock()
+		if known {
+			continue
+		}
+
+		l := podLogger(pod)
+		kp := p.podSandboxParams(l, cfg, pod)
+		for _, ctr := range running[pod.GetId()] {
+			if kp != nil {
+				break
+			}
+			kp, _ = p.containerParams(ctx, containerLogger(pod, ctr), cfg, pod, ctr)
+		}
+		if kp == nil {
+			var err error
+			if kp, err = p.bindings.podParams(pod); err != nil {
+				l.Errorf("cannot take over the credentials of the state file: %v", err)
+				continue
+			}
+			if kp != nil {
+				l.Infof("taking the parameters of the credentials for %s from the state file", kp.Principal())
+			}
+		}
+		if kp == nil {
+			continue
+		}
+		if cfg.DryRun {
+			p.dryRunSetup(ctx, l, cfg, pod, kp)
+			continue
+		}
+		err := p.restoreCredentials(ctx, l, cfg, pod, kp)
+		p.tickets.report(pod, kp, err)
+		if err != nil {
+			l.Errorf("failed to restore credentials for %s: %v", kp.Principal(), err)
+			p.events.warn(pod, reasonRenewalFailed, "renewal of credentials for %s failed (%s): %v",
+				kp.Principal(), failureReason(err), err)
+			continue
+		}
+		p.track(pod, kp, l)
+		p.restoreVolumePrincipals(ctx, l, cfg, pod, kp)
+		restored++
+	}
+
+	// Resume the cleanups of stopped pods pending when the previous instance
+	// shut down.
+	for id, due := range p.bindings.takeCleanups() {
+		if present[id] && len(p.podKeys(id)) > 0 {
+			p.cleaner.Schedule(id, due.Sub(p.clock.Now()), func() { p.releasePod(id) })
+		}
+	}
+
+	// pod IDs by the keys of their credentials
+	gone := map[string]string{}
+	p.Lock()
+	for key, mc := range p.managed {
+		if !present[mc.pod.GetId()] {
+			gone[key] = mc.pod.GetId()
+		}
+	}
+	for id := range p.failed {
+		if !present[id] {
+			delete(p.failed, id)
+		}
+	}
+	for id := range p.dryRuns {
+		if !present[id] {
+			delete(p.dryRuns, id)
+		}
+	}
+	p.sandboxes = sandboxes
+	p.pods = byID
+	p.Unlock()
+	for key, id := range gone {
+		p.cleaner.Cancel(id)
+		p.releaseCache(key)
+	}
+	p.bindings.prune(present)
+
+	log.Infof("synchronized %d pods: took over credentials of %d, released %d",
+		len(pods), restored, len(gone))
+
+	return nil, nil
+}
+
+// Take over the credentials of a running container with credentials of its
+// own, returning whether they were.
+func (p *plugin) restoreContainer(ctx context.Context, cfg *config, pod *api.PodSandbox, ctr *api.Container) bool {
+	if p.managedParams(pod, ctr.GetName()) != nil {
+		return false
+	}
+	l := containerLogger(pod, ctr)
+	kp := p.resolveParams(l, cfg, pod, containerSettings(l, cfg, pod, ctr.GetName()))
+	if kp == nil {
+		return false
+	}
+	kp.Container = ctr.GetName()
+	err := p.restoreCredentials(ctx, l, cfg, pod, kp)
+	p.tickets.report(pod, kp, err)
+	if err != nil {
+		l.Errorf("failed to restore credentials for %s: %v", kp.Principal(), err)
+		p.events.warn(pod, reasonRenewalFailed, "renewal of credentials for %s of container %s failed (%s): %v",
+			kp.Principal(), ctr.GetName(), failureReason(err), err)
+		return false
+	}
+	p.track(pod, kp, l)
+	p.restoreVolumePrincipals(ctx, l, cfg, pod, kp)
+	return true
+}
+
+// Take over the credentials of the volume and further principals of a pod,
+// setting up those which are gone.
+func (p *plugin) restoreVolumePrincipals(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams) {
+	ctx, cancel := context.WithTimeout(withLogger(ctx, l), cfg.setupTimeout())
+	defer cancel()
+	if err := p.setupVolumePrincipals(ctx, l, cfg, pod, kp); err != nil {
+		l.Error(err)
+		p.events.warn(pod, reasonRenewalFailed, "%v", err)
+	}
+	if err := p.setupPodPrincipals(ctx, l, pod, kp); err != nil {
+		l.Error(err)
+		p.events.warn(pod, reasonRenewalFailed, "%v", err)
+	}
+}
+
+// Check the credential cache of a pod set up before we restarted,
+// setting it up again if it is gone or about to expire.
+func (p *plugin) restoreCredentials(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams) error {
+	err := checkCCache(kp.CCName, kp.Realm, p.clock.Now().Add(syncMinLifetime))
+	if err == nil {
+		l.Infof("resuming management of credentials for %s", kp.Principal())
+		return nil
+	}
+	l.Infof("renewing credentials for %s: %v", kp.Principal(), err)
+
+	ctx, cancel := context.WithTimeout(withLogger(ctx, l), cfg.setupTimeout())
+	defer cancel()
+
+	err = p.fetchCredentials(ctx, pod, kp)
+	if err == nil {
+		err = p.backend.Renew(ctx, kp)
+	}
+	p.auditOp("renew", pod, kp.Container, kp, err)
+	if err != nil {
+		return err
+	}
+
+	if pod.GetUid() == "" {
+		return nil
+	}
+	_, err = p.publishCCache(pod, kp)
+	return err
+}
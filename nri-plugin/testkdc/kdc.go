@@ -0,0 +1,597 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package testkdc is an in-process KDC for tests. It answers AS and TGS
+// exchanges over TCP and UDP on a loopback port for the principals added to
+// it, with keys derived from their passwords, and writes keytabs of them, so
+// that obtaining and renewing credentials can be tested without a real KDC.
+//
+// It implements what clients of the plugin use: AS-REQs with or without
+// PA-ENC-TIMESTAMP pre-authentication, and TGS-REQs for service tickets and
+// renewals. There is no FAST, PKINIT, cross-realm or kadmin.
+package testkdc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	defaultRealm          = "EXAMPLE.COM"
+	defaultTicketLifetime = 10 * time.Hour
+	defaultRenewLifetime  = 7 * 24 * time.Hour
+	// Clock skew allowed for pre-authentication timestamps and authenticators.
+	clockSkew = 5 * time.Minute
+	// Largest request accepted over TCP.
+	maxRequestSize = 1 << 16
+)
+
+// Enctypes of the keys of principals by default, preferred first.
+var defaultETypes = []int32{etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.AES128_CTS_HMAC_SHA1_96}
+
+// Config of a test KDC.
+type Config struct {
+	// Realm served, EXAMPLE.COM by default.
+	Realm string
+	// Enctypes of the keys of principals, preferred first; aes256-cts-hmac-sha1-96
+	// and aes128-cts-hmac-sha1-96 by default.
+	ETypes []int32
+	// Lifetime of the tickets issued, 10h by default, shortened to what the
+	// client asks for.
+	TicketLifetime time.Duration
+	// Time tickets can be renewed for, 7d by default; tickets are not
+	// renewable if negative.
+	RenewLifetime time.Duration
+	// Offset of the KDC clock from that of the host, to test clock skew.
+	ClockOffset time.Duration
+	// Answer AS-REQs without pre-authentication instead of asking for it.
+	NoPreauth bool
+}
+
+// KDC serving a realm on a loopback port.
+type KDC struct {
+	cfg Config
+	tcp net.Listener
+	udp net.PacketConn
+	wg  sync.WaitGroup
+
+	sync.Mutex
+	principals map[string]*principal
+	// Keys of all principals, all key versions.
+	keys *keytab.Keytab
+	// Requests answered, by message type.
+	requests map[int]int
+}
+
+type principal struct {
+	password string
+	kvno     uint8
+}
+
+// Start a KDC listening on 127.0.0.1, on the same port for TCP and UDP, with
+// the krbtgt principal of its realm.
+func Start(cfg Config) (*KDC, error) {
+	if cfg.Realm == "" {
+		cfg.Realm = defaultRealm
+	}
+	if len(cfg.ETypes) == 0 {
+		cfg.ETypes = defaultETypes
+	}
+	if cfg.TicketLifetime <= 0 {
+		cfg.TicketLifetime = defaultTicketLifetime
+	}
+	if cfg.RenewLifetime == 0 {
+		cfg.RenewLifetime = defaultRenewLifetime
+	}
+	k := &KDC{
+		cfg:        cfg,
+		principals: map[string]*principal{},
+		keys:       keytab.New(),
+		requests:   map[int]int{},
+	}
+	if err := k.AddService("krbtgt/" + cfg.Realm); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if k.tcp, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return nil, err
+		}
+		if k.udp, err = net.ListenPacket("udp", k.tcp.Addr().String()); err == nil {
+			break
+		}
+		k.tcp.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no port free for both TCP and UDP: %w", err)
+	}
+	k.wg.Add(2)
+	go k.serveTCP()
+	go k.serveUDP()
+	return k, nil
+}
+
+// Stop serving.
+func (k *KDC) Close() error {
+	err := errors.Join(k.tcp.Close(), k.udp.Close())
+	k.wg.Wait()
+	return err
+}
+
+// Address of the KDC, host:port for both TCP and UDP.
+func (k *KDC) Addr() string {
+	return k.tcp.Addr().String()
+}
+
+// Realm of the KDC.
+func (k *KDC) Realm() string {
+	return k.cfg.Realm
+}
+
+// Add a principal, its name without realm, with the keys of the password.
+func (k *KDC) AddPrincipal(name, password string) error {
+	k.Lock()
+	defer k.Unlock()
+	if _, ok := k.principals[name]; ok {
+		return fmt.Errorf("principal %s@%s exists", name, k.cfg.Realm)
+	}
+	return k.setKeys(name, &principal{password: password, kvno: 1})
+}
+
+// Add a principal with random keys, as for services.
+func (k *KDC) AddService(name string) error {
+	return k.AddPrincipal(name, randomPassword())
+}
+
+// Change the keys of a principal to those of the password, incrementing its
+// key version as kadmin does. Its keytabs written before no longer work.
+func (k *KDC) ChangePassword(name, password string) error {
+	k.Lock()
+	defer k.Unlock()
+	p, ok := k.principals[name]
+	if !ok {
+		return fmt.Errorf("no principal %s@%s", name, k.cfg.Realm)
+	}
+	return k.setKeys(name, &principal{password: password, kvno: p.kvno + 1})
+}
+
+// Delete a principal.
+func (k *KDC) DeletePrincipal(name string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.principals, name)
+}
+
+// Record the keys of a principal, with the lock held.
+func (k *KDC) setKeys(name string, p *principal) error {
+	for _, etype := range k.cfg.ETypes {
+		if err := k.keys.AddEntry(name, k.cfg.Realm, p.password, time.Now(), p.kvno, etype); err != nil {
+			return fmt.Errorf("cannot derive keys of %s: %w", name, err)
+		}
+	}
+	k.principals[name] = p
+	return nil
+}
+
+// Number of requests answered of a message type, msgtype.KRB_AS_REQ or
+// msgtype.KRB_TGS_REQ.
+func (k *KDC) Requests(msgType int) int {
+	k.Lock()
+	defer k.Unlock()
+	return k.requests[msgType]
+}
+
+var krb5ConfTemplate = template.Must(template.New("krb5.conf").Parse(`[libdefaults]
+    default_realm = {{ .Realm }}
+    dns_lookup_kdc = false
+    dns_lookup_realm = false
+    rdns = false
+    udp_preference_limit = 1465
+    default_tkt_enctypes = {{ .ETypes }}
+    default_tgs_enctypes = {{ .ETypes }}
+    permitted_enctypes = {{ .ETypes }}
+
+[realms]
+    {{ .Realm }} = {
+        kdc = {{ .Addr }}
+    }
+`))
+
+// Minimal krb5.conf for clients of the KDC.
+func (k *KDC) Krb5Conf() string {
+	names := make([]string, len(k.cfg.ETypes))
+	for i, etype := range k.cfg.ETypes {
+		names[i] = etypeName(etype)
+	}
+	buf := &bytes.Buffer{}
+	_ = krb5ConfTemplate.Execute(buf, map[string]string{
+		"Realm":  k.cfg.Realm,
+		"Addr":   k.Addr(),
+		"ETypes": strings.Join(names, " "),
+	})
+	return buf.String()
+}
+
+func (k *KDC) serveTCP() {
+	defer k.wg.Done()
+	for {
+		conn, err := k.tcp.Accept()
+		if err != nil {
+			return
+		}
+		k.wg.Add(1)
+		go func() {
+			defer k.wg.Done()
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+			var size uint32
+			if err := binary.Read(conn, binary.BigEndian, &size); err != nil || size > maxRequestSize {
+				return
+			}
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			reply := k.handle(msg)
+			if err := binary.Write(conn, binary.BigEndian, uint32(len(reply))); err == nil {
+				_, _ = conn.Write(reply)
+			}
+		}()
+	}
+}
+
+func (k *KDC) serveUDP() {
+	defer k.wg.Done()
+	buf := make([]byte, maxRequestSize)
+	for {
+		n, addr, err := k.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = k.udp.WriteTo(k.handle(slices.Clone(buf[:n])), addr)
+	}
+}
+
+// Answer a request with a reply or a KRB-ERROR.
+func (k *KDC) handle(msg []byte) []byte {
+	k.Lock()
+	defer k.Unlock()
+	var as messages.ASReq
+	if err := as.Unmarshal(msg); err == nil {
+		k.requests[msgtype.KRB_AS_REQ]++
+		return k.as(&as)
+	}
+	var tgs messages.TGSReq
+	if err := tgs.Unmarshal(msg); err == nil {
+		k.requests[msgtype.KRB_TGS_REQ]++
+		return k.tgs(&tgs)
+	}
+	return k.krbError(types.PrincipalName{}, errorcode.KRB_ERR_GENERIC, "cannot decode request", nil)
+}
+
+func (k *KDC) now() time.Time {
+	return time.Now().Add(k.cfg.ClockOffset).UTC().Truncate(time.Second)
+}
+
+// Answer an AS-REQ, asking for pre-authentication unless it has a valid one.
+func (k *KDC) as(req *messages.ASReq) []byte {
+	body := &req.ReqBody
+	if body.Realm != k.cfg.Realm {
+		return k.krbError(body.SName, errorcode.KDC_ERR_WRONG_REALM, "realm "+body.Realm+" not served", nil)
+	}
+	if _, ok := k.principals[principalName(body.CName)]; !ok {
+		return k.krbError(body.SName, errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, "client not found", nil)
+	}
+	if _, ok := k.principals[principalName(body.SName)]; !ok {
+		return k.krbError(body.SName, errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, "server not found", nil)
+	}
+	etype, ok := k.etype(body.EType)
+	if !ok {
+		return k.krbError(body.SName, errorcode.KDC_ERR_ETYPE_NOSUPP, "no supported enctype requested", nil)
+	}
+	key, kvno, err := k.keys.GetEncryptionKey(body.CName, k.cfg.Realm, 0, etype)
+	if err != nil {
+		return k.krbError(body.SName, errorcode.KDC_ERR_ETYPE_NOSUPP, err.Error(), nil)
+	}
+	now := k.now()
+	var padata types.PADataSequence
+	if !k.cfg.NoPreauth {
+		if code, text := k.verifyTimestamp(req, now); code != 0 {
+			return k.krbError(body.SName, code, text, k.preauthMethods(body.CName))
+		}
+		padata = k.preauthMethods(body.CName)[:1]
+	}
+
+	f := types.NewKrbFlags()
+	types.SetFlag(&f, flags.Initial)
+	if !k.cfg.NoPreauth {
+		types.SetFlag(&f, flags.PreAuthent)
+	}
+	tkt, enc, err := k.issue(body, body.CName, body.SName, etype, f, now, nil, false)
+	if err != nil {
+		return k.krbError(body.SName, errorcode.KRB_ERR_GENERIC, err.Error(), nil)
+	}
+	b, err := enc.Marshal()
+	if err == nil {
+		var encPart types.EncryptedData
+		if encPart, err = crypto.GetEncryptedData(b, key, keyusage.AS_REP_ENCPART, kvno); err == nil {
+			rep := messages.ASRep{KDCRepFields: messages.KDCRepFields{
+				PVNO:    iana.PVNO,
+				MsgType: msgtype.KRB_AS_REP,
+				PAData:  padata,
+				CRealm:  k.cfg.Realm,
+				CName:   body.CName,
+				Ticket:  tkt,
+				EncPart: encPart,
+			}}
+			if b, err = rep.Marshal(); err == nil {
+				return b
+			}
+		}
+	}
+	return k.krbError(body.SName, errorcode.KRB_ERR_GENERIC, err.Error(), nil)
+}
+
+// Check the PA-ENC-TIMESTAMP of an AS-REQ, returning the error code if it is
+// missing or invalid.
+func (k *KDC) verifyTimestamp(req *messages.ASReq, now time.Time) (int32, string) {
+	for _, pa := range req.PAData {
+		if pa.PADataType != patype.PA_ENC_TIMESTAMP {
+			continue
+		}
+		var ed types.EncryptedData
+		if err := ed.Unmarshal(pa.PADataValue); err != nil {
+			return errorcode.KDC_ERR_PREAUTH_FAILED, err.Error()
+		}
+		key, _, err := k.keys.GetEncryptionKey(req.ReqBody.CName, k.cfg.Realm, ed.KVNO, ed.EType)
+		if err != nil {
+			return errorcode.KDC_ERR_PREAUTH_FAILED, err.Error()
+		}
+		b, err := crypto.DecryptEncPart(ed, key, keyusage.AS_REQ_PA_ENC_TIMESTAMP)
+		if err != nil {
+			return errorcode.KDC_ERR_PREAUTH_FAILED, "pre-authentication failed"
+		}
+		var ts types.PAEncTSEnc
+		if err := ts.Unmarshal(b); err != nil {
+			return errorcode.KDC_ERR_PREAUTH_FAILED, err.Error()
+		}
+		if d := now.Sub(ts.PATimestamp); d > clockSkew || d < -clockSkew {
+			return errorcode.KRB_AP_ERR_SKEW, "clock skew too great"
+		}
+		return 0, ""
+	}
+	return errorcode.KDC_ERR_PREAUTH_REQUIRED, "additional pre-authentication required"
+}
+
+// PA-ETYPE-INFO2 with the enctypes and salt of the keys of a principal, and
+// PA-ENC-TIMESTAMP as the pre-authentication method.
+func (k *KDC) preauthMethods(cname types.PrincipalName) types.PADataSequence {
+	salt := k.cfg.Realm + strings.Join(cname.NameString, "")
+	info := make(types.ETypeInfo2, len(k.cfg.ETypes))
+	for i, etype := range k.cfg.ETypes {
+		info[i] = types.ETypeInfo2Entry{EType: etype, Salt: salt}
+	}
+	b, _ := asn1.Marshal(info)
+	return types.PADataSequence{
+		{PADataType: patype.PA_ETYPE_INFO2, PADataValue: b},
+		{PADataType: patype.PA_ENC_TIMESTAMP},
+	}
+}
+
+// Answer a TGS-REQ for a service ticket or the renewal of a ticket.
+func (k *KDC) tgs(req *messages.TGSReq) []byte {
+	body := &req.ReqBody
+	var ap messages.APReq
+	found := false
+	for _, pa := range req.PAData {
+		if pa.PADataType == patype.PA_TGS_REQ {
+			if err := ap.Unmarshal(pa.PADataValue); err != nil {
+				return k.krbError(body.SName, errorcode.KRB_AP_ERR_MSG_TYPE, err.Error(), nil)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return k.krbError(body.SName, errorcode.KDC_ERR_PADATA_TYPE_NOSUPP, "no PA-TGS-REQ", nil)
+	}
+	tgt := ap.Ticket
+	if len(tgt.SName.NameString) == 0 || tgt.SName.NameString[0] != "krbtgt" || tgt.Realm != k.cfg.Realm {
+		return k.krbError(body.SName, errorcode.KRB_AP_ERR_NOT_US, "not a TGT of "+k.cfg.Realm, nil)
+	}
+	if err := tgt.DecryptEncPart(k.keys, nil); err != nil {
+		return k.krbError(body.SName, errorcode.KRB_AP_ERR_BAD_INTEGRITY, err.Error(), nil)
+	}
+	part := tgt.DecryptedEncPart
+	if err := ap.DecryptAuthenticator(part.Key); err != nil {
+		return k.krbError(body.SName, errorcode.KRB_AP_ERR_BAD_INTEGRITY, err.Error(), nil)
+	}
+	if !ap.Authenticator.CName.Equal(part.CName) {
+		return k.krbError(body.SName, errorcode.KRB_AP_ERR_BADMATCH, "authenticator is not of the ticket client", nil)
+	}
+	now := k.now()
+	if d := now.Sub(ap.Authenticator.CTime); d > clockSkew || d < -clockSkew {
+		return k.krbError(body.SName, errorcode.KRB_AP_ERR_SKEW, "clock skew too great", nil)
+	}
+
+	sname := body.SName
+	renew := types.IsFlagSet(&body.KDCOptions, flags.Renew)
+	switch {
+	case renew && !types.IsFlagSet(&part.Flags, flags.Renewable):
+		return k.krbError(sname, errorcode.KDC_ERR_BADOPTION, "ticket not renewable", nil)
+	case renew && now.After(part.RenewTill):
+		return k.krbError(sname, errorcode.KRB_AP_ERR_TKT_EXPIRED, "ticket renewable lifetime expired", nil)
+	case !renew && now.After(part.EndTime):
+		return k.krbError(sname, errorcode.KRB_AP_ERR_TKT_EXPIRED, "ticket expired", nil)
+	case renew:
+		sname = tgt.SName
+	}
+	if _, ok := k.principals[principalName(part.CName)]; !ok {
+		return k.krbError(sname, errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, "client not found", nil)
+	}
+	if _, ok := k.principals[principalName(sname)]; !ok {
+		return k.krbError(sname, errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, "server not found", nil)
+	}
+	etype, ok := k.etype(body.EType)
+	if !ok {
+		return k.krbError(sname, errorcode.KDC_ERR_ETYPE_NOSUPP, "no supported enctype requested", nil)
+	}
+
+	f := types.NewKrbFlags()
+	if types.IsFlagSet(&part.Flags, flags.PreAuthent) {
+		types.SetFlag(&f, flags.PreAuthent)
+	}
+	issued, enc, err := k.issue(body, part.CName, sname, etype, f, part.AuthTime, &part, renew)
+	if err != nil {
+		return k.krbError(sname, errorcode.KRB_ERR_GENERIC, err.Error(), nil)
+	}
+	b, err := asn1.Marshal(enc)
+	if err == nil {
+		b = asn1tools.AddASNAppTag(b, asnAppTag.EncTGSRepPart)
+		var encPart types.EncryptedData
+		if encPart, err = crypto.GetEncryptedData(b, part.Key, keyusage.TGS_REP_ENCPART_SESSION_KEY, 0); err == nil {
+			rep := messages.TGSRep{KDCRepFields: messages.KDCRepFields{
+				PVNO:    iana.PVNO,
+				MsgType: msgtype.KRB_TGS_REP,
+				CRealm:  part.CRealm,
+				CName:   part.CName,
+				Ticket:  issued,
+				EncPart: encPart,
+			}}
+			if b, err = rep.Marshal(); err == nil {
+				return b
+			}
+		}
+	}
+	return k.krbError(sname, errorcode.KRB_ERR_GENERIC, err.Error(), nil)
+}
+
+// Issue a ticket for a client and the service of the request, valid from
+// now for the ticket lifetime or what the client asked for if shorter. It is
+// renewable for the renew lifetime from the authentication unless renewal is
+// off. A ticket issued with a TGT is renewable only if that is and ends no
+// later than it, which renewals extend to its renewable lifetime.
+func (k *KDC) issue(body *messages.KDCReqBody, cname, sname types.PrincipalName, etype int32, f asn1.BitString, authTime time.Time, tgt *messages.EncTicketPart, renew bool) (messages.Ticket, messages.EncKDCRepPart, error) {
+	now := k.now()
+	end := now.Add(k.cfg.TicketLifetime)
+	if !body.Till.IsZero() && body.Till.After(now) && body.Till.Before(end) {
+		end = body.Till
+	}
+	var renewTill time.Time
+	if k.cfg.RenewLifetime > 0 && (tgt == nil || types.IsFlagSet(&tgt.Flags, flags.Renewable)) {
+		renewTill = authTime.Add(k.cfg.RenewLifetime)
+		if !body.RTime.IsZero() && body.RTime.After(now) && body.RTime.Before(renewTill) {
+			renewTill = body.RTime
+		}
+		if tgt != nil && tgt.RenewTill.Before(renewTill) {
+			renewTill = tgt.RenewTill
+		}
+		types.SetFlag(&f, flags.Renewable)
+	}
+	switch {
+	case tgt != nil && !renew && tgt.EndTime.Before(end):
+		end = tgt.EndTime
+	case !renewTill.IsZero() && renewTill.Before(end):
+		end = renewTill
+	}
+	if types.IsFlagSet(&body.KDCOptions, flags.Forwardable) {
+		types.SetFlag(&f, flags.Forwardable)
+	}
+
+	_, kvno, err := k.keys.GetEncryptionKey(sname, k.cfg.Realm, 0, etype)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+	tkt, key, err := messages.NewTicket(cname, k.cfg.Realm, sname, k.cfg.Realm, f, k.keys, etype, kvno, authTime, now, end, renewTill)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+	enc := messages.EncKDCRepPart{
+		Key:       key,
+		LastReqs:  []messages.LastReq{{LRType: 0, LRValue: now}},
+		Nonce:     body.Nonce,
+		Flags:     f,
+		AuthTime:  authTime,
+		StartTime: now,
+		EndTime:   end,
+		RenewTill: renewTill,
+		SRealm:    k.cfg.Realm,
+		SName:     sname,
+	}
+	return tkt, enc, nil
+}
+
+// First of the enctypes requested the KDC has keys of.
+func (k *KDC) etype(requested []int32) (int32, bool) {
+	for _, etype := range requested {
+		if slices.Contains(k.cfg.ETypes, etype) {
+			return etype, true
+		}
+	}
+	return 0, false
+}
+
+func (k *KDC) krbError(sname types.PrincipalName, code int32, text string, edata types.PADataSequence) []byte {
+	e := messages.NewKRBError(sname, k.cfg.Realm, code, text)
+	now := time.Now().Add(k.cfg.ClockOffset).UTC()
+	e.STime, e.Susec = now.Truncate(time.Second), int((now.UnixNano()/int64(time.Microsecond))%1e6)
+	if len(e.SName.NameString) == 0 {
+		e.SName = types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+k.cfg.Realm)
+	}
+	if len(edata) > 0 {
+		e.EData, _ = asn1.Marshal(edata)
+	}
+	b, _ := e.Marshal()
+	return b
+}
+
+// Name of a principal without realm.
+func principalName(name types.PrincipalName) string {
+	return strings.Join(name.NameString, "/")
+}
+
+func randomPassword() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
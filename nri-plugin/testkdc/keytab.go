@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testkdc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// Keytab with the current keys of the principals, as ktadd writes it.
+func (k *KDC) Keytab(names ...string) (*keytab.Keytab, error) {
+	k.Lock()
+	defer k.Unlock()
+	kt := keytab.New()
+	for _, name := range names {
+		p, ok := k.principals[name]
+		if !ok {
+			return nil, fmt.Errorf("no principal %s@%s", name, k.cfg.Realm)
+		}
+		for _, entry := range k.keys.Entries {
+			if entry.KVNO == uint32(p.kvno) && entry.Principal.String() == name+"@"+k.cfg.Realm {
+				kt.Entries = append(kt.Entries, entry)
+			}
+		}
+	}
+	return kt, nil
+}
+
+// Write the keytab of the principals to path, readable by the owner only.
+func (k *KDC) WriteKeytab(path string, names ...string) error {
+	kt, err := k.Keytab(names...)
+	if err != nil {
+		return err
+	}
+	b, err := kt.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+// Write the krb5.conf of the KDC to path.
+func (k *KDC) WriteKrb5Conf(path string) error {
+	return os.WriteFile(path, []byte(k.Krb5Conf()), 0o644)
+}
+
+// Name of an enctype as krb5.conf takes it, the longest of its aliases being
+// the full one.
+func etypeName(etype int32) string {
+	name := strconv.Itoa(int(etype))
+	for alias, id := range etypeID.ETypesByName {
+		if id == etype && (len(alias) > len(name) || len(alias) == len(name) && alias < name) {
+			name = alias
+		}
+	}
+	return name
+}
@@ -0,0 +1,358 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+const (
+	ticketsPathFormat = "/apis/kerberos.nri.io/v1alpha1/namespaces/%s/kerberostickets"
+	ticketNodeLabel   = "kerberos.nri.io/node"
+
+	conditionReady = "Ready"
+
+	// Annotations of pods with podStatus.annotations: ready, failed or
+	// released, the principal, the TGT expiry and the failure class.
+	statusAnnotation          = "kerberos-status"
+	statusPrincipalAnnotation = "kerberos-status-principal"
+	statusExpiresAnnotation   = "kerberos-status-expires"
+	statusReasonAnnotation    = "kerberos-status-reason"
+	// Condition of pods with podStatus.condition, for readiness gates.
+	ticketCondition = "kerberos.nri.io/TicketReady"
+)
+
+// Ticket state written back to the pods themselves.
+type podStatusConfig struct {
+	// Annotate pods with the state, principal and expiry of their credentials.
+	Annotations bool `json:"annotations,omitempty"`
+	// Set the ticketCondition of pods.
+	Condition bool `json:"condition,omitempty"`
+}
+
+func (c *podStatusConfig) enabled() bool {
+	return c.Annotations || c.Condition
+}
+
+// KerberosTicket, the ticket state of a pod as published by the node plugin.
+type kerberosTicket struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Metadata   kerberosTicketMeta   `json:"metadata"`
+	Spec       kerberosTicketSpec   `json:"spec"`
+	Status     kerberosTicketStatus `json:"status,omitzero"`
+}
+
+type kerberosTicketMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	OwnerReferences []ownerReference  `json:"ownerReferences,omitempty"`
+}
+
+type ownerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+}
+
+type kerberosTicketSpec struct {
+	Pod       string `json:"pod"`
+	Node      string `json:"node"`
+	Principal string `json:"principal"`
+}
+
+type kerberosTicketStatus struct {
+	Expires     *time.Time `json:"expires,omitempty"`
+	RenewTill   *time.Time `json:"renewTill,omitempty"`
+	LastRenewal *time.Time `json:"lastRenewal,omitempty"`
+	// Ticket and renewable lifetimes of the TGT, as the KDC granted them.
+	TicketLifetime string              `json:"ticketLifetime,omitempty"`
+	RenewLifetime  string              `json:"renewLifetime,omitempty"`
+	Conditions     []identityCondition `json:"conditions,omitempty"`
+}
+
+// Publisher of KerberosTicket objects, one per managed pod, named after the
+// pod and owned by it, and of the ticket state of pods in their annotations
+// and conditions. Updates are queued and published in the background, later
+// ones for a pod replacing those not published yet.
+type ticketReporter struct {
+	kube  *kubeClient
+	node  string
+	clock Clock
+	// Publish KerberosTickets, with ticketStatus.
+	tickets   bool
+	podStatus podStatusConfig
+	// Annotation names of the annotation prefix.
+	annotation func(string) string
+
+	sync.Mutex
+	pending map[string]*ticketReport
+	// Last published status, by pod ID.
+	published map[string]*kerberosTicketStatus
+	// Last ticketCondition set, by pod ID.
+	conditions map[string]identityCondition
+	wake       chan struct{}
+}
+
+type ticketReport struct {
+	namespace, name, uid string
+	params               *kerberosParams
+	err                  error
+	at                   time.Time
+	release              bool
+}
+
+func newTicketReporter(kube *kubeClient, node string, cfg *config, clock Clock) *ticketReporter {
+	return &ticketReporter{
+		kube:       kube,
+		node:       node,
+		clock:      clock,
+		tickets:    cfg.TicketStatus,
+		podStatus:  cfg.PodStatus,
+		annotation: cfg.annotation,
+		pending:    make(map[string]*ticketReport),
+		published:  make(map[string]*kerberosTicketStatus),
+		conditions: make(map[string]identityCondition),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Report that credentials of a pod were set up or renewed, or failed to be.
+func (r *ticketReporter) report(pod *api.PodSandbox, kp *kerberosParams, err error) {
+	if r == nil {
+		return
+	}
+	r.queue(pod, &ticketReport{params: kp, err: err})
+}
+
+// Report that credentials of a pod were released, deleting its KerberosTicket.
+func (r *ticketReporter) release(pod *api.PodSandbox) {
+	if r == nil {
+		return
+	}
+	r.queue(pod, &ticketReport{release: true})
+}
+
+func (r *ticketReporter) queue(pod *api.PodSandbox, rep *ticketReport) {
+	rep.namespace, rep.name, rep.uid = pod.GetNamespace(), pod.GetName(), pod.GetUid()
+	rep.at = r.clock.Now().UTC().Truncate(time.Second)
+
+	r.Lock()
+	r.pending[pod.GetId()] = rep
+	r.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Publish queued reports until the context is cancelled.
+func (r *ticketReporter) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		}
+
+		r.Lock()
+		pending := r.pending
+		r.pending = make(map[string]*ticketReport)
+		r.Unlock()
+
+		for id, rep := range pending {
+			if r.tickets {
+				if err := r.publish(ctx, id, rep); err != nil {
+					log.Warnf("failed to publish KerberosTicket %s/%s: %v", rep.namespace, rep.name, err)
+				}
+			}
+			if r.podStatus.enabled() {
+				if err := r.publishPodStatus(ctx, id, rep); err != nil {
+					log.Warnf("failed to publish the ticket state of pod %s/%s: %v", rep.namespace, rep.name, err)
+				}
+			}
+		}
+	}
+}
+
+func (r *ticketReporter) publish(ctx context.Context, id string, rep *ticketReport) error {
+	path := fmt.Sprintf(ticketsPathFormat, rep.namespace)
+
+	r.Lock()
+	prev, ok := r.published[id]
+	r.Unlock()
+
+	if rep.release {
+		r.Lock()
+		delete(r.published, id)
+		r.Unlock()
+		err := r.kube.do(ctx, http.MethodDelete, path+"/"+rep.name, "", nil, nil)
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if !ok {
+		prev = &kerberosTicketStatus{}
+		ticket := &kerberosTicket{
+			APIVersion: "kerberos.nri.io/v1alpha1",
+			Kind:       "KerberosTicket",
+			Metadata: kerberosTicketMeta{
+				Name:      rep.name,
+				Namespace: rep.namespace,
+				Labels:    map[string]string{ticketNodeLabel: r.node},
+				OwnerReferences: []ownerReference{
+					{APIVersion: "v1", Kind: "Pod", Name: rep.name, UID: rep.uid},
+				},
+			},
+			Spec: kerberosTicketSpec{
+				Pod:       rep.name,
+				Node:      r.node,
+				Principal: rep.params.Principal(),
+			},
+		}
+		if err := r.kube.do(ctx, http.MethodPost, path, "", ticket, nil); err != nil && !errors.Is(err, errConflict) {
+			return err
+		}
+	}
+
+	status := &kerberosTicketStatus{Expires: prev.Expires, RenewTill: prev.RenewTill, LastRenewal: prev.LastRenewal,
+		TicketLifetime: prev.TicketLifetime, RenewLifetime: prev.RenewLifetime}
+	ready := identityCondition{Type: conditionReady, Status: "True", Reason: "TicketValid"}
+	if rep.err != nil {
+		ready = identityCondition{Type: conditionReady, Status: "False", Reason: conditionReason(rep.err), Message: rep.err.Error()}
+	} else {
+		status.LastRenewal = &rep.at
+		if t, err := ccacheTimes(rep.params.CCName, rep.params.Realm); err == nil {
+			expires := t.end.UTC()
+			status.Expires = &expires
+			ticket, renew := t.lifetimes()
+			status.TicketLifetime = ticket.Round(time.Second).String()
+			if renew > 0 {
+				renewTill := t.renewTill.UTC()
+				status.RenewTill = &renewTill
+				status.RenewLifetime = renew.Round(time.Second).String()
+			}
+		}
+	}
+	status.Conditions = []identityCondition{mergeCondition(prev.Conditions, ready, rep.at)}
+
+	patch := map[string]any{"status": status}
+	if err := r.kube.do(ctx, http.MethodPatch, path+"/"+rep.name+"/status", "application/merge-patch+json", patch, nil); err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.published[id] = status
+	r.Unlock()
+	return nil
+}
+
+// Write the ticket state back to the pod, in its annotations and its
+// ticketCondition. Pods already deleted are left alone.
+func (r *ticketReporter) publishPodStatus(ctx context.Context, id string, rep *ticketReport) error {
+	path := fmt.Sprintf(podPathFormat, rep.namespace, rep.name)
+	state, reason := "ready", ""
+	cond := identityCondition{Type: ticketCondition, Status: "True", Reason: "TicketValid"}
+	switch {
+	case rep.release:
+		state = "released"
+		cond = identityCondition{Type: ticketCondition, Status: "False", Reason: "Released", Message: "credentials released"}
+	case rep.err != nil:
+		state, reason = "failed", failureReason(rep.err)
+		cond = identityCondition{Type: ticketCondition, Status: "False", Reason: conditionReason(rep.err), Message: rep.err.Error()}
+	}
+
+	if r.podStatus.Annotations {
+		// null removes the annotations not applying
+		var principal, expires, why any
+		if !rep.release {
+			principal = rep.params.Principal()
+			if t, err := ccacheTimes(rep.params.CCName, rep.params.Realm); err == nil {
+				expires = t.end.UTC().Format(time.RFC3339)
+			}
+		}
+		if reason != "" {
+			why = reason
+		}
+		patch := map[string]any{"metadata": map[string]any{"annotations": map[string]any{
+			r.annotation(statusAnnotation):          state,
+			r.annotation(statusPrincipalAnnotation): principal,
+			r.annotation(statusExpiresAnnotation):   expires,
+			r.annotation(statusReasonAnnotation):    why,
+		}}}
+		err := r.kube.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+		if errors.Is(err, errNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if r.podStatus.Condition {
+		r.Lock()
+		prev, ok := r.conditions[id]
+		r.Unlock()
+		var old []identityCondition
+		if ok {
+			old = append(old, prev)
+		}
+		cond = mergeCondition(old, cond, rep.at)
+		patch := map[string]any{"status": map[string]any{"conditions": []identityCondition{cond}}}
+		err := r.kube.do(ctx, http.MethodPatch, path+"/status", "application/strategic-merge-patch+json", patch, nil)
+		if errors.Is(err, errNotFound) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Lock()
+	if rep.release {
+		delete(r.conditions, id)
+	} else {
+		r.conditions[id] = cond
+	}
+	r.Unlock()
+	return nil
+}
+
+// Condition reason for a failure class, e.g. KdcUnreachable.
+func conditionReason(err error) string {
+	reason := failureReason(err)
+	if reason == "other" {
+		return "SetupFailed"
+	}
+	parts := strings.Split(reason, "_")
+	for i, p := range parts {
+		parts[i] = strings.ToUpper(p[:1]) + p[1:]
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,278 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Lifetime of the ServiceAccount tokens presented to the broker unless
+// configured, the shortest the API server issues.
+const defaultBrokerTokenLifetime = 10 * time.Minute
+
+// errBrokerForbidden is returned when the broker refuses the token of a pod.
+var errBrokerForbidden = errors.New("token refused")
+
+// Exchange service handing out keytabs or tickets for the ServiceAccount
+// tokens of pods, which it validates with a TokenReview and maps to
+// principals.
+type tokenBrokerConfig struct {
+	// URL of the exchange endpoint, https. Disabled if empty.
+	URL string `json:"url,omitempty"`
+	// PEM CA bundle for verifying the broker, the system roots if empty.
+	CAFile string `json:"caFile,omitempty"`
+	// Client certificate and key the plugin authenticates to the broker with.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// Audience of the tokens, the URL by default. The broker reviews tokens
+	// for it.
+	Audience string `json:"audience,omitempty"`
+	// Lifetime of the tokens, 10m by default.
+	TokenLifetime duration `json:"tokenLifetime,omitempty"`
+	// Namespaces whose pods get their credentials from the broker, all if
+	// empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Keytabs and tickets exchanged for the tokens of pods at the broker.
+type tokenBroker struct {
+	cfg  tokenBrokerConfig
+	kube *kubeClient
+	http *http.Client
+}
+
+// Create the token broker client, nil if no broker is configured.
+func newTokenBroker(cfg tokenBrokerConfig, kube *kubeClient) (*tokenBroker, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid token broker URL %q, must be https://", cfg.URL)
+	}
+	if kube == nil {
+		return nil, errors.New("the token broker needs Kubernetes API access")
+	}
+	if cfg.Audience == "" {
+		cfg.Audience = cfg.URL
+	}
+	if cfg.TokenLifetime.Duration <= 0 {
+		cfg.TokenLifetime.Duration = defaultBrokerTokenLifetime
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token broker CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("failed to parse token broker CA")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load token broker client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return &tokenBroker{
+		cfg:  cfg,
+		kube: kube,
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+func (b *tokenBroker) Name() string {
+	return "token broker " + b.cfg.URL
+}
+
+// Check whether pods of the namespace get their credentials from the broker.
+func (b *tokenBroker) handles(namespace string) bool {
+	return b != nil && (len(b.cfg.Namespaces) == 0 || slices.Contains(b.cfg.Namespaces, namespace))
+}
+
+// Request of the exchange, the token going in the Authorization header.
+type brokerRequest struct {
+	Principal string `json:"principal"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+}
+
+// Answer of the exchange: a keytab of the principal, or a credential cache
+// holding a TGT of it, base64.
+type brokerResponse struct {
+	Keytab string `json:"keytab,omitempty"`
+	CCache string `json:"ccache,omitempty"`
+}
+
+// Exchange a token of the ServiceAccount of the pod, bound to the pod, for
+// the credentials of its principal.
+func (b *tokenBroker) Fetch(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) (*credential, error) {
+	token, err := b.podToken(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&brokerRequest{Principal: kp.Principal(), Namespace: pod.GetNamespace(), Pod: pod.GetName()})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := b.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange failed: %w", err)
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("exchange failed: %w", err)
+	}
+	switch {
+	case rsp.StatusCode == http.StatusUnauthorized || rsp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("exchange for %s: %w: %s", kp.Principal(), errBrokerForbidden, rsp.Status)
+	case rsp.StatusCode < 200 || rsp.StatusCode > 299:
+		return nil, fmt.Errorf("exchange for %s failed: %s", kp.Principal(), rsp.Status)
+	}
+
+	var out brokerResponse
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("invalid exchange response: %w", err)
+	}
+	switch {
+	case out.CCache != "":
+		cc, err := base64.StdEncoding.DecodeString(out.CCache)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential cache for %s: %w", kp.Principal(), err)
+		}
+		return &credential{CCache: cc}, nil
+	case out.Keytab != "":
+		keytab, err := base64.StdEncoding.DecodeString(out.Keytab)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keytab for %s: %w", kp.Principal(), err)
+		}
+		return &credential{Keytab: keytab}, nil
+	}
+	return nil, fmt.Errorf("no keytab or credential cache for %s in the exchange response", kp.Principal())
+}
+
+// Token of the ServiceAccount of the pod for the audience of the broker, bound
+// to the pod so that it is void once the pod is gone, from a TokenRequest.
+func (b *tokenBroker) podToken(ctx context.Context, pod *api.PodSandbox) (string, error) {
+	account, err := podServiceAccount(ctx, b.kube, pod)
+	if err != nil {
+		return "", err
+	}
+	if account == "" {
+		account = "default"
+	}
+	req := map[string]any{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenRequest",
+		"spec": map[string]any{
+			"audiences":         []string{b.cfg.Audience},
+			"expirationSeconds": int64(b.cfg.TokenLifetime.Seconds()),
+			"boundObjectRef": map[string]string{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"name":       pod.GetName(),
+				"uid":        pod.GetUid(),
+			},
+		},
+	}
+	out := struct {
+		Status struct {
+			Token string `json:"token"`
+		} `json:"status"`
+	}{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/serviceaccounts/%s/token", pod.GetNamespace(), account)
+	if err := b.kube.do(ctx, http.MethodPost, path, "", req, &out); err != nil {
+		return "", fmt.Errorf("failed to request a token of service account %s/%s: %w", pod.GetNamespace(), account, err)
+	}
+	if out.Status.Token == "" {
+		return "", fmt.Errorf("no token of service account %s/%s issued", pod.GetNamespace(), account)
+	}
+	return out.Status.Token, nil
+}
+
+// Install a credential cache issued for the workload as its host credential
+// cache, checking that it holds a TGT of the principal.
+func installIssuedCCache(kp *kerberosParams, data []byte) error {
+	path, err := ccachePath(kp.CCName)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", "nri-kerberos-issued-*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCCacheFailed, err)
+	}
+	if err := checkCCachePrincipal("FILE:"+tmp.Name(), kp.Principal()); err != nil {
+		return err
+	}
+	if err := checkCCache("FILE:"+tmp.Name(), kp.Realm, time.Now()); err != nil {
+		return err
+	}
+	return copyCCache(tmp.Name(), path, int(kp.UID), int(kp.GID), 0600)
+}
+
+// Backend leaving the credentials issued with a credential cache alone, and
+// obtaining the others.
+type issuedBackend struct {
+	KerberosBackend
+}
+
+func (b *issuedBackend) Setup(ctx context.Context, kp *kerberosParams) error {
+	if kp.Issued {
+		return nil
+	}
+	return b.KerberosBackend.Setup(ctx, kp)
+}
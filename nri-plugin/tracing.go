@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer of the plugin, a no-op unless tracing is set up.
+var tracer = otel.Tracer("github.com/tuminoid/nri-plugins/kerberos-auth")
+
+// OpenTelemetry tracing configuration.
+type tracingConfig struct {
+	// OTLP/HTTP collector endpoint, host:port. The standard OTEL_EXPORTER_OTLP_*
+	// variables are used if empty; tracing is off if neither is set.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Export without TLS.
+	Insecure bool `json:"insecure,omitempty"`
+	// Fraction of traces sampled, 1 if unset.
+	SampleRatio float64 `json:"sampleRatio,omitempty"`
+}
+
+// Set up the trace exporter, returning a function flushing and stopping it.
+func setupTracing(ctx context.Context, cfg tracingConfig) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	ratio := cfg.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName("nri-kerberos"),
+		semconv.HostName(nodeName()),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Span attributes identifying a pod.
+func podAttributes(namespace, pod string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		semconv.K8SNamespaceName(namespace),
+		semconv.K8SPodName(pod),
+	)
+}
+
+// Span attributes identifying a container.
+func containerAttributes(namespace, pod, container string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		semconv.K8SNamespaceName(namespace),
+		semconv.K8SPodName(pod),
+		semconv.K8SContainerName(container),
+	)
+}
+
+// Span attributes identifying a principal.
+func principalAttributes(kp *kerberosParams) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("kerberos.principal", kp.Principal()),
+		attribute.String("kerberos.realm", kp.Realm),
+		attribute.String("kerberos.kdc", kp.KDC),
+	)
+}
+
+// End a span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
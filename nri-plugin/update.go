@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/containerd/nri/pkg/api"
+)
+
+// Check the credentials of a container once its resources were updated, as
+// by an in-place resize, and refresh them if they are no longer good: managed
+// credentials whose cache is missing, not published to the pod or about to
+// expire are renewed at once, and a failed setup of the pod is retried. The
+// plugin adjusts no resources, so it does not handle UpdateContainer itself
+// and never holds up an update.
+func (p *plugin) PostUpdateContainer(_ context.Context, pod *api.PodSandbox, container *api.Container) error {
+	cfg := p.config()
+	l := containerLogger(pod, container)
+	l.Debug("PostUpdateContainer")
+	if !cfg.enabledFor(pod, container.GetName()) || cfg.DryRun {
+		return nil
+	}
+
+	kp := p.podParams(pod)
+	if cfg.ownCredentials(pod, container.GetName()) {
+		kp = p.managedParams(pod, container.GetName())
+	}
+	if kp == nil {
+		p.Lock()
+		setupErr := p.failed[pod.GetId()]
+		p.Unlock()
+		if setupErr != nil && cfg.enabled(pod) {
+			l.Infof("retrying the failed credential setup of the pod after update: %v", setupErr)
+			go p.retrySetup(pod)
+		}
+		return nil
+	}
+
+	err := checkCCache(kp.CCName, kp.Realm, p.clock.Now().Add(syncMinLifetime))
+	if err == nil {
+		err = p.checkPublished(pod, kp)
+	}
+	if err == nil {
+		return nil
+	}
+	key := managedKey(pod, kp)
+	if !cfg.Renewal.Enabled {
+		l.Warnf("credentials for %s no longer good after update, renewal disabled: %v", kp.Principal(), err)
+		return nil
+	}
+	l.Warnf("credentials for %s no longer good after update, renewing them: %v", kp.Principal(), err)
+	p.renewals.Cancel(key)
+	go p.renewPod(key)
+	return nil
+}
+
+// Set up the credentials of a pod whose setup failed again, as when it ran.
+func (p *plugin) retrySetup(pod *api.PodSandbox) {
+	p.Lock()
+	_, failed := p.failed[pod.GetId()]
+	p.Unlock()
+	if !failed {
+		return
+	}
+	cfg := p.config()
+	l := podLogger(pod)
+	kp := p.podSandboxParams(l, cfg, pod)
+	if kp == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(withLogger(context.Background(), l), cfg.setupTimeout())
+	defer cancel()
+	err := p.setupPod(ctx, l, cfg, pod, kp, "")
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		l.Error(err)
+		p.failed[pod.GetId()] = err
+		return
+	}
+	delete(p.failed, pod.GetId())
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+var procNSRegexp = regexp.MustCompile(`^/proc/([0-9]+)/ns/user$`)
+
+// Id mappings of the user namespace of a pod, as with hostUsers: false.
+type userNamespace struct {
+	uids, gids []userNSRange
+}
+
+// Range of ids of a user namespace mapped to the host, as in /proc/<pid>/uid_map.
+type userNSRange struct {
+	container, host, size uint64
+}
+
+// Host id of a container id by the ranges, and whether it is mapped.
+func mapToHost(ranges []userNSRange, id uint64) (uint64, bool) {
+	for _, r := range ranges {
+		if id >= r.container && id-r.container < r.size {
+			return r.host + id - r.container, true
+		}
+	}
+	return 0, false
+}
+
+// Container id of a host id by the ranges, and whether it is mapped.
+func mapToContainer(ranges []userNSRange, id uint64) (uint64, bool) {
+	for _, r := range ranges {
+		if id >= r.host && id-r.host < r.size {
+			return r.container + id - r.host, true
+		}
+	}
+	return 0, false
+}
+
+// User namespace of a pod, nil if it runs in that of the host. NRI does not
+// pass the mappings, so they are read from /proc of a process in the
+// namespace: that of its path, of another process in the namespace it names,
+// or the pod sandbox process.
+func podUserNamespace(pod *api.PodSandbox) (*userNamespace, error) {
+	var ns *api.LinuxNamespace
+	for _, n := range pod.GetLinux().GetNamespaces() {
+		if n.GetType() == "user" {
+			ns = n
+		}
+	}
+	if ns == nil {
+		return nil, nil
+	}
+
+	var pid string
+	switch {
+	case procNSRegexp.MatchString(ns.GetPath()):
+		pid = procNSRegexp.FindStringSubmatch(ns.GetPath())[1]
+	case ns.GetPath() != "":
+		var err error
+		if pid, err = userNamespaceProcess(ns.GetPath()); err != nil {
+			return nil, err
+		}
+	case pod.GetPid() != 0:
+		pid = strconv.FormatUint(uint64(pod.GetPid()), 10)
+	default:
+		return nil, errors.New("the id mappings of the user namespace of the pod are not known")
+	}
+
+	userns := &userNamespace{}
+	var err error
+	if userns.uids, err = readIDMap(filepath.Join("/proc", pid, "uid_map")); err != nil {
+		return nil, err
+	}
+	if userns.gids, err = readIDMap(filepath.Join("/proc", pid, "gid_map")); err != nil {
+		return nil, err
+	}
+	if len(userns.uids) == 1 && userns.uids[0] == (userNSRange{0, 0, 1<<32 - 1}) {
+		// the initial namespace, or one mapping it as a whole
+		return nil, nil
+	}
+	return userns, nil
+}
+
+// A process in the user namespace bound at a path.
+func userNamespaceProcess(path string) (string, error) {
+	var want unix.Stat_t
+	if err := unix.Stat(path, &want); err != nil {
+		return "", fmt.Errorf("failed to open user namespace: %w", err)
+	}
+	procs, _ := filepath.Glob("/proc/[0-9]*/ns/user")
+	for _, proc := range procs {
+		var st unix.Stat_t
+		if unix.Stat(proc, &st) == nil && st.Dev == want.Dev && st.Ino == want.Ino {
+			return strings.Split(proc, "/")[2], nil
+		}
+	}
+	return "", fmt.Errorf("no process in user namespace %s", path)
+}
+
+// Parse an id map of /proc.
+func readIDMap(path string) ([]userNSRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read id mappings: %w", err)
+	}
+	defer f.Close()
+
+	var ranges []userNSRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r userNSRange
+		if _, err := fmt.Sscan(scanner.Text(), &r.container, &r.host, &r.size); err != nil {
+			return nil, fmt.Errorf("invalid id mapping %q in %s", scanner.Text(), path)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, scanner.Err()
+}
+
+// Translate ids as the containers of the pod see them to those of the host,
+// which the files of the pod are owned by, and rpc.gssd and gss-proxy see its
+// processes as.
+func (userns *userNamespace) toHost(uid, gid, fsid uint64) (uint64, uint64, uint64, error) {
+	hostUID, ok := mapToHost(userns.uids, uid)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("uid %d is not mapped by the user namespace of the pod", uid)
+	}
+	hostGID, ok := mapToHost(userns.gids, gid)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("gid %d is not mapped by the user namespace of the pod", gid)
+	}
+	hostFSID, ok := mapToHost(userns.gids, fsid)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("fsid %d is not mapped by the user namespace of the pod", fsid)
+	}
+	return hostUID, hostGID, hostFSID, nil
+}
+
+// Ids of the parameters as the containers of the pod see them.
+func (kp *kerberosParams) containerIDs() (uid, gid, fsid uint64) {
+	if kp.UserNS == nil {
+		return kp.UID, kp.GID, kp.FSID
+	}
+	uid, _ = mapToContainer(kp.UserNS.uids, kp.UID)
+	gid, _ = mapToContainer(kp.UserNS.gids, kp.GID)
+	fsid, _ = mapToContainer(kp.UserNS.gids, kp.FSID)
+	return uid, gid, fsid
+}
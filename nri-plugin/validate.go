@@ -0,0 +1,348 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Validating webhook rejecting pods whose Kerberos annotations or env vars the
+// plugin would silently ignore at container creation.
+type validator struct {
+	annotationPrefix string
+	// Require the uid/gid/fsid annotations and KERBEROS_REALM on enabled pods,
+	// off when KerberosIdentities or node defaults provide them.
+	strict bool
+	// The plugin takes ids from the securityContext, so it may stand in for
+	// the annotations.
+	securityContextIDs bool
+}
+
+func (v *validator) annotation(name string) string {
+	return v.annotationPrefix + name
+}
+
+func (v *validator) validate(req *admissionRequest, pod *admissionPod) *admissionResponse {
+	legacy := normalizeAnnotations(pod.Metadata.Annotations, v.annotation)
+	ann := pod.Metadata.Annotations
+	var errs []string
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	enabled := false
+	switch value, ok := ann[v.annotation("kerberos-auth")]; {
+	case !ok:
+	case value == "enabled":
+		enabled = true
+	case value != "disabled":
+		fail("%s must be \"enabled\" or \"disabled\", not %q", v.annotation("kerberos-auth"), value)
+	}
+
+	ids := map[string]uint64{}
+	for _, name := range []string{"kerberos-uid", "kerberos-gid", "kerberos-fsid"} {
+		key := v.annotation(name)
+		value, ok := ann[key]
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || id == 0 {
+			fail("%s must be a positive number, not %q", key, value)
+			continue
+		}
+		ids[name] = id
+	}
+	scIDs := map[string]bool{}
+	for _, sc := range append([]*podSecurityContext{pod.Spec.SecurityContext}, containerSecurityContexts(pod)...) {
+		if sc == nil {
+			continue
+		}
+		if sc.RunAsUser != nil {
+			scIDs["kerberos-uid"] = true
+		}
+		if sc.RunAsGroup != nil {
+			scIDs["kerberos-gid"] = true
+		}
+		if sc.FSGroup != nil {
+			scIDs["kerberos-fsid"] = true
+		}
+		if uid, ok := ids["kerberos-uid"]; ok && sc.RunAsUser != nil && uint64(*sc.RunAsUser) != uid {
+			fail("%s %d does not match runAsUser %d", v.annotation("kerberos-uid"), uid, *sc.RunAsUser)
+		}
+		if gid, ok := ids["kerberos-gid"]; ok && sc.RunAsGroup != nil && uint64(*sc.RunAsGroup) != gid {
+			fail("%s %d does not match runAsGroup %d", v.annotation("kerberos-gid"), gid, *sc.RunAsGroup)
+		}
+		if fsid, ok := ids["kerberos-fsid"]; ok && sc.FSGroup != nil && uint64(*sc.FSGroup) != fsid {
+			fail("%s %d does not match fsGroup %d", v.annotation("kerberos-fsid"), fsid, *sc.FSGroup)
+		}
+	}
+	if enabled && v.strict {
+		for _, name := range []string{"kerberos-uid", "kerberos-gid", "kerberos-fsid"} {
+			if _, ok := ann[v.annotation(name)]; !ok && !(v.securityContextIDs && scIDs[name]) {
+				fail("%s is required", v.annotation(name))
+			}
+		}
+	}
+
+	if value, ok := ann[v.annotation("kerberos-user")]; ok {
+		if err := validateUser(value); err != nil {
+			fail("%s: %v", v.annotation("kerberos-user"), err)
+		}
+	}
+	if value, ok := ann[v.annotation("kerberos-renewal-time")]; ok {
+		if _, err := parseRenewalTime(value); err != nil {
+			fail("%s: %v", v.annotation("kerberos-renewal-time"), err)
+		}
+	}
+	if value, ok := ann[v.annotation(ephemeralAnnotation)]; ok && value != "true" && value != "false" {
+		fail("%s must be true or false, not %q", v.annotation(ephemeralAnnotation), value)
+	}
+	if value, ok := ann[v.annotation(anonymousAnnotation)]; ok && value != "true" && value != "false" {
+		fail("%s must be true or false, not %q", v.annotation(anonymousAnnotation), value)
+	} else if value == "true" {
+		for _, key := range []string{"kerberos-user", ephemeralAnnotation, keytabSecretAnnotation, passwordSecretAnnotation, pkinitSecretAnnotation} {
+			if _, ok := ann[v.annotation(key)]; ok {
+				fail("%s and %s are mutually exclusive", v.annotation(anonymousAnnotation), v.annotation(key))
+			}
+		}
+	}
+	if value, ok := ann[v.annotation(forwardableAnnotation)]; ok && value != "true" && value != "false" {
+		fail("%s must be true or false, not %q", v.annotation(forwardableAnnotation), value)
+	}
+	for _, key := range []string{ticketLifetimeAnnotation, renewLifetimeAnnotation} {
+		if value, ok := ann[v.annotation(key)]; ok {
+			if _, err := parseLifetime(value); err != nil {
+				fail("%s: %v", v.annotation(key), err)
+			}
+		}
+	}
+	if value, ok := ann[v.annotation(gidsAnnotation)]; ok {
+		gids, err := parseGIDs(value)
+		if err != nil {
+			fail("%s: %v", v.annotation(gidsAnnotation), err)
+		}
+		if sc := pod.Spec.SecurityContext; sc != nil && len(sc.SupplementalGroups) > 0 {
+			for _, gid := range gids {
+				if !slices.Contains(sc.SupplementalGroups, int64(gid)) {
+					fail("%s gid %d is not one of supplementalGroups", v.annotation(gidsAnnotation), gid)
+				}
+			}
+		}
+	}
+	if value, ok := ann[v.annotation(hostAliasesAnnotation)]; ok {
+		if _, err := parseHostAliases(value); err != nil {
+			fail("%s: %v", v.annotation(hostAliasesAnnotation), err)
+		}
+	}
+	if value, ok := ann[v.annotation(automountAnnotation)]; ok {
+		if _, err := parseAutomounts(value, nil); err != nil {
+			fail("%s: %v", v.annotation(automountAnnotation), err)
+		}
+	}
+	if value, ok := ann[v.annotation("kerberos-sec")]; ok {
+		if err := validSec(strings.ToLower(value)); err != nil || value == "" {
+			fail("%s must be krb5, krb5i or krb5p, not %q", v.annotation("kerberos-sec"), value)
+		}
+	}
+	for key, value := range ann {
+		if key == v.annotation("kerberos-nfs-version") || strings.HasPrefix(key, v.annotation("kerberos-nfs-version.")) {
+			if err := validNFSVersion(value); err != nil || value == "" {
+				fail("%s must be 3, 4, 4.0, 4.1 or 4.2, not %q", key, value)
+			}
+		}
+	}
+	if value, ok := ann[v.annotation("kerberos-ccache-type")]; ok {
+		if err := validCCacheType(strings.ToUpper(value)); err != nil || value == "" {
+			fail("%s must be FILE, DIR, KEYRING or KCM, not %q", v.annotation("kerberos-ccache-type"), value)
+		}
+	}
+	for key, value := range ann {
+		if strings.HasPrefix(key, v.annotation("kerberos-principal.")) {
+			user, realm, _ := strings.Cut(value, "@")
+			if err := validateUser(user); err != nil {
+				fail("%s: %v", key, err)
+			} else if podRealm, ok := ann[v.annotation("kerberos-realm")]; ok && realm != "" && realm != podRealm {
+				fail("%s must be in realm %s of the pod, not %s", key, podRealm, realm)
+			}
+		}
+	}
+	if value, ok := ann[v.annotation(principalsAnnotation)]; ok {
+		if _, err := parsePrincipals(value, ann[v.annotation("kerberos-realm")]); err != nil {
+			fail("%s: %v", v.annotation(principalsAnnotation), err)
+		}
+	}
+	if value, ok := ann[v.annotation(sharedCCacheAnnotation)]; ok {
+		i := slices.IndexFunc(pod.Spec.Volumes, func(vol podVolume) bool { return vol.Name == value })
+		switch {
+		case i < 0 || pod.Spec.Volumes[i].EmptyDir == nil:
+			fail("%s must name an emptyDir volume of the pod, not %q", v.annotation(sharedCCacheAnnotation), value)
+		case !strings.EqualFold(cmp.Or(ann[v.annotation("kerberos-ccache-type")], ccacheTypeDir), ccacheTypeDir):
+			fail("%s needs the DIR credential cache type", v.annotation(sharedCCacheAnnotation))
+		}
+	}
+	containers := map[string]bool{}
+	for _, c := range pod.allContainers() {
+		containers[c.Name] = true
+	}
+	for key, value := range ann {
+		for _, name := range append([]string{"kerberos-auth", ccachePrincipalAnnotation}, containerAnnotations...) {
+			container, ok := strings.CutPrefix(key, v.annotation(name)+".")
+			if !ok {
+				continue
+			}
+			if !containers[container] {
+				fail("%s names no container of the pod", key)
+			}
+			if _, shared := ann[v.annotation(sharedCCacheAnnotation)]; shared && slices.Contains(containerAnnotations, name) {
+				fail("%s is ignored, the containers share the credentials of the pod by %s", key, v.annotation(sharedCCacheAnnotation))
+			}
+			switch name {
+			case "kerberos-auth":
+				if value != "enabled" && value != "disabled" {
+					fail("%s must be \"enabled\" or \"disabled\", not %q", key, value)
+				}
+			case "kerberos-uid", "kerberos-gid", "kerberos-fsid":
+				if id, err := strconv.ParseUint(value, 10, 32); err != nil || id == 0 {
+					fail("%s must be a positive number, not %q", key, value)
+				}
+			case "kerberos-user":
+				if err := validateUser(value); err != nil {
+					fail("%s: %v", key, err)
+				}
+			case "kerberos-realm":
+				if !realmRegexp.MatchString(value) {
+					fail("%s %q must be upper case", key, value)
+				}
+			case "kerberos-ccache-type":
+				if err := validCCacheType(strings.ToUpper(value)); err != nil || value == "" {
+					fail("%s must be FILE, DIR, KEYRING or KCM, not %q", key, value)
+				}
+			case "kerberos-sec":
+				if err := validSec(strings.ToLower(value)); err != nil || value == "" {
+					fail("%s must be krb5, krb5i or krb5p, not %q", key, value)
+				}
+			}
+		}
+	}
+	var secrets []string
+	for _, key := range []string{keytabSecretAnnotation, passwordSecretAnnotation, pkinitSecretAnnotation} {
+		if value, ok := ann[v.annotation(key)]; ok {
+			if ns, name, found := strings.Cut(value, "/"); name == "" || (found && ns != req.Namespace) {
+				fail("%s must name a Secret in namespace %q", v.annotation(key), req.Namespace)
+			}
+			secrets = append(secrets, v.annotation(key))
+		}
+	}
+	if len(secrets) > 1 {
+		fail("%s are mutually exclusive", strings.Join(secrets, " and "))
+	}
+
+	_, hasRealm := ann[v.annotation("kerberos-realm")]
+	if value, ok := ann[v.annotation("kerberos-realm")]; ok && !realmRegexp.MatchString(value) {
+		fail("%s %q must be upper case", v.annotation("kerberos-realm"), value)
+	}
+	for _, c := range pod.allContainers() {
+		for _, e := range c.Env {
+			switch e.Name {
+			case "KERBEROS_REALM":
+				hasRealm = true
+				if e.ValueFrom == nil && !realmRegexp.MatchString(e.Value) {
+					fail("container %s: KERBEROS_REALM %q must be upper case", c.Name, e.Value)
+				}
+			case "KERBEROS_USER":
+				if e.ValueFrom == nil {
+					if err := validateUser(e.Value); err != nil {
+						fail("container %s: KERBEROS_USER: %v", c.Name, err)
+					}
+				}
+			case "KERBEROS_RENEWAL_TIME":
+				if _, err := parseRenewalTime(e.Value); e.ValueFrom == nil && err != nil {
+					fail("container %s: KERBEROS_RENEWAL_TIME: %v", c.Name, err)
+				}
+			case "KRB5CCNAME":
+				if e.ValueFrom == nil {
+					if _, err := ccachePath(e.Value); err != nil {
+						fail("container %s: KRB5CCNAME: %v", c.Name, err)
+					}
+				}
+			}
+		}
+	}
+	if enabled && v.strict && !hasRealm {
+		fail("neither %s nor KERBEROS_REALM on any container is set", v.annotation("kerberos-realm"))
+	}
+
+	if len(errs) == 0 {
+		rsp := &admissionResponse{Allowed: true}
+		if len(legacy) > 0 {
+			rsp.Warnings = append(rsp.Warnings, fmt.Sprintf("%s are deprecated, use %s instead",
+				strings.Join(legacy, ", "), strings.Join(versionedKeys(legacy, v.annotation), ", ")))
+		}
+		return rsp
+	}
+
+	log.Infof("%s: rejected: %s", pod.name(req.Namespace), strings.Join(errs, "; "))
+	return &admissionResponse{
+		Allowed: false,
+		Result: &admissionStatus{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "invalid Kerberos configuration: " + strings.Join(errs, "; "),
+		},
+	}
+}
+
+// Check a user name, which must come without realm or instance. Names are
+// passed to kinit and the script as arguments and make up paths, so they
+// cannot pass for options or directories either.
+func validateUser(user string) error {
+	switch {
+	case user == "":
+		return errors.New("must not be empty")
+	case strings.ContainsAny(user, "@/"):
+		return fmt.Errorf("%q must be a plain user name, without realm or instance", user)
+	case strings.ContainsAny(user, " \t\n"):
+		return fmt.Errorf("%q must not contain whitespace", user)
+	case strings.ContainsFunc(user, func(r rune) bool { return r == utf8.RuneError || !unicode.IsPrint(r) }):
+		return fmt.Errorf("%q must not contain non-printable characters", user)
+	case strings.HasPrefix(user, "-"):
+		return fmt.Errorf("%q must not start with -", user)
+	case user == "." || user == "..":
+		return fmt.Errorf("%q is not a user name", user)
+	}
+	return nil
+}
+
+// Security contexts of the containers and native sidecars of a pod which have
+// one. Other init containers, as those preparing volumes, may run as others.
+func containerSecurityContexts(pod *admissionPod) []*podSecurityContext {
+	var scs []*podSecurityContext
+	for _, c := range pod.longRunningContainers() {
+		if c.SecurityContext != nil {
+			scs = append(scs, c.SecurityContext)
+		}
+	}
+	return scs
+}
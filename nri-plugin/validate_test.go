@@ -0,0 +1,218 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Decision of the validating webhook on a pod with the annotations, created
+// in namespace default, as the API server gets it in an AdmissionReview.
+func validateReview(t *testing.T, v *validator, ann map[string]string, containers ...podContainer) *admissionResponse {
+	t.Helper()
+	pod := &admissionPod{}
+	pod.Metadata.Name = "app"
+	pod.Metadata.Annotations = ann
+	pod.Spec.Containers = append([]podContainer{{Name: "app"}}, containers...)
+	object, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&admissionReview{
+		APIVersion: "admission.k8s.io/v1",
+		Kind:       "AdmissionReview",
+		Request:    &admissionRequest{UID: "0b5c2f0e", Namespace: "default", Operation: "CREATE", Object: object},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	serveAdmission(v.validate)(w, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/validate status %d: %s", w.Code, w.Body)
+	}
+	review := &admissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil || review.Response.UID != "0b5c2f0e" {
+		t.Fatalf("response %+v does not answer request 0b5c2f0e", review.Response)
+	}
+	return review.Response
+}
+
+func TestValidate(t *testing.T) {
+	valid := map[string]string{
+		"v1alpha2.kerberos.nri.io/auth":  "enabled",
+		"v1alpha2.kerberos.nri.io/user":  "alice",
+		"v1alpha2.kerberos.nri.io/uid":   "61001",
+		"v1alpha2.kerberos.nri.io/gid":   "61001",
+		"v1alpha2.kerberos.nri.io/fsid":  "61001",
+		"v1alpha2.kerberos.nri.io/realm": "EXAMPLE.COM",
+	}
+	with := func(extra ...string) map[string]string {
+		ann := maps.Clone(valid)
+		for i := 0; i+1 < len(extra); i += 2 {
+			ann[extra[i]] = extra[i+1]
+		}
+		return ann
+	}
+	for _, tc := range []struct {
+		name       string
+		strict     bool
+		ann        map[string]string
+		containers []podContainer
+		// Parts of the denial message, allowed if none.
+		wantDenied []string
+		wantWarn   string
+	}{{
+		name: "not managed",
+		ann:  map[string]string{"app": "web"},
+	}, {
+		name:   "valid",
+		strict: true,
+		ann:    valid,
+	}, {
+		name:     "deprecated keys",
+		ann:      map[string]string{testAnnotation("kerberos-auth"): "enabled", testAnnotation("kerberos-user"): "alice"},
+		wantWarn: "nri.io/kerberos-auth, nri.io/kerberos-user are deprecated, use v1alpha2.kerberos.nri.io/auth, v1alpha2.kerberos.nri.io/user instead",
+	}, {
+		name:       "invalid auth",
+		ann:        with("v1alpha2.kerberos.nri.io/auth", "yes"),
+		wantDenied: []string{`nri.io/kerberos-auth must be "enabled" or "disabled", not "yes"`},
+	}, {
+		name:       "invalid uid",
+		ann:        with("v1alpha2.kerberos.nri.io/uid", "0"),
+		wantDenied: []string{`nri.io/kerberos-uid must be a positive number, not "0"`},
+	}, {
+		name:       "invalid user",
+		ann:        with("v1alpha2.kerberos.nri.io/user", "alice@EXAMPLE.COM"),
+		wantDenied: []string{`nri.io/kerberos-user: "alice@EXAMPLE.COM" must be a plain user name, without realm or instance`},
+	}, {
+		name:       "lower case realm",
+		ann:        with("v1alpha2.kerberos.nri.io/realm", "example.com"),
+		wantDenied: []string{`nri.io/kerberos-realm "example.com" must be upper case`},
+	}, {
+		name:       "secret of another namespace",
+		ann:        with("v1alpha2.kerberos.nri.io/keytab-secret", "kube-system/keytabs"),
+		wantDenied: []string{`nri.io/kerberos-keytab-secret must name a Secret in namespace "default"`},
+	}, {
+		name:       "unknown container",
+		ann:        with("v1alpha2.kerberos.nri.io/user.sidecar", "bob"),
+		wantDenied: []string{"nri.io/kerberos-user.sidecar names no container of the pod"},
+	}, {
+		name:       "invalid env",
+		ann:        with(),
+		containers: []podContainer{{Name: "sidecar", Env: []podEnvVar{{Name: "KERBEROS_USER", Value: "-alice"}}}},
+		wantDenied: []string{`container sidecar: KERBEROS_USER: "-alice" must not start with -`},
+	}, {
+		name:   "strict without ids and realm",
+		strict: true,
+		ann:    map[string]string{"v1alpha2.kerberos.nri.io/auth": "enabled"},
+		wantDenied: []string{
+			"nri.io/kerberos-uid is required",
+			"nri.io/kerberos-gid is required",
+			"nri.io/kerberos-fsid is required",
+			"neither nri.io/kerberos-realm nor KERBEROS_REALM on any container is set",
+		},
+	}, {
+		name: "all errors",
+		ann:  with("v1alpha2.kerberos.nri.io/uid", "x", "v1alpha2.kerberos.nri.io/ephemeral", "maybe"),
+		wantDenied: []string{
+			`nri.io/kerberos-uid must be a positive number, not "x"`,
+			`nri.io/kerberos-ephemeral must be true or false, not "maybe"`,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := &validator{annotationPrefix: defaultAnnotationPrefix, strict: tc.strict}
+			rsp := validateReview(t, v, tc.ann, tc.containers...)
+			if len(tc.wantDenied) == 0 {
+				if !rsp.Allowed {
+					t.Fatalf("denied: %+v", rsp.Result)
+				}
+				if tc.wantWarn == "" && len(rsp.Warnings) > 0 || tc.wantWarn != "" && !slices.Contains(rsp.Warnings, tc.wantWarn) {
+					t.Errorf("warnings = %q, want %q", rsp.Warnings, tc.wantWarn)
+				}
+				return
+			}
+			if rsp.Allowed || rsp.Result == nil {
+				t.Fatalf("allowed, want denied for %q", tc.wantDenied)
+			}
+			if rsp.Result.Code != http.StatusUnprocessableEntity {
+				t.Errorf("code = %d, want %d", rsp.Result.Code, http.StatusUnprocessableEntity)
+			}
+			msg, ok := strings.CutPrefix(rsp.Result.Message, "invalid Kerberos configuration: ")
+			if !ok {
+				t.Fatalf("message %q", rsp.Result.Message)
+			}
+			for _, want := range tc.wantDenied {
+				if !slices.Contains(strings.Split(msg, "; "), want) {
+					t.Errorf("message %q does not tell %q", msg, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateUndecodablePod(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"7","namespace":"default","operation":"CREATE","object":{"metadata":{"annotations":"enabled"}}}}`
+	w := httptest.NewRecorder()
+	serveAdmission((&validator{annotationPrefix: defaultAnnotationPrefix}).validate)(w, httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body)))
+	review := &admissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), review); err != nil {
+		t.Fatal(err)
+	}
+	if rsp := review.Response; rsp == nil || rsp.Allowed || rsp.UID != "7" || rsp.Result.Code != http.StatusBadRequest {
+		t.Errorf("response %+v, want request 7 denied as bad", rsp)
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	for _, tc := range []struct {
+		user    string
+		wantErr bool
+	}{
+		{"alice", false},
+		{"svc-nfs_01.batch", false},
+		{"svc$", false},
+		{"", true},
+		{"alice@EXAMPLE.COM", true},
+		{"nfs/server", true},
+		{"alice smith", true},
+		{"alice\tsmith", true},
+		{"-alice", true},
+		{"--help", true},
+		{".", true},
+		{"..", true},
+		{"alice\x00", true},
+		{"alice\x1b[2J", true},
+		{"alice\u200b", true},
+		{"alice\xff", true},
+	} {
+		if err := validateUser(tc.user); (err != nil) != tc.wantErr {
+			t.Errorf("validateUser(%q) error = %v, want error %v", tc.user, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+
+	"github.com/tuminoid/nri-plugins/kerberos-auth/kubeapi"
+)
+
+const (
+	vaultEngineKV       = "kv"
+	vaultEngineKerberos = "kerberos"
+
+	vaultAuthKubernetes = "kubernetes"
+	vaultAuthToken      = "token"
+)
+
+// errVaultForbidden is returned when Vault rejects our token.
+var errVaultForbidden = errors.New("permission denied")
+
+// HashiCorp Vault credential source configuration.
+type vaultConfig struct {
+	// Address of Vault, e.g. https://vault.example.com:8200.
+	Address string `json:"address,omitempty"`
+	// PEM CA bundle for verifying Vault.
+	CACert string `json:"caCert,omitempty"`
+	// Authentication to Vault.
+	Auth vaultAuthConfig `json:"auth,omitempty"`
+	// Secrets engine, kv (KV version 2, default) or kerberos.
+	Engine string `json:"engine,omitempty"`
+	// Mount path of the secrets engine, "secret" or "kerberos" by default.
+	Mount string `json:"mount,omitempty"`
+	// Secret path used for namespaces without an entry in NamespacePaths.
+	// {namespace}, {pod} and {user} are substituted. Empty limits Vault to NamespacePaths.
+	DefaultPath string `json:"defaultPath,omitempty"`
+	// Secret paths per namespace, with the same substitutions as DefaultPath.
+	NamespacePaths map[string]string `json:"namespacePaths,omitempty"`
+}
+
+// Vault authentication configuration.
+type vaultAuthConfig struct {
+	// Method is kubernetes (default) or token.
+	Method string `json:"method,omitempty"`
+	// Mount path of the kubernetes auth method, "kubernetes" by default.
+	Mount string `json:"mount,omitempty"`
+	// Vault role for kubernetes auth.
+	Role string `json:"role,omitempty"`
+	// Service account token for kubernetes auth, or Vault token for token auth.
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// Keytabs and passwords from Vault.
+type vaultSource struct {
+	cfg  vaultConfig
+	http *http.Client
+
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Create the Vault credential source, nil if Vault is not configured.
+func newVaultSource(cfg vaultConfig) (*vaultSource, error) {
+	if cfg.Address == "" {
+		return nil, nil
+	}
+
+	switch cfg.Engine {
+	case "":
+		cfg.Engine = vaultEngineKV
+	case vaultEngineKV, vaultEngineKerberos:
+	default:
+		return nil, fmt.Errorf("invalid Vault secrets engine %q", cfg.Engine)
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = map[string]string{vaultEngineKV: "secret", vaultEngineKerberos: "kerberos"}[cfg.Engine]
+	}
+
+	switch cfg.Auth.Method {
+	case "":
+		cfg.Auth.Method = vaultAuthKubernetes
+	case vaultAuthKubernetes, vaultAuthToken:
+	default:
+		return nil, fmt.Errorf("invalid Vault auth method %q", cfg.Auth.Method)
+	}
+	if cfg.Auth.Mount == "" {
+		cfg.Auth.Mount = "kubernetes"
+	}
+	if cfg.Auth.TokenFile == "" {
+		if cfg.Auth.Method != vaultAuthKubernetes {
+			return nil, errors.New("Vault token auth needs a tokenFile")
+		}
+		cfg.Auth.TokenFile = kubeapi.InClusterTokenFile
+	}
+	if cfg.Auth.Method == vaultAuthKubernetes && cfg.Auth.Role == "" {
+		return nil, errors.New("Vault kubernetes auth needs a role")
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		ca, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("failed to parse Vault CA")
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	return &vaultSource{
+		cfg: cfg,
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+func (v *vaultSource) Name() string {
+	return "Vault " + v.cfg.Address
+}
+
+// Check whether Vault holds credentials for workloads in the namespace.
+func (v *vaultSource) handles(namespace string) bool {
+	_, ok := v.cfg.NamespacePaths[namespace]
+	return ok || v.cfg.DefaultPath != ""
+}
+
+func (v *vaultSource) Fetch(ctx context.Context, pod *api.PodSandbox, kp *kerberosParams) (*credential, error) {
+	path, ok := v.cfg.NamespacePaths[pod.GetNamespace()]
+	if !ok {
+		path = v.cfg.DefaultPath
+	}
+	path = secretPath(path, pod, kp)
+
+	var url string
+	if v.cfg.Engine == vaultEngineKV {
+		url = fmt.Sprintf("/v1/%s/data/%s", v.cfg.Mount, path)
+	} else {
+		url = fmt.Sprintf("/v1/%s/creds/%s", v.cfg.Mount, path)
+	}
+
+	data, err := v.read(ctx, url)
+	if errors.Is(err, errVaultForbidden) {
+		// token may have been revoked early, log in again once
+		v.Lock()
+		v.token = ""
+		v.Unlock()
+		data, err = v.read(ctx, url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if kt, ok := data["keytab"].(string); ok && kt != "" {
+		keytab, err := base64.StdEncoding.DecodeString(kt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keytab at %s: %w", path, err)
+		}
+		return &credential{Keytab: keytab}, nil
+	}
+	if pw, ok := data["password"].(string); ok && pw != "" {
+		return &credential{Password: pw}, nil
+	}
+
+	return nil, fmt.Errorf("no keytab or password at %s", path)
+}
+
+// Read a secret, returning its (for KV, innermost) data.
+func (v *vaultSource) read(ctx context.Context, path string) (map[string]any, error) {
+	token, err := v.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := struct {
+		Data map[string]any `json:"data"`
+	}{}
+	if err := v.do(ctx, http.MethodGet, path, token, nil, &rsp); err != nil {
+		return nil, err
+	}
+
+	if v.cfg.Engine == vaultEngineKV {
+		inner, _ := rsp.Data["data"].(map[string]any)
+		return inner, nil
+	}
+	return rsp.Data, nil
+}
+
+// Get a valid Vault token, logging in if necessary.
+func (v *vaultSource) login(ctx context.Context) (string, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.token != "" && (v.expires.IsZero() || time.Now().Before(v.expires)) {
+		return v.token, nil
+	}
+
+	secret, err := os.ReadFile(v.cfg.Auth.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Vault auth token: %w", err)
+	}
+
+	if v.cfg.Auth.Method == vaultAuthToken {
+		v.token, v.expires = strings.TrimSpace(string(secret)), time.Time{}
+		return v.token, nil
+	}
+
+	req := map[string]string{
+		"role": v.cfg.Auth.Role,
+		"jwt":  strings.TrimSpace(string(secret)),
+	}
+	rsp := struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}{}
+	if err := v.do(ctx, http.MethodPost, "/v1/auth/"+v.cfg.Auth.Mount+"/login", "", req, &rsp); err != nil {
+		return "", fmt.Errorf("Vault login failed: %w", err)
+	}
+
+	v.token = rsp.Auth.ClientToken
+	// renew at 80% of the lease to stay clear of expiry
+	v.expires = time.Now().Add(time.Duration(rsp.Auth.LeaseDuration) * time.Second * 8 / 10)
+
+	return v.token, nil
+}
+
+func (v *vaultSource) do(ctx context.Context, method, path, token string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.cfg.Address, "/")+path, rd)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := v.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	switch {
+	case rsp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s %s: %w", method, path, errVaultForbidden)
+	case rsp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s %s: %w", method, path, errNotFound)
+	case rsp.StatusCode < 200 || rsp.StatusCode > 299:
+		return fmt.Errorf("%s %s failed: %s", method, path, rsp.Status)
+	}
+
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,197 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Header of the .k5identity files the plugin writes, which it may replace.
+const k5identityHeader = "# Managed by nri-kerberos, do not edit.\n"
+
+// Parameters for the credentials of a principal volumes of the pod are mapped
+// to, kept in a cache next to that of the pod in its collection and used for
+// the NFS servers of the volumes.
+func (kp *kerberosParams) forVolumes(user string, volumes, servers []string) *kerberosParams {
+	vp := *kp
+	path, _ := ccachePath(kp.CCName)
+	vp.User, vp.Name, vp.Password, vp.Keytab, vp.PKINIT = user, "", "", "", nil
+	vp.CCName = "DIR::" + filepath.Join(filepath.Dir(path), dirCCacheName+"."+user)
+	vp.NFS, vp.NFSServers = servers[0], servers
+	vp.VolumePrincipals, vp.Volumes = nil, volumes
+	vp.GSSProxy = false
+	return &vp
+}
+
+// Obtain the credentials of the principals volumes of the pod are mapped to,
+// into the credential cache collection of the pod, and have rpc.gssd pick them
+// for the NFS servers of these volumes. rpc.gssd is asked for credentials by
+// uid and server, so volumes of a server can only be accessed as one principal.
+// Credentials still valid in the collection, as after a restart, are kept.
+func (p *plugin) setupVolumePrincipals(ctx context.Context, l *logrus.Entry, cfg *config, pod *api.PodSandbox, kp *kerberosParams) error {
+	if len(kp.VolumePrincipals) == 0 || pod.GetUid() == "" {
+		return nil
+	}
+	mounts, err := podVolumeMounts(p.mounter, cfg.MountCheck.kubeletDir(), pod.GetUid())
+	if err != nil {
+		return err
+	}
+
+	// principals the NFS servers of the pod are accessed as, and volumes and
+	// servers by principal
+	serverUsers := map[string]map[string]bool{}
+	volumes, servers := map[string][]string{}, map[string][]string{}
+	for mountPoint, m := range mounts {
+		v := kubeletVolumeRegexp.FindStringSubmatch(mountPoint)
+		if v == nil {
+			continue
+		}
+		server, _ := splitNFSSource(m.source)
+		user, ok := kp.VolumePrincipals[v[1]]
+		if !ok {
+			user = kp.User
+		}
+		if serverUsers[server] == nil {
+			serverUsers[server] = map[string]bool{}
+		}
+		serverUsers[server][user] = true
+		volumes[user] = append(volumes[user], v[1])
+		if !slices.Contains(servers[user], server) {
+			servers[user] = append(servers[user], server)
+		}
+	}
+	for volume, user := range kp.VolumePrincipals {
+		if !slices.Contains(volumes[user], volume) {
+			l.Warnf("volume %s of principal %s is not an NFS volume of the pod", volume, user)
+			p.events.warn(pod, reasonConfigIncomplete, "volume %s of principal %s is not an NFS volume of the pod", volume, user)
+		}
+	}
+
+	for _, user := range slices.Sorted(maps.Keys(volumes)) {
+		if user == kp.User {
+			continue
+		}
+		var own []string
+		for _, server := range servers[user] {
+			if len(serverUsers[server]) > 1 {
+				l.Warnf("volumes on %s are accessed as %s and others, which rpc.gssd cannot tell apart, using %s for all",
+					server, user, kp.Principal())
+				p.events.warn(pod, reasonConfigIncomplete, "volumes on %s are mapped to different principals, using %s for all",
+					server, kp.Principal())
+				continue
+			}
+			own = append(own, server)
+		}
+		if len(own) == 0 {
+			continue
+		}
+		slices.Sort(volumes[user])
+		vp := kp.forVolumes(user, volumes[user], own)
+		if p.managedParamsOf(managedKey(pod, vp)) != nil {
+			continue
+		}
+		if err := checkCCache(vp.CCName, vp.Realm, p.clock.Now().Add(syncMinLifetime)); err != nil {
+			if err := p.setupPrincipal(ctx, l, pod, vp); err != nil {
+				return fmt.Errorf("setup of credentials for %s of volumes %s failed: %w",
+					vp.Principal(), strings.Join(vp.Volumes, ", "), err)
+			}
+		}
+		l.Infof("volumes %s use credentials for %s", strings.Join(vp.Volumes, ", "), vp.Principal())
+		p.track(pod, vp, l)
+	}
+	p.writeK5Identity(l, kp.UID, kp.GID)
+	return nil
+}
+
+// Obtain the credentials of a volume or further principal of a pod.
+func (p *plugin) setupPrincipal(ctx context.Context, l *logrus.Entry, pod *api.PodSandbox, vp *kerberosParams) error {
+	if err := prepareCollection(vp.CCName, int(vp.UID), int(vp.GID)); err != nil {
+		return err
+	}
+	err := p.fetchCredentials(ctx, pod, vp)
+	if err == nil {
+		l.Infof("setting up Kerberos credentials for %s", vp.Principal())
+		if err = p.backend.Setup(ctx, vp); err != nil {
+			err = fmt.Errorf("kerberos setup failed: %w", err)
+		}
+	}
+	p.auditOp("setup", pod, vp.Container, vp, err)
+	return err
+}
+
+// Write the .k5identity file of a uid, selecting the credentials of its volume
+// principals in its collection for the NFS servers of their volumes, or remove
+// it once there are none. Kerberos finds the file in the home directory of the
+// uid, which it has to have on the node.
+func (p *plugin) writeK5Identity(l *logrus.Entry, uid, gid uint64) {
+	rules := &bytes.Buffer{}
+	p.Lock()
+	for _, key := range slices.Sorted(maps.Keys(p.managed)) {
+		kp := p.managed[key].params
+		if kp.UID != uid || len(kp.Volumes) == 0 {
+			continue
+		}
+		for _, server := range kp.nfsServers() {
+			fmt.Fprintf(rules, "%s service=nfs host=%s\n", kp.Principal(), server)
+		}
+	}
+	p.Unlock()
+
+	account, err := user.LookupId(strconv.FormatUint(uid, 10))
+	if err != nil || account.HomeDir == "" {
+		if rules.Len() > 0 {
+			l.Warnf("uid %d has no home directory for .k5identity, NFS volumes use the primary credentials", uid)
+		}
+		return
+	}
+	path := filepath.Join(account.HomeDir, ".k5identity")
+	if rules.Len() == 0 {
+		if old, err := os.ReadFile(path); err == nil && bytes.HasPrefix(old, []byte(k5identityHeader)) {
+			_ = os.Remove(path)
+		}
+		return
+	}
+	if old, err := os.ReadFile(path); err == nil && !bytes.HasPrefix(old, []byte(k5identityHeader)) {
+		l.Warnf("%s is not managed by the plugin, leaving it alone", path)
+		return
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		l.Warnf("cannot read %s: %v", path, err)
+		return
+	}
+	// #nosec G306:gosec -- .k5identity holds no secrets
+	if _, err := installFile(path, append([]byte(k5identityHeader), rules.Bytes()...), 0644); err != nil {
+		l.Warn(err)
+		return
+	}
+	if err := os.Chown(path, int(uid), int(gid)); err != nil {
+		l.Warnf("failed to set %s ownership: %v", path, err)
+	}
+}